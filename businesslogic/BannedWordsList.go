@@ -16,58 +16,316 @@
 package businesslogic
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"justthetalk/connections"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"justthetalk/utils"
 	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
-	"gorm.io/gorm"
+	"github.com/google/uuid"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// bannedWordsReloadChannel tells every API instance to reload the banned
+// words list
+const bannedWordsReloadChannel = "cache:banned_words"
+
 type BannedWordsEntry struct {
-	Id      int            `gorm:"column:id"`
-	Version int            `gorm:"column:version"`
-	Pattern string         `gorm:"column:word"`
-	re      *regexp.Regexp `gorm:"-"`
+	model.BannedWord
+	re      *regexp.Regexp
+	folders map[uint]bool
+}
+
+// appliesTo is true when the entry isn't limited to particular folders or
+// folderId is one of them
+func (entry *BannedWordsEntry) appliesTo(folderId uint) bool {
+	return len(entry.folders) == 0 || entry.folders[folderId]
+}
+
+// bannedWordSeverity ranks the actions so that the most severe one wins
+var bannedWordSeverity = map[string]int{
+	model.BannedWordActionMask:   1,
+	model.BannedWordActionWatch:  2,
+	model.BannedWordActionHold:   3,
+	model.BannedWordActionReject: 4,
+}
+
+// BannedWordsCheck is the outcome of checking some text. Text has every
+// match of a masking entry replaced with asterisks; Action is the most
+// severe action of all the entries which matched, or empty if none did.
+type BannedWordsCheck struct {
+	Text    string
+	Action  string
+	WordIds []uint
+	// Matched is the text which decided the action
+	Matched string
 }
 
+// BannedWordsList is swapped in whole on reload in the same way as
+// FolderCache, so posts are always checked against one consistent list
 type BannedWordsList struct {
-	bannedWords []*BannedWordsEntry
+	provider   repository.Provider
+	entries    atomic.Value
+	shared     sharedCacheTier
+	instanceId string
+	reloadLock sync.Mutex
+	quit       chan struct{}
+	done       chan struct{}
+	stopOnce   sync.Once
+	isStarted  bool
+}
+
+// bannedWordsReload is broadcast when the banned words change. Instances
+// ignore their own messages as they have already reloaded.
+type bannedWordsReload struct {
+	Instance string `json:"instance"`
+}
+
+func NewBannedWordsList(provider repository.Provider) (*BannedWordsList, error) {
+
+	wordList := &BannedWordsList{
+		provider:   provider,
+		shared:     &redisCacheTier{},
+		instanceId: uuid.New().String(),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	if err := wordList.Reload(); err != nil {
+		return nil, err
+	}
+
+	return wordList, nil
+
+}
+
+// compileBannedWord checks that a pattern can be used as a banned word. A
+// pattern which matches an empty string would catch every post.
+func compileBannedWord(pattern string) (*regexp.Regexp, error) {
+
+	if len(pattern) == 0 || len(pattern) > 255 {
+		return nil, errors.New("pattern must be 1 to 255 characters")
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("pattern is not a valid regular expression: %v", err)
+	}
+
+	if re.MatchString("") {
+		return nil, errors.New("pattern matches everything")
+	}
+
+	return re, nil
+
 }
 
-func NewBannedWordsList() *BannedWordsList {
+// Start listens for reloads requested by the other instances
+func (list *BannedWordsList) Start(ctx context.Context) error {
 
-	wordList := BannedWordsList{
-		bannedWords: make([]*BannedWordsEntry, 0),
+	if list.isStarted {
+		return errors.New("banned words list already started")
 	}
 
-	connections.WithDatabase(1*time.Second, func(db *gorm.DB) {
-		if result := db.Raw("select * from banned_word").Scan(&wordList.bannedWords); result.Error != nil {
-			panic(result.Error)
+	list.isStarted = true
+	go list.listen(ctx)
+
+	return nil
+
+}
+
+func (list *BannedWordsList) Stop(ctx context.Context) error {
+
+	list.stopOnce.Do(func() {
+		close(list.quit)
+	})
+
+	if !list.isStarted {
+		return nil
+	}
+
+	select {
+	case <-list.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stopping banned words list: %w", ctx.Err())
+	}
+
+}
+
+func (list *BannedWordsList) listen(ctx context.Context) {
+
+	defer close(list.done)
+
+	subscription := connections.RedisConnection().Subscribe(ctx, bannedWordsReloadChannel)
+	defer subscription.Close()
+
+	messages := subscription.Channel()
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			list.handleReload([]byte(message.Payload))
+		case <-list.quit:
+			return
+		case <-ctx.Done():
+			return
 		}
+	}
+
+}
+
+func (list *BannedWordsList) handleReload(payload []byte) {
+
+	var message bannedWordsReload
+	if err := json.Unmarshal(payload, &message); err != nil {
+		log.Errorf("BannedWordsList: unreadable reload %q: %v", payload, err)
+		return
+	}
+
+	if message.Instance == list.instanceId {
+		return
+	}
+
+	if err := list.Reload(); err != nil {
+		log.Errorf("BannedWordsList: reload: %v", err)
+	}
+
+}
+
+// Reload reads the banned words from the database and swaps them in. A
+// pattern which doesn't compile is logged and left out rather than stopping
+// the others from being applied.
+func (list *BannedWordsList) Reload() error {
+
+	list.reloadLock.Lock()
+	defer list.reloadLock.Unlock()
+
+	var words []*model.BannedWord
+	var err error
+	list.provider.WithRepository(1*time.Second, func(repo repository.Repository) {
+		words, err = repo.Moderation().GetBannedWords()
 	})
 
-	for _, entry := range wordList.bannedWords {
-		entry.re = regexp.MustCompile(entry.Pattern)
+	if err != nil {
+		return utils.InternalError(err)
+	}
+
+	entries := make([]*BannedWordsEntry, 0, len(words))
+	for _, word := range words {
+		re, err := compileBannedWord(word.Pattern)
+		if err != nil {
+			log.Errorf("BannedWordsList: skipping banned word %d: %v", word.Id, err)
+			continue
+		}
+		if _, known := bannedWordSeverity[word.Action]; !known {
+			log.Errorf("BannedWordsList: banned word %d has unknown action %q, holding instead", word.Id, word.Action)
+			word.Action = model.BannedWordActionHold
+		}
+		entry := &BannedWordsEntry{
+			BannedWord: *word,
+			re:         re,
+			folders:    make(map[uint]bool),
+		}
+		for _, folderId := range word.FolderIds {
+			entry.folders[folderId] = true
+		}
+		entries = append(entries, entry)
+	}
+
+	list.entries.Store(entries)
+
+	return nil
+
+}
+
+// Changed reloads this instance's list and tells the other instances to do
+// the same
+func (list *BannedWordsList) Changed() error {
+
+	if err := list.Reload(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&bannedWordsReload{Instance: list.instanceId})
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancelFn()
+
+	if err := list.shared.Publish(ctx, bannedWordsReloadChannel, data); err != nil {
+		log.Errorf("BannedWordsList: publishing reload: %v", err)
 	}
 
-	return &wordList
+	return nil
+
+}
 
+func (list *BannedWordsList) current() []*BannedWordsEntry {
+	entries, _ := list.entries.Load().([]*BannedWordsEntry)
+	return entries
 }
 
-func (list *BannedWordsList) CheckForBannedWords(text string) bool {
+// Check finds the banned words in text which apply to the folder
+func (list *BannedWordsList) Check(text string, folderId uint) *BannedWordsCheck {
 
-	var found bool
+	check := &BannedWordsCheck{
+		Text:    text,
+		WordIds: make([]uint, 0),
+	}
+
+	// every entry is matched against the original text so that masking one
+	// word cannot hide a stricter rule which matches around it
+	masks := make([]*BannedWordsEntry, 0)
+	for _, entry := range list.current() {
 
-	for _, entry := range list.bannedWords {
-		if entry.re.MatchString(text) {
-			log.Warnf("%s=%s\n", text, entry.Pattern)
-			found = true
-			break
+		if !entry.appliesTo(folderId) {
+			continue
 		}
+
+		matched := entry.re.FindString(text)
+		if len(matched) == 0 {
+			continue
+		}
+
+		check.WordIds = append(check.WordIds, entry.Id)
+
+		if entry.Action == model.BannedWordActionMask {
+			masks = append(masks, entry)
+		}
+
+		if bannedWordSeverity[entry.Action] > bannedWordSeverity[check.Action] {
+			check.Action = entry.Action
+			check.Matched = matched
+		}
+
+	}
+
+	for _, entry := range masks {
+		check.Text = entry.re.ReplaceAllStringFunc(check.Text, func(match string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(match))
+		})
+	}
+
+	if len(check.WordIds) > 0 {
+		log.Warnf("BannedWordsList: folder %d matched %v, action %s", folderId, check.WordIds, check.Action)
 	}
 
-	return found
+	return check
 
 }
@@ -0,0 +1,337 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"encoding/json"
+	"errors"
+	"justthetalk/config"
+	"justthetalk/model"
+	"justthetalk/repository/memory"
+	"justthetalk/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newUnitBannedWordsList(t *testing.T, store *memory.Store) (*BannedWordsList, *fakeCacheTier) {
+
+	list, err := NewBannedWordsList(store)
+	require.NoError(t, err)
+
+	shared := newFakeCacheTier()
+	list.shared = shared
+
+	return list, shared
+
+}
+
+func catches(list *BannedWordsList, text string) bool {
+	return len(list.Check(text, 0).WordIds) > 0
+}
+
+func TestBannedWordsListSkipsBadPatterns(t *testing.T) {
+
+	store := memory.NewStore()
+	store.AddBannedWord("(unclosed")
+	store.AddBannedWord("x*")
+	store.AddBannedWord("spam")
+
+	list, _ := newUnitBannedWordsList(t, store)
+
+	assert.Len(t, list.current(), 1)
+	assert.True(t, catches(list, "buy spam now"))
+	assert.False(t, catches(list, "nothing to see"))
+
+}
+
+func TestBannedWordsAdmin(t *testing.T) {
+
+	store := memory.NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	list, shared := newUnitBannedWordsList(t, store)
+	folderCache, err := NewFolderCache(store)
+	require.NoError(t, err)
+
+	_, err = CreateBannedWord(&model.BannedWord{Pattern: "(unclosed", Action: "shout", FolderIds: []uint{folder.Id + 100}}, list, folderCache, store)
+	var typedErr *utils.Error
+	if assert.True(t, errors.As(err, &typedErr)) {
+		assert.Equal(t, utils.ErrorCodeValidationFailed, typedErr.Code)
+		if assert.Len(t, typedErr.Fields, 3) {
+			assert.Equal(t, "pattern", typedErr.Fields[0].Field)
+			assert.Equal(t, "action", typedErr.Fields[1].Field)
+			assert.Equal(t, "folderIds", typedErr.Fields[2].Field)
+		}
+	}
+
+	_, err = CreateBannedWord(&model.BannedWord{Pattern: ".*"}, list, folderCache, store)
+	assert.True(t, errors.Is(err, utils.ErrBadRequest), "a pattern matching everything is refused")
+
+	words, err := GetBannedWords(store)
+	require.NoError(t, err)
+	assert.Empty(t, words, "nothing invalid is saved")
+
+	created, err := CreateBannedWord(&model.BannedWord{Pattern: " eggs "}, list, folderCache, store)
+	require.NoError(t, err)
+	assert.Equal(t, "eggs", created.Pattern)
+	assert.Equal(t, model.BannedWordActionHold, created.Action, "words are held by default")
+	assert.True(t, catches(list, "green eggs"))
+	assert.Len(t, shared.published, 1)
+
+	updated, err := UpdateBannedWord(created.Id, &model.BannedWord{Pattern: "ham"}, list, folderCache, store)
+	require.NoError(t, err)
+	assert.Equal(t, created.Version+1, updated.Version)
+	assert.False(t, catches(list, "green eggs"))
+	assert.True(t, catches(list, "and ham"))
+
+	_, err = UpdateBannedWord(created.Id+100, &model.BannedWord{Pattern: "ham"}, list, folderCache, store)
+	assert.True(t, errors.Is(err, utils.ErrNotFound))
+
+	require.NoError(t, DeleteBannedWord(created.Id, list, store))
+	assert.False(t, catches(list, "and ham"))
+	assert.True(t, errors.Is(DeleteBannedWord(created.Id, list, store), utils.ErrNotFound))
+
+}
+
+func TestBannedWordsListReloadsOnOtherInstancesChanges(t *testing.T) {
+
+	store := memory.NewStore()
+	list, _ := newUnitBannedWordsList(t, store)
+
+	store.AddBannedWord("spam")
+
+	own, err := json.Marshal(&bannedWordsReload{Instance: list.instanceId})
+	require.NoError(t, err)
+	list.handleReload(own)
+	assert.False(t, catches(list, "spam"), "an instance ignores its own reloads")
+
+	other, err := json.Marshal(&bannedWordsReload{Instance: "other"})
+	require.NoError(t, err)
+	list.handleReload(other)
+	assert.True(t, catches(list, "spam"))
+
+}
+
+func TestTestBannedWordShowsRecentMatches(t *testing.T) {
+
+	store := memory.NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+	discussion, err := store.Discussions().Create(folder.Id, "Breakfast", "", user.Id, false)
+	require.NoError(t, err)
+
+	var posts []*model.Post
+	for _, text := range []string{"green eggs", "toast", "boiled eggs"} {
+		post, err := store.Posts().Create(folder.Id, discussion.Id, text, model.PostStatusOK, user.Id)
+		require.NoError(t, err)
+		posts = append(posts, post)
+	}
+
+	discussionCache := newUnitDiscussionCache(t, config.Default().DiscussionCache, store, newFakeCacheTier())
+
+	result, err := TestBannedWord(&model.BannedWord{Pattern: "eggs"}, 2, discussionCache.folderCache, discussionCache, store)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Scanned, "only the most recent posts are read")
+	if assert.Len(t, result.Matches, 1) {
+		assert.Equal(t, posts[2].Id, result.Matches[0].Id)
+		assert.NotEmpty(t, result.Matches[0].Url)
+	}
+
+	words, err := GetBannedWords(store)
+	require.NoError(t, err)
+	assert.Empty(t, words, "a test doesn't save the pattern")
+
+	_, err = TestBannedWord(&model.BannedWord{Pattern: "eggs"}, 0, discussionCache.folderCache, discussionCache, store)
+	assert.True(t, errors.Is(err, utils.ErrBadRequest))
+
+}
+
+func TestBannedWordsCheck(t *testing.T) {
+
+	store := memory.NewStore()
+	sport := store.AddFolder(&model.Folder{Key: "sport", Description: "Sport", Type: model.FolderTypeNormal})
+	general := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+
+	words := make(map[string]*model.BannedWord)
+	for pattern, action := range map[string]string{
+		"darn":  model.BannedWordActionMask,
+		"cheap": model.BannedWordActionWatch,
+		"spam":  model.BannedWordActionHold,
+		"scam":  model.BannedWordActionReject,
+	} {
+		word, err := store.Moderation().CreateBannedWord(pattern, action, nil)
+		require.NoError(t, err)
+		words[pattern] = word
+	}
+	offside, err := store.Moderation().CreateBannedWord("offside", model.BannedWordActionHold, []uint{sport.Id})
+	require.NoError(t, err)
+
+	_, err = store.Moderation().CreateBannedWord("ass", model.BannedWordActionMask, nil)
+	require.NoError(t, err)
+	_, err = store.Moderation().CreateBannedWord("kill.*ass", model.BannedWordActionReject, nil)
+	require.NoError(t, err)
+
+	list, _ := newUnitBannedWordsList(t, store)
+
+	check := list.Check("nothing to see", general.Id)
+	assert.Equal(t, "", check.Action)
+	assert.Empty(t, check.WordIds)
+
+	check = list.Check("darn it, darn it all", general.Id)
+	assert.Equal(t, model.BannedWordActionMask, check.Action)
+	assert.Equal(t, "**** it, **** it all", check.Text)
+
+	check = list.Check("darn cheap spam", general.Id)
+	assert.Equal(t, model.BannedWordActionHold, check.Action, "the most severe action wins")
+	assert.Equal(t, "spam", check.Matched)
+	assert.Equal(t, "**** cheap spam", check.Text)
+	assert.ElementsMatch(t, []uint{words["darn"].Id, words["cheap"].Id, words["spam"].Id}, check.WordIds)
+
+	check = list.Check("a cheap scam", general.Id)
+	assert.Equal(t, model.BannedWordActionReject, check.Action)
+	assert.Equal(t, "scam", check.Matched)
+
+	check = list.Check("i will kill your ass", general.Id)
+	assert.Equal(t, model.BannedWordActionReject, check.Action, "masking does not hide words from other rules")
+	assert.Equal(t, "i will kill your ***", check.Text)
+
+	assert.Equal(t, "", list.Check("that was offside", general.Id).Action, "scoped words only apply in their folders")
+	check = list.Check("that was offside", sport.Id)
+	assert.Equal(t, model.BannedWordActionHold, check.Action)
+	assert.Equal(t, []uint{offside.Id}, check.WordIds)
+
+}
+
+func TestCreatePostAppliesBannedWordActions(t *testing.T) {
+
+	store := memory.NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+	discussion, err := store.Discussions().Create(folder.Id, "Words", "", user.Id, false)
+	require.NoError(t, err)
+
+	darn, err := store.Moderation().CreateBannedWord("darn", model.BannedWordActionMask, nil)
+	require.NoError(t, err)
+	_, err = store.Moderation().CreateBannedWord("cheap", model.BannedWordActionWatch, nil)
+	require.NoError(t, err)
+	_, err = store.Moderation().CreateBannedWord("spam", model.BannedWordActionHold, nil)
+	require.NoError(t, err)
+	_, err = store.Moderation().CreateBannedWord("scam", model.BannedWordActionReject, nil)
+	require.NoError(t, err)
+
+	list, _ := newUnitBannedWordsList(t, store)
+	previous := BannedWords()
+	SetBannedWords(list)
+	defer SetBannedWords(previous)
+
+	discussionCache := newUnitDiscussionCache(t, config.Default().DiscussionCache, store, newFakeCacheTier())
+
+	post := func(text string) (*model.Post, error) {
+		return CreatePost(folder, discussion, user, &model.Post{Text: text}, discussionCache, nil, store)
+	}
+
+	masked, err := post("oh darn")
+	require.NoError(t, err)
+	assert.Equal(t, "oh ****", masked.Text)
+	assert.Equal(t, model.PostStatusOK, masked.Status)
+
+	matches, err := store.Moderation().GetBannedWordMatches([]uint{masked.Id})
+	require.NoError(t, err)
+	assert.Equal(t, []uint{darn.Id}, matches[masked.Id], "matches are recorded for moderators")
+
+	watched, err := post("cheap watches")
+	require.NoError(t, err)
+	assert.Equal(t, model.PostStatusWatch, watched.Status)
+
+	held, err := post("more spam")
+	require.NoError(t, err)
+	assert.Equal(t, model.PostStatusSuspendedByAdmin, held.Status)
+
+	_, err = post("a scam")
+	var typedErr *utils.Error
+	if assert.True(t, errors.As(err, &typedErr)) {
+		assert.Equal(t, utils.ErrorCodeBannedWord, typedErr.Code)
+		assert.Equal(t, "text", typedErr.Fields[0].Field)
+	}
+
+	_, err = CreateDiscussion(folder, &model.Discussion{Title: "Another scam"}, user, nil, discussionCache, nil, store)
+	assert.True(t, errors.Is(err, utils.ErrBadRequest), "discussions can be rejected too")
+
+}
+
+func TestEditPostAppliesBannedWordActions(t *testing.T) {
+
+	store := memory.NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+	discussion, err := store.Discussions().Create(folder.Id, "Words", "", user.Id, false)
+	require.NoError(t, err)
+
+	darn, err := store.Moderation().CreateBannedWord("darn", model.BannedWordActionMask, nil)
+	require.NoError(t, err)
+	_, err = store.Moderation().CreateBannedWord("cheap", model.BannedWordActionWatch, nil)
+	require.NoError(t, err)
+	_, err = store.Moderation().CreateBannedWord("spam", model.BannedWordActionHold, nil)
+	require.NoError(t, err)
+	_, err = store.Moderation().CreateBannedWord("scam", model.BannedWordActionReject, nil)
+	require.NoError(t, err)
+
+	list, _ := newUnitBannedWordsList(t, store)
+	previous := BannedWords()
+	SetBannedWords(list)
+	defer SetBannedWords(previous)
+
+	discussionCache := newUnitDiscussionCache(t, config.Default().DiscussionCache, store, newFakeCacheTier())
+
+	edit := func(text string) (*model.Post, error) {
+		post, err := CreatePost(folder, discussion, user, &model.Post{Text: "all good"}, discussionCache, nil, store)
+		require.NoError(t, err)
+		return EditPost(folder, discussion, user, &model.Post{ModelBase: model.ModelBase{Id: post.Id}, Text: text}, store)
+	}
+
+	masked, err := edit("oh darn")
+	require.NoError(t, err)
+	assert.Equal(t, "oh ****", masked.Text)
+	assert.Equal(t, model.PostStatusOK, masked.Status)
+
+	matches, err := store.Moderation().GetBannedWordMatches([]uint{masked.Id})
+	require.NoError(t, err)
+	assert.Equal(t, []uint{darn.Id}, matches[masked.Id])
+
+	watched, err := edit("cheap watches")
+	require.NoError(t, err)
+	assert.Equal(t, model.PostStatusWatch, watched.Status)
+
+	held, err := edit("more spam")
+	require.NoError(t, err)
+	assert.Equal(t, model.PostStatusSuspendedByAdmin, held.Status)
+
+	queue, err := store.Moderation().GetQueueEntries()
+	require.NoError(t, err)
+	queued := make([]uint, 0)
+	for _, entry := range queue {
+		queued = append(queued, entry.PostId)
+	}
+	assert.ElementsMatch(t, []uint{watched.Id, held.Id}, queued, "edited posts are queued for the moderators")
+
+	_, err = edit("a scam")
+	var typedErr *utils.Error
+	if assert.True(t, errors.As(err, &typedErr)) {
+		assert.Equal(t, utils.ErrorCodeBannedWord, typedErr.Code)
+	}
+
+}
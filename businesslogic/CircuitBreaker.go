@@ -0,0 +1,136 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	CircuitClosed   = 0
+	CircuitOpen     = 1
+	CircuitHalfOpen = 2
+)
+
+var circuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "justthetalk_circuit_breaker_state",
+	Help: "State of each circuit breaker: 0 closed, 1 open, 2 half open",
+}, []string{"name"})
+
+// circuitBreaker stops calls to a dependency which keeps failing so that
+// requests don't each wait for it to time out. After threshold failures in a
+// row the circuit opens and calls are refused. Once cooldown has passed a
+// single trial call is let through, which closes the circuit if it succeeds
+// and opens it again if it doesn't.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	mutex     sync.Mutex
+	state     int
+	failures  int
+	openedAt  time.Time
+	trialling bool
+	now       func() time.Time
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+
+	circuitBreakerState.WithLabelValues(name).Set(CircuitClosed)
+
+	return &circuitBreaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+
+}
+
+// Allow reports whether a call may be made. Every call which is allowed must
+// be followed by Success or Failure.
+func (b *circuitBreaker) Allow() bool {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(CircuitHalfOpen)
+		b.trialling = true
+		return true
+	case CircuitHalfOpen:
+		if b.trialling {
+			return false
+		}
+		b.trialling = true
+		return true
+	default:
+		return true
+	}
+
+}
+
+func (b *circuitBreaker) Success() {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures = 0
+	b.trialling = false
+	if b.state != CircuitClosed {
+		log.Infof("Circuit %s closed", b.name)
+		b.setState(CircuitClosed)
+	}
+
+}
+
+func (b *circuitBreaker) Failure() {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+	b.trialling = false
+	if b.state == CircuitHalfOpen || (b.state == CircuitClosed && b.failures >= b.threshold) {
+		log.Errorf("Circuit %s opened after %d failures", b.name, b.failures)
+		b.openedAt = b.now()
+		b.setState(CircuitOpen)
+	}
+
+}
+
+func (b *circuitBreaker) State() int {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state
+
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	circuitBreakerState.WithLabelValues(b.name).Set(float64(state))
+}
@@ -0,0 +1,54 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+
+	now := time.Now()
+	breaker := newCircuitBreaker("test", 2, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	assert.True(t, breaker.Allow())
+	breaker.Failure()
+	assert.Equal(t, CircuitClosed, breaker.State())
+	assert.True(t, breaker.Allow())
+	breaker.Failure()
+	assert.Equal(t, CircuitOpen, breaker.State())
+	assert.False(t, breaker.Allow())
+
+	// after the cooldown one trial call is let through at a time
+	now = now.Add(time.Minute)
+	assert.True(t, breaker.Allow())
+	assert.Equal(t, CircuitHalfOpen, breaker.State())
+	assert.False(t, breaker.Allow())
+	breaker.Failure()
+	assert.Equal(t, CircuitOpen, breaker.State())
+	assert.False(t, breaker.Allow())
+
+	now = now.Add(time.Minute)
+	assert.True(t, breaker.Allow())
+	breaker.Success()
+	assert.Equal(t, CircuitClosed, breaker.State())
+	assert.True(t, breaker.Allow())
+
+}
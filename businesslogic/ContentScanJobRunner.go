@@ -0,0 +1,318 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	contentScanJobStaleAfter     = 5 * time.Minute
+	maxContentScanJobErrorLength = 1024
+	maxModerationReasonLength    = 255
+)
+
+var (
+	contentScanJobCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "justthetalk_content_scan_job_count",
+		Help: "Count of content scan jobs by result",
+	}, []string{"status"})
+
+	contentScanMatchCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "justthetalk_content_scan_match_count",
+		Help: "Count of posts queued for moderation by content scans",
+	})
+)
+
+// ContentScanJobRunner checks posts made before a banned word was added
+// against the current list, in batches, and queues the ones which match for
+// moderation. Like SearchIndexJobRunner its jobs are recorded in the
+// database, and a job which is cut short carries on from the last post it
+// reached.
+type ContentScanJobRunner struct {
+	interval    time.Duration
+	batchSize   int
+	window      time.Duration
+	bannedWords *BannedWordsList
+	provider    repository.Provider
+	wake        chan struct{}
+	quit        chan struct{}
+	workerDone  chan struct{}
+	stopOnce    sync.Once
+	isStarted   bool
+}
+
+func NewContentScanJobRunner(interval time.Duration, batchSize int, window time.Duration, bannedWords *BannedWordsList, provider repository.Provider) *ContentScanJobRunner {
+	return &ContentScanJobRunner{
+		interval:    interval,
+		batchSize:   batchSize,
+		window:      window,
+		bannedWords: bannedWords,
+		provider:    provider,
+		wake:        make(chan struct{}, 1),
+		quit:        make(chan struct{}),
+		workerDone:  make(chan struct{}),
+	}
+}
+
+// Window is how far back a scan looks when it isn't given dates
+func (r *ContentScanJobRunner) Window() time.Duration {
+	return r.window
+}
+
+// Enqueue records a job to scan the posts made between the given dates and
+// wakes the runner
+func (r *ContentScanJobRunner) Enqueue(userId uint, from time.Time, to time.Time) (*model.ContentScanJob, error) {
+
+	var job *model.ContentScanJob
+	var err error
+	r.provider.WithRepository(5*time.Second, func(repo repository.Repository) {
+		job, err = repo.ContentScanJobs().Create(userId, from, to)
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("creating content scan job: %w", err)
+	}
+
+	r.Wake()
+
+	return job, nil
+
+}
+
+func (r *ContentScanJobRunner) Wake() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *ContentScanJobRunner) Start(ctx context.Context) error {
+
+	if r.isStarted {
+		return errors.New("content scan job runner already started")
+	}
+
+	r.isStarted = true
+	go r.worker(ctx)
+
+	return nil
+
+}
+
+// Stop waits for the batch in hand to finish. The job is left running and
+// will be picked up again once it goes stale.
+func (r *ContentScanJobRunner) Stop(ctx context.Context) error {
+
+	r.stopOnce.Do(func() {
+		close(r.quit)
+	})
+
+	if !r.isStarted {
+		return nil
+	}
+
+	select {
+	case <-r.workerDone:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stopping content scan job runner: %w", ctx.Err())
+	}
+
+}
+
+func (r *ContentScanJobRunner) isQuitting(ctx context.Context) bool {
+	select {
+	case <-r.quit:
+		return true
+	case <-ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *ContentScanJobRunner) worker(ctx context.Context) {
+
+	log.Info("Starting ContentScanJobRunner")
+
+	defer close(r.workerDone)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+
+		r.RunPending(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-r.wake:
+		case <-r.quit:
+			log.Info("Closed ContentScanJobRunner")
+			return
+		case <-ctx.Done():
+			log.Info("ContentScanJobRunner cancelled")
+			return
+		}
+
+	}
+
+}
+
+// RunPending runs jobs until there are none left or the runner is stopped
+func (r *ContentScanJobRunner) RunPending(ctx context.Context) {
+
+	for !r.isQuitting(ctx) {
+
+		var job *model.ContentScanJob
+		var err error
+		r.provider.WithRepository(5*time.Second, func(repo repository.Repository) {
+			job, err = repo.ContentScanJobs().ClaimNext(contentScanJobStaleAfter)
+		})
+
+		if errors.Is(err, repository.ErrNotFound) {
+			return
+		} else if err != nil {
+			log.Errorf("Claiming content scan job: %v", err)
+			return
+		}
+
+		if !r.run(ctx, job) {
+			return
+		}
+
+	}
+
+}
+
+// run scans the job's posts a batch at a time and reports whether it got to
+// the end
+func (r *ContentScanJobRunner) run(ctx context.Context, job *model.ContentScanJob) bool {
+
+	log.Infof("Running content scan job %d for posts from %v to %v", job.Id, job.FromDate, job.ToDate)
+
+	var err error
+	for !r.isQuitting(ctx) {
+
+		var posts []*model.IndexablePost
+		r.provider.WithRepository(30*time.Second, func(repo repository.Repository) {
+			posts, err = repo.Posts().GetCreatedBetween(job.LastPostId, job.FromDate, job.ToDate, r.batchSize)
+		})
+
+		if err != nil || len(posts) == 0 {
+			break
+		}
+
+		if err = r.scan(job, posts); err != nil {
+			break
+		}
+
+	}
+
+	if err == nil && r.isQuitting(ctx) {
+		log.Infof("Content scan job %d stopped at post %d", job.Id, job.LastPostId)
+		return false
+	}
+
+	status := model.ContentScanJobStatusComplete
+	var lastError string
+	if err != nil {
+		status = model.ContentScanJobStatusFailed
+		lastError = truncateError(err, maxContentScanJobErrorLength)
+		log.Errorf("Content scan job %d failed: %v", job.Id, err)
+	}
+
+	contentScanJobCount.WithLabelValues(status).Inc()
+
+	r.provider.WithRepository(5*time.Second, func(repo repository.Repository) {
+		if err := repo.ContentScanJobs().Finish(job.Id, status, lastError); err != nil {
+			log.Errorf("Finishing content scan job %d: %v", job.Id, err)
+		}
+	})
+
+	return true
+
+}
+
+// scan checks a batch of posts and records how far the job has got in the
+// same transaction as the matches it queued
+func (r *ContentScanJobRunner) scan(job *model.ContentScanJob, posts []*model.IndexablePost) (scanErr error) {
+
+	matched := job.Matched
+	lastPostId := posts[len(posts)-1].Id
+	scanned := job.Scanned + len(posts)
+
+	r.provider.WithRepository(30*time.Second, func(repo repository.Repository) {
+		scanErr = repo.Transaction(func(tx repository.Repository) error {
+
+			for _, post := range posts {
+
+				check := r.bannedWords.Check(post.Text, post.FolderId)
+				if len(check.WordIds) == 0 {
+					continue
+				}
+
+				reason := truncateString(fmt.Sprintf("Content scan %d matched banned words %v (%s)", job.Id, check.WordIds, check.Action), maxModerationReasonLength)
+				queued, err := tx.Moderation().QueueForReview(post.Id, reason)
+				if err != nil {
+					return fmt.Errorf("queueing post %d: %w", post.Id, err)
+				}
+
+				if err := tx.Moderation().RecordBannedWordMatches(post.Id, check.WordIds); err != nil {
+					return fmt.Errorf("recording banned words matched by post %d: %w", post.Id, err)
+				}
+
+				// a post already waiting for a moderator isn't counted again
+				if queued {
+					matched++
+				}
+
+			}
+
+			if err := tx.ContentScanJobs().UpdateProgress(job.Id, lastPostId, scanned, matched); err != nil {
+				return fmt.Errorf("updating progress: %w", err)
+			}
+
+			return nil
+
+		})
+	})
+
+	if scanErr != nil {
+		return scanErr
+	}
+
+	contentScanMatchCount.Add(float64(matched - job.Matched))
+
+	job.LastPostId = lastPostId
+	job.Scanned = scanned
+	job.Matched = matched
+
+	return nil
+
+}
@@ -0,0 +1,109 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"context"
+	"errors"
+	"justthetalk/model"
+	"justthetalk/repository/memory"
+	"justthetalk/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentScanQueuesOldPostsMatchingBannedWords(t *testing.T) {
+
+	store := memory.NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+	discussion, _ := store.Discussions().Create(folder.Id, "Old posts", "", user.Id, false)
+
+	texts := []string{"fine", "buy cheap pills", "also fine", "more pills", "fine again"}
+	posts := make([]*model.Post, 0, len(texts))
+	for _, text := range texts {
+		post, err := store.Posts().Create(folder.Id, discussion.Id, text, model.PostStatusOK, user.Id)
+		require.NoError(t, err)
+		posts = append(posts, post)
+	}
+
+	// the word is added after the posts were made
+	list, _ := newUnitBannedWordsList(t, store)
+	word, err := store.Moderation().CreateBannedWord("pills", model.BannedWordActionHold, nil)
+	require.NoError(t, err)
+	require.NoError(t, list.Reload())
+
+	runner := NewContentScanJobRunner(time.Minute, 2, time.Hour, list, store)
+	job, err := CreateContentScanJob(user, &model.ContentScanJob{}, runner, time.Now().UTC().Add(time.Minute))
+	require.NoError(t, err)
+	runner.RunPending(context.Background())
+
+	job, err = store.ContentScanJobs().Get(job.Id)
+	require.NoError(t, err)
+	assert.Equal(t, model.ContentScanJobStatusComplete, job.Status)
+	assert.Equal(t, len(texts), job.Scanned)
+	assert.Equal(t, 2, job.Matched)
+	assert.Equal(t, posts[len(posts)-1].Id, job.LastPostId)
+
+	queue, _ := store.Moderation().GetQueue()
+	if assert.Len(t, queue, 2) {
+		assert.Equal(t, posts[1].Id, queue[0].Id)
+		assert.Equal(t, posts[3].Id, queue[1].Id)
+		if assert.NotNil(t, queue[0].ModerationReason) {
+			assert.Contains(t, *queue[0].ModerationReason, "hold")
+		}
+	}
+
+	matches, _ := store.Moderation().GetBannedWordMatches([]uint{posts[1].Id})
+	assert.Equal(t, []uint{word.Id}, matches[posts[1].Id])
+
+	// posts already waiting for a moderator aren't queued twice
+	again, err := runner.Enqueue(user.Id, job.FromDate, job.ToDate)
+	require.NoError(t, err)
+	runner.RunPending(context.Background())
+	again, _ = store.ContentScanJobs().Get(again.Id)
+	assert.Equal(t, 0, again.Matched)
+	queue, _ = store.Moderation().GetQueue()
+	assert.Len(t, queue, 2)
+
+}
+
+func TestContentScanJobDates(t *testing.T) {
+
+	store := memory.NewStore()
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+	list, _ := newUnitBannedWordsList(t, store)
+	now := time.Now().UTC()
+
+	runner := NewContentScanJobRunner(time.Minute, 100, 24*time.Hour, list, store)
+	job, err := CreateContentScanJob(user, &model.ContentScanJob{}, runner, now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-24*time.Hour), job.FromDate)
+	assert.Equal(t, now, job.ToDate)
+	assert.Equal(t, user.Id, job.CreatedByUserId)
+
+	_, err = CreateContentScanJob(user, &model.ContentScanJob{FromDate: now, ToDate: now.Add(-time.Hour)}, runner, now)
+	assert.True(t, errors.Is(err, utils.ErrBadRequest), "expected bad request, got %v", err)
+
+	// without a window there's nothing to default the start to
+	runner = NewContentScanJobRunner(time.Minute, 100, 0, list, store)
+	_, err = CreateContentScanJob(user, &model.ContentScanJob{}, runner, now)
+	assert.True(t, errors.Is(err, utils.ErrBadRequest), "expected bad request, got %v", err)
+
+}
@@ -1,25 +1,14 @@
-// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
-// Copyright (c) 2021 John Dudmesh.
-
-// This program is free software: you can redistribute it and/or modify
-// it under the terms of the GNU General Public License as published by
-// the Free Software Foundation, version 3.
-
-// This program is distributed in the hope that it will be useful, but
-// WITHOUT ANY WARRANTY; without even the implied warranty of
-// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
-// General Public License for more details.
-
-// You should have received a copy of the GNU General Public License
-// along with this program. If not, see <http://www.gnu.org/licenses/>.
-
 package businesslogic
 
 import (
 	"errors"
+	"fmt"
+	"justthetalk/config"
 	"justthetalk/connections"
 	"justthetalk/model"
+	"justthetalk/repository"
 	"justthetalk/utils"
+	"sync"
 
 	"context"
 	"encoding/json"
@@ -27,109 +16,366 @@ import (
 	"time"
 
 	"github.com/go-redis/redis/v8"
-	"gorm.io/gorm"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// discussionInvalidationChannel carries the ids of discussions which have
+// changed to every API instance
+const discussionInvalidationChannel = "cache:discussion"
+
+var (
+	discussionCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "justthetalk_discussion_cache_lookup_count",
+		Help: "Count of discussion cache lookups by tier and result",
+	}, []string{"tier", "result"})
+
+	discussionCacheInvalidations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "justthetalk_discussion_cache_invalidation_count",
+		Help: "Count of discussion cache invalidations received from other instances",
+	})
+)
+
+// DiscussionCache holds discussions in two tiers: an LRU in each API instance
+// in front of Redis, which all the instances share. Every change is written
+// through to Redis and then broadcast so that the other instances drop their
+// local copy. Entries carry the discussion's version and an older version
+// never replaces a newer one, whatever order the writes arrive in.
 type DiscussionCache struct {
 	postFormatter *utils.PostFormatter
 	folderCache   *FolderCache
+	provider      repository.Provider
+	cfg           config.DiscussionCacheConfig
+	local         *localCache
+	shared        sharedCacheTier
+	instanceId    string
+	quit          chan struct{}
+	done          chan struct{}
+	stopOnce      sync.Once
+	isStarted     bool
+}
+
+// discussionInvalidation is broadcast when a discussion changes. Instances
+// ignore their own messages as they have already updated their local tier.
+type discussionInvalidation struct {
+	Instance     string `json:"instance"`
+	DiscussionId uint   `json:"discussionId"`
 }
 
-func NewDiscussionCache(folderCache *FolderCache) *DiscussionCache {
+func NewDiscussionCache(cfg config.DiscussionCacheConfig, folderCache *FolderCache, provider repository.Provider) *DiscussionCache {
 
 	return &DiscussionCache{
 		postFormatter: utils.NewPostFormatter(),
 		folderCache:   folderCache,
+		provider:      provider,
+		cfg:           cfg,
+		local:         newLocalCache(cfg.Size, cfg.LocalTTL),
+		shared:        &redisCacheTier{},
+		instanceId:    uuid.New().String(),
+		quit:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+}
+
+// Start listens for invalidations from the other instances. There is nothing
+// to listen for in legacy compatibility mode as nothing is cached locally.
+func (cache *DiscussionCache) Start(ctx context.Context) error {
+
+	if cache.isStarted {
+		return errors.New("discussion cache already started")
+	}
+
+	if cache.cfg.LegacyCompat {
+		return nil
+	}
+
+	cache.isStarted = true
+	go cache.listen(ctx)
+
+	return nil
+
+}
+
+func (cache *DiscussionCache) Stop(ctx context.Context) error {
+
+	cache.stopOnce.Do(func() {
+		close(cache.quit)
+	})
+
+	if !cache.isStarted {
+		return nil
+	}
+
+	select {
+	case <-cache.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stopping discussion cache: %w", ctx.Err())
+	}
+
+}
+
+// listen applies invalidations until stopped. The Redis client resubscribes
+// by itself after a dropped connection, and the local TTL limits how long an
+// entry can outlive an invalidation lost in the meantime.
+func (cache *DiscussionCache) listen(ctx context.Context) {
+
+	defer close(cache.done)
+
+	subscription := connections.RedisConnection().Subscribe(ctx, discussionInvalidationChannel)
+	defer subscription.Close()
+
+	messages := subscription.Channel()
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			cache.handleInvalidation([]byte(message.Payload))
+		case <-cache.quit:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+
+}
+
+func (cache *DiscussionCache) handleInvalidation(payload []byte) {
+
+	var message discussionInvalidation
+	if err := json.Unmarshal(payload, &message); err != nil {
+		log.Errorf("DiscussionCache: unreadable invalidation %q: %v", payload, err)
+		return
+	}
+
+	if message.Instance == cache.instanceId {
+		return
+	}
+
+	cache.local.Remove(message.DiscussionId)
+	discussionCacheInvalidations.Inc()
+
+}
+
+func (cache *DiscussionCache) publishInvalidation(discussionId uint) {
+
+	data, err := json.Marshal(&discussionInvalidation{Instance: cache.instanceId, DiscussionId: discussionId})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancelFn()
+
+	if err := cache.shared.Publish(ctx, discussionInvalidationChannel, data); err != nil {
+		log.Errorf("DiscussionCache: publishing invalidation of %d: %v", discussionId, err)
 	}
 
 }
 
-func (cache *DiscussionCache) Get(discussionId uint, user *model.User) *model.Discussion {
+func (cache *DiscussionCache) Get(discussionId uint, user *model.User) (*model.Discussion, error) {
 
-	discussion := cache.UnsafeGet(discussionId)
+	discussion, err := cache.UnsafeGet(discussionId)
+	if err != nil {
+		return nil, err
+	}
 
 	if discussion.Status != model.DiscussionStatusOk || discussion.IsDeleted {
 		if user == nil || !user.IsAdmin {
-			panic(utils.ErrForbidden)
+			return nil, utils.NewError(utils.ErrForbidden, utils.ErrorCodeForbidden, "This discussion is not available")
 		}
 	}
 
-	cache.folderCache.Get(discussion.FolderId, user)
+	if _, err := cache.folderCache.Get(discussion.FolderId, user); err != nil {
+		return nil, err
+	}
 
-	discussion.IsBlocked = cache.IsBlocked(discussion, user)
+	if discussion.IsBlocked, err = cache.IsBlocked(discussion, user); err != nil {
+		return nil, err
+	}
 
-	return discussion
+	return discussion, nil
 
 }
 
-func (cache *DiscussionCache) UnsafeGet(discussionId uint) *model.Discussion {
+// UnsafeGet returns the discussion whatever its status and whoever is asking.
+// The caller gets its own copy which it is free to change.
+func (cache *DiscussionCache) UnsafeGet(discussionId uint) (*model.Discussion, error) {
 
-	var discussion model.Discussion
+	discussion, err := cache.get(discussionId)
+	if err != nil {
+		return nil, err
+	}
 
-	key := "D" + strconv.Itoa(int(discussionId))
-	//val, err := connections.RedisConnection().Get(context.Background(), key).Result()
-	val := []byte{}
-	err := redis.Nil
-	// TODO - don't use Redis cache while running in parallel with legacy site
-	if err == redis.Nil {
-		log.Debug("DiscussionCache: cache miss")
-		connections.WithDatabase(1*time.Second, func(db *gorm.DB) {
-			if result := db.Raw("call get_discussion(?)", discussionId).First(&discussion); result.Error != nil {
-				if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-					panic(utils.ErrNotFound)
-				} else {
-					utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
-				}
-			}
-		})
+	// the url is taken from the folder as it is now, as the folder's key can
+	// change while the discussion is cached
+	if folder := cache.folderCache.UnsafeGet(discussion.FolderId); folder != nil {
+		discussion.Url = utils.UrlForDiscussion(folder, discussion)
+	}
+
+	return discussion, nil
+
+}
+
+func (cache *DiscussionCache) get(discussionId uint) (*model.Discussion, error) {
+
+	if cache.cfg.LegacyCompat {
+		return cache.load(discussionId)
+	}
 
-		folder := cache.folderCache.UnsafeGet(discussion.FolderId)
-		discussion.Url = utils.UrlForDiscussion(folder, &discussion)
-		discussion.HeaderMarkup = cache.postFormatter.ApplyPostFormatting(discussion.Header, &discussion)
+	if value, found := cache.local.Get(discussionId); found {
+		discussionCacheLookups.WithLabelValues("local", "hit").Inc()
+		discussion := value.(model.Discussion)
+		return &discussion, nil
+	}
+	discussionCacheLookups.WithLabelValues("local", "miss").Inc()
+
+	key := discussionKey(discussionId)
 
-		cache.Put(&discussion)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancelFn()
 
+	// Redis failing only costs a trip to the database
+	data, err := cache.shared.Get(ctx, key)
+	if err != nil {
+		discussionCacheLookups.WithLabelValues("shared", "error").Inc()
+		log.Errorf("DiscussionCache: reading %s: %v", key, err)
+	} else if data != nil {
+		var discussion model.Discussion
+		if err := json.Unmarshal(data, &discussion); err == nil {
+			discussionCacheLookups.WithLabelValues("shared", "hit").Inc()
+			cache.local.Put(discussion.Id, discussion, discussion.Version)
+			return &discussion, nil
+		}
+		discussionCacheLookups.WithLabelValues("shared", "error").Inc()
+		log.Errorf("DiscussionCache: discarding unreadable %s: %v", key, err)
 	} else {
-		log.Debug("DiscussionCache: cache hit")
-		if err := json.Unmarshal([]byte(val), &discussion); err != nil {
-			panic(err)
+		discussionCacheLookups.WithLabelValues("shared", "miss").Inc()
+	}
+
+	discussion, err := cache.load(discussionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cache.store(discussion); err != nil {
+		log.Error(err)
+	}
+
+	return discussion, nil
+
+}
+
+// load reads the discussion from the database
+func (cache *DiscussionCache) load(discussionId uint) (*model.Discussion, error) {
+
+	var discussion model.Discussion
+	var err error
+	cache.provider.WithRepository(1*time.Second, func(repo repository.Repository) {
+		var found *model.Discussion
+		if found, err = repo.Discussions().Get(discussionId); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = utils.NewError(utils.ErrNotFound, utils.ErrorCodeDiscussionNotFound, "Discussion not found")
+			} else {
+				err = utils.InternalError(err)
+			}
+			return
 		}
-		connections.RedisConnection().Expire(context.Background(), key, time.Hour*1)
+		discussion = cache.entry(found)
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
-	return &discussion
+	return &discussion, nil
 
 }
 
-func (cache *DiscussionCache) Put(discussion *model.Discussion) {
+// entry returns the copy of discussion to cache, with the derived fields
+// filled in and the ones which depend on the user cleared
+func (cache *DiscussionCache) entry(discussion *model.Discussion) model.Discussion {
+
+	entry := *discussion
+	entry.IsBlocked = false
+	entry.IsSubscribed = false
+	entry.IgnoreSimilar = false
+
+	folder := cache.folderCache.UnsafeGet(entry.FolderId)
+	entry.Url = utils.UrlForDiscussion(folder, &entry)
+	entry.HeaderMarkup = cache.postFormatter.ApplyPostFormatting(entry.Header, &entry)
+
+	return entry
 
-	key := "D" + strconv.Itoa(int(discussion.Id))
-	data, err := json.Marshal(discussion)
+}
+
+// Put caches a discussion which has just been changed and tells the other
+// instances to drop their copies
+func (cache *DiscussionCache) Put(discussion *model.Discussion) error {
+
+	if err := cache.store(discussion); err != nil {
+		return err
+	}
+
+	cache.publishInvalidation(discussion.Id)
+
+	return nil
+
+}
+
+func (cache *DiscussionCache) store(discussion *model.Discussion) error {
+
+	entry := cache.entry(discussion)
+
+	if !cache.cfg.LegacyCompat {
+		cache.local.Put(entry.Id, entry, entry.Version)
+	}
+
+	data, err := json.Marshal(&entry)
 	if err != nil {
-		panic(err)
+		return utils.InternalError(err)
 	}
 
-	status := connections.RedisConnection().Set(context.Background(), key, data, time.Hour*1)
-	if status.Err() != nil {
-		panic(status.Err())
+	ctx, cancelFn := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancelFn()
+
+	if err := cache.shared.SetIfNotOlder(ctx, discussionKey(entry.Id), data, entry.Version, cache.cfg.SharedTTL); err != nil {
+		return utils.InternalError(err)
 	}
 
+	return nil
+
 }
 
-func (cache *DiscussionCache) Flush(discussionId uint) {
+func (cache *DiscussionCache) Flush(discussionId uint) error {
 
-	discussionIdStr := strconv.Itoa(int(discussionId))
+	cache.local.Remove(discussionId)
 
-	status := connections.RedisConnection().Del(context.Background(), "D"+discussionIdStr, "B"+discussionIdStr)
-	if status.Err() != nil {
-		panic(status.Err())
+	ctx, cancelFn := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancelFn()
+
+	if err := cache.shared.Delete(ctx, discussionKey(discussionId), "B"+strconv.Itoa(int(discussionId))); err != nil {
+		return utils.InternalError(err)
 	}
 
+	cache.publishInvalidation(discussionId)
+
+	return nil
+
+}
+
+func discussionKey(discussionId uint) string {
+	return "D" + strconv.Itoa(int(discussionId))
 }
 
-func (cache *DiscussionCache) BlockedUsers(discussion *model.Discussion) map[uint]*model.BlockedDiscussionUser {
+func (cache *DiscussionCache) BlockedUsers(discussion *model.Discussion) (map[uint]*model.BlockedDiscussionUser, error) {
 
 	var blockedUserMap map[uint]*model.BlockedDiscussionUser
 
@@ -137,57 +383,69 @@ func (cache *DiscussionCache) BlockedUsers(discussion *model.Discussion) map[uin
 	val, err := connections.RedisConnection().Get(context.Background(), key).Result()
 	if err == redis.Nil {
 
-		connections.WithDatabase(1*time.Second, func(db *gorm.DB) {
-			blockedUserMap = FetchBlockedUsers(discussion, db)
+		cache.provider.WithRepository(1*time.Second, func(repo repository.Repository) {
+			blockedUserMap, err = FetchBlockedUsers(discussion, repo)
 		})
 
+		if err != nil {
+			return nil, err
+		}
+
 		data, err := json.Marshal(&blockedUserMap)
 		if err != nil {
-			panic(err)
+			return nil, utils.InternalError(err)
 		}
 
 		status := connections.RedisConnection().Set(context.Background(), key, data, time.Hour*1)
 		if status.Err() != nil {
-			panic(status.Err().Error())
+			return nil, utils.InternalError(status.Err())
 		}
 
 	} else {
 		if err := json.Unmarshal([]byte(val), &blockedUserMap); err != nil {
-			panic(err)
+			return nil, utils.InternalError(err)
 		}
 		connections.RedisConnection().Expire(context.Background(), key, time.Hour*1)
 	}
 
-	return blockedUserMap
+	return blockedUserMap, nil
 
 }
 
-func (cache *DiscussionCache) BlockOrUnblockUser(discussion *model.Discussion, targetUser *model.User, blockNotUnblock bool, adminUser *model.User) map[uint]*model.BlockedDiscussionUser {
+func (cache *DiscussionCache) BlockOrUnblockUser(discussion *model.Discussion, targetUser *model.User, blockNotUnblock bool, adminUser *model.User) (map[uint]*model.BlockedDiscussionUser, error) {
 
 	var blockedUserMap map[uint]*model.BlockedDiscussionUser
+	var err error
 
-	connections.WithDatabase(1*time.Second, func(db *gorm.DB) {
-		blockedUserMap = BlockUnblockUser(discussion, targetUser, blockNotUnblock, adminUser, db)
+	cache.provider.WithRepository(1*time.Second, func(repo repository.Repository) {
+		blockedUserMap, err = BlockUnblockUser(discussion, targetUser, blockNotUnblock, adminUser, repo)
 	})
 
+	if err != nil {
+		return nil, err
+	}
+
 	key := "B" + strconv.Itoa(int(discussion.Id))
 	data, err := json.Marshal(&blockedUserMap)
 	if err != nil {
-		panic(err)
+		return nil, utils.InternalError(err)
 	}
 
 	status := connections.RedisConnection().Set(context.Background(), key, data, time.Hour*1)
 	if status.Err() != nil {
-		panic(status.Err().Error())
+		return nil, utils.InternalError(status.Err())
 	}
 
-	return blockedUserMap
+	return blockedUserMap, nil
 
 }
 
-func (cache *DiscussionCache) IsBlocked(discussion *model.Discussion, user *model.User) bool {
+func (cache *DiscussionCache) IsBlocked(discussion *model.Discussion, user *model.User) (bool, error) {
 
-	blockedUserMap := cache.BlockedUsers(discussion)
+	blockedUserMap, err := cache.BlockedUsers(discussion)
+	if err != nil {
+		return false, err
+	}
 
 	isBlocked := false
 	if user != nil {
@@ -196,6 +454,6 @@ func (cache *DiscussionCache) IsBlocked(discussion *model.Discussion, user *mode
 		}
 	}
 
-	return isBlocked
+	return isBlocked, nil
 
 }
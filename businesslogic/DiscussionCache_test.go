@@ -16,28 +16,39 @@
 package businesslogic
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"justthetalk/config"
+	"justthetalk/model"
+	"justthetalk/repository/memory"
 	"justthetalk/utils"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetDiscussionGet(t *testing.T) {
 
-	userCache := NewUserCache()
-
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, _, discussionCache := newTestCaches(t)
 
 	userId := uint(5540)
-	user := userCache.Get(userId)
+	user := getTestUser(t, userCache, userId)
 
 	discussionId := uint(2271)
 
-	if discussion := discussionCache.Get(discussionId, user); discussion.Id != discussionId {
+	discussion, err := discussionCache.Get(discussionId, user)
+	require.NoError(t, err)
+	if discussion.Id != discussionId {
 		t.Error("Failed to get")
 	}
 
-	if discussion := discussionCache.Get(discussionId, user); discussion.Id != discussionId {
+	discussion, err = discussionCache.Get(discussionId, user)
+	require.NoError(t, err)
+	if discussion.Id != discussionId {
 		t.Error("Failed to get cached version")
 	}
 
@@ -45,48 +56,248 @@ func TestGetDiscussionGet(t *testing.T) {
 
 func TestGetDiscussionGetLockedNonAdmin(t *testing.T) {
 
-	defer func() {
-		if r := recover(); r != nil {
-			err := r.(error)
-			switch {
-			case errors.Is(err, utils.ErrForbidden):
-				t.Log("Got forbidden")
-			default:
-				t.Error(err)
-			}
-		}
-	}()
-
-	userCache := NewUserCache()
-
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, _, discussionCache := newTestCaches(t)
 
 	userId := uint(5540)
-	user := userCache.Get(userId)
+	user := getTestUser(t, userCache, userId)
 
 	discussionId := uint(21)
 
-	discussionCache.Get(discussionId, user)
-
-	t.Error("Should have panicked")
+	_, err := discussionCache.Get(discussionId, user)
+	assert.True(t, errors.Is(err, utils.ErrForbidden), "expected forbidden, got %v", err)
 
 }
 
 func TestGetDiscussionGetLockedAsAdmin(t *testing.T) {
 
-	userCache := NewUserCache()
-
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, _, discussionCache := newTestCaches(t)
 
 	userId := uint(50)
-	user := userCache.Get(userId)
+	user := getTestUser(t, userCache, userId)
 
 	discussionId := uint(21)
 
-	if discussion := discussionCache.Get(discussionId, user); discussion.Id != discussionId {
+	discussion, err := discussionCache.Get(discussionId, user)
+	require.NoError(t, err)
+	if discussion.Id != discussionId {
 		t.Error("Failed to get")
 	}
 
 }
+
+// fakeCacheTier stands in for Redis, including the version check
+type fakeCacheTier struct {
+	mutex     sync.Mutex
+	values    map[string][]byte
+	versions  map[string]uint
+	published [][]byte
+	err       error
+}
+
+func newFakeCacheTier() *fakeCacheTier {
+	return &fakeCacheTier{
+		values:   make(map[string][]byte),
+		versions: make(map[string]uint),
+	}
+}
+
+func (t *fakeCacheTier) Get(ctx context.Context, key string) ([]byte, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.values[key], t.err
+}
+
+func (t *fakeCacheTier) Set(ctx context.Context, key string, data []byte, ttl time.Duration) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	t.values[key] = data
+	return nil
+}
+
+func (t *fakeCacheTier) SetIfNotOlder(ctx context.Context, key string, data []byte, version uint, ttl time.Duration) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	if current, exists := t.versions[key]; !exists || current <= version {
+		t.values[key] = data
+		t.versions[key] = version
+	}
+	return nil
+}
+
+func (t *fakeCacheTier) Delete(ctx context.Context, keys ...string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, key := range keys {
+		delete(t.values, key)
+		delete(t.versions, key)
+	}
+	return t.err
+}
+
+func (t *fakeCacheTier) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.err
+}
+
+func (t *fakeCacheTier) Publish(ctx context.Context, channel string, message []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.published = append(t.published, message)
+	return t.err
+}
+
+func newUnitDiscussionCache(t *testing.T, cfg config.DiscussionCacheConfig, store *memory.Store, shared sharedCacheTier) *DiscussionCache {
+
+	folderCache, err := NewFolderCache(store)
+	require.NoError(t, err)
+
+	cache := NewDiscussionCache(cfg, folderCache, store)
+	cache.shared = shared
+
+	return cache
+
+}
+
+func TestDiscussionCacheTiers(t *testing.T) {
+
+	store := memory.NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+	discussion, err := store.Discussions().Create(folder.Id, "Cached", "Header", user.Id, false)
+	require.NoError(t, err)
+
+	shared := newFakeCacheTier()
+	cfg := config.Default().DiscussionCache
+	first := newUnitDiscussionCache(t, cfg, store, shared)
+	second := newUnitDiscussionCache(t, cfg, store, shared)
+
+	loaded, err := first.UnsafeGet(discussion.Id)
+	require.NoError(t, err)
+	assert.NotEmpty(t, loaded.Url)
+	assert.NotNil(t, shared.values[discussionKey(discussion.Id)], "a miss fills the shared tier")
+	assert.Empty(t, shared.published, "filling the cache isn't a change")
+
+	// callers get their own copy
+	loaded.IsBlocked = true
+	again, _ := first.UnsafeGet(discussion.Id)
+	assert.False(t, again.IsBlocked)
+
+	// the second instance finds it in Redis even once the database has moved
+	// on, and keeps it locally
+	locked, err := store.Discussions().Lock(discussion.Id, true)
+	require.NoError(t, err)
+	fromShared, err := second.UnsafeGet(discussion.Id)
+	require.NoError(t, err)
+	assert.False(t, fromShared.IsLocked)
+	assert.Equal(t, 1, second.local.Len())
+
+	// a change through the first instance reaches the second by invalidation
+	require.NoError(t, first.Put(locked))
+	if assert.Len(t, shared.published, 1) {
+		first.handleInvalidation(shared.published[0])
+		assert.Equal(t, 1, first.local.Len(), "an instance ignores its own invalidations")
+		second.handleInvalidation(shared.published[0])
+	}
+	fromShared, err = second.UnsafeGet(discussion.Id)
+	require.NoError(t, err)
+	assert.True(t, fromShared.IsLocked)
+
+	// a stale copy doesn't replace the newer one in either tier
+	require.NoError(t, second.Put(discussion))
+	current, _ := first.UnsafeGet(discussion.Id)
+	assert.True(t, current.IsLocked)
+	var cached model.Discussion
+	require.NoError(t, json.Unmarshal(shared.values[discussionKey(discussion.Id)], &cached))
+	assert.Equal(t, locked.Version, cached.Version)
+
+	require.NoError(t, first.Flush(discussion.Id))
+	assert.Nil(t, shared.values[discussionKey(discussion.Id)])
+	assert.Equal(t, 0, first.local.Len())
+
+}
+
+func TestPostsFromTwoInstancesCacheTheDatabaseVersion(t *testing.T) {
+
+	store := memory.NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+	created, err := store.Discussions().Create(folder.Id, "Busy", "", user.Id, false)
+	require.NoError(t, err)
+
+	shared := newFakeCacheTier()
+	cfg := config.Default().DiscussionCache
+	first := newUnitDiscussionCache(t, cfg, store, shared)
+	second := newUnitDiscussionCache(t, cfg, store, shared)
+
+	// both instances start from the same copy
+	onFirst, err := first.UnsafeGet(created.Id)
+	require.NoError(t, err)
+	onSecond, err := second.UnsafeGet(created.Id)
+	require.NoError(t, err)
+
+	_, err = CreatePost(folder, onFirst, user, &model.Post{Text: "one"}, first, nil, store)
+	require.NoError(t, err)
+	_, err = CreatePost(folder, onSecond, user, &model.Post{Text: "two"}, second, nil, store)
+	require.NoError(t, err)
+
+	current, err := store.Discussions().Get(created.Id)
+	require.NoError(t, err)
+
+	var cached model.Discussion
+	require.NoError(t, json.Unmarshal(shared.values[discussionKey(created.Id)], &cached))
+	assert.Equal(t, current.Version, cached.Version)
+	assert.Equal(t, int64(2), cached.PostCount, "the second post isn't lost to the first")
+
+}
+
+func TestDiscussionCacheSurvivesRedisFailures(t *testing.T) {
+
+	store := memory.NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+	discussion, _ := store.Discussions().Create(folder.Id, "Cached", "", user.Id, false)
+
+	shared := newFakeCacheTier()
+	shared.err = errors.New("connection refused")
+	cache := newUnitDiscussionCache(t, config.Default().DiscussionCache, store, shared)
+
+	loaded, err := cache.UnsafeGet(discussion.Id)
+	require.NoError(t, err)
+	assert.Equal(t, discussion.Id, loaded.Id)
+
+	_, err = cache.UnsafeGet(9999)
+	assert.True(t, errors.Is(err, utils.ErrNotFound))
+
+}
+
+func TestDiscussionCacheLegacyCompatReadsTheDatabase(t *testing.T) {
+
+	store := memory.NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+	discussion, _ := store.Discussions().Create(folder.Id, "Legacy", "", user.Id, false)
+
+	cfg := config.Default().DiscussionCache
+	cfg.LegacyCompat = true
+	shared := newFakeCacheTier()
+	cache := newUnitDiscussionCache(t, cfg, store, shared)
+
+	_, err := cache.UnsafeGet(discussion.Id)
+	require.NoError(t, err)
+
+	// the legacy site changes the discussion behind the cache's back
+	store.Discussions().Lock(discussion.Id, true)
+
+	loaded, err := cache.UnsafeGet(discussion.Id)
+	require.NoError(t, err)
+	assert.True(t, loaded.IsLocked)
+	assert.Equal(t, 0, cache.local.Len())
+
+}
@@ -0,0 +1,242 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"fmt"
+	"html"
+	"justthetalk/config"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"justthetalk/utils"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// similarDiscussionCandidates caps how many recent discussions in a folder
+	// are compared with a new one
+	similarDiscussionCandidates = 500
+
+	// similarDiscussionPreviewThreshold is the least similar a discussion can
+	// be and still be suggested while the user is typing
+	similarDiscussionPreviewThreshold = 0.4
+
+	maxSimilarDiscussions = 5
+)
+
+// similarityStopWords are ignored when comparing titles, otherwise "the" and
+// "of" make unrelated titles look alike
+var similarityStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "by": true,
+	"for": true, "from": true, "has": true, "in": true, "is": true, "it": true, "of": true, "on": true,
+	"or": true, "that": true, "the": true, "this": true, "to": true, "was": true, "with": true,
+}
+
+// DuplicateDiscussionDetector finds recent discussions in a folder which look
+// like a new one, typically several threads about the same news story. It
+// suggests them while the user types and, depending on the configuration,
+// warns about or blocks a new discussion which is too like one of them.
+type DuplicateDiscussionDetector struct {
+	cfg config.DuplicateDiscussionsConfig
+}
+
+func NewDuplicateDiscussionDetector(cfg config.DuplicateDiscussionsConfig) *DuplicateDiscussionDetector {
+	return &DuplicateDiscussionDetector{
+		cfg: cfg,
+	}
+}
+
+// Preview returns the discussions to suggest to a user who is starting one
+// with the given title and header
+func (d *DuplicateDiscussionDetector) Preview(folder *model.Folder, title string, header string, repo repository.Repository) ([]*model.SimilarDiscussion, error) {
+	return d.FindSimilar(folder, title, header, similarDiscussionPreviewThreshold, repo)
+}
+
+// FindSimilar returns the recent discussions in the folder which are at least
+// minSimilarity like the title and header, most similar first
+func (d *DuplicateDiscussionDetector) FindSimilar(folder *model.Folder, title string, header string, minSimilarity float64, repo repository.Repository) ([]*model.SimilarDiscussion, error) {
+
+	text := newSimilarityText(title, header)
+	if len(text.titleWords) == 0 {
+		return []*model.SimilarDiscussion{}, nil
+	}
+
+	candidates, err := repo.Discussions().GetRecent(folder.Id, time.Now().Add(-d.cfg.Window), similarDiscussionCandidates)
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	similar := make([]*model.SimilarDiscussion, 0)
+	for _, candidate := range candidates {
+
+		similarity := text.similarity(newSimilarityText(candidate.Title, candidate.Header))
+		if similarity < minSimilarity {
+			continue
+		}
+
+		similar = append(similar, &model.SimilarDiscussion{
+			DiscussionId: candidate.Id,
+			Title:        candidate.Title,
+			Url:          utils.UrlForDiscussion(folder, candidate),
+			CreatedDate:  candidate.CreatedDate,
+			PostCount:    candidate.PostCount,
+			Similarity:   similarity,
+		})
+
+	}
+
+	sort.SliceStable(similar, func(i, j int) bool {
+		return similar[i].Similarity > similar[j].Similarity
+	})
+
+	if len(similar) > maxSimilarDiscussions {
+		similar = similar[:maxSimilarDiscussions]
+	}
+
+	return similar, nil
+
+}
+
+// check applies the configured action to a discussion which is about to be
+// created. A warning is an error which the client can get past by setting
+// IgnoreSimilar, a block is one which it can't.
+func (d *DuplicateDiscussionDetector) check(folder *model.Folder, discussion *model.Discussion, repo repository.Repository) error {
+
+	if d == nil || d.cfg.Action == config.DuplicateDiscussionsOff {
+		return nil
+	}
+
+	if d.cfg.Action == config.DuplicateDiscussionsWarn && discussion.IgnoreSimilar {
+		return nil
+	}
+
+	similar, err := d.FindSimilar(folder, discussion.Title, discussion.Header, d.cfg.Threshold, repo)
+	if err != nil {
+		return err
+	}
+
+	if len(similar) == 0 {
+		return nil
+	}
+
+	return utils.NewError(utils.ErrBadRequest, utils.ErrorCodeSimilarDiscussion, "A similar discussion already exists").
+		WithField("title", fmt.Sprintf("is very like \"%s\"", html.UnescapeString(similar[0].Title)))
+
+}
+
+// similarityText holds the parts of a title and header which are compared
+type similarityText struct {
+	titleWords    map[string]bool
+	titleTrigrams map[string]bool
+	headerWords   map[string]bool
+}
+
+func newSimilarityText(title string, header string) *similarityText {
+
+	words := similarityWords(title)
+
+	return &similarityText{
+		titleWords:    wordSet(words),
+		titleTrigrams: trigramSet(words),
+		headerWords:   wordSet(similarityWords(header)),
+	}
+
+}
+
+// similarity scores titles on the words they share, whatever their order,
+// averaged with the trigrams they share, which allows for typos and plurals.
+// Headers can raise the score but not lower it since they are often empty or
+// just a link.
+func (t *similarityText) similarity(other *similarityText) float64 {
+
+	score := (diceCoefficient(t.titleWords, other.titleWords) + diceCoefficient(t.titleTrigrams, other.titleTrigrams)) / 2
+
+	if len(t.headerWords) > 0 && len(other.headerWords) > 0 {
+		withHeaders := 0.7*score + 0.3*diceCoefficient(t.headerWords, other.headerWords)
+		if withHeaders > score {
+			score = withHeaders
+		}
+	}
+
+	return score
+
+}
+
+// similarityWords returns the lower case words of text without its stop
+// words, unless there is nothing else. Titles and headers are stored HTML
+// escaped so they are unescaped first.
+func similarityWords(text string) []string {
+
+	all := strings.FieldsFunc(strings.ToLower(html.UnescapeString(text)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	words := make([]string, 0, len(all))
+	for _, word := range all {
+		if !similarityStopWords[word] {
+			words = append(words, word)
+		}
+	}
+
+	if len(words) == 0 {
+		return all
+	}
+
+	return words
+
+}
+
+func wordSet(words []string) map[string]bool {
+	set := make(map[string]bool, len(words))
+	for _, word := range words {
+		set[word] = true
+	}
+	return set
+}
+
+func trigramSet(words []string) map[string]bool {
+
+	set := make(map[string]bool)
+	for _, word := range words {
+		runes := []rune(" " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			set[string(runes[i:i+3])] = true
+		}
+	}
+
+	return set
+
+}
+
+func diceCoefficient(a map[string]bool, b map[string]bool) float64 {
+
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for key := range a {
+		if b[key] {
+			shared++
+		}
+	}
+
+	return 2 * float64(shared) / float64(len(a)+len(b))
+
+}
@@ -0,0 +1,93 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"errors"
+	"justthetalk/config"
+	"justthetalk/model"
+	"justthetalk/repository/memory"
+	"justthetalk/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimilarity(t *testing.T) {
+
+	score := func(a string, b string) float64 {
+		return newSimilarityText(a, "").similarity(newSimilarityText(b, ""))
+	}
+
+	assert.Equal(t, 1.0, score("Prime Minister resigns", "prime minister RESIGNS!"))
+	assert.Greater(t, score("The Prime Minister resigns", "Prime Minister has resigned"), 0.75)
+	assert.Greater(t, score("Election results 2024", "2024 election results"), 0.75)
+	assert.Less(t, score("Prime Minister resigns", "Best pizza in town"), 0.2)
+	assert.Equal(t, 0.0, score("The", "Cheese"))
+
+	withHeaders := newSimilarityText("Storm warning", "Heavy rain and flooding expected in the north").
+		similarity(newSimilarityText("Weather this weekend", "Heavy rain and flooding expected in the north"))
+	assert.Greater(t, withHeaders, score("Storm warning", "Weather this weekend"), "shared headers raise the score")
+
+}
+
+func TestDuplicateDiscussionDetector(t *testing.T) {
+
+	store := memory.NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "news", Description: "News", Type: model.FolderTypeNormal})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+
+	existing, err := store.Discussions().Create(folder.Id, "Prime Minister resigns", "", user.Id, false)
+	require.NoError(t, err)
+	store.Discussions().Create(folder.Id, "Best pizza in town", "", user.Id, false)
+
+	cfg := config.DuplicateDiscussionsConfig{Action: config.DuplicateDiscussionsWarn, Threshold: 0.75, Window: time.Hour}
+	detector := NewDuplicateDiscussionDetector(cfg)
+
+	similar, err := detector.Preview(folder, "prime minister has resigned", "", store)
+	require.NoError(t, err)
+	if assert.Len(t, similar, 1) {
+		assert.Equal(t, existing.Id, similar[0].DiscussionId)
+		assert.NotEmpty(t, similar[0].Url)
+	}
+
+	similar, err = detector.Preview(folder, "", "", store)
+	require.NoError(t, err)
+	assert.Empty(t, similar)
+
+	duplicate := &model.Discussion{Title: "The Prime Minister resigns"}
+	err = detector.check(folder, duplicate, store)
+	assert.True(t, errors.Is(err, utils.ErrBadRequest))
+	var typedErr *utils.Error
+	if assert.True(t, errors.As(err, &typedErr)) {
+		assert.Equal(t, utils.ErrorCodeSimilarDiscussion, typedErr.Code)
+	}
+
+	assert.Nil(t, detector.check(folder, &model.Discussion{Title: "Local elections"}, store))
+
+	duplicate.IgnoreSimilar = true
+	assert.Nil(t, detector.check(folder, duplicate, store), "a warning can be overridden")
+
+	cfg.Action = config.DuplicateDiscussionsBlock
+	assert.NotNil(t, NewDuplicateDiscussionDetector(cfg).check(folder, duplicate, store), "a block can't")
+
+	cfg.Action = config.DuplicateDiscussionsOff
+	duplicate.IgnoreSimilar = false
+	assert.Nil(t, NewDuplicateDiscussionDetector(cfg).check(folder, duplicate, store))
+
+}
@@ -17,10 +17,12 @@ package businesslogic
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"html/template"
+	"justthetalk/config"
 	"justthetalk/model"
-	"os"
-	"strconv"
+	"justthetalk/utils"
 	"sync"
 
 	gomail "gopkg.in/gomail.v2"
@@ -28,6 +30,9 @@ import (
 
 var onceTemplateMap sync.Once
 
+var mailConfig config.MailConfig
+var mailConfigLock sync.RWMutex
+
 const (
 	NewSignupTemplate            = 1
 	PasswordResetRequestTemplate = 2
@@ -37,8 +42,8 @@ const (
 
 func getTemplate(filename string) *template.Template {
 	tpl, err := template.ParseFiles(filename)
-	if err != nil {
-		panic(err)
+	if err != nil && templateErr == nil {
+		templateErr = fmt.Errorf("parsing %s: %w", filename, err)
 	}
 	return tpl
 }
@@ -50,8 +55,9 @@ type templateSpec struct {
 }
 
 var templateMap map[int]templateSpec
+var templateErr error
 
-func getTemplateMap() map[int]templateSpec {
+func getTemplateMap() (map[int]templateSpec, error) {
 	onceTemplateMap.Do(func() {
 		templateMap = map[int]templateSpec{
 			NewSignupTemplate: {
@@ -71,21 +77,38 @@ func getTemplateMap() map[int]templateSpec {
 			},
 		}
 	})
-	return templateMap
+	return templateMap, templateErr
+}
+
+func SetMailConfig(cfg config.MailConfig) {
+	mailConfigLock.Lock()
+	defer mailConfigLock.Unlock()
+	mailConfig = cfg
+}
+
+func getMailConfig() config.MailConfig {
+	mailConfigLock.RLock()
+	defer mailConfigLock.RUnlock()
+	return mailConfig
 }
 
-func SendEmailToUser(user *model.User, params interface{}, templateType int) {
-	SendEmail(user.Email, params, templateType)
+func SendEmailToUser(user *model.User, params interface{}, templateType int) error {
+	return SendEmail(user.Email, params, templateType)
 }
 
-func SendEmail(toAddress string, params interface{}, templateType int) {
+func SendEmail(toAddress string, params interface{}, templateType int) error {
+
+	templates, err := getTemplateMap()
+	if err != nil {
+		return utils.InternalError(err)
+	}
 
 	var buf bytes.Buffer
-	config := getTemplateMap()[templateType]
+	config := templates[templateType]
 
 	template := config.htmlTemplate
 	if err := template.Execute(&buf, params); err != nil {
-		panic(err)
+		return utils.InternalError(err)
 	}
 
 	htmlBody := buf.String()
@@ -93,32 +116,32 @@ func SendEmail(toAddress string, params interface{}, templateType int) {
 	buf.Reset()
 	template = config.textTemplate
 	if err := template.Execute(&buf, params); err != nil {
-		panic(err)
+		return utils.InternalError(err)
 	}
 	textBody := buf.String()
 
-	mailFromAddress := os.Getenv("MAIL_FROM_ADDRESS")
-	mailFromName := os.Getenv("MAIL_FROM_NAME")
-	mailBccAddress := os.Getenv("MAIL_BCC_ADDRESS")
-	mailBccName := os.Getenv("MAIL_BCC_NAME")
-	mailHost := os.Getenv("MAIL_HOST")
-	mailPort, _ := strconv.Atoi(os.Getenv("MAIL_PORT"))
-	mailUser := os.Getenv("MAIL_USERNAME")
-	mailPassword := os.Getenv("MAIL_PASSWORD")
+	mail := getMailConfig()
+	if len(mail.Host) == 0 {
+		return utils.InternalError(errors.New("mail server is not configured"))
+	}
 
 	m := gomail.NewMessage()
-	m.SetAddressHeader("From", mailFromAddress, mailFromName)
+	m.SetAddressHeader("From", mail.FromAddress, mail.FromName)
 	m.SetHeader("To", toAddress)
-	m.SetAddressHeader("Bcc", mailBccAddress, mailBccName)
+	if len(mail.BccAddress) > 0 {
+		m.SetAddressHeader("Bcc", mail.BccAddress, mail.BccName)
+	}
 	m.SetHeader("Subject", config.subject)
 	m.SetBody("text/plain", textBody)
 	m.AddAlternative("text/html", htmlBody)
 
-	d := gomail.NewDialer(mailHost, mailPort, mailUser, mailPassword)
+	d := gomail.NewDialer(mail.Host, mail.Port, mail.Username, mail.Password.Value())
 
 	// Send the email to Bob, Cora and Dan.
 	if err := d.DialAndSend(m); err != nil {
-		panic(err)
+		return utils.InternalError(err)
 	}
 
+	return nil
+
 }
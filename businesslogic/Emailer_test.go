@@ -27,7 +27,9 @@ import (
 
 func TestSendPasswordResetEmail(t *testing.T) {
 
-	userCache := NewUserCache()
+	requireDatabase(t)
+
+	userCache := NewUserCache(testProvider)
 
 	requestId := 1274
 	connections.WithDatabase(30*time.Second, func(db *gorm.DB) {
@@ -37,9 +39,11 @@ func TestSendPasswordResetEmail(t *testing.T) {
 			t.Error("failed to get request")
 		}
 
-		user := userCache.Get(request.UserId)
+		user := getTestUser(t, userCache, request.UserId)
 
-		SendEmailToUser(user, &request, PasswordResetRequestTemplate)
+		if err := SendEmailToUser(user, &request, PasswordResetRequestTemplate); err != nil {
+			t.Error(err)
+		}
 
 	})
 
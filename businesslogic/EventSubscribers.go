@@ -0,0 +1,235 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"justthetalk/connections"
+	"justthetalk/events"
+	"justthetalk/model"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SearchIndexSubscriber keeps the search index in step with the database.
+// Post changes are delivered through the outbox, so all it has to do for
+// those is make the relay look now rather than at its next poll. Discussion
+// changes touch every post in the discussion and are handed to the job
+// runner.
+type SearchIndexSubscriber struct {
+	postProcessor *PostProcessor
+	jobRunner     *SearchIndexJobRunner
+}
+
+func NewSearchIndexSubscriber(postProcessor *PostProcessor, jobRunner *SearchIndexJobRunner) *SearchIndexSubscriber {
+	return &SearchIndexSubscriber{
+		postProcessor: postProcessor,
+		jobRunner:     jobRunner,
+	}
+}
+
+func (s *SearchIndexSubscriber) Name() string {
+	return "search-index"
+}
+
+func (s *SearchIndexSubscriber) Events() []string {
+	return []string{
+		events.NamePostCreated,
+		events.NamePostEdited,
+		events.NamePostDeleted,
+		events.NamePostModerated,
+		events.NameDiscussionEdited,
+		events.NameDiscussionMoved,
+		events.NameDiscussionLocked,
+		events.NameDiscussionDeleted,
+		events.NameDiscussionErased,
+	}
+}
+
+func (s *SearchIndexSubscriber) Handle(event events.Event) error {
+
+	var discussionId uint
+	switch e := event.(type) {
+	case *events.DiscussionEdited:
+		discussionId = e.Discussion.Id
+	case *events.DiscussionMoved:
+		discussionId = e.Discussion.Id
+	case *events.DiscussionLocked:
+		discussionId = e.Discussion.Id
+	case *events.DiscussionDeleted:
+		discussionId = e.Discussion.Id
+	case *events.DiscussionErased:
+		discussionId = e.DiscussionId
+	default:
+		s.postProcessor.Wake()
+		return nil
+	}
+
+	_, err := s.jobRunner.Enqueue(model.SearchIndexJobScopeDiscussion, discussionId, event.Name())
+	return err
+
+}
+
+// NotificationSubscriber tells users over their websocket when something
+// has been done to them or their posts
+type NotificationSubscriber struct {
+	userCache *UserCache
+	publish   func(topic string, message string) error
+}
+
+func NewNotificationSubscriber(userCache *UserCache) *NotificationSubscriber {
+	return &NotificationSubscriber{
+		userCache: userCache,
+		publish:   publishToRedis,
+	}
+}
+
+func publishToRedis(topic string, message string) error {
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancelFn()
+
+	return connections.RedisConnection().Publish(ctx, topic, message).Err()
+
+}
+
+func (s *NotificationSubscriber) Name() string {
+	return "notification"
+}
+
+func (s *NotificationSubscriber) Events() []string {
+	return []string{events.NamePostModerated, events.NameUserBlocked, events.NameUserStatusChanged}
+}
+
+func (s *NotificationSubscriber) Handle(event events.Event) error {
+
+	switch e := event.(type) {
+	case *events.PostModerated:
+		action := PubSubMessageActionRejected
+		if e.Approved() {
+			action = PubSubMessageActionApproved
+		}
+		return s.notify(e.Post.CreatedByUserId, &Envelope{Action: action, Urn: e.Urn(), Data: e.Post})
+	case *events.UserBlocked:
+		return s.notify(e.UserId, &Envelope{Action: PubSubMessageActionUpdate, Urn: events.DiscussionUrn(e.DiscussionId), Data: map[string]interface{}{"blocked": e.Blocked}})
+	case *events.UserStatusChanged:
+		return s.notify(e.UserId, &Envelope{Action: PubSubMessageActionUpdate, Urn: e.Urn(), Data: e.Changes})
+	}
+
+	return nil
+
+}
+
+func (s *NotificationSubscriber) notify(userId uint, envelope *Envelope) error {
+
+	if !s.userCache.IsActiveSubscriber(userId) {
+		return nil
+	}
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	if err := s.publish(fmt.Sprintf("user:%d", userId), string(data)); err != nil {
+		return fmt.Errorf("notifying user %d: %w", userId, err)
+	}
+
+	return nil
+
+}
+
+// AuditSubscriber writes every event to the audit log. Only the ids of what
+// was changed and by whom are logged, never the content of posts or users.
+type AuditSubscriber struct {
+	logger log.FieldLogger
+}
+
+func NewAuditSubscriber(logger log.FieldLogger) *AuditSubscriber {
+	return &AuditSubscriber{
+		logger: logger,
+	}
+}
+
+func (s *AuditSubscriber) Name() string {
+	return "audit"
+}
+
+func (s *AuditSubscriber) Events() []string {
+	return nil
+}
+
+func (s *AuditSubscriber) Handle(event events.Event) error {
+
+	fields := log.Fields{
+		"event": event.Name(),
+		"urn":   event.Urn(),
+	}
+
+	switch e := event.(type) {
+	case *events.PostCreated:
+		addPostAuditFields(fields, e.Post)
+	case *events.PostEdited:
+		addPostAuditFields(fields, e.Post)
+	case *events.PostDeleted:
+		addPostAuditFields(fields, e.Post)
+	case *events.PostModerated:
+		addPostAuditFields(fields, e.Post)
+		fields["moderatorId"] = e.ModeratorId
+	case *events.DiscussionCreated:
+		addDiscussionAuditFields(fields, e.Discussion)
+	case *events.DiscussionEdited:
+		addDiscussionAuditFields(fields, e.Discussion)
+	case *events.DiscussionMoved:
+		addDiscussionAuditFields(fields, e.Discussion)
+		fields["fromFolderId"] = e.FromFolderId
+		fields["toFolderId"] = e.ToFolderId
+	case *events.DiscussionLocked:
+		addDiscussionAuditFields(fields, e.Discussion)
+	case *events.DiscussionDeleted:
+		addDiscussionAuditFields(fields, e.Discussion)
+	case *events.DiscussionErased:
+		fields["discussionId"] = e.DiscussionId
+		fields["folderId"] = e.FolderId
+	case *events.UserBlocked:
+		fields["userId"] = e.UserId
+		fields["discussionId"] = e.DiscussionId
+		fields["adminId"] = e.AdminId
+	case *events.UserStatusChanged:
+		fields["userId"] = e.UserId
+		fields["adminId"] = e.AdminId
+	}
+
+	s.logger.WithFields(fields).Info("audit")
+
+	return nil
+
+}
+
+func addPostAuditFields(fields log.Fields, post *model.Post) {
+	fields["postId"] = post.Id
+	fields["discussionId"] = post.DiscussionId
+	fields["userId"] = post.CreatedByUserId
+}
+
+func addDiscussionAuditFields(fields log.Fields, discussion *model.Discussion) {
+	fields["discussionId"] = discussion.Id
+	fields["folderId"] = discussion.FolderId
+	fields["userId"] = discussion.CreatedByUserId
+}
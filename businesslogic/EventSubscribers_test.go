@@ -0,0 +1,104 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"bytes"
+	"encoding/json"
+	"justthetalk/events"
+	"justthetalk/model"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type publishedMessage struct {
+	topic   string
+	message string
+}
+
+func newTestNotificationSubscriber(activeUserIds ...uint) (*NotificationSubscriber, *[]publishedMessage) {
+
+	userCache := NewUserCache(nil)
+	for _, userId := range activeUserIds {
+		userCache.AddSubscriber(&model.User{ModelBase: model.ModelBase{Id: userId}})
+	}
+
+	published := make([]publishedMessage, 0)
+	subscriber := NewNotificationSubscriber(userCache)
+	subscriber.publish = func(topic string, message string) error {
+		published = append(published, publishedMessage{topic: topic, message: message})
+		return nil
+	}
+
+	return subscriber, &published
+
+}
+
+func TestNotificationSubscriberTellsTheAuthorAboutModeration(t *testing.T) {
+
+	subscriber, published := newTestNotificationSubscriber(7)
+
+	post := &model.Post{ModelBase: model.ModelBase{Id: 11}, CreatedByUserId: 7, Status: model.PostStatusDeletedByAdmin}
+	require.NoError(t, subscriber.Handle(&events.PostModerated{Post: post, ModeratorId: 1}))
+
+	require.Len(t, *published, 1)
+	assert.Equal(t, "user:7", (*published)[0].topic)
+
+	var envelope Envelope
+	require.NoError(t, json.Unmarshal([]byte((*published)[0].message), &envelope))
+	assert.Equal(t, PubSubMessageActionRejected, envelope.Action)
+	assert.Equal(t, "post:11", envelope.Urn)
+
+}
+
+func TestNotificationSubscriberSkipsUsersWhoAreNotConnected(t *testing.T) {
+
+	subscriber, published := newTestNotificationSubscriber()
+
+	require.NoError(t, subscriber.Handle(&events.UserBlocked{DiscussionId: 3, UserId: 7, Blocked: true}))
+	require.NoError(t, subscriber.Handle(&events.UserStatusChanged{UserId: 7, Changes: map[string]interface{}{"enabled": false}}))
+
+	assert.Empty(t, *published)
+
+}
+
+func TestAuditSubscriberLogsEveryEvent(t *testing.T) {
+
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+
+	subscriber := NewAuditSubscriber(logger)
+	require.NoError(t, subscriber.Handle(&events.DiscussionMoved{Discussion: &model.Discussion{ModelBase: model.ModelBase{Id: 5}, Header: "private header"}, FromFolderId: 1, ToFolderId: 2}))
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "discussion.moved", entry["event"])
+	assert.Equal(t, "discussion:5", entry["urn"])
+	assert.Equal(t, float64(2), entry["toFolderId"])
+
+	buf.Reset()
+	require.NoError(t, subscriber.Handle(&events.PostEdited{Post: &model.Post{ModelBase: model.ModelBase{Id: 9}, DiscussionId: 5, CreatedByUserId: 3, Text: "private text"}}))
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, float64(9), entry["postId"])
+	assert.Equal(t, float64(3), entry["userId"])
+	assert.NotContains(t, buf.String(), "private", "content is never logged")
+
+}
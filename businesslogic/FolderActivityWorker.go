@@ -0,0 +1,141 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"context"
+	"fmt"
+	"justthetalk/repository"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	folderActivityGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "justthetalk_folder_activity",
+		Help: "Visible posts made in each folder during the activity window",
+	}, []string{"folder"})
+
+	folderDiscussionCountGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "justthetalk_folder_discussion_count",
+		Help: "Count of discussions in each folder",
+	}, []string{"folder"})
+)
+
+// FolderActivityWorker periodically recalculates each folder's activity over
+// a rolling window and reloads the folder cache, which also picks up fresh
+// discussion counts. Every instance runs it against its own cache, so the
+// reload isn't broadcast.
+type FolderActivityWorker struct {
+	interval    time.Duration
+	window      time.Duration
+	folderCache *FolderCache
+	provider    repository.Provider
+	quit        chan struct{}
+	done        chan struct{}
+	stopOnce    sync.Once
+}
+
+func NewFolderActivityWorker(interval time.Duration, window time.Duration, folderCache *FolderCache, provider repository.Provider) *FolderActivityWorker {
+	return &FolderActivityWorker{
+		interval:    interval,
+		window:      window,
+		folderCache: folderCache,
+		provider:    provider,
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+func (w *FolderActivityWorker) Start(ctx context.Context) error {
+	go w.worker(ctx)
+	return nil
+}
+
+func (w *FolderActivityWorker) Stop(ctx context.Context) error {
+
+	w.stopOnce.Do(func() {
+		close(w.quit)
+	})
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stopping folder activity worker: %w", ctx.Err())
+	}
+
+}
+
+func (w *FolderActivityWorker) worker(ctx context.Context) {
+
+	log.Info("Starting FolderActivityWorker...")
+
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	// the figures loaded at startup may be arbitrarily old
+	w.recalculate(time.Now().UTC())
+
+	for {
+		select {
+		case <-ticker.C:
+			w.recalculate(time.Now().UTC())
+		case <-w.quit:
+			log.Info("...closing FolderActivityWorker")
+			return
+		case <-ctx.Done():
+			log.Info("...closing FolderActivityWorker")
+			return
+		}
+	}
+
+}
+
+func (w *FolderActivityWorker) recalculate(now time.Time) {
+
+	var err error
+	w.provider.WithRepository(10*time.Second, func(repo repository.Repository) {
+		err = repo.Folders().CalculateActivity(now.Add(-w.window))
+	})
+
+	if err != nil {
+		log.Errorf("FolderActivityWorker: calculating activity: %v", err)
+		return
+	}
+
+	if err := w.folderCache.Reload(); err != nil {
+		log.Errorf("FolderActivityWorker: reloading folders: %v", err)
+		return
+	}
+
+	// folders may have been renamed since the last run
+	folderActivityGauge.Reset()
+	folderDiscussionCountGauge.Reset()
+
+	for _, folder := range w.folderCache.Entries() {
+		folderActivityGauge.WithLabelValues(folder.Key).Set(float64(folder.Activity))
+		folderDiscussionCountGauge.WithLabelValues(folder.Key).Set(float64(folder.DiscussionCount))
+	}
+
+}
@@ -0,0 +1,60 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository/memory"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFolderActivityWorkerRecalculates(t *testing.T) {
+
+	store := memory.NewStore()
+	busy := store.AddFolder(&model.Folder{Key: "busy", Description: "Busy", Type: model.FolderTypeNormal})
+	quiet := store.AddFolder(&model.Folder{Key: "quiet", Description: "Quiet", Type: model.FolderTypeNormal})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+
+	folderCache, err := NewFolderCache(store)
+	require.NoError(t, err)
+
+	discussion, err := store.Discussions().Create(busy.Id, "Busy", "", user.Id, false)
+	require.NoError(t, err)
+	for _, status := range []int{model.PostStatusOK, model.PostStatusPostedByAdmin, model.PostStatusSuspendedByAdmin} {
+		_, err := store.Posts().Create(busy.Id, discussion.Id, "Post", status, user.Id)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, uint(0), folderCache.UnsafeGet(busy.Id).DiscussionCount, "the cache is only as fresh as its last reload")
+
+	worker := NewFolderActivityWorker(time.Hour, 24*time.Hour, folderCache, store)
+	worker.recalculate(time.Now().UTC())
+
+	assert.Equal(t, 2, folderCache.UnsafeGet(busy.Id).Activity, "suspended posts don't count")
+	assert.Equal(t, uint(1), folderCache.UnsafeGet(busy.Id).DiscussionCount)
+	assert.Equal(t, 0, folderCache.UnsafeGet(quiet.Id).Activity)
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(folderActivityGauge.WithLabelValues("busy")))
+
+	worker.recalculate(time.Now().UTC().Add(48 * time.Hour))
+	assert.Equal(t, 0, folderCache.UnsafeGet(busy.Id).Activity, "posts outside the window don't count")
+
+}
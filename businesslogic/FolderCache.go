@@ -16,50 +16,234 @@
 package businesslogic
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"justthetalk/connections"
 	"justthetalk/model"
+	"justthetalk/repository"
 	"justthetalk/utils"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"gorm.io/gorm"
+	"github.com/google/uuid"
+
+	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// folderReloadChannel tells every API instance to reload its folders
+	folderReloadChannel = "cache:folder"
+
+	// folderCacheRefreshInterval bounds how long an instance can go on
+	// serving stale folders if it misses a reload message
+	folderCacheRefreshInterval = 5 * time.Minute
+)
+
+// folderSnapshot is never modified once it has been published, so readers
+// can use it without locking
+type folderSnapshot struct {
+	entries []*model.Folder
+	byId    map[uint]*model.Folder
+}
+
+// FolderCache holds every folder in memory. A reload builds a new snapshot
+// and swaps it in whole, so readers see either the old folders or the new
+// ones and never a mixture. Admin changes are broadcast so that the other
+// instances reload too.
 type FolderCache struct {
-	entries       []*model.Folder
-	byId          map[uint]*model.Folder
-	updateChannel chan *model.Post
+	provider   repository.Provider
+	snapshot   atomic.Value
+	shared     sharedCacheTier
+	instanceId string
+	reloadLock sync.Mutex
+	quit       chan struct{}
+	done       chan struct{}
+	stopOnce   sync.Once
+	isStarted  bool
+}
+
+// folderReload is broadcast when folders change. Instances ignore their own
+// messages as they have already reloaded.
+type folderReload struct {
+	Instance string `json:"instance"`
 }
 
-func NewFolderCache() *FolderCache {
+func NewFolderCache(provider repository.Provider) (*FolderCache, error) {
 
 	cache := &FolderCache{
-		byId:          make(map[uint]*model.Folder),
-		updateChannel: make(chan *model.Post, 50),
+		provider:   provider,
+		shared:     &redisCacheTier{},
+		instanceId: uuid.New().String(),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	if err := cache.Reload(); err != nil {
+		return nil, err
 	}
 
-	connections.WithDatabase(1*time.Second, func(db *gorm.DB) {
-		if result := db.Raw("call get_folders()").Scan(&cache.entries); result.Error != nil {
-			panic(result.Error)
+	return cache, nil
+
+}
+
+// Start listens for reloads requested by the other instances
+func (cache *FolderCache) Start(ctx context.Context) error {
+
+	if cache.isStarted {
+		return errors.New("folder cache already started")
+	}
+
+	cache.isStarted = true
+	go cache.listen(ctx)
+
+	return nil
+
+}
+
+func (cache *FolderCache) Stop(ctx context.Context) error {
+
+	cache.stopOnce.Do(func() {
+		close(cache.quit)
+	})
+
+	if !cache.isStarted {
+		return nil
+	}
+
+	select {
+	case <-cache.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stopping folder cache: %w", ctx.Err())
+	}
+
+}
+
+func (cache *FolderCache) listen(ctx context.Context) {
+
+	defer close(cache.done)
+
+	subscription := connections.RedisConnection().Subscribe(ctx, folderReloadChannel)
+	defer subscription.Close()
+
+	ticker := time.NewTicker(folderCacheRefreshInterval)
+	defer ticker.Stop()
+
+	messages := subscription.Channel()
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			cache.handleReload([]byte(message.Payload))
+		case <-ticker.C:
+			if err := cache.Reload(); err != nil {
+				log.Errorf("FolderCache: periodic reload: %v", err)
+			}
+		case <-cache.quit:
+			return
+		case <-ctx.Done():
+			return
 		}
+	}
+
+}
+
+func (cache *FolderCache) handleReload(payload []byte) {
+
+	var message folderReload
+	if err := json.Unmarshal(payload, &message); err != nil {
+		log.Errorf("FolderCache: unreadable reload %q: %v", payload, err)
+		return
+	}
+
+	if message.Instance == cache.instanceId {
+		return
+	}
+
+	if err := cache.Reload(); err != nil {
+		log.Errorf("FolderCache: reload: %v", err)
+	}
+
+}
+
+// Reload reads the folders from the database and swaps them in
+func (cache *FolderCache) Reload() error {
+
+	cache.reloadLock.Lock()
+	defer cache.reloadLock.Unlock()
+
+	var folders []*model.Folder
+	var err error
+	cache.provider.WithRepository(1*time.Second, func(repo repository.Repository) {
+		folders, err = repo.Folders().GetFolders()
 	})
 
-	for _, entry := range cache.entries {
-		cache.byId[entry.ModelBase.Id] = entry
+	if err != nil {
+		return utils.InternalError(err)
+	}
+
+	next := &folderSnapshot{
+		entries: folders,
+		byId:    make(map[uint]*model.Folder),
+	}
+
+	for _, entry := range next.entries {
+		next.byId[entry.ModelBase.Id] = entry
+	}
+
+	cache.snapshot.Store(next)
+
+	return nil
+
+}
+
+// Changed reloads this instance's folders and tells the other instances to
+// do the same. A failure to publish is logged rather than returned as the
+// change itself has been made and the others will catch up on their next
+// periodic reload.
+func (cache *FolderCache) Changed() error {
+
+	if err := cache.Reload(); err != nil {
+		return err
 	}
 
-	return cache
+	data, err := json.Marshal(&folderReload{Instance: cache.instanceId})
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancelFn()
+
+	if err := cache.shared.Publish(ctx, folderReloadChannel, data); err != nil {
+		log.Errorf("FolderCache: publishing reload: %v", err)
+	}
+
+	return nil
+
+}
 
+func (cache *FolderCache) current() *folderSnapshot {
+	return cache.snapshot.Load().(*folderSnapshot)
 }
 
+// Entries returns the folders in display order. The slice and the folders
+// in it are shared with other readers and must not be modified.
 func (cache *FolderCache) Entries() []*model.Folder {
-	return cache.entries
+	return cache.current().entries
 }
 
-func (cache *FolderCache) Get(id uint, user *model.User) *model.Folder {
+func (cache *FolderCache) Get(id uint, user *model.User) (*model.Folder, error) {
 
 	var folder *model.Folder
 
-	if f, exists := cache.byId[id]; exists {
+	if f, exists := cache.current().byId[id]; exists {
 		if f.Type == model.FolderTypeNormal {
 			folder = f
 		} else if user != nil && user.IsAdmin {
@@ -68,16 +252,16 @@ func (cache *FolderCache) Get(id uint, user *model.User) *model.Folder {
 	}
 
 	if folder == nil {
-		panic(utils.ErrForbidden)
+		return nil, utils.NewError(utils.ErrForbidden, utils.ErrorCodeFolderForbidden, "You do not have access to this folder")
 	}
 
-	return folder
+	return folder, nil
 
 }
 
 func (cache *FolderCache) SafeGet(id uint) *model.Folder {
 
-	if f, exists := cache.byId[id]; exists && f.Type == model.FolderTypeNormal {
+	if f, exists := cache.current().byId[id]; exists && f.Type == model.FolderTypeNormal {
 		return f
 	}
 
@@ -87,7 +271,7 @@ func (cache *FolderCache) SafeGet(id uint) *model.Folder {
 
 func (cache *FolderCache) UnsafeGet(id uint) *model.Folder {
 
-	if f, exists := cache.byId[id]; exists {
+	if f, exists := cache.current().byId[id]; exists {
 		return f
 	}
 
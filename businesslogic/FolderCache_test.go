@@ -0,0 +1,149 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"encoding/json"
+	"errors"
+	"justthetalk/config"
+	"justthetalk/model"
+	"justthetalk/repository/memory"
+	"justthetalk/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newUnitFolderCache(t *testing.T, store *memory.Store) (*FolderCache, *fakeCacheTier) {
+
+	cache, err := NewFolderCache(store)
+	require.NoError(t, err)
+
+	shared := newFakeCacheTier()
+	cache.shared = shared
+
+	return cache, shared
+
+}
+
+func TestFolderCacheReloadsOnOtherInstancesChanges(t *testing.T) {
+
+	store := memory.NewStore()
+	store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+
+	cache, _ := newUnitFolderCache(t, store)
+	before := cache.Entries()
+	require.Len(t, before, 1)
+
+	created, err := store.Folders().Create("news", "News", model.FolderTypeNormal)
+	require.NoError(t, err)
+
+	own, err := json.Marshal(&folderReload{Instance: cache.instanceId})
+	require.NoError(t, err)
+	cache.handleReload(own)
+	assert.Nil(t, cache.UnsafeGet(created.Id), "an instance ignores its own reloads")
+
+	other, err := json.Marshal(&folderReload{Instance: "other"})
+	require.NoError(t, err)
+	cache.handleReload(other)
+	assert.NotNil(t, cache.UnsafeGet(created.Id))
+	assert.Len(t, cache.Entries(), 2)
+
+	assert.Len(t, before, 1, "a reader's snapshot is never modified")
+
+}
+
+func TestFolderAdmin(t *testing.T) {
+
+	store := memory.NewStore()
+	general := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+
+	cache, shared := newUnitFolderCache(t, store)
+
+	_, err := CreateFolder(&model.Folder{Key: "Not Valid", Description: "", Type: 7}, cache, store)
+	var typedErr *utils.Error
+	if assert.True(t, errors.As(err, &typedErr)) {
+		assert.Equal(t, utils.ErrorCodeValidationFailed, typedErr.Code)
+		assert.Len(t, typedErr.Fields, 3)
+	}
+
+	_, err = CreateFolder(&model.Folder{Key: "general", Description: "Another", Type: model.FolderTypeNormal}, cache, store)
+	if assert.True(t, errors.As(err, &typedErr)) {
+		assert.Equal(t, utils.ErrorCodeFolderKeyExists, typedErr.Code)
+	}
+
+	created, err := CreateFolder(&model.Folder{Key: "news", Description: " News ", Type: model.FolderTypeNormal}, cache, store)
+	require.NoError(t, err)
+	assert.Equal(t, "News", created.Description)
+	assert.NotNil(t, cache.SafeGet(created.Id))
+	assert.Len(t, shared.published, 1)
+
+	_, err = ReorderFolders([]uint{created.Id}, cache, store)
+	assert.True(t, errors.Is(err, utils.ErrBadRequest), "every folder must be included")
+
+	_, err = ReorderFolders([]uint{created.Id, created.Id}, cache, store)
+	assert.True(t, errors.Is(err, utils.ErrBadRequest), "folders can't be repeated")
+
+	folders, err := ReorderFolders([]uint{created.Id, general.Id}, cache, store)
+	require.NoError(t, err)
+	if assert.Len(t, folders, 2) {
+		assert.Equal(t, created.Id, folders[0].Id)
+		assert.Equal(t, general.Id, folders[1].Id)
+	}
+
+	discussionCache := NewDiscussionCache(config.Default().DiscussionCache, cache, store)
+	discussionCache.shared = newFakeCacheTier()
+	indexJobRunner := NewSearchIndexJobRunner(time.Minute, nil, cache, store)
+
+	discussion, err := store.Discussions().Create(created.Id, "Headlines", "", user.Id, false)
+	require.NoError(t, err)
+	cached, err := discussionCache.UnsafeGet(discussion.Id)
+	require.NoError(t, err)
+	assert.Contains(t, cached.Url, "/news/")
+
+	_, err = UpdateFolder(general.Id+100, &model.Folder{Key: "missing", Description: "Missing"}, cache, indexJobRunner, store)
+	assert.True(t, errors.Is(err, utils.ErrNotFound))
+
+	archived, err := UpdateFolder(created.Id, &model.Folder{Key: "old-news", Description: "Old News", Type: model.FolderTypeNormal, IsArchived: true}, cache, indexJobRunner, store)
+	require.NoError(t, err)
+	assert.Equal(t, "old-news", archived.Key)
+	assert.True(t, cache.UnsafeGet(created.Id).IsArchived)
+
+	cached, err = discussionCache.UnsafeGet(discussion.Id)
+	require.NoError(t, err)
+	assert.Contains(t, cached.Url, "/old-news/", "cached discussions pick up the new key")
+
+	jobs, err := store.SearchIndexJobs().GetRecent(0, 10)
+	require.NoError(t, err)
+	if assert.Len(t, jobs, 1) {
+		assert.Equal(t, model.SearchIndexJobScopeFolder, jobs[0].Scope)
+		assert.Equal(t, created.Id, jobs[0].TargetId)
+	}
+	select {
+	case <-indexJobRunner.wake:
+	default:
+		t.Error("the index job runner is woken")
+	}
+
+	_, err = CreateDiscussion(cache.UnsafeGet(created.Id), &model.Discussion{Title: "Too late"}, user, nil, nil, nil, store)
+	if assert.True(t, errors.As(err, &typedErr)) {
+		assert.Equal(t, utils.ErrorCodeFolderArchived, typedErr.Code)
+	}
+
+}
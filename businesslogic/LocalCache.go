@@ -0,0 +1,133 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// localCache is a fixed size, in-process, least recently used cache keyed by
+// id. Each value carries the version of the row it came from so that a stale
+// copy can't replace a newer one. Entries also expire after ttl, which bounds
+// how long one can be served after a missed invalidation.
+type localCache struct {
+	mutex   sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[uint]*list.Element
+	order   *list.List
+	now     func() time.Time
+}
+
+type localCacheEntry struct {
+	key     uint
+	value   interface{}
+	version uint
+	expires time.Time
+}
+
+func newLocalCache(size int, ttl time.Duration) *localCache {
+	return &localCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[uint]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+func (c *localCache) Get(key uint) (interface{}, bool) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, exists := c.entries[key]
+	if !exists {
+		return nil, false
+	}
+
+	entry := element.Value.(*localCacheEntry)
+	if c.now().After(entry.expires) {
+		c.remove(element)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+
+	return entry.value, true
+
+}
+
+// Put stores value unless the cache already holds a newer version of it and
+// reports whether it did
+func (c *localCache) Put(key uint, value interface{}, version uint) bool {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, exists := c.entries[key]; exists {
+		entry := element.Value.(*localCacheEntry)
+		if entry.version > version && !c.now().After(entry.expires) {
+			return false
+		}
+		entry.value = value
+		entry.version = version
+		entry.expires = c.now().Add(c.ttl)
+		c.order.MoveToFront(element)
+		return true
+	}
+
+	c.entries[key] = c.order.PushFront(&localCacheEntry{
+		key:     key,
+		value:   value,
+		version: version,
+		expires: c.now().Add(c.ttl),
+	})
+
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+
+	return true
+
+}
+
+func (c *localCache) Remove(key uint) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, exists := c.entries[key]; exists {
+		c.remove(element)
+	}
+
+}
+
+func (c *localCache) Len() int {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.order.Len()
+
+}
+
+func (c *localCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*localCacheEntry).key)
+}
@@ -0,0 +1,72 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalCacheEvictsTheLeastRecentlyUsed(t *testing.T) {
+
+	cache := newLocalCache(2, time.Minute)
+	cache.Put(1, "one", 1)
+	cache.Put(2, "two", 1)
+
+	_, found := cache.Get(1)
+	assert.True(t, found)
+
+	cache.Put(3, "three", 1)
+	assert.Equal(t, 2, cache.Len())
+
+	_, found = cache.Get(2)
+	assert.False(t, found, "2 was used least recently")
+	_, found = cache.Get(1)
+	assert.True(t, found)
+
+}
+
+func TestLocalCacheKeepsTheNewerVersion(t *testing.T) {
+
+	cache := newLocalCache(10, time.Minute)
+	assert.True(t, cache.Put(1, "v2", 2))
+	assert.False(t, cache.Put(1, "v1", 1))
+	assert.True(t, cache.Put(1, "v2 again", 2))
+
+	value, _ := cache.Get(1)
+	assert.Equal(t, "v2 again", value)
+
+}
+
+func TestLocalCacheEntriesExpire(t *testing.T) {
+
+	now := time.Now()
+	cache := newLocalCache(10, time.Minute)
+	cache.now = func() time.Time { return now }
+	cache.Put(1, "v2", 2)
+
+	now = now.Add(2 * time.Minute)
+	_, found := cache.Get(1)
+	assert.False(t, found)
+	assert.Equal(t, 0, cache.Len())
+
+	cache.Put(1, "v2", 2)
+	now = now.Add(2 * time.Minute)
+	assert.True(t, cache.Put(1, "v1", 1), "an expired entry doesn't hold back an older version")
+
+}
@@ -0,0 +1,158 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"fmt"
+	"justthetalk/config"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"justthetalk/utils"
+	"strings"
+	"time"
+)
+
+const (
+	ModerationResultKeep   = "KEEP"
+	ModerationResultDelete = "DELETE"
+)
+
+// moderationStatuses names post statuses the way the configuration does
+var moderationStatuses = map[int]string{
+	model.PostStatusOK:               config.ModerationStatusOK,
+	model.PostStatusSuspendedByAdmin: config.ModerationStatusSuspended,
+	model.PostStatusPostedByAdmin:    config.ModerationStatusAdmin,
+	model.PostStatusWatch:            config.ModerationStatusWatch,
+}
+
+// ModerationDecision is what the policy makes of the votes on a post. An
+// empty Result leaves the post in the queue.
+type ModerationDecision struct {
+	Result    string
+	Score     int
+	Voters    int
+	Threshold int
+}
+
+// ModerationPolicy decides when the moderators' votes on a queued post are
+// enough to keep or delete it. Both the admin API and the queue cleaner go
+// through it so that they always agree.
+type ModerationPolicy struct {
+	cfg config.ModerationConfig
+}
+
+func NewModerationPolicy(cfg config.ModerationConfig) *ModerationPolicy {
+	return &ModerationPolicy{
+		cfg: cfg,
+	}
+}
+
+// Threshold is how far the votes on the post must lean one way to settle it.
+// The post's status is more specific than its folder.
+func (p *ModerationPolicy) Threshold(folder *model.Folder, post *model.Post) int {
+
+	if threshold, exists := p.cfg.StatusThresholds[moderationStatuses[post.Status]]; exists {
+		return threshold
+	}
+
+	if folder != nil {
+		if threshold, exists := p.cfg.FolderThresholds[folder.Key]; exists {
+			return threshold
+		}
+	}
+
+	return p.cfg.Threshold
+
+}
+
+// weight is how many times the comment's vote counts. Votes from moderators
+// without a weighted role count once.
+func (p *ModerationPolicy) weight(comment *model.ModeratorComment) int {
+
+	weight := -1
+	for _, role := range strings.Split(comment.Roles, ",") {
+		if roleWeight, exists := p.cfg.RoleWeights[strings.TrimSpace(role)]; exists && roleWeight > weight {
+			weight = roleWeight
+		}
+	}
+
+	if weight < 0 {
+		return 1
+	}
+
+	return weight
+
+}
+
+// Decide settles the post once enough moderators have voted and their votes
+// reach its threshold. A post nobody has voted on is kept once it has been
+// queued for longer than KeepAfter; pass a zero queuedSince to skip that.
+func (p *ModerationPolicy) Decide(folder *model.Folder, post *model.Post, comments []*model.ModeratorComment, queuedSince time.Time, now time.Time) *ModerationDecision {
+
+	decision := &ModerationDecision{
+		Threshold: p.Threshold(folder, post),
+	}
+
+	voters := make(map[uint]bool)
+	for _, comment := range comments {
+		vote := comment.Vote * p.weight(comment)
+		if vote != 0 {
+			voters[comment.UserId] = true
+		}
+		decision.Score += vote
+	}
+	decision.Voters = len(voters)
+
+	if decision.Voters >= p.cfg.Quorum && utils.Abs(decision.Score) >= decision.Threshold {
+		if decision.Score < 0 {
+			decision.Result = ModerationResultDelete
+		} else {
+			decision.Result = ModerationResultKeep
+		}
+	} else if decision.Voters == 0 && p.cfg.KeepAfter > 0 && !queuedSince.IsZero() && now.Sub(queuedSince) >= p.cfg.KeepAfter {
+		decision.Result = ModerationResultKeep
+	}
+
+	return decision
+
+}
+
+// ApplyModerationDecision sets the post's status as decided and records the
+// result in its author's history. A decision with no result changes nothing.
+func ApplyModerationDecision(decision *ModerationDecision, post *model.Post, author *model.User, repo repository.Repository) (*model.Post, error) {
+
+	var status int
+	switch decision.Result {
+	case ModerationResultKeep:
+		status = model.PostStatusOK
+	case ModerationResultDelete:
+		status = model.PostStatusDeletedByAdmin
+	default:
+		return post, nil
+	}
+
+	if err := CreateUserHistory(model.UserHistoryAdminPostModerated, fmt.Sprintf("PostId: %d, %s", post.Id, decision.Result), author, repo); err != nil {
+		return nil, err
+	}
+
+	updated, err := repo.Posts().SetStatus(post.DiscussionId, post.Id, status, decision.Score)
+	if err != nil {
+		return nil, postError(err)
+	}
+
+	return updated, nil
+
+}
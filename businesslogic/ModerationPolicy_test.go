@@ -0,0 +1,173 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"justthetalk/config"
+	"justthetalk/model"
+	"justthetalk/repository/memory"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func votes(votes ...int) []*model.ModeratorComment {
+	comments := make([]*model.ModeratorComment, 0, len(votes))
+	for i, vote := range votes {
+		comments = append(comments, &model.ModeratorComment{UserId: uint(i + 1), Vote: vote})
+	}
+	return comments
+}
+
+func TestModerationPolicy(t *testing.T) {
+
+	now := time.Now().UTC()
+	general := &model.Folder{Key: "general"}
+	politics := &model.Folder{Key: "politics"}
+
+	weighted := votes(1)
+	weighted[0].Roles = "ROLE_USER,ROLE_SENIOR_MODERATOR"
+
+	tests := []struct {
+		name        string
+		configure   func(cfg *config.ModerationConfig)
+		folder      *model.Folder
+		status      int
+		comments    []*model.ModeratorComment
+		queuedSince time.Time
+		result      string
+		score       int
+	}{
+		{"no votes", nil, general, model.PostStatusOK, nil, time.Time{}, "", 0},
+		{"one vote isn't enough", nil, general, model.PostStatusOK, votes(-1), time.Time{}, "", -1},
+		{"two votes delete", nil, general, model.PostStatusOK, votes(-1, -1), time.Time{}, ModerationResultDelete, -2},
+		{"two votes keep", nil, general, model.PostStatusOK, votes(1, 1), time.Time{}, ModerationResultKeep, 2},
+		{"split votes", nil, general, model.PostStatusOK, votes(1, -1, -1), time.Time{}, "", -1},
+		{"comments without votes", nil, general, model.PostStatusOK, votes(0, 0, 0), time.Time{}, "", 0},
+		{"one vote settles a suspended post", nil, general, model.PostStatusSuspendedByAdmin, votes(-1), time.Time{}, ModerationResultDelete, -1},
+		{"one vote settles a watched post", nil, general, model.PostStatusWatch, votes(1), time.Time{}, ModerationResultKeep, 1},
+		{"folder threshold", func(cfg *config.ModerationConfig) {
+			cfg.FolderThresholds = map[string]int{"politics": 3}
+		}, politics, model.PostStatusOK, votes(-1, -1), time.Time{}, "", -2},
+		{"folder threshold reached", func(cfg *config.ModerationConfig) {
+			cfg.FolderThresholds = map[string]int{"politics": 3}
+		}, politics, model.PostStatusOK, votes(-1, -1, -1), time.Time{}, ModerationResultDelete, -3},
+		{"status threshold beats folder threshold", func(cfg *config.ModerationConfig) {
+			cfg.FolderThresholds = map[string]int{"politics": 3}
+		}, politics, model.PostStatusWatch, votes(-1), time.Time{}, ModerationResultDelete, -1},
+		{"weighted role", func(cfg *config.ModerationConfig) {
+			cfg.RoleWeights = map[string]int{"ROLE_SENIOR_MODERATOR": 2}
+		}, general, model.PostStatusOK, weighted, time.Time{}, ModerationResultKeep, 2},
+		{"role weighted to nothing", func(cfg *config.ModerationConfig) {
+			cfg.RoleWeights = map[string]int{"ROLE_SENIOR_MODERATOR": 0}
+		}, general, model.PostStatusWatch, weighted, time.Time{}, "", 0},
+		{"quorum not met", func(cfg *config.ModerationConfig) {
+			cfg.Quorum = 2
+		}, general, model.PostStatusSuspendedByAdmin, votes(-1), time.Time{}, "", -1},
+		{"quorum met", func(cfg *config.ModerationConfig) {
+			cfg.Quorum = 2
+		}, general, model.PostStatusSuspendedByAdmin, votes(-1, -1), time.Time{}, ModerationResultDelete, -2},
+		{"kept after timeout without votes", func(cfg *config.ModerationConfig) {
+			cfg.KeepAfter = 48 * time.Hour
+		}, general, model.PostStatusOK, nil, now.Add(-49 * time.Hour), ModerationResultKeep, 0},
+		{"timeout not reached", func(cfg *config.ModerationConfig) {
+			cfg.KeepAfter = 48 * time.Hour
+		}, general, model.PostStatusOK, nil, now.Add(-time.Hour), "", 0},
+		{"timeout doesn't override votes", func(cfg *config.ModerationConfig) {
+			cfg.KeepAfter = 48 * time.Hour
+		}, general, model.PostStatusOK, votes(-1), now.Add(-49 * time.Hour), "", -1},
+		{"no timeout by default", nil, general, model.PostStatusOK, nil, now.Add(-365 * 24 * time.Hour), "", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			cfg := config.Default().Moderation
+			if test.configure != nil {
+				test.configure(&cfg)
+			}
+
+			decision := NewModerationPolicy(cfg).Decide(test.folder, &model.Post{Status: test.status}, test.comments, test.queuedSince, now)
+			assert.Equal(t, test.result, decision.Result)
+			assert.Equal(t, test.score, decision.Score)
+
+		})
+	}
+
+}
+
+func TestApplyModerationDecision(t *testing.T) {
+
+	store := memory.NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+	discussion, _ := store.Discussions().Create(folder.Id, "Moderated", "", user.Id, false)
+	post, err := store.Posts().Create(folder.Id, discussion.Id, "rude", model.PostStatusWatch, user.Id)
+	require.NoError(t, err)
+
+	unchanged, err := ApplyModerationDecision(&ModerationDecision{Score: -1}, post, user, store)
+	require.NoError(t, err)
+	assert.Equal(t, model.PostStatusWatch, unchanged.Status)
+
+	deleted, err := ApplyModerationDecision(&ModerationDecision{Result: ModerationResultDelete, Score: -2}, post, user, store)
+	require.NoError(t, err)
+	assert.Equal(t, model.PostStatusDeletedByAdmin, deleted.Status)
+	assert.Equal(t, -2, deleted.ModerationResult)
+
+	history, err := store.Users().GetHistory(user.Id)
+	require.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, model.UserHistoryAdminPostModerated, history[0].EventType)
+	}
+
+}
+
+func TestCreateCommentWeighsModeratorRoles(t *testing.T) {
+
+	store := memory.NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	author := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+	moderator := store.AddUser(&model.User{Username: "mod", Email: "mod@example.com", Enabled: true, IsAdmin: true})
+	senior := store.AddUser(&model.User{Username: "senior", Email: "senior@example.com", Enabled: true, IsAdmin: true})
+	store.AddUserRoles(senior.Id, "ROLE_USER", "ROLE_SENIOR_MODERATOR")
+	discussion, _ := store.Discussions().Create(folder.Id, "Moderated", "", author.Id, false)
+
+	userCache := NewUserCache(store)
+	userCache.shared = newFakeCacheTier()
+
+	cfg := config.Default().Moderation
+	cfg.RoleWeights = map[string]int{"ROLE_SENIOR_MODERATOR": 2}
+	policy := NewModerationPolicy(cfg)
+
+	vote := func(user *model.User) (*model.Post, []*model.ModeratorComment) {
+		post, err := store.Posts().Create(folder.Id, discussion.Id, "rude", model.PostStatusOK, author.Id)
+		require.NoError(t, err)
+		comments, updated, err := CreateComment(&model.ModeratorComment{Body: "delete", Vote: -1}, folder, discussion, post, user, policy, userCache, store)
+		require.NoError(t, err)
+		return updated, comments
+	}
+
+	kept, _ := vote(moderator)
+	assert.Equal(t, model.PostStatusOK, kept.Status, "one ordinary vote is below the threshold")
+
+	deleted, comments := vote(senior)
+	assert.Equal(t, "ROLE_USER,ROLE_SENIOR_MODERATOR", comments[0].Roles)
+	assert.Equal(t, model.PostStatusDeletedByAdmin, deleted.Status, "a senior moderator's vote counts twice")
+	assert.Equal(t, -2, deleted.ModerationResult)
+
+}
@@ -16,48 +16,76 @@
 package businesslogic
 
 import (
-	"justthetalk/connections"
+	"context"
+	"fmt"
+	"justthetalk/repository"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"gorm.io/gorm"
 )
 
 type MostActiveWorker struct {
-	ticker *time.Ticker
-	wait   sync.WaitGroup
-	quit   bool
+	interval time.Duration
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	provider repository.Provider
 }
 
-func NewMostActiveWorker() *MostActiveWorker {
-	worker := &MostActiveWorker{
-		ticker: time.NewTicker(time.Minute * 5),
+func NewMostActiveWorker(interval time.Duration, provider repository.Provider) *MostActiveWorker {
+	return &MostActiveWorker{
+		interval: interval,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+		provider: provider,
 	}
-	go worker.worker()
-	return worker
 }
 
-func (w *MostActiveWorker) Close() {
-	w.quit = true
-	w.ticker.Stop()
+func (w *MostActiveWorker) Start(ctx context.Context) error {
+	go w.worker(ctx)
+	return nil
 }
 
-func (w *MostActiveWorker) worker() {
+func (w *MostActiveWorker) Stop(ctx context.Context) error {
+
+	w.stopOnce.Do(func() {
+		close(w.quit)
+	})
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stopping most active worker: %w", ctx.Err())
+	}
+
+}
+
+func (w *MostActiveWorker) worker(ctx context.Context) {
 
 	log.Info("Starting MostActiveWorker...")
 
-	w.wait.Add(1)
-	defer w.wait.Done()
+	defer close(w.done)
 
-	for range w.ticker.C {
-		connections.WithDatabase(1*time.Second, func(db *gorm.DB) {
-			if result := db.Exec("call calculate_frontpage_mostactive()"); result.Error != nil {
-				log.Error(result.Error)
-			}
-		})
-	}
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
 
-	log.Info("...closing MostActiveWorker")
+	for {
+		select {
+		case <-ticker.C:
+			w.provider.WithRepository(1*time.Second, func(repo repository.Repository) {
+				if err := repo.Discussions().CalculateMostActive(); err != nil {
+					log.Error(err)
+				}
+			})
+		case <-w.quit:
+			log.Info("...closing MostActiveWorker")
+			return
+		case <-ctx.Done():
+			log.Info("...closing MostActiveWorker")
+			return
+		}
+	}
 
 }
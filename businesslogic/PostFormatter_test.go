@@ -22,9 +22,12 @@ import (
 
 func TestFormatting1(t *testing.T) {
 
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
-	discussion := discussionCache.UnsafeGet(47)
+	_, _, discussionCache := newTestCaches(t)
+
+	discussion, err := discussionCache.UnsafeGet(47)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	formatter := utils.NewPostFormatter()
 
@@ -16,24 +16,25 @@
 package businesslogic
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
+	"justthetalk/config"
 	"justthetalk/connections"
 	"justthetalk/model"
+	"justthetalk/repository"
+	"justthetalk/search"
+	"justthetalk/utils"
 
 	"runtime/debug"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
-	"github.com/elastic/go-elasticsearch/v8/esapi"
-	"gorm.io/gorm"
-
 	log "github.com/sirupsen/logrus"
 )
 
@@ -42,6 +43,11 @@ var (
 		Name: "elasticsearch_index_request_count",
 		Help: "Count of post index requests",
 	}, []string{"success"})
+
+	outboxDeliveryCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "justthetalk_outbox_delivery_count",
+		Help: "Count of post outbox deliveries by result",
+	}, []string{"result"})
 )
 
 const (
@@ -53,16 +59,26 @@ const (
 
 	PubSubMessageActionApproved = "approved"
 	PubSubMessageActionRejected = "rejected"
+
+	PubSubMessageActionAlert = "alert"
+
+	outboxLease          = time.Minute
+	maxOutboxErrorLength = 1024
 )
 
 type PostProcessor struct {
+	config          config.OutboxConfig
+	engine          search.Engine
 	userCache       *UserCache
 	folderCache     *FolderCache
 	discussionCache *DiscussionCache
-	publishChannel  chan *model.Post
-	endWait         sync.WaitGroup
-	startWait       sync.WaitGroup
-	isRunning       bool
+	alerter         *SearchAlerter
+	provider        repository.Provider
+	wake            chan struct{}
+	quit            chan struct{}
+	workerDone      chan struct{}
+	stopOnce        sync.Once
+	isStarted       bool
 }
 
 type Envelope struct {
@@ -71,294 +87,424 @@ type Envelope struct {
 	Data   interface{} `json:"data"`
 }
 
-func NewPostProcessor(userCache *UserCache, folderCache *FolderCache, discussionCache *DiscussionCache) *PostProcessor {
+func NewPostProcessor(cfg config.OutboxConfig, engine search.Engine, userCache *UserCache, folderCache *FolderCache, discussionCache *DiscussionCache, alerter *SearchAlerter, provider repository.Provider) *PostProcessor {
 
 	pubSub := &PostProcessor{
+		config:          cfg,
+		engine:          engine,
 		userCache:       userCache,
 		folderCache:     folderCache,
 		discussionCache: discussionCache,
-		publishChannel:  make(chan *model.Post, 50),
+		alerter:         alerter,
+		provider:        provider,
+		wake:            make(chan struct{}, 1),
+		quit:            make(chan struct{}),
+		workerDone:      make(chan struct{}),
 	}
 
 	return pubSub
 
 }
 
-func (p *PostProcessor) PublishPost(post *model.Post) {
-	p.publishChannel <- post
+// Wake asks the relay to check the outbox now rather than at the next poll.
+// The change itself was written to the outbox by the stored procedure that
+// saved the post, so this never blocks the caller.
+func (p *PostProcessor) Wake() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
 }
 
-func (p *PostProcessor) Run() {
-	p.startWait.Add(1)
-	go p.worker()
-	p.startWait.Wait()
+func (p *PostProcessor) Start(ctx context.Context) error {
+
+	if p.isStarted {
+		return errors.New("post processor already started")
+	}
+
+	p.isStarted = true
+	go p.worker(ctx)
+
+	return nil
+
 }
 
-func (p *PostProcessor) Close() {
-	close(p.publishChannel)
-	p.endWait.Wait()
+// Stop waits for the batch in hand to be delivered. Undelivered entries stay
+// in the outbox, so nothing is lost if ctx expires first.
+func (p *PostProcessor) Stop(ctx context.Context) error {
+
+	p.stopOnce.Do(func() {
+		close(p.quit)
+	})
+
+	if !p.isStarted {
+		return nil
+	}
+
+	select {
+	case <-p.workerDone:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stopping post processor: %w", ctx.Err())
+	}
+
 }
 
+// IsRunning is true from Start until the worker has exited
 func (p *PostProcessor) IsRunning() bool {
-	return p.isRunning
+
+	if !p.isStarted {
+		return false
+	}
+
+	select {
+	case <-p.workerDone:
+		return false
+	default:
+		return true
+	}
+
 }
 
-func (p *PostProcessor) QueueLength() int {
-	return len(p.publishChannel)
+func (p *PostProcessor) isQuitting(ctx context.Context) bool {
+	select {
+	case <-p.quit:
+		return true
+	case <-ctx.Done():
+		return true
+	default:
+		return false
+	}
 }
 
-func (p *PostProcessor) worker() {
+func (p *PostProcessor) worker(ctx context.Context) {
 
 	log.Info("Starting PostProcessor")
 
-	defer func() {
-		p.isRunning = false
-	}()
+	defer close(p.workerDone)
 
-	p.isRunning = true
-	p.startWait.Done()
+	ticker := time.NewTicker(p.config.PollInterval)
+	defer ticker.Stop()
 
-	p.endWait.Add(1)
-	for post := range p.publishChannel {
-		go p.DispatchToSubscribers(post)
-		go p.DispatchToElasticsearch(post)
-	}
-	p.endWait.Done()
+	for {
 
-	log.Info("Closed PostProcessor")
+		p.RelayOutbox(ctx)
 
-}
+		select {
+		case <-ticker.C:
+		case <-p.wake:
+		case <-p.quit:
+			log.Info("Closed PostProcessor")
+			return
+		case <-ctx.Done():
+			log.Info("PostProcessor cancelled")
+			return
+		}
+
+	}
 
-type subscribedUser struct {
-	UserId uint `gorm:"column:user_id"`
 }
 
-func (p *PostProcessor) DispatchToSubscribers(post *model.Post) (dispatchError error) {
+// RelayOutbox delivers due outbox entries until the outbox is empty or the
+// processor is asked to stop
+func (p *PostProcessor) RelayOutbox(ctx context.Context) {
 
-	connections.WithDatabase(5*time.Second, func(db *gorm.DB) {
+	for !p.isQuitting(ctx) {
 
-		defer func() {
-			if r := recover(); r != nil {
-				dispatchError = r.(error)
-				log.Error(dispatchError)
-				debug.PrintStack()
-			}
-		}()
+		var entries []*model.OutboxEntry
+		var err error
+		p.provider.WithRepository(5*time.Second, func(repo repository.Repository) {
+			entries, err = repo.Outbox().Claim(p.config.BatchSize, outboxLease)
+		})
 
-		var frontPageEntry model.FrontPageEntry
-		if result := db.Raw("call get_frontpage_entry(?)", post.DiscussionId).First(&frontPageEntry); result.Error != nil {
-			panic(result.Error)
+		if err != nil {
+			log.Errorf("Claiming outbox entries: %v", err)
+			return
 		}
 
-		var messageData string
-		if data, err := json.Marshal(frontPageEntry); err != nil {
-			panic(err)
-		} else {
-			messageData = string(data)
+		for _, entry := range entries {
+			p.relayEntry(entry)
 		}
 
-		log.Debug(messageData)
-
-		if rows, err := db.Model(&subscribedUser{}).Raw("call get_subscribers_for_post(?)", post.Id).Rows(); err == nil {
-			defer rows.Close()
-
-			for rows.Next() {
+		if len(entries) < p.config.BatchSize {
+			return
+		}
 
-				var subscriber subscribedUser
-				if err := db.ScanRows(rows, &subscriber); err != nil {
-					panic(err)
-				}
+	}
 
-				if p.userCache.IsActiveSubscriber(subscriber.UserId) && subscriber.UserId != post.CreatedByUserId {
+}
 
-					ctx, cancelFn := context.WithTimeout(context.Background(), 1*time.Second)
-					defer cancelFn()
+func (p *PostProcessor) relayEntry(entry *model.OutboxEntry) {
 
-					topic := fmt.Sprintf("user:%d", subscriber.UserId)
-					connections.RedisConnection().Publish(ctx, topic, messageData)
+	deliveryErr := p.deliver(entry)
 
-				}
+	p.provider.WithRepository(5*time.Second, func(repo repository.Repository) {
 
+		if deliveryErr == nil {
+			outboxDeliveryCount.WithLabelValues("success").Inc()
+			if err := repo.Outbox().Complete(entry.Id); err != nil {
+				log.Errorf("Completing outbox entry %d: %v", entry.Id, err)
 			}
+			return
+		}
 
+		attempts := entry.Attempts + 1
+		deadLetter := attempts >= p.config.MaxAttempts
+		if deadLetter {
+			outboxDeliveryCount.WithLabelValues("deadletter").Inc()
+			log.Errorf("Dead lettering outbox entry %d for post %d after %d attempts: %v", entry.Id, entry.PostId, attempts, deliveryErr)
+		} else {
+			outboxDeliveryCount.WithLabelValues("retry").Inc()
+			log.Warnf("Delivering outbox entry %d for post %d failed, attempt %d: %v", entry.Id, entry.PostId, attempts, deliveryErr)
+		}
+
+		nextAttemptDate := time.Now().UTC().Add(OutboxBackoff(attempts, p.config.InitialBackoff, p.config.MaxBackoff))
+		if err := repo.Outbox().Fail(entry.Id, truncateError(deliveryErr, maxOutboxErrorLength), nextAttemptDate, deadLetter); err != nil {
+			log.Errorf("Recording outbox failure %d: %v", entry.Id, err)
 		}
 
 	})
 
+}
+
+// deliver fans a post change out to subscribers and the search index, and
+// alerts saved searches to new posts once they are searchable. The post is
+// reloaded so that a retry always sends its current state.
+func (p *PostProcessor) deliver(entry *model.OutboxEntry) error {
+
+	var post *model.Post
+	var err error
+	p.provider.WithRepository(5*time.Second, func(repo repository.Repository) {
+		post, err = repo.Posts().Get(entry.PostId)
+	})
+
+	if errors.Is(err, repository.ErrNotFound) {
+		// the post has been erased so there is nobody to tell, just make sure
+		// it has gone from the index
+		return p.deletePostFromSearchEngine(&model.Post{ModelBase: model.ModelBase{Id: entry.PostId}})
+	} else if err != nil {
+		return fmt.Errorf("fetching post: %w", err)
+	}
+
+	if err := p.DispatchToSubscribers(post); err != nil {
+		return err
+	}
+
+	doc, err := p.dispatchToSearchEngine(post)
+	if err != nil {
+		return err
+	}
+
+	if entry.Action == model.OutboxActionCreate && doc != nil {
+		p.alertSavedSearches(post, doc)
+	}
+
 	return nil
 
 }
 
-func (p *PostProcessor) DispatchToElasticsearch(post *model.Post) bool {
+// alertSavedSearches never fails the delivery, as retrying it would index
+// the post again for the sake of a notification
+func (p *PostProcessor) alertSavedSearches(post *model.Post, doc *model.IndexablePost) {
+
+	if p.alerter == nil {
+		return
+	}
 
 	defer func() {
 		if r := recover(); r != nil {
-			indexRequestCount.WithLabelValues("failure").Inc()
-			log.Errorf("ES index failure: %v", r.(error))
+			log.Errorf("Saved search alerts for post %d: %v", post.Id, utils.ErrorFromPanic(r))
 		}
 	}()
 
-	if post.Status == model.PostStatusOK || post.Status == model.PostStatusWatch {
-		p.indexPostIntoSearchEngine(post)
-	} else {
-		p.deletePostFromSearchEngine(post)
+	discussion, err := p.discussionCache.UnsafeGet(doc.DiscussionId)
+	if err != nil {
+		log.Errorf("Saved search alerts for post %d: %v", post.Id, err)
+		return
 	}
 
-	return true
-
-}
+	url := utils.UrlForPost(p.folderCache.UnsafeGet(doc.FolderId), discussion, post)
 
-func (p *PostProcessor) deletePostFromSearchEngine(post *model.Post) {
-
-	ctx, cancelFn := context.WithTimeout(context.Background(), 1*time.Second)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancelFn()
 
-	req := esapi.DeleteRequest{
-		Index:      "posts",
-		DocumentID: fmt.Sprintf("%d", post.Id),
+	if err := p.alerter.Alert(ctx, doc, url); err != nil {
+		log.Errorf("Saved search alerts for post %d: %v", post.Id, err)
 	}
 
-	res, err := req.Do(ctx, connections.ElasticSearchConnection())
-	if err != nil {
-		panic(fmt.Errorf("[%s] error deleting document ID=%d", res.Status(), post.Id))
-	}
-	defer res.Body.Close()
-
-	if res.IsError() {
-		panic(fmt.Errorf("[%s] error deleting document ID=%d", res.Status(), post.Id))
-	} else {
-		var r map[string]interface{}
-		if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-			panic(fmt.Errorf("error parsing the response body: %s", err))
-		} else {
-			log.Debugf("%v", r)
+}
+
+// OutboxBackoff is the delay before the given attempt is retried. It doubles
+// with every attempt up to max.
+func OutboxBackoff(attempts int, initial time.Duration, max time.Duration) time.Duration {
+
+	backoff := initial
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= max {
+			return max
 		}
 	}
 
-}
+	return backoff
 
-func (p *PostProcessor) indexPostIntoSearchEngine(post *model.Post) {
+}
 
-	var data []byte
-	var err error
+func truncateError(err error, length int) string {
+	return truncateString(err.Error(), length)
+}
 
-	discussion := p.discussionCache.UnsafeGet(post.DiscussionId)
-	if discussion.Status != model.DiscussionStatusOk || discussion.IsLocked || discussion.IsDeleted {
-		return
+func truncateString(message string, length int) string {
+	if len(message) > length {
+		return message[:length]
 	}
+	return message
+}
 
-	folder := p.folderCache.UnsafeGet(discussion.FolderId)
-	if folder.Type != model.FolderTypeNormal {
-		return
-	}
+func (p *PostProcessor) DispatchToSubscribers(post *model.Post) (dispatchError error) {
 
-	user := p.userCache.Get(post.CreatedByUserId)
+	defer func() {
+		if r := recover(); r != nil {
+			dispatchError = utils.ErrorFromPanic(r)
+			log.Error(dispatchError)
+			debug.PrintStack()
+		}
+	}()
 
-	var doc = model.IndexablePost{
-		Id:               post.Id,
-		CreatedDate:      post.CreatedDate,
-		Text:             post.Text,
-		Username:         user.Username,
-		FolderName:       folder.Description,
-		DiscussionTitle:  discussion.Title,
-		DiscussionHeader: discussion.Header,
+	p.provider.WithRepository(5*time.Second, func(repo repository.Repository) {
+		dispatchError = p.dispatchToSubscribers(post, repo)
+	})
+
+	if dispatchError != nil {
+		log.Error(dispatchError)
 	}
 
-	if data, err = json.Marshal(doc); err != nil {
-		panic(err)
+	return dispatchError
+
+}
+
+func (p *PostProcessor) dispatchToSubscribers(post *model.Post, repo repository.Repository) error {
+
+	frontPageEntry, err := repo.Discussions().GetFrontPageEntry(post.DiscussionId)
+	if err != nil {
+		return fmt.Errorf("fetching front page entry: %w", err)
 	}
 
-	req := esapi.IndexRequest{
-		Index:      "posts",
-		DocumentID: fmt.Sprintf("%d", post.Id),
-		Body:       bytes.NewReader(data),
-		Refresh:    "true",
+	data, err := json.Marshal(frontPageEntry)
+	if err != nil {
+		return err
 	}
+	messageData := string(data)
 
-	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancelFn()
+	log.Debug(messageData)
 
-	res, err := req.Do(ctx, connections.ElasticSearchConnection())
+	subscribers, err := repo.Posts().GetSubscribers(post.Id)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("fetching subscribers: %w", err)
 	}
-	defer res.Body.Close()
 
-	if res.IsError() {
-		panic(fmt.Errorf("[%s] error indexing document ID=%d", res.Status(), post.Id))
-	} else {
+	for _, subscriberId := range subscribers {
 
-		indexRequestCount.WithLabelValues("success").Inc()
+		if p.userCache.IsActiveSubscriber(subscriberId) && subscriberId != post.CreatedByUserId {
+
+			ctx, cancelFn := context.WithTimeout(context.Background(), 1*time.Second)
+			topic := fmt.Sprintf("user:%d", subscriberId)
+			err := connections.RedisConnection().Publish(ctx, topic, messageData).Err()
+			cancelFn()
+
+			if err != nil {
+				return fmt.Errorf("publishing to subscriber %d: %w", subscriberId, err)
+			}
 
-		var r map[string]interface{}
-		if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-			panic(fmt.Errorf("error parsing the response body: %s", err))
-		} else {
-			log.Debugf("[%s] %s; version=%d", res.Status(), r["result"], int(r["_version"].(float64)))
 		}
 
 	}
 
+	return nil
+
 }
 
-func (p *PostProcessor) IndexAllPosts() {
+func (p *PostProcessor) DispatchToSearchEngine(post *model.Post) bool {
 
-	connections.WithDatabase(1*time.Hour, func(db *gorm.DB) {
+	if _, err := p.dispatchToSearchEngine(post); err != nil {
+		log.Errorf("Search index failure: %v", err)
+		return false
+	}
 
-		rows, err := db.Raw("call get_indexable_posts();").Rows()
-		if err != nil {
-			panic(err)
+	return true
+
+}
+
+// dispatchToSearchEngine indexes or removes the post and returns the
+// document if it was indexed
+func (p *PostProcessor) dispatchToSearchEngine(post *model.Post) (doc *model.IndexablePost, dispatchError error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			dispatchError = utils.ErrorFromPanic(r)
 		}
+		if dispatchError != nil {
+			indexRequestCount.WithLabelValues("failure").Inc()
+		}
+	}()
+
+	if post.Status == model.PostStatusOK || post.Status == model.PostStatusWatch {
+		return p.indexPostIntoSearchEngine(post)
+	}
 
-		var buf bytes.Buffer
-		var batchCount int
-		var batchNum int
-		es := connections.ElasticSearchConnection()
-		for rows.Next() {
+	return nil, p.deletePostFromSearchEngine(post)
 
-			var post model.IndexablePost
-			if err := db.ScanRows(rows, &post); err != nil {
-				panic(err)
-			}
+}
 
-			meta := []byte(fmt.Sprintf("{ \"index\" : { \"_id\" : \"%d\" } } \n", post.Id))
+func (p *PostProcessor) deletePostFromSearchEngine(post *model.Post) error {
 
-			data, err := json.Marshal(post)
-			if err != nil {
-				panic(err)
-			}
-			data = append(data, "\n"...)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancelFn()
 
-			buf.Grow(len(meta) + len(data))
-			buf.Write(meta)
-			buf.Write(data)
+	return p.engine.Delete(ctx, post.Id)
 
-			batchCount++
-			if batchCount%1000 == 0 {
+}
 
-				res, err := es.Bulk(bytes.NewReader(buf.Bytes()), es.Bulk.WithIndex("posts"))
-				if err != nil {
-					log.Fatalf("Failure indexing batch %d: %s", batchNum, err)
-				}
+func (p *PostProcessor) indexPostIntoSearchEngine(post *model.Post) (*model.IndexablePost, error) {
+
+	discussion, err := p.discussionCache.UnsafeGet(post.DiscussionId)
+	if err != nil {
+		return nil, err
+	}
 
-				var responseData map[string]interface{}
-				if err := json.NewDecoder(res.Body).Decode(&responseData); err != nil {
-					log.Fatalf("Failure to to parse response body: %s", err)
-				}
+	folder := p.folderCache.UnsafeGet(discussion.FolderId)
+	if !isIndexableDiscussion(discussion, folder) {
+		return nil, nil
+	}
 
-				if res.IsError() {
-					log.Errorf("%v", responseData)
-				}
+	user, err := p.userCache.Get(post.CreatedByUserId)
+	if err != nil {
+		return nil, err
+	}
 
-				batchNum++
-				buf.Reset()
+	var doc = model.IndexablePost{
+		Id:               post.Id,
+		CreatedDate:      post.CreatedDate,
+		FolderId:         folder.Id,
+		DiscussionId:     discussion.Id,
+		Text:             post.Text,
+		Username:         user.Username,
+		UserId:           user.Id,
+		Status:           post.Status,
+		FolderName:       folder.Description,
+		DiscussionTitle:  discussion.Title,
+		DiscussionHeader: discussion.Header,
+	}
 
-				log.Infof("Completed batch: %d, total rows=%d", batchNum, batchCount)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
 
-			}
+	if err := p.engine.Index(ctx, &doc); err != nil {
+		return nil, err
+	}
 
-		}
+	indexRequestCount.WithLabelValues("success").Inc()
 
-	})
+	return &doc, nil
 
 }
@@ -18,29 +18,29 @@ package businesslogic
 //docker run -d -p 9200:9200 -p 9300:9300 -e "discovery.type=single-node" docker.elastic.co/elasticsearch/elasticsearch:7.12.1
 
 import (
+	"context"
 	"justthetalk/connections"
 	"justthetalk/model"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gorm.io/gorm"
 )
 
 func TestCreationAndTeardown(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
-	p := NewPostProcessor(userCache, folderCache, discussionCache)
-	p.Run()
+	p := NewPostProcessor(testOutboxConfig, testSearchEngine, userCache, folderCache, discussionCache, nil, testProvider)
+	require.NoError(t, p.Start(context.Background()))
 
 	if !p.IsRunning() {
 		t.Error("Failed to start")
 	}
 
-	p.Close()
+	require.NoError(t, p.Stop(context.Background()))
 	if p.IsRunning() {
 		t.Error("Failed to stop")
 	}
@@ -49,12 +49,10 @@ func TestCreationAndTeardown(t *testing.T) {
 
 func TestPublishPostToSearchIndex(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
-	p := NewPostProcessor(userCache, folderCache, discussionCache)
-	p.Run()
+	p := NewPostProcessor(testOutboxConfig, testSearchEngine, userCache, folderCache, discussionCache, nil, testProvider)
+	require.NoError(t, p.Start(context.Background()))
 	if !p.IsRunning() {
 		t.Error("Failed to start")
 	}
@@ -64,27 +62,25 @@ func TestPublishPostToSearchIndex(t *testing.T) {
 		var post model.Post
 		// normal
 		db.Raw("call get_post(?)", 446).First(&post)
-		success := p.DispatchToElasticsearch(&post)
+		success := p.DispatchToSearchEngine(&post)
 		assert.True(t, success)
 
 		// deleted
 		db.Raw("call get_post(?)", 90).First(&post)
-		success = p.DispatchToElasticsearch(&post)
+		success = p.DispatchToSearchEngine(&post)
 		assert.True(t, success)
 
 	})
 
-	p.Close()
+	require.NoError(t, p.Stop(context.Background()))
 }
 
 func TestPublishPostRedis(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
-	p := NewPostProcessor(userCache, folderCache, discussionCache)
-	p.Run()
+	p := NewPostProcessor(testOutboxConfig, testSearchEngine, userCache, folderCache, discussionCache, nil, testProvider)
+	require.NoError(t, p.Start(context.Background()))
 	if !p.IsRunning() {
 		t.Error("Failed to start")
 	}
@@ -99,17 +95,15 @@ func TestPublishPostRedis(t *testing.T) {
 
 	})
 
-	p.Close()
+	require.NoError(t, p.Stop(context.Background()))
 }
 
 func TestDeletePostFromSearchIndex(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
-	p := NewPostProcessor(userCache, folderCache, discussionCache)
-	p.Run()
+	p := NewPostProcessor(testOutboxConfig, testSearchEngine, userCache, folderCache, discussionCache, nil, testProvider)
+	require.NoError(t, p.Start(context.Background()))
 	if !p.IsRunning() {
 		t.Error("Failed to start")
 	}
@@ -119,21 +113,23 @@ func TestDeletePostFromSearchIndex(t *testing.T) {
 		var post model.Post
 		db.Raw("call get_post(?)", 446).First(&post)
 		post.Status = model.PostStatusDeletedByAdmin
-		p.DispatchToElasticsearch(&post)
+		p.DispatchToSearchEngine(&post)
 
 	})
 
-	p.Close()
+	require.NoError(t, p.Stop(context.Background()))
 
 }
 
-func TestIndexAllPosts(t *testing.T) {
+func TestOutboxBackoffDoublesUpToMax(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	initial := 5 * time.Second
+	max := time.Minute
 
-	p := NewPostProcessor(userCache, folderCache, discussionCache)
-	p.IndexAllPosts()
+	assert.Equal(t, 5*time.Second, OutboxBackoff(1, initial, max))
+	assert.Equal(t, 10*time.Second, OutboxBackoff(2, initial, max))
+	assert.Equal(t, 40*time.Second, OutboxBackoff(4, initial, max))
+	assert.Equal(t, time.Minute, OutboxBackoff(5, initial, max))
+	assert.Equal(t, time.Minute, OutboxBackoff(50, initial, max))
 
 }
@@ -0,0 +1,216 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"justthetalk/events"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"justthetalk/search"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var savedSearchAlertCount = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "justthetalk_saved_search_alert_count",
+	Help: "Count of saved search alerts published",
+})
+
+// savedSearchReloadInterval is how long the alerter keeps its copy of the
+// alerting searches. Changes made through this instance are picked up
+// straight away, changes made through any other within this interval.
+const savedSearchReloadInterval = time.Minute
+
+type alertingSearch struct {
+	savedSearch *model.SavedSearch
+	query       *search.Query
+}
+
+// SearchAlerter tells users when a newly indexed post matches one of their
+// saved searches. Alerts go to the user's pub/sub topic in the same way as
+// other notifications, so only users connected to this instance receive
+// them.
+type SearchAlerter struct {
+	engine    search.Engine
+	userCache *UserCache
+	provider  repository.Provider
+	getUser   func(userId uint) (*model.User, error)
+	publish   func(topic string, message string) error
+	mutex     sync.Mutex
+	searches  []*alertingSearch
+	loadedAt  time.Time
+}
+
+func NewSearchAlerter(engine search.Engine, userCache *UserCache, provider repository.Provider) *SearchAlerter {
+	return &SearchAlerter{
+		engine:    engine,
+		userCache: userCache,
+		provider:  provider,
+		getUser:   userCache.Get,
+		publish:   publishToRedis,
+	}
+}
+
+// Invalidate makes the alerter reload the saved searches before it checks
+// the next post
+func (a *SearchAlerter) Invalidate() {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.searches = nil
+
+}
+
+func (a *SearchAlerter) load() ([]*alertingSearch, error) {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.searches != nil && time.Since(a.loadedAt) < savedSearchReloadInterval {
+		return a.searches, nil
+	}
+
+	var savedSearches []*model.SavedSearch
+	var err error
+	a.provider.WithRepository(5*time.Second, func(repo repository.Repository) {
+		savedSearches, err = repo.SavedSearches().GetAlerting()
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("loading saved searches: %w", err)
+	}
+
+	searches := make([]*alertingSearch, 0, len(savedSearches))
+	for _, savedSearch := range savedSearches {
+		query, err := search.NewQuery(savedSearch.SearchQuery(1))
+		if err != nil {
+			// searches are validated when they are saved, so this only
+			// happens if the rules have been tightened since
+			log.Warnf("Skipping saved search %d: %v", savedSearch.Id, err)
+			continue
+		}
+		searches = append(searches, &alertingSearch{savedSearch: savedSearch, query: query})
+	}
+
+	a.searches = searches
+	a.loadedAt = time.Now()
+
+	return searches, nil
+
+}
+
+// Alert checks a post which has just been indexed against the saved searches
+// of every connected user and publishes an alert to each user with a match.
+// Users are not alerted about their own posts or posts by users they ignore,
+// and get one alert per post however many of their searches match it. Only
+// posts in public discussions are indexed, so there is no need to check
+// whether each user may read the post.
+func (a *SearchAlerter) Alert(ctx context.Context, post *model.IndexablePost, url string) error {
+
+	searches, err := a.load()
+	if err != nil {
+		return err
+	}
+
+	owners := make(map[uint]*model.User)
+	candidates := make([]*alertingSearch, 0)
+	queries := make([]*search.Query, 0)
+	for _, s := range searches {
+
+		ownerId := s.savedSearch.UserId
+		if ownerId == post.UserId || !a.userCache.IsActiveSubscriber(ownerId) {
+			continue
+		}
+
+		owner, loaded := owners[ownerId]
+		if !loaded {
+			if owner, err = a.getUser(ownerId); err != nil {
+				log.Warnf("Loading user %d for saved search alerts: %v", ownerId, err)
+			}
+			owners[ownerId] = owner
+		}
+
+		if owner == nil || !owner.Enabled {
+			continue
+		}
+
+		if _, ignored := owner.IgnoredUsers[post.UserId]; ignored {
+			continue
+		}
+
+		candidates = append(candidates, s)
+		queries = append(queries, s.query)
+
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	matched, err := a.engine.Match(ctx, post, queries)
+	if err != nil {
+		return fmt.Errorf("matching post %d against saved searches: %w", post.Id, err)
+	}
+
+	alerted := make(map[uint]bool)
+	for _, i := range matched {
+
+		savedSearch := candidates[i].savedSearch
+		if alerted[savedSearch.UserId] {
+			continue
+		}
+		alerted[savedSearch.UserId] = true
+
+		alert := &model.SavedSearchAlert{
+			SavedSearchId:   savedSearch.Id,
+			SavedSearchName: savedSearch.Name,
+			PostId:          post.Id,
+			FolderId:        post.FolderId,
+			DiscussionId:    post.DiscussionId,
+			DiscussionTitle: post.DiscussionTitle,
+			Username:        post.Username,
+			CreatedDate:     post.CreatedDate,
+			Url:             url,
+		}
+
+		data, err := json.Marshal(&Envelope{Action: PubSubMessageActionAlert, Urn: events.SavedSearchUrn(savedSearch.Id), Data: alert})
+		if err != nil {
+			return err
+		}
+
+		// an alert is a courtesy, so one user who can't be reached doesn't
+		// stop the rest from hearing about the post
+		if err := a.publish(fmt.Sprintf("user:%d", savedSearch.UserId), string(data)); err != nil {
+			log.Warnf("Publishing saved search alert to user %d: %v", savedSearch.UserId, err)
+			continue
+		}
+
+		savedSearchAlertCount.Inc()
+
+	}
+
+	return nil
+
+}
@@ -0,0 +1,191 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"justthetalk/events"
+	"justthetalk/model"
+	"justthetalk/repository/memory"
+	"justthetalk/search/embedded"
+	"justthetalk/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSearchAlerter(t *testing.T, store *memory.Store, users map[uint]*model.User, activeUserIds ...uint) (*SearchAlerter, *[]publishedMessage) {
+
+	dir, err := ioutil.TempDir("", "search")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	engine, err := embedded.Open(filepath.Join(dir, "search.log"))
+	require.NoError(t, err)
+	t.Cleanup(func() { engine.Close() })
+
+	userCache := NewUserCache(nil)
+	for _, userId := range activeUserIds {
+		userCache.AddSubscriber(&model.User{ModelBase: model.ModelBase{Id: userId}})
+	}
+
+	published := make([]publishedMessage, 0)
+	alerter := NewSearchAlerter(engine, userCache, store)
+	alerter.getUser = func(userId uint) (*model.User, error) {
+		if user, exists := users[userId]; exists {
+			return user, nil
+		}
+		return nil, errors.New("no such user")
+	}
+	alerter.publish = func(topic string, message string) error {
+		published = append(published, publishedMessage{topic: topic, message: message})
+		return nil
+	}
+
+	return alerter, &published
+
+}
+
+func testAlertUser(userId uint) *model.User {
+	return &model.User{ModelBase: model.ModelBase{Id: userId}, Enabled: true, IgnoredUsers: make(map[uint]*model.IgnoredUser)}
+}
+
+func TestSearchAlerterAlertsConnectedUsersWithMatchingSearches(t *testing.T) {
+
+	store := memory.NewStore()
+	users := make(map[uint]*model.User)
+	for userId := uint(1); userId <= 6; userId++ {
+		users[userId] = testAlertUser(userId)
+	}
+	users[2].IgnoredUsers[5] = &model.IgnoredUser{}
+
+	save := func(userId uint, query string, alerts bool) *model.SavedSearch {
+		saved, err := store.SavedSearches().Create(&model.SavedSearch{UserId: userId, Name: query, Query: query, Alerts: alerts})
+		require.NoError(t, err)
+		return saved
+	}
+
+	matching := save(1, "lighthouse", true)
+	save(1, "windmill", true)
+	save(2, "lighthouse", true) // ignores the author
+	save(3, "lighthouse", true) // not connected
+	save(4, "lighthouse", false)
+	save(5, "lighthouse", true) // the author
+	first := save(6, "keeper", true)
+	save(6, `"lighthouse keeper"`, true)
+
+	alerter, published := newTestSearchAlerter(t, store, users, 1, 2, 4, 5, 6)
+
+	post := &model.IndexablePost{
+		Id:              99,
+		CreatedDate:     time.Now(),
+		FolderId:        1,
+		DiscussionId:    10,
+		DiscussionTitle: "Coastal walks",
+		Text:            "the lighthouse keeper waved",
+		Username:        "eve",
+		UserId:          5,
+		Status:          model.PostStatusOK,
+	}
+	require.NoError(t, alerter.Alert(context.Background(), post, "/general/10/coastal-walks/3"))
+
+	require.Len(t, *published, 2)
+	sort.Slice(*published, func(i, j int) bool { return (*published)[i].topic < (*published)[j].topic })
+	assert.Equal(t, "user:1", (*published)[0].topic)
+	assert.Equal(t, "user:6", (*published)[1].topic)
+
+	var envelope struct {
+		Action string                 `json:"action"`
+		Urn    string                 `json:"urn"`
+		Data   model.SavedSearchAlert `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal([]byte((*published)[0].message), &envelope))
+	assert.Equal(t, PubSubMessageActionAlert, envelope.Action)
+	assert.Equal(t, events.SavedSearchUrn(matching.Id), envelope.Urn)
+	assert.Equal(t, uint(99), envelope.Data.PostId)
+	assert.Equal(t, "/general/10/coastal-walks/3", envelope.Data.Url)
+
+	require.NoError(t, json.Unmarshal([]byte((*published)[1].message), &envelope))
+	assert.Equal(t, first.Id, envelope.Data.SavedSearchId, "one alert per user, for their first matching search")
+
+}
+
+func TestSearchAlerterReloadsWhenInvalidated(t *testing.T) {
+
+	store := memory.NewStore()
+	users := map[uint]*model.User{1: testAlertUser(1)}
+	alerter, published := newTestSearchAlerter(t, store, users, 1)
+
+	post := &model.IndexablePost{Id: 1, CreatedDate: time.Now(), FolderId: 1, DiscussionId: 1, Text: "tide tables", UserId: 2, Status: model.PostStatusOK}
+	require.NoError(t, alerter.Alert(context.Background(), post, ""))
+	assert.Empty(t, *published)
+
+	store.SavedSearches().Create(&model.SavedSearch{UserId: 1, Name: "Tides", Query: "tide", Alerts: true})
+
+	require.NoError(t, alerter.Alert(context.Background(), post, ""))
+	assert.Empty(t, *published, "searches are cached until invalidated")
+
+	alerter.Invalidate()
+	require.NoError(t, alerter.Alert(context.Background(), post, ""))
+	assert.Len(t, *published, 1)
+
+}
+
+func TestSavedSearchesAreValidatedAndLimited(t *testing.T) {
+
+	store := memory.NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	admin := store.AddFolder(&model.Folder{Key: "admin", Description: "Admin", Type: model.FolderTypeAdmin})
+	folderCache, err := NewFolderCache(store)
+	require.NoError(t, err)
+
+	user := testAlertUser(1)
+
+	_, err = CreateSavedSearch(&model.SavedSearch{Name: " ", Query: "boats"}, user, folderCache, nil, store)
+	assert.True(t, errors.Is(err, utils.ErrBadRequest))
+
+	_, err = CreateSavedSearch(&model.SavedSearch{Name: "Boats", Query: `""`}, user, folderCache, nil, store)
+	assert.True(t, errors.Is(err, utils.ErrBadRequest))
+
+	_, err = CreateSavedSearch(&model.SavedSearch{Name: "Admin", Query: "boats", FolderId: admin.Id}, user, folderCache, nil, store)
+	assert.True(t, errors.Is(err, utils.ErrForbidden))
+
+	for i := 0; i < MaxSavedSearches; i++ {
+		_, err := CreateSavedSearch(&model.SavedSearch{Name: "Boats", Query: "boats", FolderId: folder.Id}, user, folderCache, nil, store)
+		require.NoError(t, err)
+	}
+
+	_, err = CreateSavedSearch(&model.SavedSearch{Name: "Boats", Query: "boats"}, user, folderCache, nil, store)
+	var limitErr *utils.Error
+	if assert.True(t, errors.As(err, &limitErr)) {
+		assert.Equal(t, utils.ErrorCodeTooManySavedSearches, limitErr.Code)
+	}
+
+	saved, _ := GetSavedSearches(user, store)
+	assert.Len(t, saved, MaxSavedSearches)
+
+	err = DeleteSavedSearch(saved[0].Id, testAlertUser(2), store)
+	assert.True(t, errors.Is(err, utils.ErrNotFound))
+
+}
@@ -0,0 +1,93 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"context"
+	"justthetalk/search"
+	"justthetalk/utils"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const searchGuardRecheckInterval = time.Minute
+
+// SearchGuard stops searches being run against an engine which can't serve
+// them, for example an Elasticsearch index whose mapping doesn't match the
+// managed one. A failed check is retried at most once a minute so that search
+// comes back by itself once the problem is fixed.
+type SearchGuard struct {
+	engine      search.Engine
+	mutex       sync.Mutex
+	err         error
+	lastChecked time.Time
+}
+
+func NewSearchGuard(engine search.Engine) *SearchGuard {
+	return &SearchGuard{
+		engine: engine,
+	}
+}
+
+// Check runs the engine's check now and remembers the result
+func (g *SearchGuard) Check() error {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.check()
+
+}
+
+func (g *SearchGuard) check() error {
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFn()
+
+	g.err = g.engine.Check(ctx)
+	g.lastChecked = time.Now()
+
+	if g.err != nil {
+		log.Errorf("Search is unavailable: %v", g.err)
+	}
+
+	return g.err
+
+}
+
+// Err returns an error suitable for the client if search can't be served
+func (g *SearchGuard) Err() error {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.err != nil && time.Since(g.lastChecked) >= searchGuardRecheckInterval {
+		if g.check() == nil {
+			log.Info("Search is available again")
+		}
+	}
+
+	if g.err != nil {
+		err := utils.NewError(utils.ErrUnavailable, utils.ErrorCodeSearchUnavailable, "Search is temporarily unavailable")
+		err.Err = g.err
+		return err
+	}
+
+	return nil
+
+}
@@ -13,27 +13,23 @@
 // You should have received a copy of the GNU General Public License
 // along with this program. If not, see <http://www.gnu.org/licenses/>.
 
-package server
+package businesslogic
 
 import (
-	"fmt"
-	"justthetalk/connections"
-	"os"
+	"justthetalk/utils"
 	"testing"
-)
-
-func TestMain(m *testing.M) {
+	"time"
 
-	fmt.Println("Starting tests...")
+	"github.com/stretchr/testify/assert"
+)
 
-	dbHost := "localhost"
-	dbPort := "3306"
-	redisHost := "localhost"
-	redisPort := "6379"
-	elasticsearchHosts := []string{"http://localhost:9200"}
+func TestSearchGuardReportsUnavailable(t *testing.T) {
 
-	connections.OpenConnections(dbHost, dbPort, redisHost, redisPort, elasticsearchHosts)
+	guard := NewSearchGuard(nil)
+	guard.err = assert.AnError
+	guard.lastChecked = time.Now()
 
-	os.Exit(m.Run())
+	err := guard.Err()
+	assert.ErrorIs(t, err, utils.ErrUnavailable)
 
 }
@@ -0,0 +1,375 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"justthetalk/search"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	searchIndexJobBatchSize      = 500
+	searchIndexJobStaleAfter     = 5 * time.Minute
+	maxSearchIndexJobErrorLength = 1024
+)
+
+var (
+	searchIndexJobCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "justthetalk_search_index_job_count",
+		Help: "Count of search index jobs by action and result",
+	}, []string{"action", "status"})
+)
+
+// SearchIndexJobRunner works through the search index jobs raised when a
+// discussion or folder changes in a way that affects every one of its posts.
+// Jobs are recorded in the database so their progress can be followed and
+// so they survive a restart.
+type SearchIndexJobRunner struct {
+	interval    time.Duration
+	engine      search.Engine
+	folderCache *FolderCache
+	provider    repository.Provider
+	wake        chan struct{}
+	quit        chan struct{}
+	workerDone  chan struct{}
+	stopOnce    sync.Once
+	isStarted   bool
+}
+
+func NewSearchIndexJobRunner(interval time.Duration, engine search.Engine, folderCache *FolderCache, provider repository.Provider) *SearchIndexJobRunner {
+	return &SearchIndexJobRunner{
+		interval:    interval,
+		engine:      engine,
+		folderCache: folderCache,
+		provider:    provider,
+		wake:        make(chan struct{}, 1),
+		quit:        make(chan struct{}),
+		workerDone:  make(chan struct{}),
+	}
+}
+
+// Enqueue records a job to bring the index into line with the given
+// discussion or folder and wakes the runner
+func (r *SearchIndexJobRunner) Enqueue(scope string, targetId uint, reason string) (*model.SearchIndexJob, error) {
+
+	var job *model.SearchIndexJob
+	var err error
+	r.provider.WithRepository(5*time.Second, func(repo repository.Repository) {
+		job, err = repo.SearchIndexJobs().Create(scope, targetId, reason)
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("creating search index job for %s %d: %w", scope, targetId, err)
+	}
+
+	r.Wake()
+
+	return job, nil
+
+}
+
+func (r *SearchIndexJobRunner) Wake() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *SearchIndexJobRunner) Start(ctx context.Context) error {
+
+	if r.isStarted {
+		return errors.New("search index job runner already started")
+	}
+
+	r.isStarted = true
+	go r.worker(ctx)
+
+	return nil
+
+}
+
+// Stop waits for the job in hand to finish. A job that is cut short is left
+// running and will be picked up again once it goes stale.
+func (r *SearchIndexJobRunner) Stop(ctx context.Context) error {
+
+	r.stopOnce.Do(func() {
+		close(r.quit)
+	})
+
+	if !r.isStarted {
+		return nil
+	}
+
+	select {
+	case <-r.workerDone:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stopping search index job runner: %w", ctx.Err())
+	}
+
+}
+
+func (r *SearchIndexJobRunner) isQuitting(ctx context.Context) bool {
+	select {
+	case <-r.quit:
+		return true
+	case <-ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *SearchIndexJobRunner) worker(ctx context.Context) {
+
+	log.Info("Starting SearchIndexJobRunner")
+
+	defer close(r.workerDone)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+
+		r.RunPending(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-r.wake:
+		case <-r.quit:
+			log.Info("Closed SearchIndexJobRunner")
+			return
+		case <-ctx.Done():
+			log.Info("SearchIndexJobRunner cancelled")
+			return
+		}
+
+	}
+
+}
+
+// RunPending runs jobs until there are none left or the runner is stopped
+func (r *SearchIndexJobRunner) RunPending(ctx context.Context) {
+
+	for !r.isQuitting(ctx) {
+
+		var job *model.SearchIndexJob
+		var err error
+		r.provider.WithRepository(5*time.Second, func(repo repository.Repository) {
+			job, err = repo.SearchIndexJobs().ClaimNext(searchIndexJobStaleAfter)
+		})
+
+		if errors.Is(err, repository.ErrNotFound) {
+			return
+		} else if err != nil {
+			log.Errorf("Claiming search index job: %v", err)
+			return
+		}
+
+		r.run(job)
+
+	}
+
+}
+
+func (r *SearchIndexJobRunner) run(job *model.SearchIndexJob) {
+
+	log.Infof("Running search index job %d for %s %d (%s)", job.Id, job.Scope, job.TargetId, job.Reason)
+
+	progress := &searchIndexJobProgress{job: job, provider: r.provider}
+
+	action, err := r.action(job)
+	if err == nil {
+		switch action {
+		case model.SearchIndexJobActionReindex:
+			err = r.reindex(job, progress)
+		case model.SearchIndexJobActionRemove:
+			err = r.remove(job, progress)
+		}
+	}
+
+	status := model.SearchIndexJobStatusComplete
+	var lastError string
+	if err != nil {
+		status = model.SearchIndexJobStatusFailed
+		lastError = truncateError(err, maxSearchIndexJobErrorLength)
+		log.Errorf("Search index job %d failed: %v", job.Id, err)
+	} else if progress.failed > 0 {
+		status = model.SearchIndexJobStatusFailed
+		lastError = truncateString(progress.lastError, maxSearchIndexJobErrorLength)
+		log.Errorf("Search index job %d failed for %d posts: %s", job.Id, progress.failed, lastError)
+	}
+
+	searchIndexJobCount.WithLabelValues(action, status).Inc()
+
+	r.provider.WithRepository(5*time.Second, func(repo repository.Repository) {
+		if err := repo.SearchIndexJobs().Finish(job.Id, status, action, progress.processed, progress.failed, lastError); err != nil {
+			log.Errorf("Finishing search index job %d: %v", job.Id, err)
+		}
+	})
+
+}
+
+// action decides from the current state of the target whether its posts
+// belong in the index at all. Deciding when the job runs rather than when it
+// is raised means a backlog of jobs always converges on the latest state.
+func (r *SearchIndexJobRunner) action(job *model.SearchIndexJob) (string, error) {
+
+	switch job.Scope {
+	case model.SearchIndexJobScopeDiscussion:
+
+		var discussion *model.Discussion
+		var err error
+		r.provider.WithRepository(5*time.Second, func(repo repository.Repository) {
+			discussion, err = repo.Discussions().Get(job.TargetId)
+		})
+
+		if errors.Is(err, repository.ErrNotFound) {
+			return model.SearchIndexJobActionRemove, nil
+		} else if err != nil {
+			return "", fmt.Errorf("fetching discussion: %w", err)
+		}
+
+		if isIndexableDiscussion(discussion, r.folderCache.UnsafeGet(discussion.FolderId)) {
+			return model.SearchIndexJobActionReindex, nil
+		}
+
+	case model.SearchIndexJobScopeFolder:
+
+		if isIndexableFolder(r.folderCache.UnsafeGet(job.TargetId)) {
+			return model.SearchIndexJobActionReindex, nil
+		}
+
+	default:
+		return "", fmt.Errorf("unknown search index job scope: %s", job.Scope)
+	}
+
+	return model.SearchIndexJobActionRemove, nil
+
+}
+
+func isIndexableFolder(folder *model.Folder) bool {
+	return folder != nil && folder.Type == model.FolderTypeNormal
+}
+
+func isIndexableDiscussion(discussion *model.Discussion, folder *model.Folder) bool {
+	return discussion.Status == model.DiscussionStatusOk && !discussion.IsLocked && !discussion.IsDeleted && isIndexableFolder(folder)
+}
+
+func (r *SearchIndexJobRunner) reindex(job *model.SearchIndexJob, progress *searchIndexJobProgress) (reindexErr error) {
+
+	var folderId, discussionId uint
+	if job.Scope == model.SearchIndexJobScopeFolder {
+		folderId = job.TargetId
+	} else {
+		discussionId = job.TargetId
+	}
+
+	batch := make([]*model.IndexablePost, 0, searchIndexJobBatchSize)
+	flush := func() error {
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		ctx, cancelFn := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancelFn()
+
+		failures, err := r.engine.Bulk(ctx, batch)
+		if err != nil {
+			return err
+		}
+
+		progress.add(len(batch), failures)
+		batch = batch[:0]
+
+		return nil
+
+	}
+
+	r.provider.WithRepository(1*time.Hour, func(repo repository.Repository) {
+		reindexErr = repo.Posts().ForEachIndexableIn(folderId, discussionId, func(post *model.IndexablePost) error {
+			batch = append(batch, post)
+			if len(batch) < searchIndexJobBatchSize {
+				return nil
+			}
+			return flush()
+		})
+	})
+
+	if reindexErr != nil {
+		return reindexErr
+	}
+
+	return flush()
+
+}
+
+func (r *SearchIndexJobRunner) remove(job *model.SearchIndexJob, progress *searchIndexJobProgress) error {
+
+	filter := search.Filter{DiscussionId: job.TargetId}
+	if job.Scope == model.SearchIndexJobScopeFolder {
+		filter = search.Filter{FolderId: job.TargetId}
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancelFn()
+
+	deleted, failures, err := r.engine.DeleteMatching(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	progress.add(deleted+len(failures), failures)
+
+	return nil
+
+}
+
+type searchIndexJobProgress struct {
+	job       *model.SearchIndexJob
+	provider  repository.Provider
+	processed int
+	failed    int
+	lastError string
+}
+
+func (p *searchIndexJobProgress) add(processed int, failures []search.BulkItemFailure) {
+
+	p.processed += processed
+	p.failed += len(failures)
+	if len(failures) > 0 {
+		p.lastError = failures[len(failures)-1].String()
+	}
+
+	p.provider.WithRepository(5*time.Second, func(repo repository.Repository) {
+		if err := repo.SearchIndexJobs().UpdateProgress(p.job.Id, p.processed, p.failed); err != nil {
+			log.Errorf("Updating search index job %d: %v", p.job.Id, err)
+		}
+	})
+
+}
@@ -0,0 +1,152 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"context"
+	"io/ioutil"
+	"justthetalk/config"
+	"justthetalk/events"
+	"justthetalk/model"
+	"justthetalk/repository/memory"
+	"justthetalk/search"
+	"justthetalk/search/embedded"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchIndexJobActionFollowsTheCurrentState(t *testing.T) {
+
+	store := memory.NewStore()
+	normal := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	admin := store.AddFolder(&model.Folder{Key: "admin", Description: "Admin", Type: model.FolderTypeAdmin})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+
+	open, _ := store.Discussions().Create(normal.Id, "Open", "", user.Id, false)
+	locked, _ := store.Discussions().Create(normal.Id, "Locked", "", user.Id, false)
+	store.Discussions().Lock(locked.Id, true)
+	moved, _ := store.Discussions().Create(normal.Id, "Moved", "", user.Id, false)
+	store.Discussions().Move(moved.Id, admin.Id)
+
+	folderCache, err := NewFolderCache(store)
+	require.NoError(t, err)
+	runner := NewSearchIndexJobRunner(time.Minute, nil, folderCache, store)
+
+	tests := []struct {
+		name     string
+		scope    string
+		targetId uint
+		action   string
+	}{
+		{"open discussion", model.SearchIndexJobScopeDiscussion, open.Id, model.SearchIndexJobActionReindex},
+		{"locked discussion", model.SearchIndexJobScopeDiscussion, locked.Id, model.SearchIndexJobActionRemove},
+		{"discussion moved to admin folder", model.SearchIndexJobScopeDiscussion, moved.Id, model.SearchIndexJobActionRemove},
+		{"erased discussion", model.SearchIndexJobScopeDiscussion, 9999, model.SearchIndexJobActionRemove},
+		{"normal folder", model.SearchIndexJobScopeFolder, normal.Id, model.SearchIndexJobActionReindex},
+		{"admin folder", model.SearchIndexJobScopeFolder, admin.Id, model.SearchIndexJobActionRemove},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			action, err := runner.action(&model.SearchIndexJob{Scope: test.scope, TargetId: test.targetId})
+			require.NoError(t, err)
+			assert.Equal(t, test.action, action)
+		})
+	}
+
+}
+
+func TestSearchIndexJobsAreQueuedForDiscussionChanges(t *testing.T) {
+
+	store := memory.NewStore()
+	folderCache, err := NewFolderCache(store)
+	require.NoError(t, err)
+
+	runner := NewSearchIndexJobRunner(time.Minute, nil, folderCache, store)
+	subscriber := NewSearchIndexSubscriber(NewPostProcessor(config.Default().Outbox, nil, nil, folderCache, nil, nil, store), runner)
+
+	discussion := &model.Discussion{ModelBase: model.ModelBase{Id: 42}}
+	require.NoError(t, subscriber.Handle(&events.DiscussionMoved{Discussion: discussion, FromFolderId: 1, ToFolderId: 2}))
+	require.NoError(t, subscriber.Handle(&events.DiscussionLocked{Discussion: discussion, Locked: true}))
+	require.NoError(t, subscriber.Handle(&events.DiscussionErased{DiscussionId: 43}))
+
+	jobs, err := store.SearchIndexJobs().GetRecent(0, 10)
+	require.NoError(t, err)
+	if assert.Len(t, jobs, 2, "pending jobs for the same discussion should be merged") {
+		assert.Equal(t, uint(43), jobs[0].TargetId)
+		assert.Equal(t, uint(42), jobs[1].TargetId)
+		assert.Equal(t, "discussion.moved", jobs[1].Reason)
+	}
+
+}
+
+func TestSearchIndexJobsKeepTheEngineInLine(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "search")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	engine, err := embedded.Open(filepath.Join(dir, "search.log"))
+	require.NoError(t, err)
+	defer engine.Close()
+
+	store := memory.NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+	discussion, _ := store.Discussions().Create(folder.Id, "Lighthouses", "", user.Id, false)
+	for i := 0; i < 3; i++ {
+		store.Posts().Create(folder.Id, discussion.Id, "a lighthouse keeper", model.PostStatusOK, user.Id)
+	}
+
+	folderCache, err := NewFolderCache(store)
+	require.NoError(t, err)
+	runner := NewSearchIndexJobRunner(time.Minute, engine, folderCache, store)
+
+	count := func() int {
+		query, err := search.NewQuery(&model.SearchQuery{Text: "lighthouse", Sort: model.SearchSortDate, Size: 10})
+		require.NoError(t, err)
+		results, err := engine.Query(context.Background(), query)
+		require.NoError(t, err)
+		return results.Total
+	}
+
+	_, err = runner.Enqueue(model.SearchIndexJobScopeDiscussion, discussion.Id, "test")
+	require.NoError(t, err)
+	runner.RunPending(context.Background())
+	assert.Equal(t, 3, count())
+
+	store.Discussions().Lock(discussion.Id, true)
+	_, err = runner.Enqueue(model.SearchIndexJobScopeDiscussion, discussion.Id, "test")
+	require.NoError(t, err)
+	runner.RunPending(context.Background())
+	assert.Equal(t, 0, count())
+
+	jobs, err := store.SearchIndexJobs().GetRecent(0, 10)
+	require.NoError(t, err)
+	if assert.Len(t, jobs, 2) {
+		if assert.NotNil(t, jobs[0].Action) {
+			assert.Equal(t, model.SearchIndexJobActionRemove, *jobs[0].Action)
+		}
+		assert.Equal(t, model.SearchIndexJobStatusComplete, jobs[0].Status)
+		assert.Equal(t, 3, jobs[0].Processed)
+	}
+
+}
@@ -0,0 +1,83 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import (
+	"context"
+	"justthetalk/connections"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// sharedCacheTier is the cache tier which every instance sees
+type sharedCacheTier interface {
+	// Get returns nil data when the key isn't cached
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, data []byte, ttl time.Duration) error
+	// SetIfNotOlder stores data unless the cached value has a later version
+	SetIfNotOlder(ctx context.Context, key string, data []byte, version uint, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+	Publish(ctx context.Context, channel string, message []byte) error
+}
+
+// setIfNotOlderScript compares versions inside Redis so that two instances
+// writing the same discussion at once can't leave the older one cached
+var setIfNotOlderScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current then
+	local ok, decoded = pcall(cjson.decode, current)
+	if ok and type(decoded) == 'table' and tonumber(decoded['version']) and tonumber(decoded['version']) > tonumber(ARGV[2]) then
+		return 0
+	end
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+return 1
+`)
+
+type redisCacheTier struct{}
+
+func (t *redisCacheTier) Get(ctx context.Context, key string) ([]byte, error) {
+
+	data, err := connections.RedisConnection().Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	return data, err
+
+}
+
+func (t *redisCacheTier) Set(ctx context.Context, key string, data []byte, ttl time.Duration) error {
+	return connections.RedisConnection().Set(ctx, key, data, ttl).Err()
+}
+
+func (t *redisCacheTier) SetIfNotOlder(ctx context.Context, key string, data []byte, version uint, ttl time.Duration) error {
+	return setIfNotOlderScript.Run(ctx, connections.RedisConnection(), []string{key}, data, version, ttl.Milliseconds()).Err()
+}
+
+func (t *redisCacheTier) Delete(ctx context.Context, keys ...string) error {
+	return connections.RedisConnection().Del(ctx, keys...).Err()
+}
+
+func (t *redisCacheTier) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return connections.RedisConnection().Expire(ctx, key, ttl).Err()
+}
+
+func (t *redisCacheTier) Publish(ctx context.Context, channel string, message []byte) error {
+	return connections.RedisConnection().Publish(ctx, channel, message).Err()
+}
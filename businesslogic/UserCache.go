@@ -18,98 +18,217 @@ package businesslogic
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"justthetalk/connections"
 	"justthetalk/model"
+	"justthetalk/repository"
 	"justthetalk/utils"
 	"strconv"
 	"sync"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
-	"gorm.io/gorm"
+	"golang.org/x/sync/singleflight"
 )
 
+const (
+	userCacheTTL          = time.Hour * 24
+	userCacheRedisTimeout = 500 * time.Millisecond
+
+	// userCacheBreakerThreshold failed Redis calls in a row open the circuit
+	// for userCacheBreakerCooldown
+	userCacheBreakerThreshold = 5
+	userCacheBreakerCooldown  = 10 * time.Second
+
+	// the in-process fallback used while Redis is unavailable
+	userFallbackSize = 10000
+	userFallbackTTL  = time.Minute
+
+	// how many users can be marked stale during an outage. A mark lasts as
+	// long as a Redis entry, as by the time it expires the Redis entry it
+	// stands for has expired too.
+	userStaleSize = 100000
+	userStaleTTL  = userCacheTTL
+)
+
+// UserCache is consulted by every authenticated request. Concurrent misses
+// for the same user are coalesced into one database load. Redis sits behind a
+// circuit breaker and, while it is unavailable, users are held in a small
+// in-process cache instead so that requests carry on working.
 type UserCache struct {
 	subscribers     map[uint]bool
 	subscribersLock sync.RWMutex
+	provider        repository.Provider
+	shared          sharedCacheTier
+	breaker         *circuitBreaker
+	fallback        *localCache
+	loads           singleflight.Group
+
+	// stale holds the users whose Redis entries couldn't be replaced or
+	// removed. They are reloaded from the database until one can be.
+	stale *localCache
 }
 
-func NewUserCache() *UserCache {
+func NewUserCache(provider repository.Provider) *UserCache {
 	cache := &UserCache{
 		subscribers:     make(map[uint]bool),
 		subscribersLock: sync.RWMutex{},
+		provider:        provider,
+		shared:          &redisCacheTier{},
+		breaker:         newCircuitBreaker("user_cache_redis", userCacheBreakerThreshold, userCacheBreakerCooldown),
+		fallback:        newLocalCache(userFallbackSize, userFallbackTTL),
+		stale:           newLocalCache(userStaleSize, userStaleTTL),
 	}
 	return cache
 }
 
-func (cache *UserCache) Get(userId uint) *model.User {
+func (cache *UserCache) Get(userId uint) (*model.User, error) {
 
-	var user model.User
+	if user, found := cache.getCached(userId); found {
+		return user, nil
+	}
 
-	userKey := fmt.Sprintf("U%d", userId)
-	val, err := connections.RedisConnection().Get(context.Background(), userKey).Result()
-	if err != redis.Nil {
+	value, err, _ := cache.loads.Do(strconv.FormatUint(uint64(userId), 10), func() (interface{}, error) {
+		var user model.User
+		if err := cache.getFromDB(userId, &user); err != nil {
+			return nil, err
+		}
+		return &user, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return copyUser(value.(*model.User)), nil
+
+}
 
-		if err := json.Unmarshal([]byte(val), &user); err != nil {
-			panic(utils.ErrInternalError)
+// getCached looks for the user in Redis or, if Redis can't be reached, in the
+// fallback
+func (cache *UserCache) getCached(userId uint) (*model.User, bool) {
+
+	if !cache.isStale(userId) && cache.breaker.Allow() {
+
+		userKey := fmt.Sprintf("U%d", userId)
+
+		ctx, cancelFn := context.WithTimeout(context.Background(), userCacheRedisTimeout)
+		defer cancelFn()
+
+		data, err := cache.shared.Get(ctx, userKey)
+		if err == nil {
+			cache.breaker.Success()
+			if data == nil {
+				return nil, false
+			}
+			var user model.User
+			if err := json.Unmarshal(data, &user); err != nil {
+				log.Errorf("UserCache: discarding unreadable %s: %v", userKey, err)
+				return nil, false
+			}
+			cache.shared.Expire(ctx, userKey, userCacheTTL)
+			return &user, true
 		}
-		connections.RedisConnection().Expire(context.Background(), userKey, time.Hour*24)
 
-	} else {
-		cache.getFromDB(userId, &user)
+		cache.breaker.Failure()
+		log.Errorf("UserCache: reading %s: %v", userKey, err)
+
+	}
+
+	if value, found := cache.fallback.Get(userId); found {
+		return copyUser(value.(*model.User)), true
 	}
 
-	return &user
+	return nil, false
 
 }
 
-func (cache *UserCache) Reload(userId uint) *model.User {
+func (cache *UserCache) Reload(userId uint) (*model.User, error) {
+
 	var user model.User
-	cache.getFromDB(userId, &user)
-	return &user
+	if err := cache.getFromDB(userId, &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+
 }
 
-func (cache *UserCache) getFromDB(userId uint, user *model.User) {
+func (cache *UserCache) getFromDB(userId uint, user *model.User) (err error) {
 
 	var ignored []*model.IgnoredUser
 
-	connections.WithDatabase(1*time.Second, func(db *gorm.DB) {
+	cache.provider.WithRepository(1*time.Second, func(repo repository.Repository) {
 
-		if result := db.Raw("call get_user(?)", userId).First(&user); result.Error != nil {
-			utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+		var found *model.User
+		if found, err = repo.Users().Get(userId); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = utils.NewError(utils.ErrNotFound, utils.ErrorCodeUserNotFound, "User not found")
+			} else {
+				err = utils.InternalError(err)
+			}
+			return
 		}
+		*user = *found
 
-		if result := db.Raw("call get_user_ignored_users(?)", userId).Scan(&ignored); result.Error != nil {
-			utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+		if ignored, err = repo.Users().GetIgnoredUsers(userId); err != nil {
+			err = utils.InternalError(err)
 		}
 
 	})
 
+	if err != nil {
+		return err
+	}
+
 	user.IgnoredUsers = make(map[uint]*model.IgnoredUser)
 	for _, item := range ignored {
 		user.IgnoredUsers[item.IgnoredUserId] = item
 	}
 
-	cache.Put(user)
+	return cache.Put(user)
 
 }
 
-func (cache *UserCache) Put(user *model.User) {
+// Put caches the user. It only fails if the user can't be serialised: when
+// Redis is unavailable the user is kept in the fallback and Redis is caught up
+// on the next load.
+func (cache *UserCache) Put(user *model.User) error {
 
 	data, err := json.Marshal(user)
 	if err != nil {
-		panic(err)
+		return utils.InternalError(err)
 	}
 
+	// the user being put is the latest, whatever its version says, so an
+	// older copy is never left in the fallback
+	cache.fallback.Remove(user.Id)
+
+	if !cache.breaker.Allow() {
+		cache.fallback.Put(user.Id, copyUser(user), user.Version)
+		cache.setStale(user.Id, true)
+		return nil
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), userCacheRedisTimeout)
+	defer cancelFn()
+
 	userKey := fmt.Sprintf("U%d", user.Id)
-	status := connections.RedisConnection().Set(context.Background(), userKey, string(data), time.Hour*24)
-	if status.Err() != nil {
-		panic(status.Err())
+	if err := cache.shared.Set(ctx, userKey, data, userCacheTTL); err != nil {
+		cache.breaker.Failure()
+		cache.fallback.Put(user.Id, copyUser(user), user.Version)
+		cache.setStale(user.Id, true)
+		log.Errorf("UserCache: writing %s: %v", userKey, err)
+		return nil
 	}
 
+	cache.breaker.Success()
+	cache.setStale(user.Id, false)
+
+	return nil
+
 }
 
 func (cache *UserCache) Flush(user *model.User) {
@@ -117,47 +236,96 @@ func (cache *UserCache) Flush(user *model.User) {
 }
 
 func (cache *UserCache) FlushById(userId uint) {
-	userKey := fmt.Sprintf("U%d", userId)
-	connections.RedisConnection().Del(context.Background(), userKey)
-	dataKey := fmt.Sprintf("US%d", userId)
-	connections.RedisConnection().Del(context.Background(), dataKey)
+
+	cache.fallback.Remove(userId)
+
+	if !cache.breaker.Allow() {
+		cache.setStale(userId, true)
+		return
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), userCacheRedisTimeout)
+	defer cancelFn()
+
+	if err := cache.shared.Delete(ctx, fmt.Sprintf("U%d", userId), fmt.Sprintf("US%d", userId)); err != nil {
+		cache.breaker.Failure()
+		cache.setStale(userId, true)
+		log.Errorf("UserCache: flushing %d: %v", userId, err)
+		return
+	}
+
+	cache.breaker.Success()
+	cache.setStale(userId, false)
+
+}
+
+func (cache *UserCache) isStale(userId uint) bool {
+	_, stale := cache.stale.Get(userId)
+	return stale
+}
+
+func (cache *UserCache) setStale(userId uint, stale bool) {
+	if stale {
+		cache.stale.Put(userId, true, 0)
+	} else {
+		cache.stale.Remove(userId)
+	}
 }
 
-func (cache *UserCache) ClearRefreshToken(refreshToken string) {
+// copyUser copies the user and its map of ignored users so that one cached
+// user is never shared between requests
+func copyUser(user *model.User) *model.User {
+
+	copied := *user
+	if user.IgnoredUsers != nil {
+		copied.IgnoredUsers = make(map[uint]*model.IgnoredUser, len(user.IgnoredUsers))
+		for id, ignored := range user.IgnoredUsers {
+			copied.IgnoredUsers[id] = ignored
+		}
+	}
+
+	return &copied
+
+}
+
+func (cache *UserCache) ClearRefreshToken(refreshToken string) error {
 	log.Debugf("Clear refresh token '%s'", refreshToken)
 	tokenKey := "T" + refreshToken
 	status := connections.RedisConnection().Del(context.Background(), tokenKey)
 	if status.Err() != nil {
-		panic(status.Err())
+		return utils.InternalError(status.Err())
 	}
+	return nil
 }
 
-func (cache *UserCache) RotateRefreshToken(user *model.User) string {
+func (cache *UserCache) RotateRefreshToken(user *model.User) (string, error) {
 	log.Debugf("Rotate refresh token for %d", user.Id)
 	refreshToken := uuid.NewString()
 	tokenKey := "T" + refreshToken
 	status := connections.RedisConnection().Set(context.Background(), tokenKey, strconv.Itoa(int(user.Id)), time.Hour*720)
 	if status.Err() != nil {
-		panic(status.Err())
+		return "", utils.InternalError(status.Err())
 	}
 
-	return refreshToken
+	return refreshToken, nil
 
 }
 
-func (cache *UserCache) GetUserIdForRefreshToken(refreshToken string) uint {
+func (cache *UserCache) GetUserIdForRefreshToken(refreshToken string) (uint, error) {
 	log.Debugf("Get refresh token '%s'", refreshToken)
 	tokenKey := "T" + refreshToken
-	if result := connections.RedisConnection().Get(context.Background(), tokenKey); result.Err() != nil {
+	result := connections.RedisConnection().Get(context.Background(), tokenKey)
+	if result.Err() != nil {
 		log.Errorf("fetching cached refresh token: %v", result.Err())
-		panic(utils.ErrForbidden)
-	} else {
-		if val, err := result.Int64(); err == nil {
-			return uint(val)
-		} else {
-			panic(err)
-		}
+		return 0, utils.NewError(utils.ErrForbidden, utils.ErrorCodeInvalidToken, "Invalid refresh token")
 	}
+
+	val, err := result.Int64()
+	if err != nil {
+		return 0, utils.InternalError(err)
+	}
+
+	return uint(val), nil
 }
 
 func (cache *UserCache) AddSubscriber(user *model.User) {
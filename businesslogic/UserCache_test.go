@@ -16,14 +16,27 @@
 package businesslogic
 
 import (
+	"errors"
+	"fmt"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"justthetalk/repository/memory"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetUser(t *testing.T) {
 
-	userCache := NewUserCache()
+	requireDatabase(t)
+
+	userCache := NewUserCache(testProvider)
 
-	user := userCache.Get(50)
+	user := getTestUser(t, userCache, 50)
 
 	if user.Id != 50 {
 		t.Error("Failed to load user")
@@ -33,7 +46,7 @@ func TestGetUser(t *testing.T) {
 		t.Error("Failed to get ignored users")
 	}
 
-	user = userCache.Get(251)
+	user = getTestUser(t, userCache, 251)
 
 	if user.Id != 50 {
 		t.Error("Failed to load user")
@@ -44,3 +57,78 @@ func TestGetUser(t *testing.T) {
 	}
 
 }
+
+// countingProvider counts the trips to the database and makes each one slow
+// enough for concurrent requests to overlap
+type countingProvider struct {
+	store *memory.Store
+	calls int32
+}
+
+func (p *countingProvider) WithRepository(timeout time.Duration, fn func(repo repository.Repository)) {
+	atomic.AddInt32(&p.calls, 1)
+	time.Sleep(20 * time.Millisecond)
+	p.store.WithRepository(timeout, fn)
+}
+
+func TestUserCacheSurvivesRedisOutage(t *testing.T) {
+
+	store := memory.NewStore()
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+	provider := &countingProvider{store: store}
+
+	shared := newFakeCacheTier()
+	shared.err = errors.New("connection refused")
+	cache := NewUserCache(provider)
+	cache.shared = shared
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found, err := cache.Get(user.Id)
+			if assert.NoError(t, err) {
+				assert.Equal(t, user.Id, found.Id)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&provider.calls), "concurrent misses are loaded once")
+	assert.Equal(t, CircuitOpen, cache.breaker.State())
+
+	// with the circuit open the user comes from the fallback
+	found, err := cache.Get(user.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", found.Username)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&provider.calls))
+
+}
+
+func TestUserCacheCatchesRedisUpAfterAnOutage(t *testing.T) {
+
+	store := memory.NewStore()
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+
+	shared := newFakeCacheTier()
+	cache := NewUserCache(store)
+	cache.shared = shared
+
+	_, err := cache.Get(user.Id)
+	require.NoError(t, err)
+	require.NotNil(t, shared.values[fmt.Sprintf("U%d", user.Id)])
+	assert.Equal(t, 0, cache.fallback.Len(), "the fallback is only filled while Redis is failing")
+
+	// the user is changed while Redis is down, so the flush is missed
+	shared.err = errors.New("connection refused")
+	cache.FlushById(user.Id)
+	store.Users().UpdateBio(user.Id, "changed")
+	shared.err = nil
+
+	found, err := cache.Get(user.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "changed", found.Bio, "the stale Redis entry isn't used")
+	assert.False(t, cache.isStale(user.Id))
+
+}
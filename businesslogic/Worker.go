@@ -0,0 +1,26 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package businesslogic
+
+import "context"
+
+// Worker is a background process owned by the App. Start returns once the
+// worker is running and the worker stops by itself if ctx is cancelled. Stop
+// blocks until the worker has finished its outstanding work or ctx expires.
+type Worker interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
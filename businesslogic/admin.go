@@ -16,23 +16,33 @@
 package businesslogic
 
 import (
+	"errors"
 	"fmt"
 	"justthetalk/model"
+	"justthetalk/repository"
 	"justthetalk/utils"
+	"regexp"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gosimple/slug"
-	"gorm.io/gorm"
+	log "github.com/sirupsen/logrus"
 )
 
-func FetchBlockedUsers(discussion *model.Discussion, db *gorm.DB) map[uint]*model.BlockedDiscussionUser {
+var folderKeyPattern = regexp.MustCompile(`^[a-z0-9-]+$`)
 
-	var blockedUsersList []*model.BlockedDiscussionUser
-	if result := db.Raw("call get_blocked_discussion_users(?)", discussion.Id).Scan(&blockedUsersList); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+// maxBannedWordTestPosts limits how many posts a test of a banned word reads
+const maxBannedWordTestPosts = 10000
+
+func FetchBlockedUsers(discussion *model.Discussion, repo repository.Repository) (map[uint]*model.BlockedDiscussionUser, error) {
+
+	blockedUsersList, err := repo.Discussions().GetBlockedUsers(discussion.Id)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	return mapBlockedUsers(blockedUsersList)
+	return mapBlockedUsers(blockedUsersList), nil
 
 }
 
@@ -47,29 +57,27 @@ func mapBlockedUsers(blockedUsersList []*model.BlockedDiscussionUser) map[uint]*
 
 }
 
-func BlockUnblockUser(discussion *model.Discussion, targetUser *model.User, blockNotUnblock bool, adminUser *model.User, db *gorm.DB) map[uint]*model.BlockedDiscussionUser {
+func BlockUnblockUser(discussion *model.Discussion, targetUser *model.User, blockNotUnblock bool, adminUser *model.User, repo repository.Repository) (map[uint]*model.BlockedDiscussionUser, error) {
 
-	state := 0
 	eventType := model.UserHistoryAdminDiscussionUnblocked
 	if blockNotUnblock {
-		state = 1
 		eventType = model.UserHistoryAdminDiscussionBlocked
 	}
 
-	var blockedUsersList []*model.BlockedDiscussionUser
-	if result := db.Raw("call block_discussion_user(?, ?, ?)", discussion.Id, targetUser.Id, state).Scan(&blockedUsersList); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	blockedUsersList, err := repo.Discussions().SetUserBlocked(discussion.Id, targetUser.Id, blockNotUnblock)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	CreateUserHistory(eventType, fmt.Sprintf("DiscussionId: %d, Actioned by: %s", discussion.Id, adminUser.Username), targetUser, db)
+	if err := CreateUserHistory(eventType, fmt.Sprintf("DiscussionId: %d, Actioned by: %s", discussion.Id, adminUser.Username), targetUser, repo); err != nil {
+		return nil, err
+	}
 
-	return mapBlockedUsers(blockedUsersList)
+	return mapBlockedUsers(blockedUsersList), nil
 
 }
 
-func AdminDeleteNoUndeletePost(postId uint, folder *model.Folder, discussion *model.Discussion, deleteNotUndelete bool, adminUser *model.User, userCache *UserCache, db *gorm.DB) *model.Post {
-
-	var post model.Post
+func AdminDeleteNoUndeletePost(postId uint, folder *model.Folder, discussion *model.Discussion, deleteNotUndelete bool, adminUser *model.User, userCache *UserCache, repo repository.Repository) (*model.Post, error) {
 
 	postStatus := model.PostStatusDeletedByAdmin
 	if !deleteNotUndelete {
@@ -77,307 +85,320 @@ func AdminDeleteNoUndeletePost(postId uint, folder *model.Folder, discussion *mo
 	}
 
 	// TODO put this in a transaction
-	if result := db.Raw("call set_post_status(?, ?, ?, ?)", discussion.Id, postId, postStatus, 0).First(&post); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	post, err := repo.Posts().SetStatus(discussion.Id, postId, postStatus, 0)
+	if err != nil {
+		return nil, postError(err)
+	}
+
+	targetUser, err := userCache.Get(post.CreatedByUserId)
+	if err != nil {
+		return nil, err
 	}
 
-	targetUser := userCache.Get(post.CreatedByUserId)
 	var eventType string
 	if deleteNotUndelete {
 		eventType = model.UserHistoryAdminPostDelete
 	} else {
 		eventType = model.UserHistoryAdminPostUndelete
 	}
-	CreateUserHistory(eventType, fmt.Sprintf("Actioned by: %s", adminUser.Username), targetUser, db)
+
+	if err := CreateUserHistory(eventType, fmt.Sprintf("Actioned by: %s", adminUser.Username), targetUser, repo); err != nil {
+		return nil, err
+	}
 
 	post.Markup = PostFormatter().ApplyPostFormatting(post.Text, discussion)
-	post.Url = utils.UrlForPost(folder, discussion, &post)
+	post.Url = utils.UrlForPost(folder, discussion, post)
 
-	return &post
+	return post, nil
 
 }
 
-func GetModerationHistory(pageStart int, pageSize int, folderCache *FolderCache, discussionCache *DiscussionCache, db *gorm.DB) []*model.Post {
+func formatModeratedPosts(posts []*model.Post, folderCache *FolderCache, discussionCache *DiscussionCache, repo repository.Repository) error {
 
-	posts := make([]*model.Post, 0)
+	postIds := make([]uint, 0, len(posts))
+	for _, post := range posts {
+		postIds = append(postIds, post.Id)
+	}
 
-	if result := db.Raw("call get_moderated_posts(?, ?)", pageStart*pageSize, pageSize).Find(&posts); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	matches, err := repo.Moderation().GetBannedWordMatches(postIds)
+	if err != nil {
+		return utils.InternalError(err)
 	}
 
 	for _, post := range posts {
-		discussion := discussionCache.UnsafeGet(post.DiscussionId)
+		post.BannedWordIds = matches[post.Id]
+		discussion, err := discussionCache.UnsafeGet(post.DiscussionId)
+		if err != nil {
+			return err
+		}
 		folder := folderCache.UnsafeGet(discussion.FolderId)
 		post.Markup = PostFormatter().ApplyPostFormatting(post.Text, discussion)
 		post.Url = utils.UrlForPost(folder, discussion, post)
 	}
 
-	return posts
+	return nil
 
 }
 
-func GetModerationQueue(folderCache *FolderCache, discussionCache *DiscussionCache, db *gorm.DB) []*model.Post {
-
-	posts := make([]*model.Post, 0)
+func GetModerationHistory(pageStart int, pageSize int, folderCache *FolderCache, discussionCache *DiscussionCache, repo repository.Repository) ([]*model.Post, error) {
 
-	if result := db.Raw("call get_moderation_queue()").Find(&posts); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	posts, err := repo.Moderation().GetModeratedPosts(pageStart*pageSize, pageSize)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	for _, post := range posts {
-		discussion := discussionCache.UnsafeGet(post.DiscussionId)
-		folder := folderCache.UnsafeGet(discussion.FolderId)
-		post.Markup = PostFormatter().ApplyPostFormatting(post.Text, discussion)
-		post.Url = utils.UrlForPost(folder, discussion, post)
+	if err := formatModeratedPosts(posts, folderCache, discussionCache, repo); err != nil {
+		return nil, err
 	}
 
-	return posts
+	return posts, nil
 
 }
 
-func GetReportsByPost(postId uint, db *gorm.DB) []*model.PostReport {
+func GetModerationQueue(folderCache *FolderCache, discussionCache *DiscussionCache, repo repository.Repository) ([]*model.Post, error) {
 
-	results := make([]*model.PostReport, 0)
-	if result := db.Raw("call get_reports_by_post(?)", postId).Scan(&results); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	posts, err := repo.Moderation().GetQueue()
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	if err := formatModeratedPosts(posts, folderCache, discussionCache, repo); err != nil {
+		return nil, err
 	}
 
-	return results
+	return posts, nil
 
 }
 
-func GetCommentsByPost(postId uint, db *gorm.DB) []*model.ModeratorComment {
+func GetReportsByPost(postId uint, repo repository.Repository) ([]*model.PostReport, error) {
 
-	results := make([]*model.ModeratorComment, 0)
-	if result := db.Raw("call get_comments_by_post(?)", postId).Scan(&results); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	results, err := repo.Moderation().GetReportsByPost(postId)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	return results
+	return results, nil
 
 }
 
-func GetReportsByDiscussion(discussion *model.Discussion, db *gorm.DB) []*model.PostReport {
+func GetCommentsByPost(postId uint, repo repository.Repository) ([]*model.ModeratorComment, error) {
 
-	results := make([]*model.PostReport, 0)
-	if result := db.Raw("call get_reports_by_discussion(?)", discussion.Id).Scan(&results); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	results, err := repo.Moderation().GetCommentsByPost(postId)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	return results
+	return results, nil
 
 }
 
-func GetCommentsByDiscussion(discussion *model.Discussion, db *gorm.DB) []*model.ModeratorComment {
+func GetReportsByDiscussion(discussion *model.Discussion, repo repository.Repository) ([]*model.PostReport, error) {
 
-	results := make([]*model.ModeratorComment, 0)
-	if result := db.Raw("call get_comments_by_discussion(?)", discussion.Id).Scan(&results); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	results, err := repo.Moderation().GetReportsByDiscussion(discussion.Id)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	return results
+	return results, nil
 
 }
 
-func CreateComment(comment *model.ModeratorComment, folder *model.Folder, discussion *model.Discussion, post *model.Post, user *model.User, userCache *UserCache, db *gorm.DB) ([]*model.ModeratorComment, *model.Post) {
+func GetCommentsByDiscussion(discussion *model.Discussion, repo repository.Repository) ([]*model.ModeratorComment, error) {
 
-	results := make([]*model.ModeratorComment, 0)
-	if result := db.Raw("call create_admin_coment(?, ?, ?, ?)", post.Id, user.Id, comment.Body, comment.Vote).Scan(&results); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	results, err := repo.Moderation().GetCommentsByDiscussion(discussion.Id)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	totalVote := 0
-	for _, comment := range results {
-		totalVote += comment.Vote
-	}
+	return results, nil
 
-	moderationThreshold := 2
-	if post.Status == model.PostStatusSuspendedByAdmin || post.Status == model.PostStatusWatch {
-		moderationThreshold = 1
+}
+
+func CreateComment(comment *model.ModeratorComment, folder *model.Folder, discussion *model.Discussion, post *model.Post, user *model.User, policy *ModerationPolicy, userCache *UserCache, repo repository.Repository) ([]*model.ModeratorComment, *model.Post, error) {
+
+	results, err := repo.Moderation().CreateComment(post.Id, user.Id, comment.Body, comment.Vote)
+	if err != nil {
+		return nil, nil, utils.InternalError(err)
 	}
 
-	if utils.Abs(totalVote) >= moderationThreshold {
+	decision := policy.Decide(folder, post, results, time.Time{}, time.Now().UTC())
+	if len(decision.Result) > 0 {
 
-		var result string
-		if totalVote < 0 {
-			post.Status = model.PostStatusDeletedByAdmin
-			result = "DELETE"
-		} else {
-			post.Status = model.PostStatusOK
-			result = "KEEP"
+		targetUser, err := userCache.Get(post.CreatedByUserId)
+		if err != nil {
+			return nil, nil, err
 		}
 
-		targetUser := userCache.Get(post.CreatedByUserId)
-		CreateUserHistory(model.UserHistoryAdminPostModerated, fmt.Sprintf("PostId: %d, %s", post.Id, result), targetUser, db)
-
-		if result := db.Raw("call set_post_status(?, ?, ?, ?)", discussion.Id, post.Id, post.Status, totalVote).First(post); result.Error != nil {
-			utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+		updated, err := ApplyModerationDecision(decision, post, targetUser, repo)
+		if err != nil {
+			return nil, nil, err
 		}
+		*post = *updated
 
 		post.Markup = PostFormatter().ApplyPostFormatting(post.Text, discussion)
 		post.Url = utils.UrlForPost(folder, discussion, post)
 
 	}
 
-	return results, post
+	return results, post, nil
 
 }
 
-func LockDiscussion(discussion *model.Discussion, lockState int, discussionCache *DiscussionCache, db *gorm.DB) {
+func LockDiscussion(discussion *model.Discussion, lockState int, discussionCache *DiscussionCache, repo repository.Repository) error {
 
-	if result := db.Raw("call lock_discussion(?, ?)", discussion.Id, lockState).Take(discussion); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	updated, err := repo.Discussions().Lock(discussion.Id, lockState != 0)
+	if err != nil {
+		return discussionError(err)
 	}
+	*discussion = *updated
 
-	discussionCache.Put(discussion)
+	return discussionCache.Put(discussion)
 
 }
 
-func PremoderateDiscussion(discussion *model.Discussion, premodState int, discussionCache *DiscussionCache, db *gorm.DB) {
+func PremoderateDiscussion(discussion *model.Discussion, premodState int, discussionCache *DiscussionCache, repo repository.Repository) error {
 
-	if result := db.Raw("call lock_premoderate_discussiondiscussion(?, ?)", discussion.Id, premodState).Take(discussion); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	updated, err := repo.Discussions().Premoderate(discussion.Id, premodState != 0)
+	if err != nil {
+		return discussionError(err)
 	}
+	*discussion = *updated
 
-	discussionCache.Put(discussion)
+	return discussionCache.Put(discussion)
 
 }
 
-func AdminDeleteDiscussion(discussion *model.Discussion, deleteState int, discussionCache *DiscussionCache, db *gorm.DB) {
+func AdminDeleteDiscussion(discussion *model.Discussion, deleteState int, discussionCache *DiscussionCache, repo repository.Repository) error {
 
 	var status = model.DiscussionStatusOk
 	if deleteState == 1 {
 		status = model.DiscussionStatusDeletedByAdmin
 	}
 
-	if result := db.Raw("call delete_discussion(?, ?)", discussion.Id, status).Take(discussion); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	updated, err := repo.Discussions().SetStatus(discussion.Id, status)
+	if err != nil {
+		return discussionError(err)
 	}
+	*discussion = *updated
 
-	discussionCache.Put(discussion)
+	return discussionCache.Put(discussion)
 
 }
 
-func MoveDiscussion(discussion *model.Discussion, targetFolder *model.Folder, discussionCache *DiscussionCache, db *gorm.DB) {
+func MoveDiscussion(discussion *model.Discussion, targetFolder *model.Folder, discussionCache *DiscussionCache, repo repository.Repository) error {
+
+	moved, err := repo.Discussions().Move(discussion.Id, targetFolder.Id)
+	if err != nil {
+		return discussionError(err)
+	}
+	*discussion = *moved
 
-	if result := db.Exec("call move_discussion(?, ?)", discussion.Id, targetFolder.Id); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	if err := discussionCache.Put(discussion); err != nil {
+		return err
 	}
+	discussion.Url = utils.UrlForDiscussion(targetFolder, discussion)
 
-	discussionCache.Put(discussion)
+	return nil
 
 }
 
-func EraseDiscussion(discussion *model.Discussion, discussionCache *DiscussionCache, db *gorm.DB) {
+func EraseDiscussion(discussion *model.Discussion, discussionCache *DiscussionCache, repo repository.Repository) error {
 
-	if result := db.Exec("call erase_discussion(?)", discussion.Id); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	if err := repo.Discussions().Erase(discussion.Id); err != nil {
+		return utils.InternalError(err)
 	}
 
-	discussionCache.Flush(discussion.Id)
+	return discussionCache.Flush(discussion.Id)
 
 }
 
-func SearchUsers(searchTerm string, db *gorm.DB) []*model.UserSearchResults {
-
-	results := make([]*model.UserSearchResults, 0)
+func SearchUsers(searchTerm string, repo repository.Repository) ([]*model.UserSearchResults, error) {
 
-	if result := db.Raw("call search_users(?)", fmt.Sprintf("%%%s%%", searchTerm)).Scan(&results); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	results, err := repo.Users().Search(searchTerm)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	return results
+	return results, nil
 }
 
-func FilterUsers(filterKey string, db *gorm.DB) []*model.UserSearchResults {
-
-	results := make([]*model.UserSearchResults, 0)
+func FilterUsers(filterKey string, repo repository.Repository) ([]*model.UserSearchResults, error) {
 
-	command := ""
-	switch filterKey {
-	case "premod":
-		command = "search_users_premod"
-	case "watch":
-		command = "search_users_watch"
-	case "locked":
-		command = "search_users_locked"
-	case "recent":
-		command = "search_users_recent"
+	filter := repository.UserFilter(filterKey)
+	switch filter {
+	case repository.UserFilterPremoderate, repository.UserFilterWatch, repository.UserFilterLocked, repository.UserFilterRecent:
 	default:
-		panic(utils.ErrBadRequest)
+		return nil, utils.NewError(utils.ErrBadRequest, utils.ErrorCodeUnknownFilter, "Unknown user filter").WithField("filter", fmt.Sprintf("unknown value %q", filterKey))
 	}
 
-	if result := db.Raw(fmt.Sprintf("call %s", command)).Scan(&results); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	results, err := repo.Users().Filter(filter)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	return results
+	return results, nil
 
 }
 
-func SetUserStatus(targetUser *model.User, fieldMap map[string]interface{}, adminUser *model.User, userCache *UserCache, db *gorm.DB) (*model.User, error) {
+func SetUserStatus(targetUser *model.User, fieldMap map[string]interface{}, adminUser *model.User, userCache *UserCache, repo repository.Repository) (*model.User, error) {
 
-	err := db.Transaction(func(tx *gorm.DB) error {
+	err := repo.Transaction(func(tx repository.Repository) error {
 
-		var result *gorm.DB
 		for k, v := range fieldMap {
 
 			var eventType string
 			eventData := fmt.Sprintf("Actioned by: %s", adminUser.Username)
 
-			switch k {
-			case "enabled":
-				result = tx.Table("user").Where("id = ?", targetUser.Id).Update("enabled", v)
-				if v.(bool) {
+			value, ok := v.(bool)
+			if !ok {
+				return utils.NewValidationError(utils.FieldError{Field: k, Message: "must be a boolean"})
+			}
+
+			switch repository.UserFlag(k) {
+			case repository.UserFlagEnabled:
+				if value {
 					eventType = model.UserHistoryAdminAccountDeleteEnabled
 				} else {
 					eventType = model.UserHistoryAdminAccountDeleteDisabled
 				}
 
-			case "accountLocked":
-				result = tx.Table("user").Where("id = ?", targetUser.Id).Update("account_locked", v)
-				if v.(bool) {
+			case repository.UserFlagLocked:
+				if value {
 					eventType = model.UserHistoryAdminAccountLockedEnabled
 				} else {
 					eventType = model.UserHistoryAdminAccountLockedDisabled
 				}
 
-			case "isPremoderate":
-				result = tx.Table("user_options").Where("user_id = ?", targetUser.Id).Update("premoderate", v)
-				if v.(bool) {
+			case repository.UserFlagPremoderate:
+				if value {
 					eventType = model.UserHistoryAdminPremodEnabled
 				} else {
 					eventType = model.UserHistoryAdminPremodDisabled
 				}
 
-			case "isWatch":
-				result = tx.Table("user_options").Where("user_id = ?", targetUser.Id).Update("watch", v)
-				if v.(bool) {
+			case repository.UserFlagWatch:
+				if value {
 					eventType = model.UserHistoryAdminWatchEnabled
 				} else {
 					eventType = model.UserHistoryAdminWatchDisabled
 				}
 
-			}
+			default:
+				continue
 
-			if result.Error != nil {
-				break
 			}
 
-			result = tx.Table("user").Where("id = ?", targetUser.Id).Update("last_updated", time.Now())
-			if result.Error != nil {
-				break
+			if err := tx.Users().SetFlag(targetUser.Id, repository.UserFlag(k), value); err != nil {
+				return utils.InternalError(err)
 			}
 
-			CreateUserHistory(eventType, eventData, targetUser, tx)
+			if err := CreateUserHistory(eventType, eventData, targetUser, tx); err != nil {
+				return err
+			}
 
 		}
 
-		if result.Error != nil {
-			return result.Error
-		} else {
-			return nil
-		}
+		return nil
 
 	})
 
@@ -386,26 +407,110 @@ func SetUserStatus(targetUser *model.User, fieldMap map[string]interface{}, admi
 	}
 
 	userCache.Flush(targetUser)
-	return userCache.Get(targetUser.Id), nil
+	return userCache.Get(targetUser.Id)
 
 }
 
-func GetUserHistory(targetUser *model.User, db *gorm.DB) []*model.UserHistory {
+func GetUserHistory(targetUser *model.User, repo repository.Repository) ([]*model.UserHistory, error) {
 
-	results := make([]*model.UserHistory, 0)
-	if result := db.Raw("call get_user_history(?)", targetUser.Id).Scan(&results); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	results, err := repo.Users().GetHistory(targetUser.Id)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	return results
+	return results, nil
 
 }
 
-func GetUserDiscussionBlocks(db *gorm.DB) []*model.DiscussionBlock {
+func GetModNotes(targetUser *model.User, repo repository.Repository) ([]*model.UserModNote, error) {
 
-	results := make([]*model.DiscussionBlock, 0)
-	if result := db.Raw("call get_user_discussion_blocks()").Scan(&results); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	results, err := repo.Users().GetModNotes(targetUser.Id)
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return results, nil
+
+}
+
+func validateModNote(note *model.UserModNote) error {
+
+	note.Note = strings.TrimSpace(note.Note)
+	if length := utf8.RuneCountInString(note.Note); length == 0 || length > 255 {
+		return utils.NewValidationError(utils.FieldError{Field: "note", Message: "Note must be between 1 and 255 characters"})
+	}
+
+	return nil
+
+}
+
+// getModNote fetches the note, which must be about the target user
+func getModNote(targetUser *model.User, noteId uint, repo repository.Repository) (*model.UserModNote, error) {
+
+	note, err := repo.Users().GetModNote(noteId)
+	if errors.Is(err, repository.ErrNotFound) || (err == nil && note.UserId != targetUser.Id) {
+		return nil, utils.NewError(utils.ErrNotFound, utils.ErrorCodeModNoteNotFound, "Note not found")
+	} else if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return note, nil
+
+}
+
+func CreateModNote(targetUser *model.User, note *model.UserModNote, moderator *model.User, repo repository.Repository) (*model.UserModNote, error) {
+
+	if err := validateModNote(note); err != nil {
+		return nil, err
+	}
+
+	created, err := repo.Users().CreateModNote(targetUser.Id, moderator.Id, note.Note)
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return created, nil
+
+}
+
+func UpdateModNote(targetUser *model.User, noteId uint, note *model.UserModNote, repo repository.Repository) (*model.UserModNote, error) {
+
+	if err := validateModNote(note); err != nil {
+		return nil, err
+	}
+
+	if _, err := getModNote(targetUser, noteId, repo); err != nil {
+		return nil, err
+	}
+
+	updated, err := repo.Users().UpdateModNote(noteId, note.Note)
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return updated, nil
+
+}
+
+func DeleteModNote(targetUser *model.User, noteId uint, repo repository.Repository) error {
+
+	if _, err := getModNote(targetUser, noteId, repo); err != nil {
+		return err
+	}
+
+	if err := repo.Users().DeleteModNote(noteId); err != nil {
+		return utils.InternalError(err)
+	}
+
+	return nil
+
+}
+
+func GetUserDiscussionBlocks(repo repository.Repository) ([]*model.DiscussionBlock, error) {
+
+	results, err := repo.Discussions().GetUserDiscussionBlocks()
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
 	for _, item := range results {
@@ -413,6 +518,383 @@ func GetUserDiscussionBlocks(db *gorm.DB) []*model.DiscussionBlock {
 		item.Url = fmt.Sprintf("/%s/%d/%s/1", item.FolderKey, item.DiscussionId, slugText)
 	}
 
-	return results
+	return results, nil
+
+}
+
+func GetDeadLetteredOutboxEntries(pageStart int, pageSize int, repo repository.Repository) ([]*model.OutboxEntry, error) {
+
+	results, err := repo.Outbox().GetDeadLettered(pageStart, pageSize)
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return results, nil
+
+}
+
+func ReplayOutboxEntry(entryId uint, repo repository.Repository) (*model.OutboxEntry, error) {
+
+	entry, err := repo.Outbox().Replay(entryId)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, utils.NewError(utils.ErrNotFound, utils.ErrorCodeOutboxEntryNotFound, "Dead lettered outbox entry not found")
+	} else if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return entry, nil
+
+}
+
+func GetSearchIndexJobs(pageStart int, pageSize int, repo repository.Repository) ([]*model.SearchIndexJob, error) {
+
+	results, err := repo.SearchIndexJobs().GetRecent(pageStart, pageSize)
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return results, nil
+
+}
+
+func RetrySearchIndexJob(jobId uint, repo repository.Repository) (*model.SearchIndexJob, error) {
+
+	job, err := repo.SearchIndexJobs().Retry(jobId)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, utils.NewError(utils.ErrNotFound, utils.ErrorCodeSearchIndexJobNotFound, "Failed search index job not found")
+	} else if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return job, nil
+
+}
+
+// CreateContentScanJob queues a scan of the posts made between the job's
+// dates. Missing dates default to the runner's window up to now.
+func CreateContentScanJob(user *model.User, job *model.ContentScanJob, runner *ContentScanJobRunner, now time.Time) (*model.ContentScanJob, error) {
+
+	if job.ToDate.IsZero() {
+		job.ToDate = now
+	}
+
+	if job.FromDate.IsZero() && runner.Window() > 0 {
+		job.FromDate = job.ToDate.Add(-runner.Window())
+	}
+
+	if job.FromDate.IsZero() {
+		return nil, utils.NewValidationError(utils.FieldError{Field: "fromDate", Message: "A start date is required"})
+	}
+
+	if !job.FromDate.Before(job.ToDate) {
+		return nil, utils.NewValidationError(utils.FieldError{Field: "toDate", Message: "The end date must be after the start date"})
+	}
+
+	created, err := runner.Enqueue(user.Id, job.FromDate, job.ToDate)
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return created, nil
+
+}
+
+func GetContentScanJobs(pageStart int, pageSize int, repo repository.Repository) ([]*model.ContentScanJob, error) {
+
+	results, err := repo.ContentScanJobs().GetRecent(pageStart, pageSize)
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return results, nil
+
+}
+
+func GetContentScanJob(jobId uint, repo repository.Repository) (*model.ContentScanJob, error) {
+
+	job, err := repo.ContentScanJobs().Get(jobId)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, utils.NewError(utils.ErrNotFound, utils.ErrorCodeContentScanJobNotFound, "Content scan job not found")
+	} else if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return job, nil
+
+}
+
+func validateFolder(folderId uint, folder *model.Folder, folderCache *FolderCache) error {
+
+	folder.Key = strings.TrimSpace(folder.Key)
+	folder.Description = strings.TrimSpace(folder.Description)
+
+	var fields []utils.FieldError
+
+	if len(folder.Key) == 0 || len(folder.Key) > 64 || !folderKeyPattern.MatchString(folder.Key) {
+		fields = append(fields, utils.FieldError{Field: "key", Message: "Key must be 1 to 64 lower case letters, digits or hyphens"})
+	}
+
+	if len(folder.Description) == 0 || len(folder.Description) > 255 {
+		fields = append(fields, utils.FieldError{Field: "description", Message: "Description must be 1 to 255 characters"})
+	}
+
+	if folder.Type != model.FolderTypeNormal && folder.Type != model.FolderTypeAdmin {
+		fields = append(fields, utils.FieldError{Field: "type", Message: "Unknown folder type"})
+	}
+
+	if len(fields) > 0 {
+		return utils.NewValidationError(fields...)
+	}
+
+	for _, existing := range folderCache.Entries() {
+		if existing.Key == folder.Key && existing.Id != folderId {
+			return utils.NewError(utils.ErrBadRequest, utils.ErrorCodeFolderKeyExists, "A folder with that key already exists").WithField("key", "A folder with that key already exists")
+		}
+	}
+
+	return nil
+
+}
+
+// CreateFolder adds a folder at the end of the list and reloads the folder
+// cache on every instance
+func CreateFolder(folder *model.Folder, folderCache *FolderCache, repo repository.Repository) (*model.Folder, error) {
+
+	if err := validateFolder(0, folder, folderCache); err != nil {
+		return nil, err
+	}
+
+	created, err := repo.Folders().Create(folder.Key, folder.Description, folder.Type)
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	if err := folderCache.Changed(); err != nil {
+		return nil, err
+	}
+
+	return created, nil
+
+}
+
+// UpdateFolder renames, retypes or archives a folder. Discussions in an
+// archived folder can still be read but nothing new can be posted there.
+// The folder's key is part of every post url, so its posts are queued to be
+// reindexed. Cached discussions take their urls from the folder cache.
+func UpdateFolder(folderId uint, folder *model.Folder, folderCache *FolderCache, indexJobRunner *SearchIndexJobRunner, repo repository.Repository) (*model.Folder, error) {
+
+	if folderCache.UnsafeGet(folderId) == nil {
+		return nil, utils.NewError(utils.ErrNotFound, utils.ErrorCodeNotFound, "Folder not found")
+	}
+
+	if err := validateFolder(folderId, folder, folderCache); err != nil {
+		return nil, err
+	}
+
+	updated, err := repo.Folders().Update(folderId, folder.Key, folder.Description, folder.Type, folder.IsArchived)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, utils.NewError(utils.ErrNotFound, utils.ErrorCodeNotFound, "Folder not found")
+	} else if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	if err := folderCache.Changed(); err != nil {
+		return nil, err
+	}
+
+	// the folder has been saved so a failure here is only logged
+	if _, err := indexJobRunner.Enqueue(model.SearchIndexJobScopeFolder, folderId, "folder.edited"); err != nil {
+		log.Error(err)
+	}
+
+	return updated, nil
+
+}
+
+// ReorderFolders puts the folders in the order given, which must include
+// every folder exactly once
+func ReorderFolders(folderIds []uint, folderCache *FolderCache, repo repository.Repository) ([]*model.Folder, error) {
+
+	entries := folderCache.Entries()
+
+	known := make(map[uint]bool)
+	for _, entry := range entries {
+		known[entry.Id] = true
+	}
+
+	seen := make(map[uint]bool)
+	for _, folderId := range folderIds {
+		if !known[folderId] || seen[folderId] {
+			return nil, utils.NewValidationError(utils.FieldError{Field: "folderIds", Message: fmt.Sprintf("Unknown or repeated folder %d", folderId)})
+		}
+		seen[folderId] = true
+	}
+
+	if len(folderIds) != len(entries) {
+		return nil, utils.NewValidationError(utils.FieldError{Field: "folderIds", Message: "Every folder must be included"})
+	}
+
+	err := repo.Transaction(func(tx repository.Repository) error {
+		for ix, folderId := range folderIds {
+			if err := tx.Folders().SetSortOrder(folderId, ix+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	if err := folderCache.Changed(); err != nil {
+		return nil, err
+	}
+
+	return folderCache.Entries(), nil
+
+}
+
+func GetBannedWords(repo repository.Repository) ([]*model.BannedWord, error) {
+
+	words, err := repo.Moderation().GetBannedWords()
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return words, nil
+
+}
+
+func validateBannedWord(word *model.BannedWord, folderCache *FolderCache) error {
+
+	word.Pattern = strings.TrimSpace(word.Pattern)
+	if len(word.Action) == 0 {
+		word.Action = model.BannedWordActionHold
+	}
+
+	var fields []utils.FieldError
+
+	if _, err := compileBannedWord(word.Pattern); err != nil {
+		fields = append(fields, utils.FieldError{Field: "pattern", Message: err.Error()})
+	}
+
+	if _, known := bannedWordSeverity[word.Action]; !known {
+		fields = append(fields, utils.FieldError{Field: "action", Message: fmt.Sprintf("Action must be one of %s, %s, %s or %s", model.BannedWordActionMask, model.BannedWordActionWatch, model.BannedWordActionHold, model.BannedWordActionReject)})
+	}
+
+	for _, folderId := range word.FolderIds {
+		if folderCache.UnsafeGet(folderId) == nil {
+			fields = append(fields, utils.FieldError{Field: "folderIds", Message: fmt.Sprintf("Unknown folder %d", folderId)})
+		}
+	}
+
+	if len(fields) > 0 {
+		return utils.NewValidationError(fields...)
+	}
+
+	return nil
+
+}
+
+func bannedWordNotFound() error {
+	return utils.NewError(utils.ErrNotFound, utils.ErrorCodeBannedWordNotFound, "Banned word not found")
+}
+
+// CreateBannedWord adds a pattern and reloads the banned words on every
+// instance. The pattern is checked first so that a bad one can't be saved.
+func CreateBannedWord(word *model.BannedWord, bannedWordList *BannedWordsList, folderCache *FolderCache, repo repository.Repository) (*model.BannedWord, error) {
+
+	if err := validateBannedWord(word, folderCache); err != nil {
+		return nil, err
+	}
+
+	created, err := repo.Moderation().CreateBannedWord(word.Pattern, word.Action, word.FolderIds)
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	if err := bannedWordList.Changed(); err != nil {
+		return nil, err
+	}
+
+	return created, nil
+
+}
+
+func UpdateBannedWord(wordId uint, word *model.BannedWord, bannedWordList *BannedWordsList, folderCache *FolderCache, repo repository.Repository) (*model.BannedWord, error) {
+
+	if err := validateBannedWord(word, folderCache); err != nil {
+		return nil, err
+	}
+
+	updated, err := repo.Moderation().UpdateBannedWord(wordId, word.Pattern, word.Action, word.FolderIds)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, bannedWordNotFound()
+	} else if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	if err := bannedWordList.Changed(); err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+
+}
+
+func DeleteBannedWord(wordId uint, bannedWordList *BannedWordsList, repo repository.Repository) error {
+
+	if _, err := repo.Moderation().GetBannedWord(wordId); errors.Is(err, repository.ErrNotFound) {
+		return bannedWordNotFound()
+	} else if err != nil {
+		return utils.InternalError(err)
+	}
+
+	if err := repo.Moderation().DeleteBannedWord(wordId); err != nil {
+		return utils.InternalError(err)
+	}
+
+	return bannedWordList.Changed()
+
+}
+
+// TestBannedWord runs a pattern over the most recent posts without saving
+// it, so that moderators can see what it would catch
+func TestBannedWord(word *model.BannedWord, limit int, folderCache *FolderCache, discussionCache *DiscussionCache, repo repository.Repository) (*model.BannedWordTest, error) {
+
+	word.Pattern = strings.TrimSpace(word.Pattern)
+
+	re, err := compileBannedWord(word.Pattern)
+	if err != nil {
+		return nil, utils.NewValidationError(utils.FieldError{Field: "pattern", Message: err.Error()})
+	}
+
+	if limit < 1 || limit > maxBannedWordTestPosts {
+		return nil, utils.NewValidationError(utils.FieldError{Field: "size", Message: fmt.Sprintf("Size must be between 1 and %d", maxBannedWordTestPosts)})
+	}
+
+	posts, err := repo.Posts().GetRecent(limit)
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	result := &model.BannedWordTest{
+		Pattern: word.Pattern,
+		Scanned: len(posts),
+		Matches: make([]*model.Post, 0),
+	}
+
+	for _, post := range posts {
+		if re.MatchString(post.Text) {
+			result.Matches = append(result.Matches, post)
+		}
+	}
+
+	if err := formatModeratedPosts(result.Matches, folderCache, discussionCache, repo); err != nil {
+		return nil, err
+	}
+
+	return result, nil
 
 }
@@ -16,24 +16,31 @@
 package businesslogic
 
 import (
-	"justthetalk/connections"
+	"errors"
 	"justthetalk/model"
+	"justthetalk/repository"
+	"justthetalk/repository/memory"
+	"justthetalk/utils"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
-	"gorm.io/gorm"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFetchBlockedUsers(t *testing.T) {
 
+	requireDatabase(t)
+
 	discussionId := uint(25876)
 
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	_, _, discussionCache := newTestCaches(t)
 
-	discussion := discussionCache.UnsafeGet(discussionId)
-	blockedUsers := discussionCache.BlockedUsers(discussion)
+	discussion, err := discussionCache.UnsafeGet(discussionId)
+	require.NoError(t, err)
+	blockedUsers, err := discussionCache.BlockedUsers(discussion)
+	require.NoError(t, err)
 	if _, exists := blockedUsers[uint(2994)]; !exists {
 		t.Fail()
 	}
@@ -42,16 +49,18 @@ func TestFetchBlockedUsers(t *testing.T) {
 
 func TestBlockUser(t *testing.T) {
 
+	requireDatabase(t)
+
 	discussionId := uint(25876)
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, _, discussionCache := newTestCaches(t)
 
-	targetUser := userCache.Get(5540)
-	adminUser := userCache.Get(50)
-	discussion := discussionCache.UnsafeGet(discussionId)
-	blockedUsers := discussionCache.BlockOrUnblockUser(discussion, targetUser, true, adminUser)
+	targetUser := getTestUser(t, userCache, 5540)
+	adminUser := getTestUser(t, userCache, 50)
+	discussion, err := discussionCache.UnsafeGet(discussionId)
+	require.NoError(t, err)
+	blockedUsers, err := discussionCache.BlockOrUnblockUser(discussion, targetUser, true, adminUser)
+	require.NoError(t, err)
 	if _, exists := blockedUsers[uint(5540)]; !exists {
 		t.Fail()
 	}
@@ -60,16 +69,18 @@ func TestBlockUser(t *testing.T) {
 
 func TestUnblockUser(t *testing.T) {
 
+	requireDatabase(t)
+
 	discussionId := uint(25876)
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, _, discussionCache := newTestCaches(t)
 
-	targetUser := userCache.Get(5540)
-	adminUser := userCache.Get(50)
-	discussion := discussionCache.UnsafeGet(discussionId)
-	blockedUsers := discussionCache.BlockOrUnblockUser(discussion, targetUser, false, adminUser)
+	targetUser := getTestUser(t, userCache, 5540)
+	adminUser := getTestUser(t, userCache, 50)
+	discussion, err := discussionCache.UnsafeGet(discussionId)
+	require.NoError(t, err)
+	blockedUsers, err := discussionCache.BlockOrUnblockUser(discussion, targetUser, false, adminUser)
+	require.NoError(t, err)
 	if _, exists := blockedUsers[uint(5540)]; exists {
 		t.Fail()
 	}
@@ -77,45 +88,56 @@ func TestUnblockUser(t *testing.T) {
 }
 
 func TestAdminDeleteUndeletePost(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestAdminGetReports(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestAdminCreateAndGetComments(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestLockUnlockDiscussion(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestAdminPremodDiscussion(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestAdminDeleteDiscussion(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestAdminMoveDiscussion(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestAdminEraseDiscussion(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestModerationQueue(t *testing.T) {
+
+	requireDatabase(t)
+
 	// TODO - clear queue, create reports
-	connections.WithDatabase(60*time.Second, func(db *gorm.DB) {
+	testProvider.WithRepository(60*time.Second, func(repo repository.Repository) {
 
-		folderCache := NewFolderCache()
-		discussionCache := NewDiscussionCache(folderCache)
+		_, folderCache, discussionCache := newTestCaches(t)
 
-		posts := GetModerationQueue(folderCache, discussionCache, db)
+		posts, err := GetModerationQueue(folderCache, discussionCache, repo)
+		require.NoError(t, err)
 		if len(posts) == 0 {
 			t.Error("No posts")
 		}
@@ -124,14 +146,18 @@ func TestModerationQueue(t *testing.T) {
 
 func TestSearchUsers(t *testing.T) {
 
-	connections.WithDatabase(60*time.Second, func(db *gorm.DB) {
+	requireDatabase(t)
 
-		results := SearchUsers("johnny", db)
+	testProvider.WithRepository(60*time.Second, func(repo repository.Repository) {
+
+		results, err := SearchUsers("johnny", repo)
+		require.NoError(t, err)
 		if len(results) == 0 {
 			t.Error("No results")
 		}
 
-		results = SearchUsers("@@@", db)
+		results, err = SearchUsers("@@@", repo)
+		require.NoError(t, err)
 		if len(results) > 0 {
 			t.Error("Unexpected results")
 		}
@@ -141,11 +167,13 @@ func TestSearchUsers(t *testing.T) {
 
 func TestSetUserStatus(t *testing.T) {
 
-	connections.WithDatabase(60*time.Second, func(db *gorm.DB) {
+	requireDatabase(t)
+
+	testProvider.WithRepository(60*time.Second, func(repo repository.Repository) {
 
-		userCache := NewUserCache()
-		targetUser := userCache.Get(5540)
-		adminUser := userCache.Get(50)
+		userCache := NewUserCache(testProvider)
+		targetUser := getTestUser(t, userCache, 5540)
+		adminUser := getTestUser(t, userCache, 50)
 
 		fieldMap := make(map[string]interface{})
 
@@ -153,13 +181,13 @@ func TestSetUserStatus(t *testing.T) {
 		var err error
 
 		fieldMap["isWatch"] = false
-		updated, err = SetUserStatus(targetUser, fieldMap, adminUser, userCache, db)
+		updated, err = SetUserStatus(targetUser, fieldMap, adminUser, userCache, repo)
 		assert.NoError(t, err)
 		if updated.IsWatch {
 			t.Error("Unexpected: isWatch")
 		}
 		fieldMap["isWatch"] = true
-		updated, err = SetUserStatus(targetUser, fieldMap, adminUser, userCache, db)
+		updated, err = SetUserStatus(targetUser, fieldMap, adminUser, userCache, repo)
 		assert.NoError(t, err)
 		if !updated.IsWatch {
 			t.Error("Unexpected: isWatch")
@@ -167,3 +195,43 @@ func TestSetUserStatus(t *testing.T) {
 
 	})
 }
+
+func TestModNotes(t *testing.T) {
+
+	store := memory.NewStore()
+	moderator := store.AddUser(&model.User{Username: "mod", Email: "mod@example.com", Enabled: true, IsAdmin: true})
+	user := store.AddUser(&model.User{Username: "dave", Email: "dave@example.com", Enabled: true})
+	other := store.AddUser(&model.User{Username: "erin", Email: "erin@example.com", Enabled: true})
+
+	_, err := CreateModNote(user, &model.UserModNote{Note: "   "}, moderator, store)
+	assert.True(t, errors.Is(err, utils.ErrBadRequest), "expected bad request, got %v", err)
+
+	accented, err := CreateModNote(user, &model.UserModNote{Note: strings.Repeat("é", 255)}, moderator, store)
+	require.NoError(t, err, "the limit is in characters not bytes")
+	require.NoError(t, DeleteModNote(user, accented.Id, store))
+
+	note, err := CreateModNote(user, &model.UserModNote{Note: " keeps posting links "}, moderator, store)
+	require.NoError(t, err)
+	assert.Equal(t, "keeps posting links", note.Note)
+	assert.Equal(t, moderator.Id, note.ModeratorId)
+
+	CreateUserHistory(model.UserHistoryAdminPostModerated, "PostId: 1, DELETE", user, store)
+	history, err := GetUserHistory(user, store)
+	require.NoError(t, err)
+	assert.Len(t, history, 1, "notes are kept apart from the history")
+
+	// a note can only be changed through the user it is about
+	_, err = UpdateModNote(other, note.Id, &model.UserModNote{Note: "moved"}, store)
+	assert.True(t, errors.Is(err, utils.ErrNotFound), "expected not found, got %v", err)
+	assert.True(t, errors.Is(DeleteModNote(other, note.Id, store), utils.ErrNotFound))
+
+	updated, err := UpdateModNote(user, note.Id, &model.UserModNote{Note: "keeps posting spam links"}, store)
+	require.NoError(t, err)
+	assert.Equal(t, "keeps posting spam links", updated.Note)
+
+	require.NoError(t, DeleteModNote(user, note.Id, store))
+	notes, err := GetModNotes(user, store)
+	require.NoError(t, err)
+	assert.Empty(t, notes)
+
+}
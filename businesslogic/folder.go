@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"html"
 	"justthetalk/model"
+	"justthetalk/repository"
 	"justthetalk/utils"
 	"time"
 
@@ -26,14 +27,14 @@ import (
 
 	"sync"
 
-	"gorm.io/gorm"
+	log "github.com/sirupsen/logrus"
 )
 
 var postFormatterOnce sync.Once
 var postFormatter *utils.PostFormatter
 
-var bannedWordsOnce sync.Once
-var bannedWords *BannedWordsList
+var bannedWordsLock sync.RWMutex
+var bannedWords = &BannedWordsList{}
 
 func PostFormatter() *utils.PostFormatter {
 	postFormatterOnce.Do(func() {
@@ -43,162 +44,241 @@ func PostFormatter() *utils.PostFormatter {
 }
 
 func BannedWords() *BannedWordsList {
-	bannedWordsOnce.Do(func() {
-		bannedWords = NewBannedWordsList()
-	})
+	bannedWordsLock.RLock()
+	defer bannedWordsLock.RUnlock()
 	return bannedWords
 }
 
-func GetDiscussions(folder *model.Folder, pageStart int, pageSize int, user *model.User, db *gorm.DB) []*model.FrontPageEntry {
+func SetBannedWords(list *BannedWordsList) {
+	bannedWordsLock.Lock()
+	defer bannedWordsLock.Unlock()
+	bannedWords = list
+}
+
+func discussionError(err error) error {
+	if errors.Is(err, repository.ErrNotFound) {
+		return utils.NewError(utils.ErrNotFound, utils.ErrorCodeDiscussionNotFound, "Discussion not found")
+	}
+	return utils.InternalError(err)
+}
+
+func postError(err error) error {
+	if errors.Is(err, repository.ErrNotFound) {
+		return utils.NewError(utils.ErrNotFound, utils.ErrorCodePostNotFound, "Post not found")
+	}
+	return utils.InternalError(err)
+}
+
+func accountForbidden() error {
+	return utils.NewError(utils.ErrForbidden, utils.ErrorCodeAccountLocked, "This account is not allowed to post")
+}
+
+func folderArchived() error {
+	return utils.NewError(utils.ErrForbidden, utils.ErrorCodeFolderArchived, "This folder has been archived")
+}
+
+func bannedWordRejected(field string, check *BannedWordsCheck) error {
+	return utils.NewError(utils.ErrBadRequest, utils.ErrorCodeBannedWord, "This contains a word or phrase which isn't allowed").WithField(field, fmt.Sprintf("%q isn't allowed", check.Matched))
+}
+
+// checkDiscussionForBannedWords masks the title and header and reports
+// whether the discussion should be locked until a moderator has seen it
+func checkDiscussionForBannedWords(folder *model.Folder, discussion *model.Discussion) (bool, error) {
+
+	title := BannedWords().Check(discussion.Title, folder.Id)
+	if title.Action == model.BannedWordActionReject {
+		return false, bannedWordRejected("title", title)
+	}
+
+	header := BannedWords().Check(discussion.Header, folder.Id)
+	if header.Action == model.BannedWordActionReject {
+		return false, bannedWordRejected("header", header)
+	}
+
+	discussion.Title = title.Text
+	discussion.Header = header.Text
+
+	return title.Action == model.BannedWordActionHold || header.Action == model.BannedWordActionHold, nil
 
-	userId := 0
+}
+
+func GetDiscussions(folder *model.Folder, pageStart int, pageSize int, user *model.User, repo repository.Repository) ([]*model.FrontPageEntry, error) {
+
+	var userId uint
 	if user != nil {
-		userId = int(user.Id)
+		userId = user.Id
 	}
 
-	discussions := make([]*model.FrontPageEntry, 0)
-	if result := db.Raw("call get_folder_discussions(?, ?, ?, ?)", folder.Id, userId, pageStart, pageSize).Scan(&discussions); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	discussions, err := repo.Discussions().GetFolderDiscussions(folder.Id, userId, pageStart, pageSize)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
 	utils.FormatFrontPageEntries(discussions)
 
-	return discussions
+	return discussions, nil
 
 }
 
-func GetDiscussionsBefore(folder *model.Folder, beforeDate time.Time, pageSize int, user *model.User, db *gorm.DB) []*model.FrontPageEntry {
+func GetDiscussionsBefore(folder *model.Folder, beforeDate time.Time, pageSize int, user *model.User, repo repository.Repository) ([]*model.FrontPageEntry, error) {
 
-	userId := 0
+	var userId uint
 	if user != nil {
-		userId = int(user.Id)
+		userId = user.Id
 	}
 
-	discussions := make([]*model.FrontPageEntry, 0)
-	if result := db.Raw("call get_folder_discussions_before(?, ?, ?, ?)", folder.Id, userId, beforeDate, pageSize).Scan(&discussions); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	discussions, err := repo.Discussions().GetFolderDiscussionsBefore(folder.Id, userId, beforeDate, pageSize)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
 	utils.FormatFrontPageEntries(discussions)
 
-	return discussions
+	return discussions, nil
 
 }
 
-func validateDiscussion(folder *model.Folder, discussion *model.Discussion, db *gorm.DB) {
+func validateDiscussion(folder *model.Folder, discussion *model.Discussion, repo repository.Repository) error {
 
 	discussion.Title = html.EscapeString(discussion.Title)
 	discussion.Header = html.EscapeString(discussion.Header)
 
+	var fields []utils.FieldError
+
 	if len(discussion.Title) > 128 {
-		utils.PanicWithWrapper(errors.New("Title too long"), utils.ErrBadRequest)
+		fields = append(fields, utils.FieldError{Field: "title", Message: "Title too long"})
 	}
 
 	if len(discussion.Header) > 1024 {
-		utils.PanicWithWrapper(errors.New("Header too long"), utils.ErrBadRequest)
+		fields = append(fields, utils.FieldError{Field: "header", Message: "Header too long"})
 	}
 
-	var duplicateDiscussion model.Discussion
-	if result := db.Raw("call find_discussion_by_title(?, ?)", folder.Id, discussion.Title).First(&duplicateDiscussion); result.Error != nil {
-		if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
-		}
+	duplicateDiscussion, err := repo.Discussions().FindByTitle(folder.Id, discussion.Title)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		return utils.InternalError(err)
 	}
 
-	if duplicateDiscussion.Id != 0 && duplicateDiscussion.Id != discussion.Id {
-		utils.PanicWithWrapper(errors.New("A discussion with that title already exists"), utils.ErrBadRequest)
+	if duplicateDiscussion != nil && duplicateDiscussion.Id != discussion.Id {
+		fields = append(fields, utils.FieldError{Field: "title", Message: "A discussion with that title already exists"})
 	}
 
+	if len(fields) > 0 {
+		return utils.NewValidationError(fields...)
+	}
+
+	return nil
+
 }
 
-func CreateDiscussion(folder *model.Folder, discussion *model.Discussion, user *model.User, userCache *UserCache, discussionCache *DiscussionCache, db *gorm.DB) *model.Discussion {
+func CreateDiscussion(folder *model.Folder, discussion *model.Discussion, user *model.User, userCache *UserCache, discussionCache *DiscussionCache, duplicateDetector *DuplicateDiscussionDetector, repo repository.Repository) (*model.Discussion, error) {
 
 	if user.IsPremoderate || user.AccountExpired || user.AccountLocked || !user.Enabled {
-		panic(utils.ErrForbidden)
+		return nil, accountForbidden()
+	}
+
+	if folder.IsArchived {
+		return nil, folderArchived()
 	}
 
-	validateDiscussion(folder, discussion, db)
+	if err := validateDiscussion(folder, discussion, repo); err != nil {
+		return nil, err
+	}
+
+	if err := duplicateDetector.check(folder, discussion, repo); err != nil {
+		return nil, err
+	}
 
-	lockedParam := 0
-	if BannedWords().CheckForBannedWords(discussion.Title) || BannedWords().CheckForBannedWords(discussion.Header) {
-		lockedParam = 1
+	locked, err := checkDiscussionForBannedWords(folder, discussion)
+	if err != nil {
+		return nil, err
 	}
 
-	var created model.Discussion
-	if result := db.Raw("call create_discussion(?, ?, ?, ?, ?)", folder.Id, discussion.Title, discussion.Header, user.Id, lockedParam).First(&created); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	created, err := repo.Discussions().Create(folder.Id, discussion.Title, discussion.Header, user.Id, locked)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	created.HeaderMarkup = PostFormatter().ApplyPostFormatting(created.Header, &created)
-	created.Url = utils.UrlForDiscussion(folder, &created)
+	created.HeaderMarkup = PostFormatter().ApplyPostFormatting(created.Header, created)
+	created.Url = utils.UrlForDiscussion(folder, created)
 
 	if discussion.IsSubscribed {
-		SetDiscussionSubscriptionStatus(&created, user, db, userCache)
+		if err := SetDiscussionSubscriptionStatus(created, user, repo, userCache); err != nil {
+			return nil, err
+		}
 	}
 
-	discussionCache.Put(&created)
+	if err := discussionCache.Put(created); err != nil {
+		return nil, err
+	}
 
-	return &created
+	return created, nil
 
 }
 
-func EditDiscussion(folder *model.Folder, discussion *model.Discussion, user *model.User, discussionCache *DiscussionCache, db *gorm.DB) *model.Discussion {
+func EditDiscussion(folder *model.Folder, discussion *model.Discussion, user *model.User, discussionCache *DiscussionCache, repo repository.Repository) (*model.Discussion, error) {
 
 	if user.IsPremoderate || user.AccountExpired || user.AccountLocked || !user.Enabled {
-		panic(utils.ErrForbidden)
+		return nil, accountForbidden()
 	}
 
-	validateDiscussion(folder, discussion, db)
+	if folder.IsArchived {
+		return nil, folderArchived()
+	}
+
+	if err := validateDiscussion(folder, discussion, repo); err != nil {
+		return nil, err
+	}
 
-	lockedParam := 0
-	if BannedWords().CheckForBannedWords(discussion.Title) || BannedWords().CheckForBannedWords(discussion.Header) {
-		lockedParam = 1
+	locked, err := checkDiscussionForBannedWords(folder, discussion)
+	if err != nil {
+		return nil, err
 	}
 
-	var edited model.Discussion
-	if result := db.Raw("call edit_discussion(?, ?, ?, ?, ?, ?)", folder.Id, discussion.Id, discussion.Title, discussion.Header, user.Id, lockedParam).Scan(&edited); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	edited, err := repo.Discussions().Edit(folder.Id, discussion.Id, discussion.Title, discussion.Header, user.Id, locked)
+	if err != nil {
+		return nil, discussionError(err)
 	}
 
-	edited.HeaderMarkup = PostFormatter().ApplyPostFormatting(edited.Header, &edited)
+	edited.HeaderMarkup = PostFormatter().ApplyPostFormatting(edited.Header, edited)
 	edited.Url = utils.UrlForDiscussion(folder, discussion)
 
-	discussionCache.Put(&edited)
+	if err := discussionCache.Put(edited); err != nil {
+		return nil, err
+	}
 
-	return &edited
+	return edited, nil
 
 }
 
-func DeleteDiscussion(folder *model.Folder, discussion *model.Discussion, user *model.User, db *gorm.DB) *model.Discussion {
+func DeleteDiscussion(folder *model.Folder, discussion *model.Discussion, user *model.User, repo repository.Repository) (*model.Discussion, error) {
 
 	if discussion.FolderId != folder.Id {
-		panic(utils.ErrBadRequest)
+		return nil, utils.NewError(utils.ErrBadRequest, utils.ErrorCodeBadRequest, "Discussion is not in this folder")
 	}
 
 	if !(discussion.CreatedByUserId == user.Id) {
-		panic(utils.ErrForbidden)
+		return nil, utils.NewError(utils.ErrForbidden, utils.ErrorCodeForbidden, "Only the creator can delete a discussion")
 	}
 
-	var deleted model.Discussion
-	if result := db.Raw("call delete_discussion(?, ?)", discussion.Id, model.DiscussionStatusDeletedByUser).Take(&deleted); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	deleted, err := repo.Discussions().SetStatus(discussion.Id, model.DiscussionStatusDeletedByUser)
+	if err != nil {
+		return nil, discussionError(err)
 	}
 
-	return &deleted
+	return deleted, nil
 
 }
 
-func GetPosts(folder *model.Folder, discussion *model.Discussion, user *model.User, pageStart int64, pageSize int, db *gorm.DB) []*model.Post {
-
-	posts := make([]*model.Post, 0)
+func GetPosts(folder *model.Folder, discussion *model.Discussion, user *model.User, pageStart int64, pageSize int, repo repository.Repository) ([]*model.Post, error) {
 
-	userId := 0
+	var userId uint
 	if user != nil {
-		userId = int(user.Id)
+		userId = user.Id
 	}
 
-	if result := db.Raw("call get_discussion_posts(?, ?, ?, ?, ?)", userId, folder.Id, discussion.Id, pageStart, pageSize).Scan(&posts); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	posts, err := repo.Posts().GetPosts(userId, folder.Id, discussion.Id, pageStart, pageSize)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
 	for _, post := range posts {
@@ -224,103 +304,196 @@ func GetPosts(folder *model.Folder, discussion *model.Discussion, user *model.Us
 		}
 	}
 
-	return posts
+	return posts, nil
 
 }
 
-func CreatePost(folder *model.Folder, discussion *model.Discussion, user *model.User, post *model.Post, discussionCache *DiscussionCache, userCache *UserCache, db *gorm.DB) *model.Post {
+func CreatePost(folder *model.Folder, discussion *model.Discussion, user *model.User, post *model.Post, discussionCache *DiscussionCache, userCache *UserCache, repo repository.Repository) (*model.Post, error) {
 
 	if user.AccountExpired || user.AccountLocked || !user.Enabled {
-		panic(utils.ErrForbidden)
+		return nil, accountForbidden()
+	}
+
+	if folder.IsArchived {
+		return nil, folderArchived()
 	}
 
 	if discussion.IsBlocked {
-		panic(utils.ErrForbidden)
+		return nil, utils.NewError(utils.ErrForbidden, utils.ErrorCodeDiscussionBlocked, "You have been blocked from this discussion")
 	}
 
 	if post.PostAsAdmin && !user.IsAdmin {
-		panic(utils.ErrForbidden)
+		return nil, utils.NewError(utils.ErrForbidden, utils.ErrorCodeForbidden, "Only admins can post as admin")
 	}
 
+	var check *BannedWordsCheck
 	status := model.PostStatusOK
 	if post.PostAsAdmin && user.IsAdmin {
 		status = model.PostStatusPostedByAdmin
-	} else if user.IsPremoderate || discussion.IsPremoderate {
-		status = model.PostStatusSuspendedByAdmin
-	} else if user.IsWatch {
-		status = model.PostStatusWatch
-	} else if BannedWords().CheckForBannedWords(post.Text) {
-		status = model.PostStatusSuspendedByAdmin
+	} else {
+
+		check = BannedWords().Check(post.Text, folder.Id)
+		if check.Action == model.BannedWordActionReject {
+			return nil, bannedWordRejected("text", check)
+		}
+		post.Text = check.Text
+
+		if user.IsPremoderate || discussion.IsPremoderate || check.Action == model.BannedWordActionHold {
+			status = model.PostStatusSuspendedByAdmin
+		} else if user.IsWatch || check.Action == model.BannedWordActionWatch {
+			status = model.PostStatusWatch
+		}
+
 	}
 
 	post.Text = html.EscapeString(post.Text)
 
-	var created model.Post
-	if result := db.Raw("call create_discussion_post(?, ?, ?, ?, ?)", folder.Id, discussion.Id, post.Text, status, user.Id).First(&created); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	created, err := repo.Posts().Create(folder.Id, discussion.Id, post.Text, status, user.Id)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
 	if created.Id == 0 {
-		panic(utils.ErrInternalError)
+		return nil, utils.InternalError(errors.New("post was not created"))
 	}
 
-	discussion.LastPostDate = created.CreatedDate
-	discussion.PostCount = created.PostNum
-	discussionCache.Put(discussion)
+	// the post has been made so a failure here is only logged
+	if check != nil && len(check.WordIds) > 0 {
+		if err := repo.Moderation().RecordBannedWordMatches(created.Id, check.WordIds); err != nil {
+			log.Errorf("recording banned words matched by post %d: %v", created.Id, err)
+		}
+	}
+
+	// the new version comes from the database, as other instances may be
+	// posting to the same discussion
+	updated, err := repo.Discussions().Get(discussion.Id)
+	if err != nil {
+		return nil, discussionError(err)
+	}
+
+	discussion.Version = updated.Version
+	discussion.LastPostDate = updated.LastPostDate
+	discussion.LastPostId = updated.LastPostId
+	discussion.PostCount = updated.PostCount
+	if err := discussionCache.Put(discussion); err != nil {
+		return nil, err
+	}
 
 	created.Markup = PostFormatter().ApplyPostFormatting(created.Text, discussion)
-	created.Url = utils.UrlForPost(folder, discussion, &created)
+	created.Url = utils.UrlForPost(folder, discussion, created)
 
 	if post.SubscribeToDiscussion {
-		SetDiscussionSubscriptionStatus(discussion, user, db, userCache)
+		if err := SetDiscussionSubscriptionStatus(discussion, user, repo, userCache); err != nil {
+			return nil, err
+		}
 	}
 
-	return &created
+	return created, nil
 
 }
 
-func EditPost(folder *model.Folder, discussion *model.Discussion, user *model.User, update *model.Post, db *gorm.DB) *model.Post {
-
-	var post model.Post
+func EditPost(folder *model.Folder, discussion *model.Discussion, user *model.User, update *model.Post, repo repository.Repository) (*model.Post, error) {
 
 	if discussion.IsBlocked {
-		panic(utils.ErrForbidden)
+		return nil, utils.NewError(utils.ErrForbidden, utils.ErrorCodeDiscussionBlocked, "You have been blocked from this discussion")
+	}
+
+	existing, err := repo.Posts().Get(update.Id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, utils.ErrNotModified
+		}
+		return nil, utils.InternalError(err)
+	}
+
+	var check *BannedWordsCheck
+	if existing.Status != model.PostStatusPostedByAdmin {
+		check = BannedWords().Check(update.Text, folder.Id)
+		if check.Action == model.BannedWordActionReject {
+			return nil, bannedWordRejected("text", check)
+		}
+		update.Text = check.Text
 	}
 
 	update.Text = html.EscapeString(update.Text)
 
-	if result := db.Raw("call edit_discussion_post(?, ?, ?, ?, ?)", folder.Id, discussion.Id, update.Id, update.Text, user.Id).Scan(&post); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	post, err := repo.Posts().Edit(folder.Id, discussion.Id, update.Id, update.Text, user.Id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, utils.ErrNotModified
+		}
+		return nil, utils.InternalError(err)
 	}
 
-	if post.Id == 0 {
-		panic(utils.ErrNotModified)
+	if check != nil && len(check.WordIds) > 0 {
+		if post, err = moderateEditedPost(discussion, post, check, repo); err != nil {
+			return nil, err
+		}
 	}
 
 	post.Markup = PostFormatter().ApplyPostFormatting(post.Text, discussion)
-	post.Url = utils.UrlForPost(folder, discussion, &post)
+	post.Url = utils.UrlForPost(folder, discussion, post)
 
-	return &post
+	return post, nil
 
 }
 
-func DeletePost(folder *model.Folder, discussion *model.Discussion, user *model.User, postId uint, db *gorm.DB) *model.Post {
+// moderateEditedPost records the banned words matched by an edit and puts a
+// post which now matches hold or watch words back in front of the moderators
+func moderateEditedPost(discussion *model.Discussion, post *model.Post, check *BannedWordsCheck, repo repository.Repository) (*model.Post, error) {
 
-	var post model.Post
-	if result := db.Raw("call get_post(?)", postId).First(&post); result.Error != nil {
-		panic(utils.ErrBadRequest)
+	// the edit has been saved so a failure here is only logged
+	if err := repo.Moderation().RecordBannedWordMatches(post.Id, check.WordIds); err != nil {
+		log.Errorf("recording banned words matched by post %d: %v", post.Id, err)
 	}
 
-	if !(user.Id == post.CreatedByUserId || user.IsAdmin) {
-		panic(utils.ErrForbidden)
+	status := post.Status
+	switch check.Action {
+	case model.BannedWordActionHold:
+		if post.Status == model.PostStatusOK || post.Status == model.PostStatusWatch {
+			status = model.PostStatusSuspendedByAdmin
+		}
+	case model.BannedWordActionWatch:
+		if post.Status == model.PostStatusOK {
+			status = model.PostStatusWatch
+		}
+	}
+
+	if status == post.Status {
+		return post, nil
+	}
+
+	updated, err := repo.Posts().SetStatus(discussion.Id, post.Id, status, post.ModerationResult)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	if result := db.Raw("call delete_discussion_post(?, ?, ?, ?)", folder.Id, discussion.Id, postId, user.Id).First(&post); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	reason := truncateString(fmt.Sprintf("Edit matched banned words %v (%s)", check.WordIds, check.Action), maxModerationReasonLength)
+	if _, err := repo.Moderation().QueueForReview(post.Id, reason); err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	if post.Id == 0 {
-		panic(utils.ErrNotModified)
+	return updated, nil
+
+}
+
+func DeletePost(folder *model.Folder, discussion *model.Discussion, user *model.User, postId uint, repo repository.Repository) (*model.Post, error) {
+
+	post, err := repo.Posts().Get(postId)
+	if err != nil {
+		return nil, postError(err)
+	}
+
+	if !(user.Id == post.CreatedByUserId || user.IsAdmin) {
+		return nil, utils.NewError(utils.ErrForbidden, utils.ErrorCodeForbidden, "You can only delete your own posts")
+	}
+
+	post, err = repo.Posts().Delete(folder.Id, discussion.Id, postId, user.Id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, utils.ErrNotModified
+		}
+		return nil, utils.InternalError(err)
 	}
 
 	if user.IsAdmin {
@@ -330,16 +503,16 @@ func DeletePost(folder *model.Folder, discussion *model.Discussion, user *model.
 		post.Markup = ""
 	}
 
-	post.Url = utils.UrlForPost(folder, discussion, &post)
+	post.Url = utils.UrlForPost(folder, discussion, post)
 
-	return &post
+	return post, nil
 
 }
 
-func GetPost(postId uint, db *gorm.DB) (*model.Post, error) {
-	var post model.Post
-	if result := db.Raw("call get_post(?)", postId).First(&post); result.Error != nil {
-		return nil, fmt.Errorf("fetching post: %w", result.Error)
+func GetPost(postId uint, repo repository.Repository) (*model.Post, error) {
+	post, err := repo.Posts().Get(postId)
+	if err != nil {
+		return nil, postError(err)
 	}
-	return &post, nil
+	return post, nil
 }
@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"justthetalk/connections"
 	"justthetalk/model"
+	"justthetalk/repository"
+	"justthetalk/repository/storedproc"
 	"justthetalk/utils"
 	"strings"
 	"testing"
@@ -26,60 +28,75 @@ import (
 
 	"errors"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gorm.io/gorm"
 )
 
 func TestResubscribingToAFolderSubscriptionExceptionRemovesTheException(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestLoggingInWritesToLoginHistory(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestPostedOnDiscussionCannotBeDeleted(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestPostedOnDiscussionCannotBeEdited(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestNormalUserCannotGetAdminFolders(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestNormalUserCannotGetAdminFolderPosts(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestNormalUserCannotPostAdminFolders(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestSubscribeToDiscussion(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestSubscribeToFolder(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestEditPostsAddsRowToPostEdits(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestGetDiscussion(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestGetDiscussions(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestGetFolders(t *testing.T) {
 
-	folderCache := NewFolderCache()
+	_, folderCache, _ := newTestCaches(t)
+
 	folders := folderCache.Entries()
 	if len(folders) == 0 {
 		t.Fail()
@@ -89,21 +106,20 @@ func TestGetFolders(t *testing.T) {
 
 func TestCreateDiscussion(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
-	user := userCache.Get(5540)
-	folder := folderCache.Get(26, user)
+	user := getTestUser(t, userCache, 5540)
+	folder := getTestFolder(t, folderCache, 26, user)
 
-	connections.WithDatabase(10*time.Second, func(db *gorm.DB) {
+	testProvider.WithRepository(10*time.Second, func(repo repository.Repository) {
 
 		discussionSpec := model.Discussion{
 			Title:  fmt.Sprintf("New & <script>alert('hello')</script>discussion: %s", time.Now().Format("02/01/2006 15:04:05")),
 			Header: "This is an test discussion & <script>alert('hello')</script>",
 		}
 
-		discussion := CreateDiscussion(folder, &discussionSpec, user, userCache, discussionCache, db)
+		discussion, err := CreateDiscussion(folder, &discussionSpec, user, userCache, discussionCache, nil, repo)
+		require.NoError(t, err)
 		if discussion.Id == 0 {
 			t.Error("Failed to create discussion")
 		}
@@ -130,28 +146,28 @@ func TestCreateDiscussion(t *testing.T) {
 
 func TestEditDiscussion(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
-	user := userCache.Get(5540)
-	folder := folderCache.Get(26, user)
+	user := getTestUser(t, userCache, 5540)
+	folder := getTestFolder(t, folderCache, 26, user)
 
-	connections.WithDatabase(10*time.Second, func(db *gorm.DB) {
+	testProvider.WithRepository(10*time.Second, func(repo repository.Repository) {
 
 		discussionSpec := model.Discussion{
 			Title:  fmt.Sprintf("New & <script>alert('hello')</script>discussion: %s", time.Now().Format("02/01/2006 15:04:05")),
 			Header: "This is an test discussion & <script>alert('hello')</script>",
 		}
 
-		discussion := CreateDiscussion(folder, &discussionSpec, user, userCache, discussionCache, db)
+		discussion, err := CreateDiscussion(folder, &discussionSpec, user, userCache, discussionCache, nil, repo)
+		require.NoError(t, err)
 		if discussion.Id == 0 {
 			t.Error("Failed to create discussion")
 		}
 
 		discussion.Title += ":Edited"
 		discussion.Header += ":Edited"
-		updated := EditDiscussion(folder, discussion, user, discussionCache, db)
+		updated, err := EditDiscussion(folder, discussion, user, discussionCache, repo)
+		require.NoError(t, err)
 
 		if !strings.HasSuffix(updated.Title, ":Edited") {
 			t.Error("Edit Failed")
@@ -165,24 +181,24 @@ func TestEditDiscussion(t *testing.T) {
 }
 
 func TestDeleteDiscussion(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestCreatePostAdminByAdminUser(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
-	user := userCache.Get(50)
-	folder := folderCache.Get(33, user)
-	discussion := discussionCache.Get(13506, user)
+	user := getTestUser(t, userCache, 50)
+	folder := getTestFolder(t, folderCache, 33, user)
+	discussion := getTestDiscussion(t, discussionCache, 13506, user)
 
-	connections.WithDatabase(10*time.Second, func(db *gorm.DB) {
+	testProvider.WithRepository(10*time.Second, func(repo repository.Repository) {
 		postSpec := model.Post{
 			Text: "This is an admin post",
 		}
-		post := CreatePost(folder, discussion, user, &postSpec, discussionCache, userCache, db)
+		post, err := CreatePost(folder, discussion, user, &postSpec, discussionCache, userCache, repo)
+		require.NoError(t, err)
 		if post.Id == 0 {
 			t.Error("Failed to create post")
 		}
@@ -192,19 +208,18 @@ func TestCreatePostAdminByAdminUser(t *testing.T) {
 
 func TestCreatePostByNonAdminUser(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
-	user := userCache.Get(5540)
-	folder := folderCache.Get(26, user)
-	discussion := discussionCache.Get(130, user)
+	user := getTestUser(t, userCache, 5540)
+	folder := getTestFolder(t, folderCache, 26, user)
+	discussion := getTestDiscussion(t, discussionCache, 130, user)
 
-	connections.WithDatabase(10*time.Second, func(db *gorm.DB) {
+	testProvider.WithRepository(10*time.Second, func(repo repository.Repository) {
 		postSpec := model.Post{
 			Text: "This is an test post <script>alert('hello')</script>",
 		}
-		post := CreatePost(folder, discussion, user, &postSpec, discussionCache, userCache, db)
+		post, err := CreatePost(folder, discussion, user, &postSpec, discussionCache, userCache, repo)
+		require.NoError(t, err)
 		if post.Id == 0 {
 			t.Error("Failed to create post")
 		}
@@ -218,20 +233,21 @@ func TestCreatePostByNonAdminUser(t *testing.T) {
 
 func TestEditPost(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
-	user := userCache.Get(5540)
-	folder := folderCache.Get(26, user)
-	discussion := discussionCache.Get(130, user)
+	user := getTestUser(t, userCache, 5540)
+	folder := getTestFolder(t, folderCache, 26, user)
+	discussion := getTestDiscussion(t, discussionCache, 130, user)
 
 	connections.WithDatabase(60*time.Second, func(db *gorm.DB) {
 
+		repo := storedproc.New(db)
+
 		postSpec := model.Post{
 			Text: "This is an test post",
 		}
-		post := CreatePost(folder, discussion, user, &postSpec, discussionCache, userCache, db)
+		post, err := CreatePost(folder, discussion, user, &postSpec, discussionCache, userCache, repo)
+		require.NoError(t, err)
 		if post.Id == 0 {
 			t.Error("Failed to create post")
 		}
@@ -242,7 +258,8 @@ func TestEditPost(t *testing.T) {
 			ModelBase: model.ModelBase{Id: post.Id},
 			Text:      "This is an edited test post",
 		}
-		updated := EditPost(folder, discussion, user, &updateSpec, db)
+		updated, err := EditPost(folder, discussion, user, &updateSpec, repo)
+		require.NoError(t, err)
 
 		if updated.Id != post.Id {
 			t.Error("Wrong post returned")
@@ -264,25 +281,25 @@ func TestEditPost(t *testing.T) {
 
 func TestDeletePost(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
-	user := userCache.Get(5540)
-	folder := folderCache.Get(26, user)
-	discussion := discussionCache.Get(130, user)
+	user := getTestUser(t, userCache, 5540)
+	folder := getTestFolder(t, folderCache, 26, user)
+	discussion := getTestDiscussion(t, discussionCache, 130, user)
 
-	connections.WithDatabase(10*time.Second, func(db *gorm.DB) {
+	testProvider.WithRepository(10*time.Second, func(repo repository.Repository) {
 		postSpec := model.Post{
 			Text: "This is an test post",
 		}
-		post := CreatePost(folder, discussion, user, &postSpec, discussionCache, userCache, db)
+		post, err := CreatePost(folder, discussion, user, &postSpec, discussionCache, userCache, repo)
+		require.NoError(t, err)
 		if post.Id == 0 {
 			t.Error("Failed to create post")
 		}
 		t.Logf("PostId: %d", post.Id)
 
-		updated := DeletePost(folder, discussion, user, post.Id, db)
+		updated, err := DeletePost(folder, discussion, user, post.Id, repo)
+		require.NoError(t, err)
 		if !updated.Deleted {
 			t.Error("Post not flagged as deleted")
 		}
@@ -293,121 +310,92 @@ func TestDeletePost(t *testing.T) {
 
 func TestDeletePostFailsForOtherPeople(t *testing.T) {
 
-	defer func() {
-		if r := recover(); r != nil {
-			err := r.(error)
-			switch {
-			case errors.Is(err, utils.ErrForbidden):
-				t.Log("Got forbidden")
-			default:
-				t.Error(err)
-			}
-		}
-	}()
-
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
-	user := userCache.Get(5540)
-	folder := folderCache.Get(1, user)
-	discussion := discussionCache.Get(1, user)
+	user := getTestUser(t, userCache, 5540)
 
-	connections.WithDatabase(10*time.Second, func(db *gorm.DB) {
-		post, _ := GetPost(1, db)
-		DeletePost(folder, discussion, user, post.Id, db)
+	err := withFolderAndDiscussion(folderCache, discussionCache, 1, 1, user, func(folder *model.Folder, discussion *model.Discussion, repo repository.Repository) error {
+		post, err := GetPost(1, repo)
+		if err != nil {
+			return err
+		}
+		_, err = DeletePost(folder, discussion, user, post.Id, repo)
+		return err
 	})
 
-	t.Error("Should have panicked")
+	assert.True(t, errors.Is(err, utils.ErrForbidden), "expected forbidden, got %v", err)
 
 }
 
 func TestLockedAccountCannotPost(t *testing.T) {
 
-	defer func() {
-		if r := recover(); r != nil {
-			err := r.(error)
-			switch {
-			case errors.Is(err, utils.ErrForbidden):
-				t.Log("Got forbidden")
-			default:
-				t.Error(err)
-			}
-		}
-	}()
-
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
-	user := userCache.Get(730)
-	folder := folderCache.Get(26, user)
-	discussion := discussionCache.Get(130, user)
+	user := getTestUser(t, userCache, 730)
 
-	connections.WithDatabase(10*time.Second, func(db *gorm.DB) {
+	err := withFolderAndDiscussion(folderCache, discussionCache, 26, 130, user, func(folder *model.Folder, discussion *model.Discussion, repo repository.Repository) error {
 		postSpec := model.Post{
 			Text: "This is an test post",
 		}
-		post := CreatePost(folder, discussion, user, &postSpec, discussionCache, userCache, db)
-		if post.Id == 0 {
-			t.Error("Failed to create post")
-		}
-		t.Logf("PostId: %d", post.Id)
+		_, err := CreatePost(folder, discussion, user, &postSpec, discussionCache, userCache, repo)
+		return err
 	})
 
-	t.Error("Should have panicked")
+	assert.True(t, errors.Is(err, utils.ErrForbidden), "expected forbidden, got %v", err)
 
 }
 
 func TestLockedDiscussionCannotPost(t *testing.T) {
 
-	defer func() {
-		if r := recover(); r != nil {
-			err := r.(error)
-			switch {
-			case errors.Is(err, utils.ErrForbidden):
-				t.Log("Got forbidden")
-			default:
-				t.Error(err)
-			}
-		}
-	}()
-
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
-	user := userCache.Get(730)
-	folder := folderCache.Get(16, user)
-	discussion := discussionCache.Get(479, user)
+	user := getTestUser(t, userCache, 730)
 
-	connections.WithDatabase(10*time.Second, func(db *gorm.DB) {
+	err := withFolderAndDiscussion(folderCache, discussionCache, 16, 479, user, func(folder *model.Folder, discussion *model.Discussion, repo repository.Repository) error {
 		postSpec := model.Post{
 			Text: "This is an test post",
 		}
-		post := CreatePost(folder, discussion, user, &postSpec, discussionCache, userCache, db)
-		if post.Id == 0 {
-			t.Error("Failed to create post")
-		}
-		t.Logf("PostId: %d", post.Id)
+		_, err := CreatePost(folder, discussion, user, &postSpec, discussionCache, userCache, repo)
+		return err
+	})
+
+	assert.True(t, errors.Is(err, utils.ErrForbidden), "expected forbidden, got %v", err)
+
+}
+
+// withFolderAndDiscussion runs fn against the given folder and discussion and returns
+// the first error hit along the way, so callers can assert on access failures
+func withFolderAndDiscussion(folderCache *FolderCache, discussionCache *DiscussionCache, folderId uint, discussionId uint, user *model.User, fn func(folder *model.Folder, discussion *model.Discussion, repo repository.Repository) error) error {
+
+	folder, err := folderCache.Get(folderId, user)
+	if err != nil {
+		return err
+	}
+
+	discussion, err := discussionCache.Get(discussionId, user)
+	if err != nil {
+		return err
+	}
+
+	testProvider.WithRepository(10*time.Second, func(repo repository.Repository) {
+		err = fn(folder, discussion, repo)
 	})
 
-	t.Error("Should have panicked")
+	return err
 
 }
 
 func TestGetPosts(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
-	user := userCache.Get(5540)
-	folder := folderCache.Get(26, user)
-	discussion := discussionCache.Get(130, user)
+	user := getTestUser(t, userCache, 5540)
+	folder := getTestFolder(t, folderCache, 26, user)
+	discussion := getTestDiscussion(t, discussionCache, 130, user)
 
-	connections.WithDatabase(10*time.Second, func(db *gorm.DB) {
-		posts := GetPosts(folder, discussion, user, 1, 20, db)
+	testProvider.WithRepository(10*time.Second, func(repo repository.Repository) {
+		posts, err := GetPosts(folder, discussion, user, 1, 20, repo)
+		require.NoError(t, err)
 		if len(posts) != 20 {
 			t.Errorf("Not enough posts, got: %d", len(posts))
 		}
@@ -16,132 +16,88 @@
 package businesslogic
 
 import (
+	"fmt"
 	"justthetalk/model"
+	"justthetalk/repository"
 	"justthetalk/utils"
 	"time"
-
-	"gorm.io/gorm"
 )
 
-func GetFrontPage(user *model.User, viewType string, pageSize int, pageStart int, userCache *UserCache, discussionCache *DiscussionCache, db *gorm.DB) []*model.FrontPageEntry {
+func frontPageView(user *model.User, viewType string) (repository.FrontPageView, uint, bool, error) {
 
-	userId := 0
-	isAdmin := 0
+	var userId uint
+	isAdmin := false
 
 	if user != nil {
-		userId = int(user.Id)
-		if user.IsAdmin {
-			isAdmin = 1
-		}
+		userId = user.Id
+		isAdmin = user.IsAdmin
 	}
 
-	if userId == 0 && (viewType == "subs" || viewType == "startedbyme") {
-		panic(utils.ErrForbidden)
+	view := repository.FrontPageView(viewType)
+	switch view {
+	case repository.FrontPageViewLatest, repository.FrontPageViewMostActive:
+	case repository.FrontPageViewSubscriptions, repository.FrontPageViewStartedByMe:
+		if userId == 0 {
+			return view, 0, false, utils.NewError(utils.ErrForbidden, utils.ErrorCodeForbidden, "You must be logged in to see this view")
+		}
+	default:
+		return view, 0, false, utils.NewError(utils.ErrBadRequest, utils.ErrorCodeUnknownView, "Unknown front page view").WithField("viewType", fmt.Sprintf("unknown value %q", viewType))
 	}
 
-	discussions := []*model.FrontPageEntry{}
-	var result *gorm.DB
-	switch viewType {
-	case "latest":
-		result = db.Raw("call get_frontpage_latest(?, ?, ?, ?)", userId, isAdmin, pageStart, pageSize).Scan(&discussions)
-	case "mostactive":
-		result = db.Raw("call get_frontpage_mostactive(?, ?, ?, ?)", userId, isAdmin, pageStart, pageSize).Scan(&discussions)
-	case "subs":
-		result = db.Raw("call get_frontpage_subscriptions(?, ?, ?, ?)", userId, isAdmin, pageStart, pageSize).Scan(&discussions)
-	case "startedbyme":
-		result = db.Raw("call get_frontpage_startedbyme(?, ?, ?, ?)", userId, isAdmin, pageStart, pageSize).Scan(&discussions)
-	default:
-		panic(utils.ErrBadRequest)
+	return view, userId, isAdmin, nil
+
+}
+
+func GetFrontPage(user *model.User, viewType string, pageSize int, pageStart int, userCache *UserCache, discussionCache *DiscussionCache, repo repository.Repository) ([]*model.FrontPageEntry, error) {
+
+	view, userId, isAdmin, err := frontPageView(user, viewType)
+	if err != nil {
+		return nil, err
 	}
 
-	if result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	discussions, err := repo.Discussions().GetFrontPage(view, userId, isAdmin, pageStart, pageSize)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
 	utils.FormatFrontPageEntries(discussions)
 
-	return discussions
+	return discussions, nil
 
 }
 
-func GetFrontPageSince(user *model.User, viewType string, pageSize int, sinceDate time.Time, userCache *UserCache, discussionCache *DiscussionCache, db *gorm.DB) []*model.FrontPageEntry {
-
-	userId := 0
-	isAdmin := 0
+func GetFrontPageSince(user *model.User, viewType string, pageSize int, sinceDate time.Time, userCache *UserCache, discussionCache *DiscussionCache, repo repository.Repository) ([]*model.FrontPageEntry, error) {
 
-	if user != nil {
-		userId = int(user.Id)
-		if user.IsAdmin {
-			isAdmin = 1
-		}
+	view, userId, isAdmin, err := frontPageView(user, viewType)
+	if err != nil {
+		return nil, err
 	}
 
-	if userId == 0 && (viewType == "subs" || viewType == "startedbyme") {
-		panic(utils.ErrForbidden)
-	}
-
-	discussions := []*model.FrontPageEntry{}
-	var result *gorm.DB
-	switch viewType {
-	case "latest":
-		result = db.Raw("call get_frontpage_latest_since(?, ?, ?, ?)", userId, isAdmin, sinceDate, pageSize).Scan(&discussions)
-	case "mostactive":
-		result = db.Raw("call get_frontpage_mostactive_since(?, ?, ?, ?)", userId, isAdmin, sinceDate, pageSize).Scan(&discussions)
-	case "subs":
-		result = db.Raw("call get_frontpage_subscriptions_since(?, ?, ?, ?)", userId, isAdmin, sinceDate, pageSize).Scan(&discussions)
-	case "startedbyme":
-		result = db.Raw("call get_frontpage_startedbyme_since(?, ?, ?, ?)", userId, isAdmin, sinceDate, pageSize).Scan(&discussions)
-	default:
-		panic(utils.ErrBadRequest)
-	}
-
-	if result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	discussions, err := repo.Discussions().GetFrontPageSince(view, userId, isAdmin, sinceDate, pageSize)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
 	utils.FormatFrontPageEntries(discussions)
 
-	return discussions
+	return discussions, nil
 
 }
 
-func GetFrontPageBefore(user *model.User, viewType string, pageSize int, beforeDate time.Time, userCache *UserCache, discussionCache *DiscussionCache, db *gorm.DB) []*model.FrontPageEntry {
-
-	userId := 0
-	isAdmin := 0
-
-	if user != nil {
-		userId = int(user.Id)
-		if user.IsAdmin {
-			isAdmin = 1
-		}
-	}
+func GetFrontPageBefore(user *model.User, viewType string, pageSize int, beforeDate time.Time, userCache *UserCache, discussionCache *DiscussionCache, repo repository.Repository) ([]*model.FrontPageEntry, error) {
 
-	if userId == 0 && (viewType == "subs" || viewType == "startedbyme") {
-		panic(utils.ErrForbidden)
-	}
-
-	discussions := []*model.FrontPageEntry{}
-	var result *gorm.DB
-	switch viewType {
-	case "latest":
-		result = db.Raw("call get_frontpage_latest_before(?, ?, ?, ?)", userId, isAdmin, beforeDate, pageSize).Scan(&discussions)
-	case "mostactive":
-		result = db.Raw("call get_frontpage_mostactive_before(?, ?, ?, ?)", userId, isAdmin, beforeDate, pageSize).Scan(&discussions)
-	case "subs":
-		result = db.Raw("call get_frontpage_subscriptions_before(?, ?, ?, ?)", userId, isAdmin, beforeDate, pageSize).Scan(&discussions)
-	case "startedbyme":
-		result = db.Raw("call get_frontpage_startedbyme_before(?, ?, ?, ?)", userId, isAdmin, beforeDate, pageSize).Scan(&discussions)
-	default:
-		panic(utils.ErrBadRequest)
+	view, userId, isAdmin, err := frontPageView(user, viewType)
+	if err != nil {
+		return nil, err
 	}
 
-	if result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	discussions, err := repo.Discussions().GetFrontPageBefore(view, userId, isAdmin, beforeDate, pageSize)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
 	utils.FormatFrontPageEntries(discussions)
 
-	return discussions
+	return discussions, nil
 
 }
@@ -16,38 +16,38 @@
 package businesslogic
 
 import (
-	"justthetalk/connections"
 	"justthetalk/model"
+	"justthetalk/repository"
 
 	"testing"
 	"time"
 
-	"gorm.io/gorm"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetFrontPageLatestAndStartedByMe(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
-	adminUser := userCache.Get(50)
-	normalUser := userCache.Get(5540)
-	folder := folderCache.Get(33, adminUser)
-	discussion := discussionCache.Get(13506, adminUser)
+	adminUser := getTestUser(t, userCache, 50)
+	normalUser := getTestUser(t, userCache, 5540)
+	folder := getTestFolder(t, folderCache, 33, adminUser)
+	discussion := getTestDiscussion(t, discussionCache, 13506, adminUser)
 
-	connections.WithDatabase(60*time.Second, func(db *gorm.DB) {
+	testProvider.WithRepository(60*time.Second, func(repo repository.Repository) {
 
 		postSpec := model.Post{
 			Text: "This is an admin post",
 		}
 
-		post := CreatePost(folder, discussion, adminUser, &postSpec, discussionCache, userCache, db)
+		post, err := CreatePost(folder, discussion, adminUser, &postSpec, discussionCache, userCache, repo)
+		require.NoError(t, err)
 		if post.Id == 0 {
 			t.Error("Failed to create post")
 		}
 
-		posts := GetFrontPage(adminUser, "latest", 20, 0, userCache, discussionCache, db)
+		posts, err := GetFrontPage(adminUser, "latest", 20, 0, userCache, discussionCache, repo)
+		require.NoError(t, err)
 		if len(posts) != 20 {
 			t.Error("Not enough posts for admin user")
 		}
@@ -56,12 +56,14 @@ func TestGetFrontPageLatestAndStartedByMe(t *testing.T) {
 			t.Error("New post not first in latest list")
 		}
 
-		posts = GetFrontPage(adminUser, "startedbyme", 20, 0, userCache, discussionCache, db)
+		posts, err = GetFrontPage(adminUser, "startedbyme", 20, 0, userCache, discussionCache, repo)
+		require.NoError(t, err)
 		if !(posts[0].DiscussionId == discussion.Id && posts[0].LastPostId == post.Id) {
 			t.Error("New post not first in startedbyme list")
 		}
 
-		posts = GetFrontPage(normalUser, "latest", 20, 0, userCache, discussionCache, db)
+		posts, err = GetFrontPage(normalUser, "latest", 20, 0, userCache, discussionCache, repo)
+		require.NoError(t, err)
 		if len(posts) != 20 {
 			t.Error("Not enough posts for normal user")
 		}
@@ -70,7 +72,8 @@ func TestGetFrontPageLatestAndStartedByMe(t *testing.T) {
 			t.Error("New post should not be in list for ordinary user")
 		}
 
-		posts = GetFrontPage(normalUser, "startedbyme", 20, 0, userCache, discussionCache, db)
+		posts, err = GetFrontPage(normalUser, "startedbyme", 20, 0, userCache, discussionCache, repo)
+		require.NoError(t, err)
 		if posts[0].DiscussionId == discussion.Id && posts[0].LastPostId == post.Id {
 			t.Error("New post should not be in started by me list for ordinary user")
 		}
@@ -80,19 +83,19 @@ func TestGetFrontPageLatestAndStartedByMe(t *testing.T) {
 
 func TestGetFrontPageMostActiveSmokeTest(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
-	normalUser := userCache.Get(5540)
+	normalUser := getTestUser(t, userCache, 5540)
 
-	connections.WithDatabase(60*time.Second, func(db *gorm.DB) {
-		posts := GetFrontPage(normalUser, "mostactive", 20, 0, userCache, discussionCache, db)
+	testProvider.WithRepository(60*time.Second, func(repo repository.Repository) {
+		posts, err := GetFrontPage(normalUser, "mostactive", 20, 0, userCache, discussionCache, repo)
+		require.NoError(t, err)
 		if len(posts) != 20 {
 			t.Errorf("Not enough posts for normal user - got %d", len(posts))
 		}
 		for _, p := range posts {
-			folderCache.Get(p.FolderId, normalUser) // will panic if no access
+			_, err := folderCache.Get(p.FolderId, normalUser)
+			require.NoError(t, err)
 		}
 	})
 
@@ -18,33 +18,49 @@ package businesslogic
 import (
 	"bufio"
 	"context"
+	"fmt"
+	"justthetalk/config"
 	"justthetalk/connections"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"justthetalk/repository/storedproc"
+	"justthetalk/search"
+	"justthetalk/search/elastic"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
 )
 
-func TestMain(m *testing.M) {
-
-	dbHost := "localhost"
-	dbPort := "3306"
-	redisHost := "localhost"
-	redisPort := "6379"
-	elasticsearchHosts := []string{"http://localhost:9200"}
-
-	connections.OpenConnections(dbHost, dbPort, redisHost, redisPort, elasticsearchHosts)
+var testProvider repository.Provider
+var testOutboxConfig config.OutboxConfig
+var testSearchEngine search.Engine
 
-	connections.RedisConnection().FlushAll(context.Background())
+// TestMain connects to the MySQL, Redis and Elasticsearch servers named in
+// env.local. Without them the tests which need them are skipped and the
+// ones which run against the memory store still run.
+func TestMain(m *testing.M) {
 
 	if err := os.Chdir("../"); err != nil {
 		log.Fatal(err)
 	}
 
+	if err := openTestConnections(); err != nil {
+		log.Warnf("Skipping the database tests: %v", err)
+	}
+
+	os.Exit(m.Run())
+
+}
+
+func openTestConnections() error {
+
 	file, err := os.Open("./env.local")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer file.Close()
 
@@ -54,6 +70,76 @@ func TestMain(m *testing.M) {
 		os.Setenv(f[0], f[1])
 	}
 
-	os.Exit(m.Run())
+	cfg := config.Default()
+	if err := cfg.ApplyEnvironment(); err != nil {
+		return err
+	}
+
+	if err := connections.OpenConnections(cfg); err != nil {
+		return err
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+
+	if err := connections.RedisConnection().FlushAll(ctx).Err(); err != nil {
+		return err
+	}
+
+	es := connections.ElasticSearchConnection()
+	res, err := es.Ping(es.Ping.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("elasticsearch: %s", res.Status())
+	}
+
+	SetMailConfig(cfg.Mail)
+	testOutboxConfig = cfg.Outbox
+
+	testProvider = storedproc.NewProvider(connections.DatabaseConnection())
+	testSearchEngine = elastic.NewEngine(connections.ElasticSearchConnection(), elastic.DefaultAlias)
+
+	return nil
+
+}
+
+// requireDatabase skips a test which needs the servers from env.local when
+// they aren't available
+func requireDatabase(t *testing.T) {
+	t.Helper()
+	if testProvider == nil {
+		t.Skip("needs the MySQL, Redis and Elasticsearch servers in env.local")
+	}
+}
+
+func newTestCaches(t *testing.T) (*UserCache, *FolderCache, *DiscussionCache) {
+
+	requireDatabase(t)
+
+	folderCache, err := NewFolderCache(testProvider)
+	require.NoError(t, err)
+
+	return NewUserCache(testProvider), folderCache, NewDiscussionCache(config.Default().DiscussionCache, folderCache, testProvider)
+
+}
+
+func getTestUser(t *testing.T, userCache *UserCache, userId uint) *model.User {
+	user, err := userCache.Get(userId)
+	require.NoError(t, err)
+	return user
+}
+
+func getTestFolder(t *testing.T, folderCache *FolderCache, folderId uint, user *model.User) *model.Folder {
+	folder, err := folderCache.Get(folderId, user)
+	require.NoError(t, err)
+	return folder
+}
 
+func getTestDiscussion(t *testing.T, discussionCache *DiscussionCache, discussionId uint, user *model.User) *model.Discussion {
+	discussion, err := discussionCache.Get(discussionId, user)
+	require.NoError(t, err)
+	return discussion
 }
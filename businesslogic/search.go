@@ -16,120 +16,554 @@
 package businesslogic
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"justthetalk/connections"
+	"errors"
+	"fmt"
 	"justthetalk/model"
+	"justthetalk/repository"
+	"justthetalk/search"
 	"justthetalk/utils"
+	"strings"
 	"time"
-
-	log "github.com/sirupsen/logrus"
-	"gorm.io/gorm"
 )
 
-func createSearchHistory(queryString string, user *model.User, ipAddress string, db *gorm.DB) {
+func createSearchHistory(queryString string, resultCount *int, user *model.User, ipAddress string, repo repository.Repository) error {
 
 	history := model.SearchHistory{
 		CreatedDate: time.Now(),
 		UserId:      user.Id,
 		IPAddress:   ipAddress,
 		Query:       queryString,
+		ResultCount: resultCount,
 	}
 
-	if result := db.Table("search_history").Create(&history); result.Error != nil {
-		log.Errorf("%v", result.Error)
-		panic(utils.ErrInternalError)
+	if err := repo.Users().CreateSearchHistory(&history); err != nil {
+		return utils.InternalError(err)
 	}
 
+	return nil
+
 }
 
-func SearchPosts(queryString string, size int, page int, user *model.User, ipAddress string, folderCache *FolderCache, discussionCache *DiscussionCache, db *gorm.DB, ctx context.Context) []*model.SearchResult {
+// maxSearchTopUps is how many more times the engine is asked for hits when
+// some on a page turn out to be stale, for example a post which has been
+// hidden since it was indexed
+const maxSearchTopUps = 3
+
+// SearchPosts runs query against the search engine and returns a page of
+// results. Each result carries the cursor to pass as query.After to fetch the
+// page which follows it.
+//
+// Hidden posts and posts by users the searcher ignores are filtered out by the
+// engine, so a page is only short when the index is behind the database. The
+// gap is then topped up from the hits which follow.
+func SearchPosts(engine search.Engine, query *model.SearchQuery, user *model.User, ipAddress string, folderCache *FolderCache, discussionCache *DiscussionCache, repo repository.Repository, ctx context.Context) ([]*model.SearchResult, error) {
+
+	excludeIgnoredUsers(query, user)
+
+	parsed, err := search.NewQuery(query)
+	if err != nil {
+		return nil, err
+	}
 
-	createSearchHistory(queryString, user, ipAddress, db)
+	hydrator := newSearchHydrator(user, folderCache, discussionCache, repo)
+	results, total, searchErr := fillSearchPage(engine, parsed, hydrator, ctx)
 
-	var buf bytes.Buffer
-	query := map[string]interface{}{
-		"query": map[string]interface{}{
-			"query_string": map[string]interface{}{
-				"query": queryString,
-			},
-		},
-		"size":    size,
-		"from":    page,
-		"fields":  []string{},
-		"_source": false,
-		"sort": []map[string]interface{}{
-			{"date": "desc"},
-		},
+	// failed searches are recorded too, without a result count, so that
+	// nothing is missing from the analytics
+	var resultCount *int
+	if searchErr == nil {
+		resultCount = &total
 	}
 
-	if err := json.NewEncoder(&buf).Encode(query); err != nil {
-		log.Fatalf("Error encoding query: %s", err)
+	if err := createSearchHistory(query.Text, resultCount, user, ipAddress, repo); err != nil {
+		return nil, err
 	}
 
-	// Perform the search request.
-	elastic := connections.ElasticSearchConnection()
-	res, err := elastic.Search(
-		elastic.Search.WithContext(ctx),
-		elastic.Search.WithIndex("posts"),
-		elastic.Search.WithBody(&buf),
-		elastic.Search.WithTrackTotalHits(true),
-		elastic.Search.WithPretty(),
-	)
+	if searchErr != nil {
+		return nil, searchErr
+	}
+
+	for _, result := range results {
+		result.TotalResults = total
+	}
+
+	return results, nil
+
+}
+
+func excludeIgnoredUsers(query *model.SearchQuery, user *model.User) {
+	if user != nil {
+		query.ExcludeUserIds = make([]uint, 0, len(user.IgnoredUsers))
+		for ignoredUserId := range user.IgnoredUsers {
+			query.ExcludeUserIds = append(query.ExcludeUserIds, ignoredUserId)
+		}
+	}
+}
+
+// SearchDiscussion finds posts within a single discussion, newest first, so
+// that the client can jump to them by their post number. The search engine is
+// used when it is available and holds the discussion. Otherwise, for example
+// when the discussion is locked and so not indexed, the posts are matched in
+// the database instead. Cursors from either can be passed to the other.
+func SearchDiscussion(engine search.Engine, searchGuard *SearchGuard, query *model.SearchQuery, folder *model.Folder, discussion *model.Discussion, user *model.User, ipAddress string, folderCache *FolderCache, discussionCache *DiscussionCache, repo repository.Repository, ctx context.Context) ([]*model.SearchResult, error) {
+
+	query.FolderId = 0
+	query.DiscussionId = discussion.Id
+	query.Sort = model.SearchSortDate
+
+	if searchGuard.Err() == nil && isIndexableDiscussion(discussion, folder) {
+		return SearchPosts(engine, query, user, ipAddress, folderCache, discussionCache, repo, ctx)
+	}
+
+	return searchDiscussionText(query, folder, discussion, user, ipAddress, repo)
+
+}
+
+// searchDiscussionText is the database fallback for SearchDiscussion. Words
+// and phrases are matched as plain substrings and there are no highlights.
+func searchDiscussionText(query *model.SearchQuery, folder *model.Folder, discussion *model.Discussion, user *model.User, ipAddress string, repo repository.Repository) ([]*model.SearchResult, error) {
 
+	excludeIgnoredUsers(query, user)
+
+	parsed, err := search.NewQuery(query)
 	if err != nil {
-		log.Fatalf("Error getting response: %s", err)
+		return nil, err
 	}
-	defer res.Body.Close()
 
-	var e map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
-		log.Errorf("Error parsing the response body: %s", err)
-		panic(utils.ErrInternalError)
+	textSearch := repository.PostTextSearch{
+		DiscussionId:   discussion.Id,
+		ExcludeUserIds: parsed.ExcludeUserIds,
+		Limit:          parsed.Size,
 	}
 
-	if res.IsError() {
-		log.Errorf("[%s] %s: %s",
-			res.Status(),
-			e["error"].(map[string]interface{})["type"],
-			e["error"].(map[string]interface{})["reason"],
-		)
-		panic(utils.ErrBadRequest)
+	for _, term := range parsed.Terms {
+		if term.Exclude {
+			textSearch.Exclude = append(textSearch.Exclude, term.Text)
+		} else {
+			textSearch.Include = append(textSearch.Include, term.Text)
+		}
 	}
 
-	hits := e["hits"].(map[string]interface{})
-	total := hits["total"].(map[string]interface{})
-	hitsList := hits["hits"].([]interface{})
+	// post ids increase with the date so the id alone places the cursor
+	if len(parsed.After) > 0 {
+		postId, err := parsed.After[len(parsed.After)-1].(json.Number).Int64()
+		if err != nil || postId < 0 {
+			return nil, utils.NewError(utils.ErrBadRequest, utils.ErrorCodeInvalidParameter, "Invalid request parameter").WithField("after", "is not a valid cursor")
+		}
+		textSearch.BeforePostId = uint(postId)
+	}
 
-	results := make([]*model.SearchResult, 0)
-	for _, hit := range hitsList {
+	posts, total, searchErr := repo.Posts().SearchText(textSearch)
 
-		d := hit.(map[string]interface{})
-		docId := d["_id"].(string)
+	var resultCount *int
+	if searchErr == nil {
+		resultCount = &total
+	}
+
+	if err := createSearchHistory(query.Text, resultCount, user, ipAddress, repo); err != nil {
+		return nil, err
+	}
 
-		var post model.Post
-		if result := db.Raw("call get_post(?)", docId).First(&post); result.Error != nil {
-			log.Errorf("%v", result.Error)
-			panic(utils.ErrInternalError)
+	if searchErr != nil {
+		return nil, utils.InternalError(searchErr)
+	}
+
+	results := make([]*model.SearchResult, 0, len(posts))
+	for _, post := range posts {
+
+		cursor, err := search.EncodeCursor([]interface{}{post.CreatedDate.UnixNano() / int64(time.Millisecond), post.Id})
+		if err != nil {
+			return nil, utils.InternalError(err)
 		}
 
-		if post.Status == 0 {
-			discussion := discussionCache.Get(post.DiscussionId, user)
-			folder := folderCache.Get(discussion.FolderId, user)
-			post.Url = utils.UrlForPost(folder, discussion, &post)
-			post.Markup = PostFormatter().ApplyPostFormatting(post.Text, discussion)
-			result := &model.SearchResult{
-				Post:         &post,
-				Folder:       folder,
-				Discussion:   discussion,
-				TotalResults: int(total["value"].(float64)),
-			}
-			results = append(results, result)
+		post.Url = utils.UrlForPost(folder, discussion, post)
+		post.Markup = PostFormatter().ApplyPostFormatting(post.Text, discussion)
+
+		results = append(results, &model.SearchResult{
+			Post:         post,
+			Folder:       folder,
+			Discussion:   discussion,
+			Cursor:       cursor,
+			TotalResults: total,
+		})
+
+	}
+
+	return results, nil
+
+}
+
+// fillSearchPage fetches a page of results and the total number of them,
+// topping the page up when some of its hits are stale
+func fillSearchPage(engine search.Engine, parsed *search.Query, hydrator *searchHydrator, ctx context.Context) ([]*model.SearchResult, int, error) {
+
+	size := parsed.Size
+	results := make([]*model.SearchResult, 0, size)
+	total := 0
+	for attempt := 0; attempt <= maxSearchTopUps; attempt++ {
+
+		response, err := engine.Query(ctx, parsed)
+		if err != nil {
+			return nil, 0, utils.InternalError(err)
 		}
 
+		if attempt == 0 {
+			total = response.Total
+		}
+
+		page, stale, err := hydrator.hydrate(response.Hits)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		results = append(results, page...)
+		total -= stale
+
+		if stale == 0 || len(response.Hits) < parsed.Size || len(results) >= size {
+			break
+		}
+
+		if parsed.After, err = search.DecodeCursor(response.Hits[len(response.Hits)-1].Cursor, parsed.Sort); err != nil {
+			return nil, 0, utils.InternalError(err)
+		}
+		parsed.Size = size - len(results)
+
 	}
 
-	return results
+	return results, total, nil
+
+}
+
+// searchHydrator turns search hits into results. Posts are loaded in one query
+// per page and each discussion is looked up once however many hits it has.
+type searchHydrator struct {
+	user            *model.User
+	folderCache     *FolderCache
+	discussionCache *DiscussionCache
+	repo            repository.Repository
+	discussions     map[uint]*model.Discussion
+}
+
+func newSearchHydrator(user *model.User, folderCache *FolderCache, discussionCache *DiscussionCache, repo repository.Repository) *searchHydrator {
+	return &searchHydrator{
+		user:            user,
+		folderCache:     folderCache,
+		discussionCache: discussionCache,
+		repo:            repo,
+		discussions:     make(map[uint]*model.Discussion),
+	}
+}
+
+// hydrate returns the results for hits, in the same order, along with the
+// number of hits which were dropped because the searcher can no longer see
+// them
+func (h *searchHydrator) hydrate(hits []search.Hit) ([]*model.SearchResult, int, error) {
+
+	postIds := make([]uint, 0, len(hits))
+	for _, hit := range hits {
+		postIds = append(postIds, hit.PostId)
+	}
+
+	posts, err := h.repo.Posts().GetByIds(postIds)
+	if err != nil {
+		return nil, 0, utils.InternalError(err)
+	}
+
+	byId := make(map[uint]*model.Post, len(posts))
+	for _, post := range posts {
+		byId[post.Id] = post
+	}
+
+	results := make([]*model.SearchResult, 0, len(hits))
+	stale := 0
+	for _, hit := range hits {
+
+		post, exists := byId[hit.PostId]
+		if !exists || !h.isVisible(post) {
+			stale++
+			continue
+		}
+
+		discussion, err := h.discussion(post.DiscussionId)
+		if err != nil {
+			return nil, 0, err
+		} else if discussion == nil {
+			stale++
+			continue
+		}
+
+		folder := h.folderCache.UnsafeGet(discussion.FolderId)
+
+		post.Url = utils.UrlForPost(folder, discussion, post)
+		post.Markup = PostFormatter().ApplyPostFormatting(post.Text, discussion)
+
+		results = append(results, &model.SearchResult{
+			Post:       post,
+			Folder:     folder,
+			Discussion: discussion,
+			Highlights: hit.Highlights,
+			Cursor:     hit.Cursor,
+		})
+
+	}
+
+	return results, stale, nil
+
+}
+
+func (h *searchHydrator) isVisible(post *model.Post) bool {
+
+	if !search.IsVisiblePostStatus(post.Status) {
+		return false
+	}
+
+	if h.user != nil {
+		if _, ignored := h.user.IgnoredUsers[post.CreatedByUserId]; ignored {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+// discussion returns the discussion if the searcher may see it, or nil if it
+// has been hidden or removed
+func (h *searchHydrator) discussion(discussionId uint) (*model.Discussion, error) {
+
+	if discussion, exists := h.discussions[discussionId]; exists {
+		return discussion, nil
+	}
+
+	discussion, err := h.discussionCache.Get(discussionId, h.user)
+	if errors.Is(err, utils.ErrForbidden) || errors.Is(err, utils.ErrNotFound) {
+		discussion = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	h.discussions[discussionId] = discussion
+
+	return discussion, nil
+
+}
+
+const (
+	defaultSearchHistoryPageSize = 50
+	maxSearchHistoryPageSize     = 200
+
+	defaultSearchAnalyticsDays  = 30
+	maxSearchAnalyticsDays      = 366
+	defaultSearchAnalyticsLimit = 50
+	maxSearchAnalyticsLimit     = 500
+)
+
+// GetSearchHistory returns a page of the user's own searches, newest first
+func GetSearchHistory(user *model.User, pageStart int, pageSize int, repo repository.Repository) ([]*model.SearchHistory, error) {
+
+	if pageStart < 0 {
+		return nil, utils.NewValidationError(utils.FieldError{Field: "start", Message: "must not be negative"})
+	}
+
+	if pageSize <= 0 {
+		pageSize = defaultSearchHistoryPageSize
+	} else if pageSize > maxSearchHistoryPageSize {
+		pageSize = maxSearchHistoryPageSize
+	}
+
+	results, err := repo.Users().GetSearchHistory(user.Id, pageStart, pageSize)
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return results, nil
+
+}
+
+// ClearSearchHistory deletes all of the user's searches. They are gone from
+// the analytics too.
+func ClearSearchHistory(user *model.User, repo repository.Repository) error {
+
+	if err := repo.Users().DeleteSearchHistory(user.Id); err != nil {
+		return utils.InternalError(err)
+	}
+
+	return nil
+
+}
+
+// GetSearchAnalytics summarises the searches made from from up to to, which
+// default to the last 30 days. limit caps the number of queries and users
+// listed.
+func GetSearchAnalytics(from time.Time, to time.Time, limit int, repo repository.Repository) (*model.SearchAnalytics, error) {
+
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+
+	if from.IsZero() {
+		from = to.AddDate(0, 0, -defaultSearchAnalyticsDays)
+	}
+
+	if limit <= 0 {
+		limit = defaultSearchAnalyticsLimit
+	}
+
+	validationErr := utils.NewValidationError()
+	if !from.Before(to) {
+		validationErr.WithField("from", "must be before to")
+	} else if to.Sub(from) > maxSearchAnalyticsDays*24*time.Hour {
+		validationErr.WithField("from", fmt.Sprintf("must be within %d days of to", maxSearchAnalyticsDays))
+	}
+	if limit > maxSearchAnalyticsLimit {
+		validationErr.WithField("limit", fmt.Sprintf("must be %d or less", maxSearchAnalyticsLimit))
+	}
+	if len(validationErr.Fields) > 0 {
+		return nil, validationErr
+	}
+
+	analytics := &model.SearchAnalytics{From: from, To: to}
+
+	var err error
+	if analytics.TopQueries, err = repo.Users().GetTopSearches(from, to, false, limit); err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	if analytics.ZeroResultQueries, err = repo.Users().GetTopSearches(from, to, true, limit); err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	if analytics.PerDay, err = repo.Users().GetSearchesPerDay(from, to); err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	if analytics.PerUser, err = repo.Users().GetTopSearchers(from, to, limit); err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return analytics, nil
+
+}
+
+const (
+	MaxSavedSearches         = 25
+	maxSavedSearchNameLength = 100
+	maxSavedSearchAuthor     = 255
+)
+
+func GetSavedSearches(user *model.User, repo repository.Repository) ([]*model.SavedSearch, error) {
+
+	savedSearches, err := repo.SavedSearches().GetForUser(user.Id)
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return savedSearches, nil
+
+}
+
+// validateSavedSearch checks a saved search in the same way as the search it
+// will run, so that its alerts can't fail later on
+func validateSavedSearch(savedSearch *model.SavedSearch, user *model.User, folderCache *FolderCache, discussionCache *DiscussionCache) error {
+
+	savedSearch.Name = strings.TrimSpace(savedSearch.Name)
+	savedSearch.Query = strings.TrimSpace(savedSearch.Query)
+	savedSearch.Author = strings.TrimSpace(savedSearch.Author)
+
+	validationErr := utils.NewValidationError()
+	if len(savedSearch.Name) == 0 {
+		validationErr.WithField("name", "is required")
+	} else if len(savedSearch.Name) > maxSavedSearchNameLength {
+		validationErr.WithField("name", "must be 100 characters or fewer")
+	}
+	if len(savedSearch.Query) == 0 {
+		validationErr.WithField("query", "is required")
+	}
+	if len(savedSearch.Author) > maxSavedSearchAuthor {
+		validationErr.WithField("author", "is too long")
+	}
+	if len(validationErr.Fields) > 0 {
+		return validationErr
+	}
+
+	if _, err := search.NewQuery(savedSearch.SearchQuery(1)); err != nil {
+		return err
+	}
+
+	if savedSearch.FolderId > 0 {
+		if _, err := folderCache.Get(savedSearch.FolderId, user); err != nil {
+			return err
+		}
+	}
+
+	if savedSearch.DiscussionId > 0 {
+		if _, err := discussionCache.Get(savedSearch.DiscussionId, user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+func CreateSavedSearch(savedSearch *model.SavedSearch, user *model.User, folderCache *FolderCache, discussionCache *DiscussionCache, repo repository.Repository) (*model.SavedSearch, error) {
+
+	if err := validateSavedSearch(savedSearch, user, folderCache, discussionCache); err != nil {
+		return nil, err
+	}
+
+	existing, err := repo.SavedSearches().GetForUser(user.Id)
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	if len(existing) >= MaxSavedSearches {
+		return nil, utils.NewError(utils.ErrBadRequest, utils.ErrorCodeTooManySavedSearches, fmt.Sprintf("You can save up to %d searches", MaxSavedSearches))
+	}
+
+	savedSearch.UserId = user.Id
+	created, err := repo.SavedSearches().Create(savedSearch)
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return created, nil
+
+}
+
+func EditSavedSearch(savedSearch *model.SavedSearch, user *model.User, folderCache *FolderCache, discussionCache *DiscussionCache, repo repository.Repository) (*model.SavedSearch, error) {
+
+	if err := validateSavedSearch(savedSearch, user, folderCache, discussionCache); err != nil {
+		return nil, err
+	}
+
+	savedSearch.UserId = user.Id
+	updated, err := repo.SavedSearches().Update(savedSearch)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, savedSearchNotFound()
+	} else if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	return updated, nil
+
+}
+
+func DeleteSavedSearch(savedSearchId uint, user *model.User, repo repository.Repository) error {
+
+	err := repo.SavedSearches().Delete(user.Id, savedSearchId)
+	if errors.Is(err, repository.ErrNotFound) {
+		return savedSearchNotFound()
+	} else if err != nil {
+		return utils.InternalError(err)
+	}
+
+	return nil
+
+}
 
+func savedSearchNotFound() error {
+	return utils.NewError(utils.ErrNotFound, utils.ErrorCodeSavedSearchNotFound, "Saved search not found")
 }
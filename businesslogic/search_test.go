@@ -18,32 +18,43 @@ package businesslogic
 import (
 	"context"
 	"errors"
+	"io/ioutil"
 	"justthetalk/connections"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"justthetalk/repository/memory"
+	"justthetalk/repository/storedproc"
+	"justthetalk/search/embedded"
 	"justthetalk/utils"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gorm.io/gorm"
 )
 
 func TestSearch(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
 	userId := uint(5540)
-	user := userCache.Get(userId)
+	user := getTestUser(t, userCache, userId)
 
 	query := "johnnythesailor"
 	connections.WithDatabase(30*time.Second, func(db *gorm.DB) {
 
+		repo := storedproc.New(db)
+
 		var count1 int64
 		var count2 int64
 
 		db.Table("search_history").Count(&count1)
 
-		posts := SearchPosts(query, 20, 0, user, "8.8.8.8", folderCache, discussionCache, db, context.Background())
+		posts, err := SearchPosts(testSearchEngine, &model.SearchQuery{Text: query, Sort: model.SearchSortDate, Size: 20}, user, "8.8.8.8", folderCache, discussionCache, repo, context.Background())
+		require.NoError(t, err)
 
 		if len(posts) == 0 {
 			t.Error("No results")
@@ -58,34 +69,150 @@ func TestSearch(t *testing.T) {
 
 }
 
-func TestSearchFailure(t *testing.T) {
+func TestSearchFillsThePage(t *testing.T) {
+
+	userCache, folderCache, discussionCache := newTestCaches(t)
+	user := getTestUser(t, userCache, 5540)
 
-	defer func() {
-		if r := recover(); r != nil {
-			err := r.(error)
-			switch {
-			case errors.Is(err, utils.ErrBadRequest):
-				t.Log("Got bad request")
-			default:
-				t.Error(err)
-			}
+	testProvider.WithRepository(30*time.Second, func(repo repository.Repository) {
+
+		posts, err := SearchPosts(testSearchEngine, &model.SearchQuery{Text: "johnnythesailor", Sort: model.SearchSortDate, Size: 5}, user, "8.8.8.8", folderCache, discussionCache, repo, context.Background())
+		require.NoError(t, err)
+		require.NotEmpty(t, posts)
+
+		total := posts[0].TotalResults
+		if total >= 5 {
+			assert.Len(t, posts, 5)
+		} else {
+			assert.Len(t, posts, total)
 		}
-	}()
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+		for _, post := range posts {
+			assert.Equal(t, total, post.TotalResults)
+			_, ignored := user.IgnoredUsers[post.Post.CreatedByUserId]
+			assert.False(t, ignored, "post %d is by an ignored user", post.Post.Id)
+		}
+
+	})
+
+}
+
+func TestSearchFailure(t *testing.T) {
+
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
 	userId := uint(5540)
-	user := userCache.Get(userId)
+	user := getTestUser(t, userCache, userId)
 
 	query := ":::::"
-	connections.WithDatabase(30*time.Second, func(db *gorm.DB) {
+	testProvider.WithRepository(30*time.Second, func(repo repository.Repository) {
 
-		SearchPosts(query, 20, 0, user, "8.8.8.8", folderCache, discussionCache, db, context.Background())
-
-		t.Error("Unexpected success")
+		_, err := SearchPosts(testSearchEngine, &model.SearchQuery{Text: query, Sort: model.SearchSortDate, Size: 20}, user, "8.8.8.8", folderCache, discussionCache, repo, context.Background())
+		assert.True(t, errors.Is(err, utils.ErrBadRequest), "expected bad request, got %v", err)
 
 	})
 
 }
+
+func TestSearchHistoryRecordsResultCounts(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "search")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	engine, err := embedded.Open(filepath.Join(dir, "search.log"))
+	require.NoError(t, err)
+	defer engine.Close()
+
+	store := memory.NewStore()
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+	other := store.AddUser(&model.User{Username: "bob", Email: "bob@example.com", Enabled: true})
+
+	for _, text := range []string{"Kittens", "kittens", "unicorns"} {
+		_, err := SearchPosts(engine, &model.SearchQuery{Text: text, Sort: model.SearchSortDate, Size: 10}, user, "10.0.0.1", nil, nil, store, context.Background())
+		require.NoError(t, err)
+	}
+	_, err = SearchPosts(engine, &model.SearchQuery{Text: "kittens", Sort: model.SearchSortDate, Size: 10}, other, "10.0.0.2", nil, nil, store, context.Background())
+	require.NoError(t, err)
+
+	history, err := GetSearchHistory(user, 0, 0, store)
+	require.NoError(t, err)
+	if assert.Len(t, history, 3) && assert.NotNil(t, history[0].ResultCount) {
+		assert.Equal(t, 0, *history[0].ResultCount)
+	}
+
+	analytics, err := GetSearchAnalytics(time.Time{}, time.Time{}, 0, store)
+	require.NoError(t, err)
+	if assert.Len(t, analytics.TopQueries, 2) {
+		assert.Equal(t, "kittens", analytics.TopQueries[0].Query)
+		assert.Equal(t, 3, analytics.TopQueries[0].Count)
+		assert.Equal(t, 2, analytics.TopQueries[0].Users)
+	}
+	assert.Len(t, analytics.ZeroResultQueries, 2)
+	if assert.Len(t, analytics.PerDay, 1) {
+		assert.Equal(t, 4, analytics.PerDay[0].ZeroResults)
+	}
+	if assert.Len(t, analytics.PerUser, 2) {
+		assert.Equal(t, "alice", analytics.PerUser[0].Username)
+		assert.Equal(t, 2, analytics.PerUser[0].DistinctQueries)
+	}
+
+	require.NoError(t, ClearSearchHistory(user, store))
+	history, _ = GetSearchHistory(user, 0, 0, store)
+	assert.Empty(t, history)
+	history, _ = GetSearchHistory(other, 0, 0, store)
+	assert.Len(t, history, 1)
+
+	now := time.Now()
+	_, err = GetSearchAnalytics(now, now.Add(-time.Hour), 0, store)
+	assert.True(t, errors.Is(err, utils.ErrBadRequest))
+	_, err = GetSearchAnalytics(now.AddDate(-2, 0, 0), now, 0, store)
+	assert.True(t, errors.Is(err, utils.ErrBadRequest))
+
+}
+
+func TestSearchDiscussionFallsBackToTheDatabase(t *testing.T) {
+
+	store := memory.NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+	discussion, _ := store.Discussions().Create(folder.Id, "Pets", "", user.Id, false)
+
+	for _, text := range []string{"first cat", "a dog", "second cat", "third cat"} {
+		_, err := store.Posts().Create(folder.Id, discussion.Id, text, model.PostStatusOK, user.Id)
+		require.NoError(t, err)
+	}
+
+	// the guard reports the engine as unavailable so it is never called
+	guard := NewSearchGuard(nil)
+	guard.err = assert.AnError
+	guard.lastChecked = time.Now()
+
+	results, err := SearchDiscussion(nil, guard, &model.SearchQuery{Text: "cat", Size: 2}, folder, discussion, user, "10.0.0.1", nil, nil, store, context.Background())
+	require.NoError(t, err)
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, int64(4), results[0].Post.PostNum)
+		assert.Equal(t, 3, results[0].TotalResults)
+		assert.NotEmpty(t, results[0].Post.Url)
+	}
+
+	results, err = SearchDiscussion(nil, guard, &model.SearchQuery{Text: "cat", Size: 2, After: results[1].Cursor}, folder, discussion, user, "10.0.0.1", nil, nil, store, context.Background())
+	require.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, int64(1), results[0].Post.PostNum)
+	}
+
+	// locked discussions aren't indexed so they are always searched in the
+	// database
+	discussion.IsLocked = true
+	results, err = SearchDiscussion(nil, NewSearchGuard(nil), &model.SearchQuery{Text: "dog", Size: 10}, folder, discussion, user, "10.0.0.1", nil, nil, store, context.Background())
+	require.NoError(t, err)
+	assert.Len(t, results, 1)
+
+	history, err := GetSearchHistory(user, 0, 0, store)
+	require.NoError(t, err)
+	if assert.Len(t, history, 3) && assert.NotNil(t, history[0].ResultCount) {
+		assert.Equal(t, 1, *history[0].ResultCount)
+	}
+
+}
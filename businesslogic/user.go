@@ -16,13 +16,12 @@
 package businesslogic
 
 import (
-	"gorm.io/gorm"
-
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"html"
 	"justthetalk/model"
+	"justthetalk/repository"
 	"justthetalk/utils"
 	"time"
 
@@ -30,7 +29,7 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func CreateLoginHistory(status string, user *model.User, ipAddress string, db *gorm.DB) {
+func CreateLoginHistory(status string, user *model.User, ipAddress string, repo repository.Repository) error {
 
 	history := model.LoginHistory{
 		CreatedDate: time.Now(),
@@ -39,253 +38,221 @@ func CreateLoginHistory(status string, user *model.User, ipAddress string, db *g
 		Status:      status,
 	}
 
-	db.Table("user").Where("id = ?", user.Id).Update("last_login_date", time.Now())
+	repo.Users().UpdateLastLogin(user.Id, time.Now())
 
-	if result := db.Table("login_history").Create(&history); result.Error != nil {
-		log.Errorf("%v", result.Error)
-		panic(utils.ErrInternalError)
+	if err := repo.Users().CreateLoginHistory(&history); err != nil {
+		return utils.InternalError(err)
 	}
 
+	return nil
+
 }
 
-func ValidateUserLogin(credentials model.LoginCredentials, ipAddress string, db *gorm.DB, userCache *UserCache) *model.User {
+func ValidateUserLogin(credentials model.LoginCredentials, ipAddress string, repo repository.Repository, userCache *UserCache) (*model.User, error) {
 
 	username := html.EscapeString(credentials.Username)
 	passwordHashBytes := sha256.Sum256([]byte(credentials.Password))
 	passwordHash := fmt.Sprintf("%x", passwordHashBytes)
 
-	var userLookup model.User
-	if result := db.Raw("call find_user(?, ?)", username, passwordHash).Take(&userLookup); result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+	userLookup, err := repo.Users().FindByCredentials(username, passwordHash)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
 			log.Errorf("Failed login for user: %s", username)
-			utils.PanicWithWrapper(errors.New("Unknown username or incorrect password"), utils.ErrUnauthorised)
-		} else {
-			utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+			return nil, utils.NewError(utils.ErrUnauthorised, utils.ErrorCodeInvalidCredentials, "Unknown username or incorrect password")
 		}
-	} else if userLookup.ModelBase.Id == 0 {
-		log.Errorf("Failed login for user: %s", username)
-		panic(utils.ErrUnauthorised)
+		return nil, utils.InternalError(err)
 	}
 
-	user := userCache.Get(userLookup.Id)
+	user, err := userCache.Get(userLookup.Id)
+	if err != nil {
+		return nil, err
+	}
 
 	if user.AccountExpired || !user.Enabled {
-		utils.PanicWithWrapper(errors.New("This account has been deleted"), utils.ErrUnauthorised)
+		return nil, utils.NewError(utils.ErrUnauthorised, utils.ErrorCodeAccountDeleted, "This account has been deleted")
 	}
 
-	CreateLoginHistory("login", user, ipAddress, db)
+	if err := CreateLoginHistory("login", user, ipAddress, repo); err != nil {
+		return nil, err
+	}
 
-	return user
+	return user, nil
 
 }
 
-func GetDiscussionSubscriptionStatus(discussion *model.Discussion, user *model.User, db *gorm.DB) bool {
+func GetDiscussionSubscriptionStatus(discussion *model.Discussion, user *model.User, repo repository.Repository) (bool, error) {
 
-	var isSubscribed int64
-	if result := db.Raw("call get_discussion_subscription_status(?, ?)", user.Id, discussion.Id).First(&isSubscribed); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	isSubscribed, err := repo.Subscriptions().IsSubscribedToDiscussion(user.Id, discussion.Id)
+	if err != nil {
+		return false, utils.InternalError(err)
 	}
 
-	if isSubscribed == 0 {
-		return false
-	} else {
-		return true
-	}
+	return isSubscribed, nil
 
 }
 
-func GetFolderSubscriptionStatus(folder *model.Folder, user *model.User, db *gorm.DB) bool {
+func GetFolderSubscriptionStatus(folder *model.Folder, user *model.User, repo repository.Repository) (bool, error) {
 
-	var isSubscribed int64
-	if result := db.Raw("call get_folder_subscription_status(?, ?)", user.Id, folder.Id).First(&isSubscribed); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	isSubscribed, err := repo.Subscriptions().IsSubscribedToFolder(user.Id, folder.Id)
+	if err != nil {
+		return false, utils.InternalError(err)
 	}
 
-	if isSubscribed == 0 {
-		return false
-	} else {
-		return true
-	}
+	return isSubscribed, nil
 
 }
 
-func MarkFolderSubscriptionsRead(subsList []uint, user *model.User, db *gorm.DB, userCache *UserCache) []*model.UserFolderSubscription {
+func MarkFolderSubscriptionsRead(subsList []uint, user *model.User, repo repository.Repository, userCache *UserCache) ([]*model.UserFolderSubscription, error) {
 
-	err := db.Transaction(func(tx *gorm.DB) error {
-
-		var err error
+	err := repo.Transaction(func(tx repository.Repository) error {
 		for _, subsId := range subsList {
-			err = tx.Exec("call mark_folder_subscription_read(?, ?)", user.Id, subsId).Error
-			if err != nil {
-				break
+			if err := tx.Subscriptions().MarkFolderSubscriptionRead(user.Id, subsId); err != nil {
+				return err
 			}
 		}
-		return err
+		return nil
 	})
 
 	if err != nil {
-		utils.PanicWithWrapper(err, utils.ErrInternalError)
-	}
-
-	var entries []*model.UserFolderSubscription
-	if result := db.Raw("call get_folder_subscriptions(?)", user.Id).Scan(&entries); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+		return nil, utils.InternalError(err)
 	}
 
-	return entries
+	return GetFolderSubscriptions(user, repo)
 
 }
 
-func MarkDiscussionSubscriptionsRead(subsList []uint, user *model.User, db *gorm.DB, userCache *UserCache) []*model.FrontPageEntry {
+func MarkDiscussionSubscriptionsRead(subsList []uint, user *model.User, repo repository.Repository, userCache *UserCache) ([]*model.FrontPageEntry, error) {
 
-	err := db.Transaction(func(tx *gorm.DB) error {
-		var err error
+	err := repo.Transaction(func(tx repository.Repository) error {
 		for _, subsId := range subsList {
-			err = tx.Exec("call mark_discussion_read(?, ?)", user.Id, subsId).Error
-			if err != nil {
-				break
+			if err := tx.Subscriptions().MarkDiscussionRead(user.Id, subsId); err != nil {
+				return err
 			}
 		}
-		return err
+		return nil
 	})
 
 	if err != nil {
-		utils.PanicWithWrapper(err, utils.ErrInternalError)
-	}
-
-	var entries []*model.FrontPageEntry
-	if result := db.Raw("call get_discussion_subscriptions(?)", user.Id).Scan(&entries); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+		return nil, utils.InternalError(err)
 	}
 
-	utils.FormatFrontPageEntries(entries)
-
-	return entries
+	return GetDiscussionSubscriptions(user, repo)
 
 }
 
-func DeleteFolderSubscriptions(subsList []uint, user *model.User, db *gorm.DB, userCache *UserCache) []*model.UserFolderSubscription {
+func DeleteFolderSubscriptions(subsList []uint, user *model.User, repo repository.Repository, userCache *UserCache) ([]*model.UserFolderSubscription, error) {
 
-	err := db.Transaction(func(tx *gorm.DB) error {
-
-		var err error
+	err := repo.Transaction(func(tx repository.Repository) error {
 		for _, subsId := range subsList {
-			err = tx.Exec("call delete_folder_subscription(?, ?)", user.Id, subsId).Error
-			if err != nil {
-				break
+			if err := tx.Subscriptions().DeleteFolderSubscription(user.Id, subsId); err != nil {
+				return err
 			}
 		}
-		return err
+		return nil
 	})
 
 	if err != nil {
-		utils.PanicWithWrapper(err, utils.ErrInternalError)
-	}
-
-	entries := make([]*model.UserFolderSubscription, 0)
-	if result := db.Raw("call get_folder_subscriptions(?)", user.Id).Scan(&entries); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+		return nil, utils.InternalError(err)
 	}
 
-	return entries
+	return GetFolderSubscriptions(user, repo)
 
 }
 
-func DeleteDiscussionSubscriptions(subsList []uint, user *model.User, db *gorm.DB, userCache *UserCache) []*model.FrontPageEntry {
+func DeleteDiscussionSubscriptions(subsList []uint, user *model.User, repo repository.Repository, userCache *UserCache) ([]*model.FrontPageEntry, error) {
 
-	err := db.Transaction(func(tx *gorm.DB) error {
-		var err error
+	err := repo.Transaction(func(tx repository.Repository) error {
 		for _, subsId := range subsList {
-			err = tx.Exec("call delete_discussion_subscription(?, ?)", user.Id, subsId).Error
-			if err != nil {
-				break
+			if err := tx.Subscriptions().DeleteDiscussionSubscription(user.Id, subsId); err != nil {
+				return err
 			}
 		}
-		return err
+		return nil
 	})
 
 	if err != nil {
-		utils.PanicWithWrapper(err, utils.ErrInternalError)
-	}
-
-	subscriptions := make([]*model.FrontPageEntry, 0)
-	if result := db.Raw("call get_discussion_subscriptions(?)", user.Id).Scan(&subscriptions); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+		return nil, utils.InternalError(err)
 	}
 
-	utils.FormatFrontPageEntries(subscriptions)
-
-	return subscriptions
+	return GetDiscussionSubscriptions(user, repo)
 
 }
 
-func SetDiscussionSubscriptionStatus(discussion *model.Discussion, user *model.User, db *gorm.DB, userCache *UserCache) {
+func SetDiscussionSubscriptionStatus(discussion *model.Discussion, user *model.User, repo repository.Repository, userCache *UserCache) error {
 
-	if result := db.Exec("call update_user_discussion_subscription(?, ?, ?)", user.Id, discussion.Id, 1); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	if err := repo.Subscriptions().SetDiscussionSubscription(user.Id, discussion.Id, true); err != nil {
+		return utils.InternalError(err)
 	}
 
+	return nil
+
 }
 
-func UnsetDiscussionSubscriptionStatus(discussion *model.Discussion, user *model.User, db *gorm.DB, userCache *UserCache) {
+func UnsetDiscussionSubscriptionStatus(discussion *model.Discussion, user *model.User, repo repository.Repository, userCache *UserCache) error {
 
-	if result := db.Exec("call update_user_discussion_subscription(?, ?, ?)", user.Id, discussion.Id, 0); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	if err := repo.Subscriptions().SetDiscussionSubscription(user.Id, discussion.Id, false); err != nil {
+		return utils.InternalError(err)
 	}
 
+	return nil
+
 }
 
-func SetFolderSubscriptionStatus(folder *model.Folder, user *model.User, db *gorm.DB, userCache *UserCache) {
+func SetFolderSubscriptionStatus(folder *model.Folder, user *model.User, repo repository.Repository, userCache *UserCache) error {
 
-	if result := db.Exec("call update_user_folder_subscription(?, ?, ?)", user.Id, folder.Id, 1); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	if err := repo.Subscriptions().SetFolderSubscription(user.Id, folder.Id, true); err != nil {
+		return utils.InternalError(err)
 	}
 
+	return nil
+
 }
 
-func UnsetFolderSubscriptionStatus(folder *model.Folder, user *model.User, db *gorm.DB, userCache *UserCache) {
+func UnsetFolderSubscriptionStatus(folder *model.Folder, user *model.User, repo repository.Repository, userCache *UserCache) error {
 
-	if result := db.Exec("call update_user_folder_subscription(?, ?, ?)", user.Id, folder.Id, 0); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	if err := repo.Subscriptions().SetFolderSubscription(user.Id, folder.Id, false); err != nil {
+		return utils.InternalError(err)
 	}
 
+	return nil
+
 }
 
-func GetDiscussionSubscriptions(user *model.User, db *gorm.DB) []*model.FrontPageEntry {
+func GetDiscussionSubscriptions(user *model.User, repo repository.Repository) ([]*model.FrontPageEntry, error) {
 
-	subscriptions := make([]*model.FrontPageEntry, 0)
-	if result := db.Raw("call get_discussion_subscriptions(?)", user.Id).Scan(&subscriptions); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	subscriptions, err := repo.Subscriptions().GetDiscussionSubscriptions(user.Id)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
 	utils.FormatFrontPageEntries(subscriptions)
 
-	return subscriptions
+	return subscriptions, nil
 }
 
-func GetFolderSubscriptions(user *model.User, db *gorm.DB) []*model.UserFolderSubscription {
+func GetFolderSubscriptions(user *model.User, repo repository.Repository) ([]*model.UserFolderSubscription, error) {
 
-	subscriptions := make([]*model.UserFolderSubscription, 0)
-	if result := db.Raw("call get_folder_subscriptions(?)", user.Id).Scan(&subscriptions); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	subscriptions, err := repo.Subscriptions().GetFolderSubscriptions(user.Id)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	return subscriptions
+	return subscriptions, nil
 
 }
 
-func GetFolderSubscriptionExcepions(user *model.User, db *gorm.DB) []*model.UserFolderSubscriptionException {
+func GetFolderSubscriptionExcepions(user *model.User, repo repository.Repository) ([]*model.UserFolderSubscriptionException, error) {
 
-	exceptions := make([]*model.UserFolderSubscriptionException, 0)
-	if result := db.Raw("call get_folder_subscription_exceptions(?)", user.Id).Scan(&exceptions); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	exceptions, err := repo.Subscriptions().GetFolderSubscriptionExceptions(user.Id)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	return exceptions
+	return exceptions, nil
 
 }
 
-func UpdateFolderSubscriptions(subsList []uint, user *model.User, db *gorm.DB, userCache *UserCache, folderCache *FolderCache) []*model.UserFolderSubscription {
+func UpdateFolderSubscriptions(subsList []uint, user *model.User, repo repository.Repository, userCache *UserCache, folderCache *FolderCache) ([]*model.UserFolderSubscription, error) {
 
 	subscriptions := make(map[uint]bool)
 
@@ -297,47 +264,44 @@ func UpdateFolderSubscriptions(subsList []uint, user *model.User, db *gorm.DB, u
 		subscriptions[folderId] = true
 	}
 
-	err := db.Transaction(func(tx *gorm.DB) error {
-		var err error
+	err := repo.Transaction(func(tx repository.Repository) error {
 		for folderId, subscribed := range subscriptions {
-			subscriptionState := 0
-			if subscribed {
-				subscriptionState = 1
-			}
-			if result := db.Exec("call update_user_folder_subscription(?, ?, ?)", user.Id, folderId, subscriptionState); result.Error != nil {
-				err = result.Error
-				break
+			if err := tx.Subscriptions().SetFolderSubscription(user.Id, folderId, subscribed); err != nil {
+				return err
 			}
-
 		}
-		return err
+		return nil
 	})
 
 	if err != nil {
-		utils.PanicWithWrapper(err, utils.ErrInternalError)
+		return nil, utils.InternalError(err)
 	}
 
-	results := GetFolderSubscriptions(user, db)
-
-	return results
+	return GetFolderSubscriptions(user, repo)
 
 }
 
-func GetOtherUser(userId uint, db *gorm.DB, userCache *UserCache) *model.OtherUser {
-	user := userCache.Get(userId)
+func GetOtherUser(userId uint, repo repository.Repository, userCache *UserCache) (*model.OtherUser, error) {
+
+	user, err := userCache.Get(userId)
+	if err != nil {
+		return nil, err
+	}
+
 	return &model.OtherUser{
 		UserId:      user.Id,
 		Username:    user.Username,
 		Bio:         user.Bio,
 		CreatedDate: user.CreatedDate,
-	}
+	}, nil
+
 }
 
-func UpdateIgnore(user *model.User, ignoreUserId uint, ignoreState int, db *gorm.DB, userCache *UserCache) {
+func UpdateIgnore(user *model.User, ignoreUserId uint, ignoreState int, repo repository.Repository, userCache *UserCache) error {
 
-	var ignored []*model.IgnoredUser
-	if result := db.Raw("call update_user_ignore(?, ?, ?)", user.Id, ignoreUserId, ignoreState).Scan(&ignored); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	ignored, err := repo.Users().SetIgnored(user.Id, ignoreUserId, ignoreState != 0)
+	if err != nil {
+		return utils.InternalError(err)
 	}
 
 	user.IgnoredUsers = make(map[uint]*model.IgnoredUser)
@@ -345,138 +309,147 @@ func UpdateIgnore(user *model.User, ignoreUserId uint, ignoreState int, db *gorm
 		user.IgnoredUsers[item.IgnoredUserId] = item
 	}
 
-	userCache.Put(user)
+	return userCache.Put(user)
 
 }
 
-func CreateUser(credentials *model.LoginCredentials, ipAddress string, db *gorm.DB) *model.User {
+func CreateUser(credentials *model.LoginCredentials, ipAddress string, repo repository.Repository) (*model.User, error) {
 
 	username := html.EscapeString(credentials.Username)
 
-	var countOfExisting int64
-	if result := db.Table("user").Where("username = ? or email = ?", username, credentials.Email).Count(&countOfExisting); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	if countOfExisting, err := repo.Users().CountByUsernameOrEmail(username, credentials.Email); err != nil {
+		return nil, utils.InternalError(err)
 	} else if countOfExisting > 0 {
-		utils.PanicWithWrapper(utils.ErrBadRequest, errors.New("This username is already taken or e-mail address has already been used"))
+		return nil, utils.NewError(utils.ErrBadRequest, utils.ErrorCodeAccountExists, "This username is already taken or e-mail address has already been used")
 	}
 
 	passwordHashBytes := sha256.Sum256([]byte(credentials.Password))
 	passwordHash := fmt.Sprintf("%x", passwordHashBytes)
 
 	// TODO - put this in a transaction
-	var user model.User
-	if result := db.Raw("call create_user(?, ?, ?)", credentials.Email, username, passwordHash).Take(&user); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	user, err := repo.Users().Create(credentials.Email, username, passwordHash)
+	if err != nil {
+		return nil, utils.InternalError(err)
+	}
+
+	if err := CreateUserHistory(model.UserHistoryAdminSignup, ipAddress, user, repo); err != nil {
+		return nil, err
 	}
 
-	CreateUserHistory(model.UserHistoryAdminSignup, ipAddress, &user, db)
-	CreateLoginHistory("new", &user, ipAddress, db)
+	if err := CreateLoginHistory("new", user, ipAddress, repo); err != nil {
+		return nil, err
+	}
 
-	CreateNewSignupConfirmation(&user, db)
+	if err := CreateNewSignupConfirmation(user, repo); err != nil {
+		return nil, err
+	}
 
-	return &user
+	return user, nil
 
 }
 
-func CreateNewSignupConfirmation(user *model.User, db *gorm.DB) {
+func CreateNewSignupConfirmation(user *model.User, repo repository.Repository) error {
 
-	var confirmation model.SignupConfirmation
-	if result := db.Raw("call create_signup_confirmation(?, ?)", user.Id, uuid.NewString()).Take(&confirmation); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	confirmation, err := repo.Users().CreateSignupConfirmation(user.Id, uuid.NewString())
+	if err != nil {
+		return utils.InternalError(err)
 	}
 
-	SendEmailToUser(user, confirmation, NewSignupTemplate)
+	return SendEmailToUser(user, *confirmation, NewSignupTemplate)
 
 }
 
-func ForgotPassword(credentials *model.LoginCredentials, ipAddress string, userCache *UserCache, db *gorm.DB) *model.PasswordResetRequest {
+func ForgotPassword(credentials *model.LoginCredentials, ipAddress string, userCache *UserCache, repo repository.Repository) (*model.PasswordResetRequest, error) {
 
-	var foundUser model.User
-	if result := db.Raw("call find_user_by_email(?)", credentials.Email).Take(&foundUser); result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil
+	foundUser, err := repo.Users().FindByEmail(credentials.Email)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, nil
 		}
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+		return nil, utils.InternalError(err)
 	}
 
-	user := userCache.Get(foundUser.Id)
+	user, err := userCache.Get(foundUser.Id)
+	if err != nil {
+		return nil, err
+	}
 
-	var request model.PasswordResetRequest
-	if result := db.Raw("call create_password_reset_request(?, ?, ?)", user.Id, ipAddress, uuid.NewString()).Take(&request); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	request, err := repo.Users().CreatePasswordResetRequest(user.Id, ipAddress, uuid.NewString())
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	SendEmailToUser(user, request, PasswordResetRequestTemplate)
+	if err := SendEmailToUser(user, *request, PasswordResetRequestTemplate); err != nil {
+		return nil, err
+	}
 
-	return &request
+	return request, nil
 
 }
 
-func ValidatePasswordResetKey(key string, userCache *UserCache, db *gorm.DB) (*model.PasswordResetRequest, error) {
+func ValidatePasswordResetKey(key string, userCache *UserCache, repo repository.Repository) (*model.PasswordResetRequest, error) {
 
 	if _, err := uuid.Parse(key); err != nil {
-		panic(utils.ErrBadRequest)
+		return nil, utils.NewError(utils.ErrBadRequest, utils.ErrorCodeInvalidKey, "Invalid password reset key").WithField("key", "must be a UUID")
 	}
 
-	var request model.PasswordResetRequest
-	if result := db.Raw("call find_password_reset_request(?)", key).Take(&request); result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil, errors.New("key not found")
+	request, err := repo.Users().FindPasswordResetRequest(key)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, utils.NewError(utils.ErrBadRequest, utils.ErrorCodeInvalidKey, "Password reset key not found")
 		}
-		return nil, utils.ErrInternalError
+		return nil, utils.InternalError(err)
 	}
 
 	if request.CreatedDate.Add(time.Hour).Before(time.Now()) {
-		return nil, utils.ErrExpired
+		return nil, utils.NewError(utils.ErrExpired, utils.ErrorCodeKeyExpired, "Password reset key has expired")
 	}
 
-	return &request, nil
+	return request, nil
 
 }
 
-func UpdatePassword(user *model.User, updateData *model.UserOptionsUpdateData, userCache *UserCache, db *gorm.DB) *model.User {
+func UpdatePassword(user *model.User, updateData *model.UserOptionsUpdateData, userCache *UserCache, repo repository.Repository) (*model.User, error) {
 
 	if len(updateData.NewPassword) < 8 {
-		utils.PanicWithWrapper(errors.New("Passwords must be at least 8 characters long"), utils.ErrBadRequest)
+		return nil, utils.NewValidationError(utils.FieldError{Field: "newPassword", Message: "Passwords must be at least 8 characters long"})
 	}
 
 	var userId uint
 
-	err := db.Transaction(func(tx *gorm.DB) error {
+	err := repo.Transaction(func(tx repository.Repository) error {
 		if user != nil {
 
 			passwordHashBytes := sha256.Sum256([]byte(updateData.OldPassword))
 			passwordHash := fmt.Sprintf("%x", passwordHashBytes)
 
-			if result := tx.Raw("call find_user(?, ?)", user.Username, passwordHash).Take(user); result.Error != nil {
-				if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-					return utils.ErrUnauthorised
+			found, err := tx.Users().FindByCredentials(user.Username, passwordHash)
+			if err != nil {
+				if errors.Is(err, repository.ErrNotFound) {
+					return utils.NewError(utils.ErrUnauthorised, utils.ErrorCodeInvalidCredentials, "Incorrect password")
 				}
-				return fmt.Errorf("fetching user: %w", result.Error)
-			}
-			if user.ModelBase.Id == 0 {
-				return utils.ErrUnauthorised
+				return utils.InternalError(fmt.Errorf("fetching user: %w", err))
 			}
 
-			userId = user.Id
+			userId = found.Id
 
 		} else if len(updateData.ResetKey) > 0 {
 			resetRequest, err := ValidatePasswordResetKey(updateData.ResetKey, userCache, tx)
 			if err != nil {
 				return err
 			}
-			if result := tx.Raw("delete from password_reset where id = ?", resetRequest.Id); result.Error != nil {
-				return fmt.Errorf("clearing password request: %w", result.Error)
+			if err := tx.Users().DeletePasswordResetRequest(resetRequest.Id); err != nil {
+				return utils.InternalError(fmt.Errorf("clearing password request: %w", err))
 			}
 			userId = resetRequest.UserId
 		} else {
-			return utils.ErrBadRequest
+			return utils.NewValidationError(utils.FieldError{Field: "resetKey", Message: "is required"})
 		}
 
 		passwordHashBytes := sha256.Sum256([]byte(updateData.NewPassword))
 		passwordHash := fmt.Sprintf("%x", passwordHashBytes)
-		if result := tx.Raw("call update_user_password(?, ?)", userId, passwordHash).Scan(user); result.Error != nil {
-			return fmt.Errorf("updating password: %w", result.Error)
+		if _, err := tx.Users().UpdatePassword(userId, passwordHash); err != nil {
+			return utils.InternalError(fmt.Errorf("updating password: %w", err))
 		}
 
 		userCache.FlushById(userId)
@@ -485,202 +458,202 @@ func UpdatePassword(user *model.User, updateData *model.UserOptionsUpdateData, u
 	})
 
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	return userCache.Get(userId)
 }
 
-func ValidateSignupConfirmationKey(key string, ipAddress string, userCache *UserCache, db *gorm.DB) (*model.User, error) {
+func ValidateSignupConfirmationKey(key string, ipAddress string, userCache *UserCache, repo repository.Repository) (*model.User, error) {
 
 	if _, err := uuid.Parse(key); err != nil {
-		return nil, utils.ErrBadRequest
+		return nil, utils.NewError(utils.ErrBadRequest, utils.ErrorCodeInvalidKey, "Invalid confirmation key").WithField("key", "must be a UUID")
 	}
 
-	var request model.SignupConfirmation
-
-	if result := db.Raw("call find_signup_confirmation_request(?)", key).Take(&request); result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil, utils.ErrBadRequest
+	request, err := repo.Users().FindSignupConfirmation(key)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, utils.NewError(utils.ErrBadRequest, utils.ErrorCodeInvalidKey, "Confirmation key not found")
 		}
-		return nil, result.Error
+		return nil, utils.InternalError(err)
 	}
 
 	if request.CreatedDate.Add(72 * time.Hour).Before(time.Now()) {
-		return nil, utils.ErrExpired
+		return nil, utils.NewError(utils.ErrExpired, utils.ErrorCodeKeyExpired, "Confirmation key has expired")
 	}
 
 	// TODO - put this in a transaction
-	var user model.User
-	if result := db.Raw("call accept_signup_confirmation_request(?, ?)", request.Id, ipAddress).Take(&user); result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil, utils.ErrBadRequest
+	user, err := repo.Users().AcceptSignupConfirmation(request.Id, ipAddress)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, utils.NewError(utils.ErrBadRequest, utils.ErrorCodeInvalidKey, "Confirmation key has already been used")
 		}
-		return nil, result.Error
+		return nil, utils.InternalError(err)
 	}
 
-	updatedUser := userCache.Reload(user.Id)
+	updatedUser, err := userCache.Reload(user.Id)
+	if err != nil {
+		return nil, err
+	}
 
-	CreateUserHistory(model.UserHistoryAdminSignupConfirmed, ipAddress, &user, db)
-	CreateLoginHistory("new", &user, ipAddress, db)
+	if err := CreateUserHistory(model.UserHistoryAdminSignupConfirmed, ipAddress, user, repo); err != nil {
+		return nil, err
+	}
+
+	if err := CreateLoginHistory("new", user, ipAddress, repo); err != nil {
+		return nil, err
+	}
 
 	return updatedUser, nil
 
 }
 
-func UpdateAutoSubscribe(user *model.User, subscribeState int, userCache *UserCache, db *gorm.DB) *model.User {
+func UpdateAutoSubscribe(user *model.User, subscribeState int, userCache *UserCache, repo repository.Repository) (*model.User, error) {
 
-	var u model.User
-	if result := db.Raw("call update_user_autosubscribe(?, ?)", user.Id, subscribeState).Scan(&u); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	if _, err := repo.Users().UpdateAutoSubscribe(user.Id, subscribeState); err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	updatedUser := userCache.Reload(user.Id)
-
-	return updatedUser
+	return userCache.Reload(user.Id)
 
 }
 
-func UpdateSortFoldersByActivity(user *model.User, sortState int, userCache *UserCache, db *gorm.DB) *model.User {
+func UpdateSortFoldersByActivity(user *model.User, sortState int, userCache *UserCache, repo repository.Repository) (*model.User, error) {
 
-	var u model.User
-	if result := db.Raw("call update_user_foldersort(?, ?)", user.Id, sortState).Scan(&u); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	if _, err := repo.Users().UpdateSortFoldersByActivity(user.Id, sortState); err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	updatedUser := userCache.Reload(user.Id)
-
-	return updatedUser
+	return userCache.Reload(user.Id)
 
 }
 
-func UpdateSubscriptionFetchOrder(user *model.User, fetchOrder int, userCache *UserCache, db *gorm.DB) *model.User {
+func UpdateSubscriptionFetchOrder(user *model.User, fetchOrder int, userCache *UserCache, repo repository.Repository) (*model.User, error) {
 
-	var u model.User
-	if result := db.Raw("call update_user_subsfetchorder(?, ?)", user.Id, fetchOrder).Scan(&u); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	if _, err := repo.Users().UpdateSubscriptionFetchOrder(user.Id, fetchOrder); err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	updatedUser := userCache.Reload(user.Id)
-
-	return updatedUser
+	return userCache.Reload(user.Id)
 
 }
 
-func UpdateBio(user *model.User, bio string, userCache *UserCache, db *gorm.DB) *model.User {
+func UpdateBio(user *model.User, bio string, userCache *UserCache, repo repository.Repository) (*model.User, error) {
 
-	var u model.User
-	if result := db.Raw("call update_user_bio(?, ?)", user.Id, bio).Scan(&u); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	if _, err := repo.Users().UpdateBio(user.Id, bio); err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	updatedUser := userCache.Reload(user.Id)
-
-	return updatedUser
+	return userCache.Reload(user.Id)
 
 }
 
-func GetDiscussionBookmark(user *model.User, discussion *model.Discussion, db *gorm.DB) *model.UserDiscussionBookmark {
-
-	var bookmark model.UserDiscussionBookmark
+func GetDiscussionBookmark(user *model.User, discussion *model.Discussion, repo repository.Repository) (*model.UserDiscussionBookmark, error) {
 
 	if user == nil {
-		return nil
+		return nil, nil
 	}
 
-	if result := db.Raw("call get_user_discussion_bookmark(?, ?)", user.Id, discussion.Id).First(&bookmark); result.Error != nil {
-		if result.Error == gorm.ErrRecordNotFound {
-			return nil
+	bookmark, err := repo.Subscriptions().GetBookmark(user.Id, discussion.Id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, nil
 		}
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+		return nil, utils.InternalError(err)
 	}
 
-	return &bookmark
+	return bookmark, nil
 
 }
 
-func UpdateDiscussionBookmark(user *model.User, discussion *model.Discussion, post *model.Post, db *gorm.DB) *model.UserDiscussionBookmark {
-
-	var nextBookmark model.UserDiscussionBookmark
+func UpdateDiscussionBookmark(user *model.User, discussion *model.Discussion, post *model.Post, repo repository.Repository) (*model.UserDiscussionBookmark, error) {
 
-	if result := db.Raw("call update_user_bookmark(?, ?, ?, ?, ?)", user.Id, discussion.Id, post.Id, post.PostNum, post.CreatedDate).First(&nextBookmark); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	nextBookmark, err := repo.Subscriptions().UpdateBookmark(user.Id, discussion.Id, post.Id, post.PostNum, post.CreatedDate)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	return &nextBookmark
+	return nextBookmark, nil
 
 }
 
-func DeleteDiscussionBookmark(user *model.User, discussion *model.Discussion, userCache *UserCache, db *gorm.DB) {
+func DeleteDiscussionBookmark(user *model.User, discussion *model.Discussion, userCache *UserCache, repo repository.Repository) error {
 
-	if result := db.Exec("call delete_user_bookmark(?, ?)", user.Id, discussion.Id); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	if err := repo.Subscriptions().DeleteBookmark(user.Id, discussion.Id); err != nil {
+		return utils.InternalError(err)
 	}
 
+	return nil
+
 }
 
-func CreateReport(reportData *model.PostReport, userCache *UserCache, db *gorm.DB) {
+func CreateReport(reportData *model.PostReport, userCache *UserCache, repo repository.Repository) error {
 
 	// TODO put all in transaction
-	if result := db.Exec("call create_report(?, ?, ?, ?, ?, ?)", reportData.PostId, reportData.ReporterUserId, reportData.ReporterName, reportData.ReporterEmail, reportData.Body, reportData.IPAddress); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	if err := repo.Moderation().CreateReport(reportData); err != nil {
+		return utils.InternalError(err)
 	}
 
-	post, err := GetPost(reportData.PostId, db)
+	post, err := GetPost(reportData.PostId, repo)
 	if err != nil {
-		utils.PanicWithWrapper(err, utils.ErrInternalError)
+		return err
 	}
-	targetUser := userCache.Get(post.CreatedByUserId)
 
-	CreateUserHistory(model.UserHistoryUserPostReported, fmt.Sprintf("PostId: %d, Reported by: %s(%s)", reportData.PostId, reportData.ReporterName, reportData.ReporterEmail), targetUser, db)
+	targetUser, err := userCache.Get(post.CreatedByUserId)
+	if err != nil {
+		return err
+	}
+
+	if err := CreateUserHistory(model.UserHistoryUserPostReported, fmt.Sprintf("PostId: %d, Reported by: %s(%s)", reportData.PostId, reportData.ReporterName, reportData.ReporterEmail), targetUser, repo); err != nil {
+		return err
+	}
 
 	if reportData.ReporterUserId > 0 {
-		reportingUser := userCache.Get(reportData.ReporterUserId)
-		CreateUserHistory(model.UserHistoryUserReportedPost, fmt.Sprintf("PostId: %d", reportData.PostId), reportingUser, db)
+		reportingUser, err := userCache.Get(reportData.ReporterUserId)
+		if err != nil {
+			return err
+		}
+		if err := CreateUserHistory(model.UserHistoryUserReportedPost, fmt.Sprintf("PostId: %d", reportData.PostId), reportingUser, repo); err != nil {
+			return err
+		}
 	}
 
-	SendEmail(reportData.ReporterEmail, reportData, ReportSubmittedTemplate)
+	return SendEmail(reportData.ReporterEmail, reportData, ReportSubmittedTemplate)
 
 }
 
-func UpdateViewType(user *model.User, viewType string, userCache *UserCache, db *gorm.DB) *model.User {
+func UpdateViewType(user *model.User, viewType string, userCache *UserCache, repo repository.Repository) (*model.User, error) {
 
-	var updatedUser model.User
-	if result := db.Raw("call update_user_viewtype(?, ?)", user.Id, viewType).Scan(&updatedUser); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	updatedUser, err := repo.Users().UpdateViewType(user.Id, viewType)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
 	user.ViewType = updatedUser.ViewType
-	userCache.Put(user)
+	if err := userCache.Put(user); err != nil {
+		return nil, err
+	}
 
-	return user
+	return user, nil
 
 }
 
-func GetIgnoredUsers(user *model.User, db *gorm.DB) []*model.IgnoredUser {
+func GetIgnoredUsers(user *model.User, repo repository.Repository) ([]*model.IgnoredUser, error) {
 
-	var ignoredUserList []*model.IgnoredUser
-	if result := db.Raw("call get_user_ignored_users(?)", user.Id).Scan(&ignoredUserList); result.Error != nil {
-		utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
+	ignoredUserList, err := repo.Users().GetIgnoredUsers(user.Id)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
-	return ignoredUserList
+	return ignoredUserList, nil
 
 }
 
-func CheckSubscriptions(user *model.User, db *gorm.DB) []*model.FrontPageEntry {
+func CheckSubscriptions(user *model.User, repo repository.Repository) ([]*model.FrontPageEntry, error) {
 
-	var subscriptions []*model.FrontPageEntry
-
-	isAdmin := 0
-	if user.IsAdmin {
-		isAdmin = 1
-	}
-
-	if result := db.Raw("call get_frontpage_subscriptions(?, ?, ?, ?)", user.Id, isAdmin, 0, 1).Scan(&subscriptions); result.Error != nil {
-		if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
-		}
+	subscriptions, err := repo.Discussions().GetFrontPage(repository.FrontPageViewSubscriptions, user.Id, user.IsAdmin, 0, 1)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
 	unreadSubs := make([]*model.FrontPageEntry, 0)
@@ -691,11 +664,11 @@ func CheckSubscriptions(user *model.User, db *gorm.DB) []*model.FrontPageEntry {
 		}
 	}
 
-	return unreadSubs
+	return unreadSubs, nil
 
 }
 
-func CreateUserHistory(eventType string, eventData string, targetUser *model.User, db *gorm.DB) {
+func CreateUserHistory(eventType string, eventData string, targetUser *model.User, repo repository.Repository) error {
 
 	history := model.UserHistory{
 		Version:     1,
@@ -705,8 +678,10 @@ func CreateUserHistory(eventType string, eventData string, targetUser *model.Use
 		UserId:      targetUser.Id,
 	}
 
-	if result := db.Table("user_history").Create(&history); result.Error != nil {
-		panic(result.Error)
+	if err := repo.Users().CreateHistory(&history); err != nil {
+		return utils.InternalError(err)
 	}
 
+	return nil
+
 }
@@ -19,17 +19,22 @@ import (
 	"errors"
 	"justthetalk/connections"
 	"justthetalk/model"
+	"justthetalk/repository"
+	"justthetalk/repository/storedproc"
 	"justthetalk/utils"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gorm.io/gorm"
 )
 
 func TestValidUserLogin(t *testing.T) {
 
-	userCache := NewUserCache()
+	requireDatabase(t)
+
+	userCache := NewUserCache(testProvider)
 
 	credentials := model.LoginCredentials{
 		Username: "testuser1",
@@ -38,12 +43,15 @@ func TestValidUserLogin(t *testing.T) {
 
 	connections.WithDatabase(10*time.Second, func(db *gorm.DB) {
 
+		repo := storedproc.New(db)
+
 		var count1 int64
 		var count2 int64
 
 		db.Table("login_history").Count(&count1)
 
-		user := ValidateUserLogin(credentials, "8.8.8.8", db, userCache)
+		user, err := ValidateUserLogin(credentials, "8.8.8.8", repo, userCache)
+		require.NoError(t, err)
 		if user == nil || user.Id != 5540 {
 			t.Error("User not found")
 		}
@@ -59,49 +67,43 @@ func TestValidUserLogin(t *testing.T) {
 
 func TestInvalidUserLogin(t *testing.T) {
 
-	defer func() {
-		if r := recover(); r != nil {
-			err := r.(error)
-			switch {
-			case errors.Is(err, utils.ErrUnauthorised):
-				t.Log("Got unauthorised")
-			default:
-				t.Error(err)
-			}
-		}
-	}()
+	requireDatabase(t)
 
-	userCache := NewUserCache()
+	userCache := NewUserCache(testProvider)
 
 	credentials := model.LoginCredentials{
 		Username: "testuser1",
 		Password: "xxxxxx",
 	}
 
-	connections.WithDatabase(1*time.Second, func(db *gorm.DB) {
-		ValidateUserLogin(credentials, "8.8.8.8", db, userCache)
+	testProvider.WithRepository(1*time.Second, func(repo repository.Repository) {
+		_, err := ValidateUserLogin(credentials, "8.8.8.8", repo, userCache)
+		assert.ErrorIs(t, err, utils.ErrUnauthorised)
 	})
 
-	t.Error("Expecting a panic here")
-
 }
 
 func TestCreateUser(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestConfirmUser(t *testing.T) {
 
+	requireDatabase(t)
+
 	assert := assert.New(t)
 
 	key := "50926866-aa8b-4751-b173-ae57b3d9eb7f"
-	userCache := NewUserCache()
+	userCache := NewUserCache(testProvider)
 	connections.WithDatabase(300*time.Second, func(db *gorm.DB) {
 
+		repo := storedproc.New(db)
+
 		t.Run("should fail if expired", func(t *testing.T) {
 			res := db.Exec("update signup_confirmation set created_date = date_add(now(), interval -7 day), ip_address = null where confirmation_key = ?;", key)
 			if assert.NoError(res.Error) {
-				_, err := ValidateSignupConfirmationKey(key, "8.8.8.8", userCache, db)
+				_, err := ValidateSignupConfirmationKey(key, "8.8.8.8", userCache, repo)
 				assert.ErrorIs(err, utils.ErrExpired)
 			}
 		})
@@ -109,7 +111,7 @@ func TestConfirmUser(t *testing.T) {
 		t.Run("should succeed", func(t *testing.T) {
 			res := db.Exec("update signup_confirmation set created_date = date_add(now(), interval -1 day), ip_address = null where confirmation_key = ?;", key)
 			if assert.NoError(res.Error) {
-				user, err := ValidateSignupConfirmationKey(key, "8.8.8.8", userCache, db)
+				user, err := ValidateSignupConfirmationKey(key, "8.8.8.8", userCache, repo)
 				if assert.NoError(err) {
 					assert.Equal(uint(5533), user.Id)
 				}
@@ -117,7 +119,7 @@ func TestConfirmUser(t *testing.T) {
 		})
 
 		t.Run("cannot be re-run", func(t *testing.T) {
-			_, err := ValidateSignupConfirmationKey(key, "8.8.8.8", userCache, db)
+			_, err := ValidateSignupConfirmationKey(key, "8.8.8.8", userCache, repo)
 			assert.ErrorIs(err, utils.ErrBadRequest)
 		})
 
@@ -127,72 +129,60 @@ func TestConfirmUser(t *testing.T) {
 
 func TestConfirmUserExpired(t *testing.T) {
 
-	defer func() {
-		if r := recover(); r != nil {
-			err := r.(error)
-			switch {
-			case errors.Is(err, utils.ErrExpired):
-				t.Log("Got expired")
-			default:
-				t.Error(err)
-			}
-		}
-	}()
+	requireDatabase(t)
 
 	key := "58ffca03-3f5c-4e64-bfbe-ba22357b68a4"
-	userCache := NewUserCache()
-	connections.WithDatabase(60*time.Second, func(db *gorm.DB) {
-		ValidateSignupConfirmationKey(key, "8.8.8.8", userCache, db)
-		t.Error("Should have failed")
+	userCache := NewUserCache(testProvider)
+	testProvider.WithRepository(60*time.Second, func(repo repository.Repository) {
+		_, err := ValidateSignupConfirmationKey(key, "8.8.8.8", userCache, repo)
+		assert.ErrorIs(t, err, utils.ErrExpired)
 	})
 
 }
 
 func TestConfirmUserAlreadyUsed(t *testing.T) {
 
-	defer func() {
-		if r := recover(); r != nil {
-			err := r.(error)
-			switch {
-			case errors.Is(err, utils.ErrBadRequest):
-				t.Log("Got bad request")
-			default:
-				t.Error(err)
-			}
-		}
-	}()
+	requireDatabase(t)
 
 	key := "50926866-aa8b-4751-b173-ae57b3d9eb7f"
-	userCache := NewUserCache()
-	connections.WithDatabase(60*time.Second, func(db *gorm.DB) {
-		ValidateSignupConfirmationKey(key, "8.8.8.8", userCache, db)
+	userCache := NewUserCache(testProvider)
+	testProvider.WithRepository(60*time.Second, func(repo repository.Repository) {
+		_, err := ValidateSignupConfirmationKey(key, "8.8.8.8", userCache, repo)
+		assert.ErrorIs(t, err, utils.ErrBadRequest)
 	})
 
 }
 
 func TestCreateUserFailsWithGarbageParams(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestCreateReport(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestCreateReportFailsIfPostAlreadyReported(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestCreateReportCreatesUserHistory(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestGetOtherUser(t *testing.T) {
 
-	userCache := NewUserCache()
+	requireDatabase(t)
+
+	userCache := NewUserCache(testProvider)
 	userId := uint(50)
 
-	connections.WithDatabase(1*time.Second, func(db *gorm.DB) {
-		user := GetOtherUser(userId, db, userCache)
+	testProvider.WithRepository(1*time.Second, func(repo repository.Repository) {
+		user, err := GetOtherUser(userId, repo, userCache)
+		require.NoError(t, err)
 		if user == nil {
 			t.Error("Failed to get user")
 		} else if !(user.UserId == 50 && user.Username == "johnnythesailor") {
@@ -204,41 +194,43 @@ func TestGetOtherUser(t *testing.T) {
 
 func TestSetUnsetFolderSubscription(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, folderCache, discussionCache := newTestCaches(t)
 
 	userId := uint(5540)
-	user := userCache.Get(userId)
+	user := getTestUser(t, userCache, userId)
 
 	folderId := uint(1)
-	folder := folderCache.Get(folderId, user)
+	folder := getTestFolder(t, folderCache, folderId, user)
 
 	discussionId := uint(1)
-	discussion := discussionCache.Get(discussionId, user)
+	discussion := getTestDiscussion(t, discussionCache, discussionId, user)
 
-	connections.WithDatabase(1*time.Second, func(db *gorm.DB) {
+	testProvider.WithRepository(1*time.Second, func(repo repository.Repository) {
 
-		SetDiscussionSubscriptionStatus(discussion, user, db, userCache)
-		subscribed := GetDiscussionSubscriptionStatus(discussion, user, db)
+		require.NoError(t, SetDiscussionSubscriptionStatus(discussion, user, repo, userCache))
+		subscribed, err := GetDiscussionSubscriptionStatus(discussion, user, repo)
+		require.NoError(t, err)
 		if !subscribed {
 			t.Error("Subscription not set")
 		}
 
-		UnsetDiscussionSubscriptionStatus(discussion, user, db, userCache)
-		subscribed = GetDiscussionSubscriptionStatus(discussion, user, db)
+		require.NoError(t, UnsetDiscussionSubscriptionStatus(discussion, user, repo, userCache))
+		subscribed, err = GetDiscussionSubscriptionStatus(discussion, user, repo)
+		require.NoError(t, err)
 		if subscribed {
 			t.Error("Subscription set")
 		}
 
-		SetFolderSubscriptionStatus(folder, user, db, userCache)
-		subscribed = GetFolderSubscriptionStatus(folder, user, db)
+		require.NoError(t, SetFolderSubscriptionStatus(folder, user, repo, userCache))
+		subscribed, err = GetFolderSubscriptionStatus(folder, user, repo)
+		require.NoError(t, err)
 		if !subscribed {
 			t.Error("Subscription not set")
 		}
 
-		UnsetFolderSubscriptionStatus(folder, user, db, userCache)
-		subscribed = GetFolderSubscriptionStatus(folder, user, db)
+		require.NoError(t, UnsetFolderSubscriptionStatus(folder, user, repo, userCache))
+		subscribed, err = GetFolderSubscriptionStatus(folder, user, repo)
+		require.NoError(t, err)
 		if !subscribed {
 			t.Error("Subscription not unset")
 		}
@@ -248,45 +240,41 @@ func TestSetUnsetFolderSubscription(t *testing.T) {
 }
 func TestSetUnsetDiscussionSubscription(t *testing.T) {
 
-	folderCache := NewFolderCache()
-
-	userCache := NewUserCache()
-
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, _, discussionCache := newTestCaches(t)
 
 	userId := uint(5540)
-	user := userCache.Get(userId)
+	user := getTestUser(t, userCache, userId)
 
 	discussionId := uint(2801)
-	discussion := discussionCache.Get(discussionId, user)
+	discussion := getTestDiscussion(t, discussionCache, discussionId, user)
 
-	connections.WithDatabase(60*time.Second, func(db *gorm.DB) {
+	testProvider.WithRepository(60*time.Second, func(repo repository.Repository) {
 
-		SetDiscussionSubscriptionStatus(discussion, user, db, userCache)
-		UnsetDiscussionSubscriptionStatus(discussion, user, db, userCache)
+		require.NoError(t, SetDiscussionSubscriptionStatus(discussion, user, repo, userCache))
+		require.NoError(t, UnsetDiscussionSubscriptionStatus(discussion, user, repo, userCache))
 
 	})
 
 }
 func TestGetUserSubscriptionStatus(t *testing.T) {
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, _, discussionCache := newTestCaches(t)
 
-	user := userCache.Get(50)
+	user := getTestUser(t, userCache, 50)
 
-	connections.WithDatabase(60*time.Second, func(db *gorm.DB) {
-		discussion := discussionCache.Get(2494, user)
-		subscribed := GetDiscussionSubscriptionStatus(discussion, user, db)
+	testProvider.WithRepository(60*time.Second, func(repo repository.Repository) {
+		discussion := getTestDiscussion(t, discussionCache, 2494, user)
+		subscribed, err := GetDiscussionSubscriptionStatus(discussion, user, repo)
+		require.NoError(t, err)
 		if !subscribed {
 			t.Error("Not subscribed")
 		}
 	})
 
-	connections.WithDatabase(60*time.Second, func(db *gorm.DB) {
-		discussion := discussionCache.Get(2495, user)
-		subscribed := GetDiscussionSubscriptionStatus(discussion, user, db)
+	testProvider.WithRepository(60*time.Second, func(repo repository.Repository) {
+		discussion := getTestDiscussion(t, discussionCache, 2495, user)
+		subscribed, err := GetDiscussionSubscriptionStatus(discussion, user, repo)
+		require.NoError(t, err)
 		if subscribed {
 			t.Error("Subscribed")
 		}
@@ -296,14 +284,17 @@ func TestGetUserSubscriptionStatus(t *testing.T) {
 
 func TestGetFolderSubscriptions(t *testing.T) {
 
-	userCache := NewUserCache()
+	requireDatabase(t)
+
+	userCache := NewUserCache(testProvider)
 
 	userId := uint(50)
-	user := userCache.Get(userId)
+	user := getTestUser(t, userCache, userId)
 	//	var subs []*model.FolderSubscription
 
-	connections.WithDatabase(1*time.Second, func(db *gorm.DB) {
-		results := GetFolderSubscriptions(user, db)
+	testProvider.WithRepository(1*time.Second, func(repo repository.Repository) {
+		results, err := GetFolderSubscriptions(user, repo)
+		require.NoError(t, err)
 		if len(results) == 0 {
 			t.Error("No subs found")
 		}
@@ -313,13 +304,16 @@ func TestGetFolderSubscriptions(t *testing.T) {
 
 func TestGetFolderSubscriptionExceptions(t *testing.T) {
 
-	userCache := NewUserCache()
+	requireDatabase(t)
+
+	userCache := NewUserCache(testProvider)
 
 	userId := uint(50)
-	user := userCache.Get(userId)
+	user := getTestUser(t, userCache, userId)
 
-	connections.WithDatabase(1*time.Second, func(db *gorm.DB) {
-		results := GetFolderSubscriptionExcepions(user, db)
+	testProvider.WithRepository(1*time.Second, func(repo repository.Repository) {
+		results, err := GetFolderSubscriptionExcepions(user, repo)
+		require.NoError(t, err)
 		if len(results) == 0 {
 			t.Error("No subs exceptions found")
 		}
@@ -329,22 +323,23 @@ func TestGetFolderSubscriptionExceptions(t *testing.T) {
 
 func TestUpdateFolderSubscriptions(t *testing.T) {
 
-	folderCache := NewFolderCache()
-	userCache := NewUserCache()
+	userCache, folderCache, _ := newTestCaches(t)
 
 	userId := uint(5540)
-	user := userCache.Get(userId)
+	user := getTestUser(t, userCache, userId)
 
 	subscriptions := []uint{1, 2, 3}
 
-	connections.WithDatabase(1*time.Second, func(db *gorm.DB) {
-		result := UpdateFolderSubscriptions(subscriptions, user, db, userCache, folderCache)
+	testProvider.WithRepository(1*time.Second, func(repo repository.Repository) {
+		result, err := UpdateFolderSubscriptions(subscriptions, user, repo, userCache, folderCache)
+		require.NoError(t, err)
 		if len(result) != 3 {
 			t.Error("Not all subscriptions created")
 		}
 
 		subscriptions = []uint{}
-		result = UpdateFolderSubscriptions(subscriptions, user, db, userCache, folderCache)
+		result, err = UpdateFolderSubscriptions(subscriptions, user, repo, userCache, folderCache)
+		require.NoError(t, err)
 		if len(result) != 0 {
 			t.Error("Not all subscriptions deleted")
 		}
@@ -354,23 +349,25 @@ func TestUpdateFolderSubscriptions(t *testing.T) {
 
 func TestUpdateIgnore(t *testing.T) {
 
-	userCache := NewUserCache()
+	requireDatabase(t)
+
+	userCache := NewUserCache(testProvider)
 	userId := uint(50)
-	user := userCache.Get(userId)
+	user := getTestUser(t, userCache, userId)
 	otherUserId := uint(5540)
 
-	connections.WithDatabase(1*time.Second, func(db *gorm.DB) {
-		UpdateIgnore(user, otherUserId, 0, db, userCache)
+	testProvider.WithRepository(1*time.Second, func(repo repository.Repository) {
+		require.NoError(t, UpdateIgnore(user, otherUserId, 0, repo, userCache))
 		if _, exists := user.IgnoredUsers[otherUserId]; exists {
 			t.Error("Should not have user in ignore state")
 		}
 
-		UpdateIgnore(user, otherUserId, 1, db, userCache)
+		require.NoError(t, UpdateIgnore(user, otherUserId, 1, repo, userCache))
 		if _, exists := user.IgnoredUsers[otherUserId]; !exists {
 			t.Error("Should have user in ignore state")
 		}
 
-		UpdateIgnore(user, otherUserId, 0, db, userCache)
+		require.NoError(t, UpdateIgnore(user, otherUserId, 0, repo, userCache))
 		if _, exists := user.IgnoredUsers[otherUserId]; exists {
 			t.Error("Should not have user in ignore state after add + remove")
 		}
@@ -380,20 +377,25 @@ func TestUpdateIgnore(t *testing.T) {
 
 func TestForgotPasswordWithValidEmail(t *testing.T) {
 
+	requireDatabase(t)
+
 	credentials := model.LoginCredentials{
 		Email: "john@johndudmesh.com",
 	}
 
-	userCache := NewUserCache()
+	userCache := NewUserCache(testProvider)
 
 	connections.WithDatabase(30*time.Second, func(db *gorm.DB) {
 
+		repo := storedproc.New(db)
+
 		var count1 int64
 		var count2 int64
 
 		db.Table("password_reset").Count(&count1)
 
-		request := ForgotPassword(&credentials, "8.8.8.8", userCache, db)
+		request, err := ForgotPassword(&credentials, "8.8.8.8", userCache, repo)
+		require.NoError(t, err)
 		if request == nil {
 			t.Error("user not found")
 		}
@@ -409,20 +411,25 @@ func TestForgotPasswordWithValidEmail(t *testing.T) {
 
 func TestForgotPasswordWithInvalidEmail(t *testing.T) {
 
+	requireDatabase(t)
+
 	credentials := model.LoginCredentials{
 		Email: "john@nobody.com",
 	}
 
-	userCache := NewUserCache()
+	userCache := NewUserCache(testProvider)
 
 	connections.WithDatabase(30*time.Second, func(db *gorm.DB) {
 
+		repo := storedproc.New(db)
+
 		var count1 int64
 		var count2 int64
 
 		db.Table("password_reset").Count(&count1)
 
-		request := ForgotPassword(&credentials, "8.8.8.8", userCache, db)
+		request, err := ForgotPassword(&credentials, "8.8.8.8", userCache, repo)
+		require.NoError(t, err)
 		if request != nil {
 			t.Error("Unexpected user")
 		}
@@ -438,21 +445,24 @@ func TestForgotPasswordWithInvalidEmail(t *testing.T) {
 
 func TestValidatePasswordResetKeySuccess(t *testing.T) {
 
+	requireDatabase(t)
+
 	credentials := model.LoginCredentials{
 		Email: "john@johndudmesh.com",
 	}
 
-	userCache := NewUserCache()
+	userCache := NewUserCache(testProvider)
 
-	connections.WithDatabase(30*time.Second, func(db *gorm.DB) {
+	testProvider.WithRepository(30*time.Second, func(repo repository.Repository) {
 
-		request := ForgotPassword(&credentials, "8.8.8.8", userCache, db)
+		request, err := ForgotPassword(&credentials, "8.8.8.8", userCache, repo)
+		require.NoError(t, err)
 		if request == nil {
 			t.Error("user not found")
 			return
 		}
 
-		user, _ := ValidatePasswordResetKey(request.ResetKey, userCache, db)
+		user, _ := ValidatePasswordResetKey(request.ResetKey, userCache, repo)
 		if user == nil || user.Id != request.UserId {
 			t.Error("User not returned or invalid")
 		}
@@ -462,23 +472,14 @@ func TestValidatePasswordResetKeySuccess(t *testing.T) {
 
 func TestValidatePasswordResetKeyFail(t *testing.T) {
 
-	defer func() {
-		if r := recover(); r != nil {
-			err := r.(error)
-			switch {
-			case errors.Is(err, utils.ErrBadRequest):
-				t.Log("Got bad request")
-			default:
-				t.Error(err)
-			}
-		}
-	}()
+	requireDatabase(t)
 
-	userCache := NewUserCache()
+	userCache := NewUserCache(testProvider)
 
-	connections.WithDatabase(30*time.Second, func(db *gorm.DB) {
+	testProvider.WithRepository(30*time.Second, func(repo repository.Repository) {
 
-		user, _ := ValidatePasswordResetKey("11111111-1111-1111-1111-111111111111", userCache, db)
+		user, err := ValidatePasswordResetKey("11111111-1111-1111-1111-111111111111", userCache, repo)
+		assert.ErrorIs(t, err, utils.ErrBadRequest)
 		if user != nil {
 			t.Error("Unexpected user")
 		}
@@ -489,23 +490,14 @@ func TestValidatePasswordResetKeyFail(t *testing.T) {
 
 func TestValidatePasswordResetKeyExpired(t *testing.T) {
 
-	defer func() {
-		if r := recover(); r != nil {
-			err := r.(error)
-			switch {
-			case errors.Is(err, utils.ErrExpired):
-				t.Log("Got expired")
-			default:
-				t.Error(err)
-			}
-		}
-	}()
+	requireDatabase(t)
 
-	userCache := NewUserCache()
+	userCache := NewUserCache(testProvider)
 
-	connections.WithDatabase(30*time.Second, func(db *gorm.DB) {
+	testProvider.WithRepository(30*time.Second, func(repo repository.Repository) {
 
-		user, _ := ValidatePasswordResetKey("696f4adf-39ab-4e9a-905d-8c5412962c09", userCache, db)
+		user, err := ValidatePasswordResetKey("696f4adf-39ab-4e9a-905d-8c5412962c09", userCache, repo)
+		assert.ErrorIs(t, err, utils.ErrExpired)
 		if user != nil {
 			t.Error("Unexpected user")
 		}
@@ -516,57 +508,56 @@ func TestValidatePasswordResetKeyExpired(t *testing.T) {
 
 func TestUpdateUserPasswordSuccess(t *testing.T) {
 
+	requireDatabase(t)
+
 	updateData := model.UserOptionsUpdateData{
 		OldPassword: "password",
 		NewPassword: "password",
 	}
 
-	userCache := NewUserCache()
-	user := userCache.Get(1777)
-	connections.WithDatabase(30*time.Second, func(db *gorm.DB) {
-		UpdatePassword(user, &updateData, userCache, db)
+	userCache := NewUserCache(testProvider)
+	user := getTestUser(t, userCache, 1777)
+	testProvider.WithRepository(30*time.Second, func(repo repository.Repository) {
+		_, err := UpdatePassword(user, &updateData, userCache, repo)
+		assert.NoError(t, err)
 	})
 
 }
 
 func TestUpdateUserPasswordFailure(t *testing.T) {
 
-	defer func() {
-		if r := recover(); r != nil {
-			err := r.(error)
-			switch {
-			case errors.Is(err, utils.ErrUnauthorised):
-				t.Log("Got unauthorised")
-			default:
-				t.Error(err)
-			}
-		}
-	}()
+	requireDatabase(t)
 
 	updateData := model.UserOptionsUpdateData{
 		OldPassword: "wrong_password",
 		NewPassword: "password",
 	}
 
-	userCache := NewUserCache()
-	user := userCache.Get(1777)
-	connections.WithDatabase(30*time.Second, func(db *gorm.DB) {
-		UpdatePassword(user, &updateData, userCache, db)
+	userCache := NewUserCache(testProvider)
+	user := getTestUser(t, userCache, 1777)
+	testProvider.WithRepository(30*time.Second, func(repo repository.Repository) {
+		_, err := UpdatePassword(user, &updateData, userCache, repo)
+		assert.ErrorIs(t, err, utils.ErrUnauthorised)
 	})
 
 }
 
 func TestUpdateUserPasswordWithKeySuccess(t *testing.T) {
 
+	requireDatabase(t)
+
 	credentials := model.LoginCredentials{
 		Email: "john@johndudmesh.com",
 	}
 
-	userCache := NewUserCache()
-	user := userCache.Get(1777)
+	userCache := NewUserCache(testProvider)
+	user := getTestUser(t, userCache, 1777)
 	connections.WithDatabase(30*time.Second, func(db *gorm.DB) {
 
-		request := ForgotPassword(&credentials, "8.8.8.8", userCache, db)
+		repo := storedproc.New(db)
+
+		request, err := ForgotPassword(&credentials, "8.8.8.8", userCache, repo)
+		require.NoError(t, err)
 		if request == nil {
 			t.Error("user not found")
 			return
@@ -578,7 +569,8 @@ func TestUpdateUserPasswordWithKeySuccess(t *testing.T) {
 			NewPassword: "password",
 		}
 
-		UpdatePassword(user, &updateData, userCache, db)
+		_, err = UpdatePassword(user, &updateData, userCache, repo)
+		assert.NoError(t, err)
 
 		var deletedRequest model.PasswordResetRequest
 		if result := db.Table("password_reset").Where("reset_key = ?", request.ResetKey).Take(&deletedRequest); result.Error == nil || !errors.Is(result.Error, gorm.ErrRecordNotFound) {
@@ -594,33 +586,39 @@ func TestUpdateUserPasswordWithKeySuccess(t *testing.T) {
 
 func TestGetDiscussionBookmark(t *testing.T) {
 
+	requireDatabase(t)
+
 	assert := assert.New(t)
 
-	userCache := NewUserCache()
-	folderCache := NewFolderCache()
-	discussionCache := NewDiscussionCache(folderCache)
+	userCache, _, discussionCache := newTestCaches(t)
 
-	connections.WithDatabase(30*time.Second, func(db *gorm.DB) {
+	testProvider.WithRepository(30*time.Second, func(repo repository.Repository) {
 
 		t.Run("no bookmark for nil user", func(t *testing.T) {
-			discussion := discussionCache.UnsafeGet(2494)
-			bookmark := GetDiscussionBookmark(nil, discussion, db)
+			discussion, err := discussionCache.UnsafeGet(2494)
+			require.NoError(t, err)
+			bookmark, err := GetDiscussionBookmark(nil, discussion, repo)
+			require.NoError(t, err)
 			assert.Nil(bookmark)
 		})
 
 		t.Run("bookmark for user that exists", func(t *testing.T) {
-			user := userCache.Get(50)
-			discussion := discussionCache.UnsafeGet(33785)
-			bookmark := GetDiscussionBookmark(user, discussion, db)
+			user := getTestUser(t, userCache, 50)
+			discussion, err := discussionCache.UnsafeGet(33785)
+			require.NoError(t, err)
+			bookmark, err := GetDiscussionBookmark(user, discussion, repo)
+			require.NoError(t, err)
 			if assert.NotNil(bookmark) {
 				assert.NotZero(bookmark.Id)
 			}
 		})
 
 		t.Run("no bookmark for user on unread discussion", func(t *testing.T) {
-			user := userCache.Get(50)
-			discussion := discussionCache.UnsafeGet(110)
-			bookmark := GetDiscussionBookmark(user, discussion, db)
+			user := getTestUser(t, userCache, 50)
+			discussion, err := discussionCache.UnsafeGet(110)
+			require.NoError(t, err)
+			bookmark, err := GetDiscussionBookmark(user, discussion, repo)
+			require.NoError(t, err)
 			assert.Nil(bookmark)
 		})
 
@@ -3,154 +3,109 @@ package main
 import (
 	"fmt"
 	"justthetalk/businesslogic"
+	"justthetalk/config"
 	"justthetalk/connections"
 	"justthetalk/model"
-	"justthetalk/utils"
+	"justthetalk/repository"
+	"justthetalk/repository/storedproc"
 	"os"
-	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"gorm.io/gorm"
 )
 
 func main() {
 
-	logLevel := log.InfoLevel
-	logLevelEnv := os.Getenv("LOG_LEVEL")
-	switch logLevelEnv {
-	case "DEBUG":
-		logLevel = log.DebugLevel
-	case "WARN":
-		logLevel = log.WarnLevel
-	case "ERROR":
-		logLevel = log.ErrorLevel
-	}
-	log.SetLevel(logLevel)
-
-	log.Info("Starting JustTheTalk API Server...")
-
-	if secret := os.Getenv("RECAPTCHA_API_KEY"); len(secret) == 0 {
-		log.Fatal("Recaptcha key missing")
-	}
-
-	dbHost := "localhost"
-	dbPort := "3306"
-	redisHost := "localhost"
-	redisPort := "6379"
-	elasticsearchHosts := []string{"http://localhost:9200"}
-
-	if value, exists := os.LookupEnv("DB_HOST"); exists {
-		dbHost = value
-	}
-
-	if value, exists := os.LookupEnv("DB_PORT"); exists {
-		dbPort = value
+	cfg, err := config.Load(os.Getenv(config.ConfigFileEnvVar))
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if value, exists := os.LookupEnv("REDIS_HOST"); exists {
-		redisHost = value
-	}
+	cfg.SetupLogging()
 
-	if value, exists := os.LookupEnv("REDIS_PORT"); exists {
-		redisPort = value
-	}
+	log.Info("Starting JustTheTalk API Server...")
 
-	if value, exists := os.LookupEnv("ELASTICSEARCH_HOSTS"); exists {
-		elasticsearchHosts = strings.Split(value, ",")
+	if err := connections.OpenConnections(cfg); err != nil {
+		log.Fatalf("Opening connections: %v", err)
 	}
 
-	connections.OpenConnections(dbHost, dbPort, redisHost, redisPort, elasticsearchHosts)
-	CleanModQueue(connections.DatabaseConnection())
-
-}
+	CleanModQueue(businesslogic.NewModerationPolicy(cfg.Moderation), storedproc.New(connections.DatabaseConnection()))
 
-type ModerationQueueEntry struct {
-	Id          uint      `json:"id" gorm:"column:id;primaryKey"`
-	Version     uint      `json:"version" gorm:"column:version"`
-	CreatedDate time.Time `json:"createdDate" gorm:"column:created_date"`
-	PostId      uint      `gorm:"post_id"`
 }
 
-func CleanModQueue(db *gorm.DB) {
+func CleanModQueue(policy *businesslogic.ModerationPolicy, repo repository.Repository) {
 	log.Info("Starting queue cleaner...")
 
-	rows, err := db.Raw("select * from moderation_queue").Rows()
+	entries, err := repo.Moderation().GetQueueEntries()
 	if err != nil {
 		log.Errorf("Getting rows: %+v", err)
 		return
 	}
 
-	defer rows.Close()
-
 	rowCounter := 0
-	for rows.Next() {
+	for _, entry := range entries {
+
 		rowCounter += 1
 		if rowCounter%25 == 0 {
 			log.Infof("Row: %d", rowCounter)
 		}
 
-		var entry ModerationQueueEntry
-		db.ScanRows(rows, &entry)
-
-		post, err := businesslogic.GetPost(entry.PostId, db)
-		if err != nil {
-			log.Error(err)
-			result := db.Exec("delete from moderation_queue where id = ?", entry.Id)
-			if result.Error != nil {
-				log.Error(result.Error)
-			}
-			continue
+		if err := cleanQueueEntry(entry, policy, repo); err != nil {
+			log.Errorf("Cleaning entry %d: %v", entry.Id, err)
 		}
 
-		user := model.User{}
-		if result := db.Raw("call get_user(?)", post.CreatedByUserId).First(&user); result.Error != nil {
-			utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
-		}
+	}
+	log.Infof("Row: %d", rowCounter)
 
-		comments := businesslogic.GetCommentsByPost(entry.PostId, db)
-		reports := businesslogic.GetReportsByPost(entry.PostId, db)
+	if err := repo.Moderation().PurgeQueue(time.Now().AddDate(0, 0, -30)); err != nil {
+		log.Errorf("Purging queue: %v", err)
+	}
 
-		if len(comments) == 0 && len(reports) == 0 && !user.IsPremoderate {
-			result := db.Exec("delete from moderation_queue where id = ?", entry.Id)
-			if result.Error != nil {
-				log.Error(result.Error)
-			}
-			continue
-		}
+	log.Info("...completed queue cleaner")
+}
 
-		totalVote := 0
-		for _, comment := range comments {
-			totalVote += comment.Vote
-		}
+func cleanQueueEntry(entry *model.ModerationQueueEntry, policy *businesslogic.ModerationPolicy, repo repository.Repository) error {
 
-		moderationThreshold := 2
-		if post.Status == model.PostStatusSuspendedByAdmin || post.Status == model.PostStatusWatch {
-			moderationThreshold = 1
-		}
+	post, err := businesslogic.GetPost(entry.PostId, repo)
+	if err != nil {
+		log.Error(err)
+		return repo.Moderation().DeleteQueueEntry(entry.Id)
+	}
+
+	user, err := repo.Users().Get(post.CreatedByUserId)
+	if err != nil {
+		return fmt.Errorf("fetching user: %w", err)
+	}
+
+	comments, err := businesslogic.GetCommentsByPost(entry.PostId, repo)
+	if err != nil {
+		return err
+	}
 
-		if utils.Abs(totalVote) >= moderationThreshold {
+	reports, err := businesslogic.GetReportsByPost(entry.PostId, repo)
+	if err != nil {
+		return err
+	}
 
-			var result string
-			if totalVote < 0 {
-				post.Status = model.PostStatusDeletedByAdmin
-				result = "DELETE"
-			} else {
-				post.Status = model.PostStatusOK
-				result = "KEEP"
-			}
+	if len(comments) == 0 && len(reports) == 0 && !user.IsPremoderate {
+		return repo.Moderation().DeleteQueueEntry(entry.Id)
+	}
 
-			businesslogic.CreateUserHistory(model.UserHistoryAdminPostModerated, fmt.Sprintf("PostId: %d, %s", post.Id, result), &user, db)
+	discussion, err := repo.Discussions().Get(post.DiscussionId)
+	if err != nil {
+		return fmt.Errorf("fetching discussion: %w", err)
+	}
 
-			if result := db.Raw("call set_post_status(?, ?, ?, ?)", post.DiscussionId, post.Id, post.Status, totalVote).First(post); result.Error != nil {
-				utils.PanicWithWrapper(result.Error, utils.ErrInternalError)
-			}
-		}
+	folder, err := repo.Folders().Get(discussion.FolderId)
+	if err != nil {
+		return fmt.Errorf("fetching folder: %w", err)
+	}
 
+	decision := policy.Decide(folder, post, comments, entry.CreatedDate, time.Now().UTC())
+	if _, err := businesslogic.ApplyModerationDecision(decision, post, user, repo); err != nil {
+		return fmt.Errorf("settling post: %w", err)
 	}
-	log.Infof("Row: %d", rowCounter)
 
-	db.Exec("delete from moderation_queue where datediff(now(), created_date) > 30")
+	return nil
 
-	log.Info("...completed queue cleaner")
 }
@@ -0,0 +1,582 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	PlatformProduction  = "PRODUCTION"
+	PlatformDevelopment = "DEVELOPMENT"
+
+	SearchBackendElasticsearch = "elasticsearch"
+	SearchBackendEmbedded      = "embedded"
+
+	DuplicateDiscussionsOff   = "off"
+	DuplicateDiscussionsWarn  = "warn"
+	DuplicateDiscussionsBlock = "block"
+
+	ModerationStatusOK        = "ok"
+	ModerationStatusSuspended = "suspended"
+	ModerationStatusAdmin     = "admin"
+	ModerationStatusWatch     = "watch"
+
+	ConfigFileEnvVar = "CONFIG_FILE"
+
+	minSigningKeyLength = 32
+	redacted            = "********"
+)
+
+// Secret holds a credential. It prints as a fixed mask so that a Config can be
+// logged or marshalled without leaking passwords and keys.
+type Secret string
+
+func (s Secret) String() string {
+	if len(s) == 0 {
+		return ""
+	}
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(s.String())), nil
+}
+
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+func (s Secret) Value() string {
+	return string(s)
+}
+
+type ServerConfig struct {
+	ListenAddress   string        `yaml:"listenAddress"`
+	Domain          string        `yaml:"domain"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+}
+
+type AuthConfig struct {
+	SigningKey      Secret `yaml:"signingKey"`
+	RecaptchaApiKey Secret `yaml:"recaptchaApiKey"`
+}
+
+type DatabaseConfig struct {
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	User     string `yaml:"user"`
+	Password Secret `yaml:"password"`
+	Name     string `yaml:"name"`
+}
+
+func (c DatabaseConfig) DSN() string {
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=UTC", c.User, c.Password.Value(), c.Host, c.Port, c.Name)
+}
+
+type RedisConfig struct {
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	Password Secret `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
+
+func (c RedisConfig) Addr() string {
+	return fmt.Sprintf("%s:%s", c.Host, c.Port)
+}
+
+type SearchConfig struct {
+	Backend      string `yaml:"backend"`
+	EmbeddedPath string `yaml:"embeddedPath"`
+}
+
+type ElasticsearchConfig struct {
+	Hosts          []string `yaml:"hosts"`
+	ManageTemplate bool     `yaml:"manageTemplate"`
+}
+
+type MailConfig struct {
+	Host        string `yaml:"host"`
+	Port        int    `yaml:"port"`
+	Username    string `yaml:"username"`
+	Password    Secret `yaml:"password"`
+	FromAddress string `yaml:"fromAddress"`
+	FromName    string `yaml:"fromName"`
+	BccAddress  string `yaml:"bccAddress"`
+	BccName     string `yaml:"bccName"`
+}
+
+type WorkersConfig struct {
+	MostActiveInterval     time.Duration `yaml:"mostActiveInterval"`
+	SearchIndexJobInterval time.Duration `yaml:"searchIndexJobInterval"`
+	FolderActivityInterval time.Duration `yaml:"folderActivityInterval"`
+	// FolderActivityWindow is how far back posts count towards a folder's
+	// activity
+	FolderActivityWindow time.Duration `yaml:"folderActivityWindow"`
+	ContentScanInterval  time.Duration `yaml:"contentScanInterval"`
+	ContentScanBatchSize int           `yaml:"contentScanBatchSize"`
+	// ContentScanWindow is how far back a content scan looks when it isn't
+	// given dates, including the scan raised by a banned word change. Zero
+	// stops banned word changes raising a scan.
+	ContentScanWindow time.Duration `yaml:"contentScanWindow"`
+}
+
+type OutboxConfig struct {
+	PollInterval   time.Duration `yaml:"pollInterval"`
+	BatchSize      int           `yaml:"batchSize"`
+	MaxAttempts    int           `yaml:"maxAttempts"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+}
+
+// DiscussionCacheConfig sizes the in-process tier of the discussion cache,
+// which sits in front of the Redis tier shared by every instance. With
+// LegacyCompat set every read goes to the database, as the legacy site writes
+// to it without telling the cache.
+type DiscussionCacheConfig struct {
+	Size         int           `yaml:"size"`
+	LocalTTL     time.Duration `yaml:"localTTL"`
+	SharedTTL    time.Duration `yaml:"sharedTTL"`
+	LegacyCompat bool          `yaml:"legacyCompat"`
+}
+
+// DuplicateDiscussionsConfig controls what happens when a new discussion is
+// very like one started recently in the same folder. With warn the user must
+// confirm that they want to go ahead, with block they can't.
+type DuplicateDiscussionsConfig struct {
+	Action    string        `yaml:"action"`
+	Threshold float64       `yaml:"threshold"`
+	Window    time.Duration `yaml:"window"`
+}
+
+// ModerationConfig decides when the moderators' votes on a post settle it.
+// Once the votes add up to the threshold the post is kept, and once they add
+// up to minus the threshold it is deleted.
+type ModerationConfig struct {
+	Threshold int `yaml:"threshold"`
+	// FolderThresholds replace the threshold for the folders with these keys
+	FolderThresholds map[string]int `yaml:"folderThresholds"`
+	// StatusThresholds replace the folder's threshold for posts with these
+	// statuses: ok, suspended, admin or watch
+	StatusThresholds map[string]int `yaml:"statusThresholds"`
+	// RoleWeights count the vote of a moderator with one of these roles more
+	// than once. A moderator with several roles gets the largest weight.
+	RoleWeights map[string]int `yaml:"roleWeights"`
+	// Quorum is how many moderators must vote before a post is settled
+	Quorum int `yaml:"quorum"`
+	// KeepAfter keeps a post which has been in the queue this long without a
+	// vote. Zero leaves it there.
+	KeepAfter time.Duration `yaml:"keepAfter"`
+}
+
+type Config struct {
+	LogLevel      string              `yaml:"logLevel"`
+	Platform      string              `yaml:"platform"`
+	Server        ServerConfig        `yaml:"server"`
+	Auth          AuthConfig          `yaml:"auth"`
+	Database      DatabaseConfig      `yaml:"database"`
+	Redis         RedisConfig         `yaml:"redis"`
+	Search        SearchConfig        `yaml:"search"`
+	Elasticsearch ElasticsearchConfig `yaml:"elasticsearch"`
+	Mail          MailConfig          `yaml:"mail"`
+	Workers       WorkersConfig       `yaml:"workers"`
+	Outbox        OutboxConfig        `yaml:"outbox"`
+
+	DuplicateDiscussions DuplicateDiscussionsConfig `yaml:"duplicateDiscussions"`
+	DiscussionCache      DiscussionCacheConfig      `yaml:"discussionCache"`
+	Moderation           ModerationConfig           `yaml:"moderation"`
+}
+
+var logLevels = map[string]log.Level{
+	"DEBUG": log.DebugLevel,
+	"INFO":  log.InfoLevel,
+	"WARN":  log.WarnLevel,
+	"ERROR": log.ErrorLevel,
+}
+
+// Default returns the settings used for local development, before any file or
+// environment overrides are applied. It deliberately contains no credentials.
+func Default() *Config {
+	return &Config{
+		LogLevel: "INFO",
+		Platform: PlatformDevelopment,
+		Server: ServerConfig{
+			ListenAddress:   ":8080",
+			Domain:          "justthetalk.com",
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Database: DatabaseConfig{
+			Host: "localhost",
+			Port: "3306",
+			User: "notthetalk",
+			Name: "notthetalk",
+		},
+		Redis: RedisConfig{
+			Host: "localhost",
+			Port: "6379",
+		},
+		Search: SearchConfig{
+			Backend:      SearchBackendElasticsearch,
+			EmbeddedPath: "./data/search.log",
+		},
+		Elasticsearch: ElasticsearchConfig{
+			Hosts:          []string{"http://localhost:9200"},
+			ManageTemplate: true,
+		},
+		Workers: WorkersConfig{
+			MostActiveInterval:     5 * time.Minute,
+			SearchIndexJobInterval: 30 * time.Second,
+			FolderActivityInterval: 15 * time.Minute,
+			FolderActivityWindow:   7 * 24 * time.Hour,
+			ContentScanInterval:    time.Minute,
+			ContentScanBatchSize:   500,
+			ContentScanWindow:      30 * 24 * time.Hour,
+		},
+		Outbox: OutboxConfig{
+			PollInterval:   2 * time.Second,
+			BatchSize:      50,
+			MaxAttempts:    10,
+			InitialBackoff: 5 * time.Second,
+			MaxBackoff:     time.Hour,
+		},
+		DuplicateDiscussions: DuplicateDiscussionsConfig{
+			Action:    DuplicateDiscussionsWarn,
+			Threshold: 0.75,
+			Window:    14 * 24 * time.Hour,
+		},
+		DiscussionCache: DiscussionCacheConfig{
+			Size:      10000,
+			LocalTTL:  time.Minute,
+			SharedTTL: time.Hour,
+		},
+		Moderation: ModerationConfig{
+			Threshold: 2,
+			StatusThresholds: map[string]int{
+				ModerationStatusSuspended: 1,
+				ModerationStatusWatch:     1,
+			},
+			Quorum: 1,
+		},
+	}
+}
+
+// Load builds the configuration from the defaults, the YAML file at path (if
+// any) and then the environment, and validates the result
+func Load(path string) (*Config, error) {
+
+	cfg := Default()
+
+	if len(path) > 0 {
+		if err := cfg.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.ApplyEnvironment(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+
+}
+
+func (c *Config) LoadFile(path string) error {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	return nil
+
+}
+
+type envBinding struct {
+	name  string
+	apply func(c *Config, value string) error
+}
+
+func stringVar(name string, field func(c *Config) *string) envBinding {
+	return envBinding{name, func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+func secretVar(name string, field func(c *Config) *Secret) envBinding {
+	return envBinding{name, func(c *Config, value string) error {
+		*field(c) = Secret(value)
+		return nil
+	}}
+}
+
+func intVar(name string, field func(c *Config) *int) envBinding {
+	return envBinding{name, func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be an integer", name)
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func floatVar(name string, field func(c *Config) *float64) envBinding {
+	return envBinding{name, func(c *Config, value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a number", name)
+		}
+		*field(c) = f
+		return nil
+	}}
+}
+
+func boolVar(name string, field func(c *Config) *bool) envBinding {
+	return envBinding{name, func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false", name)
+		}
+		*field(c) = b
+		return nil
+	}}
+}
+
+func durationVar(name string, field func(c *Config) *time.Duration) envBinding {
+	return envBinding{name, func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration", name)
+		}
+		*field(c) = d
+		return nil
+	}}
+}
+
+func listVar(name string, field func(c *Config) *[]string) envBinding {
+	return envBinding{name, func(c *Config, value string) error {
+		*field(c) = strings.Split(value, ",")
+		return nil
+	}}
+}
+
+var envBindings = []envBinding{
+	stringVar("LOG_LEVEL", func(c *Config) *string { return &c.LogLevel }),
+	stringVar("PLATFORM", func(c *Config) *string { return &c.Platform }),
+	stringVar("LISTEN_ADDRESS", func(c *Config) *string { return &c.Server.ListenAddress }),
+	stringVar("DOMAIN", func(c *Config) *string { return &c.Server.Domain }),
+	durationVar("SHUTDOWN_TIMEOUT", func(c *Config) *time.Duration { return &c.Server.ShutdownTimeout }),
+	secretVar("SIGNING_KEY", func(c *Config) *Secret { return &c.Auth.SigningKey }),
+	secretVar("RECAPTCHA_API_KEY", func(c *Config) *Secret { return &c.Auth.RecaptchaApiKey }),
+	stringVar("DB_HOST", func(c *Config) *string { return &c.Database.Host }),
+	stringVar("DB_PORT", func(c *Config) *string { return &c.Database.Port }),
+	stringVar("DB_USER", func(c *Config) *string { return &c.Database.User }),
+	secretVar("DB_PASSWORD", func(c *Config) *Secret { return &c.Database.Password }),
+	stringVar("DB_NAME", func(c *Config) *string { return &c.Database.Name }),
+	stringVar("REDIS_HOST", func(c *Config) *string { return &c.Redis.Host }),
+	stringVar("REDIS_PORT", func(c *Config) *string { return &c.Redis.Port }),
+	secretVar("REDIS_PASSWORD", func(c *Config) *Secret { return &c.Redis.Password }),
+	intVar("REDIS_DB", func(c *Config) *int { return &c.Redis.DB }),
+	stringVar("SEARCH_BACKEND", func(c *Config) *string { return &c.Search.Backend }),
+	stringVar("SEARCH_EMBEDDED_PATH", func(c *Config) *string { return &c.Search.EmbeddedPath }),
+	listVar("ELASTICSEARCH_HOSTS", func(c *Config) *[]string { return &c.Elasticsearch.Hosts }),
+	boolVar("ELASTICSEARCH_MANAGE_TEMPLATE", func(c *Config) *bool { return &c.Elasticsearch.ManageTemplate }),
+	stringVar("MAIL_HOST", func(c *Config) *string { return &c.Mail.Host }),
+	intVar("MAIL_PORT", func(c *Config) *int { return &c.Mail.Port }),
+	stringVar("MAIL_USERNAME", func(c *Config) *string { return &c.Mail.Username }),
+	secretVar("MAIL_PASSWORD", func(c *Config) *Secret { return &c.Mail.Password }),
+	stringVar("MAIL_FROM_ADDRESS", func(c *Config) *string { return &c.Mail.FromAddress }),
+	stringVar("MAIL_FROM_NAME", func(c *Config) *string { return &c.Mail.FromName }),
+	stringVar("MAIL_BCC_ADDRESS", func(c *Config) *string { return &c.Mail.BccAddress }),
+	stringVar("MAIL_BCC_NAME", func(c *Config) *string { return &c.Mail.BccName }),
+	durationVar("MOST_ACTIVE_INTERVAL", func(c *Config) *time.Duration { return &c.Workers.MostActiveInterval }),
+	durationVar("FOLDER_ACTIVITY_INTERVAL", func(c *Config) *time.Duration { return &c.Workers.FolderActivityInterval }),
+	durationVar("FOLDER_ACTIVITY_WINDOW", func(c *Config) *time.Duration { return &c.Workers.FolderActivityWindow }),
+	durationVar("CONTENT_SCAN_INTERVAL", func(c *Config) *time.Duration { return &c.Workers.ContentScanInterval }),
+	intVar("CONTENT_SCAN_BATCH_SIZE", func(c *Config) *int { return &c.Workers.ContentScanBatchSize }),
+	durationVar("CONTENT_SCAN_WINDOW", func(c *Config) *time.Duration { return &c.Workers.ContentScanWindow }),
+	durationVar("SEARCH_INDEX_JOB_INTERVAL", func(c *Config) *time.Duration { return &c.Workers.SearchIndexJobInterval }),
+	durationVar("OUTBOX_POLL_INTERVAL", func(c *Config) *time.Duration { return &c.Outbox.PollInterval }),
+	intVar("OUTBOX_BATCH_SIZE", func(c *Config) *int { return &c.Outbox.BatchSize }),
+	intVar("OUTBOX_MAX_ATTEMPTS", func(c *Config) *int { return &c.Outbox.MaxAttempts }),
+	stringVar("DUPLICATE_DISCUSSIONS_ACTION", func(c *Config) *string { return &c.DuplicateDiscussions.Action }),
+	floatVar("DUPLICATE_DISCUSSIONS_THRESHOLD", func(c *Config) *float64 { return &c.DuplicateDiscussions.Threshold }),
+	intVar("MODERATION_THRESHOLD", func(c *Config) *int { return &c.Moderation.Threshold }),
+	intVar("MODERATION_QUORUM", func(c *Config) *int { return &c.Moderation.Quorum }),
+	durationVar("MODERATION_KEEP_AFTER", func(c *Config) *time.Duration { return &c.Moderation.KeepAfter }),
+	durationVar("DUPLICATE_DISCUSSIONS_WINDOW", func(c *Config) *time.Duration { return &c.DuplicateDiscussions.Window }),
+	intVar("DISCUSSION_CACHE_SIZE", func(c *Config) *int { return &c.DiscussionCache.Size }),
+	durationVar("DISCUSSION_CACHE_LOCAL_TTL", func(c *Config) *time.Duration { return &c.DiscussionCache.LocalTTL }),
+	durationVar("DISCUSSION_CACHE_SHARED_TTL", func(c *Config) *time.Duration { return &c.DiscussionCache.SharedTTL }),
+	boolVar("DISCUSSION_CACHE_LEGACY_COMPAT", func(c *Config) *bool { return &c.DiscussionCache.LegacyCompat }),
+}
+
+// ApplyEnvironment overrides settings with any of the supported environment
+// variables that are set. Empty variables are ignored so that the blank
+// entries in env.local do not wipe out values from the config file.
+func (c *Config) ApplyEnvironment() error {
+	return c.applyEnvironment(os.LookupEnv)
+}
+
+func (c *Config) applyEnvironment(lookup func(string) (string, bool)) error {
+
+	for _, binding := range envBindings {
+		value, exists := lookup(binding.name)
+		if !exists || len(value) == 0 {
+			continue
+		}
+		if err := binding.apply(c, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// Validate checks the configuration and reports every problem at once
+func (c *Config) Validate() error {
+
+	var problems []string
+	require := func(ok bool, message string) {
+		if !ok {
+			problems = append(problems, message)
+		}
+	}
+
+	_, knownLevel := logLevels[strings.ToUpper(c.LogLevel)]
+	require(knownLevel, fmt.Sprintf("logLevel %q is not one of DEBUG, INFO, WARN or ERROR", c.LogLevel))
+	require(c.Platform == PlatformProduction || c.Platform == PlatformDevelopment, fmt.Sprintf("platform %q is not one of %s or %s", c.Platform, PlatformProduction, PlatformDevelopment))
+
+	require(len(c.Server.ListenAddress) > 0, "server.listenAddress is required")
+	require(len(c.Server.Domain) > 0, "server.domain is required")
+	require(c.Server.ShutdownTimeout > 0, "server.shutdownTimeout must be positive")
+
+	require(len(c.Auth.SigningKey) >= minSigningKeyLength, fmt.Sprintf("auth.signingKey must be at least %d characters", minSigningKeyLength))
+	require(len(c.Auth.RecaptchaApiKey) > 0, "auth.recaptchaApiKey is required")
+
+	require(len(c.Database.Host) > 0, "database.host is required")
+	require(len(c.Database.Port) > 0, "database.port is required")
+	require(len(c.Database.User) > 0, "database.user is required")
+	require(len(c.Database.Name) > 0, "database.name is required")
+
+	require(len(c.Redis.Host) > 0, "redis.host is required")
+	require(len(c.Redis.Port) > 0, "redis.port is required")
+
+	switch c.Search.Backend {
+	case SearchBackendElasticsearch:
+		require(len(c.Elasticsearch.Hosts) > 0, "elasticsearch.hosts is required")
+	case SearchBackendEmbedded:
+		require(len(c.Search.EmbeddedPath) > 0, "search.embeddedPath is required for the embedded backend")
+	default:
+		problems = append(problems, fmt.Sprintf("search.backend %q is not one of %s or %s", c.Search.Backend, SearchBackendElasticsearch, SearchBackendEmbedded))
+	}
+
+	if len(c.Mail.Host) > 0 {
+		require(c.Mail.Port > 0, "mail.port is required when mail.host is set")
+		require(len(c.Mail.FromAddress) > 0, "mail.fromAddress is required when mail.host is set")
+	}
+
+	require(c.Workers.MostActiveInterval > 0, "workers.mostActiveInterval must be positive")
+	require(c.Workers.SearchIndexJobInterval > 0, "workers.searchIndexJobInterval must be positive")
+	require(c.Workers.FolderActivityInterval > 0, "workers.folderActivityInterval must be positive")
+	require(c.Workers.FolderActivityWindow > 0, "workers.folderActivityWindow must be positive")
+	require(c.Workers.ContentScanInterval > 0, "workers.contentScanInterval must be positive")
+	require(c.Workers.ContentScanBatchSize > 0, "workers.contentScanBatchSize must be positive")
+	require(c.Workers.ContentScanWindow >= 0, "workers.contentScanWindow must not be negative")
+
+	require(c.Outbox.PollInterval > 0, "outbox.pollInterval must be positive")
+	require(c.Outbox.BatchSize > 0, "outbox.batchSize must be positive")
+	require(c.Outbox.MaxAttempts > 0, "outbox.maxAttempts must be positive")
+	require(c.Outbox.InitialBackoff > 0 && c.Outbox.MaxBackoff >= c.Outbox.InitialBackoff, "outbox.maxBackoff must be at least outbox.initialBackoff")
+
+	switch c.DuplicateDiscussions.Action {
+	case DuplicateDiscussionsOff, DuplicateDiscussionsWarn, DuplicateDiscussionsBlock:
+	default:
+		problems = append(problems, fmt.Sprintf("duplicateDiscussions.action %q is not one of %s, %s or %s", c.DuplicateDiscussions.Action, DuplicateDiscussionsOff, DuplicateDiscussionsWarn, DuplicateDiscussionsBlock))
+	}
+	require(c.DuplicateDiscussions.Threshold > 0 && c.DuplicateDiscussions.Threshold <= 1, "duplicateDiscussions.threshold must be above 0 and at most 1")
+	require(c.DuplicateDiscussions.Window > 0, "duplicateDiscussions.window must be positive")
+
+	require(c.DiscussionCache.Size > 0, "discussionCache.size must be positive")
+	require(c.DiscussionCache.LocalTTL > 0, "discussionCache.localTTL must be positive")
+	require(c.DiscussionCache.SharedTTL > 0, "discussionCache.sharedTTL must be positive")
+
+	require(c.Moderation.Threshold > 0, "moderation.threshold must be positive")
+	for key, threshold := range c.Moderation.FolderThresholds {
+		require(threshold > 0, fmt.Sprintf("moderation.folderThresholds.%s must be positive", key))
+	}
+	for status, threshold := range c.Moderation.StatusThresholds {
+		switch status {
+		case ModerationStatusOK, ModerationStatusSuspended, ModerationStatusAdmin, ModerationStatusWatch:
+		default:
+			problems = append(problems, fmt.Sprintf("moderation.statusThresholds %q is not one of %s, %s, %s or %s", status, ModerationStatusOK, ModerationStatusSuspended, ModerationStatusAdmin, ModerationStatusWatch))
+		}
+		require(threshold > 0, fmt.Sprintf("moderation.statusThresholds.%s must be positive", status))
+	}
+	for role, weight := range c.Moderation.RoleWeights {
+		require(weight >= 0, fmt.Sprintf("moderation.roleWeights.%s must not be negative", role))
+	}
+	require(c.Moderation.Quorum > 0, "moderation.quorum must be positive")
+	require(c.Moderation.KeepAfter >= 0, "moderation.keepAfter must not be negative")
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+
+	return nil
+
+}
+
+func (c *Config) IsProduction() bool {
+	return c.Platform == PlatformProduction
+}
+
+func (c *Config) LogrusLevel() log.Level {
+	if level, exists := logLevels[strings.ToUpper(c.LogLevel)]; exists {
+		return level
+	}
+	return log.InfoLevel
+}
+
+// SetupLogging applies the configured log level and records the effective
+// configuration. Secrets are masked by their String method.
+func (c *Config) SetupLogging() {
+	log.SetLevel(c.LogrusLevel())
+	log.Infof("Configuration: %+v", *c)
+}
@@ -0,0 +1,219 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSigningKey = "0123456789abcdef0123456789abcdef"
+
+func validConfig() *Config {
+	cfg := Default()
+	cfg.Auth.SigningKey = testSigningKey
+	cfg.Auth.RecaptchaApiKey = "recaptcha-secret"
+	return cfg
+}
+
+func lookupFrom(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, exists := env[name]
+		return value, exists
+	}
+}
+
+func TestDefaultsNeedSecrets(t *testing.T) {
+
+	err := Default().Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "auth.signingKey")
+	assert.Contains(t, err.Error(), "auth.recaptchaApiKey")
+
+	assert.NoError(t, validConfig().Validate())
+
+}
+
+func TestLoadFileThenEnvironment(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`
+platform: PRODUCTION
+server:
+  listenAddress: ":9090"
+database:
+  host: db.internal
+  password: from-file
+workers:
+  mostActiveInterval: 1m
+moderation:
+  folderThresholds:
+    politics: 3
+  statusThresholds:
+    watch: 2
+`), 0600))
+
+	cfg := validConfig()
+	require.NoError(t, cfg.LoadFile(path))
+
+	err = cfg.applyEnvironment(lookupFrom(map[string]string{
+		"DB_PASSWORD":                     "from-env",
+		"DB_PORT":                         "",
+		"ELASTICSEARCH_HOSTS":             "http://es1:9200,http://es2:9200",
+		"ELASTICSEARCH_MANAGE_TEMPLATE":   "false",
+		"MAIL_PORT":                       "25",
+		"DUPLICATE_DISCUSSIONS_ACTION":    "block",
+		"DUPLICATE_DISCUSSIONS_THRESHOLD": "0.9",
+		"DISCUSSION_CACHE_LEGACY_COMPAT":  "true",
+		"FOLDER_ACTIVITY_WINDOW":          "24h",
+		"CONTENT_SCAN_BATCH_SIZE":         "100",
+	}))
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+
+	assert.True(t, cfg.IsProduction())
+	assert.Equal(t, ":9090", cfg.Server.ListenAddress)
+	assert.Equal(t, "db.internal", cfg.Database.Host)
+	assert.Equal(t, "3306", cfg.Database.Port, "empty variables must not override")
+	assert.Equal(t, "from-env", cfg.Database.Password.Value())
+	assert.Equal(t, []string{"http://es1:9200", "http://es2:9200"}, cfg.Elasticsearch.Hosts)
+	assert.False(t, cfg.Elasticsearch.ManageTemplate)
+	assert.Equal(t, 25, cfg.Mail.Port)
+	assert.Equal(t, time.Minute, cfg.Workers.MostActiveInterval)
+	assert.Equal(t, DuplicateDiscussionsBlock, cfg.DuplicateDiscussions.Action)
+	assert.Equal(t, 0.9, cfg.DuplicateDiscussions.Threshold)
+	assert.True(t, cfg.DiscussionCache.LegacyCompat)
+	assert.Equal(t, 24*time.Hour, cfg.Workers.FolderActivityWindow)
+	assert.Equal(t, 100, cfg.Workers.ContentScanBatchSize)
+	assert.Equal(t, map[string]int{"politics": 3}, cfg.Moderation.FolderThresholds)
+	assert.Equal(t, map[string]int{"suspended": 1, "watch": 2}, cfg.Moderation.StatusThresholds, "file thresholds are merged with the defaults")
+	assert.Equal(t, "justthetalk.com", cfg.Server.Domain, "unset values keep their defaults")
+
+}
+
+func TestEnvironmentParseErrors(t *testing.T) {
+
+	tests := map[string]string{
+		"MAIL_PORT":                       "smtp",
+		"REDIS_DB":                        "one",
+		"MOST_ACTIVE_INTERVAL":            "often",
+		"ELASTICSEARCH_MANAGE_TEMPLATE":   "sometimes",
+		"DUPLICATE_DISCUSSIONS_THRESHOLD": "high",
+	}
+
+	for name, value := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := validConfig().applyEnvironment(lookupFrom(map[string]string{name: value}))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), name)
+		})
+	}
+
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+
+	cfg := validConfig()
+	cfg.LogLevel = "LOUD"
+	cfg.Platform = "STAGING"
+	cfg.Auth.SigningKey = "short"
+	cfg.Database.Host = ""
+	cfg.Elasticsearch.Hosts = nil
+	cfg.Mail.Host = "smtp.example.com"
+	cfg.DuplicateDiscussions.Action = "shout"
+	cfg.DuplicateDiscussions.Threshold = 1.5
+
+	err := cfg.Validate()
+	require.Error(t, err)
+
+	for _, expected := range []string{"logLevel", "platform", "auth.signingKey", "database.host", "elasticsearch.hosts", "mail.port", "mail.fromAddress", "duplicateDiscussions.action", "duplicateDiscussions.threshold"} {
+		assert.Contains(t, err.Error(), expected)
+	}
+
+}
+
+func TestValidateModeration(t *testing.T) {
+
+	cfg := validConfig()
+	cfg.Moderation.Threshold = 0
+	cfg.Moderation.StatusThresholds["deleted"] = 1
+	cfg.Moderation.FolderThresholds = map[string]int{"general": -1}
+	cfg.Moderation.Quorum = 0
+
+	err := cfg.Validate()
+	require.Error(t, err)
+
+	for _, expected := range []string{"moderation.threshold", `moderation.statusThresholds "deleted"`, "moderation.folderThresholds.general", "moderation.quorum"} {
+		assert.Contains(t, err.Error(), expected)
+	}
+
+}
+
+func TestValidateSearchBackend(t *testing.T) {
+
+	cfg := validConfig()
+	cfg.Search.Backend = "solr"
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "search.backend")
+
+	cfg = validConfig()
+	require.NoError(t, cfg.applyEnvironment(lookupFrom(map[string]string{
+		"SEARCH_BACKEND":       SearchBackendEmbedded,
+		"SEARCH_EMBEDDED_PATH": "/var/lib/justthetalk/search.log",
+	})))
+	cfg.Elasticsearch.Hosts = nil
+	require.NoError(t, cfg.Validate(), "elasticsearch is not needed by the embedded backend")
+	assert.Equal(t, "/var/lib/justthetalk/search.log", cfg.Search.EmbeddedPath)
+
+	cfg.Search.EmbeddedPath = ""
+	err = cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "search.embeddedPath")
+
+}
+
+func TestSecretsAreNeverPrinted(t *testing.T) {
+
+	cfg := validConfig()
+	cfg.Database.Password = "db-password"
+	cfg.Redis.Password = "redis-password"
+	cfg.Mail.Password = "mail-password"
+
+	secrets := []string{testSigningKey, "recaptcha-secret", "db-password", "redis-password", "mail-password"}
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		output := fmt.Sprintf(format, *cfg)
+		for _, secret := range secrets {
+			assert.False(t, strings.Contains(output, secret), "%s leaked by %s", secret, format)
+		}
+	}
+
+	assert.Contains(t, cfg.Database.DSN(), "notthetalk:db-password@tcp(localhost:3306)/notthetalk")
+
+}
@@ -17,7 +17,7 @@ package connections
 
 import (
 	"context"
-	"fmt"
+	"justthetalk/config"
 	"sync"
 	"time"
 
@@ -36,13 +36,13 @@ var esConnection *elasticsearch.Client
 
 type DatabaseWithContextTarget func(db *gorm.DB)
 
-func OpenConnections(dbHost string, dbPort string, redisHost string, redisPort string, elasticsearchHosts []string) {
+func OpenConnections(cfg *config.Config) error {
 
 	var err error
 
 	once.Do(func() {
 
-		log.Infof("Connecting to database: %s:%s", dbHost, dbPort)
+		log.Infof("Connecting to database: %s:%s", cfg.Database.Host, cfg.Database.Port)
 
 		newLogger := logger.New(
 			log.New(), // io writer
@@ -53,32 +53,27 @@ func OpenConnections(dbHost string, dbPort string, redisHost string, redisPort s
 			},
 		)
 
-		databaseDsn := fmt.Sprintf("notthetalk:notthetalk@tcp(%s:%s)/notthetalk?charset=utf8mb4&parseTime=True&loc=UTC", dbHost, dbPort)
-		databaseConnection, err = gorm.Open(mysql.Open(databaseDsn), &gorm.Config{Logger: newLogger})
+		databaseConnection, err = gorm.Open(mysql.Open(cfg.Database.DSN()), &gorm.Config{Logger: newLogger})
 		if err != nil {
-			log.Panic(err)
+			return
 		}
 
-		log.Infof("Connecting to redis: %s:%s", redisHost, redisPort)
+		log.Infof("Connecting to redis: %s", cfg.Redis.Addr())
 
-		redisDsn := fmt.Sprintf("%s:%s", redisHost, redisPort)
 		redisConnection = redis.NewClient(&redis.Options{
-			Addr:     redisDsn,
-			Password: "", // no password set
-			DB:       0,  // use default DB
+			Addr:     cfg.Redis.Addr(),
+			Password: cfg.Redis.Password.Value(),
+			DB:       cfg.Redis.DB,
 		})
 
-		cfg := elasticsearch.Config{
-			Addresses: elasticsearchHosts,
-		}
-
-		esConnection, err = elasticsearch.NewClient(cfg)
-		if err != nil {
-			panic(err)
-		}
+		esConnection, err = elasticsearch.NewClient(elasticsearch.Config{
+			Addresses: cfg.Elasticsearch.Hosts,
+		})
 
 	})
 
+	return err
+
 }
 
 func DatabaseConnection() *gorm.DB {
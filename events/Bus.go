@@ -0,0 +1,209 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"justthetalk/utils"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultQueueLength = 256
+
+var (
+	eventDeliveryCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "justthetalk_event_delivery_count",
+		Help: "Count of domain events delivered to subscribers by result",
+	}, []string{"subscriber", "result"})
+)
+
+// Subscriber handles the events it has been registered for. Each subscriber
+// gets its own queue so a slow one can't hold up the others.
+type Subscriber interface {
+	Name() string
+	Handle(event Event) error
+}
+
+type subscription struct {
+	subscriber Subscriber
+	names      map[string]bool
+	queue      chan Event
+	done       chan struct{}
+}
+
+func (s *subscription) wants(event Event) bool {
+	return len(s.names) == 0 || s.names[event.Name()]
+}
+
+// Bus is an in-process, best-effort event bus. Publish never blocks: if a
+// subscriber's queue is full the event is dropped for that subscriber and
+// counted. Anything that must not be lost belongs in the outbox instead.
+type Bus struct {
+	lock          sync.RWMutex
+	subscriptions []*subscription
+	queueLength   int
+	isStarted     bool
+	isStopped     bool
+}
+
+func NewBus() *Bus {
+	return NewBusWithQueueLength(defaultQueueLength)
+}
+
+func NewBusWithQueueLength(queueLength int) *Bus {
+	return &Bus{
+		subscriptions: make([]*subscription, 0),
+		queueLength:   queueLength,
+	}
+}
+
+// Subscribe registers subscriber for the named events, or for every event if
+// none are given. Subscribers must be registered before the bus is started.
+func (b *Bus) Subscribe(subscriber Subscriber, names ...string) error {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.isStarted {
+		return fmt.Errorf("subscribing %s: event bus already started", subscriber.Name())
+	}
+
+	s := &subscription{
+		subscriber: subscriber,
+		names:      make(map[string]bool),
+		queue:      make(chan Event, b.queueLength),
+		done:       make(chan struct{}),
+	}
+
+	for _, name := range names {
+		s.names[name] = true
+	}
+
+	b.subscriptions = append(b.subscriptions, s)
+
+	return nil
+
+}
+
+func (b *Bus) Publish(event Event) {
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if b.isStopped {
+		log.Warnf("Dropping %s for %s, event bus is stopped", event.Name(), event.Urn())
+		return
+	}
+
+	for _, s := range b.subscriptions {
+		if !s.wants(event) {
+			continue
+		}
+		select {
+		case s.queue <- event:
+		default:
+			eventDeliveryCount.WithLabelValues(s.subscriber.Name(), "dropped").Inc()
+			log.Errorf("Dropping %s for %s, %s queue is full", event.Name(), event.Urn(), s.subscriber.Name())
+		}
+	}
+
+}
+
+func (b *Bus) Start(ctx context.Context) error {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.isStarted {
+		return errors.New("event bus already started")
+	}
+
+	b.isStarted = true
+	for _, s := range b.subscriptions {
+		go b.worker(s)
+	}
+
+	return nil
+
+}
+
+// Stop closes the bus to new events and waits for the subscribers to work
+// through what has already been published
+func (b *Bus) Stop(ctx context.Context) error {
+
+	b.lock.Lock()
+	if b.isStopped {
+		b.lock.Unlock()
+		return nil
+	}
+	b.isStopped = true
+	isStarted := b.isStarted
+	for _, s := range b.subscriptions {
+		close(s.queue)
+	}
+	b.lock.Unlock()
+
+	if !isStarted {
+		return nil
+	}
+
+	for _, s := range b.subscriptions {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return fmt.Errorf("stopping event bus: %w", ctx.Err())
+		}
+	}
+
+	return nil
+
+}
+
+func (b *Bus) worker(s *subscription) {
+
+	defer close(s.done)
+
+	for event := range s.queue {
+		deliver(s.subscriber, event)
+	}
+
+}
+
+func deliver(subscriber Subscriber, event Event) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			eventDeliveryCount.WithLabelValues(subscriber.Name(), "failure").Inc()
+			log.Errorf("%s handling %s for %s: %v", subscriber.Name(), event.Name(), event.Urn(), utils.ErrorFromPanic(r))
+		}
+	}()
+
+	if err := subscriber.Handle(event); err != nil {
+		eventDeliveryCount.WithLabelValues(subscriber.Name(), "failure").Inc()
+		log.Errorf("%s handling %s for %s: %v", subscriber.Name(), event.Name(), event.Urn(), err)
+		return
+	}
+
+	eventDeliveryCount.WithLabelValues(subscriber.Name(), "success").Inc()
+
+}
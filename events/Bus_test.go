@@ -0,0 +1,173 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package events
+
+import (
+	"context"
+	"errors"
+	"justthetalk/model"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingSubscriber struct {
+	name    string
+	lock    sync.Mutex
+	handled []string
+	err     error
+	block   chan struct{}
+}
+
+func (s *recordingSubscriber) Name() string {
+	return s.name
+}
+
+func (s *recordingSubscriber) Handle(event Event) error {
+
+	if s.block != nil {
+		<-s.block
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.handled = append(s.handled, event.Name()+" "+event.Urn())
+
+	return s.err
+
+}
+
+func (s *recordingSubscriber) events() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.handled...)
+}
+
+type panickingSubscriber struct{}
+
+func (s *panickingSubscriber) Name() string { return "panicking" }
+
+func (s *panickingSubscriber) Handle(event Event) error {
+	panic("boom")
+}
+
+func stopBus(t *testing.T, bus *Bus) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), time.Second)
+	defer cancelFn()
+	require.NoError(t, bus.Stop(ctx))
+}
+
+func TestEventsAreRoutedByName(t *testing.T) {
+
+	posts := &recordingSubscriber{name: "posts"}
+	everything := &recordingSubscriber{name: "everything"}
+
+	bus := NewBus()
+	require.NoError(t, bus.Subscribe(posts, NamePostCreated, NamePostEdited))
+	require.NoError(t, bus.Subscribe(everything))
+	require.NoError(t, bus.Start(context.Background()))
+
+	bus.Publish(&PostCreated{Post: &model.Post{ModelBase: model.ModelBase{Id: 1}}})
+	bus.Publish(&DiscussionLocked{Discussion: &model.Discussion{ModelBase: model.ModelBase{Id: 2}}, Locked: true})
+	bus.Publish(&PostEdited{Post: &model.Post{ModelBase: model.ModelBase{Id: 1}}})
+
+	stopBus(t, bus)
+
+	assert.Equal(t, []string{"post.created post:1", "post.edited post:1"}, posts.events())
+	assert.Equal(t, []string{"post.created post:1", "discussion.locked discussion:2", "post.edited post:1"}, everything.events())
+
+}
+
+func TestFailingSubscribersDoNotAffectOthers(t *testing.T) {
+
+	failing := &recordingSubscriber{name: "failing", err: errors.New("failed")}
+	healthy := &recordingSubscriber{name: "healthy"}
+
+	bus := NewBus()
+	require.NoError(t, bus.Subscribe(&panickingSubscriber{}))
+	require.NoError(t, bus.Subscribe(failing))
+	require.NoError(t, bus.Subscribe(healthy))
+	require.NoError(t, bus.Start(context.Background()))
+
+	bus.Publish(&UserStatusChanged{UserId: 3})
+	bus.Publish(&UserBlocked{DiscussionId: 2, UserId: 3, Blocked: true})
+
+	stopBus(t, bus)
+
+	assert.Len(t, failing.events(), 2)
+	assert.Equal(t, []string{"user.status_changed user:3", "user.blocked user:3"}, healthy.events())
+
+}
+
+func TestPublishDoesNotBlockOnASlowSubscriber(t *testing.T) {
+
+	slow := &recordingSubscriber{name: "slow", block: make(chan struct{})}
+
+	bus := NewBusWithQueueLength(1)
+	require.NoError(t, bus.Subscribe(slow))
+	require.NoError(t, bus.Start(context.Background()))
+
+	published := make(chan struct{})
+	go func() {
+		for i := uint(1); i <= 10; i++ {
+			bus.Publish(&PostCreated{Post: &model.Post{ModelBase: model.ModelBase{Id: i}}})
+		}
+		close(published)
+	}()
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked on a full queue")
+	}
+
+	close(slow.block)
+	stopBus(t, bus)
+
+	assert.True(t, len(slow.events()) < 10, "expected some events to be dropped")
+
+}
+
+func TestSubscribersMustRegisterBeforeStart(t *testing.T) {
+
+	bus := NewBus()
+	require.NoError(t, bus.Start(context.Background()))
+
+	assert.Error(t, bus.Subscribe(&recordingSubscriber{name: "late"}))
+	assert.Error(t, bus.Start(context.Background()))
+
+	stopBus(t, bus)
+
+}
+
+func TestEventsPublishedAfterStopAreDropped(t *testing.T) {
+
+	subscriber := &recordingSubscriber{name: "subscriber"}
+
+	bus := NewBus()
+	require.NoError(t, bus.Subscribe(subscriber))
+	require.NoError(t, bus.Start(context.Background()))
+	stopBus(t, bus)
+
+	bus.Publish(&PostCreated{Post: &model.Post{ModelBase: model.ModelBase{Id: 1}}})
+
+	assert.Empty(t, subscriber.events())
+	stopBus(t, bus)
+
+}
@@ -0,0 +1,163 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package events
+
+import (
+	"fmt"
+	"justthetalk/model"
+)
+
+const (
+	NamePostCreated       = "post.created"
+	NamePostEdited        = "post.edited"
+	NamePostDeleted       = "post.deleted"
+	NamePostModerated     = "post.moderated"
+	NameDiscussionCreated = "discussion.created"
+	NameDiscussionEdited  = "discussion.edited"
+	NameDiscussionMoved   = "discussion.moved"
+	NameDiscussionLocked  = "discussion.locked"
+	NameDiscussionDeleted = "discussion.deleted"
+	NameDiscussionErased  = "discussion.erased"
+	NameUserBlocked       = "user.blocked"
+	NameUserStatusChanged = "user.status_changed"
+)
+
+// Event is something that has already happened to a domain object. Name
+// identifies the type of event and Urn the object it happened to.
+type Event interface {
+	Name() string
+	Urn() string
+}
+
+func PostUrn(postId uint) string {
+	return fmt.Sprintf("post:%d", postId)
+}
+
+func DiscussionUrn(discussionId uint) string {
+	return fmt.Sprintf("discussion:%d", discussionId)
+}
+
+func UserUrn(userId uint) string {
+	return fmt.Sprintf("user:%d", userId)
+}
+
+func SavedSearchUrn(savedSearchId uint) string {
+	return fmt.Sprintf("savedsearch:%d", savedSearchId)
+}
+
+type PostCreated struct {
+	Post *model.Post `json:"post"`
+}
+
+func (e *PostCreated) Name() string { return NamePostCreated }
+func (e *PostCreated) Urn() string  { return PostUrn(e.Post.Id) }
+
+type PostEdited struct {
+	Post *model.Post `json:"post"`
+}
+
+func (e *PostEdited) Name() string { return NamePostEdited }
+func (e *PostEdited) Urn() string  { return PostUrn(e.Post.Id) }
+
+type PostDeleted struct {
+	Post *model.Post `json:"post"`
+}
+
+func (e *PostDeleted) Name() string { return NamePostDeleted }
+func (e *PostDeleted) Urn() string  { return PostUrn(e.Post.Id) }
+
+// PostModerated is raised when an admin or a moderation vote changes the
+// status of a post
+type PostModerated struct {
+	Post        *model.Post `json:"post"`
+	ModeratorId uint        `json:"moderatorId"`
+}
+
+func (e *PostModerated) Name() string { return NamePostModerated }
+func (e *PostModerated) Urn() string  { return PostUrn(e.Post.Id) }
+
+// Approved is true when the moderation left the post visible
+func (e *PostModerated) Approved() bool {
+	return e.Post.Status == model.PostStatusOK || e.Post.Status == model.PostStatusWatch
+}
+
+type DiscussionCreated struct {
+	Discussion *model.Discussion `json:"discussion"`
+}
+
+func (e *DiscussionCreated) Name() string { return NameDiscussionCreated }
+func (e *DiscussionCreated) Urn() string  { return DiscussionUrn(e.Discussion.Id) }
+
+type DiscussionEdited struct {
+	Discussion *model.Discussion `json:"discussion"`
+}
+
+func (e *DiscussionEdited) Name() string { return NameDiscussionEdited }
+func (e *DiscussionEdited) Urn() string  { return DiscussionUrn(e.Discussion.Id) }
+
+type DiscussionMoved struct {
+	Discussion   *model.Discussion `json:"discussion"`
+	FromFolderId uint              `json:"fromFolderId"`
+	ToFolderId   uint              `json:"toFolderId"`
+}
+
+func (e *DiscussionMoved) Name() string { return NameDiscussionMoved }
+func (e *DiscussionMoved) Urn() string  { return DiscussionUrn(e.Discussion.Id) }
+
+type DiscussionLocked struct {
+	Discussion *model.Discussion `json:"discussion"`
+	Locked     bool              `json:"locked"`
+}
+
+func (e *DiscussionLocked) Name() string { return NameDiscussionLocked }
+func (e *DiscussionLocked) Urn() string  { return DiscussionUrn(e.Discussion.Id) }
+
+type DiscussionDeleted struct {
+	Discussion *model.Discussion `json:"discussion"`
+	Deleted    bool              `json:"deleted"`
+}
+
+func (e *DiscussionDeleted) Name() string { return NameDiscussionDeleted }
+func (e *DiscussionDeleted) Urn() string  { return DiscussionUrn(e.Discussion.Id) }
+
+// DiscussionErased is raised after a discussion and all of its posts have
+// been removed from the database
+type DiscussionErased struct {
+	DiscussionId uint `json:"discussionId"`
+	FolderId     uint `json:"folderId"`
+}
+
+func (e *DiscussionErased) Name() string { return NameDiscussionErased }
+func (e *DiscussionErased) Urn() string  { return DiscussionUrn(e.DiscussionId) }
+
+type UserBlocked struct {
+	DiscussionId uint `json:"discussionId"`
+	UserId       uint `json:"userId"`
+	Blocked      bool `json:"blocked"`
+	AdminId      uint `json:"adminId"`
+}
+
+func (e *UserBlocked) Name() string { return NameUserBlocked }
+func (e *UserBlocked) Urn() string  { return UserUrn(e.UserId) }
+
+type UserStatusChanged struct {
+	UserId  uint                   `json:"userId"`
+	Changes map[string]interface{} `json:"changes"`
+	AdminId uint                   `json:"adminId"`
+}
+
+func (e *UserStatusChanged) Name() string { return NameUserStatusChanged }
+func (e *UserStatusChanged) Urn() string  { return UserUrn(e.UserId) }
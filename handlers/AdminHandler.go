@@ -16,14 +16,16 @@
 package handlers
 
 import (
-	"encoding/json"
 	"net/http"
+	"time"
 
 	"justthetalk/businesslogic"
+	"justthetalk/events"
 	"justthetalk/model"
+	"justthetalk/repository"
 	"justthetalk/utils"
 
-	"gorm.io/gorm"
+	log "github.com/sirupsen/logrus"
 )
 
 type AdminHandler struct {
@@ -31,353 +33,950 @@ type AdminHandler struct {
 	folderCache     *businesslogic.FolderCache
 	discussionCache *businesslogic.DiscussionCache
 	postProcessor   *businesslogic.PostProcessor
+	indexJobRunner  *businesslogic.SearchIndexJobRunner
+	eventBus        *events.Bus
+	bannedWordList  *businesslogic.BannedWordsList
+	scanJobRunner   *businesslogic.ContentScanJobRunner
+	policy          *businesslogic.ModerationPolicy
 	postFormatter   *utils.PostFormatter
 }
 
-func NewAdminHandler(userCache *businesslogic.UserCache, folderCache *businesslogic.FolderCache, discussionCache *businesslogic.DiscussionCache, postProcessor *businesslogic.PostProcessor) *AdminHandler {
+func NewAdminHandler(userCache *businesslogic.UserCache, folderCache *businesslogic.FolderCache, discussionCache *businesslogic.DiscussionCache, postProcessor *businesslogic.PostProcessor, indexJobRunner *businesslogic.SearchIndexJobRunner, eventBus *events.Bus, bannedWordList *businesslogic.BannedWordsList, scanJobRunner *businesslogic.ContentScanJobRunner, policy *businesslogic.ModerationPolicy) *AdminHandler {
 
 	return &AdminHandler{
 		userCache:       userCache,
 		folderCache:     folderCache,
 		discussionCache: discussionCache,
 		postProcessor:   postProcessor,
+		indexJobRunner:  indexJobRunner,
+		eventBus:        eventBus,
+		bannedWordList:  bannedWordList,
+		scanJobRunner:   scanJobRunner,
+		policy:          policy,
 		postFormatter:   utils.NewPostFormatter(),
 	}
 
 }
 
+func (h *AdminHandler) discussionFromRequest(req *http.Request, user *model.User) (*model.Discussion, error) {
+
+	discussionId, err := utils.ExtractVarInt("discussionId", req)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.discussionCache.Get(discussionId, user)
+
+}
+
+func (h *AdminHandler) targetUserFromRequest(req *http.Request) (*model.User, error) {
+
+	userId, err := utils.ExtractVarInt("userId", req)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.userCache.Get(userId)
+
+}
+
 func (h *AdminHandler) GetModerationHistory(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		pageStart := utils.ExtractQueryInt("start", req)
-		pageSize := utils.ExtractQueryInt("size", req)
+		pageStart, err := utils.ExtractQueryInt("start", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		pageSize, err := utils.ExtractQueryInt("size", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		results := businesslogic.GetModerationHistory(pageStart, pageSize, h.folderCache, h.discussionCache, db)
+		results, err := businesslogic.GetModerationHistory(pageStart, pageSize, h.folderCache, h.discussionCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, results, ""
+		return http.StatusOK, results, "", nil
 
 	})
 }
 
 func (h *AdminHandler) GetModerationQueue(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		results := businesslogic.GetModerationQueue(h.folderCache, h.discussionCache, db)
+		results, err := businesslogic.GetModerationQueue(h.folderCache, h.discussionCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, results, ""
+		return http.StatusOK, results, "", nil
 
 	})
 }
 
 func (h *AdminHandler) GetReportsByPost(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		h.discussionCache.Get(discussionId, user)
+		if _, err := h.discussionFromRequest(req, user); err != nil {
+			return 0, nil, "", err
+		}
 
-		postId := utils.ExtractVarInt("postId", req)
+		postId, err := utils.ExtractVarInt("postId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		results := businesslogic.GetReportsByPost(postId, db)
+		results, err := businesslogic.GetReportsByPost(postId, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, results, ""
+		return http.StatusOK, results, "", nil
 
 	})
 }
 
 func (h *AdminHandler) GetCommentsByPost(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		h.discussionCache.Get(discussionId, user)
+		if _, err := h.discussionFromRequest(req, user); err != nil {
+			return 0, nil, "", err
+		}
 
-		postId := utils.ExtractVarInt("postId", req)
+		postId, err := utils.ExtractVarInt("postId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		results := businesslogic.GetCommentsByPost(postId, db)
+		results, err := businesslogic.GetCommentsByPost(postId, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, results, ""
+		return http.StatusOK, results, "", nil
 
 	})
 }
 
 func (h *AdminHandler) GetReportsByDiscussion(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		discussion := h.discussionCache.Get(discussionId, user)
+		discussion, err := h.discussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		results := businesslogic.GetReportsByDiscussion(discussion, db)
+		results, err := businesslogic.GetReportsByDiscussion(discussion, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, results, ""
+		return http.StatusOK, results, "", nil
 
 	})
 }
 
 func (h *AdminHandler) GetCommentsByDiscussion(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		discussion := h.discussionCache.Get(discussionId, user)
+		discussion, err := h.discussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		results := businesslogic.GetCommentsByDiscussion(discussion, db)
+		results, err := businesslogic.GetCommentsByDiscussion(discussion, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, results, ""
+		return http.StatusOK, results, "", nil
 
 	})
 }
 
 func (h *AdminHandler) CreateComment(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		discussion, err := h.discussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		postId := utils.ExtractVarInt("postId", req)
+		postId, err := utils.ExtractVarInt("postId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
 		var comment model.ModeratorComment
-		if err := json.NewDecoder(req.Body).Decode(&comment); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &comment); err != nil {
+			return 0, nil, "", err
 		}
 
-		discussion := h.discussionCache.Get(discussionId, user)
-		folder := h.folderCache.Get(discussion.FolderId, user)
-		post, err := businesslogic.GetPost(postId, db)
+		folder, err := h.folderCache.Get(discussion.FolderId, user)
 		if err != nil {
-			utils.PanicWithWrapper(err, utils.ErrInternalError)
+			return 0, nil, "", err
 		}
 
-		if post.DiscussionId != discussionId {
-			panic(utils.ErrBadRequest)
+		post, err := businesslogic.GetPost(postId, repo)
+		if err != nil {
+			return 0, nil, "", err
 		}
 
-		results, post := businesslogic.CreateComment(&comment, folder, discussion, post, user, h.userCache, db)
+		if post.DiscussionId != discussion.Id {
+			return 0, nil, "", utils.NewError(utils.ErrBadRequest, utils.ErrorCodeInvalidParameter, "Post does not belong to discussion").WithField("postId", "not in discussion")
+		}
 
-		h.postProcessor.PublishPost(post)
+		previousStatus := post.Status
+		results, post, err := businesslogic.CreateComment(&comment, folder, discussion, post, user, h.policy, h.userCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, results, ""
+		if post.Status != previousStatus {
+			h.eventBus.Publish(&events.PostModerated{Post: post, ModeratorId: user.Id})
+		}
+
+		return http.StatusOK, results, "", nil
 
 	})
 }
 
 func (h *AdminHandler) LockDiscussion(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		discussion, err := h.discussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		lockState := utils.ExtractQueryInt("state", req)
+		lockState, err := utils.ExtractQueryInt("state", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussion := h.discussionCache.Get(discussionId, user)
+		if err := businesslogic.LockDiscussion(discussion, lockState, h.discussionCache, repo); err != nil {
+			return 0, nil, "", err
+		}
 
-		businesslogic.LockDiscussion(discussion, lockState, h.discussionCache, db)
+		h.eventBus.Publish(&events.DiscussionLocked{Discussion: discussion, Locked: discussion.IsLocked})
 
-		return http.StatusOK, discussion, ""
+		return http.StatusOK, discussion, "", nil
 
 	})
 }
 
 func (h *AdminHandler) PremoderateDiscussion(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		discussion, err := h.discussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		premodState := utils.ExtractQueryInt("state", req)
+		premodState, err := utils.ExtractQueryInt("state", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussion := h.discussionCache.Get(discussionId, user)
-		businesslogic.PremoderateDiscussion(discussion, premodState, h.discussionCache, db)
+		if err := businesslogic.PremoderateDiscussion(discussion, premodState, h.discussionCache, repo); err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, discussion, ""
+		return http.StatusOK, discussion, "", nil
 
 	})
 }
 
 func (h *AdminHandler) DeleteDiscussion(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		discussion, err := h.discussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		deleteState, err := utils.ExtractQueryInt("state", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		deleteState := utils.ExtractQueryInt("state", req)
+		if err := businesslogic.AdminDeleteDiscussion(discussion, deleteState, h.discussionCache, repo); err != nil {
+			return 0, nil, "", err
+		}
 
-		discussion := h.discussionCache.Get(discussionId, user)
-		businesslogic.AdminDeleteDiscussion(discussion, deleteState, h.discussionCache, db)
+		h.eventBus.Publish(&events.DiscussionDeleted{Discussion: discussion, Deleted: deleteState == 1})
 
-		return http.StatusOK, discussion, ""
+		return http.StatusOK, discussion, "", nil
 
 	})
 }
 
 func (h *AdminHandler) MoveDiscussion(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		targetFolderId := utils.ExtractQueryInt("targetFolderId", req)
+		discussion, err := h.discussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussion := h.discussionCache.Get(discussionId, user)
-		targetFolder := h.folderCache.Get(uint(targetFolderId), user)
+		targetFolderId, err := utils.ExtractQueryInt("targetFolderId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		targetFolder, err := h.folderCache.Get(uint(targetFolderId), user)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		fromFolderId := discussion.FolderId
+		if err := businesslogic.MoveDiscussion(discussion, targetFolder, h.discussionCache, repo); err != nil {
+			return 0, nil, "", err
+		}
 
-		businesslogic.MoveDiscussion(discussion, targetFolder, h.discussionCache, db)
+		h.eventBus.Publish(&events.DiscussionMoved{Discussion: discussion, FromFolderId: fromFolderId, ToFolderId: targetFolder.Id})
 
-		return http.StatusOK, discussion, ""
+		return http.StatusOK, discussion, "", nil
 
 	})
 }
 
 func (h *AdminHandler) EraseDiscussion(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		discussion := h.discussionCache.Get(discussionId, user)
+		discussion, err := h.discussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		if err := businesslogic.EraseDiscussion(discussion, h.discussionCache, repo); err != nil {
+			return 0, nil, "", err
+		}
 
-		businesslogic.EraseDiscussion(discussion, h.discussionCache, db)
+		h.eventBus.Publish(&events.DiscussionErased{DiscussionId: discussion.Id, FolderId: discussion.FolderId})
 
-		return http.StatusOK, nil, "Discussion erased"
+		return http.StatusOK, nil, "Discussion erased", nil
 
 	})
 }
 
 func (h *AdminHandler) GetBlockedUsers(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
+		discussion, err := h.discussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussion := h.discussionCache.Get(discussionId, user)
-		blockedUsers := h.discussionCache.BlockedUsers(discussion)
+		blockedUsers, err := h.discussionCache.BlockedUsers(discussion)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, blockedUsers, ""
+		return http.StatusOK, blockedUsers, "", nil
 
 	})
 }
 
-func (h *AdminHandler) BlockUserDiscussion(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+func (h *AdminHandler) blockOrUnblockUser(res http.ResponseWriter, req *http.Request, blockNotUnblock bool) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		targetUserId := utils.ExtractVarInt("userId", req)
+		discussion, err := h.discussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussion := h.discussionCache.Get(discussionId, user)
-		targetUser := h.userCache.Get(targetUserId)
+		targetUser, err := h.targetUserFromRequest(req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		blockedUsers := h.discussionCache.BlockOrUnblockUser(discussion, targetUser, true, user)
+		blockedUsers, err := h.discussionCache.BlockOrUnblockUser(discussion, targetUser, blockNotUnblock, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, blockedUsers, ""
+		h.eventBus.Publish(&events.UserBlocked{DiscussionId: discussion.Id, UserId: targetUser.Id, Blocked: blockNotUnblock, AdminId: user.Id})
+
+		return http.StatusOK, blockedUsers, "", nil
 
 	})
 }
 
+func (h *AdminHandler) BlockUserDiscussion(res http.ResponseWriter, req *http.Request) {
+	h.blockOrUnblockUser(res, req, true)
+}
+
 func (h *AdminHandler) UnblockUserDiscussion(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	h.blockOrUnblockUser(res, req, false)
+}
+
+func (h *AdminHandler) deleteOrUndeletePost(res http.ResponseWriter, req *http.Request, deleteNotUndelete bool) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		discussion, err := h.discussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		postId, err := utils.ExtractVarInt("postId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		targetUserId := utils.ExtractVarInt("userId", req)
+		folder, err := h.folderCache.Get(discussion.FolderId, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussion := h.discussionCache.Get(discussionId, user)
-		targetUser := h.userCache.Get(targetUserId)
+		post, err := businesslogic.AdminDeleteNoUndeletePost(postId, folder, discussion, deleteNotUndelete, user, h.userCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		blockedUsers := h.discussionCache.BlockOrUnblockUser(discussion, targetUser, false, user)
+		post.Markup = h.postFormatter.ApplyPostFormatting(post.Text, discussion)
+		h.eventBus.Publish(&events.PostModerated{Post: post, ModeratorId: user.Id})
 
-		return http.StatusOK, blockedUsers, ""
+		return http.StatusOK, post, "", nil
 
 	})
 }
 
 func (h *AdminHandler) DeletePost(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	h.deleteOrUndeletePost(res, req, true)
+}
+
+func (h *AdminHandler) UndeletePost(res http.ResponseWriter, req *http.Request) {
+	h.deleteOrUndeletePost(res, req, false)
+}
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		postId := utils.ExtractVarInt("postId", req)
+func (h *AdminHandler) SearchUsers(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		discussion := h.discussionCache.Get(discussionId, user)
-		folder := h.folderCache.Get(discussion.FolderId, user)
+		var results []*model.UserSearchResults
+		var err error
 
-		post := businesslogic.AdminDeleteNoUndeletePost(postId, folder, discussion, true, user, h.userCache, db)
+		searchTerm := req.URL.Query().Get("term")
+		filterKey := req.URL.Query().Get("filter")
+
+		switch {
+		case len(searchTerm) > 0 && len(searchTerm) <= 20:
+			results, err = businesslogic.SearchUsers(searchTerm, repo)
+		case len(filterKey) > 0:
+			results, err = businesslogic.FilterUsers(filterKey, repo)
+		default:
+			err = utils.NewError(utils.ErrBadRequest, utils.ErrorCodeValidationFailed, "You must supply a search term").WithField("term", "must be between 1 and 20 characters")
+		}
 
-		post.Markup = h.postFormatter.ApplyPostFormatting(post.Text, discussion)
-		h.postProcessor.PublishPost(post)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, post, ""
+		return http.StatusOK, results, "", nil
 
 	})
 }
 
-func (h *AdminHandler) UndeletePost(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+func (h *AdminHandler) SetUserStatus(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		postId := utils.ExtractVarInt("postId", req)
+		targetUser, err := h.targetUserFromRequest(req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussion := h.discussionCache.Get(discussionId, user)
-		folder := h.folderCache.Get(discussion.FolderId, user)
+		fieldMap := make(map[string]interface{})
+		if err := utils.DecodeRequestBody(req, &fieldMap); err != nil {
+			return 0, nil, "", err
+		}
 
-		post := businesslogic.AdminDeleteNoUndeletePost(postId, folder, discussion, false, user, h.userCache, db)
+		updated, err := businesslogic.SetUserStatus(targetUser, fieldMap, user, h.userCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		post.Markup = h.postFormatter.ApplyPostFormatting(post.Text, discussion)
-		h.postProcessor.PublishPost(post)
+		h.eventBus.Publish(&events.UserStatusChanged{UserId: updated.Id, Changes: fieldMap, AdminId: user.Id})
 
-		return http.StatusOK, post, ""
+		return http.StatusOK, updated, "", nil
 
 	})
 }
 
-func (h *AdminHandler) SearchUsers(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+func (h *AdminHandler) GetUserHistory(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		searchTerm := req.URL.Query().Get("term")
-		if len(searchTerm) > 0 && len(searchTerm) <= 20 {
-			results := businesslogic.SearchUsers(searchTerm, db)
-			return http.StatusOK, results, ""
-		} else {
-			filterKey := req.URL.Query().Get("filter")
-			if len(filterKey) > 0 {
-				results := businesslogic.FilterUsers(filterKey, db)
-				return http.StatusOK, results, ""
-			} else {
-				return http.StatusBadRequest, nil, "You must supply a search term"
-			}
+		targetUser, err := h.targetUserFromRequest(req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		results, err := businesslogic.GetUserHistory(targetUser, repo)
+		if err != nil {
+			return 0, nil, "", err
 		}
 
+		return http.StatusOK, results, "", nil
+
 	})
 }
 
-func (h *AdminHandler) SetUserStatus(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+func (h *AdminHandler) GetModNotes(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		userId := utils.ExtractVarInt("userId", req)
+		targetUser, err := h.targetUserFromRequest(req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		fieldMap := make(map[string]interface{})
-		if err := json.NewDecoder(req.Body).Decode(&fieldMap); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		results, err := businesslogic.GetModNotes(targetUser, repo)
+		if err != nil {
+			return 0, nil, "", err
 		}
 
-		targetUser := h.userCache.Get(userId)
-		if targetUser == nil {
-			panic(utils.ErrNotFound)
+		return http.StatusOK, results, "", nil
+
+	})
+}
+
+func (h *AdminHandler) CreateModNote(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		targetUser, err := h.targetUserFromRequest(req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		var note model.UserModNote
+		if err := utils.DecodeRequestBody(req, &note); err != nil {
+			return 0, nil, "", err
 		}
 
-		updated, err := businesslogic.SetUserStatus(targetUser, fieldMap, user, h.userCache, db)
+		created, err := businesslogic.CreateModNote(targetUser, &note, user, repo)
 		if err != nil {
-			panic(err)
+			return 0, nil, "", err
 		}
 
-		return http.StatusOK, updated, ""
+		return http.StatusOK, created, "", nil
 
 	})
 }
 
-func (h *AdminHandler) GetUserHistory(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+func (h *AdminHandler) UpdateModNote(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		targetUser, err := h.targetUserFromRequest(req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		userId := utils.ExtractVarInt("userId", req)
+		noteId, err := utils.ExtractVarInt("noteId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		targetUser := h.userCache.Get(userId)
-		if targetUser == nil {
-			panic(utils.ErrNotFound)
+		var note model.UserModNote
+		if err := utils.DecodeRequestBody(req, &note); err != nil {
+			return 0, nil, "", err
 		}
 
-		results := businesslogic.GetUserHistory(targetUser, db)
+		updated, err := businesslogic.UpdateModNote(targetUser, noteId, &note, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, results, ""
+		return http.StatusOK, updated, "", nil
+
+	})
+}
+
+func (h *AdminHandler) DeleteModNote(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		targetUser, err := h.targetUserFromRequest(req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		noteId, err := utils.ExtractVarInt("noteId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		if err := businesslogic.DeleteModNote(targetUser, noteId, repo); err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusNoContent, nil, "", nil
 
 	})
 }
 
 func (h *AdminHandler) GetUserDiscussionBlocks(res http.ResponseWriter, req *http.Request) {
-	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		results, err := businesslogic.GetUserDiscussionBlocks(repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, results, "", nil
+
+	})
+}
+
+func (h *AdminHandler) GetDeadLetteredOutboxEntries(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		pageStart, err := utils.ExtractQueryInt("start", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		pageSize, err := utils.ExtractQueryInt("size", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		results, err := businesslogic.GetDeadLetteredOutboxEntries(pageStart, pageSize, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, results, "", nil
+
+	})
+}
+
+func (h *AdminHandler) ReplayOutboxEntry(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		entryId, err := utils.ExtractVarInt("entryId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		entry, err := businesslogic.ReplayOutboxEntry(entryId, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		h.postProcessor.Wake()
+
+		return http.StatusOK, entry, "", nil
+
+	})
+}
+
+func (h *AdminHandler) GetSearchIndexJobs(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		pageStart, err := utils.ExtractQueryInt("start", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		pageSize, err := utils.ExtractQueryInt("size", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		results, err := businesslogic.GetSearchIndexJobs(pageStart, pageSize, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, results, "", nil
+
+	})
+}
+
+func (h *AdminHandler) RetrySearchIndexJob(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		jobId, err := utils.ExtractVarInt("jobId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		job, err := businesslogic.RetrySearchIndexJob(jobId, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		h.indexJobRunner.Wake()
+
+		return http.StatusOK, job, "", nil
+
+	})
+}
+
+func (h *AdminHandler) GetSearchAnalytics(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		from, err := utils.ExtractQueryTime("from", req, time.Time{})
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		to, err := utils.ExtractQueryTime("to", req, time.Time{})
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		limit, err := utils.ExtractQueryInt("limit", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		analytics, err := businesslogic.GetSearchAnalytics(from, to, limit, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, analytics, "", nil
+
+	})
+}
+
+func (h *AdminHandler) GetFolders(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+		return http.StatusOK, h.folderCache.Entries(), "", nil
+	})
+}
+
+func (h *AdminHandler) CreateFolder(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		var folder model.Folder
+		if err := utils.DecodeRequestBody(req, &folder); err != nil {
+			return 0, nil, "", err
+		}
+
+		created, err := businesslogic.CreateFolder(&folder, h.folderCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, created, "", nil
+
+	})
+}
+
+func (h *AdminHandler) UpdateFolder(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		folderId, err := utils.ExtractVarInt("folderId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		var folder model.Folder
+		if err := utils.DecodeRequestBody(req, &folder); err != nil {
+			return 0, nil, "", err
+		}
+
+		updated, err := businesslogic.UpdateFolder(folderId, &folder, h.folderCache, h.indexJobRunner, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, updated, "", nil
+
+	})
+}
+
+func (h *AdminHandler) ReorderFolders(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		var folderIds []uint
+		if err := utils.DecodeRequestBody(req, &folderIds); err != nil {
+			return 0, nil, "", err
+		}
+
+		folders, err := businesslogic.ReorderFolders(folderIds, h.folderCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, folders, "", nil
+
+	})
+}
+
+func (h *AdminHandler) GetBannedWords(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		words, err := businesslogic.GetBannedWords(repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, words, "", nil
+
+	})
+}
+
+func (h *AdminHandler) CreateBannedWord(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		var word model.BannedWord
+		if err := utils.DecodeRequestBody(req, &word); err != nil {
+			return 0, nil, "", err
+		}
+
+		created, err := businesslogic.CreateBannedWord(&word, h.bannedWordList, h.folderCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		h.rescanForBannedWords(user)
+
+		return http.StatusOK, created, "", nil
+
+	})
+}
+
+func (h *AdminHandler) UpdateBannedWord(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		wordId, err := utils.ExtractVarInt("wordId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		var word model.BannedWord
+		if err := utils.DecodeRequestBody(req, &word); err != nil {
+			return 0, nil, "", err
+		}
+
+		updated, err := businesslogic.UpdateBannedWord(wordId, &word, h.bannedWordList, h.folderCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		h.rescanForBannedWords(user)
+
+		return http.StatusOK, updated, "", nil
+
+	})
+}
+
+func (h *AdminHandler) DeleteBannedWord(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		wordId, err := utils.ExtractVarInt("wordId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		if err := businesslogic.DeleteBannedWord(wordId, h.bannedWordList, repo); err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusNoContent, nil, "", nil
+
+	})
+}
+
+// rescanForBannedWords checks the posts made within the scan window against
+// the changed list. The word has been saved by now so a failure is only
+// logged.
+func (h *AdminHandler) rescanForBannedWords(user *model.User) {
+
+	if h.scanJobRunner.Window() == 0 {
+		return
+	}
+
+	if _, err := businesslogic.CreateContentScanJob(user, &model.ContentScanJob{}, h.scanJobRunner, time.Now().UTC()); err != nil {
+		log.Errorf("Queueing content scan after banned word change: %v", err)
+	}
+
+}
+
+func (h *AdminHandler) TestBannedWord(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		var word model.BannedWord
+		if err := utils.DecodeRequestBody(req, &word); err != nil {
+			return 0, nil, "", err
+		}
+
+		size, err := utils.ExtractQueryInt("size", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		if size == 0 {
+			size = 1000
+		}
+
+		result, err := businesslogic.TestBannedWord(&word, size, h.folderCache, h.discussionCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, result, "", nil
+
+	})
+}
+
+func (h *AdminHandler) CreateContentScanJob(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		var job model.ContentScanJob
+		if err := utils.DecodeRequestBody(req, &job); err != nil {
+			return 0, nil, "", err
+		}
+
+		created, err := businesslogic.CreateContentScanJob(user, &job, h.scanJobRunner, time.Now().UTC())
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, created, "", nil
+
+	})
+}
+
+func (h *AdminHandler) GetContentScanJobs(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		pageStart, err := utils.ExtractQueryInt("start", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		pageSize, err := utils.ExtractQueryInt("size", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		results, err := businesslogic.GetContentScanJobs(pageStart, pageSize, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, results, "", nil
+
+	})
+}
+
+func (h *AdminHandler) GetContentScanJob(res http.ResponseWriter, req *http.Request) {
+	utils.AdminOnlyHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		jobId, err := utils.ExtractVarInt("jobId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		job, err := businesslogic.GetContentScanJob(jobId, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		results := businesslogic.GetUserDiscussionBlocks(db)
-		return http.StatusOK, results, ""
+		return http.StatusOK, job, "", nil
 
 	})
 }
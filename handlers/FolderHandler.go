@@ -16,9 +16,11 @@
 package handlers
 
 import (
-	"encoding/json"
 	"justthetalk/businesslogic"
+	"justthetalk/events"
 	"justthetalk/model"
+	"justthetalk/repository"
+	"justthetalk/search"
 	"justthetalk/utils"
 	"net/http"
 	"time"
@@ -26,7 +28,6 @@ import (
 	"github.com/jinzhu/copier"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"gorm.io/gorm"
 )
 
 var (
@@ -45,26 +46,69 @@ type FolderHandler struct {
 	userCache       *businesslogic.UserCache
 	folderCache     *businesslogic.FolderCache
 	discussionCache *businesslogic.DiscussionCache
-	postProcessor   *businesslogic.PostProcessor
+	eventBus        *events.Bus
+	searchEngine    search.Engine
+	searchGuard     *businesslogic.SearchGuard
+
+	duplicateDetector *businesslogic.DuplicateDiscussionDetector
 }
 
-func NewFolderHandler(userCache *businesslogic.UserCache, folderCache *businesslogic.FolderCache, discussionCache *businesslogic.DiscussionCache, postProcessor *businesslogic.PostProcessor) *FolderHandler {
+func NewFolderHandler(userCache *businesslogic.UserCache, folderCache *businesslogic.FolderCache, discussionCache *businesslogic.DiscussionCache, eventBus *events.Bus, searchEngine search.Engine, searchGuard *businesslogic.SearchGuard, duplicateDetector *businesslogic.DuplicateDiscussionDetector) *FolderHandler {
 
 	return &FolderHandler{
 		userCache:       userCache,
 		folderCache:     folderCache,
 		discussionCache: discussionCache,
-		postProcessor:   postProcessor,
+		eventBus:        eventBus,
+		searchEngine:    searchEngine,
+		searchGuard:     searchGuard,
+
+		duplicateDetector: duplicateDetector,
+	}
+
+}
+
+func (h *FolderHandler) folderFromRequest(req *http.Request, user *model.User) (*model.Folder, error) {
+
+	folderId, err := utils.ExtractVarInt("folderId", req)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.folderCache.Get(folderId, user)
+
+}
+
+func (h *FolderHandler) folderAndDiscussionFromRequest(req *http.Request, user *model.User) (*model.Folder, *model.Discussion, error) {
+
+	folder, err := h.folderFromRequest(req, user)
+	if err != nil {
+		return nil, nil, err
 	}
 
+	discussionId, err := utils.ExtractVarInt("discussionId", req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	discussion, err := h.discussionCache.Get(discussionId, user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return folder, discussion, nil
+
 }
 
 func (h *FolderHandler) GetFolders(res http.ResponseWriter, req *http.Request) {
-	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		subsMap := make(map[uint]*model.UserFolderSubscription)
 		if user != nil {
-			subsList := businesslogic.GetFolderSubscriptions(user, db)
+			subsList, err := businesslogic.GetFolderSubscriptions(user, repo)
+			if err != nil {
+				return 0, nil, "", err
+			}
 			for _, sub := range subsList {
 				subsMap[sub.FolderId] = sub
 			}
@@ -77,7 +121,7 @@ func (h *FolderHandler) GetFolders(res http.ResponseWriter, req *http.Request) {
 
 				var folderCopy model.Folder
 				if err := copier.Copy(&folderCopy, &folder); err != nil {
-					panic(err)
+					return 0, nil, "", utils.InternalError(err)
 				}
 
 				_, folderCopy.IsSubscribed = subsMap[folderCopy.Id]
@@ -87,311 +131,444 @@ func (h *FolderHandler) GetFolders(res http.ResponseWriter, req *http.Request) {
 			}
 		}
 
-		return http.StatusOK, data, ""
+		return http.StatusOK, data, "", nil
 
 	})
 }
 
 func (h *FolderHandler) GetFolder(res http.ResponseWriter, req *http.Request) {
-	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		folderId := utils.ExtractVarInt("folderId", req)
-		folder := h.folderCache.Get(folderId, user)
+		folder, err := h.folderFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		if folder.Type != model.FolderTypeNormal && (user == nil || !user.IsAdmin) {
+			return 0, nil, "", utils.NewError(utils.ErrForbidden, utils.ErrorCodeFolderForbidden, "You do not have access to this folder")
+		}
 
 		var folderCopy model.Folder
 		if err := copier.Copy(&folderCopy, &folder); err != nil {
-			panic(err)
+			return 0, nil, "", utils.InternalError(err)
 		}
 
-		folderCopy.IsSubscribed = businesslogic.GetFolderSubscriptionStatus(&folderCopy, user, db)
-
-		if folderCopy.Type == model.FolderTypeNormal {
-			return http.StatusOK, folderCopy, ""
-		} else {
-			if user != nil && user.IsAdmin {
-				return http.StatusOK, folderCopy, ""
-			} else {
-				panic(utils.ErrForbidden)
-			}
+		folderCopy.IsSubscribed, err = businesslogic.GetFolderSubscriptionStatus(&folderCopy, user, repo)
+		if err != nil {
+			return 0, nil, "", err
 		}
 
+		return http.StatusOK, folderCopy, "", nil
+
 	})
 }
 
 func (h *FolderHandler) GetDiscussions(res http.ResponseWriter, req *http.Request) {
-	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		folderId := utils.ExtractVarInt("folderId", req)
-		pageSize, pageStart := utils.ExtractPageSizeAndStart(req)
+		pageSize, pageStart, err := utils.ExtractPageSizeAndStart(req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		folder := h.folderCache.Get(folderId, user)
+		folder, err := h.folderFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussions := businesslogic.GetDiscussions(folder, pageStart, pageSize, user, db)
+		discussions, err := businesslogic.GetDiscussions(folder, pageStart, pageSize, user, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, discussions, ""
+		return http.StatusOK, discussions, "", nil
 
 	})
 }
 
 func (h *FolderHandler) GetDiscussionsBefore(res http.ResponseWriter, req *http.Request) {
-	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		var err error
-		dateBefore := time.Now()
-		pageSize := 0
+		dateBefore, err := utils.ExtractQueryTime("dt", req, time.Now())
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		dateParam := req.URL.Query().Get("dt")
-		if len(dateParam) > 0 {
-			dateBefore, err = time.Parse(time.RFC3339, dateParam)
-			if err != nil {
-				panic(utils.ErrBadRequest)
-			}
+		pageSize, err := utils.ExtractQueryInt("size", req)
+		if err != nil {
+			return 0, nil, "", err
 		}
 
-		pageSize = utils.ExtractQueryInt("size", req)
-		folderId := utils.ExtractVarInt("folderId", req)
+		folder, err := h.folderFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		discussions, err := businesslogic.GetDiscussionsBefore(folder, dateBefore, pageSize, user, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		folder := h.folderCache.Get(folderId, user)
+		return http.StatusOK, discussions, "", nil
 
-		discussions := businesslogic.GetDiscussionsBefore(folder, dateBefore, pageSize, user, db)
+	})
+}
 
-		return http.StatusOK, discussions, ""
+func (h *FolderHandler) GetSimilarDiscussions(res http.ResponseWriter, req *http.Request) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		folder, err := h.folderFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		similar, err := h.duplicateDetector.Preview(folder, utils.ExtractQueryString("title", req), utils.ExtractQueryString("header", req), repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, similar, "", nil
 
 	})
 }
 
 func (h *FolderHandler) CreateDiscussion(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		folderId := utils.ExtractVarInt("folderId", req)
-		folder := h.folderCache.Get(folderId, user)
+		folder, err := h.folderFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
 		var discussion model.Discussion
-		if err := json.NewDecoder(req.Body).Decode(&discussion); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &discussion); err != nil {
+			return 0, nil, "", err
 		}
 
-		created := businesslogic.CreateDiscussion(folder, &discussion, user, h.userCache, h.discussionCache, db)
+		created, err := businesslogic.CreateDiscussion(folder, &discussion, user, h.userCache, h.discussionCache, h.duplicateDetector, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
+		h.eventBus.Publish(&events.DiscussionCreated{Discussion: created})
 		discussionCount.WithLabelValues(folder.Key).Inc()
 
-		return http.StatusOK, created, ""
+		return http.StatusOK, created, "", nil
 
 	})
 }
 
 func (h *FolderHandler) GetDiscussion(res http.ResponseWriter, req *http.Request) {
-	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		folderId := utils.ExtractVarInt("folderId", req)
-		discussionId := utils.ExtractVarInt("discussionId", req)
-
-		folder := h.folderCache.Get(folderId, user)
-		discussion := h.discussionCache.Get(discussionId, user)
-
-		if discussion == nil {
-			panic(utils.ErrNotFound)
+		folder, discussion, err := h.folderAndDiscussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
 		}
 
 		if discussion.FolderId != folder.Id {
-			panic(utils.ErrBadRequest)
+			return 0, nil, "", utils.NewError(utils.ErrBadRequest, utils.ErrorCodeInvalidParameter, "Discussion is not in this folder").WithField("discussionId", "not in folder")
 		}
 
 		if user != nil {
-			discussion.IsSubscribed = businesslogic.GetDiscussionSubscriptionStatus(discussion, user, db)
-			discussion.IsBlocked = h.discussionCache.IsBlocked(discussion, user)
+			if discussion.IsSubscribed, err = businesslogic.GetDiscussionSubscriptionStatus(discussion, user, repo); err != nil {
+				return 0, nil, "", err
+			}
+			if discussion.IsBlocked, err = h.discussionCache.IsBlocked(discussion, user); err != nil {
+				return 0, nil, "", err
+			}
 		}
 
-		return http.StatusOK, discussion, ""
+		return http.StatusOK, discussion, "", nil
 
 	})
 }
 
 func (h *FolderHandler) EditDiscussion(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		folderId := utils.ExtractVarInt("folderId", req)
-		discussionId := utils.ExtractVarInt("discussionId", req)
+		folder, err := h.folderFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		folder := h.folderCache.Get(folderId, user)
+		discussionId, err := utils.ExtractVarInt("discussionId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
 		var discussion model.Discussion
-		if err := json.NewDecoder(req.Body).Decode(&discussion); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &discussion); err != nil {
+			return 0, nil, "", err
 		}
 		discussion.Id = discussionId
 
-		edited := businesslogic.EditDiscussion(folder, &discussion, user, h.discussionCache, db)
+		edited, err := businesslogic.EditDiscussion(folder, &discussion, user, h.discussionCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		h.eventBus.Publish(&events.DiscussionEdited{Discussion: edited})
 
-		return http.StatusOK, edited, ""
+		return http.StatusOK, edited, "", nil
 
 	})
 }
 
 func (h *FolderHandler) DeleteDiscussion(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		folderId := utils.ExtractVarInt("folderId", req)
-		discussionId := utils.ExtractVarInt("discussionId", req)
-
-		folder := h.folderCache.Get(folderId, user)
+		folder, discussion, err := h.folderAndDiscussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussion := h.discussionCache.Get(discussionId, user)
-		if discussion == nil {
-			panic(utils.ErrNotFound)
+		deleted, err := businesslogic.DeleteDiscussion(folder, discussion, user, repo)
+		if err != nil {
+			return 0, nil, "", err
 		}
 
-		deleted := businesslogic.DeleteDiscussion(folder, discussion, user, db)
+		if err := h.discussionCache.Put(deleted); err != nil {
+			return 0, nil, "", err
+		}
 
-		h.discussionCache.Put(deleted)
+		h.eventBus.Publish(&events.DiscussionDeleted{Discussion: deleted, Deleted: true})
 
-		return http.StatusOK, deleted, ""
+		return http.StatusOK, deleted, "", nil
 
 	})
 }
 
 func (h *FolderHandler) GetPosts(res http.ResponseWriter, req *http.Request) {
-	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		folderId := utils.ExtractVarInt("folderId", req)
-		discussionId := utils.ExtractVarInt("discussionId", req)
+		folder, discussion, err := h.folderAndDiscussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		folder := h.folderCache.Get(folderId, user)
-		discussion := h.discussionCache.Get(discussionId, user)
+		pageStart, err := utils.ExtractQueryInt64("start", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		pageStart := utils.ExtractQueryInt64("start", req)
+		pageSize, err := utils.ExtractQueryInt("size", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		pageSize := utils.ExtractQueryInt("size", req)
 		if pageSize == 0 {
 			pageSize = 20
 		}
 
-		posts := businesslogic.GetPosts(folder, discussion, user, pageStart, pageSize, db)
+		posts, err := businesslogic.GetPosts(folder, discussion, user, pageStart, pageSize, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, posts, ""
+		return http.StatusOK, posts, "", nil
 
 	})
 }
 
-func (h *FolderHandler) CreatePost(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+func (h *FolderHandler) SearchDiscussion(res http.ResponseWriter, req *http.Request) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		folder, discussion, err := h.folderAndDiscussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		query := req.URL.Query().Get("q")
+		if len(query) == 0 {
+			return 0, nil, "", utils.NewError(utils.ErrBadRequest, utils.ErrorCodeValidationFailed, "You must supply a search term").WithField("q", "is required")
+		}
+
+		size, err := utils.ExtractQueryInt("size", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		if size == 0 {
+			size = 20
+		}
+
+		searchQuery := &model.SearchQuery{
+			Text:  query,
+			Size:  size,
+			After: utils.ExtractQueryString("after", req),
+		}
+
+		results, err := businesslogic.SearchDiscussion(h.searchEngine, h.searchGuard, searchQuery, folder, discussion, user, utils.ExtractIPAdress(req), h.folderCache, h.discussionCache, repo, req.Context())
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, results, "", nil
+
+	})
+}
 
-		folderId := utils.ExtractVarInt("folderId", req)
-		discussionId := utils.ExtractVarInt("discussionId", req)
+func (h *FolderHandler) CreatePost(res http.ResponseWriter, req *http.Request) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		var post model.Post
-		if err := json.NewDecoder(req.Body).Decode(&post); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &post); err != nil {
+			return 0, nil, "", err
 		}
 
-		folder := h.folderCache.Get(folderId, user)
-		discussion := h.discussionCache.Get(discussionId, user)
+		folder, discussion, err := h.folderAndDiscussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		created := businesslogic.CreatePost(folder, discussion, user, &post, h.discussionCache, h.userCache, db)
-		h.postProcessor.PublishPost(created)
+		created, err := businesslogic.CreatePost(folder, discussion, user, &post, h.discussionCache, h.userCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		h.eventBus.Publish(&events.PostCreated{Post: created})
 
 		returnPostsFromPostNum := created.PostNum
 
-		lastBookmark := businesslogic.GetDiscussionBookmark(user, discussion, db)
+		lastBookmark, err := businesslogic.GetDiscussionBookmark(user, discussion, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
 		if lastBookmark != nil {
 			returnPostsFromPostNum = lastBookmark.LastPostCount + 1
 		}
 
-		posts := businesslogic.GetPosts(folder, discussion, user, returnPostsFromPostNum, 20, db)
+		posts, err := businesslogic.GetPosts(folder, discussion, user, returnPostsFromPostNum, 20, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		businesslogic.UpdateDiscussionBookmark(user, discussion, created, db)
+		if _, err := businesslogic.UpdateDiscussionBookmark(user, discussion, created, repo); err != nil {
+			return 0, nil, "", err
+		}
 
 		postCount.WithLabelValues(folder.Key).Inc()
 
-		return http.StatusOK, posts, ""
+		return http.StatusOK, posts, "", nil
 
 	})
 }
 
 func (h *FolderHandler) EditPost(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		folderId := utils.ExtractVarInt("folderId", req)
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		postId := utils.ExtractVarInt("postId", req)
+		folder, discussion, err := h.folderAndDiscussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		folder := h.folderCache.Get(folderId, user)
-		discussion := h.discussionCache.Get(discussionId, user)
+		postId, err := utils.ExtractVarInt("postId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
 		var post model.Post
-		if err := json.NewDecoder(req.Body).Decode(&post); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &post); err != nil {
+			return 0, nil, "", err
 		}
 
 		post.Id = postId
 
-		updated := businesslogic.EditPost(folder, discussion, user, &post, db)
+		updated, err := businesslogic.EditPost(folder, discussion, user, &post, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		h.postProcessor.PublishPost(updated)
+		h.eventBus.Publish(&events.PostEdited{Post: updated})
 
-		return http.StatusOK, updated, ""
+		return http.StatusOK, updated, "", nil
 
 	})
 }
 
 func (h *FolderHandler) DeletePost(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		folderId := utils.ExtractVarInt("folderId", req)
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		postId := utils.ExtractVarInt("postId", req)
+		folder, discussion, err := h.folderAndDiscussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		folder := h.folderCache.Get(folderId, user)
-		discussion := h.discussionCache.Get(discussionId, user)
+		postId, err := utils.ExtractVarInt("postId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		updated := businesslogic.DeletePost(folder, discussion, user, postId, db)
+		updated, err := businesslogic.DeletePost(folder, discussion, user, postId, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		h.postProcessor.PublishPost(updated)
+		h.eventBus.Publish(&events.PostDeleted{Post: updated})
 
-		return http.StatusOK, updated, ""
+		return http.StatusOK, updated, "", nil
 
 	})
 }
 
 func (h *FolderHandler) SubscribeToDiscussion(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		discussionId, err := utils.ExtractVarInt("discussionId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		discussion := h.discussionCache.Get(discussionId, user)
+		discussion, err := h.discussionCache.Get(discussionId, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
 		if req.Method == http.MethodPost {
-			businesslogic.SetDiscussionSubscriptionStatus(discussion, user, db, h.userCache)
-			discussion.IsSubscribed = true
+			err = businesslogic.SetDiscussionSubscriptionStatus(discussion, user, repo, h.userCache)
 		} else {
-			businesslogic.UnsetDiscussionSubscriptionStatus(discussion, user, db, h.userCache)
-			discussion.IsSubscribed = false
+			err = businesslogic.UnsetDiscussionSubscriptionStatus(discussion, user, repo, h.userCache)
+		}
+
+		if err != nil {
+			return 0, nil, "", err
 		}
 
-		return http.StatusOK, discussion, ""
+		discussion.IsSubscribed = req.Method == http.MethodPost
+
+		return http.StatusOK, discussion, "", nil
 
 	})
 }
 
 func (h *FolderHandler) SubscribeToFolder(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		folderId := utils.ExtractVarInt("folderId", req)
-		folder := h.folderCache.Get(folderId, user)
+		folder, err := h.folderFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
 		var folderCopy model.Folder
 		if err := copier.Copy(&folderCopy, &folder); err != nil {
-			panic(err)
+			return 0, nil, "", utils.InternalError(err)
 		}
 
 		if req.Method == http.MethodPost {
-			businesslogic.SetFolderSubscriptionStatus(folder, user, db, h.userCache)
-			folderCopy.IsSubscribed = true
+			err = businesslogic.SetFolderSubscriptionStatus(folder, user, repo, h.userCache)
 		} else {
-			businesslogic.UnsetFolderSubscriptionStatus(folder, user, db, h.userCache)
-			folderCopy.IsSubscribed = false
+			err = businesslogic.UnsetFolderSubscriptionStatus(folder, user, repo, h.userCache)
 		}
 
-		return http.StatusOK, folderCopy, ""
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		folderCopy.IsSubscribed = req.Method == http.MethodPost
+
+		return http.StatusOK, folderCopy, "", nil
 
 	})
 }
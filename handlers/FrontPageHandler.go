@@ -18,13 +18,13 @@ package handlers
 import (
 	"justthetalk/businesslogic"
 	"justthetalk/model"
+	"justthetalk/repository"
 	"justthetalk/utils"
 	"net/http"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"gorm.io/gorm"
 )
 
 var (
@@ -47,20 +47,27 @@ func NewFrontPageHandler(userCache *businesslogic.UserCache, discussionCache *bu
 }
 
 func (h *FrontPageHandler) GetFrontPage(res http.ResponseWriter, req *http.Request) {
-	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		pageSize := 0
-		pageStart := 0
+		pageStart, err := utils.ExtractQueryInt("start", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		startParam := req.URL.Query().Get("start")
-		if len(startParam) > 0 {
-			pageStart = utils.ExtractQueryInt("start", req)
+		pageSize, err := utils.ExtractQueryInt("size", req)
+		if err != nil {
+			return 0, nil, "", err
 		}
 
-		pageSize = utils.ExtractQueryInt("size", req)
-		viewType := utils.ExtractVarString("viewType", req)
+		viewType, err := utils.ExtractVarString("viewType", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussions := businesslogic.GetFrontPage(user, viewType, pageSize, pageStart, h.userCache, h.discussionCache, db)
+		discussions, err := businesslogic.GetFrontPage(user, viewType, pageSize, pageStart, h.userCache, h.discussionCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
 		if user == nil {
 			frontPageCount.WithLabelValues("anon").Inc()
@@ -68,30 +75,33 @@ func (h *FrontPageHandler) GetFrontPage(res http.ResponseWriter, req *http.Reque
 			frontPageCount.WithLabelValues("auth").Inc()
 		}
 
-		return http.StatusOK, discussions, ""
+		return http.StatusOK, discussions, "", nil
 
 	})
 }
 
 func (h *FrontPageHandler) GetFrontPageSince(res http.ResponseWriter, req *http.Request) {
-	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
-
-		var err error
-		dateSince := time.Now()
-		pageSize := 0
-
-		dateParam := req.URL.Query().Get("dt")
-		if len(dateParam) > 0 {
-			dateSince, err = time.Parse(time.RFC3339, dateParam)
-			if err != nil {
-				panic(utils.ErrBadRequest)
-			}
+	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		dateSince, err := utils.ExtractQueryTime("dt", req, time.Now())
+		if err != nil {
+			return 0, nil, "", err
 		}
 
-		pageSize = utils.ExtractQueryInt("size", req)
-		viewType := utils.ExtractVarString("viewType", req)
+		pageSize, err := utils.ExtractQueryInt("size", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussions := businesslogic.GetFrontPageSince(user, viewType, pageSize, dateSince, h.userCache, h.discussionCache, db)
+		viewType, err := utils.ExtractVarString("viewType", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		discussions, err := businesslogic.GetFrontPageSince(user, viewType, pageSize, dateSince, h.userCache, h.discussionCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
 		if user == nil {
 			frontPageCount.WithLabelValues("anon").Inc()
@@ -99,30 +109,33 @@ func (h *FrontPageHandler) GetFrontPageSince(res http.ResponseWriter, req *http.
 			frontPageCount.WithLabelValues("auth").Inc()
 		}
 
-		return http.StatusOK, discussions, ""
+		return http.StatusOK, discussions, "", nil
 
 	})
 }
 
 func (h *FrontPageHandler) GetFrontPageBefore(res http.ResponseWriter, req *http.Request) {
-	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
-
-		var err error
-		dateSince := time.Now()
-		pageSize := 0
-
-		dateParam := req.URL.Query().Get("dt")
-		if len(dateParam) > 0 {
-			dateSince, err = time.Parse(time.RFC3339, dateParam)
-			if err != nil {
-				panic(utils.ErrBadRequest)
-			}
+	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		dateBefore, err := utils.ExtractQueryTime("dt", req, time.Now())
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		pageSize, err := utils.ExtractQueryInt("size", req)
+		if err != nil {
+			return 0, nil, "", err
 		}
 
-		pageSize = utils.ExtractQueryInt("size", req)
-		viewType := utils.ExtractVarString("viewType", req)
+		viewType, err := utils.ExtractVarString("viewType", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		discussions := businesslogic.GetFrontPageBefore(user, viewType, pageSize, dateSince, h.userCache, h.discussionCache, db)
+		discussions, err := businesslogic.GetFrontPageBefore(user, viewType, pageSize, dateBefore, h.userCache, h.discussionCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
 		if user == nil {
 			frontPageCount.WithLabelValues("anon").Inc()
@@ -130,7 +143,7 @@ func (h *FrontPageHandler) GetFrontPageBefore(res http.ResponseWriter, req *http
 			frontPageCount.WithLabelValues("auth").Inc()
 		}
 
-		return http.StatusOK, discussions, ""
+		return http.StatusOK, discussions, "", nil
 
 	})
 }
@@ -18,60 +18,183 @@ package handlers
 import (
 	"justthetalk/businesslogic"
 	"justthetalk/model"
+	"justthetalk/repository"
+	"justthetalk/search"
 	"justthetalk/utils"
 	"net/http"
-	"strconv"
-
-	log "github.com/sirupsen/logrus"
-	"gorm.io/gorm"
+	"time"
 )
 
 type SearchHandler struct {
+	engine          search.Engine
 	folderCache     *businesslogic.FolderCache
 	discussionCache *businesslogic.DiscussionCache
+	searchGuard     *businesslogic.SearchGuard
+	searchAlerter   *businesslogic.SearchAlerter
 }
 
-func NewSearchHandler(folderCache *businesslogic.FolderCache, discussionCache *businesslogic.DiscussionCache) *SearchHandler {
+func NewSearchHandler(engine search.Engine, folderCache *businesslogic.FolderCache, discussionCache *businesslogic.DiscussionCache, searchGuard *businesslogic.SearchGuard, searchAlerter *businesslogic.SearchAlerter) *SearchHandler {
 
 	return &SearchHandler{
+		engine:          engine,
 		folderCache:     folderCache,
 		discussionCache: discussionCache,
+		searchGuard:     searchGuard,
+		searchAlerter:   searchAlerter,
 	}
 
 }
 
 func (h *SearchHandler) SearchPosts(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		var err error
+		if err := h.searchGuard.Err(); err != nil {
+			return 0, nil, "", err
+		}
 
 		query := req.URL.Query().Get("q")
-		sizeParam := req.URL.Query().Get("size")
-		startParam := req.URL.Query().Get("start")
+		if len(query) == 0 {
+			return 0, nil, "", utils.NewError(utils.ErrBadRequest, utils.ErrorCodeValidationFailed, "You must supply a search term").WithField("q", "is required")
+		}
+
+		size, err := utils.ExtractQueryInt("size", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		if size == 0 {
+			size = 50
+		}
+
+		folderId, err := utils.ExtractQueryInt("folderId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		discussionId, err := utils.ExtractQueryInt("discussionId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		if folderId < 0 {
+			return 0, nil, "", utils.NewValidationError(utils.FieldError{Field: "folderId", Message: "must not be negative"})
+		}
+
+		if discussionId < 0 {
+			return 0, nil, "", utils.NewValidationError(utils.FieldError{Field: "discussionId", Message: "must not be negative"})
+		}
+
+		from, err := utils.ExtractQueryTime("from", req, time.Time{})
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		to, err := utils.ExtractQueryTime("to", req, time.Time{})
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		sort := utils.ExtractQueryString("sort", req)
+		if len(sort) == 0 {
+			sort = model.SearchSortDate
+		}
+
+		searchQuery := &model.SearchQuery{
+			Text:         query,
+			FolderId:     uint(folderId),
+			DiscussionId: uint(discussionId),
+			Author:       utils.ExtractQueryString("author", req),
+			From:         from,
+			To:           to,
+			Sort:         sort,
+			Size:         size,
+			After:        utils.ExtractQueryString("after", req),
+		}
+
+		results, err := businesslogic.SearchPosts(h.engine, searchQuery, user, utils.ExtractIPAdress(req), h.folderCache, h.discussionCache, repo, req.Context())
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, results, "", nil
+
+	})
+}
 
-		size := 50
-		start := 0
+func (h *SearchHandler) GetSavedSearches(res http.ResponseWriter, req *http.Request) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		if len(sizeParam) > 0 {
-			if size, err = strconv.Atoi(sizeParam); err != nil {
-				log.Errorf("%v", err)
-				panic(utils.ErrBadRequest)
-			}
+		savedSearches, err := businesslogic.GetSavedSearches(user, repo)
+		if err != nil {
+			return 0, nil, "", err
 		}
 
-		if len(startParam) > 0 {
-			if start, err = strconv.Atoi(startParam); err != nil {
-				log.Errorf("%v", err)
-				panic(utils.ErrBadRequest)
-			}
+		return http.StatusOK, savedSearches, "", nil
+
+	})
+}
+
+func (h *SearchHandler) CreateSavedSearch(res http.ResponseWriter, req *http.Request) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		var savedSearch model.SavedSearch
+		if err := utils.DecodeRequestBody(req, &savedSearch); err != nil {
+			return 0, nil, "", err
+		}
+
+		created, err := businesslogic.CreateSavedSearch(&savedSearch, user, h.folderCache, h.discussionCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		h.searchAlerter.Invalidate()
+
+		return http.StatusOK, created, "", nil
+
+	})
+}
+
+func (h *SearchHandler) EditSavedSearch(res http.ResponseWriter, req *http.Request) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		savedSearchId, err := utils.ExtractVarInt("savedSearchId", req)
+		if err != nil {
+			return 0, nil, "", err
 		}
 
-		if len(query) > 0 {
-			results := businesslogic.SearchPosts(query, size, start, user, utils.ExtractIPAdress(req), h.folderCache, h.discussionCache, db, req.Context())
-			return http.StatusOK, results, ""
-		} else {
-			panic(utils.ErrBadRequest)
+		var savedSearch model.SavedSearch
+		if err := utils.DecodeRequestBody(req, &savedSearch); err != nil {
+			return 0, nil, "", err
 		}
+		savedSearch.Id = savedSearchId
+
+		updated, err := businesslogic.EditSavedSearch(&savedSearch, user, h.folderCache, h.discussionCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		h.searchAlerter.Invalidate()
+
+		return http.StatusOK, updated, "", nil
+
+	})
+}
+
+func (h *SearchHandler) DeleteSavedSearch(res http.ResponseWriter, req *http.Request) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		savedSearchId, err := utils.ExtractVarInt("savedSearchId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		if err := businesslogic.DeleteSavedSearch(savedSearchId, user, repo); err != nil {
+			return 0, nil, "", err
+		}
+
+		h.searchAlerter.Invalidate()
+
+		return http.StatusNoContent, nil, "", nil
 
 	})
 }
@@ -16,9 +16,7 @@ package handlers
 
 import (
 	"encoding/json"
-	"errors"
 	"net/http"
-	"os"
 	"regexp"
 	"sort"
 	"strings"
@@ -26,10 +24,11 @@ import (
 
 	"github.com/dgrijalva/jwt-go"
 	log "github.com/sirupsen/logrus"
-	"gorm.io/gorm"
 
 	"justthetalk/businesslogic"
+	"justthetalk/config"
 	"justthetalk/model"
+	"justthetalk/repository"
 	"justthetalk/utils"
 )
 
@@ -39,158 +38,209 @@ type UserHandler struct {
 	discussionCache  *businesslogic.DiscussionCache
 	emailRegex       *regexp.Regexp
 	useSecureCookies bool
+	domain           string
+	signingKey       []byte
+	recaptchaSecret  string
 }
 
-func NewUserHandler(platform string, userCache *businesslogic.UserCache, folderCache *businesslogic.FolderCache, discussionCache *businesslogic.DiscussionCache) *UserHandler {
+func NewUserHandler(cfg *config.Config, userCache *businesslogic.UserCache, folderCache *businesslogic.FolderCache, discussionCache *businesslogic.DiscussionCache) *UserHandler {
 
 	return &UserHandler{
 		userCache:        userCache,
 		folderCache:      folderCache,
 		discussionCache:  discussionCache,
 		emailRegex:       regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$"),
-		useSecureCookies: (platform == utils.Production),
+		useSecureCookies: cfg.IsProduction(),
+		domain:           cfg.Server.Domain,
+		signingKey:       []byte(cfg.Auth.SigningKey.Value()),
+		recaptchaSecret:  cfg.Auth.RecaptchaApiKey.Value(),
 	}
 
 }
 
+func (h *UserHandler) validateRecaptcha(recaptchaResponse string) error {
+	if err := utils.ValidateRecaptchaResponse(h.recaptchaSecret, recaptchaResponse); err != nil {
+		return utils.WrapError(utils.ErrBadRequest, utils.ErrorCodeRecaptchaFailed, err)
+	}
+	return nil
+}
+
 func (h *UserHandler) GetUser(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 		// just return the user straight from the cache
-		return http.StatusOK, user, ""
+		return http.StatusOK, user, "", nil
 	})
 }
 
-func (h *UserHandler) sendUserWithNewAccessToken(user *model.User) (map[string]interface{}, *http.Cookie) {
+func (h *UserHandler) sendUserWithNewAccessToken(user *model.User) (map[string]interface{}, *http.Cookie, error) {
 
-	cookie := h.createRefreshTokenCookie(user)
+	cookie, err := h.createRefreshTokenCookie(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accessToken, err := utils.CreateJWT(user, time.Now().Add(15*time.Minute), model.UserClaimPurposeAccessToken, h.domain, h.signingKey)
+	if err != nil {
+		return nil, nil, utils.InternalError(err)
+	}
 
 	responseData := make(map[string]interface{})
 	responseData["user"] = user
-	responseData["accessToken"] = utils.CreateJWT(user, time.Now().Add(15*time.Minute), model.UserClaimPurposeAccessToken)
+	responseData["accessToken"] = accessToken
 
-	return responseData, cookie
+	return responseData, cookie, nil
 
 }
 
 func (h *UserHandler) Login(res http.ResponseWriter, req *http.Request) {
-	utils.AnonymousHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, db *gorm.DB) (int, interface{}, string) {
+	utils.AnonymousHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, repo repository.Repository) (int, interface{}, string, error) {
 
 		var credentials model.LoginCredentials
-		if err := json.NewDecoder(req.Body).Decode(&credentials); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &credentials); err != nil {
+			return 0, nil, "", err
+		}
+
+		validationErr := utils.NewValidationError()
+		if len(credentials.Username) == 0 {
+			validationErr.WithField("username", "is required")
+		}
+		if len(credentials.Password) == 0 {
+			validationErr.WithField("password", "is required")
+		}
+		if len(validationErr.Fields) > 0 {
+			return 0, nil, "", validationErr
 		}
 
-		if len(credentials.Username) == 0 || len(credentials.Password) == 0 {
-			panic(utils.ErrBadRequest)
+		user, err := businesslogic.ValidateUserLogin(credentials, utils.ExtractIPAdress(req), repo, h.userCache)
+		if err != nil {
+			return 0, nil, "", err
 		}
 
-		user := businesslogic.ValidateUserLogin(credentials, utils.ExtractIPAdress(req), db, h.userCache)
+		responseData, cookie, err := h.sendUserWithNewAccessToken(user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		responseData, cookie := h.sendUserWithNewAccessToken(user)
 		http.SetCookie(res, cookie)
 
-		return http.StatusOK, responseData, "Login successful"
+		return http.StatusOK, responseData, "Login successful", nil
 
 	})
 }
 
 func (h *UserHandler) Logout(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		if refreshToken, err := req.Cookie("refresh-token"); err == nil {
-			h.userCache.ClearRefreshToken(refreshToken.Value)
+			if err := h.userCache.ClearRefreshToken(refreshToken.Value); err != nil {
+				return 0, nil, "", err
+			}
 			h.userCache.Flush(user)
 		}
 
 		cookie := h.expiredRefreshTokenCookie()
 		http.SetCookie(res, cookie)
 
-		businesslogic.CreateLoginHistory("logout", user, utils.ExtractIPAdress(req), db)
+		if err := businesslogic.CreateLoginHistory("logout", user, utils.ExtractIPAdress(req), repo); err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, nil, "User logged out"
+		return http.StatusOK, nil, "User logged out", nil
 
 	})
 }
 
-func extractCookieHack(cookieHeader string) string {
+func extractCookieHack(cookieHeader string) (string, error) {
 
 	refreshTokenCookies := []string{}
 
 	cookies := strings.Split(cookieHeader, ";")
 	for _, cookie := range cookies {
 		if strings.HasPrefix(strings.TrimSpace(cookie), "refresh-token") {
-			refreshTokenCookies = append(refreshTokenCookies, strings.Split(cookie, "=")[1])
+			if parts := strings.SplitN(cookie, "=", 2); len(parts) == 2 {
+				refreshTokenCookies = append(refreshTokenCookies, parts[1])
+			}
 		}
 	}
 
 	if len(refreshTokenCookies) == 0 {
-		panic(utils.ErrBadRequest)
+		return "", utils.NewError(utils.ErrBadRequest, utils.ErrorCodeInvalidToken, "No refresh token supplied")
 	}
 
 	sort.Slice(refreshTokenCookies, func(i, j int) bool {
 		return len(refreshTokenCookies[i]) > len(refreshTokenCookies[j])
 	})
 
-	return refreshTokenCookies[0]
+	return refreshTokenCookies[0], nil
 
 }
 
 func (h *UserHandler) RefreshToken(res http.ResponseWriter, req *http.Request) {
-	utils.AnonymousHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, db *gorm.DB) (int, interface{}, string) {
+	utils.AnonymousHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, repo repository.Repository) (statusCode int, responseData interface{}, message string, err error) {
 
 		defer func() {
-			if r := recover(); r != nil {
-				err := r.(error)
+			if err != nil {
 				log.Error(err)
 				if data, err := json.Marshal(req.Header); err == nil {
 					log.Info(string(data))
 				}
-				panic(err)
 			}
 		}()
 
 		cookieHeader := req.Header.Get("Cookie")
 		if len(cookieHeader) == 0 {
-			panic(utils.ErrBadRequest)
+			return 0, nil, "", utils.NewError(utils.ErrBadRequest, utils.ErrorCodeInvalidToken, "No refresh token supplied")
+		}
+
+		refreshToken, err := extractCookieHack(cookieHeader)
+		if err != nil {
+			return 0, nil, "", err
 		}
-		refreshToken := extractCookieHack(cookieHeader)
 
 		token, err := jwt.ParseWithClaims(refreshToken, &model.UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(utils.SigningKey), nil
+			return h.signingKey, nil
 		})
 
 		if err != nil {
-			panic(utils.ErrBadRequest)
+			return 0, nil, "", utils.WrapError(utils.ErrBadRequest, utils.ErrorCodeInvalidToken, err)
 		}
 
 		claims, ok := token.Claims.(*model.UserClaims)
-		if !ok {
-			panic(utils.ErrBadRequest)
+		if !ok || claims.Purpose != model.UserClaimPurposeRefreshToken {
+			return 0, nil, "", utils.NewError(utils.ErrBadRequest, utils.ErrorCodeInvalidToken, "Token is not a refresh token")
 		}
 
-		if claims.Purpose != model.UserClaimPurposeRefreshToken {
-			panic(utils.ErrBadRequest)
+		user, err := h.userCache.Get(claims.UserId)
+		if err != nil {
+			return 0, nil, "", err
 		}
 
-		user := h.userCache.Get(claims.UserId)
+		cookie, err := h.createRefreshTokenCookie(user)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		accessToken, err := utils.CreateJWT(user, time.Now().Add(15*time.Minute), model.UserClaimPurposeAccessToken, h.domain, h.signingKey)
+		if err != nil {
+			return 0, nil, "", utils.InternalError(err)
+		}
 
-		cookie := h.createRefreshTokenCookie(user)
 		http.SetCookie(res, cookie)
 
-		responseData := make(map[string]interface{})
-		responseData["accessToken"] = utils.CreateJWT(user, time.Now().Add(15*time.Minute), model.UserClaimPurposeAccessToken)
+		data := make(map[string]interface{})
+		data["accessToken"] = accessToken
 
-		return http.StatusOK, responseData, ""
+		return http.StatusOK, data, "", nil
 
 	})
 }
 
 func (h *UserHandler) UpdateAutoSubscribe(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		var updateData model.UserOptionsUpdateData
-		if err := json.NewDecoder(req.Body).Decode(&updateData); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &updateData); err != nil {
+			return 0, nil, "", err
 		}
 
 		state := 0
@@ -198,18 +248,21 @@ func (h *UserHandler) UpdateAutoSubscribe(res http.ResponseWriter, req *http.Req
 			state = 1
 		}
 
-		updatedUser := businesslogic.UpdateAutoSubscribe(user, state, h.userCache, db)
+		updatedUser, err := businesslogic.UpdateAutoSubscribe(user, state, h.userCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, updatedUser, ""
+		return http.StatusOK, updatedUser, "", nil
 
 	})
 }
 func (h *UserHandler) UpdateSortFolders(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		var updateData model.UserOptionsUpdateData
-		if err := json.NewDecoder(req.Body).Decode(&updateData); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &updateData); err != nil {
+			return 0, nil, "", err
 		}
 
 		state := 0
@@ -217,406 +270,532 @@ func (h *UserHandler) UpdateSortFolders(res http.ResponseWriter, req *http.Reque
 			state = 1
 		}
 
-		updatedUser := businesslogic.UpdateSortFoldersByActivity(user, state, h.userCache, db)
+		updatedUser, err := businesslogic.UpdateSortFoldersByActivity(user, state, h.userCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, updatedUser, ""
+		return http.StatusOK, updatedUser, "", nil
 
 	})
 }
 
 func (h *UserHandler) UpdateSubscriptionFetchOrder(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		var updateData model.UserOptionsUpdateData
-		if err := json.NewDecoder(req.Body).Decode(&updateData); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &updateData); err != nil {
+			return 0, nil, "", err
 		}
 
-		updatedUser := businesslogic.UpdateSubscriptionFetchOrder(user, updateData.SubscriptionFetchOrder, h.userCache, db)
+		updatedUser, err := businesslogic.UpdateSubscriptionFetchOrder(user, updateData.SubscriptionFetchOrder, h.userCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, updatedUser, ""
+		return http.StatusOK, updatedUser, "", nil
 
 	})
 }
 
 func (h *UserHandler) UpdateBio(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		var updateData model.UserOptionsUpdateData
-		if err := json.NewDecoder(req.Body).Decode(&updateData); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &updateData); err != nil {
+			return 0, nil, "", err
 		}
 
-		updatedUser := businesslogic.UpdateBio(user, updateData.Bio, h.userCache, db)
+		updatedUser, err := businesslogic.UpdateBio(user, updateData.Bio, h.userCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, updatedUser, ""
+		return http.StatusOK, updatedUser, "", nil
 
 	})
 }
 
 func (h *UserHandler) UpdatePassword(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		var updateData model.UserOptionsUpdateData
-		if err := json.NewDecoder(req.Body).Decode(&updateData); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &updateData); err != nil {
+			return 0, nil, "", err
 		}
 
 		if h.useSecureCookies {
-			if err := utils.ValidateRecaptchaResponse(updateData.RecaptchaResponse); err != nil {
-				utils.PanicWithWrapper(utils.ErrBadRequest, err)
+			if err := h.validateRecaptcha(updateData.RecaptchaResponse); err != nil {
+				return 0, nil, "", err
 			}
 		}
 
-		businesslogic.UpdatePassword(user, &updateData, h.userCache, db)
+		if _, err := businesslogic.UpdatePassword(user, &updateData, h.userCache, repo); err != nil {
+			return 0, nil, "", err
+		}
+
+		responseData, cookie, err := h.sendUserWithNewAccessToken(user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		responseData, cookie := h.sendUserWithNewAccessToken(user)
 		http.SetCookie(res, cookie)
 
-		return http.StatusOK, responseData, "Password updated"
+		return http.StatusOK, responseData, "Password updated", nil
 
 	})
 }
 
 func (h *UserHandler) UpdateViewType(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		var updateData model.UserOptionsUpdateData
-		if err := json.NewDecoder(req.Body).Decode(&updateData); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &updateData); err != nil {
+			return 0, nil, "", err
 		}
 
 		if len(updateData.ViewType) == 0 {
-			panic(utils.ErrBadRequest)
+			return 0, nil, "", utils.NewValidationError(utils.FieldError{Field: "viewType", Message: "is required"})
+		}
+
+		updatedUser, err := businesslogic.UpdateViewType(user, updateData.ViewType, h.userCache, repo)
+		if err != nil {
+			return 0, nil, "", err
 		}
 
-		updatedUser := businesslogic.UpdateViewType(user, updateData.ViewType, h.userCache, db)
-		return http.StatusOK, updatedUser, ""
+		return http.StatusOK, updatedUser, "", nil
 
 	})
 }
 
 func (h *UserHandler) GetIgnoredUsers(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		ignoredUserList := businesslogic.GetIgnoredUsers(user, db)
-		return http.StatusOK, ignoredUserList, ""
+		ignoredUserList, err := businesslogic.GetIgnoredUsers(user, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, ignoredUserList, "", nil
 
 	})
 }
 
 func (h *UserHandler) UpdateIgnore(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		ignoreUserId := utils.ExtractVarInt("userId", req)
-		ignoreState := utils.ExtractQueryInt("state", req)
+		ignoreUserId, err := utils.ExtractVarInt("userId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		ignoreState, err := utils.ExtractQueryInt("state", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		businesslogic.UpdateIgnore(user, ignoreUserId, ignoreState, db, h.userCache)
+		if err := businesslogic.UpdateIgnore(user, ignoreUserId, ignoreState, repo, h.userCache); err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, user, ""
+		return http.StatusOK, user, "", nil
 
 	})
 }
 
+func (h *UserHandler) discussionFromRequest(req *http.Request, user *model.User) (*model.Discussion, error) {
+
+	discussionId, err := utils.ExtractVarInt("discussionId", req)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.discussionCache.Get(discussionId, user)
+
+}
+
 func (h *UserHandler) UpdateDiscussionBookmark(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		discussion := h.discussionCache.Get(discussionId, user)
+		discussion, err := h.discussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
 		var lastPost model.Post
-		if err := json.NewDecoder(req.Body).Decode(&lastPost); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &lastPost); err != nil {
+			return 0, nil, "", err
 		}
 
-		currentBookmark := businesslogic.UpdateDiscussionBookmark(user, discussion, &lastPost, db)
-		return http.StatusOK, currentBookmark, ""
+		currentBookmark, err := businesslogic.UpdateDiscussionBookmark(user, discussion, &lastPost, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, currentBookmark, "", nil
 
 	})
 }
 
 func (h *UserHandler) DeleteDiscussionBookmark(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
-		discussionId := utils.ExtractVarInt("discussionId", req)
-		discussion := h.discussionCache.Get(discussionId, user)
+		discussion, err := h.discussionFromRequest(req, user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		businesslogic.DeleteDiscussionBookmark(user, discussion, h.userCache, db)
+		if err := businesslogic.DeleteDiscussionBookmark(user, discussion, h.userCache, repo); err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, nil, "Bookmark deleted"
+		return http.StatusOK, nil, "Bookmark deleted", nil
 
 	})
 }
 
 func (h *UserHandler) CreateReport(res http.ResponseWriter, req *http.Request) {
-	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		var reportData model.PostReport
-		if err := json.NewDecoder(req.Body).Decode(&reportData); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &reportData); err != nil {
+			return 0, nil, "", err
 		}
 
 		if user != nil {
 			reportData.ReporterUserId = user.Id
 		}
 
-		if len(reportData.ReporterName) == 0 || len(reportData.ReporterEmail) == 0 || len(reportData.Body) == 0 {
-			panic(utils.ErrBadRequest)
+		validationErr := utils.NewValidationError()
+		if len(reportData.ReporterName) == 0 {
+			validationErr.WithField("name", "is required")
+		}
+		if len(reportData.ReporterEmail) == 0 {
+			validationErr.WithField("email", "is required")
+		}
+		if len(reportData.Body) == 0 {
+			validationErr.WithField("body", "is required")
+		}
+		if len(validationErr.Fields) > 0 {
+			return 0, nil, "", validationErr
 		}
 
 		reportData.IPAddress = utils.ExtractIPAdress(req)
 
-		businesslogic.CreateReport(&reportData, h.userCache, db)
+		if err := businesslogic.CreateReport(&reportData, h.userCache, repo); err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, nil, "Report submitted"
+		return http.StatusOK, nil, "Report submitted", nil
 
 	})
 }
 
 func (h *UserHandler) CreateUser(res http.ResponseWriter, req *http.Request) {
-	utils.AnonymousHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, db *gorm.DB) (int, interface{}, string) {
+	utils.AnonymousHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, repo repository.Repository) (int, interface{}, string, error) {
 
 		var credentials model.LoginCredentials
-		if err := json.NewDecoder(req.Body).Decode(&credentials); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &credentials); err != nil {
+			return 0, nil, "", err
 		}
 
-		if len(credentials.Username) < 4 || len(credentials.Password) < 8 {
-			utils.PanicWithWrapper(utils.ErrBadRequest, errors.New("Invalid username or password"))
+		validationErr := utils.NewValidationError()
+		if len(credentials.Username) < 4 {
+			validationErr.WithField("username", "must be at least 4 characters long")
+		}
+		if len(credentials.Password) < 8 {
+			validationErr.WithField("password", "must be at least 8 characters long")
 		}
-
 		if !h.emailRegex.MatchString(credentials.Email) {
-			utils.PanicWithWrapper(utils.ErrBadRequest, errors.New("Invalid e-mail address"))
+			validationErr.WithField("email", "is not a valid e-mail address")
+		}
+		if len(validationErr.Fields) > 0 {
+			return 0, nil, "", validationErr
 		}
 
-		if err := utils.ValidateRecaptchaResponse(credentials.RecaptchaResponse); err != nil {
-			utils.PanicWithWrapper(utils.ErrBadRequest, err)
+		if err := h.validateRecaptcha(credentials.RecaptchaResponse); err != nil {
+			return 0, nil, "", err
 		}
 
-		user := businesslogic.CreateUser(&credentials, utils.ExtractIPAdress(req), db)
+		user, err := businesslogic.CreateUser(&credentials, utils.ExtractIPAdress(req), repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		responseData, cookie, err := h.sendUserWithNewAccessToken(user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		responseData, cookie := h.sendUserWithNewAccessToken(user)
 		http.SetCookie(res, cookie)
 
-		return http.StatusOK, responseData, ""
+		return http.StatusOK, responseData, "", nil
 
 	})
 }
 
 func (h *UserHandler) CheckSubscriptions(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		subscriptions, err := businesslogic.CheckSubscriptions(user, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		subscriptions := businesslogic.CheckSubscriptions(user, db)
 		if len(subscriptions) > 0 {
 			url := utils.UrlForFrontPageEntry(subscriptions[0])
-			return http.StatusOK, url, ""
+			return http.StatusOK, url, "", nil
 		} else {
-			return http.StatusNoContent, nil, "Subscriptions up to date"
+			return http.StatusNoContent, nil, "Subscriptions up to date", nil
 		}
 
 	})
 }
 
 func (h *UserHandler) GetDiscussionSubscriptions(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
-		entries := businesslogic.GetDiscussionSubscriptions(user, db)
-		return http.StatusOK, entries, ""
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+		entries, err := businesslogic.GetDiscussionSubscriptions(user, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+		return http.StatusOK, entries, "", nil
 	})
 }
 
 func (h *UserHandler) GetFolderSubscriptions(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
-		folderSubs := businesslogic.GetFolderSubscriptions(user, db)
-		return http.StatusOK, folderSubs, ""
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+		folderSubs, err := businesslogic.GetFolderSubscriptions(user, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+		return http.StatusOK, folderSubs, "", nil
 	})
 }
 
 func (h *UserHandler) GetFolderSubscriptionExceptions(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
-		exceptions := businesslogic.GetFolderSubscriptionExcepions(user, db)
-		return http.StatusOK, exceptions, ""
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+		exceptions, err := businesslogic.GetFolderSubscriptionExcepions(user, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+		return http.StatusOK, exceptions, "", nil
 	})
 }
 
 func (h *UserHandler) MarkFolderSubscriptionsRead(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		var subsList []uint
-		if err := json.NewDecoder(req.Body).Decode(&subsList); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &subsList); err != nil {
+			return 0, nil, "", err
+		}
+
+		subscriptons, err := businesslogic.MarkFolderSubscriptionsRead(subsList, user, repo, h.userCache)
+		if err != nil {
+			return 0, nil, "", err
 		}
 
-		subscriptons := businesslogic.MarkFolderSubscriptionsRead(subsList, user, db, h.userCache)
-		return http.StatusOK, subscriptons, ""
+		return http.StatusOK, subscriptons, "", nil
 
 	})
 }
 
 func (h *UserHandler) MarkDiscussionSubscriptionsRead(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		var subsList []uint
-		if err := json.NewDecoder(req.Body).Decode(&subsList); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &subsList); err != nil {
+			return 0, nil, "", err
 		}
 
-		subscriptons := businesslogic.MarkDiscussionSubscriptionsRead(subsList, user, db, h.userCache)
-		return http.StatusOK, subscriptons, ""
+		subscriptons, err := businesslogic.MarkDiscussionSubscriptionsRead(subsList, user, repo, h.userCache)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, subscriptons, "", nil
 
 	})
 }
 
 func (h *UserHandler) UpdateFolderSubscriptions(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		var subsList []uint
-		if err := json.NewDecoder(req.Body).Decode(&subsList); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &subsList); err != nil {
+			return 0, nil, "", err
 		}
 
-		subscriptons := businesslogic.UpdateFolderSubscriptions(subsList, user, db, h.userCache, h.folderCache)
-		return http.StatusOK, subscriptons, ""
+		subscriptons, err := businesslogic.UpdateFolderSubscriptions(subsList, user, repo, h.userCache, h.folderCache)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, subscriptons, "", nil
 
 	})
 }
 
 func (h *UserHandler) DeleteFolderSubscriptions(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		var subsList []uint
-		if err := json.NewDecoder(req.Body).Decode(&subsList); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &subsList); err != nil {
+			return 0, nil, "", err
 		}
 
-		result := businesslogic.DeleteFolderSubscriptions(subsList, user, db, h.userCache)
+		result, err := businesslogic.DeleteFolderSubscriptions(subsList, user, repo, h.userCache)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, result, ""
+		return http.StatusOK, result, "", nil
 
 	})
 }
 
 func (h *UserHandler) DeleteDiscussionSubscriptions(res http.ResponseWriter, req *http.Request) {
-	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		var subsList []uint
-		if err := json.NewDecoder(req.Body).Decode(&subsList); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &subsList); err != nil {
+			return 0, nil, "", err
 		}
 
-		result := businesslogic.DeleteDiscussionSubscriptions(subsList, user, db, h.userCache)
+		result, err := businesslogic.DeleteDiscussionSubscriptions(subsList, user, repo, h.userCache)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, result, ""
+		return http.StatusOK, result, "", nil
 
 	})
 }
 
 func (h *UserHandler) GetOtherUser(res http.ResponseWriter, req *http.Request) {
-	utils.AnonymousHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, db *gorm.DB) (int, interface{}, string) {
+	utils.AnonymousHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, repo repository.Repository) (int, interface{}, string, error) {
 
-		userId := utils.ExtractVarInt("userId", req)
+		userId, err := utils.ExtractVarInt("userId", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		user := businesslogic.GetOtherUser(userId, db, h.userCache)
+		user, err := businesslogic.GetOtherUser(userId, repo, h.userCache)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		return http.StatusOK, user, ""
+		return http.StatusOK, user, "", nil
 
 	})
 }
 
 func (h *UserHandler) ForgotPassword(res http.ResponseWriter, req *http.Request) {
-	utils.AnonymousHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, db *gorm.DB) (int, interface{}, string) {
+	utils.AnonymousHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, repo repository.Repository) (int, interface{}, string, error) {
 
 		var credentials model.LoginCredentials
-		if err := json.NewDecoder(req.Body).Decode(&credentials); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &credentials); err != nil {
+			return 0, nil, "", err
 		}
 
 		if !h.emailRegex.MatchString(credentials.Email) {
-			utils.PanicWithWrapper(utils.ErrBadRequest, errors.New("Invalid e-mail address"))
+			return 0, nil, "", utils.NewValidationError(utils.FieldError{Field: "email", Message: "is not a valid e-mail address"})
 		}
 
 		if h.useSecureCookies {
-			if err := utils.ValidateRecaptchaResponse(credentials.RecaptchaResponse); err != nil {
-				utils.PanicWithWrapper(utils.ErrBadRequest, err)
+			if err := h.validateRecaptcha(credentials.RecaptchaResponse); err != nil {
+				return 0, nil, "", err
 			}
 		}
 
-		request := businesslogic.ForgotPassword(&credentials, utils.ExtractIPAdress(req), h.userCache, db)
+		request, err := businesslogic.ForgotPassword(&credentials, utils.ExtractIPAdress(req), h.userCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		if request != nil {
-			return http.StatusOK, nil, "Request accepted"
-		} else {
-			return http.StatusBadRequest, nil, "Request not accepted"
+		if request == nil {
+			return 0, nil, "", utils.NewError(utils.ErrBadRequest, utils.ErrorCodeBadRequest, "Request not accepted")
 		}
 
+		return http.StatusOK, nil, "Request accepted", nil
+
 	})
 }
 
 func (h *UserHandler) ValidatePasswordResetKey(res http.ResponseWriter, req *http.Request) {
-	utils.AnonymousHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, db *gorm.DB) (int, interface{}, string) {
+	utils.AnonymousHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, repo repository.Repository) (int, interface{}, string, error) {
 
 		resetKey := req.URL.Query().Get("key")
 		if len(resetKey) == 0 {
-			panic(utils.ErrBadRequest)
+			return 0, nil, "", utils.NewValidationError(utils.FieldError{Field: "key", Message: "is required"})
 		}
 
-		passwordRequest, err := businesslogic.ValidatePasswordResetKey(resetKey, h.userCache, db)
+		passwordRequest, err := businesslogic.ValidatePasswordResetKey(resetKey, h.userCache, repo)
 		if err != nil {
-			if errors.Is(err, utils.ErrExpired) {
-				return http.StatusNotAcceptable, passwordRequest, "Key has expired"
-			}
-			panic(err)
+			return 0, nil, "", err
 		}
 
-		return http.StatusOK, passwordRequest, "key is valid"
+		return http.StatusOK, passwordRequest, "key is valid", nil
 
 	})
 }
 
 func (h *UserHandler) ResetPasswordFromKey(res http.ResponseWriter, req *http.Request) {
-	utils.AnonymousHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, db *gorm.DB) (int, interface{}, string) {
+	utils.AnonymousHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, repo repository.Repository) (int, interface{}, string, error) {
 
 		var updateData model.UserOptionsUpdateData
-		if err := json.NewDecoder(req.Body).Decode(&updateData); err != nil {
-			utils.PanicWithWrapper(err, utils.ErrBadRequest)
+		if err := utils.DecodeRequestBody(req, &updateData); err != nil {
+			return 0, nil, "", err
 		}
 
 		if h.useSecureCookies {
-			if err := utils.ValidateRecaptchaResponse(updateData.RecaptchaResponse); err != nil {
-				utils.PanicWithWrapper(utils.ErrBadRequest, err)
+			if err := h.validateRecaptcha(updateData.RecaptchaResponse); err != nil {
+				return 0, nil, "", err
 			}
 		}
 
-		user := businesslogic.UpdatePassword(nil, &updateData, h.userCache, db)
+		user, err := businesslogic.UpdatePassword(nil, &updateData, h.userCache, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		responseData, cookie, err := h.sendUserWithNewAccessToken(user)
+		if err != nil {
+			return 0, nil, "", err
+		}
 
-		responseData, cookie := h.sendUserWithNewAccessToken(user)
 		http.SetCookie(res, cookie)
 
-		return http.StatusOK, responseData, "Password updated"
+		return http.StatusOK, responseData, "Password updated", nil
 	})
 }
 
 func (h *UserHandler) ValidateSignupConfirmationKey(res http.ResponseWriter, req *http.Request) {
-	utils.AnonymousHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, db *gorm.DB) (int, interface{}, string) {
+	utils.AnonymousHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, repo repository.Repository) (int, interface{}, string, error) {
 
 		confirmationKey := utils.ExtractQueryString("key", req)
 		if len(confirmationKey) == 0 {
-			panic(utils.ErrBadRequest)
+			return 0, nil, "", utils.NewValidationError(utils.FieldError{Field: "key", Message: "is required"})
 		}
 
-		user, err := businesslogic.ValidateSignupConfirmationKey(confirmationKey, utils.ExtractIPAdress(req), h.userCache, db)
+		user, err := businesslogic.ValidateSignupConfirmationKey(confirmationKey, utils.ExtractIPAdress(req), h.userCache, repo)
 		if err != nil {
-			panic(err)
+			return 0, nil, "", err
+		}
+
+		responseData, cookie, err := h.sendUserWithNewAccessToken(user)
+		if err != nil {
+			return 0, nil, "", err
 		}
 
-		responseData, cookie := h.sendUserWithNewAccessToken(user)
 		http.SetCookie(res, cookie)
 
-		return http.StatusOK, responseData, "Login successful"
+		return http.StatusOK, responseData, "Login successful", nil
 
 	})
 }
 
-func (h *UserHandler) createRefreshTokenCookie(user *model.User) *http.Cookie {
+func (h *UserHandler) createRefreshTokenCookie(user *model.User) (*http.Cookie, error) {
 
 	expiryTime := time.Now().Add(time.Hour * 720)
 
@@ -625,30 +804,25 @@ func (h *UserHandler) createRefreshTokenCookie(user *model.User) *http.Cookie {
 		sameSiteMode = http.SameSiteLaxMode
 	}
 
-	domain := "justthetalk.com"
-	if d, ok := os.LookupEnv("DOMAIN"); ok {
-		domain = d
+	refreshToken, err := utils.CreateJWT(user, expiryTime, model.UserClaimPurposeRefreshToken, h.domain, h.signingKey)
+	if err != nil {
+		return nil, utils.InternalError(err)
 	}
 
 	return &http.Cookie{
 		Name:     "refresh-token",
-		Domain:   domain,
+		Domain:   h.domain,
 		Path:     "/",
-		Value:    utils.CreateJWT(user, time.Now().Add(time.Hour*720), model.UserClaimPurposeRefreshToken),
+		Value:    refreshToken,
 		HttpOnly: true,
 		Secure:   h.useSecureCookies,
 		SameSite: sameSiteMode,
 		Expires:  expiryTime,
-	}
+	}, nil
 
 }
 
 func (h *UserHandler) expiredRefreshTokenCookie() *http.Cookie {
-	domain := "justthetalk.com"
-	if d, ok := os.LookupEnv("DOMAIN"); ok {
-		domain = d
-	}
-
 	sameSiteMode := http.SameSiteNoneMode
 	if !h.useSecureCookies {
 		sameSiteMode = http.SameSiteLaxMode
@@ -656,7 +830,7 @@ func (h *UserHandler) expiredRefreshTokenCookie() *http.Cookie {
 
 	return &http.Cookie{
 		Name:     "refresh-token",
-		Domain:   domain,
+		Domain:   h.domain,
 		Path:     "/",
 		Value:    "",
 		HttpOnly: true,
@@ -666,3 +840,38 @@ func (h *UserHandler) expiredRefreshTokenCookie() *http.Cookie {
 	}
 
 }
+
+func (h *UserHandler) GetSearchHistory(res http.ResponseWriter, req *http.Request) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		pageStart, err := utils.ExtractQueryInt("start", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		pageSize, err := utils.ExtractQueryInt("size", req)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		history, err := businesslogic.GetSearchHistory(user, pageStart, pageSize, repo)
+		if err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusOK, history, "", nil
+
+	})
+}
+
+func (h *UserHandler) ClearSearchHistory(res http.ResponseWriter, req *http.Request) {
+	utils.AuthenticatedHandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+
+		if err := businesslogic.ClearSearchHistory(user, repo); err != nil {
+			return 0, nil, "", err
+		}
+
+		return http.StatusNoContent, nil, "", nil
+
+	})
+}
@@ -20,12 +20,13 @@ import (
 	"errors"
 	"fmt"
 	"justthetalk/businesslogic"
+	"justthetalk/config"
 	"justthetalk/connections"
 	"justthetalk/model"
 	"justthetalk/utils"
 	"net/http"
-	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"runtime/debug"
@@ -70,11 +71,12 @@ type WebsockerHandler struct {
 	userCache    *businesslogic.UserCache
 	upgrader     websocket.Upgrader
 	isProduction bool
+	signingKey   []byte
+	clientsLock  sync.Mutex
+	clients      map[*websocketClient]bool
 }
 
-func NewWebsockerHandler(userCache *businesslogic.UserCache) *WebsockerHandler {
-
-	platform := os.Getenv(utils.PlatformEnvVar)
+func NewWebsockerHandler(cfg *config.Config, userCache *businesslogic.UserCache) *WebsockerHandler {
 
 	websockerHandler := &WebsockerHandler{
 		upgrader: websocket.Upgrader{
@@ -82,7 +84,9 @@ func NewWebsockerHandler(userCache *businesslogic.UserCache) *WebsockerHandler {
 			WriteBufferSize: 1024,
 		},
 		userCache:    userCache,
-		isProduction: (platform == utils.Production),
+		isProduction: cfg.IsProduction(),
+		signingKey:   []byte(cfg.Auth.SigningKey.Value()),
+		clients:      make(map[*websocketClient]bool),
 	}
 
 	websockerHandler.upgrader.CheckOrigin = websockerHandler.checkOrigin
@@ -91,8 +95,64 @@ func NewWebsockerHandler(userCache *businesslogic.UserCache) *WebsockerHandler {
 
 }
 
-func (h *WebsockerHandler) Close() {
+// Stop sends a close frame to every connected client and waits for the
+// connections to shut down. Any still open when ctx expires are dropped.
+func (h *WebsockerHandler) Stop(ctx context.Context) error {
+
+	h.clientsLock.Lock()
+	clients := make([]*websocketClient, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.clientsLock.Unlock()
+
+	log.Infof("Closing %d websockets...", len(clients))
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for _, client := range clients {
+		if err := client.connection.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeWait)); err != nil {
+			log.Debugf("Sending close frame: %v", err)
+		}
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+
+		h.clientsLock.Lock()
+		remaining := len(h.clients)
+		h.clientsLock.Unlock()
+
+		if remaining == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			h.clientsLock.Lock()
+			for client := range h.clients {
+				client.connection.Close()
+			}
+			h.clientsLock.Unlock()
+			return fmt.Errorf("closing websockets, %d still open: %w", remaining, ctx.Err())
+		}
+
+	}
+
+}
+
+func (h *WebsockerHandler) addClient(client *websocketClient) {
+	h.clientsLock.Lock()
+	defer h.clientsLock.Unlock()
+	h.clients[client] = true
+}
 
+func (h *WebsockerHandler) removeClient(client *websocketClient) {
+	h.clientsLock.Lock()
+	defer h.clientsLock.Unlock()
+	delete(h.clients, client)
 }
 
 func (h *WebsockerHandler) checkOrigin(req *http.Request) bool {
@@ -133,7 +193,7 @@ func (h *WebsockerHandler) unregisterClient(client *websocketClient) {
 	h.userCache.RemoveSubscriber(client.user)
 }
 
-func (h *WebsockerHandler) findUser(userId uint) *model.User {
+func (h *WebsockerHandler) findUser(userId uint) (*model.User, error) {
 	return h.userCache.Get(userId)
 }
 
@@ -141,7 +201,7 @@ func NewWebsocketClient(connection *websocket.Conn, handler *WebsockerHandler) *
 
 	defer func() {
 		if r := recover(); r != nil {
-			err := r.(error)
+			err := utils.ErrorFromPanic(r)
 			log.Errorf("%v", err)
 			debug.PrintStack()
 		}
@@ -155,6 +215,8 @@ func NewWebsocketClient(connection *websocket.Conn, handler *WebsockerHandler) *
 		quitFlag:   make(chan bool),
 	}
 
+	handler.addClient(client)
+
 	go client.readWorker()
 	go client.writeWorker()
 
@@ -170,6 +232,7 @@ func NewWebsocketClient(connection *websocket.Conn, handler *WebsockerHandler) *
 		client.connection.Close()
 
 		handler.unregisterClient(client)
+		handler.removeClient(client)
 
 	}()
 
@@ -183,7 +246,7 @@ func (client *websocketClient) readWorker() {
 
 	defer func() {
 		if r := recover(); r != nil {
-			err := r.(error)
+			err := utils.ErrorFromPanic(r)
 			log.Debugf("%v", err)
 			debug.PrintStack()
 		}
@@ -225,7 +288,7 @@ func (client *websocketClient) writeWorker() {
 
 	defer func() {
 		if r := recover(); r != nil {
-			err := r.(error)
+			err := utils.ErrorFromPanic(r)
 			log.Debugf("%v", err)
 		}
 		if !client.hasQuit {
@@ -284,7 +347,7 @@ func (client *websocketClient) send(message string) error {
 
 	defer func() {
 		if r := recover(); r != nil {
-			err := r.(error)
+			err := utils.ErrorFromPanic(r)
 			log.Errorf("Sending to websocket: %v", err)
 			debug.PrintStack()
 		}
@@ -315,7 +378,7 @@ func (client *websocketClient) processMessage(msg string) {
 
 	defer func() {
 		if r := recover(); r != nil {
-			err := r.(error)
+			err := utils.ErrorFromPanic(r)
 			log.Error(err)
 			debug.PrintStack()
 		}
@@ -341,47 +404,59 @@ func (client *websocketClient) processMessage(msg string) {
 
 }
 
-func (client *websocketClient) hello(accessToken string) {
-
-	log.Debug("Creating pubsub reader")
-
-	defer func() {
-		if r := recover(); r != nil {
-			err := r.(error)
-			log.Errorf("%v", err)
-			debug.PrintStack()
-		}
-	}()
-
-	defer func() {
-		if r := recover(); r != nil {
-			if !client.hasQuit {
-				client.writeQueue <- "nack!"
-			}
-		}
-		log.Debug("Closing pubsub reader")
-	}()
+func (client *websocketClient) authenticate(accessToken string) error {
 
 	if len(accessToken) == 0 {
-		panic(errors.New("invalid access token"))
+		return errors.New("invalid access token")
 	}
 
 	token, err := jwt.ParseWithClaims(accessToken, &model.UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(utils.SigningKey), nil
+		return client.handler.signingKey, nil
 	})
 
 	if err != nil {
-		panic(errors.New("invalid access token"))
+		return fmt.Errorf("invalid access token: %w", err)
 	}
 
 	claims, ok := token.Claims.(*model.UserClaims)
 	if !ok {
-		panic(errors.New("invalid access token"))
+		return errors.New("invalid access token")
 	}
 
-	client.user = client.handler.findUser(claims.UserId)
-	if client.user == nil {
-		panic(errors.New("user not found"))
+	user, err := client.handler.findUser(claims.UserId)
+	if err != nil {
+		return fmt.Errorf("finding user: %w", err)
+	}
+
+	client.user = user
+
+	return nil
+
+}
+
+func (client *websocketClient) hello(accessToken string) {
+
+	log.Debug("Creating pubsub reader")
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("%v", utils.ErrorFromPanic(r))
+			debug.PrintStack()
+		}
+	}()
+
+	defer log.Debug("Closing pubsub reader")
+
+	nack := func(err error) {
+		log.Debug(err)
+		if !client.hasQuit {
+			client.writeQueue <- "nack!"
+		}
+	}
+
+	if err := client.authenticate(accessToken); err != nil {
+		nack(err)
+		return
 	}
 
 	ctx, cancelFn := context.WithTimeout(context.Background(), 1*time.Second)
@@ -392,7 +467,8 @@ func (client *websocketClient) hello(accessToken string) {
 	topic := fmt.Sprintf("user:%d", client.user.Id)
 	subscription := connections.RedisConnection().Subscribe(ctx, topic)
 	if subscription == nil {
-		panic(errors.New("subscription is nil"))
+		nack(errors.New("subscription is nil"))
+		return
 	}
 
 	defer func() {
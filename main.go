@@ -16,89 +16,158 @@
 package main
 
 import (
-	"justthetalk/businesslogic"
+	"context"
+	"flag"
+	"justthetalk/config"
 	"justthetalk/connections"
+	"justthetalk/repository/storedproc"
+	"justthetalk/search/elastic"
+	"justthetalk/search/embedded"
 	"justthetalk/server"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 func main() {
 
-	logLevel := log.InfoLevel
-	logLevelEnv := os.Getenv("LOG_LEVEL")
-	switch logLevelEnv {
-	case "DEBUG":
-		logLevel = log.DebugLevel
-	case "WARN":
-		logLevel = log.WarnLevel
-	case "ERROR":
-		logLevel = log.ErrorLevel
+	cfg, err := config.Load(os.Getenv(config.ConfigFileEnvVar))
+	if err != nil {
+		log.Fatal(err)
 	}
-	log.SetLevel(logLevel)
+
+	cfg.SetupLogging()
 
 	log.Info("Starting JustTheTalk API Server...")
 
-	if secret := os.Getenv("RECAPTCHA_API_KEY"); len(secret) == 0 {
-		log.Fatal("Recaptcha key missing")
+	if err := connections.OpenConnections(cfg); err != nil {
+		log.Fatalf("Opening connections: %v", err)
+	}
+
+	if len(os.Args) == 1 {
+		startServer(cfg)
+	} else {
+		switch os.Args[1] {
+		case "server":
+			startServer(cfg)
+		case "index":
+			indexPosts(cfg, os.Args[2:])
+		case "mappings":
+			applySearchMappings(cfg)
+		}
 	}
 
-	dbHost := "localhost"
-	dbPort := "3306"
-	redisHost := "localhost"
-	redisPort := "6379"
-	elasticsearchHosts := []string{"http://localhost:9200"}
+}
+
+func startServer(cfg *config.Config) {
 
-	if value, exists := os.LookupEnv("DB_HOST"); exists {
-		dbHost = value
+	app, err := server.NewApp(cfg)
+	if err != nil {
+		log.Fatalf("Creating app: %v", err)
 	}
 
-	if value, exists := os.LookupEnv("DB_PORT"); exists {
-		dbPort = value
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Infof("Received %v", sig)
+		cancelFn()
+	}()
+
+	if err := app.Serve(ctx); err != nil {
+		log.Fatal(err)
 	}
 
-	if value, exists := os.LookupEnv("REDIS_HOST"); exists {
-		redisHost = value
+}
+
+func applySearchMappings(cfg *config.Config) {
+
+	if cfg.Search.Backend != config.SearchBackendElasticsearch {
+		log.Infof("The %s search backend has no mappings to apply", cfg.Search.Backend)
+		return
 	}
 
-	if value, exists := os.LookupEnv("REDIS_PORT"); exists {
-		redisPort = value
+	client := connections.ElasticSearchConnection()
+	if err := elastic.ApplyTemplate(client, elastic.DefaultAlias); err != nil {
+		log.Fatalf("Applying search index template: %v", err)
 	}
 
-	if value, exists := os.LookupEnv("ELASTICSEARCH_HOSTS"); exists {
-		elasticsearchHosts = strings.Split(value, ",")
+	log.Infof("Applied search index template version %d", elastic.MappingVersion)
+
+	if err := elastic.CheckMapping(context.Background(), client, elastic.DefaultAlias); err != nil {
+		log.Warnf("%v, run the index command to rebuild it", err)
 	}
 
-	connections.OpenConnections(dbHost, dbPort, redisHost, redisPort, elasticsearchHosts)
+}
 
-	if len(os.Args) == 1 {
-		startServer()
-	} else {
-		switch os.Args[1] {
-		case "server":
-			startServer()
-		case "index":
-			indexPosts()
+func indexPosts(cfg *config.Config, args []string) {
+
+	flags := flag.NewFlagSet("index", flag.ExitOnError)
+	resume := flags.Bool("resume", false, "carry on building the newest unfinished index")
+	batchSize := flags.Int("batch-size", 1000, "number of posts sent in each bulk request")
+	maxRetries := flags.Int("max-retries", 5, "times a bulk request or failed item is retried")
+	retryDelay := flags.Duration("retry-delay", time.Second, "delay before the first retry, doubled for each further attempt")
+	maxFailures := flags.Int("max-failures", 0, "posts allowed to fail before the alias is left alone, -1 for no limit")
+	flags.Parse(args)
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Infof("Received %v, stopping after the current batch", sig)
+		cancelFn()
+	}()
+
+	provider := storedproc.NewProvider(connections.DatabaseConnection())
+
+	if cfg.Search.Backend == config.SearchBackendEmbedded {
+		indexed, err := embedded.Rebuild(ctx, cfg.Search.EmbeddedPath, *batchSize, provider)
+		if err != nil {
+			log.Fatalf("Indexing posts: %v", err)
 		}
+		log.Infof("%d posts indexed into %s, restart the server to pick them up", indexed, cfg.Search.EmbeddedPath)
+		return
 	}
 
-}
+	options := elastic.ReindexOptions{
+		Resume:      *resume,
+		BatchSize:   *batchSize,
+		MaxRetries:  *maxRetries,
+		RetryDelay:  *retryDelay,
+		MaxFailures: *maxFailures,
+	}
 
-func startServer() {
-	app := server.NewApp()
-	defer app.Shutdown()
-	app.Serve()
-}
+	reindexer := elastic.NewReindexer(connections.ElasticSearchConnection(), elastic.DefaultAlias, options, provider)
 
-func indexPosts() {
+	report, err := reindexer.Run(ctx)
+	if report != nil {
+		for _, failure := range report.Failures {
+			log.Errorf("Failed to index %s", failure)
+		}
+		log.Infof("%s: %d posts indexed up to post %d, %d failed", report.Index, report.Indexed, report.LastPostId, report.Failed)
+	}
 
-	userCache := businesslogic.NewUserCache()
-	folderCache := businesslogic.NewFolderCache()
-	discussionCache := businesslogic.NewDiscussionCache(folderCache)
+	if err != nil {
+		if report != nil {
+			log.Errorf("Index %s is incomplete, run again with -resume to carry on", report.Index)
+		}
+		log.Fatalf("Indexing posts: %v", err)
+	}
 
-	pubsub := businesslogic.NewPostProcessor(userCache, folderCache, discussionCache)
-	pubsub.IndexAllPosts()
+	if len(report.Replaced) > 0 {
+		log.Infof("%s now points at %s, replacing %s", elastic.DefaultAlias, report.Index, strings.Join(report.Replaced, ", "))
+	} else {
+		log.Infof("%s now points at %s", elastic.DefaultAlias, report.Index)
+	}
 
 }
@@ -20,6 +20,7 @@ import (
 	"os"
 	"testing"
 
+	"justthetalk/config"
 	"justthetalk/connections"
 )
 
@@ -27,13 +28,16 @@ func TestMain(m *testing.M) {
 
 	fmt.Println("Starting tests...")
 
-	dbHost := "localhost"
-	dbPort := "3306"
-	redisHost := "localhost"
-	redisPort := "6379"
-	elasticsearchHosts := []string{"http://localhost:9200"}
+	cfg := config.Default()
+	if err := cfg.ApplyEnvironment(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-	connections.OpenConnections(dbHost, dbPort, redisHost, redisPort, elasticsearchHosts)
+	// nothing here needs the servers yet, so the tests run without them
+	if err := connections.OpenConnections(cfg); err != nil {
+		fmt.Printf("Not connected: %v\n", err)
+	}
 
 	os.Exit(m.Run())
 
@@ -17,25 +17,26 @@ package middleware
 
 import (
 	"context"
-	"justthetalk/connections"
+	"justthetalk/repository"
 	"justthetalk/utils"
 	"net/http"
 	"time"
-
-	"gorm.io/gorm"
 )
 
 type DatabaseMiddleware struct {
+	provider repository.Provider
 }
 
-func NewDatabaseMiddleware() *DatabaseMiddleware {
-	return &DatabaseMiddleware{}
+func NewDatabaseMiddleware(provider repository.Provider) *DatabaseMiddleware {
+	return &DatabaseMiddleware{
+		provider: provider,
+	}
 }
 
 func (m *DatabaseMiddleware) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		connections.WithDatabase(30*time.Second, func(db *gorm.DB) {
-			ctx := context.WithValue(req.Context(), utils.ContextDbKey, db)
+		m.provider.WithRepository(30*time.Second, func(repo repository.Repository) {
+			ctx := context.WithValue(req.Context(), utils.ContextRepositoryKey, repo)
 			nextRequest := req.WithContext(ctx)
 			next.ServeHTTP(res, nextRequest)
 		})
@@ -17,26 +17,24 @@ package middleware
 
 import (
 	"context"
-	"errors"
 	"justthetalk/businesslogic"
 	"justthetalk/model"
 	"justthetalk/utils"
 	"net/http"
 	"strings"
 
-	"runtime/debug"
-
 	"github.com/dgrijalva/jwt-go"
-	log "github.com/sirupsen/logrus"
 )
 
 type SessionMiddleware struct {
-	userCache *businesslogic.UserCache
+	userCache  *businesslogic.UserCache
+	signingKey []byte
 }
 
-func NewSessionMiddleware(userCache *businesslogic.UserCache) *SessionMiddleware {
+func NewSessionMiddleware(userCache *businesslogic.UserCache, signingKey []byte) *SessionMiddleware {
 	return &SessionMiddleware{
-		userCache: userCache,
+		userCache:  userCache,
+		signingKey: signingKey,
 	}
 }
 
@@ -45,31 +43,7 @@ func (m *SessionMiddleware) Middleware(next http.Handler) http.Handler {
 
 		defer func() {
 			if r := recover(); r != nil {
-				err := r.(error)
-
-				var statusCode int
-
-				switch {
-				case errors.Is(err, utils.ErrBadRequest):
-					statusCode = http.StatusBadRequest
-				case errors.Is(err, utils.ErrUnauthorised):
-					statusCode = http.StatusUnauthorized
-				case errors.Is(err, utils.ErrForbidden):
-					statusCode = http.StatusForbidden
-				case errors.Is(err, utils.ErrInternalError):
-					statusCode = http.StatusInternalServerError
-				case errors.Is(err, utils.ErrNoContent):
-					statusCode = http.StatusNoContent
-				case errors.Is(err, utils.ErrNotModified):
-					statusCode = http.StatusNotModified
-				default:
-					log.Error(err)
-					debug.PrintStack()
-					statusCode = http.StatusInternalServerError
-				}
-
-				utils.SendRespsonse(statusCode, nil, err.Error(), res)
-
+				utils.SendProblem(utils.ErrorFromPanic(r), req, res)
 			}
 		}()
 
@@ -85,25 +59,29 @@ func (m *SessionMiddleware) Middleware(next http.Handler) http.Handler {
 		if len(accessToken) > 0 {
 
 			token, err := jwt.ParseWithClaims(accessToken, &model.UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-				return []byte(utils.SigningKey), nil
+				return m.signingKey, nil
 			})
 
 			if err != nil {
-				panic(utils.ErrBadRequest)
+				utils.SendProblem(utils.WrapError(utils.ErrBadRequest, utils.ErrorCodeInvalidToken, err), req, res)
+				return
 			}
 
 			claims, ok := token.Claims.(*model.UserClaims)
-			if !ok {
-				panic(utils.ErrBadRequest)
+			if !ok || claims.Purpose != model.UserClaimPurposeAccessToken {
+				utils.SendProblem(utils.NewError(utils.ErrBadRequest, utils.ErrorCodeInvalidToken, "Invalid access token"), req, res)
+				return
 			}
 
-			if claims.Purpose != model.UserClaimPurposeAccessToken {
-				panic(utils.ErrBadRequest)
+			user, err := m.userCache.Get(claims.UserId)
+			if err != nil {
+				utils.SendProblem(err, req, res)
+				return
 			}
 
-			user := m.userCache.Get(claims.UserId)
 			if !(user != nil && user.Id == claims.UserId && !user.AccountLocked && user.Enabled) {
-				panic(utils.ErrForbidden)
+				utils.SendProblem(utils.NewError(utils.ErrForbidden, utils.ErrorCodeAccountLocked, "This account is locked or disabled"), req, res)
+				return
 			}
 
 			ctx := context.WithValue(req.Context(), utils.ContextUserKey, user)
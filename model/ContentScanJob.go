@@ -0,0 +1,45 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import "time"
+
+const (
+	ContentScanJobStatusPending  = "pending"
+	ContentScanJobStatusRunning  = "running"
+	ContentScanJobStatusComplete = "complete"
+	ContentScanJobStatusFailed   = "failed"
+)
+
+// ContentScanJob checks the posts made between two dates against the
+// current banned words, so that a new rule catches what was posted before it
+// existed. LastPostId records how far the scan has got so that it can carry
+// on after a restart.
+type ContentScanJob struct {
+	Id              uint       `json:"id" gorm:"column:id;primaryKey"`
+	CreatedDate     time.Time  `json:"createdDate" gorm:"column:created_date"`
+	LastUpdate      time.Time  `json:"lastUpdate" gorm:"column:last_updated"`
+	CreatedByUserId uint       `json:"createdByUserId" gorm:"column:user_id"`
+	FromDate        time.Time  `json:"fromDate" gorm:"column:from_date"`
+	ToDate          time.Time  `json:"toDate" gorm:"column:to_date"`
+	Status          string     `json:"status" gorm:"column:status"`
+	LastPostId      uint       `json:"lastPostId" gorm:"column:last_post_id"`
+	Scanned         int        `json:"scanned" gorm:"column:scanned"`
+	Matched         int        `json:"matched" gorm:"column:matched"`
+	LastError       *string    `json:"lastError,omitempty" gorm:"column:last_error"`
+	StartedDate     *time.Time `json:"startedDate,omitempty" gorm:"column:started_date"`
+	CompletedDate   *time.Time `json:"completedDate,omitempty" gorm:"column:completed_date"`
+}
@@ -56,4 +56,19 @@ type Discussion struct {
 	Url          string `json:"url" gorm:"-"`
 	IsBlocked    bool   `json:"isBlocked" gorm:"-"`
 	IsSubscribed bool   `json:"isSubscribed" gorm:"-"`
+
+	// IgnoreSimilar is set by the client when the user has been warned about
+	// similar discussions and wants to start theirs anyway
+	IgnoreSimilar bool `json:"ignoreSimilar,omitempty" gorm:"-"`
+}
+
+// SimilarDiscussion is a recent discussion which resembles a new one. The
+// similarity runs from 0 for nothing in common to 1 for the same words.
+type SimilarDiscussion struct {
+	DiscussionId uint      `json:"discussionId"`
+	Title        string    `json:"title"`
+	Url          string    `json:"url"`
+	CreatedDate  time.Time `json:"createdDate"`
+	PostCount    int64     `json:"postCount"`
+	Similarity   float64   `json:"similarity"`
 }
@@ -27,5 +27,7 @@ type Folder struct {
 	Type            uint   `json:"type" gorm:"column:type"`
 	Activity        int    `json:"activity" gorm:"column:activity"`
 	DiscussionCount uint   `json:"discussionCount" gorm:"column:discussion_count"`
+	SortOrder       int    `json:"sortOrder" gorm:"column:sort_order"`
+	IsArchived      bool   `json:"isArchived" gorm:"column:archived"`
 	IsSubscribed    bool   `json:"isSubscribed" gorm:"-"`
 }
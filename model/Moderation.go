@@ -0,0 +1,65 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import "time"
+
+type ModerationQueueEntry struct {
+	Id          uint      `json:"id" gorm:"column:id;primaryKey"`
+	Version     uint      `json:"version" gorm:"column:version"`
+	CreatedDate time.Time `json:"createdDate" gorm:"column:created_date"`
+	PostId      uint      `json:"postId" gorm:"column:post_id"`
+	Reason      *string   `json:"reason,omitempty" gorm:"column:reason"`
+}
+
+// What happens to a post which matches a banned word. They are listed from
+// least to most severe; when a post matches several, the most severe wins.
+const (
+	BannedWordActionMask   = "mask"
+	BannedWordActionWatch  = "watch"
+	BannedWordActionHold   = "hold"
+	BannedWordActionReject = "reject"
+)
+
+type BannedWord struct {
+	Id      uint   `json:"id" gorm:"column:id;primaryKey"`
+	Version uint   `json:"version" gorm:"column:version"`
+	Pattern string `json:"pattern" gorm:"column:word"`
+	Action  string `json:"action" gorm:"column:action"`
+	// FolderIds limits the banned word to those folders. It applies
+	// everywhere when empty.
+	FolderIds []uint `json:"folderIds" gorm:"-"`
+}
+
+// BannedWordFolder is a row of the banned_word_folder table
+type BannedWordFolder struct {
+	BannedWordId uint `gorm:"column:banned_word_id"`
+	FolderId     uint `gorm:"column:folder_id"`
+}
+
+// PostBannedWord records that a post matched a banned word
+type PostBannedWord struct {
+	PostId       uint `gorm:"column:post_id"`
+	BannedWordId uint `gorm:"column:banned_word_id"`
+}
+
+// BannedWordTest shows which of the most recent posts a pattern would have
+// caught
+type BannedWordTest struct {
+	Pattern string  `json:"pattern"`
+	Scanned int     `json:"scanned"`
+	Matches []*Post `json:"matches"`
+}
@@ -0,0 +1,35 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import "time"
+
+const (
+	OutboxActionCreate = "create"
+	OutboxActionUpdate = "update"
+	OutboxActionDelete = "delete"
+)
+
+type OutboxEntry struct {
+	Id               uint       `json:"id" gorm:"column:id;primaryKey"`
+	CreatedDate      time.Time  `json:"createdDate" gorm:"column:created_date"`
+	PostId           uint       `json:"postId" gorm:"column:post_id"`
+	Action           string     `json:"action" gorm:"column:action"`
+	Attempts         int        `json:"attempts" gorm:"column:attempts"`
+	NextAttemptDate  time.Time  `json:"nextAttemptDate" gorm:"column:next_attempt_date"`
+	LastError        *string    `json:"lastError,omitempty" gorm:"column:last_error"`
+	DeadLetteredDate *time.Time `json:"deadLetteredDate,omitempty" gorm:"column:dead_lettered_date"`
+}
@@ -48,6 +48,8 @@ type Post struct {
 	PostNum               int64     `json:"postNum" gorm:"column:post_num"`
 	ModerationScore       float64   `json:"moderationScore" gorm:"column:moderation_score"`
 	ModerationResult      int       `json:"moderationResult" gorm:"column:moderation_result"`
+	BannedWordIds         []uint    `json:"bannedWordIds,omitempty" gorm:"-"`
+	ModerationReason      *string   `json:"moderationReason,omitempty" gorm:"column:moderation_reason"`
 	PostAsAdmin           bool      `json:"postAsAdmin,omitempty" gorm:"-"`
 	SubscribeToDiscussion bool      `json:"subscribeToDiscussion,omitempty" gorm:"-"`
 	Url                   string    `json:"url" gorm:"-"`
@@ -56,11 +58,15 @@ type Post struct {
 type IndexablePost struct {
 	Id               uint      `json:"id" gorm:"column:id;primaryKey"`
 	CreatedDate      time.Time `json:"date" gorm:"column:created_date"`
+	FolderId         uint      `json:"folderId" gorm:"column:folder_id"`
+	DiscussionId     uint      `json:"discussionId" gorm:"column:discussion_id"`
 	FolderName       string    `json:"folder" gorm:"column:folder_name"`
 	DiscussionTitle  string    `json:"thread" gorm:"column:discussion_title"`
 	DiscussionHeader string    `json:"threadHeader" gorm:"column:discussion_header"`
 	Text             string    `json:"text" gorm:"column:text"`
 	Username         string    `json:"username" gorm:"column:username"`
+	UserId           uint      `json:"userId" gorm:"column:user_id"`
+	Status           int       `json:"status" gorm:"column:status"`
 }
 type PostReport struct {
 	ModelBase
@@ -80,6 +86,8 @@ type ModeratorComment struct {
 	PostId uint   `json:"postId" gorm:"column:post_id"`
 	UserId uint   `json:"userId" gorm:"column:user_id"`
 	Vote   int    `json:"vote" gorm:"column:result"`
+	// Roles are the authorities of the moderator's roles, comma separated
+	Roles string `json:"-" gorm:"column:roles"`
 }
 
 type ModeratedPostRecord struct {
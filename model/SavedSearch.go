@@ -0,0 +1,60 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import "time"
+
+// SavedSearch is a /search query and its filters kept by a user. When Alerts
+// is set the user is told about each new post which matches it.
+type SavedSearch struct {
+	Id           uint      `json:"id" gorm:"column:id;primaryKey"`
+	CreatedDate  time.Time `json:"createdDate" gorm:"column:created_date"`
+	LastUpdate   time.Time `json:"lastUpdate" gorm:"column:last_updated"`
+	UserId       uint      `json:"userId" gorm:"column:user_id"`
+	Name         string    `json:"name" gorm:"column:name"`
+	Query        string    `json:"query" gorm:"column:query"`
+	FolderId     uint      `json:"folderId" gorm:"column:folder_id"`
+	DiscussionId uint      `json:"discussionId" gorm:"column:discussion_id"`
+	Author       string    `json:"author" gorm:"column:author"`
+	Alerts       bool      `json:"alerts" gorm:"column:alerts"`
+}
+
+// SearchQuery returns the saved search as the first page of a search for
+// its newest matches
+func (s *SavedSearch) SearchQuery(size int) *SearchQuery {
+	return &SearchQuery{
+		Text:         s.Query,
+		FolderId:     s.FolderId,
+		DiscussionId: s.DiscussionId,
+		Author:       s.Author,
+		Sort:         SearchSortDate,
+		Size:         size,
+	}
+}
+
+// SavedSearchAlert is published to a user when a new post matches one of
+// their saved searches
+type SavedSearchAlert struct {
+	SavedSearchId   uint      `json:"savedSearchId"`
+	SavedSearchName string    `json:"savedSearchName"`
+	PostId          uint      `json:"postId"`
+	FolderId        uint      `json:"folderId"`
+	DiscussionId    uint      `json:"discussionId"`
+	DiscussionTitle string    `json:"discussionTitle"`
+	Username        string    `json:"username"`
+	CreatedDate     time.Time `json:"createdDate"`
+	Url             string    `json:"url"`
+}
@@ -17,13 +17,38 @@ package model
 
 import "time"
 
+const (
+	SearchSortDate      = "date"
+	SearchSortRelevance = "relevance"
+)
+
+// SearchQuery is a parsed /search request. After is the cursor of the last
+// result on the previous page, empty for the first page.
+type SearchQuery struct {
+	Text         string
+	FolderId     uint
+	DiscussionId uint
+	Author       string
+	From         time.Time
+	To           time.Time
+	Sort         string
+	Size         int
+	After        string
+	// ExcludeUserIds are the authors, usually those the searcher ignores,
+	// whose posts are left out of the results
+	ExcludeUserIds []uint
+}
+
 type SearchResult struct {
 	Post         *Post       `json:"post"`
 	Folder       *Folder     `json:"folder"`
 	Discussion   *Discussion `json:"discussion"`
+	Highlights   []string    `json:"highlights,omitempty"`
+	Cursor       string      `json:"cursor"`
 	TotalResults int         `json:"totalResults"`
 }
 
+// SearchHistory records a search. ResultCount is nil if the search failed.
 type SearchHistory struct {
 	Id          uint      `json:"id" gorm:"column:id;primaryKey"`
 	Version     int       `json:"version" gorm:"column:version"`
@@ -31,4 +56,42 @@ type SearchHistory struct {
 	UserId      uint      `json:"userId" gorm:"column:user_id"`
 	IPAddress   string    `json:"ipAddress" gorm:"column:ip_address"`
 	Query       string    `json:"query" gorm:"column:query"`
+	ResultCount *int      `json:"resultCount" gorm:"column:result_count"`
+}
+
+// SearchQueryCount is how often a query was searched for. Queries which
+// differ only in case are counted together.
+type SearchQueryCount struct {
+	Query    string    `json:"query" gorm:"column:query"`
+	Count    int       `json:"count" gorm:"column:count"`
+	Users    int       `json:"users" gorm:"column:users"`
+	LastDate time.Time `json:"lastDate" gorm:"column:last_date"`
+}
+
+type SearchDayCount struct {
+	Day         time.Time `json:"day" gorm:"column:day"`
+	Count       int       `json:"count" gorm:"column:count"`
+	Users       int       `json:"users" gorm:"column:users"`
+	ZeroResults int       `json:"zeroResults" gorm:"column:zero_results"`
+}
+
+// SearchUserCount is how much one user has searched. A user with many
+// distinct queries, or searching from many addresses, may be scraping.
+type SearchUserCount struct {
+	UserId          uint      `json:"userId" gorm:"column:user_id"`
+	Username        string    `json:"username" gorm:"column:username"`
+	Count           int       `json:"count" gorm:"column:count"`
+	DistinctQueries int       `json:"distinctQueries" gorm:"column:distinct_queries"`
+	IPAddresses     int       `json:"ipAddresses" gorm:"column:ip_addresses"`
+	LastDate        time.Time `json:"lastDate" gorm:"column:last_date"`
+}
+
+// SearchAnalytics summarises the searches made from From up to To
+type SearchAnalytics struct {
+	From              time.Time           `json:"from"`
+	To                time.Time           `json:"to"`
+	TopQueries        []*SearchQueryCount `json:"topQueries"`
+	ZeroResultQueries []*SearchQueryCount `json:"zeroResultQueries"`
+	PerDay            []*SearchDayCount   `json:"perDay"`
+	PerUser           []*SearchUserCount  `json:"perUser"`
 }
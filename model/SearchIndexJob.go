@@ -0,0 +1,49 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import "time"
+
+const (
+	SearchIndexJobScopeDiscussion = "discussion"
+	SearchIndexJobScopeFolder     = "folder"
+
+	SearchIndexJobStatusPending  = "pending"
+	SearchIndexJobStatusRunning  = "running"
+	SearchIndexJobStatusComplete = "complete"
+	SearchIndexJobStatusFailed   = "failed"
+
+	SearchIndexJobActionReindex = "reindex"
+	SearchIndexJobActionRemove  = "remove"
+)
+
+// SearchIndexJob brings the search index back into line with a discussion or
+// folder after a change that affects every post in it
+type SearchIndexJob struct {
+	Id            uint       `json:"id" gorm:"column:id;primaryKey"`
+	CreatedDate   time.Time  `json:"createdDate" gorm:"column:created_date"`
+	LastUpdate    time.Time  `json:"lastUpdate" gorm:"column:last_updated"`
+	Scope         string     `json:"scope" gorm:"column:scope"`
+	TargetId      uint       `json:"targetId" gorm:"column:target_id"`
+	Reason        string     `json:"reason" gorm:"column:reason"`
+	Status        string     `json:"status" gorm:"column:status"`
+	Action        *string    `json:"action,omitempty" gorm:"column:action"`
+	Processed     int        `json:"processed" gorm:"column:processed"`
+	Failed        int        `json:"failed" gorm:"column:failed"`
+	LastError     *string    `json:"lastError,omitempty" gorm:"column:last_error"`
+	StartedDate   *time.Time `json:"startedDate,omitempty" gorm:"column:started_date"`
+	CompletedDate *time.Time `json:"completedDate,omitempty" gorm:"column:completed_date"`
+}
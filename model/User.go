@@ -190,6 +190,16 @@ type UserSearchResults struct {
 	IsPremoderate   bool      `json:"isPremoderate" gorm:"column:is_premoderate"`
 	IsWatch         bool      `json:"isWatch" gorm:"column:is_watch"`
 	IsEmailVerified bool      `json:"isEmailVerified" gorm:"column:email_verified"`
+	ModNoteCount    int       `json:"modNoteCount" gorm:"column:mod_note_count"`
+}
+
+// UserModNote is a moderator's private note about a user
+type UserModNote struct {
+	ModelBase
+	UserId      uint   `json:"userId" gorm:"column:user_id"`
+	ModeratorId uint   `json:"moderatorId" gorm:"column:mod_id"`
+	Moderator   string `json:"moderator" gorm:"column:mod_name"`
+	Note        string `json:"note" gorm:"column:note"`
 }
 
 type UserHistory struct {
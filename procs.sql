@@ -65,6 +65,98 @@ alter table front_page_entry  modify last_post datetime(6) null;
 drop index idx_front_page_entry_last_post on front_page_entry;
 create index idx_front_page_entry_last_post on front_page_entry(last_post);
 
+create table post_outbox (
+    id bigint not null auto_increment primary key,
+    created_date datetime(6) not null default (UTC_TIMESTAMP(6)),
+    post_id bigint not null,
+    action varchar(16) not null,
+    attempts int not null default 0,
+    next_attempt_date datetime(6) not null default (UTC_TIMESTAMP(6)),
+    last_error varchar(1024) null,
+    dead_lettered_date datetime(6) null
+);
+
+create index idx_post_outbox_due on post_outbox(dead_lettered_date, next_attempt_date);
+
+create table search_index_job (
+    id bigint not null auto_increment primary key,
+    created_date datetime(6) not null default (UTC_TIMESTAMP(6)),
+    last_updated datetime(6) not null default (UTC_TIMESTAMP(6)),
+    scope varchar(16) not null,
+    target_id bigint not null,
+    reason varchar(64) not null,
+    status varchar(16) not null default 'pending',
+    action varchar(16) null,
+    processed int not null default 0,
+    failed int not null default 0,
+    last_error varchar(1024) null,
+    started_date datetime(6) null,
+    completed_date datetime(6) null
+);
+
+create index idx_search_index_job_status on search_index_job(status, last_updated);
+create index idx_search_index_job_target on search_index_job(scope, target_id, status);
+
+create table saved_search (
+    id bigint not null auto_increment primary key,
+    created_date datetime(6) not null default (UTC_TIMESTAMP(6)),
+    last_updated datetime(6) not null default (UTC_TIMESTAMP(6)),
+    user_id bigint not null,
+    name varchar(100) not null,
+    query varchar(500) not null,
+    folder_id bigint not null default 0,
+    discussion_id bigint not null default 0,
+    author varchar(255) not null default '',
+    alerts tinyint not null default 0
+);
+
+create index idx_saved_search_user on saved_search(user_id);
+create index idx_saved_search_alerts on saved_search(alerts);
+
+alter table search_history add column result_count int null;
+create index idx_search_history_user on search_history(user_id, search_date);
+create index idx_search_history_date on search_history(search_date);
+
+alter table folder add column sort_order int not null default 0;
+alter table folder add column archived int not null default 0;
+update folder set sort_order = id where id > 0;
+create unique index idx_folder_key on folder(folder_key);
+
+alter table banned_word add column action varchar(16) not null default 'hold';
+
+create table banned_word_folder (
+    banned_word_id bigint not null references banned_word(id),
+    folder_id bigint not null references folder(id),
+    primary key (banned_word_id, folder_id)
+);
+
+create table post_banned_word (
+    post_id bigint not null references post(id),
+    banned_word_id bigint not null,
+    created_date datetime not null default current_timestamp,
+    primary key (post_id, banned_word_id)
+);
+
+alter table moderation_queue add column reason varchar(255) null;
+
+create table content_scan_job (
+    id bigint not null auto_increment primary key,
+    created_date datetime(6) not null default (UTC_TIMESTAMP(6)),
+    last_updated datetime(6) not null default (UTC_TIMESTAMP(6)),
+    user_id bigint not null,
+    from_date datetime(6) not null,
+    to_date datetime(6) not null,
+    status varchar(16) not null default 'pending',
+    last_post_id bigint not null default 0,
+    scanned int not null default 0,
+    matched int not null default 0,
+    last_error varchar(1024) null,
+    started_date datetime(6) null,
+    completed_date datetime(6) null
+);
+
+create index idx_content_scan_job_status on content_scan_job(status, last_updated);
+
 ---------------------------------------------
 
 DROP PROCEDURE IF EXISTS get_folders;
@@ -72,12 +164,179 @@ DELIMITER //
 CREATE PROCEDURE get_folders()
 BEGIN
 
-    select f.*,
-    d.discussion_count
+    select f.id,
+    f.version,
+    f.description,
+    f.activity,
+    f.folder_key,
+    f.type,
+    f.sort_order,
+    case f.archived when 1 then 1 else 0 end archived,
+    coalesce(d.discussion_count, 0) discussion_count
     from folder f
-    inner join (select folder_id, count(*) discussion_count from discussion d group by folder_id) d
+    left join (select folder_id, count(*) discussion_count from discussion d where d.status = 0 group by folder_id) d
     on d.folder_id = f.id
-    where f.type in (0, 3);
+    where f.type in (0, 3)
+    order by f.sort_order, f.id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_banned_word;
+DELIMITER //
+CREATE PROCEDURE get_banned_word(IN $word_id bigint)
+BEGIN
+
+    select id, version, word, action
+    from banned_word
+    where id = $word_id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS create_banned_word;
+DELIMITER //
+CREATE PROCEDURE create_banned_word(IN $word varchar(255), IN $action varchar(16))
+BEGIN
+
+    insert into banned_word (version, word, action)
+    values (1, $word, $action);
+
+    call get_banned_word(LAST_INSERT_ID());
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS update_banned_word;
+DELIMITER //
+CREATE PROCEDURE update_banned_word(IN $word_id bigint, IN $word varchar(255), IN $action varchar(16))
+BEGIN
+
+    update banned_word set
+    version = version + 1,
+    word = $word,
+    action = $action
+    where id = $word_id;
+
+    call get_banned_word($word_id);
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS delete_banned_word;
+DELIMITER //
+CREATE PROCEDURE delete_banned_word(IN $word_id bigint)
+BEGIN
+
+    delete from banned_word_folder
+    where banned_word_id = $word_id;
+
+    delete from banned_word
+    where id = $word_id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS record_post_banned_word;
+DELIMITER //
+CREATE PROCEDURE record_post_banned_word(IN $post_id bigint, IN $banned_word_id bigint)
+BEGIN
+
+    insert ignore into post_banned_word (post_id, banned_word_id)
+    values ($post_id, $banned_word_id);
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS calculate_folder_activity;
+DELIMITER //
+CREATE PROCEDURE calculate_folder_activity(IN $since datetime)
+BEGIN
+
+    update folder f
+    left join (
+        select d.folder_id, count(*) post_count
+        from post p
+        inner join discussion d
+        on d.id = p.discussion_id
+        where p.created_date > $since
+        and p.status in (0, 3)
+        and d.status = 0
+        group by d.folder_id
+    ) a
+    on a.folder_id = f.id
+    set f.activity = coalesce(a.post_count, 0);
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_folder;
+DELIMITER //
+CREATE PROCEDURE get_folder(IN $folder_id bigint)
+BEGIN
+
+    select f.id,
+    f.version,
+    f.description,
+    f.activity,
+    f.folder_key,
+    f.type,
+    f.sort_order,
+    case f.archived when 1 then 1 else 0 end archived,
+    (select count(*) from discussion d where d.folder_id = f.id and d.status = 0) discussion_count
+    from folder f
+    where f.id = $folder_id
+    and f.type in (0, 3);
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS create_folder;
+DELIMITER //
+CREATE PROCEDURE create_folder(IN $folder_key varchar(255), IN $description varchar(255), IN $type int)
+BEGIN
+
+    declare $folder_id bigint;
+
+    insert into folder (version, description, activity, folder_key, type, sort_order, archived)
+    select 1, $description, 0, $folder_key, $type, coalesce(max(sort_order), 0) + 1, 0
+    from folder;
+
+    set $folder_id = LAST_INSERT_ID();
+
+    call get_folder($folder_id);
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS update_folder;
+DELIMITER //
+CREATE PROCEDURE update_folder(IN $folder_id bigint, IN $folder_key varchar(255), IN $description varchar(255), IN $type int, IN $archived int)
+BEGIN
+
+    update folder set
+    version = version + 1,
+    folder_key = $folder_key,
+    description = $description,
+    type = $type,
+    archived = $archived
+    where id = $folder_id
+    and type in (0, 3);
+
+    call get_folder($folder_id);
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS set_folder_sort_order;
+DELIMITER //
+CREATE PROCEDURE set_folder_sort_order(IN $folder_id bigint, IN $sort_order int)
+BEGIN
+
+    update folder set
+    version = version + 1,
+    sort_order = $sort_order
+    where id = $folder_id;
 
 END //
 DELIMITER ;
@@ -407,6 +666,9 @@ BEGIN
     delete from moderation_queue
     where post_id = $post_id;
 
+    insert into post_outbox (post_id, action)
+    select id, 'update' from post where id = $post_id and discussion_id = $discussion_id;
+
     commit work;
 
     call get_post($post_id);
@@ -1664,8 +1926,11 @@ BEGIN
 
 	set $last_post_id = LAST_INSERT_ID();
 
+    insert into post_outbox (post_id, action) values ($last_post_id, 'create');
+
     update discussion
-    set post_count = $post_num,
+    set version = version + 1,
+    post_count = $post_num,
     last_post = $current_timestamp,
     last_post_id = $last_post_id
     where id = $discussion_id;
@@ -1775,6 +2040,10 @@ BEGIN
 
     SELECT ROW_COUNT() into $rows_affected;
 
+    if $rows_affected = 1 then
+        insert into post_outbox (post_id, action) values ($post_id, 'update');
+    end if;
+
     commit work;
 
     if $rows_affected = 1 then
@@ -1834,6 +2103,8 @@ BEGIN
     #static STATUS_DELETED_BY_ADMIN = 2
     #static STATUS_DELETED_BY_USER = 256
 
+    start transaction;
+
     update post p
     inner join discussion d
     on p.discussion_id = d.id
@@ -1848,8 +2119,13 @@ BEGIN
     SELECT ROW_COUNT() into $rows_affected;
 
     if $rows_affected = 1 then
-
         delete from moderation_queue where post_id = $post_id;
+        insert into post_outbox (post_id, action) values ($post_id, 'delete');
+    end if;
+
+    commit work;
+
+    if $rows_affected = 1 then
 
         select p.id,
         p.version,
@@ -1958,6 +2234,41 @@ BEGIN
 END //
 DELIMITER ;
 
+DROP PROCEDURE IF EXISTS get_recent_folder_discussions;
+DELIMITER //
+CREATE PROCEDURE get_recent_folder_discussions(IN $folder_id bigint, IN $since datetime, IN $limit int)
+BEGIN
+
+    select d.id,
+    d.version,
+    d.created_date,
+    d.folder_id,
+    d.header,
+    d.last_post,
+    d.title,
+    d.user_id,
+    u.username,
+    case coalesce(d.deleted, 0) when 1 then 1 else 0 end deleted,
+    case d.locked when 1 then 1 else 0 end locked,
+    d.post_count,
+    d.zorder,
+    d.status,
+    case d.premoderate when 1 then 1 else 0 end premoderate,
+    d.last_updated,
+    d.last_post_id
+    from discussion d
+    inner join user u
+    on d.user_id = u.id
+    where d.folder_id = $folder_id
+    and d.created_date >= $since
+    and d.status = 0
+    and coalesce(d.deleted, 0) = 0
+    order by d.created_date desc
+    limit $limit;
+
+END //
+DELIMITER ;
+
 DROP PROCEDURE IF EXISTS create_discussion;
 DELIMITER //
 CREATE PROCEDURE create_discussion(IN $folder_id bigint, IN $discussion_title varchar(128), IN $discussion_header varchar(1024), IN $user_id bigint, IN $locked int)
@@ -2190,7 +2501,8 @@ BEGIN
     case u.account_locked when 1 then 1 else 0 end user_locked,
     case u.account_expired when 1 then 1 else 0 end user_expired,
     case coalesce(o.watch, 0) when 1 then 1 else 0 end user_watch,
-    case coalesce(o.premoderate) when 1 then 1 else 0 end user_premod
+    case coalesce(o.premoderate) when 1 then 1 else 0 end user_premod,
+    mq.reason moderation_reason
     from post p
     inner join discussion d
     on p.discussion_id = d.id
@@ -2240,7 +2552,8 @@ CREATE PROCEDURE get_comments_by_discussion(IN $discussion_id bigint)
 BEGIN
 
 
-    select c.*, u.username
+    select c.*, u.username,
+    (select group_concat(r.authority) from user_role ur inner join role r on ur.role_id = r.id where ur.user_id = c.user_id) roles
     from moderator_comment c
     inner join post p
     on c.post_id = p.id
@@ -2282,7 +2595,8 @@ CREATE PROCEDURE get_comments_by_post(IN $post_id bigint)
 BEGIN
 
 
-    select c.*, u.username
+    select c.*, u.username,
+    (select group_concat(r.authority) from user_role ur inner join role r on ur.role_id = r.id where ur.user_id = c.user_id) roles
     from moderator_comment c
     inner join post p
     on c.post_id = p.id
@@ -2316,7 +2630,8 @@ BEGIN
     $vote,
     $user_id);
 
-    select c.*, u.username
+    select c.*, u.username,
+    (select group_concat(r.authority) from user_role ur inner join role r on ur.role_id = r.id where ur.user_id = c.user_id) roles
     from moderator_comment c
     inner join user u
     on c.user_id = u.id
@@ -2330,7 +2645,7 @@ DELIMITER //
 CREATE PROCEDURE lock_discussion(IN $discussion_id bigint, IN $state bit)
 BEGIN
 
-    update discussion set locked = $state where id = $discussion_id;
+    update discussion set version = version + 1, locked = $state where id = $discussion_id;
 
     call get_discussion($discussion_id);
 
@@ -2342,7 +2657,7 @@ DELIMITER //
 CREATE PROCEDURE premoderate_discussion(IN $discussion_id bigint, IN $state bit)
 BEGIN
 
-    update discussion set premoderate = $state where id = $discussion_id;
+    update discussion set version = version + 1, premoderate = $state where id = $discussion_id;
 
     call get_discussion($discussion_id);
 
@@ -2356,7 +2671,7 @@ BEGIN
 
     start transaction;
 
-    update discussion set status = $status, deleted = case $status when 0 then 0 else 1 end where id = $discussion_id;
+    update discussion set version = version + 1, status = $status, deleted = case $status when 0 then 0 else 1 end where id = $discussion_id;
     delete from front_page_entry where discussion_id = $discussion_id;
 
     commit work;
@@ -2371,7 +2686,7 @@ DELIMITER //
 CREATE PROCEDURE move_discussion(IN $discussion_id bigint, IN $folder_id bigint)
 BEGIN
 
-    update discussion set folder_id = $folder_id where id = $discussion_id;
+    update discussion set version = version + 1, folder_id = $folder_id where id = $discussion_id;
 
     call get_discussion($discussion_id);
 
@@ -2567,16 +2882,56 @@ END //
 DELIMITER ;
 
 DROP PROCEDURE IF EXISTS get_indexable_posts;
+
+DROP PROCEDURE IF EXISTS get_indexable_posts_after;
+DELIMITER //
+CREATE PROCEDURE get_indexable_posts_after(IN $after_post_id bigint, IN $limit int)
+BEGIN
+
+    select p.id,
+    p.created_date,
+    p.text,
+    u.username,
+    p.user_id,
+    p.status,
+    d.id discussion_id,
+    d.title discussion_title,
+    d.header discussion_header,
+    f.id folder_id,
+    f.description folder_name
+	from post p
+    inner join user u
+    on p.user_id = u.id
+	inner join discussion d
+	on p.discussion_id = d.id
+	inner join folder f
+	on d.folder_id = f.id
+	where p.id > $after_post_id
+	and p.status in (0, 4)
+	and d.status = 0
+	and d.locked = 0
+	and not f.id in (33, 34)
+	order by p.id
+	limit $limit;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_indexable_posts_in;
 DELIMITER //
-CREATE PROCEDURE get_indexable_posts()
+CREATE PROCEDURE get_indexable_posts_in(IN $folder_id bigint, IN $discussion_id bigint)
 BEGIN
 
     select p.id,
     p.created_date,
     p.text,
     u.username,
+    p.user_id,
+    p.status,
+    d.id discussion_id,
     d.title discussion_title,
     d.header discussion_header,
+    f.id folder_id,
     f.description folder_name
 	from post p
     inner join user u
@@ -2585,9 +2940,12 @@ BEGIN
 	on p.discussion_id = d.id
 	inner join folder f
 	on d.folder_id = f.id
-	where p.status = 0
+	where p.status in (0, 4)
 	and d.status = 0
-	and not f.id in (33, 34);
+	and d.locked = 0
+	and not f.id in (33, 34)
+	and ($folder_id = 0 or f.id = $folder_id)
+	and ($discussion_id = 0 or d.id = $discussion_id);
 
 END //
 DELIMITER ;
@@ -2826,12 +3184,15 @@ BEGIN
     case o.premoderate when 1 then 1 else 0 end is_premoderate,
     case o.watch when 1 then 1 else 0 end is_watch,
     case coalesce(a.is_admin, 0) when 0 then 0 else 1 end is_admin,
-    u.email_verified
+    u.email_verified,
+    coalesce(n.mod_note_count, 0) mod_note_count
     from user u
     left join user_options o
     on u.id = o.user_id
     left join (select user_id, count(*) is_admin from user_role where role_id in (2, 3) group by user_id) a
     on u.id = a.user_id
+    left join (select user_id, count(*) mod_note_count from user_mod_note group by user_id) n
+    on u.id = n.user_id
     where u.username like $search_term
     order by u.username;
 
@@ -2857,12 +3218,15 @@ BEGIN
     case o.premoderate when 1 then 1 else 0 end is_premoderate,
     case o.watch when 1 then 1 else 0 end is_watch,
     case coalesce(a.is_admin, 0) when 0 then 0 else 1 end is_admin,
-    u.email_verified
+    u.email_verified,
+    coalesce(n.mod_note_count, 0) mod_note_count
     from user u
     left join user_options o
     on u.id = o.user_id
     left join (select user_id, count(*) is_admin from user_role where role_id in (2, 3) group by user_id) a
     on u.id = a.user_id
+    left join (select user_id, count(*) mod_note_count from user_mod_note group by user_id) n
+    on u.id = n.user_id
     where not last_login_date is null
     and o.premoderate = 1
     and u.enabled = 1
@@ -2890,12 +3254,15 @@ BEGIN
     case o.premoderate when 1 then 1 else 0 end is_premoderate,
     case o.watch when 1 then 1 else 0 end is_watch,
     case coalesce(a.is_admin, 0) when 0 then 0 else 1 end is_admin,
-    u.email_verified
+    u.email_verified,
+    coalesce(n.mod_note_count, 0) mod_note_count
     from user u
     left join user_options o
     on u.id = o.user_id
     left join (select user_id, count(*) is_admin from user_role where role_id in (2, 3) group by user_id) a
     on u.id = a.user_id
+    left join (select user_id, count(*) mod_note_count from user_mod_note group by user_id) n
+    on u.id = n.user_id
     where not last_login_date is null
     and o.watch = 1
     and u.enabled = 1
@@ -2923,12 +3290,15 @@ BEGIN
     case o.premoderate when 1 then 1 else 0 end is_premoderate,
     case o.watch when 1 then 1 else 0 end is_watch,
     case coalesce(a.is_admin, 0) when 0 then 0 else 1 end is_admin,
-    u.email_verified
+    u.email_verified,
+    coalesce(n.mod_note_count, 0) mod_note_count
     from user u
     left join user_options o
     on u.id = o.user_id
     left join (select user_id, count(*) is_admin from user_role where role_id in (2, 3) group by user_id) a
     on u.id = a.user_id
+    left join (select user_id, count(*) mod_note_count from user_mod_note group by user_id) n
+    on u.id = n.user_id
     where not last_login_date is null
     and u.account_locked = 1
     and u.enabled = 1
@@ -2956,12 +3326,15 @@ BEGIN
     case o.premoderate when 1 then 1 else 0 end is_premoderate,
     case o.watch when 1 then 1 else 0 end is_watch,
     case coalesce(a.is_admin, 0) when 0 then 0 else 1 end is_admin,
-    u.email_verified
+    u.email_verified,
+    coalesce(n.mod_note_count, 0) mod_note_count
     from user u
     left join user_options o
     on u.id = o.user_id
     left join (select user_id, count(*) is_admin from user_role where role_id in (2, 3) group by user_id) a
     on u.id = a.user_id
+    left join (select user_id, count(*) mod_note_count from user_mod_note group by user_id) n
+    on u.id = n.user_id
     where not last_login_date is null
     and u.created_date > date_sub(now(), interval 30 day)
     order by u.username;
@@ -3074,9 +3447,822 @@ BEGIN
 
     end loop curs_loop;
 
-	update discussion set post_count = $post_num where id = $discussion_id;
+	update discussion set version = version + 1, post_count = $post_num where id = $discussion_id;
+
+    commit work;
+
+END //
+DELIMITER ;
+
+
+DROP PROCEDURE IF EXISTS claim_post_outbox_entries;
+DELIMITER //
+CREATE PROCEDURE claim_post_outbox_entries(IN $batch_size int, IN $lease_seconds int)
+BEGIN
+
+    declare $current_timestamp datetime(6);
+
+    DECLARE EXIT HANDLER FOR SQLEXCEPTION
+    BEGIN
+        ROLLBACK;
+        RESIGNAL;
+    END;
+
+    select UTC_TIMESTAMP(6) into $current_timestamp;
+
+    drop temporary table if exists claimed_post_outbox;
+    create temporary table claimed_post_outbox (id bigint not null primary key);
+
+    start transaction;
+
+    insert into claimed_post_outbox (id)
+    select id
+    from post_outbox
+    where dead_lettered_date is null
+    and next_attempt_date <= $current_timestamp
+    order by id
+    limit $batch_size
+    for update skip locked;
+
+    # push the entries out of reach of other relays until the lease expires
+    update post_outbox o
+    inner join claimed_post_outbox c
+    on o.id = c.id
+    set o.next_attempt_date = date_add($current_timestamp, interval $lease_seconds second);
 
     commit work;
 
+    select o.id,
+    o.created_date,
+    o.post_id,
+    o.action,
+    o.attempts,
+    o.next_attempt_date,
+    o.last_error,
+    o.dead_lettered_date
+    from post_outbox o
+    inner join claimed_post_outbox c
+    on o.id = c.id
+    order by o.id;
+
+    drop temporary table claimed_post_outbox;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS complete_post_outbox_entry;
+DELIMITER //
+CREATE PROCEDURE complete_post_outbox_entry(IN $entry_id bigint)
+BEGIN
+
+    delete from post_outbox where id = $entry_id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS fail_post_outbox_entry;
+DELIMITER //
+CREATE PROCEDURE fail_post_outbox_entry(IN $entry_id bigint, IN $last_error varchar(1024), IN $next_attempt_date datetime(6), IN $dead_letter int)
+BEGIN
+
+    update post_outbox
+    set attempts = attempts + 1,
+    last_error = $last_error,
+    next_attempt_date = $next_attempt_date,
+    dead_lettered_date = case when $dead_letter = 1 then UTC_TIMESTAMP(6) else null end
+    where id = $entry_id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_dead_lettered_post_outbox_entries;
+DELIMITER //
+CREATE PROCEDURE get_dead_lettered_post_outbox_entries(IN $page_start int, IN $page_size int)
+BEGIN
+
+    select id,
+    created_date,
+    post_id,
+    action,
+    attempts,
+    next_attempt_date,
+    last_error,
+    dead_lettered_date
+    from post_outbox
+    where dead_lettered_date is not null
+    order by dead_lettered_date desc, id desc
+    limit $page_start, $page_size;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS replay_post_outbox_entry;
+DELIMITER //
+CREATE PROCEDURE replay_post_outbox_entry(IN $entry_id bigint)
+BEGIN
+
+    update post_outbox
+    set attempts = 0,
+    last_error = null,
+    next_attempt_date = UTC_TIMESTAMP(6),
+    dead_lettered_date = null
+    where id = $entry_id
+    and dead_lettered_date is not null;
+
+    select id,
+    created_date,
+    post_id,
+    action,
+    attempts,
+    next_attempt_date,
+    last_error,
+    dead_lettered_date
+    from post_outbox
+    where id = $entry_id
+    and dead_lettered_date is null;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_search_index_job;
+DELIMITER //
+CREATE PROCEDURE get_search_index_job(IN $job_id bigint)
+BEGIN
+
+    select id,
+    created_date,
+    last_updated,
+    scope,
+    target_id,
+    reason,
+    status,
+    action,
+    processed,
+    failed,
+    last_error,
+    started_date,
+    completed_date
+    from search_index_job
+    where id = $job_id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS create_search_index_job;
+DELIMITER //
+CREATE PROCEDURE create_search_index_job(IN $scope varchar(16), IN $target_id bigint, IN $reason varchar(64))
+BEGIN
+
+    declare $job_id bigint;
+
+    # a job that has not started yet will pick up this change too
+    select id into $job_id
+    from search_index_job
+    where scope = $scope
+    and target_id = $target_id
+    and status = 'pending'
+    limit 1;
+
+    if $job_id is null then
+        insert into search_index_job (scope, target_id, reason)
+        values ($scope, $target_id, $reason);
+        select LAST_INSERT_ID() into $job_id;
+    end if;
+
+    call get_search_index_job($job_id);
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS claim_search_index_job;
+DELIMITER //
+CREATE PROCEDURE claim_search_index_job(IN $stale_seconds int)
+BEGIN
+
+    declare $job_id bigint;
+    declare $current_timestamp datetime(6);
+
+    DECLARE EXIT HANDLER FOR SQLEXCEPTION
+    BEGIN
+        ROLLBACK;
+        RESIGNAL;
+    END;
+
+    select UTC_TIMESTAMP(6) into $current_timestamp;
+
+    start transaction;
+
+    select id into $job_id
+    from search_index_job
+    where status = 'pending'
+    or (status = 'running' and last_updated < date_sub($current_timestamp, interval $stale_seconds second))
+    order by id
+    limit 1
+    for update skip locked;
+
+    if not $job_id is null then
+        update search_index_job
+        set status = 'running',
+        started_date = $current_timestamp,
+        last_updated = $current_timestamp,
+        processed = 0,
+        failed = 0,
+        last_error = null
+        where id = $job_id;
+    end if;
+
+    commit work;
+
+    call get_search_index_job($job_id);
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS update_search_index_job_progress;
+DELIMITER //
+CREATE PROCEDURE update_search_index_job_progress(IN $job_id bigint, IN $processed int, IN $failed int)
+BEGIN
+
+    update search_index_job
+    set processed = $processed,
+    failed = $failed,
+    last_updated = UTC_TIMESTAMP(6)
+    where id = $job_id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS finish_search_index_job;
+DELIMITER //
+CREATE PROCEDURE finish_search_index_job(IN $job_id bigint, IN $status varchar(16), IN $action varchar(16), IN $processed int, IN $failed int, IN $last_error varchar(1024))
+BEGIN
+
+    update search_index_job
+    set status = $status,
+    action = $action,
+    processed = $processed,
+    failed = $failed,
+    last_error = nullif($last_error, ''),
+    last_updated = UTC_TIMESTAMP(6),
+    completed_date = UTC_TIMESTAMP(6)
+    where id = $job_id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_search_index_jobs;
+DELIMITER //
+CREATE PROCEDURE get_search_index_jobs(IN $page_start int, IN $page_size int)
+BEGIN
+
+    select id,
+    created_date,
+    last_updated,
+    scope,
+    target_id,
+    reason,
+    status,
+    action,
+    processed,
+    failed,
+    last_error,
+    started_date,
+    completed_date
+    from search_index_job
+    order by id desc
+    limit $page_start, $page_size;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS retry_search_index_job;
+DELIMITER //
+CREATE PROCEDURE retry_search_index_job(IN $job_id bigint)
+BEGIN
+
+    update search_index_job
+    set status = 'pending',
+    last_updated = UTC_TIMESTAMP(6),
+    completed_date = null
+    where id = $job_id
+    and status = 'failed';
+
+    select id,
+    created_date,
+    last_updated,
+    scope,
+    target_id,
+    reason,
+    status,
+    action,
+    processed,
+    failed,
+    last_error,
+    started_date,
+    completed_date
+    from search_index_job
+    where id = $job_id
+    and status = 'pending';
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_saved_search;
+DELIMITER //
+CREATE PROCEDURE get_saved_search(IN $saved_search_id bigint)
+BEGIN
+
+    select id,
+    created_date,
+    last_updated,
+    user_id,
+    name,
+    query,
+    folder_id,
+    discussion_id,
+    author,
+    alerts
+    from saved_search
+    where id = $saved_search_id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_saved_searches;
+DELIMITER //
+CREATE PROCEDURE get_saved_searches(IN $user_id bigint)
+BEGIN
+
+    select id,
+    created_date,
+    last_updated,
+    user_id,
+    name,
+    query,
+    folder_id,
+    discussion_id,
+    author,
+    alerts
+    from saved_search
+    where user_id = $user_id
+    order by name, id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_alerting_saved_searches;
+DELIMITER //
+CREATE PROCEDURE get_alerting_saved_searches()
+BEGIN
+
+    select id,
+    created_date,
+    last_updated,
+    user_id,
+    name,
+    query,
+    folder_id,
+    discussion_id,
+    author,
+    alerts
+    from saved_search
+    where alerts = 1
+    order by id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS create_saved_search;
+DELIMITER //
+CREATE PROCEDURE create_saved_search(IN $user_id bigint, IN $name varchar(100), IN $query varchar(500), IN $folder_id bigint, IN $discussion_id bigint, IN $author varchar(255), IN $alerts tinyint)
+BEGIN
+
+    insert into saved_search (user_id, name, query, folder_id, discussion_id, author, alerts)
+    values ($user_id, $name, $query, $folder_id, $discussion_id, $author, $alerts);
+
+    call get_saved_search(LAST_INSERT_ID());
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS update_saved_search;
+DELIMITER //
+CREATE PROCEDURE update_saved_search(IN $saved_search_id bigint, IN $user_id bigint, IN $name varchar(100), IN $query varchar(500), IN $folder_id bigint, IN $discussion_id bigint, IN $author varchar(255), IN $alerts tinyint)
+BEGIN
+
+    update saved_search
+    set name = $name,
+    query = $query,
+    folder_id = $folder_id,
+    discussion_id = $discussion_id,
+    author = $author,
+    alerts = $alerts,
+    last_updated = UTC_TIMESTAMP(6)
+    where id = $saved_search_id
+    and user_id = $user_id;
+
+    select id,
+    created_date,
+    last_updated,
+    user_id,
+    name,
+    query,
+    folder_id,
+    discussion_id,
+    author,
+    alerts
+    from saved_search
+    where id = $saved_search_id
+    and user_id = $user_id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS delete_saved_search;
+DELIMITER //
+CREATE PROCEDURE delete_saved_search(IN $saved_search_id bigint, IN $user_id bigint)
+BEGIN
+
+    # the deleted row is returned so that a missing search can be reported
+    select id,
+    created_date,
+    last_updated,
+    user_id,
+    name,
+    query,
+    folder_id,
+    discussion_id,
+    author,
+    alerts
+    from saved_search
+    where id = $saved_search_id
+    and user_id = $user_id;
+
+    delete from saved_search
+    where id = $saved_search_id
+    and user_id = $user_id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_search_history;
+DELIMITER //
+CREATE PROCEDURE get_search_history(IN $user_id bigint, IN $page_start int, IN $page_size int)
+BEGIN
+
+    select id,
+    version,
+    search_date,
+    user_id,
+    ip_address,
+    query,
+    result_count
+    from search_history
+    where user_id = $user_id
+    order by search_date desc, id desc
+    limit $page_start, $page_size;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS delete_search_history;
+DELIMITER //
+CREATE PROCEDURE delete_search_history(IN $user_id bigint)
+BEGIN
+
+    delete from search_history
+    where user_id = $user_id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_top_searches;
+DELIMITER //
+CREATE PROCEDURE get_top_searches(IN $from_date datetime(6), IN $to_date datetime(6), IN $zero_results tinyint, IN $limit int)
+BEGIN
+
+    select lower(query) query,
+    count(*) count,
+    count(distinct user_id) users,
+    max(search_date) last_date
+    from search_history
+    where search_date >= $from_date
+    and search_date < $to_date
+    and ($zero_results = 0 or result_count = 0)
+    group by lower(query)
+    order by count desc, last_date desc
+    limit $limit;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_searches_per_day;
+DELIMITER //
+CREATE PROCEDURE get_searches_per_day(IN $from_date datetime(6), IN $to_date datetime(6))
+BEGIN
+
+    select date(search_date) day,
+    count(*) count,
+    count(distinct user_id) users,
+    sum(case when result_count = 0 then 1 else 0 end) zero_results
+    from search_history
+    where search_date >= $from_date
+    and search_date < $to_date
+    group by date(search_date)
+    order by day;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_top_searchers;
+DELIMITER //
+CREATE PROCEDURE get_top_searchers(IN $from_date datetime(6), IN $to_date datetime(6), IN $limit int)
+BEGIN
+
+    select h.user_id,
+    u.username,
+    count(*) count,
+    count(distinct lower(h.query)) distinct_queries,
+    count(distinct h.ip_address) ip_addresses,
+    max(h.search_date) last_date
+    from search_history h
+    left join user u on u.id = h.user_id
+    where h.search_date >= $from_date
+    and h.search_date < $to_date
+    group by h.user_id, u.username
+    order by count desc, last_date desc
+    limit $limit;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_posts_created_between;
+DELIMITER //
+CREATE PROCEDURE get_posts_created_between(IN $after_post_id bigint, IN $from_date datetime(6), IN $to_date datetime(6), IN $limit int)
+BEGIN
+
+    select p.id,
+    p.created_date,
+    p.text,
+    u.username,
+    p.user_id,
+    p.status,
+    d.id discussion_id,
+    d.title discussion_title,
+    d.header discussion_header,
+    f.id folder_id,
+    f.description folder_name
+    from post p
+    inner join user u
+    on p.user_id = u.id
+    inner join discussion d
+    on p.discussion_id = d.id
+    inner join folder f
+    on d.folder_id = f.id
+    where p.id > $after_post_id
+    and p.created_date >= $from_date
+    and p.created_date < $to_date
+    and p.status in (0, 4)
+    order by p.id
+    limit $limit;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS queue_post_for_review;
+DELIMITER //
+CREATE PROCEDURE queue_post_for_review(IN $post_id bigint, IN $reason varchar(255))
+BEGIN
+
+    insert into moderation_queue (
+    version,
+    created_date,
+    post_id,
+    reason)
+    select 1,
+    UTC_TIMESTAMP(),
+    p.id,
+    $reason
+    from post p
+    where p.id = $post_id
+    and p.id not in (select post_id from moderation_queue);
+
+    select ROW_COUNT() queued;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_content_scan_job;
+DELIMITER //
+CREATE PROCEDURE get_content_scan_job(IN $job_id bigint)
+BEGIN
+
+    select id,
+    created_date,
+    last_updated,
+    user_id,
+    from_date,
+    to_date,
+    status,
+    last_post_id,
+    scanned,
+    matched,
+    last_error,
+    started_date,
+    completed_date
+    from content_scan_job
+    where id = $job_id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS create_content_scan_job;
+DELIMITER //
+CREATE PROCEDURE create_content_scan_job(IN $user_id bigint, IN $from_date datetime(6), IN $to_date datetime(6))
+BEGIN
+
+    insert into content_scan_job (user_id, from_date, to_date)
+    values ($user_id, $from_date, $to_date);
+
+    call get_content_scan_job(LAST_INSERT_ID());
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS claim_content_scan_job;
+DELIMITER //
+CREATE PROCEDURE claim_content_scan_job(IN $stale_seconds int)
+BEGIN
+
+    declare $job_id bigint;
+    declare $current_timestamp datetime(6);
+
+    DECLARE EXIT HANDLER FOR SQLEXCEPTION
+    BEGIN
+        ROLLBACK;
+        RESIGNAL;
+    END;
+
+    select UTC_TIMESTAMP(6) into $current_timestamp;
+
+    start transaction;
+
+    select id into $job_id
+    from content_scan_job
+    where status = 'pending'
+    or (status = 'running' and last_updated < date_sub($current_timestamp, interval $stale_seconds second))
+    order by id
+    limit 1
+    for update skip locked;
+
+    -- a stale job carries on from the last post it reached
+    if not $job_id is null then
+        update content_scan_job
+        set status = 'running',
+        started_date = coalesce(started_date, $current_timestamp),
+        last_updated = $current_timestamp
+        where id = $job_id;
+    end if;
+
+    commit work;
+
+    call get_content_scan_job($job_id);
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS update_content_scan_job_progress;
+DELIMITER //
+CREATE PROCEDURE update_content_scan_job_progress(IN $job_id bigint, IN $last_post_id bigint, IN $scanned int, IN $matched int)
+BEGIN
+
+    update content_scan_job
+    set last_post_id = $last_post_id,
+    scanned = $scanned,
+    matched = $matched,
+    last_updated = UTC_TIMESTAMP(6)
+    where id = $job_id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS finish_content_scan_job;
+DELIMITER //
+CREATE PROCEDURE finish_content_scan_job(IN $job_id bigint, IN $status varchar(16), IN $last_error varchar(1024))
+BEGIN
+
+    update content_scan_job
+    set status = $status,
+    last_error = nullif($last_error, ''),
+    last_updated = UTC_TIMESTAMP(6),
+    completed_date = UTC_TIMESTAMP(6)
+    where id = $job_id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_content_scan_jobs;
+DELIMITER //
+CREATE PROCEDURE get_content_scan_jobs(IN $page_start int, IN $page_size int)
+BEGIN
+
+    select id,
+    created_date,
+    last_updated,
+    user_id,
+    from_date,
+    to_date,
+    status,
+    last_post_id,
+    scanned,
+    matched,
+    last_error,
+    started_date,
+    completed_date
+    from content_scan_job
+    order by id desc
+    limit $page_start, $page_size;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_user_mod_notes;
+DELIMITER //
+CREATE PROCEDURE get_user_mod_notes(IN $user_id bigint)
+BEGIN
+
+    select n.*, u.username mod_name
+    from user_mod_note n
+    inner join user u
+    on n.mod_id = u.id
+    where n.user_id = $user_id
+    order by n.created_date desc, n.id desc;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS get_user_mod_note;
+DELIMITER //
+CREATE PROCEDURE get_user_mod_note(IN $note_id bigint)
+BEGIN
+
+    select n.*, u.username mod_name
+    from user_mod_note n
+    inner join user u
+    on n.mod_id = u.id
+    where n.id = $note_id;
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS create_user_mod_note;
+DELIMITER //
+CREATE PROCEDURE create_user_mod_note(IN $user_id bigint, IN $mod_id bigint, IN $note varchar(255))
+BEGIN
+
+    insert into user_mod_note (
+    version,
+    created_date,
+    last_updated,
+    mod_id,
+    note,
+    user_id)
+    values (
+    1,
+    UTC_TIMESTAMP(),
+    UTC_TIMESTAMP(),
+    $mod_id,
+    $note,
+    $user_id);
+
+    call get_user_mod_note(LAST_INSERT_ID());
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS update_user_mod_note;
+DELIMITER //
+CREATE PROCEDURE update_user_mod_note(IN $note_id bigint, IN $note varchar(255))
+BEGIN
+
+    update user_mod_note
+    set note = $note,
+    version = version + 1,
+    last_updated = UTC_TIMESTAMP()
+    where id = $note_id;
+
+    call get_user_mod_note($note_id);
+
+END //
+DELIMITER ;
+
+DROP PROCEDURE IF EXISTS delete_user_mod_note;
+DELIMITER //
+CREATE PROCEDURE delete_user_mod_note(IN $note_id bigint)
+BEGIN
+
+    delete from user_mod_note
+    where id = $note_id;
+
 END //
 DELIMITER ;
@@ -0,0 +1,289 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package repository
+
+import (
+	"errors"
+	"justthetalk/model"
+	"time"
+)
+
+var ErrNotFound = errors.New("record not found")
+
+type FrontPageView string
+
+const (
+	FrontPageViewLatest        FrontPageView = "latest"
+	FrontPageViewMostActive    FrontPageView = "mostactive"
+	FrontPageViewSubscriptions FrontPageView = "subs"
+	FrontPageViewStartedByMe   FrontPageView = "startedbyme"
+)
+
+type UserFilter string
+
+const (
+	UserFilterPremoderate UserFilter = "premod"
+	UserFilterWatch       UserFilter = "watch"
+	UserFilterLocked      UserFilter = "locked"
+	UserFilterRecent      UserFilter = "recent"
+)
+
+type UserFlag string
+
+const (
+	UserFlagEnabled     UserFlag = "enabled"
+	UserFlagLocked      UserFlag = "accountLocked"
+	UserFlagPremoderate UserFlag = "isPremoderate"
+	UserFlagWatch       UserFlag = "isWatch"
+)
+
+// Repository is the entry point to the data access layer. Implementations
+// must be safe to share between the repositories they hand out so that a
+// Transaction can be threaded through several of them.
+type Repository interface {
+	Folders() FolderRepository
+	Discussions() DiscussionRepository
+	Posts() PostRepository
+	Users() UserRepository
+	Subscriptions() SubscriptionRepository
+	Moderation() ModerationRepository
+	Outbox() OutboxRepository
+	SearchIndexJobs() SearchIndexJobRepository
+	ContentScanJobs() ContentScanJobRepository
+	SavedSearches() SavedSearchRepository
+	Transaction(fn func(tx Repository) error) error
+}
+
+// Provider hands out a Repository bound to a deadline, in the same way that
+// connections.WithDatabase hands out a *gorm.DB.
+type Provider interface {
+	WithRepository(timeout time.Duration, fn func(repo Repository))
+}
+
+type FolderRepository interface {
+	GetFolders() ([]*model.Folder, error)
+	Get(folderId uint) (*model.Folder, error)
+	// Create adds a folder after all the others
+	Create(key string, description string, folderType uint) (*model.Folder, error)
+	Update(folderId uint, key string, description string, folderType uint, archived bool) (*model.Folder, error)
+	// SetSortOrder sets where the folder comes in the list of folders
+	SetSortOrder(folderId uint, sortOrder int) error
+	// CalculateActivity sets each folder's activity to the number of visible
+	// posts made in it since the given time
+	CalculateActivity(since time.Time) error
+}
+
+type DiscussionRepository interface {
+	Get(discussionId uint) (*model.Discussion, error)
+	FindByTitle(folderId uint, title string) (*model.Discussion, error)
+	// GetRecent returns the discussions in the folder which were started
+	// since the given time and haven't been deleted, newest first
+	GetRecent(folderId uint, since time.Time, limit int) ([]*model.Discussion, error)
+	Create(folderId uint, title string, header string, userId uint, locked bool) (*model.Discussion, error)
+	Edit(folderId uint, discussionId uint, title string, header string, userId uint, locked bool) (*model.Discussion, error)
+	SetStatus(discussionId uint, status int) (*model.Discussion, error)
+	Lock(discussionId uint, locked bool) (*model.Discussion, error)
+	Premoderate(discussionId uint, premoderate bool) (*model.Discussion, error)
+	Move(discussionId uint, folderId uint) (*model.Discussion, error)
+	Erase(discussionId uint) error
+
+	GetFolderDiscussions(folderId uint, userId uint, pageStart int, pageSize int) ([]*model.FrontPageEntry, error)
+	GetFolderDiscussionsBefore(folderId uint, userId uint, beforeDate time.Time, pageSize int) ([]*model.FrontPageEntry, error)
+	GetFrontPage(view FrontPageView, userId uint, isAdmin bool, pageStart int, pageSize int) ([]*model.FrontPageEntry, error)
+	GetFrontPageSince(view FrontPageView, userId uint, isAdmin bool, sinceDate time.Time, pageSize int) ([]*model.FrontPageEntry, error)
+	GetFrontPageBefore(view FrontPageView, userId uint, isAdmin bool, beforeDate time.Time, pageSize int) ([]*model.FrontPageEntry, error)
+	GetFrontPageEntry(discussionId uint) (*model.FrontPageEntry, error)
+	CalculateMostActive() error
+
+	GetBlockedUsers(discussionId uint) ([]*model.BlockedDiscussionUser, error)
+	SetUserBlocked(discussionId uint, userId uint, blocked bool) ([]*model.BlockedDiscussionUser, error)
+	GetUserDiscussionBlocks() ([]*model.DiscussionBlock, error)
+}
+
+// PostTextSearch finds posts in a discussion by their text without the
+// search engine. A post matches when its text contains every Include string
+// and none of the Exclude strings, ignoring case. Only posts anyone may see
+// are returned, newest first, starting after BeforePostId when it is set.
+type PostTextSearch struct {
+	DiscussionId   uint
+	Include        []string
+	Exclude        []string
+	ExcludeUserIds []uint
+	BeforePostId   uint
+	Limit          int
+}
+
+type PostRepository interface {
+	Get(postId uint) (*model.Post, error)
+	GetByIds(postIds []uint) ([]*model.Post, error)
+	GetPosts(userId uint, folderId uint, discussionId uint, pageStart int64, pageSize int) ([]*model.Post, error)
+	Create(folderId uint, discussionId uint, text string, status int, userId uint) (*model.Post, error)
+	Edit(folderId uint, discussionId uint, postId uint, text string, userId uint) (*model.Post, error)
+	Delete(folderId uint, discussionId uint, postId uint, userId uint) (*model.Post, error)
+	SetStatus(discussionId uint, postId uint, status int, moderationResult int) (*model.Post, error)
+	GetSubscribers(postId uint) ([]uint, error)
+	GetIndexableAfter(afterPostId uint, limit int) ([]*model.IndexablePost, error)
+	ForEachIndexableIn(folderId uint, discussionId uint, fn func(post *model.IndexablePost) error) error
+	// SearchText returns a page of posts matching search and how many match
+	// in all
+	SearchText(search PostTextSearch) ([]*model.Post, int, error)
+	// GetRecent returns the latest posts which haven't been deleted, newest
+	// first
+	GetRecent(limit int) ([]*model.Post, error)
+	// GetCreatedBetween pages through the visible posts made in [from, to)
+	// in id order
+	GetCreatedBetween(afterPostId uint, from time.Time, to time.Time, limit int) ([]*model.IndexablePost, error)
+}
+
+type UserRepository interface {
+	Get(userId uint) (*model.User, error)
+	FindByCredentials(username string, passwordHash string) (*model.User, error)
+	FindByEmail(email string) (*model.User, error)
+	CountByUsernameOrEmail(username string, email string) (int64, error)
+	Create(email string, username string, passwordHash string) (*model.User, error)
+	UpdatePassword(userId uint, passwordHash string) (*model.User, error)
+	UpdateLastLogin(userId uint, loginDate time.Time) error
+	UpdateAutoSubscribe(userId uint, state int) (*model.User, error)
+	UpdateSortFoldersByActivity(userId uint, state int) (*model.User, error)
+	UpdateSubscriptionFetchOrder(userId uint, fetchOrder int) (*model.User, error)
+	UpdateBio(userId uint, bio string) (*model.User, error)
+	UpdateViewType(userId uint, viewType string) (*model.User, error)
+	SetFlag(userId uint, flag UserFlag, value bool) error
+
+	GetIgnoredUsers(userId uint) ([]*model.IgnoredUser, error)
+	SetIgnored(userId uint, ignoredUserId uint, ignored bool) ([]*model.IgnoredUser, error)
+
+	Search(searchTerm string) ([]*model.UserSearchResults, error)
+	Filter(filter UserFilter) ([]*model.UserSearchResults, error)
+
+	CreateLoginHistory(history *model.LoginHistory) error
+	CreateHistory(history *model.UserHistory) error
+	GetHistory(userId uint) ([]*model.UserHistory, error)
+	// GetModNotes returns the moderators' notes about the user, newest first
+	GetModNotes(userId uint) ([]*model.UserModNote, error)
+	GetModNote(noteId uint) (*model.UserModNote, error)
+	CreateModNote(userId uint, moderatorId uint, note string) (*model.UserModNote, error)
+	UpdateModNote(noteId uint, note string) (*model.UserModNote, error)
+	DeleteModNote(noteId uint) error
+	CreateSearchHistory(history *model.SearchHistory) error
+	GetSearchHistory(userId uint, pageStart int, pageSize int) ([]*model.SearchHistory, error)
+	DeleteSearchHistory(userId uint) error
+	GetTopSearches(from time.Time, to time.Time, zeroResultsOnly bool, limit int) ([]*model.SearchQueryCount, error)
+	GetSearchesPerDay(from time.Time, to time.Time) ([]*model.SearchDayCount, error)
+	GetTopSearchers(from time.Time, to time.Time, limit int) ([]*model.SearchUserCount, error)
+
+	CreateSignupConfirmation(userId uint, confirmationKey string) (*model.SignupConfirmation, error)
+	FindSignupConfirmation(confirmationKey string) (*model.SignupConfirmation, error)
+	AcceptSignupConfirmation(confirmationId uint, ipAddress string) (*model.User, error)
+	CreatePasswordResetRequest(userId uint, ipAddress string, resetKey string) (*model.PasswordResetRequest, error)
+	FindPasswordResetRequest(resetKey string) (*model.PasswordResetRequest, error)
+	DeletePasswordResetRequest(requestId uint) error
+}
+
+type SubscriptionRepository interface {
+	IsSubscribedToDiscussion(userId uint, discussionId uint) (bool, error)
+	IsSubscribedToFolder(userId uint, folderId uint) (bool, error)
+	SetDiscussionSubscription(userId uint, discussionId uint, subscribed bool) error
+	SetFolderSubscription(userId uint, folderId uint, subscribed bool) error
+	DeleteDiscussionSubscription(userId uint, discussionId uint) error
+	DeleteFolderSubscription(userId uint, folderId uint) error
+	MarkDiscussionRead(userId uint, discussionId uint) error
+	MarkFolderSubscriptionRead(userId uint, subscriptionId uint) error
+	GetDiscussionSubscriptions(userId uint) ([]*model.FrontPageEntry, error)
+	GetFolderSubscriptions(userId uint) ([]*model.UserFolderSubscription, error)
+	GetFolderSubscriptionExceptions(userId uint) ([]*model.UserFolderSubscriptionException, error)
+
+	GetBookmark(userId uint, discussionId uint) (*model.UserDiscussionBookmark, error)
+	UpdateBookmark(userId uint, discussionId uint, postId uint, postNum int64, postDate time.Time) (*model.UserDiscussionBookmark, error)
+	DeleteBookmark(userId uint, discussionId uint) error
+}
+
+type ModerationRepository interface {
+	GetQueue() ([]*model.Post, error)
+	GetModeratedPosts(pageStart int, pageSize int) ([]*model.Post, error)
+	GetQueueEntries() ([]*model.ModerationQueueEntry, error)
+	DeleteQueueEntry(entryId uint) error
+	PurgeQueue(olderThan time.Time) error
+
+	CreateReport(report *model.PostReport) error
+	GetReportsByPost(postId uint) ([]*model.PostReport, error)
+	GetReportsByDiscussion(discussionId uint) ([]*model.PostReport, error)
+	CreateComment(postId uint, userId uint, body string, vote int) ([]*model.ModeratorComment, error)
+	GetCommentsByPost(postId uint) ([]*model.ModeratorComment, error)
+	GetCommentsByDiscussion(discussionId uint) ([]*model.ModeratorComment, error)
+
+	GetBannedWords() ([]*model.BannedWord, error)
+	GetBannedWord(wordId uint) (*model.BannedWord, error)
+	// CreateBannedWord and UpdateBannedWord replace the word's folders with
+	// folderIds
+	CreateBannedWord(pattern string, action string, folderIds []uint) (*model.BannedWord, error)
+	UpdateBannedWord(wordId uint, pattern string, action string, folderIds []uint) (*model.BannedWord, error)
+	DeleteBannedWord(wordId uint) error
+	RecordBannedWordMatches(postId uint, wordIds []uint) error
+	// GetBannedWordMatches returns the ids of the banned words each of the
+	// posts matched, keyed by post id
+	GetBannedWordMatches(postIds []uint) (map[uint][]uint, error)
+	// QueueForReview adds a post to the moderation queue unless it is there
+	// already, and reports whether it was added
+	QueueForReview(postId uint, reason string) (bool, error)
+}
+
+// OutboxRepository gives the relay access to the post outbox. Entries are
+// written by the post stored procedures in the same transaction as the post
+// itself; Claim leases due entries so that concurrent relays do not collide.
+type OutboxRepository interface {
+	Claim(batchSize int, lease time.Duration) ([]*model.OutboxEntry, error)
+	Complete(entryId uint) error
+	Fail(entryId uint, lastError string, nextAttemptDate time.Time, deadLetter bool) error
+	GetDeadLettered(pageStart int, pageSize int) ([]*model.OutboxEntry, error)
+	Replay(entryId uint) (*model.OutboxEntry, error)
+}
+
+// SearchIndexJobRepository tracks background search index jobs. Create folds
+// a new job into one that is already pending for the same target, and
+// ClaimNext will pick up a running job again once it has gone stale.
+type SearchIndexJobRepository interface {
+	Create(scope string, targetId uint, reason string) (*model.SearchIndexJob, error)
+	ClaimNext(staleAfter time.Duration) (*model.SearchIndexJob, error)
+	UpdateProgress(jobId uint, processed int, failed int) error
+	Finish(jobId uint, status string, action string, processed int, failed int, lastError string) error
+	GetRecent(pageStart int, pageSize int) ([]*model.SearchIndexJob, error)
+	Retry(jobId uint) (*model.SearchIndexJob, error)
+}
+
+// ContentScanJobRepository tracks scans of old posts against the current
+// banned words. ClaimNext picks up a running job again once it has gone
+// stale, and the job carries on from its LastPostId.
+type ContentScanJobRepository interface {
+	Create(userId uint, from time.Time, to time.Time) (*model.ContentScanJob, error)
+	Get(jobId uint) (*model.ContentScanJob, error)
+	ClaimNext(staleAfter time.Duration) (*model.ContentScanJob, error)
+	UpdateProgress(jobId uint, lastPostId uint, scanned int, matched int) error
+	Finish(jobId uint, status string, lastError string) error
+	GetRecent(pageStart int, pageSize int) ([]*model.ContentScanJob, error)
+}
+
+// SavedSearchRepository stores the searches users have saved. Update and
+// Delete only touch a search owned by the given user and return ErrNotFound
+// for anyone else's.
+type SavedSearchRepository interface {
+	Get(savedSearchId uint) (*model.SavedSearch, error)
+	GetForUser(userId uint) ([]*model.SavedSearch, error)
+	GetAlerting() ([]*model.SavedSearch, error)
+	Create(savedSearch *model.SavedSearch) (*model.SavedSearch, error)
+	Update(savedSearch *model.SavedSearch) (*model.SavedSearch, error)
+	Delete(userId uint, savedSearchId uint) error
+}
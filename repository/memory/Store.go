@@ -0,0 +1,345 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"sync"
+	"time"
+)
+
+type pairKey struct {
+	userId  uint
+	otherId uint
+}
+
+type dataset struct {
+	folders        map[uint]model.Folder
+	discussions    map[uint]model.Discussion
+	posts          map[uint]model.Post
+	users          map[uint]model.User
+	roles          map[uint][]string
+	ignored        map[uint]model.IgnoredUser
+	blocked        map[uint]model.BlockedDiscussionUser
+	discussionSubs map[pairKey]model.UserDiscussionSubscription
+	folderSubs     map[uint]model.UserFolderSubscription
+	exceptions     map[uint]model.UserFolderSubscriptionException
+	bookmarks      map[pairKey]model.UserDiscussionBookmark
+	frontPage      map[uint]model.FrontPageEntry
+	activity       map[uint]int64
+	loginHistory   []model.LoginHistory
+	history        []model.UserHistory
+	modNotes       map[uint]model.UserModNote
+	searchHistory  []model.SearchHistory
+	signups        map[uint]model.SignupConfirmation
+	resets         map[uint]model.PasswordResetRequest
+	reports        map[uint]model.PostReport
+	comments       map[uint]model.ModeratorComment
+	queue          map[uint]model.ModerationQueueEntry
+	bannedWords    map[uint]model.BannedWord
+	wordMatches    map[uint][]uint
+	outbox         map[uint]model.OutboxEntry
+	indexJobs      map[uint]model.SearchIndexJob
+	scanJobs       map[uint]model.ContentScanJob
+	savedSearches  map[uint]model.SavedSearch
+	lastId         uint
+}
+
+// Store is an in-memory implementation of repository.Repository which
+// mimics the behaviour of the stored procedures closely enough to exercise
+// the business logic without a database.
+type Store struct {
+	mu   sync.RWMutex
+	txMu sync.Mutex
+	data *dataset
+}
+
+func NewStore() *Store {
+	return &Store{
+		data: newDataset(),
+	}
+}
+
+func newDataset() *dataset {
+	return &dataset{
+		folders:        make(map[uint]model.Folder),
+		discussions:    make(map[uint]model.Discussion),
+		posts:          make(map[uint]model.Post),
+		users:          make(map[uint]model.User),
+		roles:          make(map[uint][]string),
+		ignored:        make(map[uint]model.IgnoredUser),
+		blocked:        make(map[uint]model.BlockedDiscussionUser),
+		discussionSubs: make(map[pairKey]model.UserDiscussionSubscription),
+		folderSubs:     make(map[uint]model.UserFolderSubscription),
+		exceptions:     make(map[uint]model.UserFolderSubscriptionException),
+		bookmarks:      make(map[pairKey]model.UserDiscussionBookmark),
+		frontPage:      make(map[uint]model.FrontPageEntry),
+		activity:       make(map[uint]int64),
+		signups:        make(map[uint]model.SignupConfirmation),
+		resets:         make(map[uint]model.PasswordResetRequest),
+		reports:        make(map[uint]model.PostReport),
+		comments:       make(map[uint]model.ModeratorComment),
+		modNotes:       make(map[uint]model.UserModNote),
+		queue:          make(map[uint]model.ModerationQueueEntry),
+		bannedWords:    make(map[uint]model.BannedWord),
+		wordMatches:    make(map[uint][]uint),
+		outbox:         make(map[uint]model.OutboxEntry),
+		indexJobs:      make(map[uint]model.SearchIndexJob),
+		scanJobs:       make(map[uint]model.ContentScanJob),
+		savedSearches:  make(map[uint]model.SavedSearch),
+	}
+}
+
+func (d *dataset) clone() *dataset {
+
+	c := newDataset()
+
+	for k, v := range d.folders {
+		c.folders[k] = v
+	}
+	for k, v := range d.discussions {
+		c.discussions[k] = v
+	}
+	for k, v := range d.posts {
+		c.posts[k] = v
+	}
+	for k, v := range d.users {
+		c.users[k] = v
+	}
+	for k, v := range d.roles {
+		c.roles[k] = append([]string{}, v...)
+	}
+	for k, v := range d.ignored {
+		c.ignored[k] = v
+	}
+	for k, v := range d.blocked {
+		c.blocked[k] = v
+	}
+	for k, v := range d.discussionSubs {
+		c.discussionSubs[k] = v
+	}
+	for k, v := range d.folderSubs {
+		c.folderSubs[k] = v
+	}
+	for k, v := range d.exceptions {
+		c.exceptions[k] = v
+	}
+	for k, v := range d.bookmarks {
+		c.bookmarks[k] = v
+	}
+	for k, v := range d.frontPage {
+		c.frontPage[k] = v
+	}
+	for k, v := range d.activity {
+		c.activity[k] = v
+	}
+	for k, v := range d.signups {
+		c.signups[k] = v
+	}
+	for k, v := range d.resets {
+		c.resets[k] = v
+	}
+	for k, v := range d.reports {
+		c.reports[k] = v
+	}
+	for k, v := range d.comments {
+		c.comments[k] = v
+	}
+	for k, v := range d.modNotes {
+		c.modNotes[k] = v
+	}
+	for k, v := range d.queue {
+		c.queue[k] = v
+	}
+	for k, v := range d.bannedWords {
+		c.bannedWords[k] = v
+	}
+	for k, v := range d.wordMatches {
+		c.wordMatches[k] = append([]uint{}, v...)
+	}
+	for k, v := range d.outbox {
+		c.outbox[k] = v
+	}
+	for k, v := range d.indexJobs {
+		c.indexJobs[k] = v
+	}
+	for k, v := range d.scanJobs {
+		c.scanJobs[k] = v
+	}
+	for k, v := range d.savedSearches {
+		c.savedSearches[k] = v
+	}
+
+	c.loginHistory = append(c.loginHistory, d.loginHistory...)
+	c.history = append(c.history, d.history...)
+	c.searchHistory = append(c.searchHistory, d.searchHistory...)
+	c.lastId = d.lastId
+
+	return c
+
+}
+
+func (d *dataset) nextId() uint {
+	d.lastId++
+	return d.lastId
+}
+
+func (s *Store) read(fn func(d *dataset)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fn(s.data)
+}
+
+func (s *Store) write(fn func(d *dataset)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.data)
+}
+
+func (s *Store) WithRepository(timeout time.Duration, fn func(repo repository.Repository)) {
+	fn(s)
+}
+
+func (s *Store) Folders() repository.FolderRepository {
+	return &folderRepository{s}
+}
+
+func (s *Store) Discussions() repository.DiscussionRepository {
+	return &discussionRepository{s}
+}
+
+func (s *Store) Posts() repository.PostRepository {
+	return &postRepository{s}
+}
+
+func (s *Store) Users() repository.UserRepository {
+	return &userRepository{s}
+}
+
+func (s *Store) Subscriptions() repository.SubscriptionRepository {
+	return &subscriptionRepository{s}
+}
+
+func (s *Store) Moderation() repository.ModerationRepository {
+	return &moderationRepository{s}
+}
+
+func (s *Store) Outbox() repository.OutboxRepository {
+	return &outboxRepository{s}
+}
+
+func (s *Store) SearchIndexJobs() repository.SearchIndexJobRepository {
+	return &searchIndexJobRepository{s}
+}
+
+func (s *Store) ContentScanJobs() repository.ContentScanJobRepository {
+	return &contentScanJobRepository{s}
+}
+
+func (s *Store) SavedSearches() repository.SavedSearchRepository {
+	return &savedSearchRepository{s}
+}
+
+// Transaction runs fn against the store and restores the previous state if
+// fn returns an error. Transactions are serialised but are not isolated from
+// callers working outside of a transaction.
+func (s *Store) Transaction(fn func(tx repository.Repository) error) error {
+
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	var snapshot *dataset
+	s.read(func(d *dataset) {
+		snapshot = d.clone()
+	})
+
+	if err := fn(s); err != nil {
+		s.write(func(d *dataset) {
+			s.data = snapshot
+		})
+		return err
+	}
+
+	return nil
+
+}
+
+func (s *Store) AddFolder(folder *model.Folder) *model.Folder {
+
+	added := *folder
+	s.write(func(d *dataset) {
+		if added.Id == 0 {
+			added.Id = d.nextId()
+		} else if added.Id > d.lastId {
+			d.lastId = added.Id
+		}
+		if added.CreatedDate.IsZero() {
+			added.CreatedDate = time.Now().UTC()
+		}
+		added.LastUpdatedDate = added.CreatedDate
+		d.folders[added.Id] = added
+	})
+
+	return &added
+
+}
+
+func (s *Store) AddUser(user *model.User) *model.User {
+
+	added := *user
+	added.IgnoredUsers = nil
+	s.write(func(d *dataset) {
+		if added.Id == 0 {
+			added.Id = d.nextId()
+		} else if added.Id > d.lastId {
+			d.lastId = added.Id
+		}
+		if added.CreatedDate.IsZero() {
+			added.CreatedDate = time.Now().UTC()
+		}
+		added.LastUpdatedDate = added.CreatedDate
+		d.users[added.Id] = added
+	})
+
+	return &added
+
+}
+
+// AddUserRoles grants the user roles by their authority, e.g. ROLE_ADMIN
+func (s *Store) AddUserRoles(userId uint, authorities ...string) {
+	s.write(func(d *dataset) {
+		d.roles[userId] = append(d.roles[userId], authorities...)
+	})
+}
+
+func (s *Store) AddBannedWord(pattern string) *model.BannedWord {
+
+	var added model.BannedWord
+	s.write(func(d *dataset) {
+		added = model.BannedWord{
+			Id:        d.nextId(),
+			Version:   1,
+			Pattern:   pattern,
+			Action:    model.BannedWordActionHold,
+			FolderIds: make([]uint, 0),
+		}
+		d.bannedWords[added.Id] = added
+	})
+
+	return &added
+
+}
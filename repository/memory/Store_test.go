@@ -0,0 +1,69 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"errors"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func seed() (*Store, *model.Folder, *model.User) {
+
+	store := NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+
+	return store, folder, user
+
+}
+
+func TestTransactionRollsBackOnError(t *testing.T) {
+
+	store, folder, user := seed()
+	failure := errors.New("failure")
+
+	err := store.Transaction(func(tx repository.Repository) error {
+		if _, err := tx.Discussions().Create(folder.Id, "Rolled back", "", user.Id, false); err != nil {
+			return err
+		}
+		return failure
+	})
+	assert.Equal(t, failure, err)
+
+	_, err = store.Discussions().FindByTitle(folder.Id, "Rolled back")
+	assert.Equal(t, repository.ErrNotFound, err)
+
+}
+
+func TestTransactionCommits(t *testing.T) {
+
+	store, folder, user := seed()
+
+	err := store.Transaction(func(tx repository.Repository) error {
+		_, err := tx.Discussions().Create(folder.Id, "Committed", "", user.Id, false)
+		return err
+	})
+	assert.Nil(t, err)
+
+	discussion, err := store.Discussions().FindByTitle(folder.Id, "Committed")
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", discussion.CreatedByUsername)
+
+}
@@ -0,0 +1,172 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"sort"
+	"time"
+)
+
+type contentScanJobRepository struct {
+	store *Store
+}
+
+func (r *contentScanJobRepository) Create(userId uint, from time.Time, to time.Time) (*model.ContentScanJob, error) {
+
+	var created model.ContentScanJob
+	r.store.write(func(d *dataset) {
+		now := time.Now().UTC()
+		created = model.ContentScanJob{
+			Id:              d.nextId(),
+			CreatedDate:     now,
+			LastUpdate:      now,
+			CreatedByUserId: userId,
+			FromDate:        from,
+			ToDate:          to,
+			Status:          model.ContentScanJobStatusPending,
+		}
+		d.scanJobs[created.Id] = created
+	})
+
+	return &created, nil
+
+}
+
+func (r *contentScanJobRepository) Get(jobId uint) (*model.ContentScanJob, error) {
+
+	var job *model.ContentScanJob
+	r.store.read(func(d *dataset) {
+		if j, exists := d.scanJobs[jobId]; exists {
+			job = &j
+		}
+	})
+
+	if job == nil {
+		return nil, repository.ErrNotFound
+	}
+
+	return job, nil
+
+}
+
+func (r *contentScanJobRepository) ClaimNext(staleAfter time.Duration) (*model.ContentScanJob, error) {
+
+	var claimed *model.ContentScanJob
+	r.store.write(func(d *dataset) {
+
+		now := time.Now().UTC()
+		for _, job := range d.scanJobs {
+			isStale := job.Status == model.ContentScanJobStatusRunning && job.LastUpdate.Before(now.Add(-staleAfter))
+			if job.Status != model.ContentScanJobStatusPending && !isStale {
+				continue
+			}
+			if claimed == nil || job.Id < claimed.Id {
+				candidate := job
+				claimed = &candidate
+			}
+		}
+
+		if claimed == nil {
+			return
+		}
+
+		// a stale job carries on from the last post it reached
+		claimed.Status = model.ContentScanJobStatusRunning
+		if claimed.StartedDate == nil {
+			claimed.StartedDate = &now
+		}
+		claimed.LastUpdate = now
+		d.scanJobs[claimed.Id] = *claimed
+
+	})
+
+	if claimed == nil {
+		return nil, repository.ErrNotFound
+	}
+
+	return claimed, nil
+
+}
+
+func (r *contentScanJobRepository) UpdateProgress(jobId uint, lastPostId uint, scanned int, matched int) error {
+
+	r.store.write(func(d *dataset) {
+		if job, exists := d.scanJobs[jobId]; exists {
+			job.LastPostId = lastPostId
+			job.Scanned = scanned
+			job.Matched = matched
+			job.LastUpdate = time.Now().UTC()
+			d.scanJobs[jobId] = job
+		}
+	})
+
+	return nil
+
+}
+
+func (r *contentScanJobRepository) Finish(jobId uint, status string, lastError string) error {
+
+	r.store.write(func(d *dataset) {
+
+		job, exists := d.scanJobs[jobId]
+		if !exists {
+			return
+		}
+
+		now := time.Now().UTC()
+		job.Status = status
+		job.LastError = nil
+		if len(lastError) > 0 {
+			job.LastError = &lastError
+		}
+		job.LastUpdate = now
+		job.CompletedDate = &now
+		d.scanJobs[jobId] = job
+
+	})
+
+	return nil
+
+}
+
+func (r *contentScanJobRepository) GetRecent(pageStart int, pageSize int) ([]*model.ContentScanJob, error) {
+
+	jobs := make([]*model.ContentScanJob, 0)
+	r.store.read(func(d *dataset) {
+		for _, job := range d.scanJobs {
+			recent := job
+			jobs = append(jobs, &recent)
+		}
+	})
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Id > jobs[j].Id
+	})
+
+	if pageStart >= len(jobs) {
+		return make([]*model.ContentScanJob, 0), nil
+	}
+
+	end := pageStart + pageSize
+	if end > len(jobs) {
+		end = len(jobs)
+	}
+
+	return jobs[pageStart:end], nil
+
+}
@@ -0,0 +1,88 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaleContentScanJobsResumeFromTheLastPost(t *testing.T) {
+
+	store := NewStore()
+	now := time.Now().UTC()
+	created, _ := store.ContentScanJobs().Create(50, now.Add(-time.Hour), now)
+
+	claimed, err := store.ContentScanJobs().ClaimNext(time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, created.Id, claimed.Id)
+	assert.Equal(t, model.ContentScanJobStatusRunning, claimed.Status)
+
+	require.NoError(t, store.ContentScanJobs().UpdateProgress(created.Id, 120, 500, 3))
+
+	_, err = store.ContentScanJobs().ClaimNext(time.Minute)
+	assert.Equal(t, repository.ErrNotFound, err)
+
+	reclaimed, err := store.ContentScanJobs().ClaimNext(-time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, uint(120), reclaimed.LastPostId)
+	assert.Equal(t, 500, reclaimed.Scanned)
+	assert.Equal(t, 3, reclaimed.Matched)
+
+	require.NoError(t, store.ContentScanJobs().Finish(created.Id, model.ContentScanJobStatusComplete, ""))
+	job, err := store.ContentScanJobs().Get(created.Id)
+	require.NoError(t, err)
+	assert.Equal(t, model.ContentScanJobStatusComplete, job.Status)
+	assert.NotNil(t, job.CompletedDate)
+	assert.Nil(t, job.LastError)
+
+}
+
+func TestPostsAreQueuedForReviewOnce(t *testing.T) {
+
+	store := NewStore()
+	folder := store.AddFolder(&model.Folder{Key: "general", Description: "General", Type: model.FolderTypeNormal})
+	user := store.AddUser(&model.User{Username: "alice", Email: "alice@example.com", Enabled: true})
+	discussion, _ := store.Discussions().Create(folder.Id, "Scanned", "", user.Id, false)
+	post, _ := store.Posts().Create(folder.Id, discussion.Id, "some text", model.PostStatusOK, user.Id)
+
+	now := time.Now().UTC()
+	posts, err := store.Posts().GetCreatedBetween(0, now.Add(-time.Hour), now.Add(time.Hour), 10)
+	require.NoError(t, err)
+	assert.Len(t, posts, 1)
+	posts, _ = store.Posts().GetCreatedBetween(post.Id, now.Add(-time.Hour), now.Add(time.Hour), 10)
+	assert.Len(t, posts, 0)
+	posts, _ = store.Posts().GetCreatedBetween(0, now.Add(-2*time.Hour), now.Add(-time.Hour), 10)
+	assert.Len(t, posts, 0)
+
+	queued, err := store.Moderation().QueueForReview(post.Id, "matched")
+	require.NoError(t, err)
+	assert.True(t, queued)
+
+	queued, _ = store.Moderation().QueueForReview(post.Id, "matched again")
+	assert.False(t, queued)
+
+	queue, _ := store.Moderation().GetQueue()
+	if assert.Len(t, queue, 1) && assert.NotNil(t, queue[0].ModerationReason) {
+		assert.Equal(t, "matched", *queue[0].ModerationReason)
+	}
+
+}
@@ -0,0 +1,639 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"fmt"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"sort"
+	"time"
+)
+
+type discussionRepository struct {
+	store *Store
+}
+
+func (d *dataset) getDiscussion(discussionId uint) (*model.Discussion, error) {
+
+	discussion, exists := d.discussions[discussionId]
+	if !exists {
+		return nil, repository.ErrNotFound
+	}
+
+	discussion.CreatedByUsername = d.users[discussion.CreatedByUserId].Username
+
+	return &discussion, nil
+
+}
+
+func (d *dataset) updateDiscussion(discussionId uint, fn func(discussion *model.Discussion)) (*model.Discussion, error) {
+
+	discussion, exists := d.discussions[discussionId]
+	if !exists {
+		return nil, repository.ErrNotFound
+	}
+
+	fn(&discussion)
+	discussion.Version++
+	d.discussions[discussionId] = discussion
+
+	return d.getDiscussion(discussionId)
+
+}
+
+func (d *dataset) frontPageEntry(entry model.FrontPageEntry, userId uint) *model.FrontPageEntry {
+
+	if bookmark, exists := d.bookmarks[pairKey{userId, entry.DiscussionId}]; exists {
+		entry.LastPostReadCount = bookmark.LastPostCount
+		entry.LastPostReadDate = bookmark.LastPostDate
+		entry.LastPostReadId = bookmark.LastPostId
+	}
+
+	return &entry
+
+}
+
+func (d *dataset) unreadCount(entry *model.FrontPageEntry) int64 {
+	return entry.PostCount - entry.LastPostReadCount
+}
+
+func (r *discussionRepository) Get(discussionId uint) (*model.Discussion, error) {
+
+	var discussion *model.Discussion
+	var err error
+	r.store.read(func(d *dataset) {
+		discussion, err = d.getDiscussion(discussionId)
+	})
+
+	return discussion, err
+
+}
+
+func (r *discussionRepository) FindByTitle(folderId uint, title string) (*model.Discussion, error) {
+
+	var discussion *model.Discussion
+	err := repository.ErrNotFound
+	r.store.read(func(d *dataset) {
+		for _, candidate := range d.discussions {
+			if candidate.FolderId == folderId && candidate.Title == title {
+				discussion, err = d.getDiscussion(candidate.Id)
+				return
+			}
+		}
+	})
+
+	return discussion, err
+
+}
+
+func (r *discussionRepository) GetRecent(folderId uint, since time.Time, limit int) ([]*model.Discussion, error) {
+
+	discussions := make([]*model.Discussion, 0)
+	r.store.read(func(d *dataset) {
+
+		for _, candidate := range d.discussions {
+			if candidate.FolderId == folderId && !candidate.CreatedDate.Before(since) && candidate.Status == model.DiscussionStatusOk && !candidate.IsDeleted {
+				discussion, _ := d.getDiscussion(candidate.Id)
+				discussions = append(discussions, discussion)
+			}
+		}
+
+		sort.Slice(discussions, func(i, j int) bool {
+			if discussions[i].CreatedDate.Equal(discussions[j].CreatedDate) {
+				return discussions[i].Id > discussions[j].Id
+			}
+			return discussions[i].CreatedDate.After(discussions[j].CreatedDate)
+		})
+
+		if len(discussions) > limit {
+			discussions = discussions[:limit]
+		}
+
+	})
+
+	return discussions, nil
+
+}
+
+func (r *discussionRepository) Create(folderId uint, title string, header string, userId uint, locked bool) (*model.Discussion, error) {
+
+	var discussion *model.Discussion
+	var err error
+	r.store.write(func(d *dataset) {
+
+		folder, exists := d.folders[folderId]
+		if !exists {
+			err = repository.ErrNotFound
+			return
+		}
+
+		now := time.Now().UTC()
+		created := model.Discussion{
+			ModelBase: model.ModelBase{
+				Id:              d.nextId(),
+				Version:         1,
+				CreatedDate:     now,
+				LastUpdatedDate: now,
+			},
+			FolderId:        folderId,
+			Title:           title,
+			Header:          header,
+			CreatedByUserId: userId,
+			IsLocked:        locked,
+			LastPostDate:    now,
+		}
+		d.discussions[created.Id] = created
+
+		if folder.Type == model.FolderTypeNormal || folder.Type == model.FolderTypeAdmin {
+			isAdmin := folder.Type == model.FolderTypeAdmin
+			d.frontPage[created.Id] = model.FrontPageEntry{
+				DiscussionId:    created.Id,
+				DiscussionTitle: created.Title,
+				FolderId:        folder.Id,
+				FolderKey:       folder.Key,
+				FolderTitle:     folder.Description,
+				LastPostDate:    created.CreatedDate,
+				IsAdmin:         &isAdmin,
+			}
+		}
+
+		discussion, err = d.getDiscussion(created.Id)
+
+	})
+
+	return discussion, err
+
+}
+
+func (r *discussionRepository) Edit(folderId uint, discussionId uint, title string, header string, userId uint, locked bool) (*model.Discussion, error) {
+
+	var discussion *model.Discussion
+	var err error
+	r.store.write(func(d *dataset) {
+
+		if existing, exists := d.discussions[discussionId]; exists && existing.FolderId == folderId {
+
+			status := 0
+			if locked {
+				status = 1
+			}
+
+			existing.Version++
+			existing.LastUpdatedDate = time.Now().UTC()
+			existing.Title = title
+			existing.Header = header
+			existing.Status = status
+			d.discussions[discussionId] = existing
+
+			if entry, exists := d.frontPage[discussionId]; exists {
+				entry.DiscussionTitle = title
+				d.frontPage[discussionId] = entry
+			}
+
+		}
+
+		discussion, err = d.getDiscussion(discussionId)
+
+	})
+
+	return discussion, err
+
+}
+
+func (r *discussionRepository) SetStatus(discussionId uint, status int) (*model.Discussion, error) {
+
+	var discussion *model.Discussion
+	var err error
+	r.store.write(func(d *dataset) {
+		discussion, err = d.updateDiscussion(discussionId, func(discussion *model.Discussion) {
+			discussion.Status = status
+			discussion.IsDeleted = status != model.DiscussionStatusOk
+		})
+		delete(d.frontPage, discussionId)
+	})
+
+	return discussion, err
+
+}
+
+func (r *discussionRepository) Lock(discussionId uint, locked bool) (*model.Discussion, error) {
+
+	var discussion *model.Discussion
+	var err error
+	r.store.write(func(d *dataset) {
+		discussion, err = d.updateDiscussion(discussionId, func(discussion *model.Discussion) {
+			discussion.IsLocked = locked
+		})
+	})
+
+	return discussion, err
+
+}
+
+func (r *discussionRepository) Premoderate(discussionId uint, premoderate bool) (*model.Discussion, error) {
+
+	var discussion *model.Discussion
+	var err error
+	r.store.write(func(d *dataset) {
+		discussion, err = d.updateDiscussion(discussionId, func(discussion *model.Discussion) {
+			discussion.IsPremoderate = premoderate
+		})
+	})
+
+	return discussion, err
+
+}
+
+func (r *discussionRepository) Move(discussionId uint, folderId uint) (*model.Discussion, error) {
+
+	var discussion *model.Discussion
+	var err error
+	r.store.write(func(d *dataset) {
+		discussion, err = d.updateDiscussion(discussionId, func(discussion *model.Discussion) {
+			discussion.FolderId = folderId
+		})
+	})
+
+	return discussion, err
+
+}
+
+func (r *discussionRepository) Erase(discussionId uint) error {
+
+	r.store.write(func(d *dataset) {
+		delete(d.discussions, discussionId)
+	})
+
+	return nil
+
+}
+
+func (r *discussionRepository) folderEntries(folderId uint, userId uint, filter func(entry *model.FrontPageEntry) bool) []*model.FrontPageEntry {
+
+	entries := make([]*model.FrontPageEntry, 0)
+	r.store.read(func(d *dataset) {
+		for _, entry := range d.frontPage {
+			if entry.FolderId != folderId {
+				continue
+			}
+			e := d.frontPageEntry(entry, userId)
+			if filter(e) {
+				entries = append(entries, e)
+			}
+		}
+		d.sortLatest(entries)
+	})
+
+	return entries
+
+}
+
+func (r *discussionRepository) GetFolderDiscussions(folderId uint, userId uint, pageStart int, pageSize int) ([]*model.FrontPageEntry, error) {
+
+	entries := r.folderEntries(folderId, userId, func(entry *model.FrontPageEntry) bool {
+		return true
+	})
+
+	return page(entries, pageStart, pageSize), nil
+
+}
+
+func (r *discussionRepository) GetFolderDiscussionsBefore(folderId uint, userId uint, beforeDate time.Time, pageSize int) ([]*model.FrontPageEntry, error) {
+
+	entries := r.folderEntries(folderId, userId, func(entry *model.FrontPageEntry) bool {
+		return entry.LastPostDate.Before(beforeDate)
+	})
+
+	return page(entries, 0, pageSize), nil
+
+}
+
+func (r *discussionRepository) frontPage(view repository.FrontPageView, userId uint, isAdmin bool, filter func(entry *model.FrontPageEntry) bool) ([]*model.FrontPageEntry, error) {
+
+	entries := make([]*model.FrontPageEntry, 0)
+	var err error
+	r.store.read(func(d *dataset) {
+
+		var include func(entry *model.FrontPageEntry) bool
+		switch view {
+		case repository.FrontPageViewLatest:
+			include = func(entry *model.FrontPageEntry) bool {
+				return true
+			}
+		case repository.FrontPageViewMostActive:
+			include = func(entry *model.FrontPageEntry) bool {
+				_, exists := d.activity[entry.DiscussionId]
+				return exists
+			}
+		case repository.FrontPageViewSubscriptions:
+			include = func(entry *model.FrontPageEntry) bool {
+				return d.inSubscriptionView(userId, entry)
+			}
+		case repository.FrontPageViewStartedByMe:
+			include = func(entry *model.FrontPageEntry) bool {
+				return d.discussions[entry.DiscussionId].CreatedByUserId == userId
+			}
+		default:
+			err = fmt.Errorf("unknown front page view: %s", view)
+			return
+		}
+
+		for _, entry := range d.frontPage {
+			if entry.IsAdmin != nil && *entry.IsAdmin && !isAdmin {
+				continue
+			}
+			e := d.frontPageEntry(entry, userId)
+			if include(e) && filter(e) {
+				entries = append(entries, e)
+			}
+		}
+
+		switch view {
+		case repository.FrontPageViewMostActive:
+			sort.SliceStable(entries, func(i, j int) bool {
+				zi, zj := d.discussions[entries[i].DiscussionId].ZOrder, d.discussions[entries[j].DiscussionId].ZOrder
+				if zi != zj {
+					return zi > zj
+				}
+				return d.activity[entries[i].DiscussionId] > d.activity[entries[j].DiscussionId]
+			})
+		case repository.FrontPageViewSubscriptions:
+			d.sortSubscriptions(entries, d.users[userId].SubscriptionFetchOrder)
+		default:
+			d.sortLatest(entries)
+		}
+
+	})
+
+	return entries, err
+
+}
+
+func (d *dataset) sortSubscriptions(entries []*model.FrontPageEntry, fetchOrder int) {
+
+	sort.SliceStable(entries, func(i, j int) bool {
+
+		ui, uj := d.unreadCount(entries[i]), d.unreadCount(entries[j])
+
+		if fetchOrder == 2 {
+			if ui != uj {
+				return ui > uj
+			}
+			return entries[i].LastPostDate.After(entries[j].LastPostDate)
+		}
+
+		if (ui > 0) != (uj > 0) {
+			return ui > 0
+		}
+
+		if fetchOrder == 0 {
+			return entries[i].LastPostDate.Before(entries[j].LastPostDate)
+		}
+
+		return entries[i].LastPostDate.After(entries[j].LastPostDate)
+
+	})
+
+}
+
+func (d *dataset) sortLatest(entries []*model.FrontPageEntry) {
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		zi, zj := d.discussions[entries[i].DiscussionId].ZOrder, d.discussions[entries[j].DiscussionId].ZOrder
+		if zi != zj {
+			return zi > zj
+		}
+		return entries[i].LastPostDate.After(entries[j].LastPostDate)
+	})
+
+}
+
+func page(entries []*model.FrontPageEntry, pageStart int, pageSize int) []*model.FrontPageEntry {
+
+	if pageStart >= len(entries) {
+		return make([]*model.FrontPageEntry, 0)
+	}
+
+	end := pageStart + pageSize
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	return entries[pageStart:end]
+
+}
+
+func (r *discussionRepository) GetFrontPage(view repository.FrontPageView, userId uint, isAdmin bool, pageStart int, pageSize int) ([]*model.FrontPageEntry, error) {
+
+	entries, err := r.frontPage(view, userId, isAdmin, func(entry *model.FrontPageEntry) bool {
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return page(entries, pageStart, pageSize), nil
+
+}
+
+func (r *discussionRepository) GetFrontPageSince(view repository.FrontPageView, userId uint, isAdmin bool, sinceDate time.Time, pageSize int) ([]*model.FrontPageEntry, error) {
+
+	entries, err := r.frontPage(view, userId, isAdmin, func(entry *model.FrontPageEntry) bool {
+		return entry.LastPostDate.After(sinceDate)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return page(entries, 0, pageSize), nil
+
+}
+
+func (r *discussionRepository) GetFrontPageBefore(view repository.FrontPageView, userId uint, isAdmin bool, beforeDate time.Time, pageSize int) ([]*model.FrontPageEntry, error) {
+
+	entries, err := r.frontPage(view, userId, isAdmin, func(entry *model.FrontPageEntry) bool {
+		return entry.LastPostDate.Before(beforeDate)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return page(entries, 0, pageSize), nil
+
+}
+
+func (r *discussionRepository) GetFrontPageEntry(discussionId uint) (*model.FrontPageEntry, error) {
+
+	var entry *model.FrontPageEntry
+	err := repository.ErrNotFound
+	r.store.read(func(d *dataset) {
+		if existing, exists := d.frontPage[discussionId]; exists {
+			entry = &existing
+			err = nil
+		}
+	})
+
+	return entry, err
+
+}
+
+func (r *discussionRepository) CalculateMostActive() error {
+
+	r.store.write(func(d *dataset) {
+
+		var latest time.Time
+		for _, post := range d.posts {
+			if post.CreatedDate.After(latest) {
+				latest = post.CreatedDate
+			}
+		}
+
+		activity := make(map[uint]int64)
+		folderActivity := make(map[uint]int64)
+		for _, post := range d.posts {
+
+			discussion, exists := d.discussions[post.DiscussionId]
+			if !exists || post.Status != model.PostStatusOK {
+				continue
+			}
+
+			var weight int64
+			age := latest.Sub(post.CreatedDate)
+			switch {
+			case age < time.Hour:
+				weight = 100000
+			case age < 6*time.Hour:
+				weight = 10000
+			case age < 24*time.Hour:
+				weight = 100
+			case age < 30*24*time.Hour:
+				weight = 1
+			}
+
+			if weight > 0 {
+				activity[discussion.Id] += weight
+				folderActivity[discussion.FolderId] += weight
+			}
+
+		}
+
+		d.activity = activity
+		for id, folder := range d.folders {
+			folder.Activity = int(folderActivity[id])
+			d.folders[id] = folder
+		}
+
+	})
+
+	return nil
+
+}
+
+func (d *dataset) blockedUsers(discussionId uint) []*model.BlockedDiscussionUser {
+
+	blockedUsers := make([]*model.BlockedDiscussionUser, 0)
+	for _, blocked := range d.blocked {
+		if blocked.DiscussionId == discussionId {
+			b := blocked
+			blockedUsers = append(blockedUsers, &b)
+		}
+	}
+
+	sort.Slice(blockedUsers, func(i, j int) bool {
+		return blockedUsers[i].Id < blockedUsers[j].Id
+	})
+
+	return blockedUsers
+
+}
+
+func (r *discussionRepository) GetBlockedUsers(discussionId uint) ([]*model.BlockedDiscussionUser, error) {
+
+	var blockedUsers []*model.BlockedDiscussionUser
+	r.store.read(func(d *dataset) {
+		blockedUsers = d.blockedUsers(discussionId)
+	})
+
+	return blockedUsers, nil
+
+}
+
+func (r *discussionRepository) SetUserBlocked(discussionId uint, userId uint, blocked bool) ([]*model.BlockedDiscussionUser, error) {
+
+	var blockedUsers []*model.BlockedDiscussionUser
+	r.store.write(func(d *dataset) {
+
+		for id, existing := range d.blocked {
+			if existing.DiscussionId == discussionId && existing.UserId == userId {
+				delete(d.blocked, id)
+			}
+		}
+
+		if blocked {
+			id := d.nextId()
+			d.blocked[id] = model.BlockedDiscussionUser{
+				ModelBase: model.ModelBase{
+					Id:      id,
+					Version: 1,
+				},
+				DiscussionId: discussionId,
+				UserId:       userId,
+				Status:       true,
+			}
+		}
+
+		blockedUsers = d.blockedUsers(discussionId)
+
+	})
+
+	return blockedUsers, nil
+
+}
+
+func (r *discussionRepository) GetUserDiscussionBlocks() ([]*model.DiscussionBlock, error) {
+
+	blocks := make([]*model.DiscussionBlock, 0)
+	r.store.read(func(d *dataset) {
+		for _, blocked := range d.blocked {
+
+			discussion, exists := d.discussions[blocked.DiscussionId]
+			if !exists {
+				continue
+			}
+
+			folder := d.folders[discussion.FolderId]
+			blocks = append(blocks, &model.DiscussionBlock{
+				Id:              blocked.Id,
+				DiscussionId:    discussion.Id,
+				DiscussionTitle: discussion.Title,
+				FolderId:        folder.Id,
+				FolderKey:       folder.Key,
+				FolderTitle:     folder.Description,
+				UserId:          blocked.UserId,
+				Username:        d.users[blocked.UserId].Username,
+			})
+
+		}
+	})
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Username < blocks[j].Username
+	})
+
+	return blocks, nil
+
+}
@@ -0,0 +1,140 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateDiscussionAddsFrontPageEntry(t *testing.T) {
+
+	store, folder, user := seed()
+
+	discussion, err := store.Discussions().Create(folder.Id, "Hello", "Header", user.Id, false)
+	assert.Nil(t, err)
+
+	entry, err := store.Discussions().GetFrontPageEntry(discussion.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello", entry.DiscussionTitle)
+	assert.Equal(t, folder.Key, entry.FolderKey)
+
+	discussions, err := store.Discussions().GetFolderDiscussions(folder.Id, user.Id, 0, 10)
+	assert.Nil(t, err)
+	assert.Len(t, discussions, 1)
+
+}
+
+func TestAdminFolderDiscussionsAreHiddenFromNonAdmins(t *testing.T) {
+
+	store, _, user := seed()
+	adminFolder := store.AddFolder(&model.Folder{Key: "admin", Description: "Admin", Type: model.FolderTypeAdmin})
+
+	_, err := store.Discussions().Create(adminFolder.Id, "Secret", "", user.Id, false)
+	assert.Nil(t, err)
+
+	entries, err := store.Discussions().GetFrontPage(repository.FrontPageViewLatest, user.Id, false, 0, 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 0)
+
+	entries, err = store.Discussions().GetFrontPage(repository.FrontPageViewLatest, user.Id, true, 0, 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+}
+
+func TestDeletedDiscussionIsRemovedFromFrontPage(t *testing.T) {
+
+	store, folder, user := seed()
+
+	discussion, _ := store.Discussions().Create(folder.Id, "Doomed", "", user.Id, false)
+
+	deleted, err := store.Discussions().SetStatus(discussion.Id, model.DiscussionStatusDeletedByAdmin)
+	assert.Nil(t, err)
+	assert.True(t, deleted.IsDeleted)
+
+	_, err = store.Discussions().GetFrontPageEntry(discussion.Id)
+	assert.Equal(t, repository.ErrNotFound, err)
+
+}
+
+func TestFrontPageIsOrderedByLastPost(t *testing.T) {
+
+	store, folder, user := seed()
+
+	first, _ := store.Discussions().Create(folder.Id, "First", "", user.Id, false)
+	second, _ := store.Discussions().Create(folder.Id, "Second", "", user.Id, false)
+	store.Posts().Create(folder.Id, first.Id, "bump", model.PostStatusOK, user.Id)
+
+	entries, err := store.Discussions().GetFrontPage(repository.FrontPageViewLatest, user.Id, false, 0, 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, first.Id, entries[0].DiscussionId)
+	assert.Equal(t, second.Id, entries[1].DiscussionId)
+
+}
+
+func TestUnknownFrontPageViewIsAnError(t *testing.T) {
+
+	store, _, user := seed()
+
+	_, err := store.Discussions().GetFrontPage(repository.FrontPageView("nonsense"), user.Id, false, 0, 10)
+	assert.NotNil(t, err)
+
+}
+
+func TestBlockingUsers(t *testing.T) {
+
+	store, folder, user := seed()
+	discussion, _ := store.Discussions().Create(folder.Id, "Blocking", "", user.Id, false)
+
+	blocked, err := store.Discussions().SetUserBlocked(discussion.Id, user.Id, true)
+	assert.Nil(t, err)
+	assert.Len(t, blocked, 1)
+
+	blocked, err = store.Discussions().SetUserBlocked(discussion.Id, user.Id, false)
+	assert.Nil(t, err)
+	assert.Len(t, blocked, 0)
+
+}
+
+func TestGetRecentSkipsOldAndDeletedDiscussions(t *testing.T) {
+
+	store, folder, user := seed()
+	other := store.AddFolder(&model.Folder{Key: "other", Description: "Other", Type: model.FolderTypeNormal})
+
+	first, _ := store.Discussions().Create(folder.Id, "First", "", user.Id, false)
+	deleted, _ := store.Discussions().Create(folder.Id, "Deleted", "", user.Id, false)
+	second, _ := store.Discussions().Create(folder.Id, "Second", "", user.Id, false)
+	store.Discussions().Create(other.Id, "Elsewhere", "", user.Id, false)
+	store.Discussions().SetStatus(deleted.Id, model.DiscussionStatusDeletedByUser)
+
+	discussions, err := store.Discussions().GetRecent(folder.Id, first.CreatedDate, 10)
+	assert.Nil(t, err)
+	if assert.Len(t, discussions, 2) {
+		assert.Equal(t, second.Id, discussions[0].Id)
+		assert.Equal(t, first.Id, discussions[1].Id)
+	}
+
+	discussions, err = store.Discussions().GetRecent(folder.Id, second.CreatedDate.Add(time.Second), 10)
+	assert.Nil(t, err)
+	assert.Empty(t, discussions)
+
+}
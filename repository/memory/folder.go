@@ -0,0 +1,203 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"sort"
+	"time"
+)
+
+type folderRepository struct {
+	store *Store
+}
+
+func (r *folderRepository) GetFolders() ([]*model.Folder, error) {
+
+	folders := make([]*model.Folder, 0)
+	r.store.read(func(d *dataset) {
+
+		counts := make(map[uint]uint)
+		for _, discussion := range d.discussions {
+			if discussion.Status == model.DiscussionStatusOk {
+				counts[discussion.FolderId]++
+			}
+		}
+
+		for _, folder := range d.folders {
+			if !isVisibleFolder(folder) {
+				continue
+			}
+			f := folder
+			f.DiscussionCount = counts[f.Id]
+			folders = append(folders, &f)
+		}
+
+	})
+
+	sort.Slice(folders, func(i, j int) bool {
+		if folders[i].SortOrder != folders[j].SortOrder {
+			return folders[i].SortOrder < folders[j].SortOrder
+		}
+		return folders[i].Id < folders[j].Id
+	})
+
+	return folders, nil
+
+}
+
+func isVisibleFolder(folder model.Folder) bool {
+	return folder.Type == model.FolderTypeNormal || folder.Type == model.FolderTypeAdmin
+}
+
+func (d *dataset) getFolder(folderId uint) (*model.Folder, error) {
+
+	folder, exists := d.folders[folderId]
+	if !exists || !isVisibleFolder(folder) {
+		return nil, repository.ErrNotFound
+	}
+
+	for _, discussion := range d.discussions {
+		if discussion.FolderId == folderId && discussion.Status == model.DiscussionStatusOk {
+			folder.DiscussionCount++
+		}
+	}
+
+	return &folder, nil
+
+}
+
+func (r *folderRepository) Get(folderId uint) (*model.Folder, error) {
+
+	var folder *model.Folder
+	var err error
+	r.store.read(func(d *dataset) {
+		folder, err = d.getFolder(folderId)
+	})
+
+	return folder, err
+
+}
+
+func (r *folderRepository) Create(key string, description string, folderType uint) (*model.Folder, error) {
+
+	var folder *model.Folder
+	var err error
+	r.store.write(func(d *dataset) {
+
+		sortOrder := 0
+		for _, f := range d.folders {
+			if f.SortOrder > sortOrder {
+				sortOrder = f.SortOrder
+			}
+		}
+
+		created := model.Folder{
+			Key:         key,
+			Description: description,
+			Type:        folderType,
+			SortOrder:   sortOrder + 1,
+		}
+		created.Id = d.nextId()
+		created.Version = 1
+		created.CreatedDate = time.Now().UTC()
+		created.LastUpdatedDate = created.CreatedDate
+		d.folders[created.Id] = created
+
+		folder, err = d.getFolder(created.Id)
+
+	})
+
+	return folder, err
+
+}
+
+func (r *folderRepository) Update(folderId uint, key string, description string, folderType uint, archived bool) (*model.Folder, error) {
+
+	var folder *model.Folder
+	var err error
+	r.store.write(func(d *dataset) {
+
+		existing, exists := d.folders[folderId]
+		if !exists || !isVisibleFolder(existing) {
+			err = repository.ErrNotFound
+			return
+		}
+
+		existing.Key = key
+		existing.Description = description
+		existing.Type = folderType
+		existing.IsArchived = archived
+		existing.Version++
+		existing.LastUpdatedDate = time.Now().UTC()
+		d.folders[folderId] = existing
+
+		folder, err = d.getFolder(folderId)
+
+	})
+
+	return folder, err
+
+}
+
+func (r *folderRepository) SetSortOrder(folderId uint, sortOrder int) error {
+
+	var err error
+	r.store.write(func(d *dataset) {
+
+		existing, exists := d.folders[folderId]
+		if !exists {
+			err = repository.ErrNotFound
+			return
+		}
+
+		existing.SortOrder = sortOrder
+		existing.Version++
+		d.folders[folderId] = existing
+
+	})
+
+	return err
+
+}
+
+func (r *folderRepository) CalculateActivity(since time.Time) error {
+
+	r.store.write(func(d *dataset) {
+
+		activity := make(map[uint]int)
+		for _, post := range d.posts {
+			if !post.CreatedDate.After(since) || (post.Status != model.PostStatusOK && post.Status != model.PostStatusPostedByAdmin) {
+				continue
+			}
+			discussion, exists := d.discussions[post.DiscussionId]
+			if !exists || discussion.Status != model.DiscussionStatusOk {
+				continue
+			}
+			activity[discussion.FolderId]++
+		}
+
+		for id, folder := range d.folders {
+			folder.Activity = activity[id]
+			d.folders[id] = folder
+		}
+
+	})
+
+	return nil
+
+}
@@ -0,0 +1,85 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFoldersAreListedInSortOrder(t *testing.T) {
+
+	store, folder, _ := seed()
+
+	created, err := store.Folders().Create("news", "News", model.FolderTypeNormal)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, created.SortOrder)
+	assert.Equal(t, uint(0), created.DiscussionCount)
+
+	assert.Nil(t, store.Folders().SetSortOrder(created.Id, 1))
+	assert.Nil(t, store.Folders().SetSortOrder(folder.Id, 2))
+
+	folders, err := store.Folders().GetFolders()
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(folders)) {
+		assert.Equal(t, created.Id, folders[0].Id)
+		assert.Equal(t, folder.Id, folders[1].Id)
+	}
+
+}
+
+func TestUpdateFolderBumpsTheVersion(t *testing.T) {
+
+	store, folder, _ := seed()
+
+	updated, err := store.Folders().Update(folder.Id, "chat", "Chat", model.FolderTypeAdmin, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "chat", updated.Key)
+	assert.Equal(t, "Chat", updated.Description)
+	assert.Equal(t, uint(model.FolderTypeAdmin), updated.Type)
+	assert.True(t, updated.IsArchived)
+	assert.Equal(t, folder.Version+1, updated.Version)
+
+	_, err = store.Folders().Update(folder.Id+100, "missing", "Missing", model.FolderTypeNormal, false)
+	assert.Equal(t, repository.ErrNotFound, err)
+
+}
+
+func TestFolderDiscussionCountExcludesHiddenDiscussions(t *testing.T) {
+
+	store, folder, user := seed()
+
+	_, err := store.Discussions().Create(folder.Id, "Visible", "", user.Id, false)
+	assert.Nil(t, err)
+	deleted, err := store.Discussions().Create(folder.Id, "Deleted", "", user.Id, false)
+	assert.Nil(t, err)
+	_, err = store.Discussions().SetStatus(deleted.Id, model.DiscussionStatusDeletedByAdmin)
+	assert.Nil(t, err)
+
+	folders, err := store.Folders().GetFolders()
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(folders)) {
+		assert.Equal(t, uint(1), folders[0].DiscussionCount)
+	}
+
+	found, err := store.Folders().Get(folder.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1), found.DiscussionCount)
+
+}
@@ -0,0 +1,436 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"sort"
+	"strings"
+	"time"
+)
+
+type moderationRepository struct {
+	store *Store
+}
+
+func (d *dataset) findComments(match func(comment *model.ModeratorComment) bool) []*model.ModeratorComment {
+
+	results := make([]*model.ModeratorComment, 0)
+	for _, comment := range d.comments {
+		if match(&comment) {
+			c := comment
+			c.Name = d.users[c.UserId].Username
+			c.Roles = strings.Join(d.roles[c.UserId], ",")
+			results = append(results, &c)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Id < results[j].Id
+	})
+
+	return results
+
+}
+
+func (r *moderationRepository) posts(match func(d *dataset, post *model.Post) bool, less func(a, b *model.Post) bool) []*model.Post {
+
+	posts := make([]*model.Post, 0)
+	r.store.read(func(d *dataset) {
+		for _, post := range d.posts {
+			if match(d, &post) {
+				p, _ := d.getPost(post.Id)
+				posts = append(posts, p)
+			}
+		}
+	})
+
+	sort.SliceStable(posts, func(i, j int) bool {
+		return less(posts[i], posts[j])
+	})
+
+	return posts
+
+}
+
+func (r *moderationRepository) GetQueue() ([]*model.Post, error) {
+
+	posts := r.posts(func(d *dataset, post *model.Post) bool {
+
+		switch post.Status {
+		case model.PostStatusOK, model.PostStatusSuspendedByAdmin, model.PostStatusPostedByAdmin, model.PostStatusWatch:
+		default:
+			return false
+		}
+
+		for _, entry := range d.queue {
+			if entry.PostId == post.Id {
+				return true
+			}
+		}
+
+		return false
+
+	}, func(a, b *model.Post) bool {
+		return a.CreatedDate.Before(b.CreatedDate)
+	})
+
+	r.store.read(func(d *dataset) {
+		for _, post := range posts {
+			for _, entry := range d.queue {
+				if entry.PostId == post.Id && entry.Reason != nil {
+					reason := *entry.Reason
+					post.ModerationReason = &reason
+				}
+			}
+		}
+	})
+
+	return posts, nil
+
+}
+
+func (r *moderationRepository) GetModeratedPosts(pageStart int, pageSize int) ([]*model.Post, error) {
+
+	since := time.Now().UTC().AddDate(0, 0, -30)
+	posts := r.posts(func(d *dataset, post *model.Post) bool {
+		return post.ModerationScore > 0 && post.ModerationResult != 0 && post.CreatedDate.After(since)
+	}, func(a, b *model.Post) bool {
+		return a.CreatedDate.After(b.CreatedDate)
+	})
+
+	if pageStart >= len(posts) {
+		return make([]*model.Post, 0), nil
+	}
+
+	end := pageStart + pageSize
+	if end > len(posts) {
+		end = len(posts)
+	}
+
+	return posts[pageStart:end], nil
+
+}
+
+func (r *moderationRepository) GetQueueEntries() ([]*model.ModerationQueueEntry, error) {
+
+	entries := make([]*model.ModerationQueueEntry, 0)
+	r.store.read(func(d *dataset) {
+		for _, entry := range d.queue {
+			e := entry
+			entries = append(entries, &e)
+		}
+	})
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].CreatedDate.Before(entries[j].CreatedDate)
+	})
+
+	return entries, nil
+
+}
+
+func (r *moderationRepository) DeleteQueueEntry(entryId uint) error {
+
+	r.store.write(func(d *dataset) {
+		delete(d.queue, entryId)
+	})
+
+	return nil
+
+}
+
+func (r *moderationRepository) PurgeQueue(olderThan time.Time) error {
+
+	r.store.write(func(d *dataset) {
+		for id, entry := range d.queue {
+			if entry.CreatedDate.Before(olderThan) {
+				delete(d.queue, id)
+			}
+		}
+	})
+
+	return nil
+
+}
+
+func (r *moderationRepository) QueueForReview(postId uint, reason string) (bool, error) {
+
+	queued := false
+	r.store.write(func(d *dataset) {
+
+		if _, exists := d.posts[postId]; !exists {
+			return
+		}
+
+		for _, entry := range d.queue {
+			if entry.PostId == postId {
+				return
+			}
+		}
+
+		id := d.enqueue(postId, time.Now().UTC())
+		entry := d.queue[id]
+		entry.Reason = &reason
+		d.queue[id] = entry
+		queued = true
+
+	})
+
+	return queued, nil
+
+}
+
+func (r *moderationRepository) CreateReport(report *model.PostReport) error {
+
+	r.store.write(func(d *dataset) {
+
+		now := time.Now().UTC()
+
+		created := *report
+		created.Id = d.nextId()
+		created.Version = 1
+		created.CreatedDate = now
+		created.Score = 1
+		d.reports[created.Id] = created
+
+		post, exists := d.posts[report.PostId]
+		if !exists {
+			return
+		}
+
+		post.ModerationScore++
+		d.posts[post.Id] = post
+
+		for _, entry := range d.queue {
+			if entry.PostId == post.Id {
+				return
+			}
+		}
+
+		d.enqueue(post.Id, now)
+
+	})
+
+	return nil
+
+}
+
+func (r *moderationRepository) reports(match func(d *dataset, report *model.PostReport) bool) []*model.PostReport {
+
+	results := make([]*model.PostReport, 0)
+	r.store.read(func(d *dataset) {
+		for _, report := range d.reports {
+			if match(d, &report) {
+				rp := report
+				results = append(results, &rp)
+			}
+		}
+	})
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].PostId != results[j].PostId {
+			return results[i].PostId < results[j].PostId
+		}
+		return results[i].Id < results[j].Id
+	})
+
+	return results
+
+}
+
+func (r *moderationRepository) GetReportsByPost(postId uint) ([]*model.PostReport, error) {
+	return r.reports(func(d *dataset, report *model.PostReport) bool {
+		return report.PostId == postId
+	}), nil
+}
+
+func (r *moderationRepository) GetReportsByDiscussion(discussionId uint) ([]*model.PostReport, error) {
+	return r.reports(func(d *dataset, report *model.PostReport) bool {
+		post := d.posts[report.PostId]
+		return post.DiscussionId == discussionId && post.ModerationResult == 0
+	}), nil
+}
+
+func (r *moderationRepository) CreateComment(postId uint, userId uint, body string, vote int) ([]*model.ModeratorComment, error) {
+
+	var results []*model.ModeratorComment
+	r.store.write(func(d *dataset) {
+
+		id := d.nextId()
+		d.comments[id] = model.ModeratorComment{
+			ModelBase: model.ModelBase{
+				Id:          id,
+				Version:     1,
+				CreatedDate: time.Now().UTC(),
+			},
+			Body:   body,
+			PostId: postId,
+			UserId: userId,
+			Vote:   vote,
+		}
+
+		results = d.findComments(func(comment *model.ModeratorComment) bool {
+			return comment.PostId == postId
+		})
+
+	})
+
+	return results, nil
+
+}
+
+func (r *moderationRepository) GetCommentsByPost(postId uint) ([]*model.ModeratorComment, error) {
+
+	var results []*model.ModeratorComment
+	r.store.read(func(d *dataset) {
+		results = d.findComments(func(comment *model.ModeratorComment) bool {
+			return comment.PostId == postId
+		})
+	})
+
+	return results, nil
+
+}
+
+func (r *moderationRepository) GetCommentsByDiscussion(discussionId uint) ([]*model.ModeratorComment, error) {
+
+	var results []*model.ModeratorComment
+	r.store.read(func(d *dataset) {
+		results = d.findComments(func(comment *model.ModeratorComment) bool {
+			return d.posts[comment.PostId].DiscussionId == discussionId
+		})
+	})
+
+	return results, nil
+
+}
+
+func copyBannedWord(word model.BannedWord) *model.BannedWord {
+	word.FolderIds = append(make([]uint, 0, len(word.FolderIds)), word.FolderIds...)
+	return &word
+}
+
+func (r *moderationRepository) GetBannedWords() ([]*model.BannedWord, error) {
+
+	words := make([]*model.BannedWord, 0)
+	r.store.read(func(d *dataset) {
+		for _, word := range d.bannedWords {
+			words = append(words, copyBannedWord(word))
+		}
+	})
+
+	sort.Slice(words, func(i, j int) bool {
+		return words[i].Id < words[j].Id
+	})
+
+	return words, nil
+
+}
+
+func (r *moderationRepository) GetBannedWord(wordId uint) (*model.BannedWord, error) {
+
+	var word *model.BannedWord
+	r.store.read(func(d *dataset) {
+		if w, exists := d.bannedWords[wordId]; exists {
+			word = copyBannedWord(w)
+		}
+	})
+
+	if word == nil {
+		return nil, repository.ErrNotFound
+	}
+
+	return word, nil
+
+}
+
+func (r *moderationRepository) CreateBannedWord(pattern string, action string, folderIds []uint) (*model.BannedWord, error) {
+
+	added := r.store.AddBannedWord(pattern)
+
+	return r.UpdateBannedWord(added.Id, pattern, action, folderIds)
+
+}
+
+func (r *moderationRepository) UpdateBannedWord(wordId uint, pattern string, action string, folderIds []uint) (*model.BannedWord, error) {
+
+	var word *model.BannedWord
+	r.store.write(func(d *dataset) {
+		if w, exists := d.bannedWords[wordId]; exists {
+			w.Pattern = pattern
+			w.Action = action
+			w.FolderIds = append(make([]uint, 0, len(folderIds)), folderIds...)
+			w.Version++
+			d.bannedWords[wordId] = w
+			word = copyBannedWord(w)
+		}
+	})
+
+	if word == nil {
+		return nil, repository.ErrNotFound
+	}
+
+	return word, nil
+
+}
+
+func (r *moderationRepository) DeleteBannedWord(wordId uint) error {
+
+	r.store.write(func(d *dataset) {
+		delete(d.bannedWords, wordId)
+	})
+
+	return nil
+
+}
+
+func (r *moderationRepository) RecordBannedWordMatches(postId uint, wordIds []uint) error {
+
+	r.store.write(func(d *dataset) {
+		existing := make(map[uint]bool)
+		for _, wordId := range d.wordMatches[postId] {
+			existing[wordId] = true
+		}
+		for _, wordId := range wordIds {
+			if !existing[wordId] {
+				d.wordMatches[postId] = append(d.wordMatches[postId], wordId)
+				existing[wordId] = true
+			}
+		}
+	})
+
+	return nil
+
+}
+
+func (r *moderationRepository) GetBannedWordMatches(postIds []uint) (map[uint][]uint, error) {
+
+	matches := make(map[uint][]uint)
+	r.store.read(func(d *dataset) {
+		for _, postId := range postIds {
+			if wordIds, exists := d.wordMatches[postId]; exists {
+				sorted := append([]uint{}, wordIds...)
+				sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+				matches[postId] = sorted
+			}
+		}
+	})
+
+	return matches, nil
+
+}
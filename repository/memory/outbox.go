@@ -0,0 +1,161 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"sort"
+	"time"
+)
+
+type outboxRepository struct {
+	store *Store
+}
+
+func (d *dataset) addOutboxEntry(postId uint, action string, createdDate time.Time) {
+	id := d.nextId()
+	d.outbox[id] = model.OutboxEntry{
+		Id:              id,
+		CreatedDate:     createdDate,
+		PostId:          postId,
+		Action:          action,
+		NextAttemptDate: createdDate,
+	}
+}
+
+func (r *outboxRepository) Claim(batchSize int, lease time.Duration) ([]*model.OutboxEntry, error) {
+
+	entries := make([]*model.OutboxEntry, 0)
+	r.store.write(func(d *dataset) {
+
+		now := time.Now().UTC()
+		for _, entry := range d.outbox {
+			if entry.DeadLetteredDate == nil && !entry.NextAttemptDate.After(now) {
+				claimed := entry
+				entries = append(entries, &claimed)
+			}
+		}
+
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Id < entries[j].Id
+		})
+		if len(entries) > batchSize {
+			entries = entries[:batchSize]
+		}
+
+		for _, entry := range entries {
+			entry.NextAttemptDate = now.Add(lease)
+			d.outbox[entry.Id] = *entry
+		}
+
+	})
+
+	return entries, nil
+
+}
+
+func (r *outboxRepository) Complete(entryId uint) error {
+	r.store.write(func(d *dataset) {
+		delete(d.outbox, entryId)
+	})
+	return nil
+}
+
+func (r *outboxRepository) Fail(entryId uint, lastError string, nextAttemptDate time.Time, deadLetter bool) error {
+
+	r.store.write(func(d *dataset) {
+
+		entry, exists := d.outbox[entryId]
+		if !exists {
+			return
+		}
+
+		entry.Attempts++
+		entry.LastError = &lastError
+		entry.NextAttemptDate = nextAttemptDate
+		entry.DeadLetteredDate = nil
+		if deadLetter {
+			now := time.Now().UTC()
+			entry.DeadLetteredDate = &now
+		}
+		d.outbox[entryId] = entry
+
+	})
+
+	return nil
+
+}
+
+func (r *outboxRepository) GetDeadLettered(pageStart int, pageSize int) ([]*model.OutboxEntry, error) {
+
+	entries := make([]*model.OutboxEntry, 0)
+	r.store.read(func(d *dataset) {
+		for _, entry := range d.outbox {
+			if entry.DeadLetteredDate != nil {
+				deadLettered := entry
+				entries = append(entries, &deadLettered)
+			}
+		}
+	})
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].DeadLetteredDate.Equal(*entries[j].DeadLetteredDate) {
+			return entries[i].Id > entries[j].Id
+		}
+		return entries[i].DeadLetteredDate.After(*entries[j].DeadLetteredDate)
+	})
+
+	if pageStart >= len(entries) {
+		return make([]*model.OutboxEntry, 0), nil
+	}
+
+	end := pageStart + pageSize
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	return entries[pageStart:end], nil
+
+}
+
+func (r *outboxRepository) Replay(entryId uint) (*model.OutboxEntry, error) {
+
+	var replayed *model.OutboxEntry
+	err := repository.ErrNotFound
+	r.store.write(func(d *dataset) {
+
+		entry, exists := d.outbox[entryId]
+		if !exists {
+			return
+		}
+
+		if entry.DeadLetteredDate != nil {
+			entry.Attempts = 0
+			entry.LastError = nil
+			entry.NextAttemptDate = time.Now().UTC()
+			entry.DeadLetteredDate = nil
+			d.outbox[entryId] = entry
+		}
+
+		replayed = &entry
+		err = nil
+
+	})
+
+	return replayed, err
+
+}
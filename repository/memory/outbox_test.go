@@ -0,0 +1,109 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostChangesAreWrittenToTheOutbox(t *testing.T) {
+
+	store, folder, user := seed()
+	discussion, _ := store.Discussions().Create(folder.Id, "Outbox", "", user.Id, false)
+
+	post, _ := store.Posts().Create(folder.Id, discussion.Id, "one", model.PostStatusOK, user.Id)
+	store.Posts().Edit(folder.Id, discussion.Id, post.Id, "edited", user.Id)
+	store.Posts().SetStatus(discussion.Id, post.Id, model.PostStatusWatch, 0)
+	store.Posts().Delete(folder.Id, discussion.Id, post.Id, user.Id)
+
+	entries, err := store.Outbox().Claim(10, time.Minute)
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 4) {
+		assert.Equal(t, model.OutboxActionCreate, entries[0].Action)
+		assert.Equal(t, model.OutboxActionUpdate, entries[1].Action)
+		assert.Equal(t, model.OutboxActionUpdate, entries[2].Action)
+		assert.Equal(t, model.OutboxActionDelete, entries[3].Action)
+		for _, entry := range entries {
+			assert.Equal(t, post.Id, entry.PostId)
+		}
+	}
+
+}
+
+func TestClaimedEntriesAreLeased(t *testing.T) {
+
+	store, folder, user := seed()
+	discussion, _ := store.Discussions().Create(folder.Id, "Outbox", "", user.Id, false)
+	for i := 0; i < 3; i++ {
+		store.Posts().Create(folder.Id, discussion.Id, "post", model.PostStatusOK, user.Id)
+	}
+
+	first, _ := store.Outbox().Claim(2, time.Minute)
+	assert.Len(t, first, 2)
+
+	second, _ := store.Outbox().Claim(2, time.Minute)
+	assert.Len(t, second, 1)
+
+	third, _ := store.Outbox().Claim(2, time.Minute)
+	assert.Len(t, third, 0)
+
+	assert.Nil(t, store.Outbox().Complete(first[0].Id))
+	assert.Nil(t, store.Outbox().Fail(first[1].Id, "unavailable", time.Now().Add(-time.Second), false))
+
+	retried, _ := store.Outbox().Claim(2, time.Minute)
+	if assert.Len(t, retried, 1) {
+		assert.Equal(t, first[1].Id, retried[0].Id)
+		assert.Equal(t, 1, retried[0].Attempts)
+		assert.Equal(t, "unavailable", *retried[0].LastError)
+	}
+
+}
+
+func TestDeadLetteredEntriesCanBeReplayed(t *testing.T) {
+
+	store, folder, user := seed()
+	discussion, _ := store.Discussions().Create(folder.Id, "Outbox", "", user.Id, false)
+	store.Posts().Create(folder.Id, discussion.Id, "post", model.PostStatusOK, user.Id)
+
+	entries, _ := store.Outbox().Claim(1, time.Minute)
+	assert.Nil(t, store.Outbox().Fail(entries[0].Id, "gave up", time.Now(), true))
+
+	claimed, _ := store.Outbox().Claim(1, 0)
+	assert.Len(t, claimed, 0, "dead letters are never claimed")
+
+	deadLettered, err := store.Outbox().GetDeadLettered(0, 10)
+	assert.Nil(t, err)
+	if assert.Len(t, deadLettered, 1) {
+		assert.NotNil(t, deadLettered[0].DeadLetteredDate)
+	}
+
+	replayed, err := store.Outbox().Replay(entries[0].Id)
+	assert.Nil(t, err)
+	assert.Nil(t, replayed.DeadLetteredDate)
+	assert.Equal(t, 0, replayed.Attempts)
+
+	claimed, _ = store.Outbox().Claim(1, time.Minute)
+	assert.Len(t, claimed, 1)
+
+	_, err = store.Outbox().Replay(12345)
+	assert.Equal(t, repository.ErrNotFound, err)
+
+}
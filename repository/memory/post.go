@@ -0,0 +1,526 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"sort"
+	"strings"
+	"time"
+)
+
+type postRepository struct {
+	store *Store
+}
+
+func (d *dataset) getPost(postId uint) (*model.Post, error) {
+
+	post, exists := d.posts[postId]
+	if !exists {
+		return nil, repository.ErrNotFound
+	}
+
+	user := d.users[post.CreatedByUserId]
+	post.CreatedByUsername = user.Username
+	post.CreatedByEnabled = user.Enabled
+	post.CreatedByLocked = user.AccountLocked
+	post.CreatedByExpired = user.AccountExpired
+	post.CreatedByWatch = user.IsWatch
+	post.CreatedByPremoderate = user.IsPremoderate
+	post.DiscussionStatus = uint(d.discussions[post.DiscussionId].Status)
+
+	return &post, nil
+
+}
+
+func (d *dataset) postInFolder(postId uint, discussionId uint, folderId uint) (model.Post, bool) {
+
+	post, exists := d.posts[postId]
+	if !exists || post.DiscussionId != discussionId {
+		return post, false
+	}
+
+	return post, d.discussions[discussionId].FolderId == folderId
+
+}
+
+func (d *dataset) deleteQueueEntries(postId uint) {
+	for id, entry := range d.queue {
+		if entry.PostId == postId {
+			delete(d.queue, id)
+		}
+	}
+}
+
+func (d *dataset) enqueue(postId uint, createdDate time.Time) uint {
+	id := d.nextId()
+	d.queue[id] = model.ModerationQueueEntry{
+		Id:          id,
+		Version:     1,
+		CreatedDate: createdDate,
+		PostId:      postId,
+	}
+	return id
+}
+
+func (r *postRepository) Get(postId uint) (*model.Post, error) {
+
+	var post *model.Post
+	var err error
+	r.store.read(func(d *dataset) {
+		post, err = d.getPost(postId)
+	})
+
+	return post, err
+
+}
+
+func (r *postRepository) GetByIds(postIds []uint) ([]*model.Post, error) {
+
+	posts := make([]*model.Post, 0, len(postIds))
+	r.store.read(func(d *dataset) {
+		for _, postId := range postIds {
+			if post, err := d.getPost(postId); err == nil {
+				posts = append(posts, post)
+			}
+		}
+	})
+
+	return posts, nil
+
+}
+
+func (r *postRepository) GetPosts(userId uint, folderId uint, discussionId uint, pageStart int64, pageSize int) ([]*model.Post, error) {
+
+	posts := make([]*model.Post, 0)
+	r.store.read(func(d *dataset) {
+
+		if d.discussions[discussionId].FolderId != folderId {
+			return
+		}
+
+		start := pageStart
+		if start == 0 {
+			start = d.bookmarks[pairKey{userId, discussionId}].LastPostCount
+		}
+		if start == 0 {
+			start = 1
+		}
+
+		for _, post := range d.posts {
+			if post.DiscussionId == discussionId && post.PostNum >= start && post.PostNum < start+int64(pageSize) {
+				p, _ := d.getPost(post.Id)
+				posts = append(posts, p)
+			}
+		}
+
+	})
+
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].PostNum < posts[j].PostNum
+	})
+
+	return posts, nil
+
+}
+
+func (r *postRepository) Create(folderId uint, discussionId uint, text string, status int, userId uint) (*model.Post, error) {
+
+	var post *model.Post
+	var err error
+	r.store.write(func(d *dataset) {
+
+		discussion, exists := d.discussions[discussionId]
+		if !exists {
+			err = repository.ErrNotFound
+			return
+		}
+
+		var postNum int64 = 1
+		for _, existing := range d.posts {
+			if existing.DiscussionId == discussionId {
+				postNum++
+			}
+		}
+
+		now := time.Now().UTC()
+		created := model.Post{
+			ModelBase: model.ModelBase{
+				Id:          d.nextId(),
+				Version:     1,
+				CreatedDate: now,
+			},
+			DiscussionId:    discussionId,
+			CreatedByUserId: userId,
+			Status:          status,
+			Text:            text,
+			PostNum:         postNum,
+		}
+		d.posts[created.Id] = created
+		d.addOutboxEntry(created.Id, model.OutboxActionCreate, now)
+
+		discussion.Version++
+		discussion.PostCount = postNum
+		discussion.LastPostDate = now
+		discussion.LastPostId = created.Id
+		d.discussions[discussionId] = discussion
+
+		if status == model.PostStatusSuspendedByAdmin || status == model.PostStatusWatch {
+			d.enqueue(created.Id, now)
+		}
+
+		if status == model.PostStatusOK || status == model.PostStatusPostedByAdmin || status == model.PostStatusWatch {
+
+			delete(d.frontPage, discussionId)
+
+			folder, exists := d.folders[discussion.FolderId]
+			if exists && discussion.Status == model.DiscussionStatusOk && (folder.Type == model.FolderTypeNormal || folder.Type == model.FolderTypeAdmin) {
+				isAdmin := folder.Type == model.FolderTypeAdmin
+				d.frontPage[discussionId] = model.FrontPageEntry{
+					DiscussionId:    discussionId,
+					DiscussionTitle: discussion.Title,
+					FolderId:        folder.Id,
+					FolderKey:       folder.Key,
+					FolderTitle:     folder.Description,
+					LastPostId:      created.Id,
+					LastPostDate:    now,
+					PostCount:       postNum,
+					IsAdmin:         &isAdmin,
+				}
+			}
+
+		}
+
+		post, err = d.getPost(created.Id)
+
+	})
+
+	return post, err
+
+}
+
+func (r *postRepository) Edit(folderId uint, discussionId uint, postId uint, text string, userId uint) (*model.Post, error) {
+
+	var post *model.Post
+	err := repository.ErrNotFound
+	r.store.write(func(d *dataset) {
+
+		existing, exists := d.postInFolder(postId, discussionId, folderId)
+		if !exists || existing.CreatedByUserId != userId {
+			return
+		}
+
+		existing.Text = text
+		existing.LastEditDate = time.Now().UTC()
+		d.posts[postId] = existing
+		d.addOutboxEntry(postId, model.OutboxActionUpdate, existing.LastEditDate)
+
+		post, err = d.getPost(postId)
+
+	})
+
+	return post, err
+
+}
+
+func (r *postRepository) Delete(folderId uint, discussionId uint, postId uint, userId uint) (*model.Post, error) {
+
+	var post *model.Post
+	err := repository.ErrNotFound
+	r.store.write(func(d *dataset) {
+
+		existing, exists := d.postInFolder(postId, discussionId, folderId)
+		if !exists {
+			return
+		}
+
+		existing.Deleted = true
+		if existing.CreatedByUserId != userId {
+			existing.Status = model.PostStatusDeletedByAdmin
+		} else {
+			existing.Status = model.PostStatusDeletedByUser
+		}
+		d.posts[postId] = existing
+
+		d.deleteQueueEntries(postId)
+		d.addOutboxEntry(postId, model.OutboxActionDelete, time.Now().UTC())
+
+		post, err = d.getPost(postId)
+
+	})
+
+	return post, err
+
+}
+
+func (r *postRepository) SetStatus(discussionId uint, postId uint, status int, moderationResult int) (*model.Post, error) {
+
+	var post *model.Post
+	var err error
+	r.store.write(func(d *dataset) {
+
+		if existing, exists := d.posts[postId]; exists && existing.DiscussionId == discussionId {
+			existing.Status = status
+			existing.ModerationResult = moderationResult
+			d.posts[postId] = existing
+			d.addOutboxEntry(postId, model.OutboxActionUpdate, time.Now().UTC())
+		}
+
+		d.deleteQueueEntries(postId)
+
+		post, err = d.getPost(postId)
+
+	})
+
+	return post, err
+
+}
+
+func (r *postRepository) GetSubscribers(postId uint) ([]uint, error) {
+
+	subscribers := make([]uint, 0)
+	r.store.read(func(d *dataset) {
+
+		post, exists := d.posts[postId]
+		if !exists {
+			return
+		}
+
+		seen := make(map[uint]bool)
+		for key := range d.bookmarks {
+			if key.otherId == post.DiscussionId && !seen[key.userId] {
+				seen[key.userId] = true
+				subscribers = append(subscribers, key.userId)
+			}
+		}
+
+		folderId := d.discussions[post.DiscussionId].FolderId
+		for _, subscription := range d.folderSubs {
+			if subscription.FolderId == folderId && !d.hasException(subscription.Id, post.DiscussionId) && !seen[subscription.UserId] {
+				seen[subscription.UserId] = true
+				subscribers = append(subscribers, subscription.UserId)
+			}
+		}
+
+	})
+
+	sort.Slice(subscribers, func(i, j int) bool {
+		return subscribers[i] < subscribers[j]
+	})
+
+	return subscribers, nil
+
+}
+
+func (r *postRepository) GetIndexableAfter(afterPostId uint, limit int) ([]*model.IndexablePost, error) {
+
+	posts := make([]*model.IndexablePost, 0, limit)
+	for _, post := range r.indexable(0, 0) {
+		if len(posts) == limit {
+			break
+		}
+		if post.Id > afterPostId {
+			posts = append(posts, post)
+		}
+	}
+
+	return posts, nil
+
+}
+
+func (r *postRepository) GetCreatedBetween(afterPostId uint, from time.Time, to time.Time, limit int) ([]*model.IndexablePost, error) {
+
+	posts := make([]*model.IndexablePost, 0, limit)
+	r.store.read(func(d *dataset) {
+		for _, post := range d.posts {
+
+			if post.Id <= afterPostId || post.CreatedDate.Before(from) || !post.CreatedDate.Before(to) {
+				continue
+			}
+			if post.Status != model.PostStatusOK && post.Status != model.PostStatusWatch {
+				continue
+			}
+
+			discussion := d.discussions[post.DiscussionId]
+			folder := d.folders[discussion.FolderId]
+			posts = append(posts, &model.IndexablePost{
+				Id:               post.Id,
+				CreatedDate:      post.CreatedDate,
+				FolderId:         folder.Id,
+				DiscussionId:     discussion.Id,
+				FolderName:       folder.Description,
+				DiscussionTitle:  discussion.Title,
+				DiscussionHeader: discussion.Header,
+				Text:             post.Text,
+				Username:         d.users[post.CreatedByUserId].Username,
+				UserId:           post.CreatedByUserId,
+				Status:           post.Status,
+			})
+
+		}
+	})
+
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].Id < posts[j].Id
+	})
+
+	if len(posts) > limit {
+		posts = posts[:limit]
+	}
+
+	return posts, nil
+
+}
+
+func (r *postRepository) ForEachIndexableIn(folderId uint, discussionId uint, fn func(post *model.IndexablePost) error) error {
+
+	for _, post := range r.indexable(folderId, discussionId) {
+		if err := fn(post); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// indexable returns the posts which belong in the search index, in id order
+func (r *postRepository) indexable(folderId uint, discussionId uint) []*model.IndexablePost {
+
+	posts := make([]*model.IndexablePost, 0)
+	r.store.read(func(d *dataset) {
+		for _, post := range d.posts {
+
+			discussion := d.discussions[post.DiscussionId]
+			folder := d.folders[discussion.FolderId]
+			if (post.Status != model.PostStatusOK && post.Status != model.PostStatusWatch) || discussion.Status != model.DiscussionStatusOk || discussion.IsLocked || folder.Type != model.FolderTypeNormal {
+				continue
+			}
+
+			if (folderId != 0 && folder.Id != folderId) || (discussionId != 0 && discussion.Id != discussionId) {
+				continue
+			}
+
+			posts = append(posts, &model.IndexablePost{
+				Id:               post.Id,
+				CreatedDate:      post.CreatedDate,
+				FolderId:         folder.Id,
+				DiscussionId:     discussion.Id,
+				FolderName:       folder.Description,
+				DiscussionTitle:  discussion.Title,
+				DiscussionHeader: discussion.Header,
+				Text:             post.Text,
+				Username:         d.users[post.CreatedByUserId].Username,
+				UserId:           post.CreatedByUserId,
+				Status:           post.Status,
+			})
+
+		}
+	})
+
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].Id < posts[j].Id
+	})
+
+	return posts
+
+}
+
+func (r *postRepository) SearchText(search repository.PostTextSearch) ([]*model.Post, int, error) {
+
+	contains := func(text string, terms []string) (bool, bool) {
+		text = strings.ToLower(text)
+		all, any := true, false
+		for _, term := range terms {
+			if strings.Contains(text, strings.ToLower(term)) {
+				any = true
+			} else {
+				all = false
+			}
+		}
+		return all, any
+	}
+
+	ignored := make(map[uint]bool)
+	for _, userId := range search.ExcludeUserIds {
+		ignored[userId] = true
+	}
+
+	matches := make([]*model.Post, 0)
+	r.store.read(func(d *dataset) {
+		for postId, post := range d.posts {
+
+			if post.DiscussionId != search.DiscussionId || (post.Status != model.PostStatusOK && post.Status != model.PostStatusWatch) || ignored[post.CreatedByUserId] {
+				continue
+			}
+
+			if all, _ := contains(post.Text, search.Include); !all {
+				continue
+			}
+
+			if _, any := contains(post.Text, search.Exclude); any {
+				continue
+			}
+
+			match, _ := d.getPost(postId)
+			matches = append(matches, match)
+
+		}
+	})
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Id > matches[j].Id
+	})
+
+	posts := make([]*model.Post, 0)
+	for _, post := range matches {
+		if len(posts) == search.Limit {
+			break
+		}
+		if search.BeforePostId == 0 || post.Id < search.BeforePostId {
+			posts = append(posts, post)
+		}
+	}
+
+	return posts, len(matches), nil
+
+}
+
+func (r *postRepository) GetRecent(limit int) ([]*model.Post, error) {
+
+	posts := make([]*model.Post, 0)
+	r.store.read(func(d *dataset) {
+		for postId, post := range d.posts {
+			if post.Deleted {
+				continue
+			}
+			recent, _ := d.getPost(postId)
+			posts = append(posts, recent)
+		}
+	})
+
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].Id > posts[j].Id
+	})
+
+	if len(posts) > limit {
+		posts = posts[:limit]
+	}
+
+	return posts, nil
+
+}
@@ -0,0 +1,213 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreatePostNumbersPostsAndUpdatesDiscussion(t *testing.T) {
+
+	store, folder, user := seed()
+	discussion, _ := store.Discussions().Create(folder.Id, "Posts", "", user.Id, false)
+
+	first, err := store.Posts().Create(folder.Id, discussion.Id, "one", model.PostStatusOK, user.Id)
+	assert.Nil(t, err)
+	second, err := store.Posts().Create(folder.Id, discussion.Id, "two", model.PostStatusOK, user.Id)
+	assert.Nil(t, err)
+
+	assert.Equal(t, int64(1), first.PostNum)
+	assert.Equal(t, int64(2), second.PostNum)
+	assert.Equal(t, "alice", second.CreatedByUsername)
+
+	updated, _ := store.Discussions().Get(discussion.Id)
+	assert.Equal(t, int64(2), updated.PostCount)
+	assert.Equal(t, second.Id, updated.LastPostId)
+	assert.Equal(t, discussion.Version+2, updated.Version, "each post bumps the discussion's version")
+
+}
+
+func TestWatchedPostsAreQueuedForModeration(t *testing.T) {
+
+	store, folder, user := seed()
+	discussion, _ := store.Discussions().Create(folder.Id, "Queue", "", user.Id, false)
+
+	post, _ := store.Posts().Create(folder.Id, discussion.Id, "watched", model.PostStatusWatch, user.Id)
+
+	queue, err := store.Moderation().GetQueue()
+	assert.Nil(t, err)
+	assert.Len(t, queue, 1)
+	assert.Equal(t, post.Id, queue[0].Id)
+
+	_, err = store.Posts().SetStatus(discussion.Id, post.Id, model.PostStatusOK, 1)
+	assert.Nil(t, err)
+
+	queue, _ = store.Moderation().GetQueue()
+	assert.Len(t, queue, 0)
+
+}
+
+func TestOnlyTheAuthorCanEditAPost(t *testing.T) {
+
+	store, folder, user := seed()
+	other := store.AddUser(&model.User{Username: "bob"})
+	discussion, _ := store.Discussions().Create(folder.Id, "Edits", "", user.Id, false)
+	post, _ := store.Posts().Create(folder.Id, discussion.Id, "original", model.PostStatusOK, user.Id)
+
+	_, err := store.Posts().Edit(folder.Id, discussion.Id, post.Id, "hijacked", other.Id)
+	assert.Equal(t, repository.ErrNotFound, err)
+
+	edited, err := store.Posts().Edit(folder.Id, discussion.Id, post.Id, "edited", user.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "edited", edited.Text)
+	assert.False(t, edited.LastEditDate.IsZero())
+
+}
+
+func TestDeletePostSetsStatusByOwnership(t *testing.T) {
+
+	store, folder, user := seed()
+	admin := store.AddUser(&model.User{Username: "admin", IsAdmin: true})
+	discussion, _ := store.Discussions().Create(folder.Id, "Deletes", "", user.Id, false)
+	own, _ := store.Posts().Create(folder.Id, discussion.Id, "mine", model.PostStatusOK, user.Id)
+	other, _ := store.Posts().Create(folder.Id, discussion.Id, "theirs", model.PostStatusOK, user.Id)
+
+	deleted, err := store.Posts().Delete(folder.Id, discussion.Id, own.Id, user.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, model.PostStatusDeletedByUser, deleted.Status)
+
+	deleted, err = store.Posts().Delete(folder.Id, discussion.Id, other.Id, admin.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, model.PostStatusDeletedByAdmin, deleted.Status)
+
+}
+
+func TestGetPostsStartsAtTheBookmark(t *testing.T) {
+
+	store, folder, user := seed()
+	discussion, _ := store.Discussions().Create(folder.Id, "Paging", "", user.Id, false)
+	for i := 0; i < 5; i++ {
+		store.Posts().Create(folder.Id, discussion.Id, "post", model.PostStatusOK, user.Id)
+	}
+
+	posts, err := store.Posts().GetPosts(user.Id, folder.Id, discussion.Id, 0, 2)
+	assert.Nil(t, err)
+	assert.Len(t, posts, 2)
+	assert.Equal(t, int64(1), posts[0].PostNum)
+
+	store.Subscriptions().UpdateBookmark(user.Id, discussion.Id, posts[1].Id, 3, posts[1].CreatedDate)
+
+	posts, err = store.Posts().GetPosts(user.Id, folder.Id, discussion.Id, 0, 10)
+	assert.Nil(t, err)
+	assert.Len(t, posts, 3)
+	assert.Equal(t, int64(3), posts[0].PostNum)
+
+}
+
+func TestGetByIdsSkipsMissingPosts(t *testing.T) {
+
+	store, folder, user := seed()
+	discussion, _ := store.Discussions().Create(folder.Id, "Batch", "", user.Id, false)
+	first, _ := store.Posts().Create(folder.Id, discussion.Id, "first", model.PostStatusOK, user.Id)
+	second, _ := store.Posts().Create(folder.Id, discussion.Id, "second", model.PostStatusWatch, user.Id)
+
+	posts, err := store.Posts().GetByIds([]uint{second.Id, 9999, first.Id})
+	assert.Nil(t, err)
+	if assert.Len(t, posts, 2) {
+		assert.Equal(t, second.Id, posts[0].Id)
+		assert.Equal(t, user.Username, posts[0].CreatedByUsername)
+		assert.Equal(t, first.Id, posts[1].Id)
+	}
+
+}
+
+func TestGetIndexableAfterPagesInIdOrder(t *testing.T) {
+
+	store, folder, user := seed()
+	discussion, _ := store.Discussions().Create(folder.Id, "Indexing", "", user.Id, false)
+	created := make([]*model.Post, 0)
+	for i := 0; i < 5; i++ {
+		post, _ := store.Posts().Create(folder.Id, discussion.Id, "post", model.PostStatusOK, user.Id)
+		created = append(created, post)
+	}
+	store.Posts().Delete(folder.Id, discussion.Id, created[3].Id, user.Id)
+
+	posts, err := store.Posts().GetIndexableAfter(0, 2)
+	assert.Nil(t, err)
+	if assert.Len(t, posts, 2) {
+		assert.Equal(t, created[0].Id, posts[0].Id)
+		assert.Equal(t, created[1].Id, posts[1].Id)
+	}
+
+	posts, err = store.Posts().GetIndexableAfter(posts[1].Id, 2)
+	assert.Nil(t, err)
+	if assert.Len(t, posts, 2) {
+		assert.Equal(t, created[2].Id, posts[0].Id)
+		assert.Equal(t, created[4].Id, posts[1].Id)
+	}
+
+	posts, err = store.Posts().GetIndexableAfter(created[4].Id, 2)
+	assert.Nil(t, err)
+	assert.Len(t, posts, 0)
+
+}
+
+func TestSearchTextMatchesWithinADiscussion(t *testing.T) {
+
+	store, folder, user := seed()
+	other := store.AddUser(&model.User{Username: "bob", Email: "bob@example.com", Enabled: true})
+	discussion, _ := store.Discussions().Create(folder.Id, "Pets", "", user.Id, false)
+	elsewhere, _ := store.Discussions().Create(folder.Id, "Elsewhere", "", user.Id, false)
+
+	first, _ := store.Posts().Create(folder.Id, discussion.Id, "My CAT is 100% fluffy", model.PostStatusOK, user.Id)
+	store.Posts().Create(folder.Id, discussion.Id, "the cat and the dog", model.PostStatusOK, user.Id)
+	third, _ := store.Posts().Create(folder.Id, discussion.Id, "another cat", model.PostStatusOK, user.Id)
+	store.Posts().Create(folder.Id, discussion.Id, "bob's cat", model.PostStatusOK, other.Id)
+	store.Posts().Create(folder.Id, elsewhere.Id, "a cat elsewhere", model.PostStatusOK, user.Id)
+
+	search := repository.PostTextSearch{
+		DiscussionId:   discussion.Id,
+		Include:        []string{"cat"},
+		Exclude:        []string{"dog"},
+		ExcludeUserIds: []uint{other.Id},
+		Limit:          1,
+	}
+
+	posts, total, err := store.Posts().SearchText(search)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, total)
+	if assert.Len(t, posts, 1) {
+		assert.Equal(t, third.Id, posts[0].Id)
+		assert.Equal(t, int64(3), posts[0].PostNum)
+	}
+
+	search.BeforePostId = third.Id
+	posts, total, err = store.Posts().SearchText(search)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, total)
+	if assert.Len(t, posts, 1) {
+		assert.Equal(t, first.Id, posts[0].Id)
+	}
+
+	posts, _, err = store.Posts().SearchText(repository.PostTextSearch{DiscussionId: discussion.Id, Include: []string{"100%"}, Limit: 10})
+	assert.Nil(t, err)
+	assert.Len(t, posts, 1)
+
+}
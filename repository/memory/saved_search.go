@@ -0,0 +1,152 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"sort"
+	"strings"
+	"time"
+)
+
+type savedSearchRepository struct {
+	store *Store
+}
+
+func sortSavedSearches(savedSearches []*model.SavedSearch, byName bool) {
+	sort.Slice(savedSearches, func(i, j int) bool {
+		if byName && savedSearches[i].Name != savedSearches[j].Name {
+			return strings.Compare(savedSearches[i].Name, savedSearches[j].Name) < 0
+		}
+		return savedSearches[i].Id < savedSearches[j].Id
+	})
+}
+
+func (r *savedSearchRepository) Get(savedSearchId uint) (*model.SavedSearch, error) {
+
+	var savedSearch model.SavedSearch
+	var exists bool
+	r.store.read(func(d *dataset) {
+		savedSearch, exists = d.savedSearches[savedSearchId]
+	})
+
+	if !exists {
+		return nil, repository.ErrNotFound
+	}
+
+	return &savedSearch, nil
+
+}
+
+func (r *savedSearchRepository) GetForUser(userId uint) ([]*model.SavedSearch, error) {
+
+	savedSearches := make([]*model.SavedSearch, 0)
+	r.store.read(func(d *dataset) {
+		for _, savedSearch := range d.savedSearches {
+			if savedSearch.UserId == userId {
+				found := savedSearch
+				savedSearches = append(savedSearches, &found)
+			}
+		}
+	})
+
+	sortSavedSearches(savedSearches, true)
+
+	return savedSearches, nil
+
+}
+
+func (r *savedSearchRepository) GetAlerting() ([]*model.SavedSearch, error) {
+
+	savedSearches := make([]*model.SavedSearch, 0)
+	r.store.read(func(d *dataset) {
+		for _, savedSearch := range d.savedSearches {
+			if savedSearch.Alerts {
+				found := savedSearch
+				savedSearches = append(savedSearches, &found)
+			}
+		}
+	})
+
+	sortSavedSearches(savedSearches, false)
+
+	return savedSearches, nil
+
+}
+
+func (r *savedSearchRepository) Create(savedSearch *model.SavedSearch) (*model.SavedSearch, error) {
+
+	created := *savedSearch
+	r.store.write(func(d *dataset) {
+		now := time.Now().UTC()
+		created.Id = d.nextId()
+		created.CreatedDate = now
+		created.LastUpdate = now
+		d.savedSearches[created.Id] = created
+	})
+
+	return &created, nil
+
+}
+
+func (r *savedSearchRepository) Update(savedSearch *model.SavedSearch) (*model.SavedSearch, error) {
+
+	var updated *model.SavedSearch
+	r.store.write(func(d *dataset) {
+
+		existing, exists := d.savedSearches[savedSearch.Id]
+		if !exists || existing.UserId != savedSearch.UserId {
+			return
+		}
+
+		existing.Name = savedSearch.Name
+		existing.Query = savedSearch.Query
+		existing.FolderId = savedSearch.FolderId
+		existing.DiscussionId = savedSearch.DiscussionId
+		existing.Author = savedSearch.Author
+		existing.Alerts = savedSearch.Alerts
+		existing.LastUpdate = time.Now().UTC()
+		d.savedSearches[existing.Id] = existing
+		updated = &existing
+
+	})
+
+	if updated == nil {
+		return nil, repository.ErrNotFound
+	}
+
+	return updated, nil
+
+}
+
+func (r *savedSearchRepository) Delete(userId uint, savedSearchId uint) error {
+
+	deleted := false
+	r.store.write(func(d *dataset) {
+		if existing, exists := d.savedSearches[savedSearchId]; exists && existing.UserId == userId {
+			delete(d.savedSearches, savedSearchId)
+			deleted = true
+		}
+	})
+
+	if !deleted {
+		return repository.ErrNotFound
+	}
+
+	return nil
+
+}
@@ -0,0 +1,57 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSavedSearchesBelongToTheirOwner(t *testing.T) {
+
+	store := NewStore()
+
+	created, err := store.SavedSearches().Create(&model.SavedSearch{UserId: 1, Name: "Swans", Query: "swan"})
+	assert.Nil(t, err)
+	store.SavedSearches().Create(&model.SavedSearch{UserId: 1, Name: "Geese", Query: "goose", Alerts: true})
+	store.SavedSearches().Create(&model.SavedSearch{UserId: 2, Name: "Ducks", Query: "duck", Alerts: true})
+
+	mine, _ := store.SavedSearches().GetForUser(1)
+	if assert.Len(t, mine, 2) {
+		assert.Equal(t, "Geese", mine[0].Name)
+		assert.Equal(t, "Swans", mine[1].Name)
+	}
+
+	alerting, _ := store.SavedSearches().GetAlerting()
+	assert.Len(t, alerting, 2)
+
+	_, err = store.SavedSearches().Update(&model.SavedSearch{Id: created.Id, UserId: 2, Name: "Stolen", Query: "swan"})
+	assert.Equal(t, repository.ErrNotFound, err)
+	assert.Equal(t, repository.ErrNotFound, store.SavedSearches().Delete(2, created.Id))
+
+	updated, err := store.SavedSearches().Update(&model.SavedSearch{Id: created.Id, UserId: 1, Name: "Black swans", Query: `"black swan"`, Alerts: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "Black swans", updated.Name)
+	assert.True(t, updated.Alerts)
+
+	assert.Nil(t, store.SavedSearches().Delete(1, created.Id))
+	_, err = store.SavedSearches().Get(created.Id)
+	assert.Equal(t, repository.ErrNotFound, err)
+
+}
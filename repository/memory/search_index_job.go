@@ -0,0 +1,197 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"sort"
+	"time"
+)
+
+type searchIndexJobRepository struct {
+	store *Store
+}
+
+func (r *searchIndexJobRepository) Create(scope string, targetId uint, reason string) (*model.SearchIndexJob, error) {
+
+	var created model.SearchIndexJob
+	r.store.write(func(d *dataset) {
+
+		for _, job := range d.indexJobs {
+			if job.Scope == scope && job.TargetId == targetId && job.Status == model.SearchIndexJobStatusPending {
+				if created.Id == 0 || job.Id < created.Id {
+					created = job
+				}
+			}
+		}
+
+		if created.Id != 0 {
+			return
+		}
+
+		now := time.Now().UTC()
+		created = model.SearchIndexJob{
+			Id:          d.nextId(),
+			CreatedDate: now,
+			LastUpdate:  now,
+			Scope:       scope,
+			TargetId:    targetId,
+			Reason:      reason,
+			Status:      model.SearchIndexJobStatusPending,
+		}
+		d.indexJobs[created.Id] = created
+
+	})
+
+	return &created, nil
+
+}
+
+func (r *searchIndexJobRepository) ClaimNext(staleAfter time.Duration) (*model.SearchIndexJob, error) {
+
+	var claimed *model.SearchIndexJob
+	r.store.write(func(d *dataset) {
+
+		now := time.Now().UTC()
+		for _, job := range d.indexJobs {
+			isStale := job.Status == model.SearchIndexJobStatusRunning && job.LastUpdate.Before(now.Add(-staleAfter))
+			if job.Status != model.SearchIndexJobStatusPending && !isStale {
+				continue
+			}
+			if claimed == nil || job.Id < claimed.Id {
+				candidate := job
+				claimed = &candidate
+			}
+		}
+
+		if claimed == nil {
+			return
+		}
+
+		claimed.Status = model.SearchIndexJobStatusRunning
+		claimed.StartedDate = &now
+		claimed.LastUpdate = now
+		claimed.Processed = 0
+		claimed.Failed = 0
+		claimed.LastError = nil
+		d.indexJobs[claimed.Id] = *claimed
+
+	})
+
+	if claimed == nil {
+		return nil, repository.ErrNotFound
+	}
+
+	return claimed, nil
+
+}
+
+func (r *searchIndexJobRepository) UpdateProgress(jobId uint, processed int, failed int) error {
+
+	r.store.write(func(d *dataset) {
+		if job, exists := d.indexJobs[jobId]; exists {
+			job.Processed = processed
+			job.Failed = failed
+			job.LastUpdate = time.Now().UTC()
+			d.indexJobs[jobId] = job
+		}
+	})
+
+	return nil
+
+}
+
+func (r *searchIndexJobRepository) Finish(jobId uint, status string, action string, processed int, failed int, lastError string) error {
+
+	r.store.write(func(d *dataset) {
+
+		job, exists := d.indexJobs[jobId]
+		if !exists {
+			return
+		}
+
+		now := time.Now().UTC()
+		job.Status = status
+		job.Action = &action
+		job.Processed = processed
+		job.Failed = failed
+		job.LastError = nil
+		if len(lastError) > 0 {
+			job.LastError = &lastError
+		}
+		job.LastUpdate = now
+		job.CompletedDate = &now
+		d.indexJobs[jobId] = job
+
+	})
+
+	return nil
+
+}
+
+func (r *searchIndexJobRepository) GetRecent(pageStart int, pageSize int) ([]*model.SearchIndexJob, error) {
+
+	jobs := make([]*model.SearchIndexJob, 0)
+	r.store.read(func(d *dataset) {
+		for _, job := range d.indexJobs {
+			recent := job
+			jobs = append(jobs, &recent)
+		}
+	})
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Id > jobs[j].Id
+	})
+
+	if pageStart >= len(jobs) {
+		return make([]*model.SearchIndexJob, 0), nil
+	}
+
+	end := pageStart + pageSize
+	if end > len(jobs) {
+		end = len(jobs)
+	}
+
+	return jobs[pageStart:end], nil
+
+}
+
+func (r *searchIndexJobRepository) Retry(jobId uint) (*model.SearchIndexJob, error) {
+
+	var retried *model.SearchIndexJob
+	r.store.write(func(d *dataset) {
+
+		job, exists := d.indexJobs[jobId]
+		if !exists || job.Status != model.SearchIndexJobStatusFailed {
+			return
+		}
+
+		job.Status = model.SearchIndexJobStatusPending
+		job.LastUpdate = time.Now().UTC()
+		job.CompletedDate = nil
+		d.indexJobs[jobId] = job
+		retried = &job
+
+	})
+
+	if retried == nil {
+		return nil, repository.ErrNotFound
+	}
+
+	return retried, nil
+
+}
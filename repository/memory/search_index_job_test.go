@@ -0,0 +1,125 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPendingSearchIndexJobsAreCoalesced(t *testing.T) {
+
+	store := NewStore()
+
+	first, _ := store.SearchIndexJobs().Create(model.SearchIndexJobScopeDiscussion, 10, "discussion.edited")
+	second, _ := store.SearchIndexJobs().Create(model.SearchIndexJobScopeDiscussion, 10, "discussion.moved")
+	other, _ := store.SearchIndexJobs().Create(model.SearchIndexJobScopeFolder, 10, "folder.edited")
+
+	assert.Equal(t, first.Id, second.Id)
+	assert.NotEqual(t, first.Id, other.Id)
+
+	claimed, err := store.SearchIndexJobs().ClaimNext(time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, first.Id, claimed.Id)
+	assert.Equal(t, model.SearchIndexJobStatusRunning, claimed.Status)
+
+	// the first job has started so a later change needs a job of its own
+	third, _ := store.SearchIndexJobs().Create(model.SearchIndexJobScopeDiscussion, 10, "discussion.locked")
+	assert.NotEqual(t, first.Id, third.Id)
+
+}
+
+func TestStaleSearchIndexJobsAreReclaimed(t *testing.T) {
+
+	store := NewStore()
+	created, _ := store.SearchIndexJobs().Create(model.SearchIndexJobScopeDiscussion, 10, "discussion.edited")
+
+	claimed, _ := store.SearchIndexJobs().ClaimNext(time.Minute)
+	assert.Equal(t, created.Id, claimed.Id)
+
+	_, err := store.SearchIndexJobs().ClaimNext(time.Minute)
+	assert.Equal(t, repository.ErrNotFound, err)
+
+	reclaimed, err := store.SearchIndexJobs().ClaimNext(-time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, created.Id, reclaimed.Id)
+
+}
+
+func TestFailedSearchIndexJobsCanBeRetried(t *testing.T) {
+
+	store := NewStore()
+	created, _ := store.SearchIndexJobs().Create(model.SearchIndexJobScopeDiscussion, 10, "discussion.edited")
+	store.SearchIndexJobs().ClaimNext(time.Minute)
+
+	_, err := store.SearchIndexJobs().Retry(created.Id)
+	assert.Equal(t, repository.ErrNotFound, err)
+
+	assert.Nil(t, store.SearchIndexJobs().UpdateProgress(created.Id, 500, 2))
+	assert.Nil(t, store.SearchIndexJobs().Finish(created.Id, model.SearchIndexJobStatusFailed, model.SearchIndexJobActionReindex, 750, 2, "mapper_parsing_exception"))
+
+	jobs, _ := store.SearchIndexJobs().GetRecent(0, 10)
+	if assert.Len(t, jobs, 1) {
+		assert.Equal(t, model.SearchIndexJobStatusFailed, jobs[0].Status)
+		assert.Equal(t, 750, jobs[0].Processed)
+		assert.Equal(t, 2, jobs[0].Failed)
+		assert.Equal(t, "mapper_parsing_exception", *jobs[0].LastError)
+		assert.NotNil(t, jobs[0].CompletedDate)
+	}
+
+	retried, err := store.SearchIndexJobs().Retry(created.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, model.SearchIndexJobStatusPending, retried.Status)
+
+	claimed, _ := store.SearchIndexJobs().ClaimNext(time.Minute)
+	assert.Equal(t, created.Id, claimed.Id)
+	assert.Nil(t, claimed.LastError)
+
+}
+
+func TestIndexablePostsCanBeFilteredByDiscussion(t *testing.T) {
+
+	store, folder, user := seed()
+	open, _ := store.Discussions().Create(folder.Id, "Open", "", user.Id, false)
+	locked, _ := store.Discussions().Create(folder.Id, "Locked", "", user.Id, false)
+	store.Posts().Create(folder.Id, open.Id, "one", model.PostStatusOK, user.Id)
+	store.Posts().Create(folder.Id, open.Id, "two", model.PostStatusOK, user.Id)
+	store.Posts().Create(folder.Id, locked.Id, "three", model.PostStatusOK, user.Id)
+	store.Discussions().Lock(locked.Id, true)
+
+	posts := make([]*model.IndexablePost, 0)
+	err := store.Posts().ForEachIndexableIn(0, open.Id, func(post *model.IndexablePost) error {
+		posts = append(posts, post)
+		return nil
+	})
+	assert.Nil(t, err)
+	if assert.Len(t, posts, 2) {
+		assert.Equal(t, open.Id, posts[0].DiscussionId)
+		assert.Equal(t, folder.Id, posts[0].FolderId)
+	}
+
+	count := 0
+	store.Posts().ForEachIndexableIn(0, locked.Id, func(post *model.IndexablePost) error {
+		count++
+		return nil
+	})
+	assert.Equal(t, 0, count)
+
+}
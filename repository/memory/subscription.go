@@ -0,0 +1,387 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"sort"
+	"time"
+)
+
+type subscriptionRepository struct {
+	store *Store
+}
+
+func (d *dataset) folderSubscription(userId uint, folderId uint) (model.UserFolderSubscription, bool) {
+
+	for _, subscription := range d.folderSubs {
+		if subscription.UserId == userId && subscription.FolderId == folderId {
+			return subscription, true
+		}
+	}
+
+	return model.UserFolderSubscription{}, false
+
+}
+
+func (d *dataset) hasException(subscriptionId uint, discussionId uint) bool {
+
+	for _, exception := range d.exceptions {
+		if exception.SubscriptionId == subscriptionId && exception.DiscussionId == discussionId {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+func (d *dataset) deleteExceptions(subscriptionId uint, discussionId uint) {
+	for id, exception := range d.exceptions {
+		if exception.SubscriptionId == subscriptionId && (discussionId == 0 || exception.DiscussionId == discussionId) {
+			delete(d.exceptions, id)
+		}
+	}
+}
+
+func (d *dataset) isSubscribedToDiscussion(userId uint, discussionId uint) bool {
+
+	if _, exists := d.discussionSubs[pairKey{userId, discussionId}]; exists {
+		return true
+	}
+
+	subscription, exists := d.folderSubscription(userId, d.discussions[discussionId].FolderId)
+
+	return exists && !d.hasException(subscription.Id, discussionId)
+
+}
+
+func (d *dataset) inSubscriptionView(userId uint, entry *model.FrontPageEntry) bool {
+
+	if _, exists := d.discussionSubs[pairKey{userId, entry.DiscussionId}]; exists {
+		return true
+	}
+
+	subscription, exists := d.folderSubscription(userId, entry.FolderId)
+	if !exists || d.hasException(subscription.Id, entry.DiscussionId) {
+		return false
+	}
+
+	return entry.LastPostDate.After(subscription.LastReadDate) && d.unreadCount(entry) > 0
+
+}
+
+func (d *dataset) updateBookmark(userId uint, discussionId uint, postId uint, postNum int64, postDate time.Time) model.UserDiscussionBookmark {
+
+	key := pairKey{userId, discussionId}
+	now := time.Now().UTC()
+
+	bookmark, exists := d.bookmarks[key]
+	if !exists {
+		bookmark = model.UserDiscussionBookmark{
+			ModelBase: model.ModelBase{
+				Id:              d.nextId(),
+				CreatedDate:     now,
+				LastUpdatedDate: now,
+			},
+			DiscussionId:  discussionId,
+			UserId:        userId,
+			LastPostId:    postId,
+			LastPostCount: postNum,
+			LastPostDate:  postDate,
+		}
+	} else if postNum > bookmark.LastPostCount {
+		bookmark.Version++
+		bookmark.LastUpdatedDate = now
+		bookmark.LastPostId = postId
+		bookmark.LastPostCount = postNum
+		bookmark.LastPostDate = postDate
+	}
+
+	d.bookmarks[key] = bookmark
+
+	return bookmark
+
+}
+
+func (r *subscriptionRepository) IsSubscribedToDiscussion(userId uint, discussionId uint) (bool, error) {
+
+	var isSubscribed bool
+	r.store.read(func(d *dataset) {
+		isSubscribed = d.isSubscribedToDiscussion(userId, discussionId)
+	})
+
+	return isSubscribed, nil
+
+}
+
+func (r *subscriptionRepository) IsSubscribedToFolder(userId uint, folderId uint) (bool, error) {
+
+	var isSubscribed bool
+	r.store.read(func(d *dataset) {
+		_, isSubscribed = d.folderSubscription(userId, folderId)
+	})
+
+	return isSubscribed, nil
+
+}
+
+func (r *subscriptionRepository) SetDiscussionSubscription(userId uint, discussionId uint, subscribed bool) error {
+
+	r.store.write(func(d *dataset) {
+
+		key := pairKey{userId, discussionId}
+
+		if subscription, exists := d.folderSubscription(userId, d.discussions[discussionId].FolderId); exists {
+
+			d.deleteExceptions(subscription.Id, discussionId)
+
+			if !subscribed {
+				id := d.nextId()
+				d.exceptions[id] = model.UserFolderSubscriptionException{
+					ModelBase: model.ModelBase{
+						Id:          id,
+						Version:     1,
+						CreatedDate: time.Now().UTC(),
+					},
+					SubscriptionId: subscription.Id,
+					DiscussionId:   discussionId,
+				}
+			}
+
+		} else {
+
+			delete(d.discussionSubs, key)
+
+			if subscribed {
+				d.discussionSubs[key] = model.UserDiscussionSubscription{
+					UserId:       userId,
+					DiscussionId: discussionId,
+				}
+			}
+
+		}
+
+	})
+
+	return nil
+
+}
+
+func (r *subscriptionRepository) SetFolderSubscription(userId uint, folderId uint, subscribed bool) error {
+
+	r.store.write(func(d *dataset) {
+
+		if subscription, exists := d.folderSubscription(userId, folderId); exists {
+			d.deleteExceptions(subscription.Id, 0)
+			delete(d.folderSubs, subscription.Id)
+		}
+
+		if subscribed {
+			now := time.Now().UTC()
+			id := d.nextId()
+			d.folderSubs[id] = model.UserFolderSubscription{
+				ModelBase: model.ModelBase{
+					Id:          id,
+					Version:     1,
+					CreatedDate: now,
+				},
+				UserId:       userId,
+				FolderId:     folderId,
+				LastReadDate: now,
+			}
+		}
+
+	})
+
+	return nil
+
+}
+
+func (r *subscriptionRepository) DeleteDiscussionSubscription(userId uint, discussionId uint) error {
+
+	r.store.write(func(d *dataset) {
+		delete(d.discussionSubs, pairKey{userId, discussionId})
+	})
+
+	return nil
+
+}
+
+func (r *subscriptionRepository) DeleteFolderSubscription(userId uint, folderId uint) error {
+
+	r.store.write(func(d *dataset) {
+		if subscription, exists := d.folderSubscription(userId, folderId); exists {
+			d.deleteExceptions(subscription.Id, 0)
+			delete(d.folderSubs, subscription.Id)
+		}
+	})
+
+	return nil
+
+}
+
+func (r *subscriptionRepository) MarkDiscussionRead(userId uint, discussionId uint) error {
+
+	r.store.write(func(d *dataset) {
+		if discussion, exists := d.discussions[discussionId]; exists {
+			d.updateBookmark(userId, discussionId, discussion.LastPostId, discussion.PostCount, discussion.LastPostDate)
+		}
+	})
+
+	return nil
+
+}
+
+func (r *subscriptionRepository) MarkFolderSubscriptionRead(userId uint, subscriptionId uint) error {
+
+	r.store.write(func(d *dataset) {
+
+		subscription, exists := d.folderSubs[subscriptionId]
+		if !exists || subscription.UserId != userId {
+			return
+		}
+
+		for _, discussion := range d.discussions {
+			if discussion.FolderId == subscription.FolderId && discussion.LastPostDate.After(subscription.LastReadDate) && discussion.PostCount > 0 {
+				d.updateBookmark(userId, discussion.Id, discussion.LastPostId, discussion.PostCount, discussion.LastPostDate)
+			}
+		}
+
+		subscription.LastReadDate = time.Now().UTC()
+		d.folderSubs[subscriptionId] = subscription
+
+	})
+
+	return nil
+
+}
+
+func (r *subscriptionRepository) GetDiscussionSubscriptions(userId uint) ([]*model.FrontPageEntry, error) {
+
+	subscriptions := make([]*model.FrontPageEntry, 0)
+	r.store.read(func(d *dataset) {
+		for key := range d.discussionSubs {
+
+			if key.userId != userId {
+				continue
+			}
+
+			discussion, exists := d.discussions[key.otherId]
+			if !exists {
+				continue
+			}
+
+			folder := d.folders[discussion.FolderId]
+			isAdmin := folder.Type != model.FolderTypeNormal
+			subscriptions = append(subscriptions, d.frontPageEntry(model.FrontPageEntry{
+				DiscussionId:    discussion.Id,
+				DiscussionTitle: discussion.Title,
+				FolderId:        folder.Id,
+				FolderKey:       folder.Key,
+				FolderTitle:     folder.Description,
+				LastPostId:      discussion.LastPostId,
+				LastPostDate:    discussion.LastPostDate,
+				PostCount:       discussion.PostCount,
+				IsAdmin:         &isAdmin,
+			}, userId))
+
+		}
+	})
+
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].DiscussionId < subscriptions[j].DiscussionId
+	})
+
+	return subscriptions, nil
+
+}
+
+func (r *subscriptionRepository) GetFolderSubscriptions(userId uint) ([]*model.UserFolderSubscription, error) {
+
+	subscriptions := make([]*model.UserFolderSubscription, 0)
+	r.store.read(func(d *dataset) {
+		for _, subscription := range d.folderSubs {
+			if subscription.UserId == userId {
+				s := subscription
+				subscriptions = append(subscriptions, &s)
+			}
+		}
+	})
+
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].Id < subscriptions[j].Id
+	})
+
+	return subscriptions, nil
+
+}
+
+func (r *subscriptionRepository) GetFolderSubscriptionExceptions(userId uint) ([]*model.UserFolderSubscriptionException, error) {
+
+	exceptions := make([]*model.UserFolderSubscriptionException, 0)
+	r.store.read(func(d *dataset) {
+		for _, exception := range d.exceptions {
+			if d.folderSubs[exception.SubscriptionId].UserId == userId {
+				e := exception
+				exceptions = append(exceptions, &e)
+			}
+		}
+	})
+
+	sort.Slice(exceptions, func(i, j int) bool {
+		return exceptions[i].Id < exceptions[j].Id
+	})
+
+	return exceptions, nil
+
+}
+
+func (r *subscriptionRepository) GetBookmark(userId uint, discussionId uint) (*model.UserDiscussionBookmark, error) {
+
+	var bookmark *model.UserDiscussionBookmark
+	err := repository.ErrNotFound
+	r.store.read(func(d *dataset) {
+		if existing, exists := d.bookmarks[pairKey{userId, discussionId}]; exists {
+			bookmark, err = &existing, nil
+		}
+	})
+
+	return bookmark, err
+
+}
+
+func (r *subscriptionRepository) UpdateBookmark(userId uint, discussionId uint, postId uint, postNum int64, postDate time.Time) (*model.UserDiscussionBookmark, error) {
+
+	var bookmark model.UserDiscussionBookmark
+	r.store.write(func(d *dataset) {
+		bookmark = d.updateBookmark(userId, discussionId, postId, postNum, postDate)
+	})
+
+	return &bookmark, nil
+
+}
+
+func (r *subscriptionRepository) DeleteBookmark(userId uint, discussionId uint) error {
+
+	r.store.write(func(d *dataset) {
+		delete(d.bookmarks, pairKey{userId, discussionId})
+	})
+
+	return nil
+
+}
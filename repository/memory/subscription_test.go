@@ -0,0 +1,99 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnsubscribingFromAFolderDiscussionAddsAnException(t *testing.T) {
+
+	store, folder, user := seed()
+	discussion, _ := store.Discussions().Create(folder.Id, "Subscriptions", "", user.Id, false)
+
+	store.Subscriptions().SetFolderSubscription(user.Id, folder.Id, true)
+
+	isSubscribed, _ := store.Subscriptions().IsSubscribedToDiscussion(user.Id, discussion.Id)
+	assert.True(t, isSubscribed)
+
+	store.Subscriptions().SetDiscussionSubscription(user.Id, discussion.Id, false)
+
+	isSubscribed, _ = store.Subscriptions().IsSubscribedToDiscussion(user.Id, discussion.Id)
+	assert.False(t, isSubscribed)
+
+	exceptions, _ := store.Subscriptions().GetFolderSubscriptionExceptions(user.Id)
+	assert.Len(t, exceptions, 1)
+
+	store.Subscriptions().SetDiscussionSubscription(user.Id, discussion.Id, true)
+
+	exceptions, _ = store.Subscriptions().GetFolderSubscriptionExceptions(user.Id)
+	assert.Len(t, exceptions, 0)
+
+}
+
+func TestSubscriptionsViewListsUnreadDiscussions(t *testing.T) {
+
+	store, folder, user := seed()
+	other := store.AddUser(&model.User{Username: "bob"})
+	discussion, _ := store.Discussions().Create(folder.Id, "Unread", "", other.Id, false)
+
+	store.Subscriptions().SetDiscussionSubscription(user.Id, discussion.Id, true)
+	store.Posts().Create(folder.Id, discussion.Id, "news", model.PostStatusOK, other.Id)
+
+	entries, err := store.Discussions().GetFrontPage(repository.FrontPageViewSubscriptions, user.Id, false, 0, 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, int64(0), entries[0].LastPostReadCount)
+
+	store.Subscriptions().MarkDiscussionRead(user.Id, discussion.Id)
+
+	entries, _ = store.Discussions().GetFrontPage(repository.FrontPageViewSubscriptions, user.Id, false, 0, 10)
+	assert.Equal(t, int64(1), entries[0].LastPostReadCount)
+
+}
+
+func TestBookmarksOnlyMoveForwards(t *testing.T) {
+
+	store, folder, user := seed()
+	discussion, _ := store.Discussions().Create(folder.Id, "Bookmarks", "", user.Id, false)
+	post, _ := store.Posts().Create(folder.Id, discussion.Id, "post", model.PostStatusOK, user.Id)
+
+	store.Subscriptions().UpdateBookmark(user.Id, discussion.Id, post.Id, 5, post.CreatedDate)
+	bookmark, err := store.Subscriptions().UpdateBookmark(user.Id, discussion.Id, post.Id, 2, post.CreatedDate)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), bookmark.LastPostCount)
+
+}
+
+func TestPostSubscribersIncludeFolderSubscribers(t *testing.T) {
+
+	store, folder, user := seed()
+	other := store.AddUser(&model.User{Username: "bob"})
+	discussion, _ := store.Discussions().Create(folder.Id, "Subscribers", "", user.Id, false)
+	post, _ := store.Posts().Create(folder.Id, discussion.Id, "post", model.PostStatusOK, user.Id)
+
+	store.Subscriptions().MarkDiscussionRead(user.Id, discussion.Id)
+	store.Subscriptions().SetFolderSubscription(other.Id, folder.Id, true)
+
+	subscribers, err := store.Posts().GetSubscribers(post.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint{user.Id, other.Id}, subscribers)
+
+}
@@ -0,0 +1,859 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"fmt"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"sort"
+	"strings"
+	"time"
+)
+
+type userRepository struct {
+	store *Store
+}
+
+func (d *dataset) getUser(userId uint) (*model.User, error) {
+
+	user, exists := d.users[userId]
+	if !exists {
+		return nil, repository.ErrNotFound
+	}
+
+	return &user, nil
+
+}
+
+func (d *dataset) updateUser(userId uint, fn func(user *model.User)) (*model.User, error) {
+
+	user, exists := d.users[userId]
+	if !exists {
+		return nil, repository.ErrNotFound
+	}
+
+	fn(&user)
+	user.LastUpdatedDate = time.Now().UTC()
+	d.users[userId] = user
+
+	return d.getUser(userId)
+
+}
+
+func (d *dataset) ignoredUsers(userId uint) []*model.IgnoredUser {
+
+	ignored := make([]*model.IgnoredUser, 0)
+	for _, entry := range d.ignored {
+		if entry.UserId == userId {
+			e := entry
+			e.IgnoredUserName = d.users[e.IgnoredUserId].Username
+			ignored = append(ignored, &e)
+		}
+	}
+
+	sort.Slice(ignored, func(i, j int) bool {
+		return ignored[i].Id < ignored[j].Id
+	})
+
+	return ignored
+
+}
+
+func searchResult(user model.User) *model.UserSearchResults {
+	return &model.UserSearchResults{
+		ModelBase:       user.ModelBase,
+		LastLoginDate:   user.LastLoginDate,
+		Username:        user.Username,
+		Email:           user.Email,
+		AccountExpired:  user.AccountExpired,
+		AccountLocked:   user.AccountLocked,
+		Enabled:         user.Enabled,
+		IsAdmin:         user.IsAdmin,
+		IsPremoderate:   user.IsPremoderate,
+		IsWatch:         user.IsWatch,
+		IsEmailVerified: user.IsEmailVerified,
+	}
+}
+
+func (r *userRepository) findUsers(match func(user *model.User) bool) []*model.UserSearchResults {
+
+	results := make([]*model.UserSearchResults, 0)
+	r.store.read(func(d *dataset) {
+		for _, user := range d.users {
+			if match(&user) {
+				result := searchResult(user)
+				for _, note := range d.modNotes {
+					if note.UserId == user.Id {
+						result.ModNoteCount++
+					}
+				}
+				results = append(results, result)
+			}
+		}
+	})
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Username < results[j].Username
+	})
+
+	return results
+
+}
+
+func (r *userRepository) findUser(match func(user *model.User) bool) (*model.User, error) {
+
+	var user *model.User
+	err := repository.ErrNotFound
+	r.store.read(func(d *dataset) {
+		for _, candidate := range d.users {
+			if match(&candidate) {
+				user, err = d.getUser(candidate.Id)
+				return
+			}
+		}
+	})
+
+	return user, err
+
+}
+
+func (r *userRepository) update(userId uint, fn func(user *model.User)) (*model.User, error) {
+
+	var user *model.User
+	var err error
+	r.store.write(func(d *dataset) {
+		user, err = d.updateUser(userId, fn)
+	})
+
+	return user, err
+
+}
+
+func (r *userRepository) Get(userId uint) (*model.User, error) {
+
+	var user *model.User
+	var err error
+	r.store.read(func(d *dataset) {
+		user, err = d.getUser(userId)
+	})
+
+	return user, err
+
+}
+
+func (r *userRepository) FindByCredentials(username string, passwordHash string) (*model.User, error) {
+	return r.findUser(func(user *model.User) bool {
+		return (user.Username == username || user.Email == username) && user.Password == passwordHash
+	})
+}
+
+func (r *userRepository) FindByEmail(email string) (*model.User, error) {
+	return r.findUser(func(user *model.User) bool {
+		return user.Email == email
+	})
+}
+
+func (r *userRepository) CountByUsernameOrEmail(username string, email string) (int64, error) {
+
+	var count int64
+	r.store.read(func(d *dataset) {
+		for _, user := range d.users {
+			if user.Username == username || user.Email == email {
+				count++
+			}
+		}
+	})
+
+	return count, nil
+
+}
+
+func (r *userRepository) Create(email string, username string, passwordHash string) (*model.User, error) {
+
+	var user *model.User
+	var err error
+	r.store.write(func(d *dataset) {
+
+		now := time.Now().UTC()
+		created := model.User{
+			ModelBase: model.ModelBase{
+				Id:              d.nextId(),
+				Version:         1,
+				CreatedDate:     now,
+				LastUpdatedDate: now,
+			},
+			Username:      username,
+			Email:         email,
+			Password:      passwordHash,
+			AccountLocked: true,
+			Enabled:       true,
+			IsWatch:       true,
+			AutoSubscribe: true,
+			ViewType:      "latest",
+		}
+		d.users[created.Id] = created
+
+		user, err = d.getUser(created.Id)
+
+	})
+
+	return user, err
+
+}
+
+func (r *userRepository) UpdatePassword(userId uint, passwordHash string) (*model.User, error) {
+	return r.update(userId, func(user *model.User) {
+		user.Password = passwordHash
+	})
+}
+
+func (r *userRepository) UpdateLastLogin(userId uint, loginDate time.Time) error {
+
+	_, err := r.update(userId, func(user *model.User) {
+		user.LastLoginDate = loginDate
+	})
+
+	return err
+
+}
+
+func (r *userRepository) UpdateAutoSubscribe(userId uint, state int) (*model.User, error) {
+	return r.update(userId, func(user *model.User) {
+		user.AutoSubscribe = state != 0
+	})
+}
+
+func (r *userRepository) UpdateSortFoldersByActivity(userId uint, state int) (*model.User, error) {
+	return r.update(userId, func(user *model.User) {
+		user.SortFoldersByActivity = state != 0
+	})
+}
+
+func (r *userRepository) UpdateSubscriptionFetchOrder(userId uint, fetchOrder int) (*model.User, error) {
+	return r.update(userId, func(user *model.User) {
+		user.SubscriptionFetchOrder = fetchOrder
+	})
+}
+
+func (r *userRepository) UpdateBio(userId uint, bio string) (*model.User, error) {
+	return r.update(userId, func(user *model.User) {
+		user.Bio = bio
+	})
+}
+
+func (r *userRepository) UpdateViewType(userId uint, viewType string) (*model.User, error) {
+	return r.update(userId, func(user *model.User) {
+		user.ViewType = viewType
+	})
+}
+
+func (r *userRepository) SetFlag(userId uint, flag repository.UserFlag, value bool) error {
+
+	var set func(user *model.User)
+	switch flag {
+	case repository.UserFlagEnabled:
+		set = func(user *model.User) { user.Enabled = value }
+	case repository.UserFlagLocked:
+		set = func(user *model.User) { user.AccountLocked = value }
+	case repository.UserFlagPremoderate:
+		set = func(user *model.User) { user.IsPremoderate = value }
+	case repository.UserFlagWatch:
+		set = func(user *model.User) { user.IsWatch = value }
+	default:
+		return fmt.Errorf("unknown user flag: %s", flag)
+	}
+
+	_, err := r.update(userId, set)
+
+	return err
+
+}
+
+func (r *userRepository) GetIgnoredUsers(userId uint) ([]*model.IgnoredUser, error) {
+
+	var ignored []*model.IgnoredUser
+	r.store.read(func(d *dataset) {
+		ignored = d.ignoredUsers(userId)
+	})
+
+	return ignored, nil
+
+}
+
+func (r *userRepository) SetIgnored(userId uint, ignoredUserId uint, ignored bool) ([]*model.IgnoredUser, error) {
+
+	var ignoredUsers []*model.IgnoredUser
+	r.store.write(func(d *dataset) {
+
+		var existingId uint
+		for id, entry := range d.ignored {
+			if entry.UserId == userId && entry.IgnoredUserId == ignoredUserId {
+				existingId = id
+			}
+		}
+
+		if !ignored && existingId != 0 {
+			delete(d.ignored, existingId)
+		} else if ignored && existingId == 0 {
+			id := d.nextId()
+			d.ignored[id] = model.IgnoredUser{
+				ModelBase: model.ModelBase{
+					Id:          id,
+					Version:     1,
+					CreatedDate: time.Now().UTC(),
+				},
+				UserId:        userId,
+				IgnoredUserId: ignoredUserId,
+			}
+		}
+
+		ignoredUsers = d.ignoredUsers(userId)
+
+	})
+
+	return ignoredUsers, nil
+
+}
+
+func (r *userRepository) Search(searchTerm string) ([]*model.UserSearchResults, error) {
+
+	searchTerm = strings.ToLower(searchTerm)
+
+	return r.findUsers(func(user *model.User) bool {
+		return strings.Contains(strings.ToLower(user.Username), searchTerm)
+	}), nil
+
+}
+
+func (r *userRepository) Filter(filter repository.UserFilter) ([]*model.UserSearchResults, error) {
+
+	var match func(user *model.User) bool
+	switch filter {
+	case repository.UserFilterPremoderate:
+		match = func(user *model.User) bool { return user.IsPremoderate }
+	case repository.UserFilterWatch:
+		match = func(user *model.User) bool { return user.IsWatch }
+	case repository.UserFilterLocked:
+		match = func(user *model.User) bool { return user.AccountLocked }
+	case repository.UserFilterRecent:
+		since := time.Now().UTC().AddDate(0, 0, -30)
+		match = func(user *model.User) bool {
+			return !user.LastLoginDate.IsZero() && user.CreatedDate.After(since)
+		}
+	default:
+		return nil, fmt.Errorf("unknown user filter: %s", filter)
+	}
+
+	return r.findUsers(match), nil
+
+}
+
+func (r *userRepository) CreateLoginHistory(history *model.LoginHistory) error {
+
+	r.store.write(func(d *dataset) {
+		history.Id = d.nextId()
+		d.loginHistory = append(d.loginHistory, *history)
+	})
+
+	return nil
+
+}
+
+func (r *userRepository) CreateHistory(history *model.UserHistory) error {
+
+	r.store.write(func(d *dataset) {
+		history.Id = d.nextId()
+		d.history = append(d.history, *history)
+	})
+
+	return nil
+
+}
+
+func (r *userRepository) GetHistory(userId uint) ([]*model.UserHistory, error) {
+
+	results := make([]*model.UserHistory, 0)
+	since := time.Now().UTC().AddDate(0, 0, -90)
+	r.store.read(func(d *dataset) {
+		for _, history := range d.history {
+			if history.UserId == userId && history.CreatedDate.After(since) {
+				h := history
+				results = append(results, &h)
+			}
+		}
+	})
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].CreatedDate.After(results[j].CreatedDate)
+	})
+
+	return results, nil
+
+}
+
+func (d *dataset) getModNote(noteId uint) (*model.UserModNote, error) {
+
+	note, exists := d.modNotes[noteId]
+	if !exists {
+		return nil, repository.ErrNotFound
+	}
+
+	note.Moderator = d.users[note.ModeratorId].Username
+
+	return &note, nil
+
+}
+
+func (r *userRepository) GetModNotes(userId uint) ([]*model.UserModNote, error) {
+
+	results := make([]*model.UserModNote, 0)
+	r.store.read(func(d *dataset) {
+		for _, note := range d.modNotes {
+			if note.UserId == userId {
+				n, _ := d.getModNote(note.Id)
+				results = append(results, n)
+			}
+		}
+	})
+
+	sort.Slice(results, func(i, j int) bool {
+		if !results[i].CreatedDate.Equal(results[j].CreatedDate) {
+			return results[i].CreatedDate.After(results[j].CreatedDate)
+		}
+		return results[i].Id > results[j].Id
+	})
+
+	return results, nil
+
+}
+
+func (r *userRepository) GetModNote(noteId uint) (*model.UserModNote, error) {
+
+	var note *model.UserModNote
+	var err error
+	r.store.read(func(d *dataset) {
+		note, err = d.getModNote(noteId)
+	})
+
+	return note, err
+
+}
+
+func (r *userRepository) CreateModNote(userId uint, moderatorId uint, text string) (*model.UserModNote, error) {
+
+	var note *model.UserModNote
+	var err error
+	r.store.write(func(d *dataset) {
+
+		now := time.Now().UTC()
+		id := d.nextId()
+		d.modNotes[id] = model.UserModNote{
+			ModelBase: model.ModelBase{
+				Id:              id,
+				Version:         1,
+				CreatedDate:     now,
+				LastUpdatedDate: now,
+			},
+			UserId:      userId,
+			ModeratorId: moderatorId,
+			Note:        text,
+		}
+
+		note, err = d.getModNote(id)
+
+	})
+
+	return note, err
+
+}
+
+func (r *userRepository) UpdateModNote(noteId uint, text string) (*model.UserModNote, error) {
+
+	var note *model.UserModNote
+	err := repository.ErrNotFound
+	r.store.write(func(d *dataset) {
+
+		existing, exists := d.modNotes[noteId]
+		if !exists {
+			return
+		}
+
+		existing.Note = text
+		existing.Version++
+		existing.LastUpdatedDate = time.Now().UTC()
+		d.modNotes[noteId] = existing
+
+		note, err = d.getModNote(noteId)
+
+	})
+
+	return note, err
+
+}
+
+func (r *userRepository) DeleteModNote(noteId uint) error {
+
+	r.store.write(func(d *dataset) {
+		delete(d.modNotes, noteId)
+	})
+
+	return nil
+
+}
+
+func (r *userRepository) CreateSearchHistory(history *model.SearchHistory) error {
+
+	r.store.write(func(d *dataset) {
+		history.Id = d.nextId()
+		d.searchHistory = append(d.searchHistory, *history)
+	})
+
+	return nil
+
+}
+
+func (r *userRepository) GetSearchHistory(userId uint, pageStart int, pageSize int) ([]*model.SearchHistory, error) {
+
+	results := make([]*model.SearchHistory, 0)
+	r.store.read(func(d *dataset) {
+		for _, history := range d.searchHistory {
+			if history.UserId == userId {
+				h := history
+				results = append(results, &h)
+			}
+		}
+	})
+
+	sort.Slice(results, func(i, j int) bool {
+		if !results[i].CreatedDate.Equal(results[j].CreatedDate) {
+			return results[i].CreatedDate.After(results[j].CreatedDate)
+		}
+		return results[i].Id > results[j].Id
+	})
+
+	if pageStart >= len(results) {
+		return make([]*model.SearchHistory, 0), nil
+	}
+
+	end := pageStart + pageSize
+	if end > len(results) {
+		end = len(results)
+	}
+
+	return results[pageStart:end], nil
+
+}
+
+func (r *userRepository) DeleteSearchHistory(userId uint) error {
+
+	r.store.write(func(d *dataset) {
+		kept := make([]model.SearchHistory, 0, len(d.searchHistory))
+		for _, history := range d.searchHistory {
+			if history.UserId != userId {
+				kept = append(kept, history)
+			}
+		}
+		d.searchHistory = kept
+	})
+
+	return nil
+
+}
+
+// searchHistoryBetween returns the searches made from from up to to
+func (d *dataset) searchHistoryBetween(from time.Time, to time.Time) []model.SearchHistory {
+
+	results := make([]model.SearchHistory, 0)
+	for _, history := range d.searchHistory {
+		if !history.CreatedDate.Before(from) && history.CreatedDate.Before(to) {
+			results = append(results, history)
+		}
+	}
+
+	return results
+
+}
+
+func (r *userRepository) GetTopSearches(from time.Time, to time.Time, zeroResultsOnly bool, limit int) ([]*model.SearchQueryCount, error) {
+
+	counts := make(map[string]*model.SearchQueryCount)
+	users := make(map[string]map[uint]bool)
+	r.store.read(func(d *dataset) {
+		for _, history := range d.searchHistoryBetween(from, to) {
+
+			if zeroResultsOnly && (history.ResultCount == nil || *history.ResultCount != 0) {
+				continue
+			}
+
+			query := strings.ToLower(history.Query)
+			count, exists := counts[query]
+			if !exists {
+				count = &model.SearchQueryCount{Query: query}
+				counts[query] = count
+				users[query] = make(map[uint]bool)
+			}
+
+			count.Count++
+			users[query][history.UserId] = true
+			if history.CreatedDate.After(count.LastDate) {
+				count.LastDate = history.CreatedDate
+			}
+
+		}
+	})
+
+	results := make([]*model.SearchQueryCount, 0, len(counts))
+	for query, count := range counts {
+		count.Users = len(users[query])
+		results = append(results, count)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Count != results[j].Count {
+			return results[i].Count > results[j].Count
+		}
+		return results[i].LastDate.After(results[j].LastDate)
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+
+}
+
+func (r *userRepository) GetSearchesPerDay(from time.Time, to time.Time) ([]*model.SearchDayCount, error) {
+
+	counts := make(map[time.Time]*model.SearchDayCount)
+	users := make(map[time.Time]map[uint]bool)
+	r.store.read(func(d *dataset) {
+		for _, history := range d.searchHistoryBetween(from, to) {
+
+			date := history.CreatedDate.UTC()
+			day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+			count, exists := counts[day]
+			if !exists {
+				count = &model.SearchDayCount{Day: day}
+				counts[day] = count
+				users[day] = make(map[uint]bool)
+			}
+
+			count.Count++
+			users[day][history.UserId] = true
+			if history.ResultCount != nil && *history.ResultCount == 0 {
+				count.ZeroResults++
+			}
+
+		}
+	})
+
+	results := make([]*model.SearchDayCount, 0, len(counts))
+	for day, count := range counts {
+		count.Users = len(users[day])
+		results = append(results, count)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Day.Before(results[j].Day)
+	})
+
+	return results, nil
+
+}
+
+func (r *userRepository) GetTopSearchers(from time.Time, to time.Time, limit int) ([]*model.SearchUserCount, error) {
+
+	counts := make(map[uint]*model.SearchUserCount)
+	queries := make(map[uint]map[string]bool)
+	addresses := make(map[uint]map[string]bool)
+	r.store.read(func(d *dataset) {
+		for _, history := range d.searchHistoryBetween(from, to) {
+
+			count, exists := counts[history.UserId]
+			if !exists {
+				count = &model.SearchUserCount{UserId: history.UserId, Username: d.users[history.UserId].Username}
+				counts[history.UserId] = count
+				queries[history.UserId] = make(map[string]bool)
+				addresses[history.UserId] = make(map[string]bool)
+			}
+
+			count.Count++
+			queries[history.UserId][strings.ToLower(history.Query)] = true
+			addresses[history.UserId][history.IPAddress] = true
+			if history.CreatedDate.After(count.LastDate) {
+				count.LastDate = history.CreatedDate
+			}
+
+		}
+	})
+
+	results := make([]*model.SearchUserCount, 0, len(counts))
+	for userId, count := range counts {
+		count.DistinctQueries = len(queries[userId])
+		count.IPAddresses = len(addresses[userId])
+		results = append(results, count)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Count != results[j].Count {
+			return results[i].Count > results[j].Count
+		}
+		return results[i].LastDate.After(results[j].LastDate)
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+
+}
+
+func (r *userRepository) CreateSignupConfirmation(userId uint, confirmationKey string) (*model.SignupConfirmation, error) {
+
+	var confirmation model.SignupConfirmation
+	err := repository.ErrNotFound
+	r.store.write(func(d *dataset) {
+
+		user, exists := d.users[userId]
+		if !exists {
+			return
+		}
+
+		now := time.Now().UTC()
+		confirmation = model.SignupConfirmation{
+			Id:              d.nextId(),
+			Version:         1,
+			CreatedDate:     now,
+			LastUpdatedDate: now,
+			UserId:          userId,
+			ConfirmationKey: confirmationKey,
+			Username:        user.Username,
+		}
+		d.signups[confirmation.Id] = confirmation
+		err = nil
+
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &confirmation, nil
+
+}
+
+func (r *userRepository) FindSignupConfirmation(confirmationKey string) (*model.SignupConfirmation, error) {
+
+	var confirmation *model.SignupConfirmation
+	err := repository.ErrNotFound
+	r.store.read(func(d *dataset) {
+		for _, candidate := range d.signups {
+			if candidate.ConfirmationKey == confirmationKey && candidate.IPAddress == "" {
+				c := candidate
+				confirmation, err = &c, nil
+				return
+			}
+		}
+	})
+
+	return confirmation, err
+
+}
+
+func (r *userRepository) AcceptSignupConfirmation(confirmationId uint, ipAddress string) (*model.User, error) {
+
+	var user *model.User
+	err := repository.ErrNotFound
+	r.store.write(func(d *dataset) {
+
+		confirmation, exists := d.signups[confirmationId]
+		if !exists {
+			return
+		}
+
+		confirmation.IPAddress = ipAddress
+		confirmation.LastUpdatedDate = time.Now().UTC()
+		d.signups[confirmationId] = confirmation
+
+		user, err = d.updateUser(confirmation.UserId, func(user *model.User) {
+			user.AccountLocked = false
+			user.IsEmailVerified = true
+		})
+
+	})
+
+	return user, err
+
+}
+
+func (r *userRepository) CreatePasswordResetRequest(userId uint, ipAddress string, resetKey string) (*model.PasswordResetRequest, error) {
+
+	var request model.PasswordResetRequest
+	r.store.write(func(d *dataset) {
+
+		for id, existing := range d.resets {
+			if existing.UserId == userId {
+				delete(d.resets, id)
+			}
+		}
+
+		request = model.PasswordResetRequest{
+			Id:          d.nextId(),
+			Version:     1,
+			CreatedDate: time.Now().UTC(),
+			UserId:      userId,
+			ResetKey:    resetKey,
+			IPAddress:   ipAddress,
+			Username:    d.users[userId].Username,
+		}
+		d.resets[request.Id] = request
+
+	})
+
+	return &request, nil
+
+}
+
+func (r *userRepository) FindPasswordResetRequest(resetKey string) (*model.PasswordResetRequest, error) {
+
+	var request *model.PasswordResetRequest
+	err := repository.ErrNotFound
+	r.store.read(func(d *dataset) {
+		for _, candidate := range d.resets {
+			if candidate.ResetKey == resetKey {
+				c := candidate
+				request, err = &c, nil
+				return
+			}
+		}
+	})
+
+	return request, err
+
+}
+
+func (r *userRepository) DeletePasswordResetRequest(requestId uint) error {
+
+	r.store.write(func(d *dataset) {
+		delete(d.resets, requestId)
+	})
+
+	return nil
+
+}
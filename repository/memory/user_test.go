@@ -0,0 +1,131 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"justthetalk/model"
+	"justthetalk/repository"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignupConfirmationUnlocksTheAccount(t *testing.T) {
+
+	store := NewStore()
+
+	user, err := store.Users().Create("carol@example.com", "carol", "hash")
+	assert.Nil(t, err)
+	assert.True(t, user.AccountLocked)
+
+	_, err = store.Users().CreateSignupConfirmation(user.Id, "key")
+	assert.Nil(t, err)
+
+	confirmation, err := store.Users().FindSignupConfirmation("key")
+	assert.Nil(t, err)
+
+	accepted, err := store.Users().AcceptSignupConfirmation(confirmation.Id, "127.0.0.1")
+	assert.Nil(t, err)
+	assert.False(t, accepted.AccountLocked)
+	assert.True(t, accepted.IsEmailVerified)
+
+	_, err = store.Users().FindSignupConfirmation("key")
+	assert.Equal(t, repository.ErrNotFound, err)
+
+}
+
+func TestFindByCredentialsMatchesUsernameOrEmail(t *testing.T) {
+
+	store := NewStore()
+	store.AddUser(&model.User{Username: "dave", Email: "dave@example.com", Password: "hash"})
+
+	_, err := store.Users().FindByCredentials("dave", "hash")
+	assert.Nil(t, err)
+
+	_, err = store.Users().FindByCredentials("dave@example.com", "hash")
+	assert.Nil(t, err)
+
+	_, err = store.Users().FindByCredentials("dave", "wrong")
+	assert.Equal(t, repository.ErrNotFound, err)
+
+}
+
+func TestPasswordResetReplacesEarlierRequests(t *testing.T) {
+
+	store, _, user := seed()
+
+	store.Users().CreatePasswordResetRequest(user.Id, "127.0.0.1", "first")
+	store.Users().CreatePasswordResetRequest(user.Id, "127.0.0.1", "second")
+
+	_, err := store.Users().FindPasswordResetRequest("first")
+	assert.Equal(t, repository.ErrNotFound, err)
+
+	request, err := store.Users().FindPasswordResetRequest("second")
+	assert.Nil(t, err)
+	assert.Equal(t, user.Id, request.UserId)
+
+}
+
+func TestFilterUsersByFlag(t *testing.T) {
+
+	store, _, user := seed()
+	store.AddUser(&model.User{Username: "eve"})
+
+	assert.Nil(t, store.Users().SetFlag(user.Id, repository.UserFlagPremoderate, true))
+
+	results, err := store.Users().Filter(repository.UserFilterPremoderate)
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "alice", results[0].Username)
+
+	_, err = store.Users().Filter(repository.UserFilter("nonsense"))
+	assert.NotNil(t, err)
+
+}
+
+func TestModNotesAreCountedInSearchResults(t *testing.T) {
+
+	store := NewStore()
+	moderator := store.AddUser(&model.User{Username: "mod", Email: "mod@example.com", Enabled: true, IsAdmin: true})
+	user := store.AddUser(&model.User{Username: "dave", Email: "dave@example.com", Enabled: true})
+
+	first, err := store.Users().CreateModNote(user.Id, moderator.Id, "warned about spamming")
+	assert.Nil(t, err)
+	assert.Equal(t, "mod", first.Moderator)
+	second, _ := store.Users().CreateModNote(user.Id, moderator.Id, "second warning")
+
+	updated, err := store.Users().UpdateModNote(first.Id, "warned about spam links")
+	assert.Nil(t, err)
+	assert.Equal(t, uint(2), updated.Version)
+
+	_, err = store.Users().UpdateModNote(second.Id+100, "missing")
+	assert.Equal(t, repository.ErrNotFound, err)
+
+	notes, _ := store.Users().GetModNotes(user.Id)
+	if assert.Len(t, notes, 2) {
+		assert.Equal(t, second.Id, notes[0].Id, "newest first")
+	}
+
+	results, _ := store.Users().Search("dave")
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, 2, results[0].ModNoteCount)
+	}
+
+	assert.Nil(t, store.Users().DeleteModNote(second.Id))
+	results, _ = store.Users().Search("dave")
+	assert.Equal(t, 1, results[0].ModNoteCount)
+
+}
@@ -0,0 +1,114 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package storedproc
+
+import (
+	"context"
+	"errors"
+	"justthetalk/repository"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type Repository struct {
+	db *gorm.DB
+}
+
+type Provider struct {
+	db *gorm.DB
+}
+
+func New(db *gorm.DB) *Repository {
+	return &Repository{
+		db: db,
+	}
+}
+
+func NewProvider(db *gorm.DB) *Provider {
+	return &Provider{
+		db: db,
+	}
+}
+
+func (p *Provider) WithRepository(timeout time.Duration, fn func(repo repository.Repository)) {
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
+	defer cancelFn()
+
+	fn(New(p.db.WithContext(ctx)))
+
+}
+
+func (r *Repository) Folders() repository.FolderRepository {
+	return &folderRepository{db: r.db}
+}
+
+func (r *Repository) Discussions() repository.DiscussionRepository {
+	return &discussionRepository{db: r.db}
+}
+
+func (r *Repository) Posts() repository.PostRepository {
+	return &postRepository{db: r.db}
+}
+
+func (r *Repository) Users() repository.UserRepository {
+	return &userRepository{db: r.db}
+}
+
+func (r *Repository) Subscriptions() repository.SubscriptionRepository {
+	return &subscriptionRepository{db: r.db}
+}
+
+func (r *Repository) Moderation() repository.ModerationRepository {
+	return &moderationRepository{db: r.db}
+}
+
+func (r *Repository) Outbox() repository.OutboxRepository {
+	return &outboxRepository{db: r.db}
+}
+
+func (r *Repository) SearchIndexJobs() repository.SearchIndexJobRepository {
+	return &searchIndexJobRepository{db: r.db}
+}
+
+func (r *Repository) ContentScanJobs() repository.ContentScanJobRepository {
+	return &contentScanJobRepository{db: r.db}
+}
+
+func (r *Repository) SavedSearches() repository.SavedSearchRepository {
+	return &savedSearchRepository{db: r.db}
+}
+
+func (r *Repository) Transaction(fn func(tx repository.Repository) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return fn(New(tx))
+	})
+}
+
+func translateError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return repository.ErrNotFound
+	}
+	return err
+}
+
+func boolParam(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
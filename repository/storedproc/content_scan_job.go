@@ -0,0 +1,79 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package storedproc
+
+import (
+	"justthetalk/model"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type contentScanJobRepository struct {
+	db *gorm.DB
+}
+
+func (r *contentScanJobRepository) Create(userId uint, from time.Time, to time.Time) (*model.ContentScanJob, error) {
+
+	var job model.ContentScanJob
+	if result := r.db.Raw("call create_content_scan_job(?, ?, ?)", userId, from, to).First(&job); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &job, nil
+
+}
+
+func (r *contentScanJobRepository) Get(jobId uint) (*model.ContentScanJob, error) {
+
+	var job model.ContentScanJob
+	if result := r.db.Raw("call get_content_scan_job(?)", jobId).First(&job); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &job, nil
+
+}
+
+func (r *contentScanJobRepository) ClaimNext(staleAfter time.Duration) (*model.ContentScanJob, error) {
+
+	var job model.ContentScanJob
+	if result := r.db.Raw("call claim_content_scan_job(?)", int(staleAfter.Seconds())).First(&job); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &job, nil
+
+}
+
+func (r *contentScanJobRepository) UpdateProgress(jobId uint, lastPostId uint, scanned int, matched int) error {
+	return r.db.Exec("call update_content_scan_job_progress(?, ?, ?, ?)", jobId, lastPostId, scanned, matched).Error
+}
+
+func (r *contentScanJobRepository) Finish(jobId uint, status string, lastError string) error {
+	return r.db.Exec("call finish_content_scan_job(?, ?, ?)", jobId, status, lastError).Error
+}
+
+func (r *contentScanJobRepository) GetRecent(pageStart int, pageSize int) ([]*model.ContentScanJob, error) {
+
+	jobs := make([]*model.ContentScanJob, 0)
+	if result := r.db.Raw("call get_content_scan_jobs(?, ?)", pageStart, pageSize).Scan(&jobs); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return jobs, nil
+
+}
@@ -0,0 +1,241 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package storedproc
+
+import (
+	"fmt"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var frontPageProcs = map[repository.FrontPageView]string{
+	repository.FrontPageViewLatest:        "get_frontpage_latest",
+	repository.FrontPageViewMostActive:    "get_frontpage_mostactive",
+	repository.FrontPageViewSubscriptions: "get_frontpage_subscriptions",
+	repository.FrontPageViewStartedByMe:   "get_frontpage_startedbyme",
+}
+
+type discussionRepository struct {
+	db *gorm.DB
+}
+
+func (r *discussionRepository) Get(discussionId uint) (*model.Discussion, error) {
+
+	var discussion model.Discussion
+	if result := r.db.Raw("call get_discussion(?)", discussionId).First(&discussion); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &discussion, nil
+
+}
+
+func (r *discussionRepository) FindByTitle(folderId uint, title string) (*model.Discussion, error) {
+
+	var discussion model.Discussion
+	if result := r.db.Raw("call find_discussion_by_title(?, ?)", folderId, title).First(&discussion); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &discussion, nil
+
+}
+
+func (r *discussionRepository) GetRecent(folderId uint, since time.Time, limit int) ([]*model.Discussion, error) {
+
+	discussions := make([]*model.Discussion, 0)
+	if result := r.db.Raw("call get_recent_folder_discussions(?, ?, ?)", folderId, since, limit).Scan(&discussions); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return discussions, nil
+
+}
+
+func (r *discussionRepository) Create(folderId uint, title string, header string, userId uint, locked bool) (*model.Discussion, error) {
+
+	var created model.Discussion
+	if result := r.db.Raw("call create_discussion(?, ?, ?, ?, ?)", folderId, title, header, userId, boolParam(locked)).First(&created); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &created, nil
+
+}
+
+func (r *discussionRepository) Edit(folderId uint, discussionId uint, title string, header string, userId uint, locked bool) (*model.Discussion, error) {
+
+	var edited model.Discussion
+	if result := r.db.Raw("call edit_discussion(?, ?, ?, ?, ?, ?)", folderId, discussionId, title, header, userId, boolParam(locked)).Scan(&edited); result.Error != nil {
+		return nil, result.Error
+	}
+
+	if edited.Id == 0 {
+		return nil, repository.ErrNotFound
+	}
+
+	return &edited, nil
+
+}
+
+func (r *discussionRepository) SetStatus(discussionId uint, status int) (*model.Discussion, error) {
+
+	var discussion model.Discussion
+	if result := r.db.Raw("call delete_discussion(?, ?)", discussionId, status).Take(&discussion); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &discussion, nil
+
+}
+
+func (r *discussionRepository) Lock(discussionId uint, locked bool) (*model.Discussion, error) {
+
+	var discussion model.Discussion
+	if result := r.db.Raw("call lock_discussion(?, ?)", discussionId, boolParam(locked)).Take(&discussion); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &discussion, nil
+
+}
+
+func (r *discussionRepository) Premoderate(discussionId uint, premoderate bool) (*model.Discussion, error) {
+
+	var discussion model.Discussion
+	if result := r.db.Raw("call premoderate_discussion(?, ?)", discussionId, boolParam(premoderate)).Take(&discussion); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &discussion, nil
+
+}
+
+func (r *discussionRepository) Move(discussionId uint, folderId uint) (*model.Discussion, error) {
+
+	var discussion model.Discussion
+	if result := r.db.Raw("call move_discussion(?, ?)", discussionId, folderId).Take(&discussion); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &discussion, nil
+
+}
+
+func (r *discussionRepository) Erase(discussionId uint) error {
+	return r.db.Exec("call erase_discussion(?)", discussionId).Error
+}
+
+func (r *discussionRepository) GetFolderDiscussions(folderId uint, userId uint, pageStart int, pageSize int) ([]*model.FrontPageEntry, error) {
+
+	discussions := make([]*model.FrontPageEntry, 0)
+	if result := r.db.Raw("call get_folder_discussions(?, ?, ?, ?)", folderId, userId, pageStart, pageSize).Scan(&discussions); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return discussions, nil
+
+}
+
+func (r *discussionRepository) GetFolderDiscussionsBefore(folderId uint, userId uint, beforeDate time.Time, pageSize int) ([]*model.FrontPageEntry, error) {
+
+	discussions := make([]*model.FrontPageEntry, 0)
+	if result := r.db.Raw("call get_folder_discussions_before(?, ?, ?, ?)", folderId, userId, beforeDate, pageSize).Scan(&discussions); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return discussions, nil
+
+}
+
+func (r *discussionRepository) frontPage(view repository.FrontPageView, suffix string, args ...interface{}) ([]*model.FrontPageEntry, error) {
+
+	proc, exists := frontPageProcs[view]
+	if !exists {
+		return nil, fmt.Errorf("unknown front page view: %s", view)
+	}
+
+	discussions := make([]*model.FrontPageEntry, 0)
+	if result := r.db.Raw(fmt.Sprintf("call %s%s(?, ?, ?, ?)", proc, suffix), args...).Scan(&discussions); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return discussions, nil
+
+}
+
+func (r *discussionRepository) GetFrontPage(view repository.FrontPageView, userId uint, isAdmin bool, pageStart int, pageSize int) ([]*model.FrontPageEntry, error) {
+	return r.frontPage(view, "", userId, boolParam(isAdmin), pageStart, pageSize)
+}
+
+func (r *discussionRepository) GetFrontPageSince(view repository.FrontPageView, userId uint, isAdmin bool, sinceDate time.Time, pageSize int) ([]*model.FrontPageEntry, error) {
+	return r.frontPage(view, "_since", userId, boolParam(isAdmin), sinceDate, pageSize)
+}
+
+func (r *discussionRepository) GetFrontPageBefore(view repository.FrontPageView, userId uint, isAdmin bool, beforeDate time.Time, pageSize int) ([]*model.FrontPageEntry, error) {
+	return r.frontPage(view, "_before", userId, boolParam(isAdmin), beforeDate, pageSize)
+}
+
+func (r *discussionRepository) GetFrontPageEntry(discussionId uint) (*model.FrontPageEntry, error) {
+
+	var entry model.FrontPageEntry
+	if result := r.db.Raw("call get_frontpage_entry(?)", discussionId).First(&entry); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &entry, nil
+
+}
+
+func (r *discussionRepository) CalculateMostActive() error {
+	return r.db.Exec("call calculate_frontpage_mostactive()").Error
+}
+
+func (r *discussionRepository) GetBlockedUsers(discussionId uint) ([]*model.BlockedDiscussionUser, error) {
+
+	blockedUsers := make([]*model.BlockedDiscussionUser, 0)
+	if result := r.db.Raw("call get_blocked_discussion_users(?)", discussionId).Scan(&blockedUsers); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return blockedUsers, nil
+
+}
+
+func (r *discussionRepository) SetUserBlocked(discussionId uint, userId uint, blocked bool) ([]*model.BlockedDiscussionUser, error) {
+
+	blockedUsers := make([]*model.BlockedDiscussionUser, 0)
+	if result := r.db.Raw("call block_discussion_user(?, ?, ?)", discussionId, userId, boolParam(blocked)).Scan(&blockedUsers); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return blockedUsers, nil
+
+}
+
+func (r *discussionRepository) GetUserDiscussionBlocks() ([]*model.DiscussionBlock, error) {
+
+	blocks := make([]*model.DiscussionBlock, 0)
+	if result := r.db.Raw("call get_user_discussion_blocks()").Scan(&blocks); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return blocks, nil
+
+}
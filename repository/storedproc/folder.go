@@ -0,0 +1,79 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package storedproc
+
+import (
+	"justthetalk/model"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type folderRepository struct {
+	db *gorm.DB
+}
+
+func (r *folderRepository) GetFolders() ([]*model.Folder, error) {
+
+	folders := make([]*model.Folder, 0)
+	if result := r.db.Raw("call get_folders()").Scan(&folders); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return folders, nil
+
+}
+
+func (r *folderRepository) Get(folderId uint) (*model.Folder, error) {
+
+	var folder model.Folder
+	if result := r.db.Raw("call get_folder(?)", folderId).First(&folder); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &folder, nil
+
+}
+
+func (r *folderRepository) Create(key string, description string, folderType uint) (*model.Folder, error) {
+
+	var created model.Folder
+	if result := r.db.Raw("call create_folder(?, ?, ?)", key, description, folderType).First(&created); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &created, nil
+
+}
+
+func (r *folderRepository) Update(folderId uint, key string, description string, folderType uint, archived bool) (*model.Folder, error) {
+
+	var updated model.Folder
+	if result := r.db.Raw("call update_folder(?, ?, ?, ?, ?)", folderId, key, description, folderType, boolParam(archived)).First(&updated); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &updated, nil
+
+}
+
+func (r *folderRepository) SetSortOrder(folderId uint, sortOrder int) error {
+	return r.db.Exec("call set_folder_sort_order(?, ?)", folderId, sortOrder).Error
+}
+
+func (r *folderRepository) CalculateActivity(since time.Time) error {
+	return r.db.Exec("call calculate_folder_activity(?)", since).Error
+}
@@ -0,0 +1,276 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package storedproc
+
+import (
+	"justthetalk/model"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type moderationRepository struct {
+	db *gorm.DB
+}
+
+func (r *moderationRepository) GetQueue() ([]*model.Post, error) {
+
+	posts := make([]*model.Post, 0)
+	if result := r.db.Raw("call get_moderation_queue()").Find(&posts); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return posts, nil
+
+}
+
+func (r *moderationRepository) GetModeratedPosts(pageStart int, pageSize int) ([]*model.Post, error) {
+
+	posts := make([]*model.Post, 0)
+	if result := r.db.Raw("call get_moderated_posts(?, ?)", pageStart, pageSize).Find(&posts); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return posts, nil
+
+}
+
+func (r *moderationRepository) GetQueueEntries() ([]*model.ModerationQueueEntry, error) {
+
+	entries := make([]*model.ModerationQueueEntry, 0)
+	if result := r.db.Table("moderation_queue").Order("created_date").Find(&entries); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return entries, nil
+
+}
+
+func (r *moderationRepository) DeleteQueueEntry(entryId uint) error {
+	return r.db.Exec("delete from moderation_queue where id = ?", entryId).Error
+}
+
+func (r *moderationRepository) PurgeQueue(olderThan time.Time) error {
+	return r.db.Exec("delete from moderation_queue where created_date < ?", olderThan).Error
+}
+
+func (r *moderationRepository) CreateReport(report *model.PostReport) error {
+	return r.db.Exec("call create_report(?, ?, ?, ?, ?, ?)", report.PostId, report.ReporterUserId, report.ReporterName, report.ReporterEmail, report.Body, report.IPAddress).Error
+}
+
+func (r *moderationRepository) GetReportsByPost(postId uint) ([]*model.PostReport, error) {
+
+	results := make([]*model.PostReport, 0)
+	if result := r.db.Raw("call get_reports_by_post(?)", postId).Scan(&results); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return results, nil
+
+}
+
+func (r *moderationRepository) GetReportsByDiscussion(discussionId uint) ([]*model.PostReport, error) {
+
+	results := make([]*model.PostReport, 0)
+	if result := r.db.Raw("call get_reports_by_discussion(?)", discussionId).Scan(&results); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return results, nil
+
+}
+
+func (r *moderationRepository) CreateComment(postId uint, userId uint, body string, vote int) ([]*model.ModeratorComment, error) {
+
+	results := make([]*model.ModeratorComment, 0)
+	if result := r.db.Raw("call create_admin_coment(?, ?, ?, ?)", postId, userId, body, vote).Scan(&results); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return results, nil
+
+}
+
+func (r *moderationRepository) GetCommentsByPost(postId uint) ([]*model.ModeratorComment, error) {
+
+	results := make([]*model.ModeratorComment, 0)
+	if result := r.db.Raw("call get_comments_by_post(?)", postId).Scan(&results); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return results, nil
+
+}
+
+func (r *moderationRepository) GetCommentsByDiscussion(discussionId uint) ([]*model.ModeratorComment, error) {
+
+	results := make([]*model.ModeratorComment, 0)
+	if result := r.db.Raw("call get_comments_by_discussion(?)", discussionId).Scan(&results); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return results, nil
+
+}
+
+func (r *moderationRepository) GetBannedWords() ([]*model.BannedWord, error) {
+
+	words := make([]*model.BannedWord, 0)
+	if result := r.db.Raw("select * from banned_word").Scan(&words); result.Error != nil {
+		return nil, result.Error
+	}
+
+	if err := r.loadBannedWordFolders(words); err != nil {
+		return nil, err
+	}
+
+	return words, nil
+
+}
+
+func (r *moderationRepository) loadBannedWordFolders(words []*model.BannedWord) error {
+
+	if len(words) == 0 {
+		return nil
+	}
+
+	byId := make(map[uint]*model.BannedWord)
+	wordIds := make([]uint, 0, len(words))
+	for _, word := range words {
+		word.FolderIds = make([]uint, 0)
+		byId[word.Id] = word
+		wordIds = append(wordIds, word.Id)
+	}
+
+	folders := make([]*model.BannedWordFolder, 0)
+	if result := r.db.Raw("select banned_word_id, folder_id from banned_word_folder where banned_word_id in ? order by folder_id", wordIds).Scan(&folders); result.Error != nil {
+		return result.Error
+	}
+
+	for _, folder := range folders {
+		if word, exists := byId[folder.BannedWordId]; exists {
+			word.FolderIds = append(word.FolderIds, folder.FolderId)
+		}
+	}
+
+	return nil
+
+}
+
+func (r *moderationRepository) GetBannedWord(wordId uint) (*model.BannedWord, error) {
+
+	var word model.BannedWord
+	if result := r.db.Raw("call get_banned_word(?)", wordId).First(&word); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	if err := r.loadBannedWordFolders([]*model.BannedWord{&word}); err != nil {
+		return nil, err
+	}
+
+	return &word, nil
+
+}
+
+// saveBannedWord runs the procedure which creates or updates the word and
+// then replaces its folders, all in one transaction
+func (r *moderationRepository) saveBannedWord(folderIds []uint, query string, args ...interface{}) (*model.BannedWord, error) {
+
+	var word model.BannedWord
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+
+		if result := tx.Raw(query, args...).First(&word); result.Error != nil {
+			return translateError(result.Error)
+		}
+
+		if result := tx.Exec("delete from banned_word_folder where banned_word_id = ?", word.Id); result.Error != nil {
+			return result.Error
+		}
+
+		for _, folderId := range folderIds {
+			if result := tx.Exec("insert ignore into banned_word_folder (banned_word_id, folder_id) values (?, ?)", word.Id, folderId); result.Error != nil {
+				return result.Error
+			}
+		}
+
+		return nil
+
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	word.FolderIds = append(make([]uint, 0, len(folderIds)), folderIds...)
+
+	return &word, nil
+
+}
+
+func (r *moderationRepository) CreateBannedWord(pattern string, action string, folderIds []uint) (*model.BannedWord, error) {
+	return r.saveBannedWord(folderIds, "call create_banned_word(?, ?)", pattern, action)
+}
+
+func (r *moderationRepository) UpdateBannedWord(wordId uint, pattern string, action string, folderIds []uint) (*model.BannedWord, error) {
+	return r.saveBannedWord(folderIds, "call update_banned_word(?, ?, ?)", wordId, pattern, action)
+}
+
+func (r *moderationRepository) DeleteBannedWord(wordId uint) error {
+	return r.db.Exec("call delete_banned_word(?)", wordId).Error
+}
+
+func (r *moderationRepository) RecordBannedWordMatches(postId uint, wordIds []uint) error {
+
+	for _, wordId := range wordIds {
+		if result := r.db.Exec("call record_post_banned_word(?, ?)", postId, wordId); result.Error != nil {
+			return result.Error
+		}
+	}
+
+	return nil
+
+}
+
+func (r *moderationRepository) GetBannedWordMatches(postIds []uint) (map[uint][]uint, error) {
+
+	matches := make(map[uint][]uint)
+	if len(postIds) == 0 {
+		return matches, nil
+	}
+
+	rows := make([]*model.PostBannedWord, 0)
+	if result := r.db.Raw("select post_id, banned_word_id from post_banned_word where post_id in ? order by banned_word_id", postIds).Scan(&rows); result.Error != nil {
+		return nil, result.Error
+	}
+
+	for _, row := range rows {
+		matches[row.PostId] = append(matches[row.PostId], row.BannedWordId)
+	}
+
+	return matches, nil
+
+}
+
+func (r *moderationRepository) QueueForReview(postId uint, reason string) (bool, error) {
+
+	var queued int64
+	if result := r.db.Raw("call queue_post_for_review(?, ?)", postId, reason).Scan(&queued); result.Error != nil {
+		return false, result.Error
+	}
+
+	return queued > 0, nil
+
+}
@@ -0,0 +1,68 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package storedproc
+
+import (
+	"justthetalk/model"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type outboxRepository struct {
+	db *gorm.DB
+}
+
+func (r *outboxRepository) Claim(batchSize int, lease time.Duration) ([]*model.OutboxEntry, error) {
+
+	entries := make([]*model.OutboxEntry, 0)
+	if result := r.db.Raw("call claim_post_outbox_entries(?, ?)", batchSize, int(lease.Seconds())).Scan(&entries); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return entries, nil
+
+}
+
+func (r *outboxRepository) Complete(entryId uint) error {
+	return r.db.Exec("call complete_post_outbox_entry(?)", entryId).Error
+}
+
+func (r *outboxRepository) Fail(entryId uint, lastError string, nextAttemptDate time.Time, deadLetter bool) error {
+	return r.db.Exec("call fail_post_outbox_entry(?, ?, ?, ?)", entryId, lastError, nextAttemptDate.UTC(), boolParam(deadLetter)).Error
+}
+
+func (r *outboxRepository) GetDeadLettered(pageStart int, pageSize int) ([]*model.OutboxEntry, error) {
+
+	entries := make([]*model.OutboxEntry, 0)
+	if result := r.db.Raw("call get_dead_lettered_post_outbox_entries(?, ?)", pageStart, pageSize).Scan(&entries); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return entries, nil
+
+}
+
+func (r *outboxRepository) Replay(entryId uint) (*model.OutboxEntry, error) {
+
+	var entry model.OutboxEntry
+	if result := r.db.Raw("call replay_post_outbox_entry(?)", entryId).First(&entry); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &entry, nil
+
+}
@@ -0,0 +1,297 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package storedproc
+
+import (
+	"database/sql"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type postRepository struct {
+	db *gorm.DB
+}
+
+type subscribedUser struct {
+	UserId uint `gorm:"column:user_id"`
+}
+
+func (r *postRepository) Get(postId uint) (*model.Post, error) {
+
+	var post model.Post
+	if result := r.db.Raw("call get_post(?)", postId).First(&post); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &post, nil
+
+}
+
+// postColumnsQuery selects the same columns as the get_post procedure. MySQL
+// procedures can't take a list, so queries which need one are built on it.
+const postColumnsQuery = `select p.id,
+    p.version,
+    p.created_date,
+    p.discussion_id,
+    d.status discussion_status,
+    p.text,
+    p.user_id,
+    case p.deleted when 1 then 1 else 0 end deleted,
+    p.moderation_result,
+    p.moderation_score,
+    p.status,
+    p.last_edit_date,
+    case p.markdown when 1 then 1 else 0 end markdown,
+    p.post_count,
+    p.post_num,
+    u.id user_id,
+    u.username,
+    case u.enabled when 1 then 1 else 0 end user_enabled,
+    case u.account_locked when 1 then 1 else 0 end user_locked,
+    case u.account_expired when 1 then 1 else 0 end user_expired,
+    case coalesce(o.watch, 0) when 1 then 1 else 0 end user_watch,
+    case coalesce(o.premoderate) when 1 then 1 else 0 end user_premod
+    from post p
+    inner join discussion d
+    on p.discussion_id = d.id
+    inner join user u
+    on p.user_id = u.id
+    left join user_options o
+    on u.id = o.user_id`
+
+const getPostsByIdQuery = postColumnsQuery + `
+    where p.id in ?`
+
+// GetByIds returns the posts which exist out of postIds, in no particular
+// order
+func (r *postRepository) GetByIds(postIds []uint) ([]*model.Post, error) {
+
+	posts := make([]*model.Post, 0, len(postIds))
+	if len(postIds) == 0 {
+		return posts, nil
+	}
+
+	if result := r.db.Raw(getPostsByIdQuery, postIds).Scan(&posts); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return posts, nil
+
+}
+
+func (r *postRepository) GetPosts(userId uint, folderId uint, discussionId uint, pageStart int64, pageSize int) ([]*model.Post, error) {
+
+	posts := make([]*model.Post, 0)
+	if result := r.db.Raw("call get_discussion_posts(?, ?, ?, ?, ?)", userId, folderId, discussionId, pageStart, pageSize).Scan(&posts); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return posts, nil
+
+}
+
+func (r *postRepository) Create(folderId uint, discussionId uint, text string, status int, userId uint) (*model.Post, error) {
+
+	var created model.Post
+	if result := r.db.Raw("call create_discussion_post(?, ?, ?, ?, ?)", folderId, discussionId, text, status, userId).First(&created); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &created, nil
+
+}
+
+func (r *postRepository) Edit(folderId uint, discussionId uint, postId uint, text string, userId uint) (*model.Post, error) {
+
+	var post model.Post
+	if result := r.db.Raw("call edit_discussion_post(?, ?, ?, ?, ?)", folderId, discussionId, postId, text, userId).Scan(&post); result.Error != nil {
+		return nil, result.Error
+	}
+
+	if post.Id == 0 {
+		return nil, repository.ErrNotFound
+	}
+
+	return &post, nil
+
+}
+
+func (r *postRepository) Delete(folderId uint, discussionId uint, postId uint, userId uint) (*model.Post, error) {
+
+	var post model.Post
+	if result := r.db.Raw("call delete_discussion_post(?, ?, ?, ?)", folderId, discussionId, postId, userId).First(&post); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &post, nil
+
+}
+
+func (r *postRepository) SetStatus(discussionId uint, postId uint, status int, moderationResult int) (*model.Post, error) {
+
+	var post model.Post
+	if result := r.db.Raw("call set_post_status(?, ?, ?, ?)", discussionId, postId, status, moderationResult).First(&post); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &post, nil
+
+}
+
+func (r *postRepository) GetSubscribers(postId uint) ([]uint, error) {
+
+	rows, err := r.db.Model(&subscribedUser{}).Raw("call get_subscribers_for_post(?)", postId).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscribers := make([]uint, 0)
+	for rows.Next() {
+		var subscriber subscribedUser
+		if err := r.db.ScanRows(rows, &subscriber); err != nil {
+			return nil, err
+		}
+		subscribers = append(subscribers, subscriber.UserId)
+	}
+
+	return subscribers, nil
+
+}
+
+func (r *postRepository) GetIndexableAfter(afterPostId uint, limit int) ([]*model.IndexablePost, error) {
+
+	posts := make([]*model.IndexablePost, 0)
+	if result := r.db.Raw("call get_indexable_posts_after(?, ?)", afterPostId, limit).Scan(&posts); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return posts, nil
+
+}
+
+func (r *postRepository) ForEachIndexableIn(folderId uint, discussionId uint, fn func(post *model.IndexablePost) error) error {
+
+	rows, err := r.db.Raw("call get_indexable_posts_in(?, ?);", folderId, discussionId).Rows()
+	if err != nil {
+		return err
+	}
+
+	return r.scanIndexable(rows, fn)
+
+}
+
+func (r *postRepository) scanIndexable(rows *sql.Rows, fn func(post *model.IndexablePost) error) error {
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var post model.IndexablePost
+		if err := r.db.ScanRows(rows, &post); err != nil {
+			return err
+		}
+
+		if err := fn(&post); err != nil {
+			return err
+		}
+
+	}
+
+	return rows.Err()
+
+}
+
+// likePattern escapes text for a LIKE which matches it anywhere
+func likePattern(text string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return "%" + escaper.Replace(strings.ToLower(text)) + "%"
+}
+
+func (r *postRepository) SearchText(search repository.PostTextSearch) ([]*model.Post, int, error) {
+
+	// only the visible statuses, as in the search index
+	where := []string{"p.discussion_id = ?", "p.status in (0, 4)"}
+	args := []interface{}{search.DiscussionId}
+
+	for _, text := range search.Include {
+		where = append(where, "lower(p.text) like ?")
+		args = append(args, likePattern(text))
+	}
+
+	for _, text := range search.Exclude {
+		where = append(where, "not lower(p.text) like ?")
+		args = append(args, likePattern(text))
+	}
+
+	if len(search.ExcludeUserIds) > 0 {
+		where = append(where, "not p.user_id in ?")
+		args = append(args, search.ExcludeUserIds)
+	}
+
+	conditions := " where " + strings.Join(where, " and ")
+
+	var total int64
+	if result := r.db.Raw("select count(*) from post p"+conditions, args...).Scan(&total); result.Error != nil {
+		return nil, 0, result.Error
+	}
+
+	if search.BeforePostId > 0 {
+		conditions += " and p.id < ?"
+		args = append(args, search.BeforePostId)
+	}
+
+	args = append(args, search.Limit)
+
+	posts := make([]*model.Post, 0)
+	if result := r.db.Raw(postColumnsQuery+conditions+" order by p.id desc limit ?", args...).Scan(&posts); result.Error != nil {
+		return nil, 0, result.Error
+	}
+
+	return posts, int(total), nil
+
+}
+
+const getRecentPostsQuery = postColumnsQuery + `
+    where p.deleted = 0
+    order by p.id desc
+    limit ?`
+
+func (r *postRepository) GetRecent(limit int) ([]*model.Post, error) {
+
+	posts := make([]*model.Post, 0, limit)
+	if result := r.db.Raw(getRecentPostsQuery, limit).Scan(&posts); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return posts, nil
+
+}
+
+func (r *postRepository) GetCreatedBetween(afterPostId uint, from time.Time, to time.Time, limit int) ([]*model.IndexablePost, error) {
+
+	posts := make([]*model.IndexablePost, 0)
+	if result := r.db.Raw("call get_posts_created_between(?, ?, ?, ?)", afterPostId, from, to, limit).Scan(&posts); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return posts, nil
+
+}
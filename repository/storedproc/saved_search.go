@@ -0,0 +1,92 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package storedproc
+
+import (
+	"justthetalk/model"
+
+	"gorm.io/gorm"
+)
+
+type savedSearchRepository struct {
+	db *gorm.DB
+}
+
+func (r *savedSearchRepository) Get(savedSearchId uint) (*model.SavedSearch, error) {
+
+	var savedSearch model.SavedSearch
+	if result := r.db.Raw("call get_saved_search(?)", savedSearchId).First(&savedSearch); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &savedSearch, nil
+
+}
+
+func (r *savedSearchRepository) GetForUser(userId uint) ([]*model.SavedSearch, error) {
+
+	savedSearches := make([]*model.SavedSearch, 0)
+	if result := r.db.Raw("call get_saved_searches(?)", userId).Scan(&savedSearches); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return savedSearches, nil
+
+}
+
+func (r *savedSearchRepository) GetAlerting() ([]*model.SavedSearch, error) {
+
+	savedSearches := make([]*model.SavedSearch, 0)
+	if result := r.db.Raw("call get_alerting_saved_searches()").Scan(&savedSearches); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return savedSearches, nil
+
+}
+
+func (r *savedSearchRepository) Create(savedSearch *model.SavedSearch) (*model.SavedSearch, error) {
+
+	var created model.SavedSearch
+	if result := r.db.Raw("call create_saved_search(?, ?, ?, ?, ?, ?, ?)", savedSearch.UserId, savedSearch.Name, savedSearch.Query, savedSearch.FolderId, savedSearch.DiscussionId, savedSearch.Author, boolParam(savedSearch.Alerts)).First(&created); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &created, nil
+
+}
+
+func (r *savedSearchRepository) Update(savedSearch *model.SavedSearch) (*model.SavedSearch, error) {
+
+	var updated model.SavedSearch
+	if result := r.db.Raw("call update_saved_search(?, ?, ?, ?, ?, ?, ?, ?)", savedSearch.Id, savedSearch.UserId, savedSearch.Name, savedSearch.Query, savedSearch.FolderId, savedSearch.DiscussionId, savedSearch.Author, boolParam(savedSearch.Alerts)).First(&updated); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &updated, nil
+
+}
+
+func (r *savedSearchRepository) Delete(userId uint, savedSearchId uint) error {
+
+	var deleted model.SavedSearch
+	if result := r.db.Raw("call delete_saved_search(?, ?)", savedSearchId, userId).First(&deleted); result.Error != nil {
+		return translateError(result.Error)
+	}
+
+	return nil
+
+}
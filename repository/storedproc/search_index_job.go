@@ -0,0 +1,79 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package storedproc
+
+import (
+	"justthetalk/model"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type searchIndexJobRepository struct {
+	db *gorm.DB
+}
+
+func (r *searchIndexJobRepository) Create(scope string, targetId uint, reason string) (*model.SearchIndexJob, error) {
+
+	var job model.SearchIndexJob
+	if result := r.db.Raw("call create_search_index_job(?, ?, ?)", scope, targetId, reason).First(&job); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &job, nil
+
+}
+
+func (r *searchIndexJobRepository) ClaimNext(staleAfter time.Duration) (*model.SearchIndexJob, error) {
+
+	var job model.SearchIndexJob
+	if result := r.db.Raw("call claim_search_index_job(?)", int(staleAfter.Seconds())).First(&job); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &job, nil
+
+}
+
+func (r *searchIndexJobRepository) UpdateProgress(jobId uint, processed int, failed int) error {
+	return r.db.Exec("call update_search_index_job_progress(?, ?, ?)", jobId, processed, failed).Error
+}
+
+func (r *searchIndexJobRepository) Finish(jobId uint, status string, action string, processed int, failed int, lastError string) error {
+	return r.db.Exec("call finish_search_index_job(?, ?, ?, ?, ?, ?)", jobId, status, action, processed, failed, lastError).Error
+}
+
+func (r *searchIndexJobRepository) GetRecent(pageStart int, pageSize int) ([]*model.SearchIndexJob, error) {
+
+	jobs := make([]*model.SearchIndexJob, 0)
+	if result := r.db.Raw("call get_search_index_jobs(?, ?)", pageStart, pageSize).Scan(&jobs); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return jobs, nil
+
+}
+
+func (r *searchIndexJobRepository) Retry(jobId uint) (*model.SearchIndexJob, error) {
+
+	var job model.SearchIndexJob
+	if result := r.db.Raw("call retry_search_index_job(?)", jobId).First(&job); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &job, nil
+
+}
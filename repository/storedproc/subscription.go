@@ -0,0 +1,132 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package storedproc
+
+import (
+	"justthetalk/model"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type subscriptionRepository struct {
+	db *gorm.DB
+}
+
+func (r *subscriptionRepository) IsSubscribedToDiscussion(userId uint, discussionId uint) (bool, error) {
+
+	var isSubscribed int64
+	if result := r.db.Raw("call get_discussion_subscription_status(?, ?)", userId, discussionId).First(&isSubscribed); result.Error != nil {
+		return false, result.Error
+	}
+
+	return isSubscribed != 0, nil
+
+}
+
+func (r *subscriptionRepository) IsSubscribedToFolder(userId uint, folderId uint) (bool, error) {
+
+	var isSubscribed int64
+	if result := r.db.Raw("call get_folder_subscription_status(?, ?)", userId, folderId).First(&isSubscribed); result.Error != nil {
+		return false, result.Error
+	}
+
+	return isSubscribed != 0, nil
+
+}
+
+func (r *subscriptionRepository) SetDiscussionSubscription(userId uint, discussionId uint, subscribed bool) error {
+	return r.db.Exec("call update_user_discussion_subscription(?, ?, ?)", userId, discussionId, boolParam(subscribed)).Error
+}
+
+func (r *subscriptionRepository) SetFolderSubscription(userId uint, folderId uint, subscribed bool) error {
+	return r.db.Exec("call update_user_folder_subscription(?, ?, ?)", userId, folderId, boolParam(subscribed)).Error
+}
+
+func (r *subscriptionRepository) DeleteDiscussionSubscription(userId uint, discussionId uint) error {
+	return r.db.Exec("call delete_discussion_subscription(?, ?)", userId, discussionId).Error
+}
+
+func (r *subscriptionRepository) DeleteFolderSubscription(userId uint, folderId uint) error {
+	return r.db.Exec("call delete_folder_subscription(?, ?)", userId, folderId).Error
+}
+
+func (r *subscriptionRepository) MarkDiscussionRead(userId uint, discussionId uint) error {
+	return r.db.Exec("call mark_discussion_read(?, ?)", userId, discussionId).Error
+}
+
+func (r *subscriptionRepository) MarkFolderSubscriptionRead(userId uint, subscriptionId uint) error {
+	return r.db.Exec("call mark_folder_subscription_read(?, ?)", userId, subscriptionId).Error
+}
+
+func (r *subscriptionRepository) GetDiscussionSubscriptions(userId uint) ([]*model.FrontPageEntry, error) {
+
+	subscriptions := make([]*model.FrontPageEntry, 0)
+	if result := r.db.Raw("call get_discussion_subscriptions(?)", userId).Scan(&subscriptions); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return subscriptions, nil
+
+}
+
+func (r *subscriptionRepository) GetFolderSubscriptions(userId uint) ([]*model.UserFolderSubscription, error) {
+
+	subscriptions := make([]*model.UserFolderSubscription, 0)
+	if result := r.db.Raw("call get_folder_subscriptions(?)", userId).Scan(&subscriptions); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return subscriptions, nil
+
+}
+
+func (r *subscriptionRepository) GetFolderSubscriptionExceptions(userId uint) ([]*model.UserFolderSubscriptionException, error) {
+
+	exceptions := make([]*model.UserFolderSubscriptionException, 0)
+	if result := r.db.Raw("call get_folder_subscription_exceptions(?)", userId).Scan(&exceptions); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return exceptions, nil
+
+}
+
+func (r *subscriptionRepository) GetBookmark(userId uint, discussionId uint) (*model.UserDiscussionBookmark, error) {
+
+	var bookmark model.UserDiscussionBookmark
+	if result := r.db.Raw("call get_user_discussion_bookmark(?, ?)", userId, discussionId).First(&bookmark); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &bookmark, nil
+
+}
+
+func (r *subscriptionRepository) UpdateBookmark(userId uint, discussionId uint, postId uint, postNum int64, postDate time.Time) (*model.UserDiscussionBookmark, error) {
+
+	var bookmark model.UserDiscussionBookmark
+	if result := r.db.Raw("call update_user_bookmark(?, ?, ?, ?, ?)", userId, discussionId, postId, postNum, postDate).First(&bookmark); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &bookmark, nil
+
+}
+
+func (r *subscriptionRepository) DeleteBookmark(userId uint, discussionId uint) error {
+	return r.db.Exec("call delete_user_bookmark(?, ?)", userId, discussionId).Error
+}
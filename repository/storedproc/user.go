@@ -0,0 +1,355 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package storedproc
+
+import (
+	"fmt"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var userFilterProcs = map[repository.UserFilter]string{
+	repository.UserFilterPremoderate: "search_users_premod",
+	repository.UserFilterWatch:       "search_users_watch",
+	repository.UserFilterLocked:      "search_users_locked",
+	repository.UserFilterRecent:      "search_users_recent",
+}
+
+type userRepository struct {
+	db *gorm.DB
+}
+
+func (r *userRepository) fetchUser(query string, args ...interface{}) (*model.User, error) {
+
+	var user model.User
+	if result := r.db.Raw(query, args...).Take(&user); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &user, nil
+
+}
+
+func (r *userRepository) Get(userId uint) (*model.User, error) {
+
+	var user model.User
+	if result := r.db.Raw("call get_user(?)", userId).First(&user); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &user, nil
+
+}
+
+func (r *userRepository) FindByCredentials(username string, passwordHash string) (*model.User, error) {
+
+	user, err := r.fetchUser("call find_user(?, ?)", username, passwordHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Id == 0 {
+		return nil, repository.ErrNotFound
+	}
+
+	return user, nil
+
+}
+
+func (r *userRepository) FindByEmail(email string) (*model.User, error) {
+	return r.fetchUser("call find_user_by_email(?)", email)
+}
+
+func (r *userRepository) CountByUsernameOrEmail(username string, email string) (int64, error) {
+
+	var countOfExisting int64
+	if result := r.db.Table("user").Where("username = ? or email = ?", username, email).Count(&countOfExisting); result.Error != nil {
+		return 0, result.Error
+	}
+
+	return countOfExisting, nil
+
+}
+
+func (r *userRepository) Create(email string, username string, passwordHash string) (*model.User, error) {
+	return r.fetchUser("call create_user(?, ?, ?)", email, username, passwordHash)
+}
+
+func (r *userRepository) UpdatePassword(userId uint, passwordHash string) (*model.User, error) {
+	return r.fetchUser("call update_user_password(?, ?)", userId, passwordHash)
+}
+
+func (r *userRepository) UpdateLastLogin(userId uint, loginDate time.Time) error {
+	return r.db.Table("user").Where("id = ?", userId).Update("last_login_date", loginDate).Error
+}
+
+func (r *userRepository) UpdateAutoSubscribe(userId uint, state int) (*model.User, error) {
+	return r.fetchUser("call update_user_autosubscribe(?, ?)", userId, state)
+}
+
+func (r *userRepository) UpdateSortFoldersByActivity(userId uint, state int) (*model.User, error) {
+	return r.fetchUser("call update_user_foldersort(?, ?)", userId, state)
+}
+
+func (r *userRepository) UpdateSubscriptionFetchOrder(userId uint, fetchOrder int) (*model.User, error) {
+	return r.fetchUser("call update_user_subsfetchorder(?, ?)", userId, fetchOrder)
+}
+
+func (r *userRepository) UpdateBio(userId uint, bio string) (*model.User, error) {
+	return r.fetchUser("call update_user_bio(?, ?)", userId, bio)
+}
+
+func (r *userRepository) UpdateViewType(userId uint, viewType string) (*model.User, error) {
+	return r.fetchUser("call update_user_viewtype(?, ?)", userId, viewType)
+}
+
+func (r *userRepository) SetFlag(userId uint, flag repository.UserFlag, value bool) error {
+
+	var result *gorm.DB
+
+	switch flag {
+	case repository.UserFlagEnabled:
+		result = r.db.Table("user").Where("id = ?", userId).Update("enabled", value)
+	case repository.UserFlagLocked:
+		result = r.db.Table("user").Where("id = ?", userId).Update("account_locked", value)
+	case repository.UserFlagPremoderate:
+		result = r.db.Table("user_options").Where("user_id = ?", userId).Update("premoderate", value)
+	case repository.UserFlagWatch:
+		result = r.db.Table("user_options").Where("user_id = ?", userId).Update("watch", value)
+	default:
+		return fmt.Errorf("unknown user flag: %s", flag)
+	}
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return r.db.Table("user").Where("id = ?", userId).Update("last_updated", time.Now()).Error
+
+}
+
+func (r *userRepository) GetIgnoredUsers(userId uint) ([]*model.IgnoredUser, error) {
+
+	ignored := make([]*model.IgnoredUser, 0)
+	if result := r.db.Raw("call get_user_ignored_users(?)", userId).Scan(&ignored); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return ignored, nil
+
+}
+
+func (r *userRepository) SetIgnored(userId uint, ignoredUserId uint, ignored bool) ([]*model.IgnoredUser, error) {
+
+	ignoredUsers := make([]*model.IgnoredUser, 0)
+	if result := r.db.Raw("call update_user_ignore(?, ?, ?)", userId, ignoredUserId, boolParam(ignored)).Scan(&ignoredUsers); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return ignoredUsers, nil
+
+}
+
+func (r *userRepository) Search(searchTerm string) ([]*model.UserSearchResults, error) {
+
+	results := make([]*model.UserSearchResults, 0)
+	if result := r.db.Raw("call search_users(?)", fmt.Sprintf("%%%s%%", searchTerm)).Scan(&results); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return results, nil
+
+}
+
+func (r *userRepository) Filter(filter repository.UserFilter) ([]*model.UserSearchResults, error) {
+
+	proc, exists := userFilterProcs[filter]
+	if !exists {
+		return nil, fmt.Errorf("unknown user filter: %s", filter)
+	}
+
+	results := make([]*model.UserSearchResults, 0)
+	if result := r.db.Raw(fmt.Sprintf("call %s", proc)).Scan(&results); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return results, nil
+
+}
+
+func (r *userRepository) CreateLoginHistory(history *model.LoginHistory) error {
+	return r.db.Table("login_history").Create(history).Error
+}
+
+func (r *userRepository) CreateHistory(history *model.UserHistory) error {
+	return r.db.Table("user_history").Create(history).Error
+}
+
+func (r *userRepository) GetHistory(userId uint) ([]*model.UserHistory, error) {
+
+	results := make([]*model.UserHistory, 0)
+	if result := r.db.Raw("call get_user_history(?)", userId).Scan(&results); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return results, nil
+
+}
+
+func (r *userRepository) GetModNotes(userId uint) ([]*model.UserModNote, error) {
+
+	results := make([]*model.UserModNote, 0)
+	if result := r.db.Raw("call get_user_mod_notes(?)", userId).Scan(&results); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return results, nil
+
+}
+
+func (r *userRepository) modNote(sql string, values ...interface{}) (*model.UserModNote, error) {
+
+	var note model.UserModNote
+	if result := r.db.Raw(sql, values...).First(&note); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &note, nil
+
+}
+
+func (r *userRepository) GetModNote(noteId uint) (*model.UserModNote, error) {
+	return r.modNote("call get_user_mod_note(?)", noteId)
+}
+
+func (r *userRepository) CreateModNote(userId uint, moderatorId uint, note string) (*model.UserModNote, error) {
+	return r.modNote("call create_user_mod_note(?, ?, ?)", userId, moderatorId, note)
+}
+
+func (r *userRepository) UpdateModNote(noteId uint, note string) (*model.UserModNote, error) {
+	return r.modNote("call update_user_mod_note(?, ?)", noteId, note)
+}
+
+func (r *userRepository) DeleteModNote(noteId uint) error {
+	return r.db.Exec("call delete_user_mod_note(?)", noteId).Error
+}
+
+func (r *userRepository) CreateSearchHistory(history *model.SearchHistory) error {
+	return r.db.Table("search_history").Create(history).Error
+}
+
+func (r *userRepository) GetSearchHistory(userId uint, pageStart int, pageSize int) ([]*model.SearchHistory, error) {
+
+	results := make([]*model.SearchHistory, 0)
+	if result := r.db.Raw("call get_search_history(?, ?, ?)", userId, pageStart, pageSize).Scan(&results); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return results, nil
+
+}
+
+func (r *userRepository) DeleteSearchHistory(userId uint) error {
+	return r.db.Exec("call delete_search_history(?)", userId).Error
+}
+
+func (r *userRepository) GetTopSearches(from time.Time, to time.Time, zeroResultsOnly bool, limit int) ([]*model.SearchQueryCount, error) {
+
+	results := make([]*model.SearchQueryCount, 0)
+	if result := r.db.Raw("call get_top_searches(?, ?, ?, ?)", from, to, boolParam(zeroResultsOnly), limit).Scan(&results); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return results, nil
+
+}
+
+func (r *userRepository) GetSearchesPerDay(from time.Time, to time.Time) ([]*model.SearchDayCount, error) {
+
+	results := make([]*model.SearchDayCount, 0)
+	if result := r.db.Raw("call get_searches_per_day(?, ?)", from, to).Scan(&results); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return results, nil
+
+}
+
+func (r *userRepository) GetTopSearchers(from time.Time, to time.Time, limit int) ([]*model.SearchUserCount, error) {
+
+	results := make([]*model.SearchUserCount, 0)
+	if result := r.db.Raw("call get_top_searchers(?, ?, ?)", from, to, limit).Scan(&results); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return results, nil
+
+}
+
+func (r *userRepository) CreateSignupConfirmation(userId uint, confirmationKey string) (*model.SignupConfirmation, error) {
+
+	var confirmation model.SignupConfirmation
+	if result := r.db.Raw("call create_signup_confirmation(?, ?)", userId, confirmationKey).Take(&confirmation); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &confirmation, nil
+
+}
+
+func (r *userRepository) FindSignupConfirmation(confirmationKey string) (*model.SignupConfirmation, error) {
+
+	var confirmation model.SignupConfirmation
+	if result := r.db.Raw("call find_signup_confirmation_request(?)", confirmationKey).Take(&confirmation); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &confirmation, nil
+
+}
+
+func (r *userRepository) AcceptSignupConfirmation(confirmationId uint, ipAddress string) (*model.User, error) {
+	return r.fetchUser("call accept_signup_confirmation_request(?, ?)", confirmationId, ipAddress)
+}
+
+func (r *userRepository) CreatePasswordResetRequest(userId uint, ipAddress string, resetKey string) (*model.PasswordResetRequest, error) {
+
+	var request model.PasswordResetRequest
+	if result := r.db.Raw("call create_password_reset_request(?, ?, ?)", userId, ipAddress, resetKey).Take(&request); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &request, nil
+
+}
+
+func (r *userRepository) FindPasswordResetRequest(resetKey string) (*model.PasswordResetRequest, error) {
+
+	var request model.PasswordResetRequest
+	if result := r.db.Raw("call find_password_reset_request(?)", resetKey).Take(&request); result.Error != nil {
+		return nil, translateError(result.Error)
+	}
+
+	return &request, nil
+
+}
+
+func (r *userRepository) DeletePasswordResetRequest(requestId uint) error {
+	return r.db.Exec("delete from password_reset where id = ?", requestId).Error
+}
@@ -0,0 +1,80 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package search
+
+import (
+	"context"
+	"fmt"
+	"justthetalk/model"
+	"net/http"
+)
+
+// Engine is a search backend holding one document per indexable post.
+// Writes are visible to Query as soon as they return.
+type Engine interface {
+	// Index adds or replaces a post
+	Index(ctx context.Context, post *model.IndexablePost) error
+	// Delete removes a post. Deleting a post which isn't indexed is not an error.
+	Delete(ctx context.Context, postId uint) error
+	// Bulk adds or replaces posts and returns each one which was rejected
+	Bulk(ctx context.Context, posts []*model.IndexablePost) ([]BulkItemFailure, error)
+	// DeleteMatching removes every post in the filter's folder or
+	// discussion and returns how many were deleted
+	DeleteMatching(ctx context.Context, filter Filter) (int, []BulkItemFailure, error)
+	// Query returns the page of hits for a query built by NewQuery
+	Query(ctx context.Context, query *Query) (*Results, error)
+	// Match returns the indexes of the queries which the post matches. The
+	// post must already have been indexed. Sort, size and cursors are ignored.
+	Match(ctx context.Context, post *model.IndexablePost, queries []*Query) ([]int, error)
+	// Check reports whether the engine is able to serve queries
+	Check(ctx context.Context) error
+}
+
+// Filter selects the posts in a folder or discussion. Exactly one of the ids
+// is set.
+type Filter struct {
+	FolderId     uint
+	DiscussionId uint
+}
+
+type Hit struct {
+	PostId     uint
+	Cursor     string
+	Highlights []string
+}
+
+type Results struct {
+	Total int
+	Hits  []Hit
+}
+
+// BulkItemFailure describes a single post rejected by a bulk request
+type BulkItemFailure struct {
+	PostId string
+	Status int
+	Type   string
+	Reason string
+}
+
+func (f BulkItemFailure) String() string {
+	return fmt.Sprintf("post %s: [%d] %s: %s", f.PostId, f.Status, f.Type, f.Reason)
+}
+
+// IsRetryable reports whether the failure was down to the backend being busy
+// or unavailable rather than a problem with the document itself
+func (f BulkItemFailure) IsRetryable() bool {
+	return f.Status == http.StatusTooManyRequests || f.Status >= http.StatusInternalServerError
+}
@@ -0,0 +1,254 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package search
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"justthetalk/model"
+	"justthetalk/utils"
+	"strings"
+	"unicode"
+)
+
+const (
+	MaxQueryLength = 500
+	MaxTerms       = 32
+	MaxPageSize    = 100
+
+	// HighlightTag wraps the matching words in highlighted snippets
+	HighlightTag = "mark"
+)
+
+// VisiblePostStatuses are the statuses of posts which anyone may see. Every
+// query is restricted to them so that a post hidden since it was indexed is
+// never returned, even before it has been removed from the index.
+var VisiblePostStatuses = []int{model.PostStatusOK, model.PostStatusWatch}
+
+// IsVisiblePostStatus reports whether status is one of VisiblePostStatuses
+func IsVisiblePostStatus(status int) bool {
+	for _, visible := range VisiblePostStatuses {
+		if status == visible {
+			return true
+		}
+	}
+	return false
+}
+
+// Term is a word or quoted phrase from the user's query. Terms prefixed with
+// a minus are excluded.
+type Term struct {
+	Text    string
+	Phrase  bool
+	Exclude bool
+}
+
+// Query is a model.SearchQuery which has been validated, with its text split
+// into terms and its cursor decoded
+type Query struct {
+	model.SearchQuery
+	Terms []Term
+	After []interface{}
+}
+
+// NewQuery validates query and parses it for the engines. Any problem with
+// the user's input is returned as a bad request.
+func NewQuery(query *model.SearchQuery) (*Query, error) {
+
+	if err := validate(query); err != nil {
+		return nil, err
+	}
+
+	terms, err := ParseText(query.Text)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := &Query{
+		SearchQuery: *query,
+		Terms:       terms,
+	}
+
+	if len(query.After) > 0 {
+		if parsed.After, err = DecodeCursor(query.After, query.Sort); err != nil {
+			return nil, err
+		}
+	}
+
+	return parsed, nil
+
+}
+
+func validate(query *model.SearchQuery) error {
+
+	fields := make([]utils.FieldError, 0)
+
+	if query.Sort != model.SearchSortDate && query.Sort != model.SearchSortRelevance {
+		fields = append(fields, utils.FieldError{Field: "sort", Message: "must be date or relevance"})
+	}
+
+	if query.Size < 1 || query.Size > MaxPageSize {
+		fields = append(fields, utils.FieldError{Field: "size", Message: "must be between 1 and 100"})
+	}
+
+	if !query.From.IsZero() && !query.To.IsZero() && query.To.Before(query.From) {
+		fields = append(fields, utils.FieldError{Field: "to", Message: "must not be before from"})
+	}
+
+	if len(fields) > 0 {
+		return utils.NewValidationError(fields...)
+	}
+
+	return nil
+
+}
+
+func invalidQuery(message string) error {
+	return utils.NewError(utils.ErrBadRequest, utils.ErrorCodeInvalidSearchQuery, "The search query is invalid").WithField("q", message)
+}
+
+// ParseText splits the user's query into words and "quoted phrases".
+// Nothing else has a special meaning so no input can make a backend reject
+// the search.
+func ParseText(text string) ([]Term, error) {
+
+	if len(text) > MaxQueryLength {
+		return nil, invalidQuery("is too long")
+	}
+
+	terms := make([]Term, 0)
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		term := Term{}
+		if runes[i] == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+			term.Exclude = true
+			i++
+		}
+
+		if runes[i] == '"' {
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, invalidQuery("has an unterminated quote")
+			}
+			term.Text = strings.TrimSpace(string(runes[i+1 : end]))
+			term.Phrase = true
+			i = end + 1
+		} else {
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) {
+				end++
+			}
+			term.Text = string(runes[i:end])
+			i = end
+		}
+
+		if hasSearchableText(term.Text) {
+			terms = append(terms, term)
+		}
+
+	}
+
+	if len(terms) > MaxTerms {
+		return nil, invalidQuery("has too many words")
+	}
+
+	for _, term := range terms {
+		if !term.Exclude {
+			return terms, nil
+		}
+	}
+
+	return nil, invalidQuery("must contain at least one word to search for")
+
+}
+
+func hasSearchableText(text string) bool {
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// SortKeys lists the fields results are ordered by, all descending. Post id
+// is always the final tie breaker so that cursors are unique. A cursor holds
+// one value for each key: the score, the date in epoch milliseconds and the
+// post id.
+func SortKeys(sort string) []string {
+
+	if sort == model.SearchSortRelevance {
+		return []string{"_score", "date", "id"}
+	}
+
+	return []string{"date", "id"}
+
+}
+
+// EncodeCursor turns the sort values of a hit into an opaque cursor
+func EncodeCursor(sortValues []interface{}) (string, error) {
+
+	data, err := json.Marshal(sortValues)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+
+}
+
+// DecodeCursor returns the sort values held in cursor as json.Numbers
+func DecodeCursor(cursor string, sort string) ([]interface{}, error) {
+
+	invalid := utils.NewError(utils.ErrBadRequest, utils.ErrorCodeInvalidParameter, "Invalid request parameter").WithField("after", "is not a valid cursor")
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, invalid
+	}
+
+	// dates in epoch millis and post ids must round trip exactly
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var values []interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return nil, invalid
+	}
+
+	if len(values) != len(SortKeys(sort)) {
+		return nil, invalid
+	}
+
+	for _, value := range values {
+		if _, ok := value.(json.Number); !ok {
+			return nil, invalid
+		}
+	}
+
+	return values, nil
+
+}
@@ -0,0 +1,93 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package search
+
+import (
+	"encoding/json"
+	"justthetalk/model"
+	"justthetalk/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseText(t *testing.T) {
+
+	terms, err := ParseText(`  cats "black dog" -mice -"field mouse" ( `)
+	require.NoError(t, err)
+	assert.Equal(t, []Term{
+		{Text: "cats"},
+		{Text: "black dog", Phrase: true},
+		{Text: "mice", Exclude: true},
+		{Text: "field mouse", Phrase: true, Exclude: true},
+	}, terms)
+
+}
+
+func TestParseTextRejectsBadInput(t *testing.T) {
+
+	tests := map[string]string{
+		"unterminated quote": `"black dog`,
+		"no words":           ":::::",
+		"only exclusions":    "-cats -dogs",
+		"too long":           string(make([]byte, MaxQueryLength+1)),
+	}
+
+	for name, text := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseText(text)
+			assert.ErrorIs(t, err, utils.ErrBadRequest)
+		})
+	}
+
+}
+
+func TestNewQueryValidatesParameters(t *testing.T) {
+
+	now := time.Now()
+	tests := map[string]*model.SearchQuery{
+		"unknown sort":   {Text: "cats", Sort: "random", Size: 10},
+		"page too large": {Text: "cats", Sort: model.SearchSortDate, Size: MaxPageSize + 1},
+		"backwards date": {Text: "cats", Sort: model.SearchSortDate, Size: 10, From: now, To: now.Add(-time.Hour)},
+		"bad cursor":     {Text: "cats", Sort: model.SearchSortDate, Size: 10, After: "not a cursor"},
+	}
+
+	for name, query := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewQuery(query)
+			assert.ErrorIs(t, err, utils.ErrBadRequest)
+		})
+	}
+
+}
+
+func TestCursorRoundTrips(t *testing.T) {
+
+	sortValues := []interface{}{json.Number("1617235200000"), json.Number("9007199254740993")}
+
+	cursor, err := EncodeCursor(sortValues)
+	require.NoError(t, err)
+
+	after, err := DecodeCursor(cursor, model.SearchSortDate)
+	require.NoError(t, err)
+	assert.Equal(t, sortValues, after)
+
+	_, err = DecodeCursor(cursor, model.SearchSortRelevance)
+	assert.ErrorIs(t, err, utils.ErrBadRequest)
+
+}
@@ -0,0 +1,441 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"justthetalk/model"
+	"justthetalk/search"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Engine is the Elasticsearch (or OpenSearch) search backend. Every read and
+// write goes through alias so the index behind it can be rebuilt by the
+// Reindexer without downtime.
+type Engine struct {
+	client *elasticsearch.Client
+	alias  string
+}
+
+func NewEngine(client *elasticsearch.Client, alias string) *Engine {
+	return &Engine{
+		client: client,
+		alias:  alias,
+	}
+}
+
+func (e *Engine) Index(ctx context.Context, post *model.IndexablePost) error {
+
+	data, err := json.Marshal(post)
+	if err != nil {
+		return err
+	}
+
+	req := esapi.IndexRequest{
+		Index:      e.alias,
+		DocumentID: strconv.FormatUint(uint64(post.Id), 10),
+		Body:       bytes.NewReader(data),
+		Refresh:    "true",
+	}
+
+	ctx, cancelFn := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelFn()
+
+	res, err := req.Do(ctx, e.client)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("[%s] error indexing document ID=%d", res.Status(), post.Id)
+	}
+
+	var r map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return fmt.Errorf("error parsing the response body: %w", err)
+	}
+
+	log.Debugf("[%s] %s; version=%v", res.Status(), r["result"], r["_version"])
+
+	return nil
+
+}
+
+func (e *Engine) Delete(ctx context.Context, postId uint) error {
+
+	ctx, cancelFn := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelFn()
+
+	req := esapi.DeleteRequest{
+		Index:      e.alias,
+		DocumentID: strconv.FormatUint(uint64(postId), 10),
+		Refresh:    "true",
+	}
+
+	res, err := req.Do(ctx, e.client)
+	if err != nil {
+		return fmt.Errorf("error deleting document ID=%d: %w", postId, err)
+	}
+	defer res.Body.Close()
+
+	// the post may never have been indexed, which is just as good
+	if res.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	if res.IsError() {
+		return fmt.Errorf("[%s] error deleting document ID=%d", res.Status(), postId)
+	}
+
+	return nil
+
+}
+
+func (e *Engine) Bulk(ctx context.Context, posts []*model.IndexablePost) ([]search.BulkItemFailure, error) {
+	return bulkIndexPosts(ctx, e.client, e.alias, posts, "wait_for")
+}
+
+func (e *Engine) DeleteMatching(ctx context.Context, filter search.Filter) (int, []search.BulkItemFailure, error) {
+
+	field, value := "discussionId", filter.DiscussionId
+	if filter.FolderId > 0 {
+		field, value = "folderId", filter.FolderId
+	}
+
+	var buf bytes.Buffer
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{
+				field: value,
+			},
+		},
+	}
+
+	if err := json.NewEncoder(&buf).Encode(query); err != nil {
+		return 0, nil, err
+	}
+
+	ctx, cancelFn := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancelFn()
+
+	refresh := true
+	req := esapi.DeleteByQueryRequest{
+		Index:     []string{e.alias},
+		Body:      &buf,
+		Conflicts: "proceed",
+		Refresh:   &refresh,
+	}
+
+	res, err := req.Do(ctx, e.client)
+	if err != nil {
+		return 0, nil, fmt.Errorf("deleting by query: %w", err)
+	}
+	defer res.Body.Close()
+
+	if err := responseError("deleting by query", res); err != nil {
+		return 0, nil, err
+	}
+
+	var response struct {
+		Deleted  int `json:"deleted"`
+		Failures []struct {
+			Id     string `json:"id"`
+			Status int    `json:"status"`
+			Cause  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"cause"`
+		} `json:"failures"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return 0, nil, fmt.Errorf("parsing delete by query response: %w", err)
+	}
+
+	failures := make([]search.BulkItemFailure, 0)
+	for _, failure := range response.Failures {
+		failures = append(failures, search.BulkItemFailure{
+			PostId: failure.Id,
+			Status: failure.Status,
+			Type:   failure.Cause.Type,
+			Reason: failure.Cause.Reason,
+		})
+	}
+
+	return response.Deleted, failures, nil
+
+}
+
+type searchResponse struct {
+	Hits struct {
+		Total struct {
+			Value int `json:"value"`
+		} `json:"total"`
+		Hits []struct {
+			Id        string              `json:"_id"`
+			Sort      []interface{}       `json:"sort"`
+			Highlight map[string][]string `json:"highlight"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+func (e *Engine) Query(ctx context.Context, query *search.Query) (*search.Results, error) {
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(buildSearchRequest(query)); err != nil {
+		return nil, fmt.Errorf("encoding query: %w", err)
+	}
+
+	res, err := e.client.Search(
+		e.client.Search.WithContext(ctx),
+		e.client.Search.WithIndex(e.alias),
+		e.client.Search.WithBody(&buf),
+		e.client.Search.WithTrackTotalHits(true),
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("getting response: %w", err)
+	}
+	defer res.Body.Close()
+
+	if err := responseError("searching posts", res); err != nil {
+		return nil, err
+	}
+
+	var response searchResponse
+	decoder := json.NewDecoder(res.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&response); err != nil {
+		return nil, fmt.Errorf("parsing the response body: %w", err)
+	}
+
+	results := &search.Results{
+		Total: response.Hits.Total.Value,
+		Hits:  make([]search.Hit, 0, len(response.Hits.Hits)),
+	}
+
+	for _, hit := range response.Hits.Hits {
+
+		postId, err := strconv.ParseUint(hit.Id, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		cursor, err := search.EncodeCursor(hit.Sort)
+		if err != nil {
+			return nil, err
+		}
+
+		results.Hits = append(results.Hits, search.Hit{
+			PostId:     uint(postId),
+			Cursor:     cursor,
+			Highlights: hit.Highlight["text"],
+		})
+
+	}
+
+	return results, nil
+
+}
+
+// Match runs every query against the post in one multi search, each one
+// restricted to the post's id. Percolator queries would avoid the round trip
+// but would need the saved queries kept in a second index and rebuilt with
+// it, whereas this reuses the query builder and the posts mapping as they
+// are.
+func (e *Engine) Match(ctx context.Context, post *model.IndexablePost, queries []*search.Query) ([]int, error) {
+
+	matched := make([]int, 0)
+	if len(queries) == 0 {
+		return matched, nil
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, query := range queries {
+
+		body := buildSearchRequest(query)
+		delete(body, "sort")
+		delete(body, "highlight")
+		delete(body, "search_after")
+		body["size"] = 0
+		body["track_total_hits"] = 1
+
+		boolQuery := body["query"].(map[string]interface{})["bool"].(map[string]interface{})
+		boolQuery["filter"] = append(boolQuery["filter"].([]interface{}), map[string]interface{}{
+			"ids": map[string]interface{}{"values": []string{strconv.FormatUint(uint64(post.Id), 10)}},
+		})
+
+		if err := encoder.Encode(map[string]interface{}{}); err != nil {
+			return nil, err
+		}
+		if err := encoder.Encode(body); err != nil {
+			return nil, fmt.Errorf("encoding query: %w", err)
+		}
+
+	}
+
+	ctx, cancelFn := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelFn()
+
+	res, err := e.client.Msearch(&buf,
+		e.client.Msearch.WithContext(ctx),
+		e.client.Msearch.WithIndex(e.alias),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("matching post %d: %w", post.Id, err)
+	}
+	defer res.Body.Close()
+
+	if err := responseError("matching post", res); err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Responses []struct {
+			searchResponse
+			Error interface{} `json:"error"`
+		} `json:"responses"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("parsing the response body: %w", err)
+	}
+
+	for i, r := range response.Responses {
+		if r.Error != nil {
+			return nil, fmt.Errorf("matching post %d: %v", post.Id, r.Error)
+		}
+		if r.Hits.Total.Value > 0 {
+			matched = append(matched, i)
+		}
+	}
+
+	return matched, nil
+
+}
+
+// Check verifies that the index behind the alias has the managed mapping
+func (e *Engine) Check(ctx context.Context) error {
+	return CheckMapping(ctx, e.client, e.alias)
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Id     string `json:"_id"`
+		Status int    `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// bulkIndexPosts writes posts to index in a single bulk request and returns
+// each item that failed
+func bulkIndexPosts(ctx context.Context, client *elasticsearch.Client, index string, posts []*model.IndexablePost, refresh string) ([]search.BulkItemFailure, error) {
+
+	var buf bytes.Buffer
+	for _, post := range posts {
+
+		meta := []byte(fmt.Sprintf("{ \"index\" : { \"_id\" : \"%d\" } }\n", post.Id))
+
+		data, err := json.Marshal(post)
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Grow(len(meta) + len(data) + 1)
+		buf.Write(meta)
+		buf.Write(data)
+		buf.WriteByte('\n')
+
+	}
+
+	ctx, cancelFn := context.WithTimeout(ctx, 30*time.Second)
+	defer cancelFn()
+
+	req := esapi.BulkRequest{
+		Index:   index,
+		Body:    &buf,
+		Refresh: refresh,
+	}
+
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("bulk indexing: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("[%s] bulk indexing failed", res.Status())
+	}
+
+	var response bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("parsing bulk response: %w", err)
+	}
+
+	failures := make([]search.BulkItemFailure, 0)
+	if !response.Errors {
+		return failures, nil
+	}
+
+	for _, item := range response.Items {
+		for _, result := range item {
+			if result.Error != nil {
+				failures = append(failures, search.BulkItemFailure{
+					PostId: result.Id,
+					Status: result.Status,
+					Type:   result.Error.Type,
+					Reason: result.Error.Reason,
+				})
+			}
+		}
+	}
+
+	return failures, nil
+
+}
+
+// responseError turns an error response from Elasticsearch into an error
+// which includes the reason given in the body
+func responseError(action string, res *esapi.Response) error {
+
+	if !res.IsError() {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil || len(body) == 0 {
+		return fmt.Errorf("[%s] %s failed", res.Status(), action)
+	}
+
+	return fmt.Errorf("[%s] %s failed: %s", res.Status(), action, strings.TrimSpace(string(body)))
+
+}
@@ -0,0 +1,75 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"fmt"
+	"justthetalk/search"
+	"justthetalk/search/searchtest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient connects to the cluster in ELASTICSEARCH_HOSTS, or a local one,
+// and skips the test if there is nothing listening
+func testClient(t *testing.T) *elasticsearch.Client {
+
+	hosts := []string{"http://localhost:9200"}
+	if value := os.Getenv("ELASTICSEARCH_HOSTS"); len(value) > 0 {
+		hosts = strings.Split(value, ",")
+	}
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: hosts})
+	require.NoError(t, err)
+
+	res, err := client.Ping()
+	if err != nil || res.IsError() {
+		t.Skip("Elasticsearch is not available")
+	}
+	res.Body.Close()
+
+	return client
+
+}
+
+func TestEngineConformance(t *testing.T) {
+
+	client := testClient(t)
+	prefix := fmt.Sprintf("posts-conformance-%d", time.Now().UnixNano())
+
+	n := 0
+	searchtest.Run(t, func(t *testing.T) search.Engine {
+
+		n++
+		name := fmt.Sprintf("%s-%d", prefix, n)
+		require.NoError(t, createIndex(client, name))
+		t.Cleanup(func() {
+			res, err := client.Indices.Delete([]string{name})
+			if err == nil {
+				res.Body.Close()
+			}
+		})
+
+		return NewEngine(client, name)
+
+	})
+
+}
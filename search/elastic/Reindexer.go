@@ -0,0 +1,546 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"justthetalk/search"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultAlias is the name every reader and writer uses for the posts
+// index. It points at one of the versioned indices built by the Reindexer.
+const DefaultAlias = "posts"
+
+const maxReindexRetryDelay = 30 * time.Second
+
+// ReindexOptions controls how a Reindexer builds a new index
+type ReindexOptions struct {
+	Resume      bool
+	BatchSize   int
+	MaxRetries  int
+	RetryDelay  time.Duration
+	MaxFailures int
+}
+
+// ReindexReport summarises a reindex run. Failures only holds the items which
+// failed during this run; Failed also counts those from any earlier runs of a
+// resumed build.
+type ReindexReport struct {
+	Index      string
+	Resumed    bool
+	LastPostId uint
+	Indexed    int
+	Failed     int
+	Failures   []search.BulkItemFailure
+	Swapped    bool
+	Replaced   []string
+}
+
+// Reindexer rebuilds the search index without taking it offline. Posts are
+// copied into a new versioned index (posts_v1, posts_v2...) in id order and
+// the last copied post id is checkpointed in the index's _meta mapping after
+// each batch so an interrupted build can be resumed. Once every post has been
+// copied the alias is moved over to the new index in a single request.
+//
+// Edits and deletions made through the outbox while a build runs land in the
+// index behind the alias, so any made to posts which have already been copied
+// are not carried over. New posts are picked up because the build runs until
+// it catches up with the highest post id.
+type Reindexer struct {
+	client   *elasticsearch.Client
+	alias    string
+	options  ReindexOptions
+	provider repository.Provider
+}
+
+type searchIndexMeta struct {
+	MappingVersion int  `json:"mappingVersion"`
+	LastPostId     uint `json:"lastPostId"`
+	Indexed        int  `json:"indexed"`
+	Failed         int  `json:"failed"`
+	Complete       bool `json:"complete"`
+}
+
+type searchIndexState struct {
+	Aliases  map[string]json.RawMessage `json:"aliases"`
+	Mappings searchMappings             `json:"mappings"`
+}
+
+func NewReindexer(client *elasticsearch.Client, alias string, options ReindexOptions, provider repository.Provider) *Reindexer {
+	return &Reindexer{
+		client:   client,
+		alias:    alias,
+		options:  options,
+		provider: provider,
+	}
+}
+
+// Run builds (or resumes building) a versioned index and swaps the alias over
+// to it. The checkpoint is saved after every batch so if ctx is cancelled the
+// build can be picked up again with ReindexOptions.Resume.
+func (r *Reindexer) Run(ctx context.Context) (*ReindexReport, error) {
+
+	indices, err := r.getIndices()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReindexReport{
+		Failures: make([]search.BulkItemFailure, 0),
+	}
+
+	var meta searchIndexMeta
+	if r.options.Resume {
+		if name := resumableSearchIndex(r.alias, indices); name != "" {
+			report.Index = name
+			report.Resumed = true
+			meta = indices[name].Mappings.Meta
+			log.Infof("Resuming %s after post %d", name, meta.LastPostId)
+		} else {
+			log.Info("No unfinished index to resume, starting a new one")
+		}
+	}
+
+	if report.Index == "" {
+		if err := ApplyTemplate(r.client, r.alias); err != nil {
+			return nil, err
+		}
+		meta.MappingVersion = MappingVersion
+		report.Index = fmt.Sprintf("%s_v%d", r.alias, nextSearchIndexVersion(r.alias, indices))
+		if err := createIndex(r.client, report.Index); err != nil {
+			return nil, err
+		}
+		log.Infof("Created %s", report.Index)
+	}
+
+	report.LastPostId = meta.LastPostId
+	report.Failed = meta.Failed
+
+	for {
+
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		var posts []*model.IndexablePost
+		r.provider.WithRepository(5*time.Minute, func(repo repository.Repository) {
+			posts, err = repo.Posts().GetIndexableAfter(meta.LastPostId, r.options.BatchSize)
+		})
+		if err != nil {
+			return report, fmt.Errorf("loading posts after %d: %w", meta.LastPostId, err)
+		}
+
+		if len(posts) == 0 {
+			break
+		}
+
+		failures, err := r.indexBatch(ctx, report.Index, posts)
+		if err != nil {
+			return report, err
+		}
+
+		meta.LastPostId = posts[len(posts)-1].Id
+		meta.Indexed += len(posts) - len(failures)
+		meta.Failed += len(failures)
+		if err := r.saveMeta(report.Index, meta); err != nil {
+			return report, err
+		}
+
+		report.LastPostId = meta.LastPostId
+		report.Indexed += len(posts) - len(failures)
+		report.Failed = meta.Failed
+		report.Failures = append(report.Failures, failures...)
+
+		log.Infof("Indexed up to post %d into %s (%d indexed, %d failed)", meta.LastPostId, report.Index, meta.Indexed, meta.Failed)
+
+	}
+
+	meta.Complete = true
+	if err := r.saveMeta(report.Index, meta); err != nil {
+		return report, err
+	}
+
+	if r.options.MaxFailures >= 0 && meta.Failed > r.options.MaxFailures {
+		return report, fmt.Errorf("%d posts failed to index, leaving %s on its current index", meta.Failed, r.alias)
+	}
+
+	if err := r.refresh(report.Index); err != nil {
+		return report, err
+	}
+
+	// the alias may have moved since the build started so look again
+	indices, err = r.getIndices()
+	if err != nil {
+		return report, err
+	}
+
+	actions, replaced := aliasSwapActions(r.alias, report.Index, indices)
+	if err := r.updateAliases(actions); err != nil {
+		return report, err
+	}
+
+	report.Swapped = true
+	report.Replaced = replaced
+
+	return report, nil
+
+}
+
+// indexBatch writes posts to index, retrying the items which fail because
+// the cluster is busy. The failures which remain once the retries run out are
+// returned.
+func (r *Reindexer) indexBatch(ctx context.Context, index string, posts []*model.IndexablePost) ([]search.BulkItemFailure, error) {
+
+	rejected := make([]search.BulkItemFailure, 0)
+	pending := posts
+	for attempt := 1; ; attempt++ {
+
+		failures, err := bulkIndexPosts(ctx, r.client, index, pending, "")
+		if err != nil {
+			if attempt > r.options.MaxRetries {
+				return nil, err
+			}
+		} else {
+			if attempt > r.options.MaxRetries {
+				return append(rejected, failures...), nil
+			}
+			retry, permanent := partitionBulkFailures(pending, failures)
+			rejected = append(rejected, permanent...)
+			if len(retry) == 0 {
+				return rejected, nil
+			}
+			pending = retry
+		}
+
+		delay := retryDelay(attempt, r.options.RetryDelay, maxReindexRetryDelay)
+		if err != nil {
+			log.Warnf("Bulk indexing into %s failed, retrying in %v: %v", index, delay, err)
+		} else {
+			log.Warnf("Retrying %d posts in %v", len(pending), delay)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+
+	}
+
+}
+
+// partitionBulkFailures splits the failures from a bulk request into the
+// posts worth sending again and the failures which will never succeed
+func partitionBulkFailures(posts []*model.IndexablePost, failures []search.BulkItemFailure) ([]*model.IndexablePost, []search.BulkItemFailure) {
+
+	byId := make(map[string]*model.IndexablePost, len(posts))
+	for _, post := range posts {
+		byId[strconv.FormatUint(uint64(post.Id), 10)] = post
+	}
+
+	retry := make([]*model.IndexablePost, 0)
+	permanent := make([]search.BulkItemFailure, 0)
+	for _, failure := range failures {
+		if post, ok := byId[failure.PostId]; ok && failure.IsRetryable() {
+			retry = append(retry, post)
+		} else {
+			permanent = append(permanent, failure)
+		}
+	}
+
+	return retry, permanent
+
+}
+
+// searchIndexVersion returns the version number of a versioned index name,
+// or 0 if name is not one of alias's versioned indices
+func searchIndexVersion(alias string, name string) int {
+
+	prefix := alias + "_v"
+	if !strings.HasPrefix(name, prefix) {
+		return 0
+	}
+
+	version, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+	if err != nil || version < 1 {
+		return 0
+	}
+
+	return version
+
+}
+
+func nextSearchIndexVersion(alias string, indices map[string]searchIndexState) int {
+
+	next := 1
+	for name := range indices {
+		if version := searchIndexVersion(alias, name); version >= next {
+			next = version + 1
+		}
+	}
+
+	return next
+
+}
+
+// resumableSearchIndex returns the newest versioned index which has neither
+// finished building nor been put behind the alias, and which was created with
+// the current mapping
+func resumableSearchIndex(alias string, indices map[string]searchIndexState) string {
+
+	names := make([]string, 0)
+	for name, state := range indices {
+		if _, live := state.Aliases[alias]; live || state.Mappings.Meta.Complete {
+			continue
+		}
+		if state.Mappings.Meta.MappingVersion != MappingVersion {
+			continue
+		}
+		if searchIndexVersion(alias, name) > 0 {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return ""
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return searchIndexVersion(alias, names[i]) > searchIndexVersion(alias, names[j])
+	})
+
+	return names[0]
+
+}
+
+// aliasSwapActions builds the _aliases actions which point alias at index
+// alone. A concrete index left over from before aliases were used, and named
+// the same as the alias, is dropped in the same request. The names of the
+// indices taken out from behind the alias are returned alongside.
+func aliasSwapActions(alias string, index string, indices map[string]searchIndexState) ([]map[string]interface{}, []string) {
+
+	names := make([]string, 0, len(indices))
+	for name := range indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	actions := make([]map[string]interface{}, 0)
+	replaced := make([]string, 0)
+	for _, name := range names {
+		if name == index {
+			continue
+		}
+		if name == alias {
+			actions = append(actions, map[string]interface{}{
+				"remove_index": map[string]interface{}{"index": name},
+			})
+			replaced = append(replaced, name)
+		} else if _, ok := indices[name].Aliases[alias]; ok {
+			actions = append(actions, map[string]interface{}{
+				"remove": map[string]interface{}{"index": name, "alias": alias},
+			})
+			replaced = append(replaced, name)
+		}
+	}
+
+	actions = append(actions, map[string]interface{}{
+		"add": map[string]interface{}{"index": index, "alias": alias},
+	})
+
+	return actions, replaced
+
+}
+
+// getIndices fetches the aliases and checkpoints of the alias's versioned
+// indices, along with any concrete index named the same as the alias
+func (r *Reindexer) getIndices() (map[string]searchIndexState, error) {
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFn()
+
+	ignoreUnavailable := true
+	allowNoIndices := true
+	req := esapi.IndicesGetRequest{
+		Index:             []string{r.alias, r.alias + "_v*"},
+		IgnoreUnavailable: &ignoreUnavailable,
+		AllowNoIndices:    &allowNoIndices,
+	}
+
+	res, err := req.Do(ctx, r.client)
+	if err != nil {
+		return nil, fmt.Errorf("getting indices: %w", err)
+	}
+	defer res.Body.Close()
+
+	indices := make(map[string]searchIndexState)
+	if res.StatusCode == http.StatusNotFound {
+		return indices, nil
+	}
+
+	if err := responseError("getting indices", res); err != nil {
+		return nil, err
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return nil, fmt.Errorf("parsing indices: %w", err)
+	}
+
+	return indices, nil
+
+}
+
+// createIndex creates an index with the managed settings and mappings
+func createIndex(client *elasticsearch.Client, name string) error {
+
+	body := map[string]interface{}{
+		"settings": searchIndexSettings(),
+		"mappings": searchIndexMappings(),
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return err
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFn()
+
+	req := esapi.IndicesCreateRequest{
+		Index: name,
+		Body:  &buf,
+	}
+
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", name, err)
+	}
+	defer res.Body.Close()
+
+	return responseError(fmt.Sprintf("creating %s", name), res)
+
+}
+
+// saveMeta checkpoints the progress of a build in the index's mapping
+func (r *Reindexer) saveMeta(name string, meta searchIndexMeta) error {
+
+	body := map[string]interface{}{
+		"_meta": meta,
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return err
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFn()
+
+	req := esapi.IndicesPutMappingRequest{
+		Index: []string{name},
+		Body:  &buf,
+	}
+
+	res, err := req.Do(ctx, r.client)
+	if err != nil {
+		return fmt.Errorf("saving checkpoint for %s: %w", name, err)
+	}
+	defer res.Body.Close()
+
+	return responseError(fmt.Sprintf("saving checkpoint for %s", name), res)
+
+}
+
+func (r *Reindexer) refresh(name string) error {
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancelFn()
+
+	req := esapi.IndicesRefreshRequest{
+		Index: []string{name},
+	}
+
+	res, err := req.Do(ctx, r.client)
+	if err != nil {
+		return fmt.Errorf("refreshing %s: %w", name, err)
+	}
+	defer res.Body.Close()
+
+	return responseError(fmt.Sprintf("refreshing %s", name), res)
+
+}
+
+// updateAliases applies every action in a single request so readers never
+// see the alias missing or pointing at two indices
+func (r *Reindexer) updateAliases(actions []map[string]interface{}) error {
+
+	body := map[string]interface{}{
+		"actions": actions,
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return err
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFn()
+
+	req := esapi.IndicesUpdateAliasesRequest{
+		Body: &buf,
+	}
+
+	res, err := req.Do(ctx, r.client)
+	if err != nil {
+		return fmt.Errorf("updating aliases: %w", err)
+	}
+	defer res.Body.Close()
+
+	return responseError("updating aliases", res)
+
+}
+
+// retryDelay is the delay before the given attempt is retried. It doubles
+// with each attempt up to max.
+func retryDelay(attempt int, initial time.Duration, max time.Duration) time.Duration {
+
+	delay := initial
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		return max
+	}
+
+	return delay
+
+}
@@ -0,0 +1,108 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"encoding/json"
+	"justthetalk/model"
+	"justthetalk/search"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextSearchIndexVersion(t *testing.T) {
+
+	assert.Equal(t, 1, nextSearchIndexVersion("posts", map[string]searchIndexState{}))
+	assert.Equal(t, 1, nextSearchIndexVersion("posts", map[string]searchIndexState{"posts": {}}))
+	assert.Equal(t, 4, nextSearchIndexVersion("posts", map[string]searchIndexState{
+		"posts_v1":   {},
+		"posts_v3":   {},
+		"posts_vnew": {},
+	}))
+
+}
+
+func TestResumableSearchIndexSkipsLiveAndCompleteIndices(t *testing.T) {
+
+	live := searchIndexState{Aliases: map[string]json.RawMessage{"posts": json.RawMessage("{}")}}
+	complete := searchIndexState{}
+	complete.Mappings.Meta.Complete = true
+	partial := searchIndexState{}
+	partial.Mappings.Meta.MappingVersion = MappingVersion
+	partial.Mappings.Meta.LastPostId = 100
+	outdated := searchIndexState{}
+	outdated.Mappings.Meta.MappingVersion = MappingVersion - 1
+
+	assert.Equal(t, "", resumableSearchIndex("posts", map[string]searchIndexState{"posts_v1": live, "posts_v2": complete}))
+	assert.Equal(t, "posts_v3", resumableSearchIndex("posts", map[string]searchIndexState{
+		"posts_v1": live,
+		"posts_v2": partial,
+		"posts_v3": partial,
+		"posts_v4": complete,
+		"posts_v5": outdated,
+	}))
+
+}
+
+func TestAliasSwapActionsMoveTheAliasInOneRequest(t *testing.T) {
+
+	live := searchIndexState{Aliases: map[string]json.RawMessage{"posts": json.RawMessage("{}")}}
+	indices := map[string]searchIndexState{
+		"posts":    {},
+		"posts_v1": live,
+		"posts_v2": {},
+		"posts_v3": {},
+	}
+
+	actions, replaced := aliasSwapActions("posts", "posts_v3", indices)
+	assert.Equal(t, []string{"posts", "posts_v1"}, replaced)
+	if assert.Len(t, actions, 3) {
+		assert.Contains(t, actions[0], "remove_index")
+		assert.Contains(t, actions[1], "remove")
+		assert.Equal(t, map[string]interface{}{"index": "posts_v3", "alias": "posts"}, actions[2]["add"])
+	}
+
+}
+
+func TestPartitionBulkFailuresRetriesOnlyTransientErrors(t *testing.T) {
+
+	posts := []*model.IndexablePost{{Id: 1}, {Id: 2}, {Id: 3}}
+	failures := []search.BulkItemFailure{
+		{PostId: "1", Status: 429, Type: "es_rejected_execution_exception"},
+		{PostId: "2", Status: 400, Type: "mapper_parsing_exception"},
+		{PostId: "3", Status: 503, Type: "unavailable_shards_exception"},
+	}
+
+	retry, permanent := partitionBulkFailures(posts, failures)
+	if assert.Len(t, retry, 2) {
+		assert.Equal(t, uint(1), retry[0].Id)
+		assert.Equal(t, uint(3), retry[1].Id)
+	}
+	if assert.Len(t, permanent, 1) {
+		assert.Equal(t, "2", permanent[0].PostId)
+	}
+
+}
+
+func TestRetryDelayDoublesUpToMax(t *testing.T) {
+
+	assert.Equal(t, time.Second, retryDelay(1, time.Second, 5*time.Second))
+	assert.Equal(t, 4*time.Second, retryDelay(3, time.Second, 5*time.Second))
+	assert.Equal(t, 5*time.Second, retryDelay(10, time.Second, 5*time.Second))
+
+}
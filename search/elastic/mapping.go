@@ -0,0 +1,245 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// MappingVersion must be bumped whenever searchIndexMappings or
+// searchIndexSettings change. Indices built with an older version are
+// rejected by the mapping check until the index has been rebuilt.
+const MappingVersion = 2
+
+type searchFieldMapping struct {
+	Type       string                        `json:"type"`
+	Analyzer   string                        `json:"analyzer,omitempty"`
+	Normalizer string                        `json:"normalizer,omitempty"`
+	Fields     map[string]searchFieldMapping `json:"fields,omitempty"`
+}
+
+type searchMappings struct {
+	Meta       searchIndexMeta               `json:"_meta"`
+	Dynamic    string                        `json:"dynamic,omitempty"`
+	Properties map[string]searchFieldMapping `json:"properties,omitempty"`
+}
+
+// searchIndexMappings describes the fields of model.IndexablePost. Free text
+// is stemmed with the post_text analyzer and the names used for filtering and
+// aggregation get a lowercased keyword subfield.
+func searchIndexMappings() searchMappings {
+
+	keyword := map[string]searchFieldMapping{
+		"keyword": {Type: "keyword", Normalizer: "lowercase_keyword"},
+	}
+
+	return searchMappings{
+		Meta:    searchIndexMeta{MappingVersion: MappingVersion},
+		Dynamic: "false",
+		Properties: map[string]searchFieldMapping{
+			"id":           {Type: "long"},
+			"date":         {Type: "date"},
+			"folderId":     {Type: "long"},
+			"discussionId": {Type: "long"},
+			"folder":       {Type: "text", Analyzer: "post_text", Fields: keyword},
+			"thread":       {Type: "text", Analyzer: "post_text"},
+			"threadHeader": {Type: "text", Analyzer: "post_text"},
+			"text":         {Type: "text", Analyzer: "post_text"},
+			"username":     {Type: "text", Analyzer: "standard", Fields: keyword},
+			"userId":       {Type: "long"},
+			"status":       {Type: "integer"},
+		},
+	}
+
+}
+
+func searchIndexSettings() map[string]interface{} {
+	return map[string]interface{}{
+		"analysis": map[string]interface{}{
+			"filter": map[string]interface{}{
+				"english_stop": map[string]interface{}{
+					"type":      "stop",
+					"stopwords": "_english_",
+				},
+				"english_stemmer": map[string]interface{}{
+					"type":     "stemmer",
+					"language": "english",
+				},
+				"english_possessive_stemmer": map[string]interface{}{
+					"type":     "stemmer",
+					"language": "possessive_english",
+				},
+			},
+			"analyzer": map[string]interface{}{
+				"post_text": map[string]interface{}{
+					"type":        "custom",
+					"char_filter": []string{"html_strip"},
+					"tokenizer":   "standard",
+					"filter":      []string{"english_possessive_stemmer", "lowercase", "english_stop", "english_stemmer"},
+				},
+			},
+			"normalizer": map[string]interface{}{
+				"lowercase_keyword": map[string]interface{}{
+					"type":   "custom",
+					"filter": []string{"lowercase", "asciifolding"},
+				},
+			},
+		},
+	}
+}
+
+// ApplyTemplate installs or replaces the index template which gives every
+// versioned index behind alias the managed settings and mappings
+func ApplyTemplate(client *elasticsearch.Client, alias string) error {
+
+	body := map[string]interface{}{
+		"index_patterns": []string{alias + "_v*"},
+		"version":        MappingVersion,
+		"template": map[string]interface{}{
+			"settings": searchIndexSettings(),
+			"mappings": searchIndexMappings(),
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return err
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFn()
+
+	req := esapi.IndicesPutIndexTemplateRequest{
+		Name: alias,
+		Body: &buf,
+	}
+
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return fmt.Errorf("applying index template: %w", err)
+	}
+	defer res.Body.Close()
+
+	return responseError("applying index template", res)
+
+}
+
+// CheckMapping verifies that every index behind alias was built with the
+// current managed mapping
+func CheckMapping(ctx context.Context, client *elasticsearch.Client, alias string) error {
+
+	ctx, cancelFn := context.WithTimeout(ctx, 30*time.Second)
+	defer cancelFn()
+
+	req := esapi.IndicesGetMappingRequest{
+		Index: []string{alias},
+	}
+
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return fmt.Errorf("getting mapping for %s: %w", alias, err)
+	}
+	defer res.Body.Close()
+
+	if err := responseError(fmt.Sprintf("getting mapping for %s", alias), res); err != nil {
+		return err
+	}
+
+	var indices map[string]struct {
+		Mappings searchMappings `json:"mappings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return fmt.Errorf("parsing mapping for %s: %w", alias, err)
+	}
+
+	names := make([]string, 0, len(indices))
+	for name := range indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	problems := make([]string, 0)
+	for _, name := range names {
+		for _, problem := range searchMappingProblems(indices[name].Mappings) {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, problem))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("incompatible search index mapping: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+
+}
+
+// searchMappingProblems compares an index's mapping with the managed one and
+// describes each difference which would break indexing or searching
+func searchMappingProblems(actual searchMappings) []string {
+
+	problems := make([]string, 0)
+
+	if actual.Meta.MappingVersion != MappingVersion {
+		problems = append(problems, fmt.Sprintf("mapping version is %d, expected %d", actual.Meta.MappingVersion, MappingVersion))
+	}
+
+	expected := searchIndexMappings()
+	names := make([]string, 0, len(expected.Properties))
+	for name := range expected.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		problems = append(problems, searchFieldProblems(name, expected.Properties[name], actual.Properties)...)
+	}
+
+	return problems
+
+}
+
+func searchFieldProblems(name string, expected searchFieldMapping, fields map[string]searchFieldMapping) []string {
+
+	actual, ok := fields[name]
+	if !ok {
+		return []string{fmt.Sprintf("%s is not mapped", name)}
+	}
+
+	problems := make([]string, 0)
+	if actual.Type != expected.Type {
+		problems = append(problems, fmt.Sprintf("%s is %q, expected %q", name, actual.Type, expected.Type))
+	}
+
+	if len(expected.Analyzer) > 0 && actual.Analyzer != expected.Analyzer {
+		problems = append(problems, fmt.Sprintf("%s is analyzed with %q, expected %q", name, actual.Analyzer, expected.Analyzer))
+	}
+
+	for subfield, mapping := range expected.Fields {
+		problems = append(problems, searchFieldProblems(subfield, mapping, actual.Fields)...)
+	}
+
+	return problems
+
+}
@@ -0,0 +1,60 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagedMappingIsCompatibleWithItself(t *testing.T) {
+
+	data, err := json.Marshal(searchIndexMappings())
+	require.NoError(t, err)
+
+	var mappings searchMappings
+	require.NoError(t, json.Unmarshal(data, &mappings))
+
+	assert.Empty(t, searchMappingProblems(mappings))
+
+}
+
+func TestDynamicMappingIsIncompatible(t *testing.T) {
+
+	// roughly what Elasticsearch guesses for an IndexablePost
+	dynamic := `{
+		"properties": {
+			"date": {"type": "date"},
+			"folder": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+			"text": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+			"username": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}}
+		}
+	}`
+
+	var mappings searchMappings
+	require.NoError(t, json.Unmarshal([]byte(dynamic), &mappings))
+
+	problems := searchMappingProblems(mappings)
+	assert.Contains(t, problems, fmt.Sprintf("mapping version is 0, expected %d", MappingVersion))
+	assert.Contains(t, problems, "id is not mapped")
+	assert.Contains(t, problems, `text is analyzed with "", expected "post_text"`)
+	assert.NotContains(t, problems, "date is not mapped")
+
+}
@@ -0,0 +1,126 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"justthetalk/search"
+	"time"
+)
+
+// searchTextFields are the fields the free text part of a query is matched
+// against, with discussion titles weighted above post text
+var searchTextFields = []string{"text", "thread^2", "threadHeader"}
+
+func searchSort(sort string) []map[string]interface{} {
+
+	keys := search.SortKeys(sort)
+	sorts := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		sorts = append(sorts, map[string]interface{}{key: "desc"})
+	}
+
+	return sorts
+
+}
+
+// buildSearchRequest turns a query into the body of an Elasticsearch search
+func buildSearchRequest(query *search.Query) map[string]interface{} {
+
+	must := make([]interface{}, 0)
+	mustNot := make([]interface{}, 0)
+	for _, term := range query.Terms {
+
+		match := map[string]interface{}{
+			"query":  term.Text,
+			"fields": searchTextFields,
+		}
+		if term.Phrase {
+			match["type"] = "phrase"
+		} else {
+			match["operator"] = "and"
+		}
+
+		clause := map[string]interface{}{"multi_match": match}
+		if term.Exclude {
+			mustNot = append(mustNot, clause)
+		} else {
+			must = append(must, clause)
+		}
+
+	}
+
+	filter := []interface{}{
+		map[string]interface{}{"terms": map[string]interface{}{"status": search.VisiblePostStatuses}},
+	}
+
+	if len(query.ExcludeUserIds) > 0 {
+		mustNot = append(mustNot, map[string]interface{}{"terms": map[string]interface{}{"userId": query.ExcludeUserIds}})
+	}
+
+	if query.FolderId > 0 {
+		filter = append(filter, map[string]interface{}{"term": map[string]interface{}{"folderId": query.FolderId}})
+	}
+
+	if query.DiscussionId > 0 {
+		filter = append(filter, map[string]interface{}{"term": map[string]interface{}{"discussionId": query.DiscussionId}})
+	}
+
+	if len(query.Author) > 0 {
+		filter = append(filter, map[string]interface{}{"term": map[string]interface{}{"username.keyword": query.Author}})
+	}
+
+	if !query.From.IsZero() || !query.To.IsZero() {
+		dateRange := make(map[string]interface{})
+		if !query.From.IsZero() {
+			dateRange["gte"] = query.From.UTC().Format(time.RFC3339)
+		}
+		if !query.To.IsZero() {
+			dateRange["lte"] = query.To.UTC().Format(time.RFC3339)
+		}
+		filter = append(filter, map[string]interface{}{"range": map[string]interface{}{"date": dateRange}})
+	}
+
+	body := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must":     must,
+				"must_not": mustNot,
+				"filter":   filter,
+			},
+		},
+		"size":    query.Size,
+		"_source": false,
+		"sort":    searchSort(query.Sort),
+		"highlight": map[string]interface{}{
+			"encoder":   "html",
+			"pre_tags":  []string{"<" + search.HighlightTag + ">"},
+			"post_tags": []string{"</" + search.HighlightTag + ">"},
+			"fields": map[string]interface{}{
+				"text": map[string]interface{}{
+					"fragment_size":       150,
+					"number_of_fragments": 3,
+				},
+			},
+		},
+	}
+
+	if len(query.After) > 0 {
+		body["search_after"] = query.After
+	}
+
+	return body
+
+}
@@ -0,0 +1,74 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"encoding/json"
+	"justthetalk/model"
+	"justthetalk/search"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchRequestAppliesFilters(t *testing.T) {
+
+	from := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	query, err := search.NewQuery(&model.SearchQuery{
+		Text:           "cats",
+		FolderId:       3,
+		DiscussionId:   7,
+		Author:         "Alice",
+		From:           from,
+		Sort:           model.SearchSortRelevance,
+		Size:           20,
+		ExcludeUserIds: []uint{11, 12},
+	})
+	require.NoError(t, err)
+
+	data, err := json.Marshal(buildSearchRequest(query))
+	require.NoError(t, err)
+
+	var request struct {
+		Query struct {
+			Bool struct {
+				Filter  []map[string]map[string]interface{} `json:"filter"`
+				MustNot []map[string]map[string]interface{} `json:"must_not"`
+			} `json:"bool"`
+		} `json:"query"`
+		Sort []map[string]string `json:"sort"`
+	}
+	require.NoError(t, json.Unmarshal(data, &request))
+
+	filters := request.Query.Bool.Filter
+	if assert.Len(t, filters, 5) {
+		assert.Equal(t, []interface{}{float64(model.PostStatusOK), float64(model.PostStatusWatch)}, filters[0]["terms"]["status"])
+		assert.Equal(t, float64(3), filters[1]["term"]["folderId"])
+		assert.Equal(t, float64(7), filters[2]["term"]["discussionId"])
+		assert.Equal(t, "Alice", filters[3]["term"]["username.keyword"])
+		assert.Equal(t, map[string]interface{}{"gte": "2021-01-01T00:00:00Z"}, filters[4]["range"]["date"])
+	}
+
+	mustNot := request.Query.Bool.MustNot
+	if assert.Len(t, mustNot, 1) {
+		assert.Equal(t, []interface{}{float64(11), float64(12)}, mustNot[0]["terms"]["userId"])
+	}
+
+	assert.Equal(t, []map[string]string{{"_score": "desc"}, {"date": "desc"}, {"id": "desc"}}, request.Sort)
+
+}
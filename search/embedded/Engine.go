@@ -0,0 +1,735 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package embedded
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"justthetalk/model"
+	"justthetalk/search"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	opIndex  = "index"
+	opDelete = "delete"
+)
+
+var ErrClosed = errors.New("search engine is closed")
+
+// fieldWeights are the text fields which are searched, with discussion
+// titles weighted above post text as they are for Elasticsearch
+var fieldWeights = map[string]float64{
+	"text":         1,
+	"thread":       2,
+	"threadHeader": 1,
+}
+
+type document struct {
+	post   *model.IndexablePost
+	fields map[string][]string
+}
+
+func newDocument(post *model.IndexablePost) *document {
+	return &document{
+		post: post,
+		fields: map[string][]string{
+			"text":         tokens(post.Text),
+			"thread":       tokens(post.DiscussionTitle),
+			"threadHeader": tokens(post.DiscussionHeader),
+		},
+	}
+}
+
+type logEntry struct {
+	Op   string               `json:"op"`
+	Id   uint                 `json:"id,omitempty"`
+	Post *model.IndexablePost `json:"post,omitempty"`
+}
+
+// Engine is a search backend which runs inside the API process, for
+// development and small deployments with no search service. Posts are held
+// in memory and every change is appended to a log file, which is replayed
+// and compacted when the engine is opened. Only one process may have the
+// file open at a time.
+type Engine struct {
+	mutex    sync.RWMutex
+	path     string
+	file     *os.File
+	writer   *bufio.Writer
+	docs     map[uint]*document
+	postings map[string]map[uint]struct{}
+}
+
+// Open loads the index at path, creating it and its directory if they don't
+// exist
+func Open(path string) (*Engine, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("creating search index directory: %w", err)
+	}
+
+	e := &Engine{
+		path:     path,
+		docs:     make(map[uint]*document),
+		postings: make(map[string]map[uint]struct{}),
+	}
+
+	if err := e.replay(); err != nil {
+		return nil, err
+	}
+
+	if err := e.compact(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+
+}
+
+func (e *Engine) replay() error {
+
+	file, err := os.Open(e.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("opening search index: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+
+		line++
+
+		var entry logEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// a crash can leave a partly written final entry behind
+			return fmt.Errorf("reading search index line %d: %w", line, err)
+		}
+
+		switch entry.Op {
+		case opIndex:
+			e.put(entry.Post)
+		case opDelete:
+			e.remove(entry.Id)
+		}
+
+	}
+
+	return scanner.Err()
+
+}
+
+// compact rewrites the log with one entry per post and leaves it open for
+// appending
+func (e *Engine) compact() error {
+
+	temp := e.path + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return fmt.Errorf("compacting search index: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, id := range e.sortedIds() {
+		if err := writeEntry(writer, logEntry{Op: opIndex, Post: e.docs[id].post}); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(temp, e.path); err != nil {
+		return fmt.Errorf("compacting search index: %w", err)
+	}
+
+	e.file, err = os.OpenFile(e.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening search index: %w", err)
+	}
+	e.writer = bufio.NewWriter(e.file)
+
+	return nil
+
+}
+
+func (e *Engine) sortedIds() []uint {
+
+	ids := make([]uint, 0, len(e.docs))
+	for id := range e.docs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+
+}
+
+func writeEntry(writer *bufio.Writer, entry logEntry) error {
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+
+	return writer.WriteByte('\n')
+
+}
+
+// append writes entries to the log. Callers hold the write lock.
+func (e *Engine) append(entries ...logEntry) error {
+
+	if e.file == nil {
+		return ErrClosed
+	}
+
+	for _, entry := range entries {
+		if err := writeEntry(e.writer, entry); err != nil {
+			return err
+		}
+	}
+
+	return e.writer.Flush()
+
+}
+
+func (e *Engine) put(post *model.IndexablePost) {
+
+	e.remove(post.Id)
+
+	doc := newDocument(post)
+	e.docs[post.Id] = doc
+	for _, fieldTokens := range doc.fields {
+		for _, token := range fieldTokens {
+			ids, ok := e.postings[token]
+			if !ok {
+				ids = make(map[uint]struct{})
+				e.postings[token] = ids
+			}
+			ids[post.Id] = struct{}{}
+		}
+	}
+
+}
+
+func (e *Engine) remove(postId uint) bool {
+
+	doc, ok := e.docs[postId]
+	if !ok {
+		return false
+	}
+
+	for _, fieldTokens := range doc.fields {
+		for _, token := range fieldTokens {
+			if ids, ok := e.postings[token]; ok {
+				delete(ids, postId)
+				if len(ids) == 0 {
+					delete(e.postings, token)
+				}
+			}
+		}
+	}
+
+	delete(e.docs, postId)
+
+	return true
+
+}
+
+func (e *Engine) Index(ctx context.Context, post *model.IndexablePost) error {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if err := e.append(logEntry{Op: opIndex, Post: post}); err != nil {
+		return err
+	}
+
+	e.put(post)
+
+	return nil
+
+}
+
+func (e *Engine) Delete(ctx context.Context, postId uint) error {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if _, ok := e.docs[postId]; !ok {
+		return nil
+	}
+
+	if err := e.append(logEntry{Op: opDelete, Id: postId}); err != nil {
+		return err
+	}
+
+	e.remove(postId)
+
+	return nil
+
+}
+
+func (e *Engine) Bulk(ctx context.Context, posts []*model.IndexablePost) ([]search.BulkItemFailure, error) {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	entries := make([]logEntry, 0, len(posts))
+	for _, post := range posts {
+		entries = append(entries, logEntry{Op: opIndex, Post: post})
+	}
+
+	if err := e.append(entries...); err != nil {
+		return nil, err
+	}
+
+	for _, post := range posts {
+		e.put(post)
+	}
+
+	return make([]search.BulkItemFailure, 0), nil
+
+}
+
+func (e *Engine) DeleteMatching(ctx context.Context, filter search.Filter) (int, []search.BulkItemFailure, error) {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	entries := make([]logEntry, 0)
+	for _, id := range e.sortedIds() {
+		post := e.docs[id].post
+		if (filter.FolderId > 0 && post.FolderId == filter.FolderId) || (filter.DiscussionId > 0 && post.DiscussionId == filter.DiscussionId) {
+			entries = append(entries, logEntry{Op: opDelete, Id: id})
+		}
+	}
+
+	if err := e.append(entries...); err != nil {
+		return 0, nil, err
+	}
+
+	for _, entry := range entries {
+		e.remove(entry.Id)
+	}
+
+	return len(entries), make([]search.BulkItemFailure, 0), nil
+
+}
+
+// queryTerms are the words and phrases of a query split into tokens
+type queryTerms struct {
+	include    [][]string
+	phrases    map[int]bool
+	exclude    []search.Term
+	highlights map[string]bool
+	// none is set when nothing can match
+	none bool
+}
+
+func compileTerms(query *search.Query) queryTerms {
+
+	terms := queryTerms{
+		include:    make([][]string, 0),
+		phrases:    make(map[int]bool),
+		exclude:    make([]search.Term, 0),
+		highlights: make(map[string]bool),
+	}
+
+	for _, term := range query.Terms {
+		termTokens := termTokens(term)
+		if term.Exclude {
+			if len(termTokens) > 0 {
+				terms.exclude = append(terms.exclude, term)
+			}
+			continue
+		}
+		// like Elasticsearch, a word which is all stop words matches nothing
+		if len(termTokens) == 0 {
+			terms.none = true
+			return terms
+		}
+		terms.phrases[len(terms.include)] = term.Phrase
+		terms.include = append(terms.include, termTokens)
+		for _, token := range termTokens {
+			terms.highlights[token] = true
+		}
+	}
+
+	terms.none = len(terms.include) == 0
+
+	return terms
+
+}
+
+// matches reports whether doc contains every included term
+func (terms queryTerms) matches(doc *document) bool {
+	for i, termTokens := range terms.include {
+		if _, ok := fieldMatch(doc, termTokens, terms.phrases[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// excludes reports whether doc contains any excluded term
+func (terms queryTerms) excludes(doc *document) bool {
+	for _, term := range terms.exclude {
+		if _, ok := fieldMatch(doc, termTokens(term), term.Phrase); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// match is a post which matched a query, along with its sort values
+type match struct {
+	doc    *document
+	values []float64
+}
+
+func (e *Engine) Query(ctx context.Context, query *search.Query) (*search.Results, error) {
+
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	if e.file == nil {
+		return nil, ErrClosed
+	}
+
+	terms := compileTerms(query)
+	if terms.none {
+		return &search.Results{Hits: make([]search.Hit, 0)}, nil
+	}
+
+	keys := search.SortKeys(query.Sort)
+	matches := make([]match, 0)
+	for id := range e.postings[terms.include[0][0]] {
+
+		doc := e.docs[id]
+		if !e.matchesFilters(doc.post, query) {
+			continue
+		}
+
+		score, ok := e.score(doc, terms.include, terms.phrases)
+		if !ok || terms.excludes(doc) {
+			continue
+		}
+
+		matches = append(matches, match{doc: doc, values: sortValues(keys, doc.post, score)})
+
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return compareValues(matches[i].values, matches[j].values) > 0
+	})
+
+	results := &search.Results{
+		Total: len(matches),
+		Hits:  make([]search.Hit, 0),
+	}
+
+	start := 0
+	if len(query.After) > 0 {
+		after, err := cursorValues(query.After)
+		if err != nil {
+			return nil, err
+		}
+		start = sort.Search(len(matches), func(i int) bool {
+			return compareValues(matches[i].values, after) < 0
+		})
+	}
+
+	for i := start; i < len(matches) && len(results.Hits) < query.Size; i++ {
+
+		m := matches[i]
+		cursor, err := search.EncodeCursor(cursorFromValues(keys, m.values))
+		if err != nil {
+			return nil, err
+		}
+
+		results.Hits = append(results.Hits, search.Hit{
+			PostId:     m.doc.post.Id,
+			Cursor:     cursor,
+			Highlights: highlight(m.doc.post.Text, terms.highlights),
+		})
+
+	}
+
+	return results, nil
+
+}
+
+// Match checks the post against each query in process. The post need not be
+// indexed.
+func (e *Engine) Match(ctx context.Context, post *model.IndexablePost, queries []*search.Query) ([]int, error) {
+
+	doc := newDocument(post)
+	matched := make([]int, 0)
+	for i, query := range queries {
+		terms := compileTerms(query)
+		if !terms.none && e.matchesFilters(post, query) && terms.matches(doc) && !terms.excludes(doc) {
+			matched = append(matched, i)
+		}
+	}
+
+	return matched, nil
+
+}
+
+func (e *Engine) matchesFilters(post *model.IndexablePost, query *search.Query) bool {
+
+	if !search.IsVisiblePostStatus(post.Status) {
+		return false
+	}
+
+	for _, userId := range query.ExcludeUserIds {
+		if post.UserId == userId {
+			return false
+		}
+	}
+
+	if query.FolderId > 0 && post.FolderId != query.FolderId {
+		return false
+	}
+
+	if query.DiscussionId > 0 && post.DiscussionId != query.DiscussionId {
+		return false
+	}
+
+	if len(query.Author) > 0 && !strings.EqualFold(post.Username, query.Author) {
+		return false
+	}
+
+	if !query.From.IsZero() && post.CreatedDate.Before(query.From) {
+		return false
+	}
+
+	if !query.To.IsZero() && post.CreatedDate.After(query.To) {
+		return false
+	}
+
+	return true
+
+}
+
+// score returns the relevance of doc to the included terms, or false if
+// any of them doesn't match
+func (e *Engine) score(doc *document, include [][]string, phrases map[int]bool) (float64, bool) {
+
+	total := 0.0
+	for i, termTokens := range include {
+
+		field, ok := fieldMatch(doc, termTokens, phrases[i])
+		if !ok {
+			return 0, false
+		}
+
+		for _, token := range termTokens {
+			idf := math.Log(1 + float64(len(e.docs))/float64(1+len(e.postings[token])))
+			total += fieldWeights[field] * float64(count(doc.fields[field], token)) * idf
+		}
+
+	}
+
+	return total, true
+
+}
+
+// fieldMatch returns the most heavily weighted field containing all of the
+// tokens, or the tokens in order if phrase is set
+func fieldMatch(doc *document, termTokens []string, phrase bool) (string, bool) {
+
+	best := ""
+	for _, field := range []string{"thread", "text", "threadHeader"} {
+		fieldTokens := doc.fields[field]
+		var ok bool
+		if phrase {
+			ok = containsSequence(fieldTokens, termTokens)
+		} else {
+			ok = containsAll(fieldTokens, termTokens)
+		}
+		if ok && (best == "" || fieldWeights[field] > fieldWeights[best]) {
+			best = field
+		}
+	}
+
+	return best, best != ""
+
+}
+
+func count(fieldTokens []string, token string) int {
+	n := 0
+	for _, t := range fieldTokens {
+		if t == token {
+			n++
+		}
+	}
+	return n
+}
+
+func containsAll(fieldTokens []string, termTokens []string) bool {
+	for _, token := range termTokens {
+		if count(fieldTokens, token) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func containsSequence(fieldTokens []string, termTokens []string) bool {
+
+	for i := 0; i+len(termTokens) <= len(fieldTokens); i++ {
+		found := true
+		for j, token := range termTokens {
+			if fieldTokens[i+j] != token {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+func sortValues(keys []string, post *model.IndexablePost, score float64) []float64 {
+
+	values := make([]float64, 0, len(keys))
+	for _, key := range keys {
+		switch key {
+		case "_score":
+			values = append(values, score)
+		case "date":
+			values = append(values, float64(post.CreatedDate.UnixNano()/int64(1e6)))
+		case "id":
+			values = append(values, float64(post.Id))
+		}
+	}
+
+	return values
+
+}
+
+func cursorFromValues(keys []string, values []float64) []interface{} {
+
+	cursor := make([]interface{}, 0, len(values))
+	for i, key := range keys {
+		if key == "_score" {
+			cursor = append(cursor, values[i])
+		} else {
+			cursor = append(cursor, int64(values[i]))
+		}
+	}
+
+	return cursor
+
+}
+
+func cursorValues(after []interface{}) ([]float64, error) {
+
+	values := make([]float64, 0, len(after))
+	for _, value := range after {
+		number, ok := value.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("unexpected cursor value %v", value)
+		}
+		f, err := number.Float64()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, f)
+	}
+
+	return values, nil
+
+}
+
+// compareValues orders sort values, returning a positive number if a sorts
+// before b
+func compareValues(a []float64, b []float64) int {
+
+	for i := range a {
+		if a[i] > b[i] {
+			return 1
+		} else if a[i] < b[i] {
+			return -1
+		}
+	}
+
+	return 0
+
+}
+
+func (e *Engine) Check(ctx context.Context) error {
+
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	if e.file == nil {
+		return ErrClosed
+	}
+
+	return nil
+
+}
+
+// Close flushes and closes the log file
+func (e *Engine) Close() error {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.file == nil {
+		return nil
+	}
+
+	err := e.writer.Flush()
+	if closeErr := e.file.Close(); err == nil {
+		err = closeErr
+	}
+	e.file = nil
+
+	return err
+
+}
@@ -0,0 +1,99 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package embedded
+
+import (
+	"context"
+	"io/ioutil"
+	"justthetalk/model"
+	"justthetalk/search"
+	"justthetalk/search/searchtest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestEngine(t *testing.T, path string) *Engine {
+	engine, err := Open(path)
+	require.NoError(t, err)
+	return engine
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "search")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestEngineConformance(t *testing.T) {
+	searchtest.Run(t, func(t *testing.T) search.Engine {
+		engine := openTestEngine(t, filepath.Join(tempDir(t), "search.log"))
+		t.Cleanup(func() { engine.Close() })
+		return engine
+	})
+}
+
+func TestEngineReplaysLogWhenReopened(t *testing.T) {
+
+	ctx := context.Background()
+	path := filepath.Join(tempDir(t), "search.log")
+
+	post := func(id uint, text string) *model.IndexablePost {
+		return &model.IndexablePost{Id: id, CreatedDate: time.Now(), FolderId: 1, DiscussionId: 1, Text: text}
+	}
+
+	engine := openTestEngine(t, path)
+	require.NoError(t, engine.Index(ctx, post(1, "kept")))
+	require.NoError(t, engine.Index(ctx, post(2, "deleted")))
+	require.NoError(t, engine.Index(ctx, post(3, "replaced")))
+	require.NoError(t, engine.Index(ctx, post(3, "replacement")))
+	require.NoError(t, engine.Delete(ctx, 2))
+	require.NoError(t, engine.Close())
+
+	assert.Equal(t, ErrClosed, engine.Index(ctx, post(4, "closed")))
+
+	engine = openTestEngine(t, path)
+	defer engine.Close()
+
+	for text, expected := range map[string]int{"kept": 1, "deleted": 0, "replaced": 0, "replacement": 1} {
+		query, err := search.NewQuery(&model.SearchQuery{Text: text, Sort: model.SearchSortDate, Size: 10})
+		require.NoError(t, err)
+		results, err := engine.Query(ctx, query)
+		require.NoError(t, err)
+		assert.Equal(t, expected, results.Total, text)
+	}
+
+	// the log is compacted to one entry per live post when it is replayed
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, countLines(data))
+
+}
+
+func countLines(data []byte) int {
+	lines := 0
+	for _, b := range data {
+		if b == '\n' {
+			lines++
+		}
+	}
+	return lines
+}
@@ -0,0 +1,84 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package embedded
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"justthetalk/model"
+	"justthetalk/repository"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Rebuild writes every indexable post into a new index file and then moves
+// it over the one at path, returning the number of posts indexed. A server
+// which already has the index open keeps using its own copy until it is
+// restarted.
+func Rebuild(ctx context.Context, path string, batchSize int, provider repository.Provider) (int, error) {
+
+	temp := path + ".new"
+	if err := os.Remove(temp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+
+	engine, err := Open(temp)
+	if err != nil {
+		return 0, err
+	}
+	defer engine.Close()
+
+	indexed := 0
+	var lastPostId uint
+	for {
+
+		if err := ctx.Err(); err != nil {
+			return indexed, err
+		}
+
+		var posts []*model.IndexablePost
+		provider.WithRepository(5*time.Minute, func(repo repository.Repository) {
+			posts, err = repo.Posts().GetIndexableAfter(lastPostId, batchSize)
+		})
+		if err != nil {
+			return indexed, fmt.Errorf("loading posts after %d: %w", lastPostId, err)
+		}
+
+		if len(posts) == 0 {
+			break
+		}
+
+		if _, err := engine.Bulk(ctx, posts); err != nil {
+			return indexed, err
+		}
+
+		indexed += len(posts)
+		lastPostId = posts[len(posts)-1].Id
+
+		log.Infof("Indexed up to post %d (%d indexed)", lastPostId, indexed)
+
+	}
+
+	if err := engine.Close(); err != nil {
+		return indexed, err
+	}
+
+	return indexed, os.Rename(temp, path)
+
+}
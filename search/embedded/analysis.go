@@ -0,0 +1,194 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package embedded
+
+import (
+	"html"
+	"justthetalk/search"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	fragmentSize    = 150
+	fragmentContext = 40
+	maxFragments    = 3
+)
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// stopWords are left out of word searches, as they are by the english
+// analyzer used for Elasticsearch. Phrases still match them.
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "but": true,
+	"by": true, "for": true, "if": true, "in": true, "into": true, "is": true, "it": true, "no": true,
+	"not": true, "of": true, "on": true, "or": true, "such": true, "that": true, "the": true,
+	"their": true, "then": true, "there": true, "these": true, "they": true, "this": true, "to": true,
+	"was": true, "will": true, "with": true,
+}
+
+// span is a word in a piece of text, measured in runes
+type span struct {
+	start int
+	end   int
+	token string
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\''
+}
+
+// spans splits text into words and normalises each one into a token
+func spans(text string) []span {
+
+	runes := []rune(text)
+	words := make([]span, 0)
+	for i := 0; i < len(runes); {
+
+		if !isWordRune(runes[i]) {
+			i++
+			continue
+		}
+
+		end := i
+		for end < len(runes) && isWordRune(runes[end]) {
+			end++
+		}
+
+		if token := normalise(string(runes[i:end])); len(token) > 0 {
+			words = append(words, span{start: i, end: end, token: token})
+		}
+
+		i = end
+
+	}
+
+	return words
+
+}
+
+// tokens returns the normalised words of text with any markup removed
+func tokens(text string) []string {
+
+	words := spans(stripTags(text))
+	result := make([]string, 0, len(words))
+	for _, word := range words {
+		result = append(result, word.token)
+	}
+
+	return result
+
+}
+
+func stripTags(text string) string {
+	return tagPattern.ReplaceAllString(text, " ")
+}
+
+// normalise lowercases a word and strips possessives and plurals so that,
+// for example, "Cat's" and "cats" both match "cat"
+func normalise(word string) string {
+
+	word = strings.Trim(strings.ToLower(word), "'")
+	word = strings.TrimSuffix(word, "'s")
+
+	switch {
+	case len(word) > 4 && strings.HasSuffix(word, "ies"):
+		word = word[:len(word)-3] + "y"
+	case strings.HasSuffix(word, "sses"):
+		word = word[:len(word)-2]
+	case len(word) > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") && !strings.HasSuffix(word, "us"):
+		word = word[:len(word)-1]
+	}
+
+	return word
+
+}
+
+// termTokens returns the tokens a term must match. Stop words are dropped
+// from words but kept in phrases so that the phrase matches exactly.
+func termTokens(term search.Term) []string {
+
+	result := make([]string, 0)
+	for _, token := range tokens(term.Text) {
+		if term.Phrase || !stopWords[token] {
+			result = append(result, token)
+		}
+	}
+
+	return result
+
+}
+
+// highlight returns up to three snippets of text around the words whose
+// tokens are in matches. The text is HTML escaped and each matching word is
+// wrapped in the highlight tag.
+func highlight(text string, matches map[string]bool) []string {
+
+	plain := stripTags(text)
+	runes := []rune(plain)
+	words := spans(plain)
+
+	open := "<" + search.HighlightTag + ">"
+	close := "</" + search.HighlightTag + ">"
+
+	fragments := make([]string, 0)
+	for i := 0; i < len(words) && len(fragments) < maxFragments; i++ {
+
+		if !matches[words[i].token] {
+			continue
+		}
+
+		start := words[i].start - fragmentContext
+		if start < 0 {
+			start = 0
+		}
+		end := start + fragmentSize
+		if end > len(runes) {
+			end = len(runes)
+		}
+		if end < words[i].end {
+			end = words[i].end
+		}
+
+		var b strings.Builder
+		pos := start
+		for ; i < len(words) && words[i].start < end; i++ {
+			word := words[i]
+			if word.end > end {
+				break
+			}
+			if matches[word.token] {
+				b.WriteString(html.EscapeString(string(runes[pos:word.start])))
+				b.WriteString(open)
+				b.WriteString(html.EscapeString(string(runes[word.start:word.end])))
+				b.WriteString(close)
+				pos = word.end
+			}
+		}
+		b.WriteString(html.EscapeString(string(runes[pos:end])))
+
+		fragments = append(fragments, strings.TrimSpace(b.String()))
+
+		// step back so the loop's increment lands on the first word after
+		// this fragment
+		i--
+
+	}
+
+	return fragments
+
+}
@@ -0,0 +1,293 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package searchtest holds the conformance suite every search.Engine must
+// pass, so that the backends can be swapped without the results changing.
+package searchtest
+
+import (
+	"context"
+	"justthetalk/model"
+	"justthetalk/search"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var baseDate = time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func newPost(id uint, discussionId uint, username string, title string, text string) *model.IndexablePost {
+	return &model.IndexablePost{
+		Id:              id,
+		CreatedDate:     baseDate.Add(time.Duration(id) * time.Hour),
+		FolderId:        1,
+		DiscussionId:    discussionId,
+		FolderName:      "General",
+		DiscussionTitle: title,
+		Text:            text,
+		Username:        username,
+		UserId:          100 + id,
+		Status:          model.PostStatusOK,
+	}
+}
+
+func query(t *testing.T, engine search.Engine, searchQuery model.SearchQuery) *search.Results {
+
+	if searchQuery.Sort == "" {
+		searchQuery.Sort = model.SearchSortDate
+	}
+	if searchQuery.Size == 0 {
+		searchQuery.Size = 10
+	}
+
+	parsed, err := search.NewQuery(&searchQuery)
+	require.NoError(t, err)
+
+	results, err := engine.Query(context.Background(), parsed)
+	require.NoError(t, err)
+
+	return results
+
+}
+
+func hitIds(results *search.Results) []uint {
+	ids := make([]uint, 0, len(results.Hits))
+	for _, hit := range results.Hits {
+		ids = append(ids, hit.PostId)
+	}
+	return ids
+}
+
+func bulk(t *testing.T, engine search.Engine, posts ...*model.IndexablePost) {
+	failures, err := engine.Bulk(context.Background(), posts)
+	require.NoError(t, err)
+	require.Empty(t, failures)
+}
+
+// Run checks that engine behaves as the application expects. newEngine must
+// return a new, empty engine each time it is called.
+func Run(t *testing.T, newEngine func(t *testing.T) search.Engine) {
+
+	ctx := context.Background()
+
+	t.Run("check", func(t *testing.T) {
+		assert.NoError(t, newEngine(t).Check(ctx))
+	})
+
+	t.Run("index and query", func(t *testing.T) {
+
+		engine := newEngine(t)
+		require.NoError(t, engine.Index(ctx, newPost(1, 10, "alice", "Pets", "My cats sleep all day")))
+
+		results := query(t, engine, model.SearchQuery{Text: "CAT"})
+		assert.Equal(t, 1, results.Total)
+		assert.Equal(t, []uint{1}, hitIds(results))
+		if assert.Len(t, results.Hits, 1) {
+			assert.NotEmpty(t, results.Hits[0].Cursor)
+			if assert.NotEmpty(t, results.Hits[0].Highlights) {
+				assert.Contains(t, results.Hits[0].Highlights[0], "<"+search.HighlightTag+">cats</"+search.HighlightTag+">")
+			}
+		}
+
+		assert.Empty(t, query(t, engine, model.SearchQuery{Text: "dogs"}).Hits)
+
+	})
+
+	t.Run("index replaces", func(t *testing.T) {
+
+		engine := newEngine(t)
+		require.NoError(t, engine.Index(ctx, newPost(1, 10, "alice", "Pets", "I have a parrot")))
+		require.NoError(t, engine.Index(ctx, newPost(1, 10, "alice", "Pets", "I have a tortoise")))
+
+		assert.Empty(t, query(t, engine, model.SearchQuery{Text: "parrot"}).Hits)
+		assert.Equal(t, []uint{1}, hitIds(query(t, engine, model.SearchQuery{Text: "tortoise"})))
+
+	})
+
+	t.Run("delete", func(t *testing.T) {
+
+		engine := newEngine(t)
+		bulk(t, engine, newPost(1, 10, "alice", "Pets", "goldfish"), newPost(2, 10, "bob", "Pets", "goldfish"))
+
+		require.NoError(t, engine.Delete(ctx, 1))
+		require.NoError(t, engine.Delete(ctx, 99), "deleting a missing post")
+
+		assert.Equal(t, []uint{2}, hitIds(query(t, engine, model.SearchQuery{Text: "goldfish"})))
+
+	})
+
+	t.Run("delete matching", func(t *testing.T) {
+
+		engine := newEngine(t)
+		bulk(t, engine,
+			newPost(1, 10, "alice", "Pets", "hamster"),
+			newPost(2, 10, "bob", "Pets", "hamster"),
+			newPost(3, 11, "carol", "More pets", "hamster"),
+		)
+
+		deleted, failures, err := engine.DeleteMatching(ctx, search.Filter{DiscussionId: 10})
+		require.NoError(t, err)
+		assert.Empty(t, failures)
+		assert.Equal(t, 2, deleted)
+
+		assert.Equal(t, []uint{3}, hitIds(query(t, engine, model.SearchQuery{Text: "hamster"})))
+
+		deleted, _, err = engine.DeleteMatching(ctx, search.Filter{FolderId: 1})
+		require.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+		assert.Empty(t, query(t, engine, model.SearchQuery{Text: "hamster"}).Hits)
+
+	})
+
+	t.Run("filters", func(t *testing.T) {
+
+		engine := newEngine(t)
+		other := newPost(3, 12, "Carol", "Elsewhere", "rabbit")
+		other.FolderId = 2
+		bulk(t, engine,
+			newPost(1, 10, "Alice", "Pets", "rabbit"),
+			newPost(2, 11, "Bob", "Pets", "rabbit"),
+			other,
+		)
+
+		assert.Equal(t, []uint{2, 1}, hitIds(query(t, engine, model.SearchQuery{Text: "rabbit", FolderId: 1})))
+		assert.Equal(t, []uint{2}, hitIds(query(t, engine, model.SearchQuery{Text: "rabbit", DiscussionId: 11})))
+		assert.Equal(t, []uint{3}, hitIds(query(t, engine, model.SearchQuery{Text: "rabbit", Author: "carol"})))
+		assert.Equal(t, []uint{3, 2}, hitIds(query(t, engine, model.SearchQuery{Text: "rabbit", From: baseDate.Add(2 * time.Hour)})))
+		assert.Equal(t, []uint{2, 1}, hitIds(query(t, engine, model.SearchQuery{Text: "rabbit", To: baseDate.Add(2 * time.Hour)})))
+
+	})
+
+	t.Run("hidden and ignored posts", func(t *testing.T) {
+
+		engine := newEngine(t)
+		watched := newPost(2, 10, "bob", "Pets", "ferret")
+		watched.Status = model.PostStatusWatch
+		suspended := newPost(3, 10, "carol", "Pets", "ferret")
+		suspended.Status = model.PostStatusSuspendedByAdmin
+		ignored := newPost(4, 10, "dave", "Pets", "ferret")
+		ignored.UserId = 99
+		bulk(t, engine, newPost(1, 10, "alice", "Pets", "ferret"), watched, suspended, ignored)
+
+		results := query(t, engine, model.SearchQuery{Text: "ferret", ExcludeUserIds: []uint{99}})
+		assert.Equal(t, []uint{2, 1}, hitIds(results))
+		assert.Equal(t, 2, results.Total)
+
+	})
+
+	t.Run("phrases and exclusions", func(t *testing.T) {
+
+		engine := newEngine(t)
+		bulk(t, engine,
+			newPost(1, 10, "alice", "Birds", "the black swan landed"),
+			newPost(2, 10, "bob", "Birds", "a swan, black with age"),
+			newPost(3, 10, "carol", "Birds", "the white swan landed"),
+		)
+
+		assert.Equal(t, []uint{1}, hitIds(query(t, engine, model.SearchQuery{Text: `"black swan"`})))
+		assert.Equal(t, []uint{3}, hitIds(query(t, engine, model.SearchQuery{Text: "swan -black"})))
+		assert.Equal(t, []uint{2}, hitIds(query(t, engine, model.SearchQuery{Text: `swan -"black swan" -white`})))
+
+	})
+
+	t.Run("match", func(t *testing.T) {
+
+		engine := newEngine(t)
+		post := newPost(1, 10, "alice", "Birds", "the black swan landed on the lake")
+		require.NoError(t, engine.Index(ctx, post))
+
+		parse := func(searchQuery model.SearchQuery) *search.Query {
+			searchQuery.Sort = model.SearchSortDate
+			searchQuery.Size = 1
+			parsed, err := search.NewQuery(&searchQuery)
+			require.NoError(t, err)
+			return parsed
+		}
+
+		queries := []*search.Query{
+			parse(model.SearchQuery{Text: "swan"}),
+			parse(model.SearchQuery{Text: "goose"}),
+			parse(model.SearchQuery{Text: `"black swan" lake`, FolderId: 1}),
+			parse(model.SearchQuery{Text: "swan", FolderId: 2}),
+			parse(model.SearchQuery{Text: "swan -lake"}),
+			parse(model.SearchQuery{Text: "birds", Author: "ALICE"}),
+			parse(model.SearchQuery{Text: "swan", ExcludeUserIds: []uint{post.UserId}}),
+		}
+
+		matched, err := engine.Match(ctx, post, queries)
+		require.NoError(t, err)
+		assert.Equal(t, []int{0, 2, 5}, matched)
+
+		matched, err = engine.Match(ctx, post, nil)
+		require.NoError(t, err)
+		assert.Empty(t, matched)
+
+	})
+
+	t.Run("titles are searched and rank above text", func(t *testing.T) {
+
+		engine := newEngine(t)
+		bulk(t, engine,
+			newPost(1, 10, "alice", "Gardening", "my zebra plant is wilting"),
+			newPost(2, 11, "bob", "Zebra plants", "how often should I water a zebra plant"),
+		)
+
+		results := query(t, engine, model.SearchQuery{Text: "zebra", Sort: model.SearchSortRelevance})
+		assert.Equal(t, []uint{2, 1}, hitIds(results))
+
+	})
+
+	t.Run("cursor pagination", func(t *testing.T) {
+
+		engine := newEngine(t)
+		posts := make([]*model.IndexablePost, 0)
+		for id := uint(1); id <= 25; id++ {
+			posts = append(posts, newPost(id, 10, "alice", "Weather", strings.Repeat("rain ", int(id%3)+1)))
+		}
+		bulk(t, engine, posts...)
+
+		for _, sort := range []string{model.SearchSortDate, model.SearchSortRelevance} {
+
+			seen := make(map[uint]bool)
+			pages := make([]int, 0)
+			after := ""
+			for {
+				results := query(t, engine, model.SearchQuery{Text: "rain", Sort: sort, Size: 10, After: after})
+				assert.Equal(t, 25, results.Total, "total with %s sort", sort)
+				if len(results.Hits) == 0 {
+					break
+				}
+				pages = append(pages, len(results.Hits))
+				for _, hit := range results.Hits {
+					assert.False(t, seen[hit.PostId], "post %d returned twice with %s sort", hit.PostId, sort)
+					seen[hit.PostId] = true
+				}
+				after = results.Hits[len(results.Hits)-1].Cursor
+			}
+
+			assert.Equal(t, []int{10, 10, 5}, pages, "pages with %s sort", sort)
+			assert.Len(t, seen, 25)
+
+		}
+
+		first := query(t, engine, model.SearchQuery{Text: "rain", Size: 3})
+		assert.Equal(t, []uint{25, 24, 23}, hitIds(first))
+
+	})
+
+}
@@ -18,5 +18,6 @@ package server
 import "testing"
 
 func TestNoAccessToAdminFunctions(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
@@ -16,19 +16,28 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
-	"os"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/gorilla/mux"
 
 	"justthetalk/businesslogic"
+	"justthetalk/config"
+	"justthetalk/connections"
+	"justthetalk/events"
 	"justthetalk/handlers"
 	"justthetalk/middleware"
-	"justthetalk/utils"
+	"justthetalk/repository"
+	"justthetalk/repository/storedproc"
+	"justthetalk/search"
+	"justthetalk/search/elastic"
+	"justthetalk/search/embedded"
 
 	"sync"
 
@@ -75,49 +84,146 @@ func prometheusMiddleware(next http.Handler) http.Handler {
 }
 
 type App struct {
-	router           *mux.Router
-	mostActiveWorker *businesslogic.MostActiveWorker
-	postProcessor    *businesslogic.PostProcessor
-	userCache        *businesslogic.UserCache
-	folderCache      *businesslogic.FolderCache
-	discussionCache  *businesslogic.DiscussionCache
-	bannedWordList   *businesslogic.BannedWordsList
+	config               *config.Config
+	provider             repository.Provider
+	router               *mux.Router
+	server               *http.Server
+	websocketHandler     *handlers.WebsockerHandler
+	mostActiveWorker     *businesslogic.MostActiveWorker
+	folderActivityWorker *businesslogic.FolderActivityWorker
+	postProcessor        *businesslogic.PostProcessor
+	indexJobRunner       *businesslogic.SearchIndexJobRunner
+	scanJobRunner        *businesslogic.ContentScanJobRunner
+	eventBus             *events.Bus
+	userCache            *businesslogic.UserCache
+	folderCache          *businesslogic.FolderCache
+	discussionCache      *businesslogic.DiscussionCache
+	bannedWordList       *businesslogic.BannedWordsList
+	searchEngine         search.Engine
+	searchGuard          *businesslogic.SearchGuard
+	searchAlerter        *businesslogic.SearchAlerter
+
+	duplicateDetector *businesslogic.DuplicateDiscussionDetector
+	moderationPolicy  *businesslogic.ModerationPolicy
 }
 
-func NewApp() *App {
+// newSearchEngine connects to the search backend chosen in the configuration
+func newSearchEngine(cfg *config.Config) (search.Engine, error) {
+
+	switch cfg.Search.Backend {
+	case config.SearchBackendEmbedded:
+		return embedded.Open(cfg.Search.EmbeddedPath)
+	case config.SearchBackendElasticsearch:
+		if cfg.Elasticsearch.ManageTemplate {
+			if err := elastic.ApplyTemplate(connections.ElasticSearchConnection(), elastic.DefaultAlias); err != nil {
+				log.Errorf("Applying search index template: %v", err)
+			}
+		}
+		return elastic.NewEngine(connections.ElasticSearchConnection(), elastic.DefaultAlias), nil
+	default:
+		return nil, fmt.Errorf("unknown search backend: %s", cfg.Search.Backend)
+	}
+
+}
+
+func NewApp(cfg *config.Config) (*App, error) {
+
+	provider := storedproc.NewProvider(connections.DatabaseConnection())
+
+	userCache := businesslogic.NewUserCache(provider)
+
+	folderCache, err := businesslogic.NewFolderCache(provider)
+	if err != nil {
+		return nil, err
+	}
 
-	userCache := businesslogic.NewUserCache()
-	folderCache := businesslogic.NewFolderCache()
-	discussionCache := businesslogic.NewDiscussionCache(folderCache)
+	discussionCache := businesslogic.NewDiscussionCache(cfg.DiscussionCache, folderCache, provider)
+
+	bannedWordList, err := businesslogic.NewBannedWordsList(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	searchEngine, err := newSearchEngine(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	searchAlerter := businesslogic.NewSearchAlerter(searchEngine, userCache, provider)
 
 	app := &App{
-		postProcessor:    businesslogic.NewPostProcessor(userCache, folderCache, discussionCache),
-		mostActiveWorker: businesslogic.NewMostActiveWorker(),
-		userCache:        userCache,
-		folderCache:      folderCache,
-		discussionCache:  discussionCache,
-		bannedWordList:   businesslogic.NewBannedWordsList(),
+		config:               cfg,
+		provider:             provider,
+		postProcessor:        businesslogic.NewPostProcessor(cfg.Outbox, searchEngine, userCache, folderCache, discussionCache, searchAlerter, provider),
+		indexJobRunner:       businesslogic.NewSearchIndexJobRunner(cfg.Workers.SearchIndexJobInterval, searchEngine, folderCache, provider),
+		scanJobRunner:        businesslogic.NewContentScanJobRunner(cfg.Workers.ContentScanInterval, cfg.Workers.ContentScanBatchSize, cfg.Workers.ContentScanWindow, bannedWordList, provider),
+		mostActiveWorker:     businesslogic.NewMostActiveWorker(cfg.Workers.MostActiveInterval, provider),
+		folderActivityWorker: businesslogic.NewFolderActivityWorker(cfg.Workers.FolderActivityInterval, cfg.Workers.FolderActivityWindow, folderCache, provider),
+		userCache:            userCache,
+		folderCache:          folderCache,
+		discussionCache:      discussionCache,
+		bannedWordList:       bannedWordList,
+		searchEngine:         searchEngine,
+		searchGuard:          businesslogic.NewSearchGuard(searchEngine),
+		searchAlerter:        searchAlerter,
+
+		duplicateDetector: businesslogic.NewDuplicateDiscussionDetector(cfg.DuplicateDiscussions),
+		moderationPolicy:  businesslogic.NewModerationPolicy(cfg.Moderation),
+	}
+
+	// a failed check is logged and leaves search disabled rather than
+	// stopping the server
+	app.searchGuard.Check()
+
+	businesslogic.SetBannedWords(app.bannedWordList)
+	businesslogic.SetMailConfig(cfg.Mail)
+
+	if app.eventBus, err = app.newEventBus(); err != nil {
+		return nil, err
 	}
 
 	app.router = app.configureRouter()
 
-	return app
+	return app, nil
 
 }
 
-func (a *App) configureRouter() *mux.Router {
+type eventSubscriber interface {
+	events.Subscriber
+	Events() []string
+}
 
-	platform := os.Getenv(utils.PlatformEnvVar)
+func (a *App) newEventBus() (*events.Bus, error) {
 
-	databaseMiddleware := middleware.NewDatabaseMiddleware()
-	sessionMiddleware := middleware.NewSessionMiddleware(a.userCache)
+	bus := events.NewBus()
+
+	subscribers := []eventSubscriber{
+		businesslogic.NewSearchIndexSubscriber(a.postProcessor, a.indexJobRunner),
+		businesslogic.NewNotificationSubscriber(a.userCache),
+		businesslogic.NewAuditSubscriber(log.WithField("component", "audit")),
+	}
+
+	for _, subscriber := range subscribers {
+		if err := bus.Subscribe(subscriber, subscriber.Events()...); err != nil {
+			return nil, err
+		}
+	}
+
+	return bus, nil
+
+}
+
+func (a *App) configureRouter() *mux.Router {
+
+	databaseMiddleware := middleware.NewDatabaseMiddleware(a.provider)
+	sessionMiddleware := middleware.NewSessionMiddleware(a.userCache, []byte(a.config.Auth.SigningKey.Value()))
 
 	router := mux.NewRouter().StrictSlash(false)
 	router.Use(databaseMiddleware.Middleware, sessionMiddleware.Middleware, prometheusMiddleware)
 
 	a.configureFolderRouter(router)
 	a.configureFrontPageRouter(router)
-	a.configureUserRouter(router, platform)
+	a.configureUserRouter(router)
 	a.configureSearchRouter(router)
 	a.configureAdminRouter(router)
 
@@ -125,8 +231,8 @@ func (a *App) configureRouter() *mux.Router {
 	router.Path("/metrics").Handler(promhttp.Handler())
 	//router.HandleFunc("/metrics", promhttp.Handler())
 
-	websocketHandler := handlers.NewWebsockerHandler(a.userCache)
-	router.HandleFunc("/ws", websocketHandler.ServeHTTP)
+	a.websocketHandler = handlers.NewWebsockerHandler(a.config, a.userCache)
+	router.HandleFunc("/ws", a.websocketHandler.ServeHTTP)
 
 	return router
 
@@ -134,7 +240,7 @@ func (a *App) configureRouter() *mux.Router {
 
 func (a *App) configureFolderRouter(router *mux.Router) {
 
-	folderHandler := handlers.NewFolderHandler(a.userCache, a.folderCache, a.discussionCache, a.postProcessor)
+	folderHandler := handlers.NewFolderHandler(a.userCache, a.folderCache, a.discussionCache, a.eventBus, a.searchEngine, a.searchGuard, a.duplicateDetector)
 
 	folderRouter := router.PathPrefix("/folder").Subrouter().StrictSlash(false)
 	folderRouter.HandleFunc("", folderHandler.GetFolders).Methods(http.MethodGet, http.MethodOptions)
@@ -142,11 +248,14 @@ func (a *App) configureFolderRouter(router *mux.Router) {
 
 	folderRouter.HandleFunc("/{folderId:[0-9]+}/discussion", folderHandler.GetDiscussions).Methods(http.MethodGet, http.MethodOptions)
 	folderRouter.HandleFunc("/{folderId:[0-9]+}/discussion/before", folderHandler.GetDiscussionsBefore).Methods(http.MethodGet, http.MethodOptions)
+	folderRouter.HandleFunc("/{folderId:[0-9]+}/discussion/similar", folderHandler.GetSimilarDiscussions).Methods(http.MethodGet, http.MethodOptions)
 	folderRouter.HandleFunc("/{folderId:[0-9]+}/discussion", folderHandler.CreateDiscussion).Methods(http.MethodPost, http.MethodOptions)
 	folderRouter.HandleFunc("/{folderId:[0-9]+}/discussion/{discussionId:[0-9]+}", folderHandler.GetDiscussion).Methods(http.MethodGet, http.MethodOptions)
 	folderRouter.HandleFunc("/{folderId:[0-9]+}/discussion/{discussionId:[0-9]+}", folderHandler.EditDiscussion).Methods(http.MethodPut, http.MethodOptions)
 	folderRouter.HandleFunc("/{folderId:[0-9]+}/discussion/{discussionId:[0-9]+}", folderHandler.DeleteDiscussion).Methods(http.MethodDelete, http.MethodOptions)
 
+	folderRouter.HandleFunc("/{folderId:[0-9]+}/discussion/{discussionId:[0-9]+}/search", folderHandler.SearchDiscussion).Methods(http.MethodGet, http.MethodOptions)
+
 	folderRouter.HandleFunc("/{folderId:[0-9]+}/discussion/{discussionId:[0-9]+}/post", folderHandler.GetPosts).Methods(http.MethodGet, http.MethodOptions)
 	folderRouter.HandleFunc("/{folderId:[0-9]+}/discussion/{discussionId:[0-9]+}/post", folderHandler.CreatePost).Methods(http.MethodPost, http.MethodOptions)
 	folderRouter.HandleFunc("/{folderId:[0-9]+}/discussion/{discussionId:[0-9]+}/post/{postId:[0-9]+}", folderHandler.EditPost).Methods(http.MethodPut, http.MethodOptions)
@@ -170,16 +279,20 @@ func (a *App) configureFrontPageRouter(router *mux.Router) {
 
 func (a *App) configureSearchRouter(router *mux.Router) {
 
-	searchHandler := handlers.NewSearchHandler(a.folderCache, a.discussionCache)
+	searchHandler := handlers.NewSearchHandler(a.searchEngine, a.folderCache, a.discussionCache, a.searchGuard, a.searchAlerter)
 
 	searchRouter := router.PathPrefix("/search").Subrouter().StrictSlash(false)
 	searchRouter.HandleFunc("", searchHandler.SearchPosts).Methods(http.MethodGet, http.MethodOptions)
+	searchRouter.HandleFunc("/saved", searchHandler.GetSavedSearches).Methods(http.MethodGet, http.MethodOptions)
+	searchRouter.HandleFunc("/saved", searchHandler.CreateSavedSearch).Methods(http.MethodPost, http.MethodOptions)
+	searchRouter.HandleFunc("/saved/{savedSearchId:[0-9]+}", searchHandler.EditSavedSearch).Methods(http.MethodPut, http.MethodOptions)
+	searchRouter.HandleFunc("/saved/{savedSearchId:[0-9]+}", searchHandler.DeleteSavedSearch).Methods(http.MethodDelete, http.MethodOptions)
 
 }
 
-func (a *App) configureUserRouter(router *mux.Router, platform string) {
+func (a *App) configureUserRouter(router *mux.Router) {
 
-	userHandler := handlers.NewUserHandler(platform, a.userCache, a.folderCache, a.discussionCache)
+	userHandler := handlers.NewUserHandler(a.config, a.userCache, a.folderCache, a.discussionCache)
 
 	userRouter := router.PathPrefix("/user").Subrouter().StrictSlash(false)
 	userRouter.HandleFunc("", userHandler.GetUser).Methods(http.MethodGet, http.MethodOptions)
@@ -194,6 +307,8 @@ func (a *App) configureUserRouter(router *mux.Router, platform string) {
 	userRouter.HandleFunc("/bio", userHandler.UpdateBio).Methods(http.MethodPut, http.MethodOptions)
 	userRouter.HandleFunc("/password", userHandler.UpdatePassword).Methods(http.MethodPut, http.MethodOptions)
 	userRouter.HandleFunc("/viewtype", userHandler.UpdateViewType).Methods(http.MethodPut, http.MethodOptions)
+	userRouter.HandleFunc("/search/history", userHandler.GetSearchHistory).Methods(http.MethodGet, http.MethodOptions)
+	userRouter.HandleFunc("/search/history", userHandler.ClearSearchHistory).Methods(http.MethodDelete, http.MethodOptions)
 	userRouter.HandleFunc("/forgotpassword", userHandler.ForgotPassword).Methods(http.MethodPost, http.MethodOptions)
 	userRouter.HandleFunc("/password/validatekey", userHandler.ValidatePasswordResetKey).Methods(http.MethodGet, http.MethodOptions)
 	userRouter.HandleFunc("/password/fromkey", userHandler.ResetPasswordFromKey).Methods(http.MethodPut, http.MethodOptions)
@@ -221,13 +336,32 @@ func (a *App) configureUserRouter(router *mux.Router, platform string) {
 
 func (a *App) configureAdminRouter(router *mux.Router) {
 
-	adminHandler := handlers.NewAdminHandler(a.userCache, a.folderCache, a.discussionCache, a.postProcessor)
+	adminHandler := handlers.NewAdminHandler(a.userCache, a.folderCache, a.discussionCache, a.postProcessor, a.indexJobRunner, a.eventBus, a.bannedWordList, a.scanJobRunner, a.moderationPolicy)
 
 	adminRouter := router.PathPrefix("/admin").Subrouter().StrictSlash(false)
 
+	adminRouter.HandleFunc("/folder", adminHandler.GetFolders).Methods(http.MethodGet, http.MethodOptions)
+	adminRouter.HandleFunc("/folder", adminHandler.CreateFolder).Methods(http.MethodPost, http.MethodOptions)
+	adminRouter.HandleFunc("/folder/order", adminHandler.ReorderFolders).Methods(http.MethodPut, http.MethodOptions)
+	adminRouter.HandleFunc("/folder/{folderId}", adminHandler.UpdateFolder).Methods(http.MethodPut, http.MethodOptions)
+
+	adminRouter.HandleFunc("/bannedwords", adminHandler.GetBannedWords).Methods(http.MethodGet, http.MethodOptions)
+	adminRouter.HandleFunc("/bannedwords", adminHandler.CreateBannedWord).Methods(http.MethodPost, http.MethodOptions)
+	adminRouter.HandleFunc("/bannedwords/test", adminHandler.TestBannedWord).Methods(http.MethodPost, http.MethodOptions)
+	adminRouter.HandleFunc("/bannedwords/{wordId}", adminHandler.UpdateBannedWord).Methods(http.MethodPut, http.MethodOptions)
+	adminRouter.HandleFunc("/bannedwords/{wordId}", adminHandler.DeleteBannedWord).Methods(http.MethodDelete, http.MethodOptions)
+
+	adminRouter.HandleFunc("/contentscan", adminHandler.GetContentScanJobs).Methods(http.MethodGet, http.MethodOptions)
+	adminRouter.HandleFunc("/contentscan", adminHandler.CreateContentScanJob).Methods(http.MethodPost, http.MethodOptions)
+	adminRouter.HandleFunc("/contentscan/{jobId}", adminHandler.GetContentScanJob).Methods(http.MethodGet, http.MethodOptions)
+
 	adminRouter.HandleFunc("/user/search", adminHandler.SearchUsers).Methods(http.MethodGet, http.MethodOptions)
 	adminRouter.HandleFunc("/user/{userId}/status", adminHandler.SetUserStatus).Methods(http.MethodPut, http.MethodOptions)
 	adminRouter.HandleFunc("/user/{userId}/history", adminHandler.GetUserHistory).Methods(http.MethodGet, http.MethodOptions)
+	adminRouter.HandleFunc("/user/{userId}/notes", adminHandler.GetModNotes).Methods(http.MethodGet, http.MethodOptions)
+	adminRouter.HandleFunc("/user/{userId}/notes", adminHandler.CreateModNote).Methods(http.MethodPost, http.MethodOptions)
+	adminRouter.HandleFunc("/user/{userId}/notes/{noteId}", adminHandler.UpdateModNote).Methods(http.MethodPut, http.MethodOptions)
+	adminRouter.HandleFunc("/user/{userId}/notes/{noteId}", adminHandler.DeleteModNote).Methods(http.MethodDelete, http.MethodOptions)
 
 	adminRouter.HandleFunc("/users/discussion/block", adminHandler.GetUserDiscussionBlocks).Methods(http.MethodGet, http.MethodOptions)
 
@@ -252,23 +386,109 @@ func (a *App) configureAdminRouter(router *mux.Router) {
 	adminRouter.HandleFunc("/discussion/{discussionId}/user/block", adminHandler.GetBlockedUsers).Methods(http.MethodGet, http.MethodOptions)
 	adminRouter.HandleFunc("/discussion/{discussionId}", adminHandler.EraseDiscussion).Methods(http.MethodDelete, http.MethodOptions)
 
+	adminRouter.HandleFunc("/outbox/deadletter", adminHandler.GetDeadLetteredOutboxEntries).Methods(http.MethodGet, http.MethodOptions)
+	adminRouter.HandleFunc("/outbox/{entryId}/replay", adminHandler.ReplayOutboxEntry).Methods(http.MethodPost, http.MethodOptions)
+
+	adminRouter.HandleFunc("/search/jobs", adminHandler.GetSearchIndexJobs).Methods(http.MethodGet, http.MethodOptions)
+	adminRouter.HandleFunc("/search/jobs/{jobId}/retry", adminHandler.RetrySearchIndexJob).Methods(http.MethodPost, http.MethodOptions)
+	adminRouter.HandleFunc("/search/analytics", adminHandler.GetSearchAnalytics).Methods(http.MethodGet, http.MethodOptions)
+
+}
+
+func (a *App) workers() []businesslogic.Worker {
+	return []businesslogic.Worker{a.folderCache, a.discussionCache, a.eventBus, a.postProcessor, a.indexJobRunner, a.scanJobRunner, a.mostActiveWorker, a.folderActivityWorker, a.bannedWordList}
 }
 
-func (a *App) Serve() {
+// Serve runs the background workers and the HTTP server until ctx is
+// cancelled, then shuts everything down within the configured timeout. The
+// workers get their own context so that they keep running while Shutdown
+// drains the requests which may still be using them.
+func (a *App) Serve(ctx context.Context) error {
 
-	a.postProcessor.Run()
+	workerCtx, cancelWorkers := context.WithCancel(context.Background())
+	defer cancelWorkers()
 
-	log.Info("Serving requests...")
-	if err := http.ListenAndServe(":8080", a.router); err != nil { // gorillahandlers.CombinedLoggingHandler
-		log.Errorf("%v", err)
-		log.Error("HTTP Server terminated")
+	for _, worker := range a.workers() {
+		if err := worker.Start(workerCtx); err != nil {
+			return err
+		}
 	}
 
+	a.server = &http.Server{
+		Addr:    a.config.Server.ListenAddress,
+		Handler: a.router,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Infof("Serving requests on %s...", a.config.Server.ListenAddress)
+		serverErr <- a.server.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-serverErr:
+		log.Errorf("HTTP Server terminated: %v", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancelFn := context.WithTimeout(context.Background(), a.config.Server.ShutdownTimeout)
+	defer cancelFn()
+
+	if shutdownErr := a.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+		err = shutdownErr
+	}
+
+	return err
+
 }
 
-func (a *App) Shutdown() {
-	a.postProcessor.Close()
-	a.mostActiveWorker.Close()
+// Shutdown stops accepting requests, waits for in flight requests to finish,
+// closes the websockets and then drains the workers. The order matters as
+// handlers may still be publishing posts until the HTTP server has stopped.
+func (a *App) Shutdown(ctx context.Context) error {
+
+	log.Info("Shutting down...")
+
+	var errs []error
+
+	if a.server != nil {
+		if err := a.server.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("stopping http server: %w", err))
+		}
+	}
+
+	if a.websocketHandler != nil {
+		if err := a.websocketHandler.Stop(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, worker := range a.workers() {
+		if err := worker.Stop(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// the embedded engine holds its index file open, so it is closed once
+	// the workers have stopped writing to it
+	if closer, ok := a.searchEngine.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing search engine: %w", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Error(err)
+		}
+		return errors.New("shutdown did not complete cleanly")
+	}
+
+	log.Info("...shutdown complete")
+
+	return nil
+
 }
 
 func (a *App) ExecuteTestRequest(req *http.Request) *httptest.ResponseRecorder {
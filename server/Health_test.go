@@ -22,7 +22,7 @@ import (
 
 func TestHealthCheck(t *testing.T) {
 
-	app := NewApp()
+	app := NewTestApp(t)
 
 	req, _ := http.NewRequest("GET", "/health", nil)
 	response := app.ExecuteTestRequest(req)
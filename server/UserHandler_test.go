@@ -25,7 +25,7 @@ import (
 
 func TestUserEndpointsNeedAuthentication(t *testing.T) {
 
-	testApp := NewApp()
+	testApp := NewTestApp(t)
 
 	endpoints := []MethodCall{
 		{"POST", "/user/logout"},
@@ -59,7 +59,7 @@ func TestUserEndpointsNeedAuthentication(t *testing.T) {
 
 func TestLoginSucceeds(t *testing.T) {
 
-	testApp := NewApp()
+	testApp := NewTestApp(t)
 
 	accessToken, _ := GetAccessAndRefreshToken(t, testApp)
 	ValidateAccessToken(t, accessToken)
@@ -68,7 +68,7 @@ func TestLoginSucceeds(t *testing.T) {
 
 func TestInvalidLoginFails(t *testing.T) {
 
-	testApp := NewApp()
+	testApp := NewTestApp(t)
 
 	var payload = []byte(`{"username":"testuser1", "password": "xxxxxxxx"}`)
 
@@ -80,12 +80,13 @@ func TestInvalidLoginFails(t *testing.T) {
 }
 
 func TestLockedLoginFails(t *testing.T) {
+	requireDatabase(t)
 	t.Fail()
 }
 
 func TestLogout(t *testing.T) {
 
-	testApp := NewApp()
+	testApp := NewTestApp(t)
 
 	accessToken, _ := GetAccessAndRefreshToken(t, testApp)
 
@@ -111,7 +112,7 @@ func TestLogout(t *testing.T) {
 
 func TestRefreshToken(t *testing.T) {
 
-	testApp := NewApp()
+	testApp := NewTestApp(t)
 
 	_, refreshToken := GetAccessAndRefreshToken(t, testApp)
 
@@ -133,7 +134,7 @@ func TestRefreshToken(t *testing.T) {
 
 func TestGetUser(t *testing.T) {
 
-	testApp := NewApp()
+	testApp := NewTestApp(t)
 
 	accessToken, _ := GetAccessAndRefreshToken(t, testApp)
 
@@ -0,0 +1,81 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"justthetalk/config"
+	"justthetalk/connections"
+	"os"
+	"testing"
+	"time"
+)
+
+const testSigningKey = "server-tests-only-signing-key-0123456789"
+
+var testConfig *config.Config
+
+// testConnected is set when the MySQL and Redis servers are available
+var testConnected bool
+
+// TestMain connects to the servers named in the environment. Without them
+// the tests which need them are skipped.
+func TestMain(m *testing.M) {
+
+	fmt.Println("Starting tests...")
+
+	testConfig = config.Default()
+	if err := testConfig.ApplyEnvironment(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if len(testConfig.Auth.SigningKey) == 0 {
+		testConfig.Auth.SigningKey = testSigningKey
+	}
+
+	if err := openTestConnections(); err != nil {
+		fmt.Printf("Skipping the database tests: %v\n", err)
+	} else {
+		testConnected = true
+	}
+
+	os.Exit(m.Run())
+
+}
+
+func openTestConnections() error {
+
+	if err := connections.OpenConnections(testConfig); err != nil {
+		return err
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+
+	return connections.RedisConnection().Ping(ctx).Err()
+
+}
+
+// requireDatabase skips a test which needs the servers when they aren't
+// available
+func requireDatabase(t *testing.T) {
+	t.Helper()
+	if !testConnected {
+		t.Skip("needs the MySQL and Redis servers")
+	}
+}
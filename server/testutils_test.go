@@ -23,7 +23,6 @@ import (
 	"testing"
 
 	"justthetalk/model"
-	"justthetalk/utils"
 
 	"github.com/dgrijalva/jwt-go"
 )
@@ -33,6 +32,20 @@ type MethodCall struct {
 	u string
 }
 
+func NewTestApp(t *testing.T) *App {
+
+	requireDatabase(t)
+
+	testApp, err := NewApp(testConfig)
+	if err != nil {
+		t.Logf("Creating app: %v", err)
+		t.FailNow()
+	}
+
+	return testApp
+
+}
+
 func DoValidLogin(t *testing.T, testApp *App) *httptest.ResponseRecorder {
 
 	var payload = []byte(`{"username":"testuser1", "password": "1234567890"}`)
@@ -101,7 +114,7 @@ func GetAccessAndRefreshToken(t *testing.T, testApp *App) (string, string) {
 func ValidateAccessToken(t *testing.T, accessToken string) {
 
 	token, err := jwt.ParseWithClaims(accessToken, &model.UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(utils.SigningKey), nil
+		return []byte(testConfig.Auth.SigningKey.Value()), nil
 	})
 
 	if err != nil {
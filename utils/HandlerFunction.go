@@ -19,50 +19,48 @@ import (
 	"encoding/json"
 	"errors"
 	"justthetalk/model"
+	"justthetalk/repository"
 	"net"
 	"net/http"
 
-	"runtime/debug"
-
 	log "github.com/sirupsen/logrus"
-	"gorm.io/gorm"
 )
 
-type HandlerFunctionTarget func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (statusCode int, responseData interface{}, message string)
-type AuthenticatedHandlerFunctionTarget func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (statusCode int, responseData interface{}, message string)
-type AnonymousHandlerFunctionTarget func(res http.ResponseWriter, req *http.Request, db *gorm.DB) (statusCode int, responseData interface{}, message string)
+type HandlerFunctionTarget func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (statusCode int, responseData interface{}, message string, err error)
+type AuthenticatedHandlerFunctionTarget func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (statusCode int, responseData interface{}, message string, err error)
+type AnonymousHandlerFunctionTarget func(res http.ResponseWriter, req *http.Request, repo repository.Repository) (statusCode int, responseData interface{}, message string, err error)
 
 func AdminOnlyHandlerFunction(res http.ResponseWriter, req *http.Request, targetFunc AuthenticatedHandlerFunctionTarget) {
-	HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		if user == nil {
-			panic(ErrUnauthorised)
+			return 0, nil, "", ErrUnauthorised
 		}
 
 		if !user.IsAdmin {
-			panic(ErrForbidden)
+			return 0, nil, "", ErrForbidden
 		}
 
-		return targetFunc(res, req, user, db)
+		return targetFunc(res, req, user, repo)
 
 	})
 }
 
 func AuthenticatedHandlerFunction(res http.ResponseWriter, req *http.Request, targetFunc AuthenticatedHandlerFunctionTarget) {
-	HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
+	HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
 
 		if user == nil {
-			panic(ErrUnauthorised)
+			return 0, nil, "", ErrUnauthorised
 		}
 
-		return targetFunc(res, req, user, db)
+		return targetFunc(res, req, user, repo)
 
 	})
 }
 
 func AnonymousHandlerFunction(res http.ResponseWriter, req *http.Request, targetFunc AnonymousHandlerFunctionTarget) {
-	HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, db *gorm.DB) (int, interface{}, string) {
-		return targetFunc(res, req, db)
+	HandlerFunction(res, req, func(res http.ResponseWriter, req *http.Request, user *model.User, repo repository.Repository) (int, interface{}, string, error) {
+		return targetFunc(res, req, repo)
 	})
 }
 
@@ -83,48 +81,23 @@ func HandlerFunction(res http.ResponseWriter, req *http.Request, targetFunc Hand
 
 	defer func() {
 		if r := recover(); r != nil {
-			err := r.(error)
-
-			var statusCode int
-
-			switch {
-			case errors.Is(err, ErrBadRequest):
-				statusCode = http.StatusBadRequest
-			case errors.Is(err, ErrUnauthorised):
-				statusCode = http.StatusUnauthorized
-			case errors.Is(err, ErrForbidden):
-				statusCode = http.StatusForbidden
-			case errors.Is(err, ErrInternalError):
-				log.Error(err)
-				debug.PrintStack()
-				statusCode = http.StatusInternalServerError
-			case errors.Is(err, ErrNoContent):
-				statusCode = http.StatusNoContent
-			case errors.Is(err, ErrNotModified):
-				statusCode = http.StatusNotModified
-			default:
-				log.Error(err)
-				debug.PrintStack()
-				statusCode = http.StatusInternalServerError
-			}
-
-			SendRespsonse(statusCode, nil, err.Error(), res)
-
+			SendProblem(ErrorFromPanic(r), req, res)
 		}
 	}()
 
-	var db *gorm.DB
-	var user *model.User
-	var ok bool
-
-	db, ok = req.Context().Value(ContextDbKey).(*gorm.DB)
+	repo, ok := req.Context().Value(ContextRepositoryKey).(repository.Repository)
 	if !ok {
-		panic(ErrInternalError)
+		SendProblem(InternalError(errors.New("no repository in request context")), req, res)
+		return
 	}
 
-	user, _ = req.Context().Value(ContextUserKey).(*model.User)
+	user, _ := req.Context().Value(ContextUserKey).(*model.User)
 
-	statusCode, responseData, message := targetFunc(res, req, user, db)
+	statusCode, responseData, message, err := targetFunc(res, req, user, repo)
+	if err != nil {
+		SendProblem(err, req, res)
+		return
+	}
 
 	res.Header().Set(HeaderCacheControl, "no-store")
 	res.Header().Set(HeaderConnection, "Keep-Alive")
@@ -151,14 +124,16 @@ func SendRespsonse(statusCode int, responseData interface{}, message string, res
 		result["message"] = message
 	}
 
-	if data, err := json.Marshal(result); err == nil {
-		res.WriteHeader(statusCode)
-		_, err := res.Write([]byte(data))
-		if err != nil {
-			PanicWithWrapper(err, ErrInternalError)
-		}
-	} else {
-		PanicWithWrapper(err, ErrInternalError)
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Errorf("marshalling response: %v", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res.WriteHeader(statusCode)
+	if _, err := res.Write(data); err != nil {
+		log.Errorf("writing response: %v", err)
 	}
 
 }
@@ -15,11 +15,7 @@
 
 package utils
 
-const PlatformEnvVar = "PLATFORM"
-const Production = "PRODUCTION"
-const Development = "DEVELOPMENT"
-
-const ContextDbKey = "DB"
+const ContextRepositoryKey = "Repository"
 const ContextUserKey = "User"
 const ContextRedisKey = "Redis"
 
@@ -41,8 +37,7 @@ const HeaderKeepAlive = "Keep-Alive"
 const Bearer = "Bearer"
 
 const ContentTypeJson = "application/json; charset=utf-8"
-
-const SigningKey = "xDHk3yWp@$Q8b5x!aPj7=6ekkcwcF#PxgFWENE@X!Vb*XU%_EYgS*ZE@UsnApj*b"
+const ContentTypeProblemJson = "application/problem+json"
 
 func Abs(val int) int {
 	if val >= 0 {
@@ -18,6 +18,7 @@ package utils
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 var (
@@ -29,8 +30,142 @@ var (
 	ErrNoContent     = errors.New("No content")
 	ErrNotModified   = errors.New("Not modified")
 	ErrExpired       = errors.New("Expired")
+	ErrUnavailable   = errors.New("Unavailable")
 )
 
-func PanicWithWrapper(outer error, wrapped error) {
-	panic(fmt.Errorf("%v: %w", outer, wrapped))
+// Stable error codes returned in the "code" member of problem responses.
+// Clients switch on these, so existing values must never change.
+const (
+	ErrorCodeBadRequest    = "bad_request"
+	ErrorCodeUnauthorised  = "unauthorised"
+	ErrorCodeForbidden     = "forbidden"
+	ErrorCodeInternalError = "internal_error"
+	ErrorCodeNotFound      = "not_found"
+	ErrorCodeNoContent     = "no_content"
+	ErrorCodeNotModified   = "not_modified"
+	ErrorCodeExpired       = "expired"
+	ErrorCodeUnavailable   = "unavailable"
+
+	ErrorCodeValidationFailed       = "validation_failed"
+	ErrorCodeInvalidParameter       = "invalid_parameter"
+	ErrorCodeInvalidCredentials     = "invalid_credentials"
+	ErrorCodeAccountDeleted         = "account_deleted"
+	ErrorCodeAccountLocked          = "account_locked"
+	ErrorCodeAccountExists          = "account_exists"
+	ErrorCodeInvalidToken           = "invalid_token"
+	ErrorCodeInvalidKey             = "invalid_key"
+	ErrorCodeKeyExpired             = "key_expired"
+	ErrorCodeFolderForbidden        = "folder_forbidden"
+	ErrorCodeDiscussionNotFound     = "discussion_not_found"
+	ErrorCodeDiscussionLocked       = "discussion_locked"
+	ErrorCodeDiscussionBlocked      = "discussion_blocked"
+	ErrorCodePostNotFound           = "post_not_found"
+	ErrorCodeUserNotFound           = "user_not_found"
+	ErrorCodeUnknownView            = "unknown_view"
+	ErrorCodeUnknownFilter          = "unknown_filter"
+	ErrorCodeSearchFailed           = "search_failed"
+	ErrorCodeSearchUnavailable      = "search_unavailable"
+	ErrorCodeInvalidSearchQuery     = "invalid_search_query"
+	ErrorCodeRecaptchaFailed        = "recaptcha_failed"
+	ErrorCodeOutboxEntryNotFound    = "outbox_entry_not_found"
+	ErrorCodeSearchIndexJobNotFound = "search_index_job_not_found"
+	ErrorCodeSavedSearchNotFound    = "saved_search_not_found"
+	ErrorCodeTooManySavedSearches   = "too_many_saved_searches"
+	ErrorCodeSimilarDiscussion      = "similar_discussion"
+	ErrorCodeFolderArchived         = "folder_archived"
+	ErrorCodeFolderKeyExists        = "folder_key_exists"
+	ErrorCodeBannedWordNotFound     = "banned_word_not_found"
+	ErrorCodeBannedWord             = "banned_word"
+	ErrorCodeContentScanJobNotFound = "content_scan_job_not_found"
+	ErrorCodeModNoteNotFound        = "mod_note_not_found"
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error is the typed error returned by the business layer. Kind is one of
+// the sentinel errors above and decides the HTTP status, Code is the stable
+// machine readable code and Err is the underlying cause, if any.
+type Error struct {
+	Kind    error
+	Code    string
+	Message string
+	Fields  []FieldError
+	Err     error
+}
+
+func NewError(kind error, code string, message string) *Error {
+	return &Error{
+		Kind:    kind,
+		Code:    code,
+		Message: message,
+	}
+}
+
+func WrapError(kind error, code string, err error) *Error {
+	return &Error{
+		Kind: kind,
+		Code: code,
+		Err:  err,
+	}
+}
+
+func InternalError(err error) *Error {
+	return WrapError(ErrInternalError, ErrorCodeInternalError, err)
+}
+
+func NewValidationError(fields ...FieldError) *Error {
+	return &Error{
+		Kind:    ErrBadRequest,
+		Code:    ErrorCodeValidationFailed,
+		Message: "One or more fields are invalid",
+		Fields:  fields,
+	}
+}
+
+func (e *Error) WithField(field string, message string) *Error {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: message})
+	return e
+}
+
+func (e *Error) Error() string {
+
+	var parts []string
+
+	if len(e.Message) > 0 {
+		parts = append(parts, e.Message)
+	} else if e.Kind != nil {
+		parts = append(parts, e.Kind.Error())
+	}
+
+	for _, field := range e.Fields {
+		parts = append(parts, fmt.Sprintf("%s: %s", field.Field, field.Message))
+	}
+
+	if e.Err != nil {
+		parts = append(parts, e.Err.Error())
+	}
+
+	return strings.Join(parts, ": ")
+
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// ErrorFromPanic converts a recovered value into an error. Anything that is
+// not already an error (strings, ints, nil maps...) is wrapped as an internal
+// error so that recover blocks never panic themselves.
+func ErrorFromPanic(r interface{}) error {
+	if err, ok := r.(error); ok {
+		return err
+	}
+	return InternalError(fmt.Errorf("panic: %v", r))
 }
@@ -16,40 +16,54 @@
 package utils
 
 import (
+	"encoding/json"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
-func ExtractPageSizeAndStart(req *http.Request) (int, int) {
+func invalidParameter(param string, message string) error {
+	return NewError(ErrBadRequest, ErrorCodeInvalidParameter, "Invalid request parameter").WithField(param, message)
+}
+
+func ExtractPageSizeAndStart(req *http.Request) (int, int, error) {
+
+	pageSize, err := ExtractQueryInt("size", req)
+	if err != nil {
+		return 0, 0, err
+	}
 
-	pageSize := ExtractQueryInt("size", req)
 	if pageSize == 0 {
 		pageSize = 50
 	}
 
-	pageStart := ExtractQueryInt("start", req)
+	pageStart, err := ExtractQueryInt("start", req)
+	if err != nil {
+		return 0, 0, err
+	}
 
-	return pageSize, pageStart
+	return pageSize, pageStart, nil
 
 }
 
-func ExtractQueryInt64(param string, req *http.Request) int64 {
-	return int64(ExtractQueryInt(param, req))
+func ExtractQueryInt64(param string, req *http.Request) (int64, error) {
+	value, err := ExtractQueryInt(param, req)
+	return int64(value), err
 }
 
-func ExtractQueryInt(param string, req *http.Request) int {
+func ExtractQueryInt(param string, req *http.Request) (int, error) {
 	value := 0
 	paramValue := req.URL.Query().Get(param)
 	if len(paramValue) > 0 {
 		if i, err := strconv.Atoi(paramValue); err != nil {
-			PanicWithWrapper(err, ErrBadRequest)
+			return 0, invalidParameter(param, "must be an integer")
 		} else {
 			value = i
 		}
 	}
-	return value
+	return value, nil
 }
 
 func ExtractQueryString(param string, req *http.Request) string {
@@ -61,33 +75,54 @@ func ExtractQueryString(param string, req *http.Request) string {
 	return value
 }
 
-func ExtractVarString(param string, req *http.Request) string {
+func ExtractQueryTime(param string, req *http.Request, defaultValue time.Time) (time.Time, error) {
 
-	value := ""
-	vars := mux.Vars(req)
+	paramValue := req.URL.Query().Get(param)
+	if len(paramValue) == 0 {
+		return defaultValue, nil
+	}
+
+	value, err := time.Parse(time.RFC3339, paramValue)
+	if err != nil {
+		return defaultValue, invalidParameter(param, "must be an RFC3339 date")
+	}
 
-	if param, exists := vars[param]; exists {
-		value = param
+	return value, nil
 
-	} else {
-		panic(ErrBadRequest)
+}
+
+func DecodeRequestBody(req *http.Request, target interface{}) error {
+	if err := json.NewDecoder(req.Body).Decode(target); err != nil {
+		return WrapError(ErrBadRequest, ErrorCodeBadRequest, err)
 	}
+	return nil
+}
 
-	return value
+func ExtractVarString(param string, req *http.Request) (string, error) {
+
+	vars := mux.Vars(req)
+
+	value, exists := vars[param]
+	if !exists {
+		return "", invalidParameter(param, "is required")
+	}
+
+	return value, nil
 
 }
 
-func ExtractVarInt(param string, req *http.Request) uint {
+func ExtractVarInt(param string, req *http.Request) (uint, error) {
 
-	value := 0
+	paramValue, err := ExtractVarString(param, req)
+	if err != nil {
+		return 0, err
+	}
 
-	paramValue := ExtractVarString(param, req)
-	if i, err := strconv.Atoi(paramValue); err == nil {
-		value = i
-	} else {
-		PanicWithWrapper(err, ErrBadRequest)
+	value, err := strconv.Atoi(paramValue)
+	if err != nil || value < 0 {
+		return 0, invalidParameter(param, "must be a positive integer")
 	}
 
-	return uint(value)
+	return uint(value), nil
 
 }
@@ -0,0 +1,132 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime/debug"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const problemTypePrefix = "urn:justthetalk:problem:"
+
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Code     string       `json:"code"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+type problemKind struct {
+	kind       error
+	statusCode int
+	code       string
+}
+
+var problemKinds = []problemKind{
+	{ErrBadRequest, http.StatusBadRequest, ErrorCodeBadRequest},
+	{ErrUnauthorised, http.StatusUnauthorized, ErrorCodeUnauthorised},
+	{ErrForbidden, http.StatusForbidden, ErrorCodeForbidden},
+	{ErrNotFound, http.StatusNotFound, ErrorCodeNotFound},
+	{ErrExpired, http.StatusGone, ErrorCodeExpired},
+	{ErrUnavailable, http.StatusServiceUnavailable, ErrorCodeUnavailable},
+	{ErrNoContent, http.StatusNoContent, ErrorCodeNoContent},
+	{ErrNotModified, http.StatusNotModified, ErrorCodeNotModified},
+	{ErrInternalError, http.StatusInternalServerError, ErrorCodeInternalError},
+}
+
+func NewProblem(err error, req *http.Request) *Problem {
+
+	statusCode := http.StatusInternalServerError
+	code := ErrorCodeInternalError
+
+	// the outermost typed error decides the kind so that, for example, an
+	// internal error wrapping a not found is still reported as a 500
+	kindErr := err
+	var typedErr *Error
+	if errors.As(err, &typedErr) && typedErr.Kind != nil {
+		kindErr = typedErr.Kind
+	}
+
+	for _, k := range problemKinds {
+		if errors.Is(kindErr, k.kind) {
+			statusCode = k.statusCode
+			code = k.code
+			break
+		}
+	}
+
+	problem := &Problem{
+		Status: statusCode,
+		Title:  http.StatusText(statusCode),
+	}
+
+	if typedErr != nil {
+		if len(typedErr.Code) > 0 {
+			code = typedErr.Code
+		}
+		problem.Detail = typedErr.Message
+		problem.Errors = typedErr.Fields
+		if len(problem.Detail) == 0 && typedErr.Err != nil && statusCode < http.StatusInternalServerError {
+			problem.Detail = typedErr.Err.Error()
+		}
+	}
+
+	problem.Code = code
+	problem.Type = problemTypePrefix + code
+
+	if req != nil {
+		problem.Instance = req.URL.Path
+	}
+
+	return problem
+
+}
+
+func SendProblem(err error, req *http.Request, res http.ResponseWriter) {
+
+	problem := NewProblem(err, req)
+
+	if problem.Status >= http.StatusInternalServerError {
+		log.Error(err)
+		debug.PrintStack()
+	}
+
+	if problem.Status == http.StatusNoContent || problem.Status == http.StatusNotModified {
+		res.WriteHeader(problem.Status)
+		return
+	}
+
+	data, marshalErr := json.Marshal(problem)
+	if marshalErr != nil {
+		log.Errorf("marshalling problem: %v", marshalErr)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set(HeaderContentType, ContentTypeProblemJson)
+	res.WriteHeader(problem.Status)
+	if _, writeErr := res.Write(data); writeErr != nil {
+		log.Errorf("writing problem: %v", writeErr)
+	}
+
+}
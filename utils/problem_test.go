@@ -0,0 +1,97 @@
+// This file is part of the JUSTtheTalkAPI distribution (https://github.com/jdudmesh/justthetalk-api).
+// Copyright (c) 2021 John Dudmesh.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewProblemMapsErrorKinds(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"bad request", ErrBadRequest, http.StatusBadRequest, ErrorCodeBadRequest},
+		{"unauthorised", ErrUnauthorised, http.StatusUnauthorized, ErrorCodeUnauthorised},
+		{"forbidden", ErrForbidden, http.StatusForbidden, ErrorCodeForbidden},
+		{"not found", ErrNotFound, http.StatusNotFound, ErrorCodeNotFound},
+		{"expired", ErrExpired, http.StatusGone, ErrorCodeExpired},
+		{"unavailable", ErrUnavailable, http.StatusServiceUnavailable, ErrorCodeUnavailable},
+		{"internal", ErrInternalError, http.StatusInternalServerError, ErrorCodeInternalError},
+		{"untyped", errors.New("boom"), http.StatusInternalServerError, ErrorCodeInternalError},
+		{"domain code", NewError(ErrForbidden, ErrorCodeAccountLocked, "locked"), http.StatusForbidden, ErrorCodeAccountLocked},
+		{"wrapped domain error", InternalError(NewError(ErrNotFound, ErrorCodePostNotFound, "gone")), http.StatusInternalServerError, ErrorCodeInternalError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problem := NewProblem(tt.err, nil)
+			assert.Equal(t, tt.status, problem.Status)
+			assert.Equal(t, tt.code, problem.Code)
+			assert.Equal(t, "urn:justthetalk:problem:"+tt.code, problem.Type)
+		})
+	}
+
+}
+
+func TestNewProblemHidesInternalDetail(t *testing.T) {
+
+	problem := NewProblem(InternalError(errors.New("dial tcp: connection refused")), nil)
+
+	assert.Equal(t, http.StatusInternalServerError, problem.Status)
+	assert.Empty(t, problem.Detail)
+
+}
+
+func TestSendProblemWritesValidationErrors(t *testing.T) {
+
+	req := httptest.NewRequest(http.MethodPost, "/user", nil)
+	res := httptest.NewRecorder()
+
+	err := NewValidationError(FieldError{Field: "username", Message: "is required"})
+	SendProblem(err, req, res)
+
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Equal(t, ContentTypeProblemJson, res.Header().Get(HeaderContentType))
+
+	var problem Problem
+	if assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &problem)) {
+		assert.Equal(t, ErrorCodeValidationFailed, problem.Code)
+		assert.Equal(t, "/user", problem.Instance)
+		assert.Equal(t, []FieldError{{Field: "username", Message: "is required"}}, problem.Errors)
+	}
+
+}
+
+func TestErrorFromPanic(t *testing.T) {
+
+	err := ErrorFromPanic("not an error")
+	assert.True(t, errors.Is(err, ErrInternalError))
+	assert.Equal(t, http.StatusInternalServerError, NewProblem(err, nil).Status)
+
+	err = ErrorFromPanic(ErrNotFound)
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+}
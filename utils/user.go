@@ -20,7 +20,6 @@ import (
 	"errors"
 	"justthetalk/model"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -38,39 +37,34 @@ type siteVerifyResponse struct {
 	ErrorCodes  []string  `json:"error-codes"`
 }
 
-func CreateJWT(user *model.User, expiresAt time.Time, purpose string) string {
-	domain := "justthetalk.com"
-	if d, ok := os.LookupEnv("DOMAIN"); ok {
-		domain = d
-	}
+func CreateJWT(user *model.User, expiresAt time.Time, purpose string, issuer string, signingKey []byte) (string, error) {
 
 	claims := model.UserClaims{
 		UserId:  user.Id,
 		Purpose: purpose,
 		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: expiresAt.Unix(),
-			Issuer:    domain,
+			Issuer:    issuer,
 		},
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	if signedToken, err := token.SignedString([]byte(SigningKey)); err == nil {
-		return signedToken
-	} else {
-		panic(ErrInternalError)
+	signedToken, err := token.SignedString(signingKey)
+	if err != nil {
+		return "", InternalError(err)
 	}
 
+	return signedToken, nil
+
 }
 
-func ValidateRecaptchaResponse(recaptchaResponse string) error {
+func ValidateRecaptchaResponse(secret string, recaptchaResponse string) error {
 
 	req, err := http.NewRequest(http.MethodPost, RECAPTCHA_API_ENDPOINT, nil)
 	if err != nil {
 		return err
 	}
 
-	secret := os.Getenv("RECAPTCHA_API_KEY")
-
 	// Add necessary request parameters.
 	q := req.URL.Query()
 	q.Add("secret", secret)